@@ -0,0 +1,106 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/standalone"
+)
+
+// runStandalone collects and serves metrics without an API server (see --standalone),
+// with the Kubelet client and summary sources configured as they would be otherwise,
+// besides anything needing the API server.
+func (o MetricsServerOptions) runStandalone(stopCh <-chan struct{}, summaryDecoder summary.SummaryDecoder, skippedSubtrees *summary.SubtreeSkips, excludedContainers *summary.ContainerFilter) error {
+	nodes, err := standalone.LoadNodes(o.StandaloneNodesFile)
+	if err != nil {
+		return err
+	}
+
+	// there's no API server, so a kubeconfig (if any) only holds the Kubelet client's credentials
+	clientConfig := &rest.Config{}
+	if len(o.Kubeconfig) > 0 {
+		if clientConfig, err = o.loadClientConfig(); err != nil {
+			return err
+		}
+	}
+	kubeletConfig := summary.GetKubeletConfig(clientConfig, o.KubeletPort, o.InsecureKubeletTLS, o.DeprecatedCompletelyInsecureKubelet, false)
+	kubeletConfig.SummaryDecoder = summaryDecoder
+	kubeletConfig.StrictDecoding = o.KubeletStrictDecoding
+	if o.AcceleratorStats {
+		skippedSubtrees = skippedSubtrees.Retaining(summary.AcceleratorSubtrees)
+	}
+	if o.PodUsageTolerance > 0 || o.PodMemoryOverhead {
+		skippedSubtrees = skippedSubtrees.Retaining(summary.PodUsageSubtrees)
+	}
+	kubeletConfig.SkippedSubtrees = skippedSubtrees
+	kubeletConfig.CaptureHeaders = o.KubeletCapturedHeaders
+	kubeletConfig.MaxConcurrentRequestsPerNode = o.KubeletMaxRequestsPerNode
+	if err := o.applyKubeletTLS(kubeletConfig); err != nil {
+		return err
+	}
+	addrPriority := make([]corev1.NodeAddressType, len(o.KubeletPreferredAddressTypes))
+	for i, addrType := range o.KubeletPreferredAddressTypes {
+		addrPriority[i] = corev1.NodeAddressType(addrType)
+	}
+
+	// serve with the given certificate, or one from a local CA generated on first start
+	if err := o.SecureServing.MaybeDefaultWithSelfSignedCerts("localhost", nil, []net.IP{net.ParseIP("127.0.0.1")}); err != nil {
+		return err
+	}
+	srv, err := standalone.NewServer(standalone.Config{
+		Nodes:           nodes,
+		Kubelet:         kubeletConfig,
+		AddressResolver: summary.NewFallbackNodeAddressResolver(addrPriority, net.DefaultResolver.LookupHost),
+		SourceOptions: summary.SourceOptions{
+			MaxPodsPerNode:       o.MaxPodsPerNode,
+			NodeNameVerification: summary.NodeNameVerification(o.NodeNameVerification),
+			PageFaultRates:       o.PageFaultRates,
+			CPUThrottlingRates:   o.CPUThrottlingRates,
+			MaxRateGap:           time.Duration(o.PageFaultRateMaxGapCycles) * o.MetricResolution,
+			ExcludedContainers:   excludedContainers,
+			PodUsageTolerance:    o.PodUsageTolerance,
+			PodMemoryOverhead:    o.PodMemoryOverhead,
+			AcceleratorStats:     o.AcceleratorStats,
+			SwapStats:            o.SwapStats,
+		},
+		MetricResolution: o.MetricResolution,
+		BindAddress:      net.JoinHostPort(o.SecureServing.BindAddress.String(), strconv.Itoa(o.SecureServing.BindPort)),
+		CertFile:         o.SecureServing.ServerCert.CertKey.CertFile,
+		KeyFile:          o.SecureServing.ServerCert.CertKey.KeyFile,
+		ClientCAFile:     o.Authentication.ClientCert.ClientCA,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return srv.Run(ctx)
+}
@@ -15,27 +15,63 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/apiserver/pkg/server/healthz"
 	genericoptions "k8s.io/apiserver/pkg/server/options"
+	utilflag "k8s.io/apiserver/pkg/util/flag"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	v1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/metrics/pkg/apis/metrics"
 
 	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver"
 	genericmetrics "github.com/kubernetes-incubator/metrics-server/pkg/apiserver/generic"
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
+	"github.com/kubernetes-incubator/metrics-server/pkg/coverage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/debugauthz"
+	"github.com/kubernetes-incubator/metrics-server/pkg/events"
+	"github.com/kubernetes-incubator/metrics-server/pkg/gctuning"
+	"github.com/kubernetes-incubator/metrics-server/pkg/hpacoverage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/informersync"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	"github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	"github.com/kubernetes-incubator/metrics-server/pkg/nsusage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/partition"
+	"github.com/kubernetes-incubator/metrics-server/pkg/podcount"
+	"github.com/kubernetes-incubator/metrics-server/pkg/podcoverage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/preflight"
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
 	"github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/scrapeaudit"
+	"github.com/kubernetes-incubator/metrics-server/pkg/server"
+	metricsink "github.com/kubernetes-incubator/metrics-server/pkg/sink"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe"
+	"github.com/kubernetes-incubator/metrics-server/pkg/statussocket"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/nodemetrics"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/podmetrics"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+	"github.com/kubernetes-incubator/metrics-server/pkg/utilization"
 )
 
 // NewCommandStartMetricsServer provides a CLI handler for the metrics server entrypoint
@@ -55,13 +91,149 @@ func NewCommandStartMetricsServer(out, errOut io.Writer, stopCh <-chan struct{})
 
 	flags := cmd.Flags()
 	flags.DurationVar(&o.MetricResolution, "metric-resolution", o.MetricResolution, "The resolution at which metrics-server will retain metrics.")
+	flags.StringVar(&o.ReloadableConfigFile, "reloadable-config-file", o.ReloadableConfigFile, "A YAML or JSON file of scrape and storage parameters which are reloaded without restarting when it changes, taking effect together at the next collection cycle: metricResolution, scrapeTimeout (90% of the resolution unless given), and storageMemoryLimitBytes.  These override their flags, and changes which don't pass validation are rejected, keeping the previous values.")
+	flags.DurationVar(&o.MaxMetricResolution, "max-metric-resolution", o.MaxMetricResolution, "If set, temporarily stretch the metric resolution, up to this value, while collection cycles keep taking longer than it.  The window reported for metrics grows to match.")
+	flags.IntVar(&o.MetricResolutionOverrunCycles, "metric-resolution-overrun-cycles", o.MetricResolutionOverrunCycles, "The number of consecutive collection cycles which must overrun the metric resolution before it is stretched, or fit within it before it is reverted.  Only used with --max-metric-resolution.")
+	flags.StringVar(&o.ScrapeOrder, "scrape-order", o.ScrapeOrder, "How to stagger the start of each cycle's scrapes: \""+sources.ScrapeOrderCost+"\" starts the nodes whose scrapes are expected to take longest (from their recent scrapes) first, after those with pods in priority namespaces, so that they're the most likely to finish when a cycle overruns, and \""+sources.ScrapeOrderRandom+"\" starts each at a random point.")
+	flags.DurationVar(&o.ScrapePhaseMaxDrift, "scrape-phase-max-drift", o.ScrapePhaseMaxDrift, "With --scrape-order="+sources.ScrapeOrderCost+", the most a node's scrape may move within the staggering window from one cycle to the next, since that stretches or shrinks the window its rates are calculated over.  Zero means no limit.")
+	flags.Float64Var(&o.LivenessCycleMultiplier, "liveness-cycle-multiplier", o.LivenessCycleMultiplier, "The number of (effective) metric resolutions without a collection cycle starting after which the scrape-loop health check fails, so that a stuck metrics-server is restarted.  Zero disables this part of the check.")
+	flags.Float64Var(&o.LivenessCommitMultiplier, "liveness-commit-multiplier", o.LivenessCommitMultiplier, "The number of (effective) metric resolutions without a collection cycle storing its metrics after which the scrape-loop health check fails.  Cycles scraping no nodes, as in an empty cluster, still count.  Zero disables this part of the check.")
+	flags.DurationVar(&o.ResumeDetectionThreshold, "resume-detection-threshold", o.ResumeDetectionThreshold, "How far the wall clock must jump ahead of the monotonic clock between checks (every second) to be treated as the host resuming from suspend, which discards the baselines of derived rates, since they span the suspend, and collects metrics immediately.  Zero disables detecting resumes.")
+	flags.DurationVar(&o.KubeletHousekeepingInterval, "kubelet-housekeeping-interval", o.KubeletHousekeepingInterval, "The Kubelets' cAdvisor housekeeping interval (their --housekeeping-interval), at which container stats are refreshed.  Metric resolutions shorter than this are refused, unless --force-metric-resolution is set.")
+	flags.BoolVar(&o.ForceMetricResolution, "force-metric-resolution", o.ForceMetricResolution, "Allow metric resolutions (of at least 1s) shorter than --kubelet-housekeeping-interval, even though most scrapes will then return the same stats again.")
 
 	flags.BoolVar(&o.InsecureKubeletTLS, "kubelet-insecure-tls", o.InsecureKubeletTLS, "Do not verify CA of serving certificates presented by Kubelets.  For testing purposes only.")
+	flags.StringSliceVar(&o.InsecureKubeletTLSNodes, "kubelet-insecure-tls-nodes", o.InsecureKubeletTLSNodes, "Comma-separated list of the names of nodes whose Kubelets' serving certificates are not verified, while every other node's still are.  Only for Kubelets whose certificates can't be fixed.")
+	flags.StringVar(&o.InsecureKubeletTLSSelector, "kubelet-insecure-tls-node-selector", o.InsecureKubeletTLSSelector, "Label selector for additional nodes whose Kubelets' serving certificates are not verified, as with --kubelet-insecure-tls-nodes.")
+	flags.StringSliceVar(&o.KubeletNodeProfiles, "kubelet-node-profiles", o.KubeletNodeProfiles, "Comma-separated list of node=profile entries, selecting how the listed nodes' Kubelets are scraped: secure (directly, on --kubelet-port), read-only (directly over plain HTTP on --kubelet-read-only-port, without credentials, not expecting the fields gated behind authentication), or proxy (through the API server, with its own client config, none of the Kubelet TLS options applying).  Every other node is scraped with proxy if --use-apiserver-proxy is set, or secure.")
+	flags.BoolVar(&o.KubeletProfileAnnotations, "kubelet-profile-annotations", o.KubeletProfileAnnotations, "Select the profile of any node annotated with "+summary.KubeletProfileAnnotation+", in place of --kubelet-node-profiles.")
+	flags.IntVar(&o.KubeletReadOnlyPort, "kubelet-read-only-port", o.KubeletReadOnlyPort, "The port to use to connect to the Kubelets scraped with the read-only profile.")
 	flags.BoolVar(&o.DeprecatedCompletelyInsecureKubelet, "deprecated-kubelet-completely-insecure", o.DeprecatedCompletelyInsecureKubelet, "Do not use any encryption, authorization, or authentication when communicating with the Kubelet.")
+	flags.BoolVar(&o.KubeletInsecureMigration, "kubelet-insecure-migration", o.KubeletInsecureMigration, "Migrate off --deprecated-kubelet-completely-insecure: request each Kubelet over HTTPS first, with the usual credentials and certificate verification (or --kubelet-insecure-tls), only falling back to plain HTTP, without credentials, when that fails in a TLS-specific way.  The nodes still requiring plain HTTP are published in metrics_server_kubelet_nodes_requiring_http, and a message is logged once a collection cycle passes without any falling back.  Only used with --deprecated-kubelet-completely-insecure.")
 	flags.BoolVar(&o.UseAPIServerProxy, "use-apiserver-proxy", o.UseAPIServerProxy, "Use the API server proxy to connect to Kubelets.")
 	flags.IntVar(&o.KubeletPort, "kubelet-port", o.KubeletPort, "The port to use to connect to Kubelets.")
+	flags.BoolVar(&o.Standalone, "standalone", o.Standalone, "Run without an API server, for Kubelets running standalone (e.g. in the CI of node components): scrape the nodes listed in --standalone-nodes-file directly, and serve the metrics API over HTTPS on the secure port (with a self-signed certificate from a local CA, unless --tls-cert-file is given), without registering it with the aggregator.  Only clients with certificates signed by --client-ca-file may read metrics, which is required unless --standalone-allow-unauthenticated is set.  Options only used alongside an API server, or by parts that don't run standalone (e.g. --reloadable-config-file or --warm-start-file), are rejected.  Pods are served from the Kubelets' summaries, without labels, and nothing depending on the API server (informers, events, debug endpoints, and the proxy) runs.")
+	flags.StringVar(&o.StandaloneNodesFile, "standalone-nodes-file", o.StandaloneNodesFile, "A YAML or JSON file holding the NodeList to scrape with --standalone, each node with its name and Kubelet addresses.")
+	flags.BoolVar(&o.StandaloneAllowUnauthenticated, "standalone-allow-unauthenticated", o.StandaloneAllowUnauthenticated, "Let any client read metrics with --standalone, without --client-ca-file, e.g. when the secure port is only reachable from the node itself.")
 	flags.StringVar(&o.Kubeconfig, "kubeconfig", o.Kubeconfig, "The path to the kubeconfig used to connect to the Kubernetes API server and the Kubelets (defaults to in-cluster config)")
 	flags.StringSliceVar(&o.KubeletPreferredAddressTypes, "kubelet-preferred-address-types", o.KubeletPreferredAddressTypes, "The priority of node address types to use when determining which address to use to connect to a particular node")
+	flags.BoolVar(&o.KubeletAddressFallback, "kubelet-address-fallback", o.KubeletAddressFallback, "When connecting to a node's Kubelet fails, try each of its other addresses of the preferred types in turn, in order of preference, remembering the first that works (e.g. for nodes with separate management and data plane networks).  The candidate in use is shown in the scrape status.")
+	flags.DurationVar(&o.KubeletAddressFallbackTTL, "kubelet-address-fallback-ttl", o.KubeletAddressFallbackTTL, "With --kubelet-address-fallback, how long the address found working for a node is remembered before its preferred address is tried again.  It's forgotten sooner if the node's addresses change.")
+
+	flags.StringVar(&o.KubeletTLSMinVersion, "kubelet-tls-min-version", o.KubeletTLSMinVersion, "The minimum TLS version to accept when connecting to Kubelets (or the API server, with --use-apiserver-proxy).  Possible values: "+strings.Join(summary.TLSPossibleVersions(), ", ")+".  Defaults to Go's minimum.")
+	flags.StringSliceVar(&o.KubeletTLSCipherSuites, "kubelet-tls-cipher-suites", o.KubeletTLSCipherSuites, "Comma-separated list of the cipher suites to allow when connecting to Kubelets, below TLS 1.3 (whose suites aren't configurable).  Possible values: "+strings.Join(utilflag.TLSCipherPossibleValues(), ",")+".  Defaults to Go's cipher suites.")
+	flags.StringVar(&o.KubeletTLSSANPolicy, "kubelet-tls-san-policy", o.KubeletTLSSANPolicy, "The subject alternative names required of Kubelet serving certificates, checked (after verifying their chain against the CA) in place of verifying them against the address connected to: \""+string(summary.SANPolicyRequireIP)+"\" requires an IP SAN for the address, \""+string(summary.SANPolicyRequireName)+"\" a DNS SAN for the node's name, and \""+string(summary.SANPolicyEither)+"\" either.  Certificates failing the policy are reported as "+summary.ErrorClassSANPolicy+" errors, listing the SANs they have.  Defaults to verifying them against the address connected to.  Not used with --use-apiserver-proxy, --kubelet-insecure-tls, or --kubelet-spiffe-trust-domain.")
+
+	flags.StringVar(&o.KubeletSPIFFESocket, "kubelet-spiffe-workload-api-socket", o.KubeletSPIFFESocket, "If set, the path of the Unix socket serving the SPIFFE Workload API (e.g. of the SPIRE agent), from which to fetch the X.509 SVID presented to Kubelets as a client certificate, in place of any other.  The SVID is rotated automatically.  Not used with --use-apiserver-proxy.")
+	flags.StringVar(&o.KubeletSPIFFETrustDomain, "kubelet-spiffe-trust-domain", o.KubeletSPIFFETrustDomain, "If set, verify the serving certificates presented by Kubelets as X.509 SVIDs in this SPIFFE trust domain, against its bundle from the SPIFFE Workload API, in place of verifying them against a CA.  Only used with --kubelet-spiffe-workload-api-socket.")
+
+	flags.DurationVar(&o.KubeletHedgeDelay, "kubelet-hedge-delay", o.KubeletHedgeDelay, "If set, race a second, identical, summary request against any that hasn't completed within this delay (e.g. the p95 Kubelet latency), using whichever succeeds first.  Never used with --use-apiserver-proxy.")
+	flags.IntVar(&o.KubeletMaxHedgesPerCycle, "kubelet-max-hedges-per-cycle", o.KubeletMaxHedgesPerCycle, "The maximum number of hedged summary requests per collection cycle.  Only used with --kubelet-hedge-delay.")
+	flags.IntVar(&o.KubeletMaxRequestsPerNode, "kubelet-max-concurrent-requests-per-node", o.KubeletMaxRequestsPerNode, "The maximum number of requests to each Kubelet in flight at once, from collection cycles and on-demand scrapes alike, since some Kubelets handle concurrent requests poorly.  Requests over the limit wait for a free slot (or, with --kubelet-coalesce-requests, for an identical request in flight) until they time out, which is published in metrics_server_kubelet_summary_gate_wait_duration_seconds.  Hedged requests bypass the limit, and are never coalesced, so that they race the requests they hedge; --kubelet-max-hedges-per-cycle caps them instead.  Zero means no limit.")
+	flags.BoolVar(&o.KubeletCoalesceRequests, "kubelet-coalesce-requests", o.KubeletCoalesceRequests, "Let summary requests over --kubelet-max-concurrent-requests-per-node share the response to an identical request already in flight to the same Kubelet, rather than waiting to make their own.")
+
+	flags.Float64Var(&o.ProxyBreakerFailureRate, "apiserver-proxy-breaker-failure-rate", o.ProxyBreakerFailureRate, "If set, the fraction (e.g. 0.5) of requests through the API server proxy which must fail (time out, fail to connect, or be answered with 429 or 5xx by the API server) within --apiserver-proxy-breaker-window to open a circuit breaker, failing scrapes fast and serving the last-known metrics until the API server recovers.  Only used with --use-apiserver-proxy.")
+	flags.IntVar(&o.ProxyBreakerMinRequests, "apiserver-proxy-breaker-min-requests", o.ProxyBreakerMinRequests, "The number of requests that must be made within the window before the API server proxy circuit breaker can open.")
+	flags.DurationVar(&o.ProxyBreakerWindow, "apiserver-proxy-breaker-window", o.ProxyBreakerWindow, "The period over which the failure rate of requests through the API server proxy is calculated.")
+	flags.DurationVar(&o.ProxyBreakerCooldown, "apiserver-proxy-breaker-cooldown", o.ProxyBreakerCooldown, "How long the API server proxy circuit breaker stays open before letting probe requests through.")
+	flags.DurationVar(&o.APIServerHostRefreshInterval, "apiserver-proxy-host-refresh-interval", o.APIServerHostRefreshInterval, "How often the address of the API server proxied through is re-resolved from the client config (re-reading --kubeconfig, if set), so that scrapes follow it when it changes (e.g. a VIP failing over to a new name or port) without a restart, along with any rotated TLS config or credentials.  In-cluster, the address comes from environment variables, so only the service account's token and CA are picked up.  Changes are logged, and counted in metrics_server_kubelet_summary_apiserver_host_changes_total.  Zero only re-resolves it after failures.  Only used with --use-apiserver-proxy.")
+	flags.IntVar(&o.APIServerHostRefreshFailures, "apiserver-proxy-host-refresh-failures", o.APIServerHostRefreshFailures, "The number of consecutive requests through the API server proxy which must fail to get any response (e.g. failing to connect) to re-resolve the API server's address straight away.  Zero only re-resolves it periodically.  Only used with --use-apiserver-proxy.")
+	flags.IntVar(&o.ProxyBreakerProbes, "apiserver-proxy-breaker-probes", o.ProxyBreakerProbes, "The number of probe requests which must succeed to close the API server proxy circuit breaker again.")
+
+	flags.StringSliceVar(&o.KubeletCapturedHeaders, "kubelet-captured-headers", o.KubeletCapturedHeaders, "Custom Kubelet response headers to record in the scrape status and log when they change, in addition to the standard Warning header.")
+
+	flags.StringVar(&o.ScrapeAuditLogPath, "scrape-audit-log-path", o.ScrapeAuditLogPath, "If set, writes an audit log of every request made to the Kubelets (time, node, URL, status, bytes, duration, and error class) to this file, as JSON lines.  Records are written asynchronously, and dropped (counted in metrics_server_scrape_audit_records_dropped_total) rather than delaying scrapes if they can't be written fast enough.")
+	flags.Int64Var(&o.ScrapeAuditLogMaxSizeBytes, "scrape-audit-log-max-size-bytes", o.ScrapeAuditLogMaxSizeBytes, "The size beyond which the scrape audit log is rotated.  Zero means it's never rotated.")
+	flags.IntVar(&o.ScrapeAuditLogMaxBackups, "scrape-audit-log-max-backups", o.ScrapeAuditLogMaxBackups, "The number of rotated scrape audit logs kept, as --scrape-audit-log-path.1 (the most recent) and so on.  Zero discards the log when it's rotated.")
+	flags.IntVar(&o.ScrapeAuditLogQueueSize, "scrape-audit-log-queue-size", o.ScrapeAuditLogQueueSize, "The number of scrape audit records which may be waiting to be written, beyond which they're dropped.")
+	flags.StringVar(&o.ScrapeStatusSocket, "scrape-status-socket", o.ScrapeStatusSocket, "If set, sends the outcome of each node's scrape in every collection cycle (node, success, error class, and latency) to the Unix datagram socket at this path, as a JSON object per datagram, e.g. for node-problem-detector to set node conditions from.  Records are sent asynchronously, and dropped (counted in metrics_server_scrape_status_socket_records_dropped_total) rather than delaying scrapes if they can't be sent, including while the socket doesn't exist, which is retried every "+statussocket.DefaultReconnectInterval.String()+".")
+
+	flags.IntVar(&o.MaxPodsPerNode, "max-pods-per-node", o.MaxPodsPerNode, "The maximum number of pods processed from a single node's summary.  Pods beyond this are dropped, in namespace/name order.  Zero means no limit.")
+
+	flags.DurationVar(&o.NodeWarmupGracePeriod, "node-warmup-grace-period", o.NodeWarmupGracePeriod, "The period after a node's creation during which a Kubelet summary without node stats is reported as warming up, rather than as a scrape failure.  Zero disables this.")
+
+	flags.BoolVar(&o.KubeletStrictDecoding, "kubelet-strict-decoding", o.KubeletStrictDecoding, "Report the fields of Kubelet summaries unknown to metrics-server, by path, in the provenance of each scrape and in metrics_server_kubelet_summary_unknown_fields_total, warning about each once per cycle, rather than silently ignoring them.  Unknown fields never fail a scrape.  Meant for testing against new Kubelet versions, to surface schema drift; the fast decoder only checks the objects it scans.")
+	flags.StringVar(&o.KubeletSummaryDecoder, "kubelet-summary-decoder", o.KubeletSummaryDecoder, "How to decode Kubelet summaries: \"fast\" decodes only the fields metrics-server uses, skipping the rest, while \"full\" decodes them in full, as a fallback in case of problems with the fast decoder.")
+	flags.StringSliceVar(&o.KubeletSummarySkippedSubtrees, "kubelet-summary-skipped-subtrees", o.KubeletSummarySkippedSubtrees, "Subtrees of Kubelet summaries for the fast decoder to skip without decoding them, by their path of JSON keys, e.g. pods.volume, or pods.containers.rootfs for the root filesystem stats of every pod's containers.  Skipped bytes are counted in metrics_server_kubelet_summary_skipped_bytes_total.  One of: "+strings.Join(summary.SkippableSubtrees(), ", ")+".")
+	flags.StringVar(&o.NodeNameVerification, "node-name-verification", o.NodeNameVerification, "How to handle Kubelet summaries that report a different node name than the node scraped: \"enforce\" discards them, keeping the previous data, while \"warn\" only logs them, for clusters with nonstandard node naming.")
+
+	flags.StringSliceVar(&o.ExcludedContainers, "excluded-containers", o.ExcludedContainers, "Names of containers (such as service mesh sidecars) to exclude from pod-level aggregates, as exact names or globs like \"*-proxy\".  metrics.k8s.io has no pod-level usage, so clients summing a pod's containers will still include listed containers; use --excluded-container-mode=drop to remove them from pod totals entirely.")
+	flags.StringVar(&o.ExcludedContainerMode, "excluded-container-mode", o.ExcludedContainerMode, "What to do with containers matched by --excluded-containers: \"list\" keeps them listed in PodMetrics, so they can still be targeted by container metrics, and \"drop\" removes them entirely.")
+	flags.BoolVar(&o.NodeHealthSignals, "node-health-signals", o.NodeHealthSignals, "Publish health signals from each node's summary (PID limits and image filesystem space) as per-node Prometheus gauges.  This adds several series per node.")
+	flags.BoolVar(&o.PerNodeMetricsAge, "per-node-metrics-age", o.PerNodeMetricsAge, "Publish the time since each node was last scraped successfully as a per-node Prometheus gauge, rather than only for the least recently scraped node in each node pool.  This adds a series per node.")
+	flags.BoolVar(&o.PageFaultRates, "page-fault-rates", o.PageFaultRates, "Calculate the memory page fault and major page fault rates of containers, serving them as additional "+string(sink.ResourcePageFaults)+" and "+string(sink.ResourceMajorPageFaults)+" usage entries in PodMetrics, along with the window they were calculated over as "+string(sink.ResourcePageFaultWindow)+".")
+	flags.BoolVar(&o.CPUThrottlingRates, "cpu-throttling-rates", o.CPUThrottlingRates, "Also scrape the CFS throttling of containers from each Kubelet's cAdvisor metrics endpoint, serving the rate they were throttled at, in seconds per second, as an additional "+string(sink.ResourceCPUThrottled)+" usage entry in PodMetrics.  Failures of this scrape don't affect the other metrics.  Requires get on nodes/metrics, as well as nodes/stats.")
+	acceleratorMemory, acceleratorMemoryTotal, acceleratorDutyCycle := sink.AcceleratorResources("nvidia")
+	flags.BoolVar(&o.AcceleratorStats, "accelerator-stats", o.AcceleratorStats, "Pass through the usage of the accelerators (e.g. GPUs) that Kubelets report attached to containers, serving it as additional usage entries in PodMetrics for containers with accelerators, named for each accelerator make, e.g. "+string(acceleratorMemory)+" and "+string(acceleratorMemoryTotal)+" for the accelerator memory allocated and in total, in bytes, and "+string(acceleratorDutyCycle)+" for the percentage of time they were active.  This retains the "+strings.Join(summary.AcceleratorSubtrees, ", ")+" summary subtree, even if --kubelet-summary-skipped-subtrees lists it.")
+	flags.BoolVar(&o.SwapStats, "swap-stats", o.SwapStats, "Collect the swap usage that Kubelets with swap enabled report for nodes and containers, serving it as an additional "+string(sink.ResourceSwap)+" usage entry, in bytes, in NodeMetrics and PodMetrics.  Nodes and containers without swap stats have no such entry.")
+	flags.Float64Var(&o.CPURateConsistencyRatio, "cpu-rate-consistency-ratio", o.CPURateConsistencyRatio, "Check the CPU usage rates reported by Kubelets against the rates derived from their cumulative CPU usage in successive summaries, serving the derived rates whenever there are any, and warning about (and counting, in metrics_server_kubelet_summary_cpu_rate_inconsistencies) rates that differ by more than this ratio, e.g. 2.  Zero disables the check, serving the reported rates.  --page-fault-rate-max-gap-cycles applies to the derived rates too.")
+	flags.StringVar(&o.WarmStartFile, "warm-start-file", o.WarmStartFile, "Save the cumulative CPU usage last sampled from each container to this file, every --warm-start-save-interval and on shutdown, and restore it on startup as the baselines of the first scrapes, so that the rates derived by --cpu-rate-consistency-ratio (which it requires) are served from the first scrape after a restart.  Baselines of containers that started at a different time than when they were sampled, or sampled more than --warm-start-max-age before, are discarded, counted in metrics_server_kubelet_summary_warm_start_baselines_total.  This retains the "+strings.Join(summary.StartTimeSubtrees, ", ")+" summary subtrees, even if --kubelet-summary-skipped-subtrees lists them.  The file should be on a volume that outlives the pod, e.g. an emptyDir survives container restarts.")
+	flags.DurationVar(&o.WarmStartMaxAge, "warm-start-max-age", o.WarmStartMaxAge, "The longest before the first scrape of a container that its baseline restored by --warm-start-file may have been sampled.  The rates first derived from them are served with the whole window since, spanning the restart, which --page-fault-rate-max-gap-cycles doesn't apply to.  Zero allows any age.")
+	flags.DurationVar(&o.WarmStartSaveInterval, "warm-start-save-interval", o.WarmStartSaveInterval, "The interval at which --warm-start-file is saved, besides on shutdown.")
+	flags.BoolVar(&o.WarmStartScrapeCosts, "warm-start-scrape-costs", o.WarmStartScrapeCosts, "Also save the rolling estimates of how long each node takes to scrape, and how many pods it has, that --scrape-order="+sources.ScrapeOrderCost+" (which it requires) orders scrapes by, to --warm-start-file, restoring them on startup so that the first cycles after a restart are ordered as well as those before it.  Restored estimates are aged by the cycles missed while metrics-server was down, at the resolution when they were saved (as stretched by --max-metric-resolution), weighting the first scrape of each node more, and those of nodes that are gone are forgotten at the first cycle.  This doesn't require --cpu-rate-consistency-ratio.")
+	flags.DurationVar(&o.PodTimestampLagThreshold, "pod-timestamp-lag-threshold", o.PodTimestampLagThreshold, "How far the sample time of a pod in a Kubelet summary may lag the node's timestamp before the pod is called out, in a log line per node per cycle and in the node's scrape status.  Every pod's lag is recorded in metrics_server_kubelet_summary_pod_timestamp_lag_seconds regardless.  Zero disables calling pods out.")
+	flags.IntVar(&o.StaleSummaryWarningThreshold, "stale-summary-warning-threshold", o.StaleSummaryWarningThreshold, "The number of consecutive scrapes of a node returning the same summary as the scrape before (served from the Kubelet's cache, e.g. when its housekeeping interval is as long as the metric resolution) after which a warning is logged.  Stale summaries are counted per node in metrics_server_kubelet_summary_consecutive_stale_responses, noted in the node's scrape status, and the CPU usage and page fault rates derived from them are carried forward from the last fresh one, whatever the threshold.  Zero disables the warning.")
+	flags.Float64Var(&o.PodUsageTolerance, "pod-usage-tolerance", o.PodUsageTolerance, "Check the CPU and memory usage of each pod's containers against the pod-level usage Kubelets report, and scale down the container usage of pods whose containers add up to more than this fraction above it, e.g. 0.1 (as seen for hostNetwork pods on runtimes whose container cgroups include other processes), counting each correction in metrics_server_kubelet_summary_pod_usage_corrections_total and annotating their PodMetrics with "+podmetrics.UsageCorrectedAnnotation+".  Zero disables the check.  This retains the "+strings.Join(summary.PodUsageSubtrees, ", ")+" summary subtrees, even if --kubelet-summary-skipped-subtrees lists them.")
+	flags.BoolVar(&o.PodMemoryOverhead, "pod-memory-overhead", o.PodMemoryOverhead, "Annotate PodMetrics with "+podmetrics.MemoryOverheadAnnotation+": how far the pod-level memory usage Kubelets report exceeds the sum of the pod's containers' (the pod sandbox, and tmpfs volumes such as memory-backed emptyDirs), in bytes.  Pods whose containers report more than the pod are annotated with zero, and counted in metrics_server_kubelet_summary_pod_memory_overhead_negative_total.  This retains the "+strings.Join(summary.PodUsageSubtrees, ", ")+" summary subtrees, even if --kubelet-summary-skipped-subtrees lists them.")
+	flags.BoolVar(&o.ServeProvenance, "serve-provenance", o.ServeProvenance, "Annotate NodeMetrics and PodMetrics requested with ?"+provider.DebugParam+"="+provider.DebugProvenance+" with where their metrics came from: the collection cycle ("+provider.ProvenanceCycleAnnotation+"), the type of source, the endpoint scraped, when it was scraped, and whether it was scraped directly, from a fallback address, or served stale after the scrape failed ("+provider.ProvenanceKindAnnotation+").  Without it, such requests are rejected.")
+	flags.BoolVar(&o.ServePodNodeNames, "serve-pod-node-names", o.ServePodNodeNames, "Annotate PodMetrics with "+podmetrics.NodeNameAnnotation+": the name of the node whose Kubelet reported the metrics served, so that they can be joined with the node's conditions without fetching the pod.  For pods that moved between collections, this is the node of the sample served.")
+	flags.IntVar(&o.PageFaultRateMaxGapCycles, "page-fault-rate-max-gap-cycles", o.PageFaultRateMaxGapCycles, "The number of metric resolutions (with --max-metric-resolution, of the maximum) the samples a page fault rate is calculated from may be apart, beyond which (e.g. after failed scrapes) no rate is reported, since averaging over long gaps hides spikes.  Zero reports rates over any gap.")
+
+	flags.Int64Var(&o.StorageMemoryLimitBytes, "storage-memory-limit-bytes", o.StorageMemoryLimitBytes, "A soft limit on the estimated memory used to store metrics, published as metrics_server_storage_memory_estimate_bytes.  When a batch exceeds it, pods' metrics are evicted (those of terminated pods first, then the stalest) until it's under the limit.  Nodes and pods in priority namespaces are never evicted.  Zero means no limit.")
+	flags.IntVar(&o.StoragePodsPerNamespaceLimit, "storage-pods-per-namespace-limit", o.StoragePodsPerNamespaceLimit, "The most pods whose metrics are stored for each namespace.  Beyond it, the pods with the stalest metrics are evicted from each batch, counted by namespace in metrics_server_storage_namespace_cap_evictions_total, and the PodMetrics listed from capped namespaces are annotated with "+podmetrics.NamespaceCappedAnnotation+" (the number of pods left out) to mark the list as partial.  Pods in priority namespaces are never evicted.  Zero means no limit.")
+	flags.DurationVar(&o.StorageSmoothingHalfLife, "storage-smoothing-half-life", o.StorageSmoothingHalfLife, "Also keep an exponentially weighted moving average of the CPU and memory usage of each node and container, whose older samples' weight halves every half-life, e.g. 5m, serving it instead of the latest usage for gets and lists with ?"+provider.SmoothingParam+"="+string(provider.SmoothingExponential)+".  Averages restart with the latest usage for nodes and containers which restarted, and nodes and pods whose averages started less than a half-life ago are left out of smoothed results.  This retains the "+strings.Join(summary.StartTimeSubtrees, ", ")+" summary subtrees, even if --kubelet-summary-skipped-subtrees lists them.  Zero disables smoothing.  Can't be used with --partition-endpoints.")
+	flags.IntVar(&o.ResponseCompressionMinBytes, "metrics-api-compression-min-bytes", o.ResponseCompressionMinBytes, "The size, in bytes, of the smallest response to gets and lists of node and pod metrics compressed (with gzip, for clients accepting it).  Clients sending Accept-Encoding: identity (or gzip;q=0) are always sent uncompressed responses.  Responses are counted by encoding in metrics_server_api_responses_by_encoding_total, their bytes before and after compression in metrics_server_api_compressed_response_bytes_total, and the time spent compressing them in metrics_server_api_response_compression_seconds_total.  Negative disables compression of these responses, whatever the APIResponseCompression feature gate.")
+	flags.BoolVar(&o.ScrapeFailureEvents, "scrape-failure-events", o.ScrapeFailureEvents, "Record a "+summary.EventReasonScrapeFailing+" warning event on nodes whose scrapes fail for --scrape-failure-event-threshold consecutive cycles, and a "+summary.EventReasonScrapeRecovered+" event once they recover.  Requires permission to create and update events, and is only logged otherwise.")
+	flags.IntVar(&o.ScrapeFailureEventThreshold, "scrape-failure-event-threshold", o.ScrapeFailureEventThreshold, "The number of consecutive failed scrapes of a node after which a "+summary.EventReasonScrapeFailing+" event is recorded on it.")
+	flags.DurationVar(&o.ScrapeFailureEventWindow, "scrape-failure-event-aggregation-window", o.ScrapeFailureEventWindow, "The window within which repeated scrape failure events about the same node are aggregated into a single event, rather than recorded again.")
+	flags.IntVar(&o.PodCountTopNamespaces, "pod-count-top-namespaces", o.PodCountTopNamespaces, "The number of namespaces given their own series in the tracked pod count metrics, with the rest counted together.  Exact counts for every namespace are served at /debug/pod-counts.")
+	flags.BoolVar(&o.PodUtilizationMetrics, "pod-utilization-metrics", o.PodUtilizationMetrics, "Publish the distribution of pods' CPU and memory usage relative to their requests, as of each committed batch, in the metrics_server_pod_utilization_ratio histograms, for right-sizing tools.  Pods without requests for a resource are counted in metrics_server_pod_utilization_unrequested_total instead.")
+	flags.IntVar(&o.PodUtilizationTopNamespaces, "pod-utilization-top-namespaces", o.PodUtilizationTopNamespaces, "The number of namespaces, with the most pods, given their own series in the per-namespace breakdown of the pod utilization metrics, with the rest counted together.  Zero disables the breakdown.  Only used with --pod-utilization-metrics.")
+
+	flags.IntVar(&o.MaxInflightGets, "metrics-api-max-inflight-gets", o.MaxInflightGets, "The maximum number of metrics API gets (e.g. from the HPA) served at once, separately from --max-requests-inflight.  Gets over the limit may also use idle list slots, and otherwise queue for up to --metrics-api-inflight-queue-timeout.  Zero means no limit.")
+	flags.IntVar(&o.MaxInflightLists, "metrics-api-max-inflight-lists", o.MaxInflightLists, "The maximum number of metrics API lists (e.g. from dashboards) served at once, separately from --max-requests-inflight.  Lists over the limit queue behind any queued gets for up to --metrics-api-inflight-queue-timeout.  Zero means no limit.")
+	flags.DurationVar(&o.InflightQueueTimeout, "metrics-api-inflight-queue-timeout", o.InflightQueueTimeout, "How long metrics API requests over the in-flight limits wait for a slot before being rejected with 429 Too Many Requests.")
+	flags.BoolVar(&o.CachingHeaders, "metrics-api-caching-headers", o.CachingHeaders, "Serve node and pod metrics with a private Cache-Control header, whose max-age is the time until the next collection is expected to be stored, and a weak ETag derived from the resource version of the metrics served, answering gets and lists whose If-None-Match matches it with 304 Not Modified, without fetching or serializing the metrics.  Can't be used with --partition-endpoints.")
+	flags.BoolVar(&o.ServeUnmatchedPods, "serve-unmatched-pods", o.ServeUnmatchedPods, "Serve PodMetrics for pods in Kubelet summaries with no matching pod object (such as static pods whose mirror pods haven't been created, e.g. on self-hosted control plane nodes), annotated with "+podmetrics.UnmatchedPodAnnotation+".  They have no labels, so are only listed for label selectors matching no labels.")
+	flags.BoolVar(&o.ServeUnavailableNodes, "serve-unavailable-nodes", o.ServeUnavailableNodes, "Serve NodeMetrics with zero usage for nodes known to the node informer which have no fresh metrics (e.g. NotReady nodes), annotated with "+nodemetrics.StatusAnnotation+": "+nodemetrics.StatusUnavailable+", with the time of the last attempt to scrape them as their timestamp, rather than leaving them out.  PodMetrics are never served this way.")
+	flags.DurationVar(&o.InformerSyncTimeout, "informer-sync-timeout", o.InformerSyncTimeout, "How long to wait at startup for the node informer to sync before diagnosing why it hasn't (e.g. a missing RBAC permission to list nodes), reporting it in the logs and the node-informer health check.")
+	flags.Float64Var(&o.MinCapacityCoverage, "min-capacity-coverage", o.MinCapacityCoverage, "The minimum fraction (between 0 and 1) of the scraped nodes' allocatable CPU and memory which must be covered by fresh metrics, below which the capacity-coverage health check fails.  Zero disables the check, although the coverage is always exported.")
+	flags.Float64Var(&o.MinPodMetricsCompleteness, "min-pod-metrics-completeness", o.MinPodMetricsCompleteness, "The minimum fraction (between 0 and 1) of the running pods on scraped nodes, in served namespaces, which must have fresh metrics, below which the pod-metrics-completeness health check fails.  Zero disables the check, although the fraction is always exported, unless partitioned.  Not supported with --partition-endpoints.")
+	flags.BoolVar(&o.HPACoverageMetrics, "hpa-coverage-metrics", o.HPACoverageMetrics, "Watch HorizontalPodAutoscalers (read-only), resolving the pods each targets with its target's scale subresource, and publish how many of those pods lack fresh metrics in each committed batch in metrics_server_storage_hpa_pods_missing_metrics, since gaps there stall autoscaling.  The breakdown by HPA is served at /debug/hpa-status.  Needs permission to list and watch HPAs, and get the scale of their targets, which the deployed ClusterRole grants for deployments, replica sets, stateful sets and replication controllers: HPAs targeting other kinds need it granted for those too.  Not supported with --partition-endpoints.")
+	flags.DurationVar(&o.HPASelectorRefreshInterval, "hpa-selector-refresh-interval", o.HPASelectorRefreshInterval, "How often the pod selectors of all HPAs' targets are re-resolved, besides whenever an HPA is added or retargeted.  Zero only resolves them when HPAs change.  Only used with --hpa-coverage-metrics.")
+	flags.BoolVar(&o.DegradedOnInformerSyncFailure, "degraded-on-informer-sync-failure", o.DegradedOnInformerSyncFailure, "Keep running if the node informer fails to sync at startup, serving 503s explaining the failure from the metrics API until it syncs, rather than exiting.")
+	flags.StringVar(&o.Preflight, "preflight", o.Preflight, "How to check Kubelet connectivity at startup, once the node informer has synced, by fetching the summaries of a sample of ready nodes: \"strict\" exits with a report classifying each failure if any fail, \"warn\" only logs the report, and \"off\" skips the checks.")
+	flags.IntVar(&o.PreflightNodes, "preflight-nodes", o.PreflightNodes, "The number of ready nodes sampled by the --preflight checks.")
+	flags.DurationVar(&o.PreflightTimeout, "preflight-timeout", o.PreflightTimeout, "How long the --preflight checks may take, bounding how long they delay startup, after which any node not yet checked fails its check.")
+	flags.StringSliceVar(&o.PropagatedNodeLabels, "propagated-node-labels", o.PropagatedNodeLabels, "Node labels (e.g. topology.kubernetes.io/zone,node.kubernetes.io/instance-type) to copy onto the labels of each node's NodeMetrics, so that they can be aggregated, or selected, by those labels.")
+	flags.StringSliceVar(&o.NodePoolLabels, "node-pool-labels", o.NodePoolLabels, "Node labels checked, in order, for the name of a node's pool, used to break down Kubelet scrape error metrics.")
+
+	flags.StringVar(&o.PartitionEndpoints, "partition-endpoints", o.PartitionEndpoints, "EXPERIMENTAL: If set, partition the nodes between all metrics-server replicas listed as ready in this Endpoints object (namespace/name, normally that of the metrics-server Service), scraping only this replica's share, and proxying node metrics requests for other nodes to their owners.  Pod metrics are not yet proxied, so are only served for this replica's nodes.")
+	flags.StringVar(&o.PartitionSelfIP, "partition-self-ip", o.PartitionSelfIP, "The IP of this replica, as listed in the --partition-endpoints Endpoints object (defaults to the POD_IP environment variable).")
+	flags.DurationVar(&o.PartitionProxyTimeout, "partition-proxy-timeout", o.PartitionProxyTimeout, "The timeout for node metrics requests proxied to other replicas, after which local data (if any) is served instead.")
+	flags.StringVar(&o.PartitionPeerCAFile, "partition-peer-ca-file", o.PartitionPeerCAFile, "The CA used to verify the serving certificates of other replicas.")
+	flags.StringVar(&o.PartitionPeerServerName, "partition-peer-server-name", o.PartitionPeerServerName, "The server name to verify the serving certificates of other replicas against (defaults to their IPs).")
+	flags.BoolVar(&o.PartitionPeerInsecureTLS, "partition-peer-insecure-tls", o.PartitionPeerInsecureTLS, "Do not verify the serving certificates of other replicas.  For testing purposes only.")
+
+	flags.StringSliceVar(&o.PriorityNamespaces, "priority-namespaces", o.PriorityNamespaces, "Namespaces whose pods' metrics are never dropped by caps or load shedding.")
+	flags.StringVar(&o.PriorityNamespaceSelector, "priority-namespace-selector", o.PriorityNamespaceSelector, "A label selector for additional namespaces whose pods' metrics are never dropped by caps or load shedding.")
+	flags.StringSliceVar(&o.ServedNamespaces, "served-namespaces", o.ServedNamespaces, "Namespaces whose pods' metrics are collected and served, e.g. by a metrics-server dedicated to one tenant.  Requests in other namespaces are forbidden, and lists across all namespaces leave them out.  Unset serves every namespace, unless --served-namespace-selector is set.")
+	flags.StringVar(&o.ServedNamespaceSelector, "served-namespace-selector", o.ServedNamespaceSelector, "A label selector for additional namespaces whose pods' metrics are collected and served, as with --served-namespaces.")
+	flags.BoolVar(&o.NamespaceAccessFiltering, "namespace-access-filtering", o.NamespaceAccessFiltering, "Let users who may only list PodMetrics in some namespaces still list them across all namespaces, serving just the pods in the namespaces they may list them in (as decided by the delegated authorization), rather than forbidding the list.  This changes what lists across all namespaces mean, so is off by default.")
+	flags.DurationVar(&o.NamespaceAccessCacheTTL, "namespace-access-cache-ttl", o.NamespaceAccessCacheTTL, "How long each decision of whether a user may list PodMetrics in a namespace is cached for, to bound the authorization requests made by --namespace-access-filtering.  Zero disables the cache.")
+
+	flags.StringVar(&o.DebugAuthorizationMode, "debug-authorization-mode", o.DebugAuthorizationMode, "How requests to the debug endpoints (/debug/scrape-status, /debug/pod-counts, /debug/hpa-status, /debug/loglevel, and /debug/capture) are authorized, needing permission either to view (GET) or trigger (any other method): \""+debugauthz.ModeDelegated+"\" asks the delegated authorization whether the user may get (to view) the endpoint's path, or otherwise use the request's method on it (e.g. put or delete), \""+debugauthz.ModeToken+"\" requires the token in --debug-authorization-token-file in the "+debugauthz.TokenHeader+" header, and \""+debugauthz.ModeClientCert+"\" requires a client certificate for client authentication, verified against the client CA (--client-ca-file, or the cluster's), with a common name in --debug-authorization-client-cert-common-names.  Each decision is logged, and counted in metrics_server_debug_access_total.  Anything misconfigured (e.g. delegating with authorization disabled) denies all access.")
+	flags.StringVar(&o.DebugAuthorizationTokenFile, "debug-authorization-token-file", o.DebugAuthorizationTokenFile, "The file containing the token requests to the debug endpoints must present, with --debug-authorization-mode="+debugauthz.ModeToken+".")
+	flags.StringSliceVar(&o.DebugAuthorizationCommonNames, "debug-authorization-client-cert-common-names", o.DebugAuthorizationCommonNames, "The common names of the client certificates allowed to access the debug endpoints, with --debug-authorization-mode="+debugauthz.ModeClientCert+".")
+	flags.StringVar(&o.DebugCaptureDir, "debug-capture-dir", o.DebugCaptureDir, "If set, enables capturing raw Kubelet summary responses for a node into this directory, either for the node given by --debug-capture-node, or by POSTing to /debug/capture?node=NAME&count=N.")
+	flags.StringVar(&o.DebugCaptureNode, "debug-capture-node", o.DebugCaptureNode, "The node whose raw Kubelet summary responses should be captured at startup.  Requires --debug-capture-dir.")
+	flags.IntVar(&o.DebugCaptureCount, "debug-capture-count", o.DebugCaptureCount, "The number of responses to capture from --debug-capture-node before disabling capture.")
+	flags.IntVar(&o.DebugCaptureMaxBytes, "debug-capture-max-bytes", o.DebugCaptureMaxBytes, "The maximum number of bytes to save from each captured response.")
+	flags.StringVar(&o.ComponentLogLevels, "component-log-levels", o.ComponentLogLevels, "A comma-separated list of component=level pairs overriding -v for the logs of individual components ("+loglevel.ComponentNames()+"), e.g. client=10 to log raw Kubelet responses without logging everything else at that level.  Levels can also be overridden at runtime by PUTting to /debug/loglevel?component=NAME&level=N[&ttl=DURATION], and reverted by DELETEing /debug/loglevel?component=NAME.")
+	flags.DurationVar(&o.RuntimeLogLevelTTL, "runtime-log-level-ttl", o.RuntimeLogLevelTTL, "How long levels overridden at runtime without a ttl parameter last before reverting, so that debug levels aren't forgotten.  Zero keeps them until restarted.  Doesn't apply to --component-log-levels.")
+	flags.IntVar(&o.GCPercent, "gc-percent", o.GCPercent, "If non-zero, the garbage collection target percentage, overriding GOGC.  A negative percentage only collects garbage once the soft memory limit is reached, and requires --soft-memory-limit-ratio.")
+	flags.Float64Var(&o.SoftMemoryLimitRatio, "soft-memory-limit-ratio", o.SoftMemoryLimitRatio, "If non-zero, sets the soft memory limit of the Go runtime to this fraction of the container's cgroup memory limit, letting the heap grow to use the memory the container was given before collecting more often, e.g. 0.9.  Fails at startup if the container's memory isn't limited.")
+	flags.BoolVar(&o.GCAfterCommit, "gc-after-commit", o.GCAfterCommit, "If true, forces a garbage collection once each batch is committed, when the previous batch has just become garbage, rather than leaving it to a collection while serving.  This lowered the worst-case latency of reads during commits in the fake fleet benchmarks, but not their p99.")
 
 	flags.MarkDeprecated("deprecated-kubelet-completely-insecure", "This is rarely the right option, since it leaves kubelet communication completely insecure.  If you encounter auth errors, make sure you've enabled token webhook auth on the Kubelet, and if you're in a test cluster with self-signed Kubelet certificates, consider using kubelet-insecure-tls instead.")
 
@@ -80,19 +252,143 @@ type MetricsServerOptions struct {
 	Authorization  *genericoptions.DelegatingAuthorizationOptions
 	Features       *genericoptions.FeatureOptions
 
-	Kubeconfig string
+	Kubeconfig                     string
+	Standalone                     bool
+	StandaloneNodesFile            string
+	StandaloneAllowUnauthenticated bool
 
 	// Only to be used to for testing
 	DisableAuthForTesting bool
 
-	MetricResolution time.Duration
+	MetricResolution              time.Duration
+	ReloadableConfigFile          string
+	MaxMetricResolution           time.Duration
+	MetricResolutionOverrunCycles int
+	ScrapeOrder                   string
+	ScrapePhaseMaxDrift           time.Duration
+	LivenessCycleMultiplier       float64
+	LivenessCommitMultiplier      float64
+	ResumeDetectionThreshold      time.Duration
+	KubeletHousekeepingInterval   time.Duration
+	ForceMetricResolution         bool
 
-	KubeletPort                  int
-	InsecureKubeletTLS           bool
-	UseAPIServerProxy            bool
-	KubeletPreferredAddressTypes []string
+	KubeletPort                   int
+	InsecureKubeletTLS            bool
+	InsecureKubeletTLSNodes       []string
+	InsecureKubeletTLSSelector    string
+	KubeletNodeProfiles           []string
+	KubeletProfileAnnotations     bool
+	KubeletReadOnlyPort           int
+	UseAPIServerProxy             bool
+	KubeletPreferredAddressTypes  []string
+	KubeletAddressFallback        bool
+	KubeletAddressFallbackTTL     time.Duration
+	KubeletCapturedHeaders        []string
+	ScrapeAuditLogPath            string
+	ScrapeAuditLogMaxSizeBytes    int64
+	ScrapeAuditLogMaxBackups      int
+	ScrapeAuditLogQueueSize       int
+	ScrapeStatusSocket            string
+	KubeletTLSMinVersion          string
+	KubeletTLSCipherSuites        []string
+	KubeletTLSSANPolicy           string
+	KubeletSPIFFESocket           string
+	KubeletSPIFFETrustDomain      string
+	KubeletHedgeDelay             time.Duration
+	KubeletMaxHedgesPerCycle      int
+	KubeletMaxRequestsPerNode     int
+	KubeletCoalesceRequests       bool
+	ProxyBreakerFailureRate       float64
+	ProxyBreakerMinRequests       int
+	ProxyBreakerWindow            time.Duration
+	ProxyBreakerCooldown          time.Duration
+	ProxyBreakerProbes            int
+	APIServerHostRefreshInterval  time.Duration
+	APIServerHostRefreshFailures  int
+	MaxPodsPerNode                int
+	NodeWarmupGracePeriod         time.Duration
+	NodeNameVerification          string
+	KubeletSummaryDecoder         string
+	KubeletStrictDecoding         bool
+	KubeletSummarySkippedSubtrees []string
+	NodePoolLabels                []string
+	PropagatedNodeLabels          []string
+	ServeUnmatchedPods            bool
+	ServeUnavailableNodes         bool
+	MaxInflightGets               int
+	MaxInflightLists              int
+	InflightQueueTimeout          time.Duration
+	CachingHeaders                bool
+	ResponseCompressionMinBytes   int
+	InformerSyncTimeout           time.Duration
+	DegradedOnInformerSyncFailure bool
+	Preflight                     string
+	PreflightNodes                int
+	PreflightTimeout              time.Duration
+	MinCapacityCoverage           float64
+	MinPodMetricsCompleteness     float64
+	HPACoverageMetrics            bool
+	HPASelectorRefreshInterval    time.Duration
+	PageFaultRates                bool
+	CPUThrottlingRates            bool
+	CPURateConsistencyRatio       float64
+	WarmStartFile                 string
+	WarmStartMaxAge               time.Duration
+	WarmStartSaveInterval         time.Duration
+	WarmStartScrapeCosts          bool
+	PodUsageTolerance             float64
+	PodMemoryOverhead             bool
+	ServeProvenance               bool
+	ServePodNodeNames             bool
+	AcceleratorStats              bool
+	SwapStats                     bool
+	PageFaultRateMaxGapCycles     int
+	NodeHealthSignals             bool
+	PerNodeMetricsAge             bool
+	PodTimestampLagThreshold      time.Duration
+	StaleSummaryWarningThreshold  int
+	PodCountTopNamespaces         int
+	PodUtilizationMetrics         bool
+	PodUtilizationTopNamespaces   int
+	ScrapeFailureEvents           bool
+	ScrapeFailureEventThreshold   int
+	ScrapeFailureEventWindow      time.Duration
+	StorageMemoryLimitBytes       int64
+	StoragePodsPerNamespaceLimit  int
+	StorageSmoothingHalfLife      time.Duration
+	ExcludedContainers            []string
+	ExcludedContainerMode         string
+	PartitionEndpoints            string
+	PartitionSelfIP               string
+	PartitionProxyTimeout         time.Duration
+	PartitionPeerCAFile           string
+	PartitionPeerServerName       string
+	PartitionPeerInsecureTLS      bool
+	PriorityNamespaces            []string
+	PriorityNamespaceSelector     string
+	ServedNamespaces              []string
+	ServedNamespaceSelector       string
+	NamespaceAccessFiltering      bool
+	NamespaceAccessCacheTTL       time.Duration
 
 	DeprecatedCompletelyInsecureKubelet bool
+	KubeletInsecureMigration            bool
+
+	DebugAuthorizationMode        string
+	DebugAuthorizationTokenFile   string
+	DebugAuthorizationCommonNames []string
+
+	DebugCaptureDir      string
+	DebugCaptureNode     string
+	DebugCaptureCount    int
+	DebugCaptureMaxBytes int
+
+	ComponentLogLevels string
+	RuntimeLogLevelTTL time.Duration
+
+	GCPercent            int
+	SoftMemoryLimitRatio float64
+	GCAfterCommit        bool
 }
 
 // NewMetricsServerOptions constructs a new set of default options for metrics-server.
@@ -103,9 +399,59 @@ func NewMetricsServerOptions() *MetricsServerOptions {
 		Authorization:  genericoptions.NewDelegatingAuthorizationOptions(),
 		Features:       genericoptions.NewFeatureOptions(),
 
-		MetricResolution:             60 * time.Second,
-		KubeletPort:                  10250,
-		KubeletPreferredAddressTypes: make([]string, len(summary.DefaultAddressTypePriority)),
+		MetricResolution:              60 * time.Second,
+		MetricResolutionOverrunCycles: 3,
+		LivenessCycleMultiplier:       manager.DefaultLivenessCycleMultiplier,
+		LivenessCommitMultiplier:      manager.DefaultLivenessCommitMultiplier,
+		ResumeDetectionThreshold:      manager.DefaultResumeDetectionThreshold,
+		KubeletHousekeepingInterval:   tuning.DefaultHousekeepingInterval,
+		PodCountTopNamespaces:         podcount.DefaultTopNamespaces,
+		HPASelectorRefreshInterval:    hpacoverage.DefaultSelectorRefreshInterval,
+		ScrapeFailureEvents:           true,
+		ScrapeFailureEventThreshold:   summary.DefaultScrapeFailureEventThreshold,
+		ScrapeFailureEventWindow:      events.DefaultAggregationWindow,
+		KubeletPort:                   defaultKubeletPort,
+		KubeletReadOnlyPort:           summary.DefaultReadOnlyPort,
+		ScrapeOrder:                   sources.ScrapeOrderCost,
+		ScrapePhaseMaxDrift:           sources.DefaultMaxPhaseDrift,
+		KubeletMaxHedgesPerCycle:      summary.DefaultMaxHedgesPerCycle,
+		KubeletMaxRequestsPerNode:     summary.DefaultMaxConcurrentRequestsPerNode,
+		ProxyBreakerMinRequests:       summary.DefaultBreakerMinRequests,
+		ProxyBreakerWindow:            summary.DefaultBreakerWindow,
+		ProxyBreakerCooldown:          summary.DefaultBreakerCooldown,
+		ProxyBreakerProbes:            summary.DefaultBreakerProbes,
+		APIServerHostRefreshInterval:  summary.DefaultAPIServerHostRefreshInterval,
+		APIServerHostRefreshFailures:  summary.DefaultAPIServerHostRefreshFailures,
+		InflightQueueTimeout:          provider.DefaultInflightQueueTimeout,
+		ResponseCompressionMinBytes:   provider.DefaultCompressionMinBytes,
+		InformerSyncTimeout:           informersync.DefaultTimeout,
+		Preflight:                     string(preflight.ModeOff),
+		PreflightNodes:                preflight.DefaultNodes,
+		PreflightTimeout:              preflight.DefaultTimeout,
+		KubeletPreferredAddressTypes:  make([]string, len(summary.DefaultAddressTypePriority)),
+		KubeletAddressFallbackTTL:     summary.DefaultAddressFallbackTTL,
+		MaxPodsPerNode:                summary.DefaultMaxPodsPerNode,
+		NodeWarmupGracePeriod:         summary.DefaultWarmupGracePeriod,
+		PodTimestampLagThreshold:      summary.DefaultPodTimestampLagThreshold,
+		StaleSummaryWarningThreshold:  summary.DefaultStaleSummaryWarningThreshold,
+		WarmStartMaxAge:               summary.DefaultWarmStartMaxAge,
+		WarmStartSaveInterval:         summary.DefaultWarmStartSaveInterval,
+		NodeNameVerification:          string(summary.NodeNameVerificationEnforce),
+		KubeletSummaryDecoder:         string(summary.SummaryDecoderFast),
+		KubeletSummarySkippedSubtrees: summary.DefaultSkippedSubtrees,
+		NodePoolLabels:                summary.DefaultNodePoolLabels,
+		ExcludedContainerMode:         string(summary.ContainerExclusionList),
+		PartitionSelfIP:               os.Getenv("POD_IP"),
+		PartitionProxyTimeout:         5 * time.Second,
+		PriorityNamespaces:            priority.DefaultNamespaces,
+		NamespaceAccessCacheTTL:       provider.DefaultNamespaceAccessTTL,
+		ScrapeAuditLogMaxSizeBytes:    scrapeaudit.DefaultMaxSizeBytes,
+		ScrapeAuditLogMaxBackups:      scrapeaudit.DefaultMaxBackups,
+		ScrapeAuditLogQueueSize:       scrapeaudit.DefaultQueueSize,
+		DebugAuthorizationMode:        debugauthz.ModeDelegated,
+		DebugCaptureCount:             1,
+		DebugCaptureMaxBytes:          summary.DefaultCaptureMaxBytes,
+		RuntimeLogLevelTTL:            loglevel.DefaultRuntimeTTL,
 	}
 
 	for i, addrType := range summary.DefaultAddressTypePriority {
@@ -141,6 +487,59 @@ func (o MetricsServerOptions) Config() (*apiserver.Config, error) {
 }
 
 func (o MetricsServerOptions) Run(stopCh <-chan struct{}) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	logLevels, err := loglevel.ParseOverrides(o.ComponentLogLevels)
+	if err != nil {
+		return err
+	}
+	for component, level := range logLevels {
+		if err := loglevel.Default.Set(component, level, 0); err != nil {
+			return err
+		}
+	}
+	loglevel.Default.SetDefaultTTL(o.RuntimeLogLevelTTL)
+	if err := gctuning.Apply(gctuning.Options{GCPercent: o.GCPercent, SoftMemoryLimitRatio: o.SoftMemoryLimitRatio}); err != nil {
+		return err
+	}
+	nodeNameVerification := summary.NodeNameVerification(o.NodeNameVerification)
+	summaryDecoder := summary.SummaryDecoder(o.KubeletSummaryDecoder)
+	// nothing reads the ephemeral storage stats yet, so they needn't be retained
+	skippedSubtrees, err := summary.NewSubtreeSkips(o.KubeletSummarySkippedSubtrees, false)
+	if err != nil {
+		return err
+	}
+	var excludedContainers *summary.ContainerFilter
+	if len(o.ExcludedContainers) > 0 {
+		var err error
+		excludedContainers, err = summary.NewContainerFilter(o.ExcludedContainers, summary.ContainerExclusionMode(o.ExcludedContainerMode))
+		if err != nil {
+			return err
+		}
+	}
+
+	// load the reloadable parameters, which override their flags
+	tunables := tuning.Config{
+		MetricResolution:        o.MetricResolution,
+		ScrapeTimeout:           tuning.ScrapeTimeoutFor(o.MetricResolution),
+		StorageMemoryLimitBytes: o.StorageMemoryLimitBytes,
+	}
+	var tunablesWatcher *tuning.Watcher
+	if o.ReloadableConfigFile != "" {
+		var err error
+		tunablesWatcher, err = tuning.NewWatcher(o.ReloadableConfigFile, tunables, o.validateTunables)
+		if err != nil {
+			return err
+		}
+		tunables = tunablesWatcher.Current()
+		o.MetricResolution, o.StorageMemoryLimitBytes = tunables.MetricResolution, tunables.StorageMemoryLimitBytes
+	}
+
+	if o.Standalone {
+		return o.runStandalone(stopCh, summaryDecoder, skippedSubtrees, excludedContainers)
+	}
+
 	// grab the config for the API server
 	config, err := o.Config()
 	if err != nil {
@@ -149,15 +548,7 @@ func (o MetricsServerOptions) Run(stopCh <-chan struct{}) error {
 	config.GenericConfig.EnableMetrics = true
 
 	// set up the client config
-	var clientConfig *rest.Config
-	if len(o.Kubeconfig) > 0 {
-		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: o.Kubeconfig}
-		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
-
-		clientConfig, err = loader.ClientConfig()
-	} else {
-		clientConfig, err = rest.InClusterConfig()
-	}
+	clientConfig, err := o.loadClientConfig()
 	if err != nil {
 		return fmt.Errorf("unable to construct lister client config: %v", err)
 	}
@@ -173,46 +564,599 @@ func (o MetricsServerOptions) Run(stopCh <-chan struct{}) error {
 	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
 
 	// set up the source manager
+	// while migrating, the Kubelets are requested as if the insecure flag were dropped,
+	// only falling back to it for those still requiring plain HTTP
+	migrating := o.DeprecatedCompletelyInsecureKubelet && o.KubeletInsecureMigration
 	kubeletConfig := summary.GetKubeletConfig(clientConfig, o.KubeletPort, o.InsecureKubeletTLS,
-		o.DeprecatedCompletelyInsecureKubelet, o.UseAPIServerProxy)
-	kubeletClient, err := summary.KubeletClientFor(kubeletConfig)
-	if err != nil {
-		return fmt.Errorf("unable to construct a client to connect to the kubelets: %v", err)
+		o.DeprecatedCompletelyInsecureKubelet && !migrating, o.UseAPIServerProxy)
+	kubeletConfig.MigrateFromCompletelyInsecure = migrating
+	kubeletConfig.CaptureHeaders = o.KubeletCapturedHeaders
+	kubeletConfig.SummaryDecoder = summaryDecoder
+	kubeletConfig.StrictDecoding = o.KubeletStrictDecoding
+	if o.AcceleratorStats {
+		skippedSubtrees = skippedSubtrees.Retaining(summary.AcceleratorSubtrees)
+	}
+	if o.PodUsageTolerance > 0 || o.PodMemoryOverhead {
+		skippedSubtrees = skippedSubtrees.Retaining(summary.PodUsageSubtrees)
+	}
+	// restored baselines are only used for containers that started when they were sampled
+	if o.StorageSmoothingHalfLife > 0 || (o.WarmStartFile != "" && o.CPURateConsistencyRatio > 0) {
+		skippedSubtrees = skippedSubtrees.Retaining(summary.StartTimeSubtrees)
+	}
+	kubeletConfig.SkippedSubtrees = skippedSubtrees
+	if err := o.applyKubeletTLS(kubeletConfig); err != nil {
+		return err
+	}
+	var insecureNodes *summary.InsecureTLSNodes
+	if len(o.InsecureKubeletTLSNodes) > 0 || o.InsecureKubeletTLSSelector != "" {
+		var selector labels.Selector
+		if o.InsecureKubeletTLSSelector != "" {
+			selector, err = labels.Parse(o.InsecureKubeletTLSSelector)
+			if err != nil {
+				return fmt.Errorf("unable to parse insecure Kubelet TLS node selector: %v", err)
+			}
+		}
+		insecureNodes = summary.NewInsecureTLSNodes(o.InsecureKubeletTLSNodes, selector, informerFactory.Core().V1().Nodes().Lister())
+		kubeletConfig.InsecureTLSNodes = insecureNodes
+	}
+	if len(o.KubeletNodeProfiles) > 0 || o.KubeletProfileAnnotations {
+		nodeProfiles, err := summary.ParseNodeProfiles(o.KubeletNodeProfiles)
+		if err != nil {
+			return fmt.Errorf("unable to parse Kubelet node profiles: %v", err)
+		}
+		var annotated v1listers.NodeLister
+		if o.KubeletProfileAnnotations {
+			annotated = informerFactory.Core().V1().Nodes().Lister()
+		}
+		kubeletConfig.Profiles = summary.NewKubeletProfiles(nodeProfiles, annotated)
+		kubeletConfig.ReadOnlyPort = o.KubeletReadOnlyPort
+		kubeletConfig.APIServerRESTConfig = clientConfig
+	}
+	kubeletConfig.HedgeDelay = o.KubeletHedgeDelay
+	kubeletConfig.MaxHedgesPerCycle = o.KubeletMaxHedgesPerCycle
+	kubeletConfig.MaxConcurrentRequestsPerNode = o.KubeletMaxRequestsPerNode
+	kubeletConfig.CoalesceRequests = o.KubeletCoalesceRequests
+	if o.ProxyBreakerFailureRate > 0 {
+		kubeletConfig.ProxyBreaker = &summary.CircuitBreakerConfig{
+			FailureRate: o.ProxyBreakerFailureRate,
+			MinRequests: o.ProxyBreakerMinRequests,
+			Window:      o.ProxyBreakerWindow,
+			Cooldown:    o.ProxyBreakerCooldown,
+			Probes:      o.ProxyBreakerProbes,
+		}
+	}
+	kubeletConfig.APIServerHost = &summary.APIServerHostConfig{
+		// reloaded each time, so that a rotated kubeconfig is picked up (in-cluster, the address
+		// comes from environment variables, so only the service account's token and CA change),
+		// as the Kubelet client sees it
+		Resolve: func() (*rest.Config, error) {
+			cfg, err := o.loadClientConfig()
+			if err != nil || !o.UseAPIServerProxy {
+				// only the nodes scraped with the proxy profile are, with the API server's own config
+				return cfg, err
+			}
+			return summary.GetKubeletConfig(cfg, o.KubeletPort, o.InsecureKubeletTLS,
+				o.DeprecatedCompletelyInsecureKubelet && !migrating, o.UseAPIServerProxy).RESTConfig, nil
+		},
+		Interval: o.APIServerHostRefreshInterval,
+		Failures: o.APIServerHostRefreshFailures,
+	}
+	if o.KubeletSPIFFESocket != "" {
+		svids := spiffe.NewX509Source(o.KubeletSPIFFESocket)
+		if err := svids.RunUntil(stopCh); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), spiffe.DefaultReadyTimeout)
+		err := svids.WaitUntilReady(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		kubeletConfig.SPIFFE = svids
+		kubeletConfig.SPIFFETrustDomain = o.KubeletSPIFFETrustDomain
+	}
+	var bodyCapture *summary.BodyCapture
+	if len(o.DebugCaptureDir) > 0 {
+		bodyCapture = summary.NewBodyCapture(o.DebugCaptureDir, o.DebugCaptureMaxBytes)
+		if len(o.DebugCaptureNode) > 0 {
+			bodyCapture.Arm(o.DebugCaptureNode, o.DebugCaptureCount)
+		}
+		kubeletConfig.Capture = bodyCapture
+	}
+	if o.ScrapeAuditLogPath != "" {
+		auditLog, err := scrapeaudit.New(scrapeaudit.Options{
+			Path:         o.ScrapeAuditLogPath,
+			MaxSizeBytes: o.ScrapeAuditLogMaxSizeBytes,
+			MaxBackups:   o.ScrapeAuditLogMaxBackups,
+			QueueSize:    o.ScrapeAuditLogQueueSize,
+		})
+		if err != nil {
+			return err
+		}
+		// flush and sync the log on shutdown (or if we fail to start)
+		defer func() {
+			if err := auditLog.Close(); err != nil {
+				glog.Errorf("unable to close the scrape audit log: %v", err)
+			}
+		}()
+		kubeletConfig.RequestObserver = auditLog
 	}
-
 	// set up an address resolver according to the user's priorities
 	addrPriority := make([]corev1.NodeAddressType, len(o.KubeletPreferredAddressTypes))
 	for i, addrType := range o.KubeletPreferredAddressTypes {
 		addrPriority[i] = corev1.NodeAddressType(addrType)
 	}
 	addrResolver := summary.NewPriorityNodeAddressResolver(addrPriority)
+	if !o.UseAPIServerProxy {
+		// the API server resolves the addresses when proxying, so only check them when connecting directly
+		addrResolver = summary.NewFallbackNodeAddressResolver(addrPriority, net.DefaultResolver.LookupHost)
+	}
+
+	// set up the priority namespaces, which are never shed
+	var prioritySelector labels.Selector
+	if len(o.PriorityNamespaceSelector) > 0 {
+		prioritySelector, err = labels.Parse(o.PriorityNamespaceSelector)
+		if err != nil {
+			return fmt.Errorf("unable to parse priority namespace selector: %v", err)
+		}
+	}
+	priorityNamespaces := priority.NewNamespaces(o.PriorityNamespaces, prioritySelector, informerFactory.Core().V1().Namespaces().Lister())
+
+	// restrict the namespaces served, if requested, both when collecting and when serving,
+	// so that a mistake in one can't leak other namespaces' metrics
+	var servedNamespaces *provider.NamespaceAllowlist
+	if len(o.ServedNamespaces) > 0 || len(o.ServedNamespaceSelector) > 0 {
+		var servedSelector labels.Selector
+		if len(o.ServedNamespaceSelector) > 0 {
+			servedSelector, err = labels.Parse(o.ServedNamespaceSelector)
+			if err != nil {
+				return fmt.Errorf("unable to parse served namespace selector: %v", err)
+			}
+		}
+		servedNamespaces = provider.NewNamespaceAllowlist(o.ServedNamespaces, servedSelector, informerFactory.Core().V1().Namespaces().Lister())
+	}
+
+	// page fault rates may span the given number of cycles, at the longest the resolution can be stretched to
+	maxRateGap := time.Duration(o.PageFaultRateMaxGapCycles) * o.MetricResolution
+	if o.MaxMetricResolution != 0 {
+		maxRateGap = time.Duration(o.PageFaultRateMaxGapCycles) * o.MaxMetricResolution
+	}
+
+	// a node's last good batch may stand in for a couple of failed scrapes, at the longest
+	// the resolution can be stretched to, but no more
+	lastBatchMaxAge := 3 * o.MetricResolution
+	if o.MaxMetricResolution != 0 {
+		lastBatchMaxAge = 3 * o.MaxMetricResolution
+	}
+
+	scrapeStatuses := summary.NewScrapeStatusTracker()
+	if o.ScrapeStatusSocket != "" {
+		statusSocket := statussocket.New(statussocket.Options{Path: o.ScrapeStatusSocket})
+		defer statusSocket.Close()
+		scrapeStatuses.AddObserver(statusSocket)
+	}
+	var failureEvents *summary.ScrapeFailureEvents
+	if o.ScrapeFailureEvents {
+		recorder := events.NewRecorder(kubeClient.CoreV1(), "metrics-server", o.ScrapeFailureEventWindow)
+		recorder.RunUntil(stopCh)
+		failureEvents = summary.NewScrapeFailureEvents(recorder, o.ScrapeFailureEventThreshold)
+	}
+	// cancel the scrapes of nodes deleted mid-cycle, rather than waiting for them to time out
+	inFlightScrapes := summary.NewInFlightScrapes()
+	informerFactory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: inFlightScrapes.NodeDeleted,
+	})
+	// restore the CPU usage baselines sampled before the last restart, saving them for the next
+	var warmStart *summary.WarmStart
+	if o.WarmStartFile != "" {
+		warmStart = summary.LoadWarmStart(o.WarmStartFile, o.WarmStartMaxAge)
+		warmStart.RunUntil(o.WarmStartSaveInterval, stopCh)
+		defer func() {
+			if err := warmStart.Save(); err != nil {
+				glog.Errorf("unable to save the warm start to %s: %v", o.WarmStartFile, err)
+			}
+		}()
+	}
+	// the summary source scrapes every node not claimed by a compiled-in source
+	var addressFallbackTTL time.Duration
+	if o.KubeletAddressFallback {
+		addressFallbackTTL = o.KubeletAddressFallbackTTL
+	}
+	sourceOptions := summary.SourceOptions{
+		Statuses:                     scrapeStatuses,
+		MaxPodsPerNode:               o.MaxPodsPerNode,
+		Priority:                     priorityNamespaces,
+		Namespaces:                   servedNamespaces,
+		WarmupGracePeriod:            o.NodeWarmupGracePeriod,
+		NodeNameVerification:         nodeNameVerification,
+		NodePoolLabels:               o.NodePoolLabels,
+		PageFaultRates:               o.PageFaultRates,
+		CPUThrottlingRates:           o.CPUThrottlingRates,
+		MaxRateGap:                   maxRateGap,
+		LastBatchMaxAge:              lastBatchMaxAge,
+		ExcludedContainers:           excludedContainers,
+		NodeHealthSignals:            o.NodeHealthSignals,
+		InFlight:                     inFlightScrapes,
+		FailureEvents:                failureEvents,
+		PodTimestampLagThreshold:     o.PodTimestampLagThreshold,
+		StaleSummaryWarningThreshold: o.StaleSummaryWarningThreshold,
+		CPURateConsistencyRatio:      o.CPURateConsistencyRatio,
+		WarmStart:                    warmStart,
+		PodUsageTolerance:            o.PodUsageTolerance,
+		PodMemoryOverhead:            o.PodMemoryOverhead,
+		AcceleratorStats:             o.AcceleratorStats,
+		SwapStats:                    o.SwapStats,
+		AddressFallbackTTL:           addressFallbackTTL,
+		Provenance:                   o.ServeProvenance,
+	}
+
+	// partition the nodes between replicas, if requested
+	var nodeRouter provider.NodeRouter
+	var scrapedNodes sources.NodeFilter
+	if len(o.PartitionEndpoints) > 0 {
+		partitioner, router, err := o.partitioner(clientConfig, kubeClient, stopCh)
+		if err != nil {
+			return err
+		}
+		scrapedNodes = partitioner.NodeFilter()
+		nodeRouter = router
+	}
+	scrapeOrdering := sources.RandomOrdering()
+	if o.ScrapeOrder == sources.ScrapeOrderCost {
+		scrapeOrdering = sources.CostOrdering(priorityNamespaces, o.ScrapePhaseMaxDrift)
+	}
+
+	// set up the scraper, the in-memory sink, and the provider serving from it
+	srv, err := server.NewServer(server.Config{
+		KubeClient:                    kubeClient,
+		Informers:                     informerFactory,
+		Kubelet:                       kubeletConfig,
+		AddressResolver:               addrResolver,
+		SourceOptions:                 sourceOptions,
+		NodeFilter:                    scrapedNodes,
+		MetricResolution:              o.MetricResolution,
+		MaxMetricResolution:           o.MaxMetricResolution,
+		ScrapeTimeout:                 tunables.ScrapeTimeout,
+		ScrapeOrdering:                scrapeOrdering,
+		InformerSyncTimeout:           o.InformerSyncTimeout,
+		DegradedOnInformerSyncFailure: o.DegradedOnInformerSyncFailure,
+		Serving:                       config,
+	})
+	if err != nil {
+		return err
+	}
+	metricSink := srv.Sink()
+
+	// track the pods in each namespace, comparing them to the scheduled pods, unless
+	// partitioned, since then this replica only scrapes its share of the nodes, or
+	// restricted to some namespaces, since the rest mustn't be revealed at all
+	var scheduledPods v1listers.PodLister
+	if nodeRouter == nil && servedNamespaces == nil {
+		scheduledPods = informerFactory.Core().V1().Pods().Lister()
+	}
+	podCounts := podcount.NewTracker(o.PodCountTopNamespaces, scheduledPods)
+	if countingSink, ok := metricSink.(metricsink.PodCountingSink); ok {
+		countingSink.ObservePodCounts(podCounts)
+	}
+
+	// track the utilization of each pod's requests, for right-sizing
+	if o.PodUtilizationMetrics {
+		if usageSink, ok := metricSink.(metricsink.PodUsageObservingSink); ok {
+			usageSink.ObservePodUsage(utilization.NewTracker(o.PodUtilizationTopNamespaces, informerFactory.Core().V1().Pods().Lister()))
+		}
+	}
+
+	// aggregate the usage in each namespace, for chargeback tooling, computing its coverage of
+	// the running pods unless partitioned, since then this replica only has its share of them
+	var runningPods v1listers.PodLister
+	if nodeRouter == nil {
+		runningPods = informerFactory.Core().V1().Pods().Lister()
+	}
+	namespaceUsage := nsusage.NewAggregator(runningPods, servedNamespaces)
+	if usageSink, ok := metricSink.(metricsink.PodUsageObservingSink); ok {
+		usageSink.ObservePodUsage(namespaceUsage)
+	}
+
+	// track the fraction of the scraped nodes' capacity covered by fresh metrics, where
+	// a node scraped in the latest cycle has metrics at most about a cycle old, while the
+	// last-known metrics served for nodes which couldn't be scraped are older
+	freshFor := 2 * o.MetricResolution
+	if o.MaxMetricResolution != 0 {
+		freshFor = 2 * o.MaxMetricResolution
+	}
+	capacityCoverage := coverage.NewTracker(informerFactory.Core().V1().Nodes().Lister(), scrapedNodes, freshFor, o.MinCapacityCoverage)
+	if observingSink, ok := metricSink.(metricsink.NodeObservingSink); ok {
+		observingSink.ObserveNodes(capacityCoverage)
+	}
 
-	sourceProvider := summary.NewSummaryProvider(informerFactory.Core().V1().Nodes().Lister(), kubeletClient, addrResolver)
-	scrapeTimeout := time.Duration(float64(o.MetricResolution) * 0.90) // scrape timeout is 90% of the scrape interval
-	sources.RegisterDurationMetrics(scrapeTimeout)
-	sourceManager := sources.NewSourceManager(sourceProvider, scrapeTimeout)
+	// track the fraction of running pods with fresh metrics, unless partitioned, since then
+	// this replica only has the metrics of its share of them
+	var podCompleteness *podcoverage.Tracker
+	if nodeRouter == nil {
+		podCompleteness = podcoverage.NewTracker(podcoverage.Config{
+			Pods:       informerFactory.Core().V1().Pods().Lister(),
+			Nodes:      informerFactory.Core().V1().Nodes().Lister(),
+			NodeFilter: scrapedNodes,
+			Namespaces: servedNamespaces,
+			MaxAge:     freshFor,
+			Min:        o.MinPodMetricsCompleteness,
+		})
+		if observingSink, ok := metricSink.(metricsink.PodObservingSink); ok {
+			observingSink.ObservePods(podCompleteness)
+		}
+	}
 
-	// set up the in-memory sink and provider
-	metricSink, metricsProvider := sink.NewSinkProvider()
+	// track whether the pods targeted by HPAs have fresh metrics, only watching HPAs if enabled
+	var hpaCoverage *hpacoverage.Tracker
+	if o.HPACoverageMetrics {
+		hpaCoverage = hpacoverage.NewTracker(hpacoverage.Config{
+			HPAs:            informerFactory.Autoscaling().V1().HorizontalPodAutoscalers(),
+			Pods:            informerFactory.Core().V1().Pods().Lister(),
+			Nodes:           informerFactory.Core().V1().Nodes().Lister(),
+			NodeFilter:      scrapedNodes,
+			Namespaces:      servedNamespaces,
+			Resolve:         hpacoverage.NewScaleSelectorResolver(kubeClient.CoreV1().RESTClient(), kubeClient.Discovery()),
+			MaxAge:          freshFor,
+			RefreshInterval: o.HPASelectorRefreshInterval,
+		})
+		if observingSink, ok := metricSink.(metricsink.PodObservingSink); ok {
+			observingSink.ObservePods(hpaCoverage)
+		}
+	}
 
-	// set up the general manager
-	manager.RegisterDurationMetrics(o.MetricResolution)
-	mgr := manager.NewManager(sourceManager, metricSink, o.MetricResolution)
+	// bound the memory used by the stored metrics, evicting terminated pods first
+	podLister := informerFactory.Core().V1().Pods().Lister()
+	setMemoryLimit := func(bytes int64) {
+		if boundedSink, ok := metricSink.(metricsink.MemoryBoundedSink); ok {
+			boundedSink.SetMemoryLimit(metricsink.MemoryLimit{
+				Bytes:    bytes,
+				Priority: priorityNamespaces,
+				PodPhase: func(namespace, name string) (corev1.PodPhase, bool) {
+					pod, err := podLister.Pods(namespace).Get(name)
+					if err != nil {
+						return "", false
+					}
+					return pod.Status.Phase, true
+				},
+			})
+		}
+	}
+	setMemoryLimit(o.StorageMemoryLimitBytes)
+	if cappedSink, ok := metricSink.(metricsink.NamespaceCappedSink); ok {
+		cappedSink.SetNamespaceCap(metricsink.NamespaceCap{PodsPerNamespace: o.StoragePodsPerNamespaceLimit, Priority: priorityNamespaces})
+	}
+	if smoothingSink, ok := metricSink.(metricsink.SmoothingSink); ok {
+		smoothingSink.SetSmoothingHalfLife(o.StorageSmoothingHalfLife)
+	}
 
-	// inject the providers into the config
-	config.ProviderConfig.Node = metricsProvider
-	config.ProviderConfig.Pod = metricsProvider
+	// configure the general manager
+	mgr := srv.Manager()
+	if o.MaxMetricResolution != 0 {
+		mgr.EnableAutoResolution(o.MaxMetricResolution, o.MetricResolutionOverrunCycles)
+	}
+	if o.WarmStartScrapeCosts {
+		// aged, and saved, at the resolution as stretched
+		warmStart.TrackScrapeCosts(scrapeOrdering.(sources.CostEstimator), mgr.EffectiveResolution)
+	}
+	mgr.EnableLivenessCheck(o.LivenessCycleMultiplier, o.LivenessCommitMultiplier)
+	if o.ResumeDetectionThreshold != 0 {
+		mgr.EnableResumeDetection(o.ResumeDetectionThreshold, manager.ReadClocks)
+	}
+	if o.GCAfterCommit {
+		mgr.EnableGCAfterCommit()
+	}
+	if tunablesWatcher != nil {
+		mgr.ReloadTunables(tunablesWatcher, func(cfg tuning.Config) {
+			setMemoryLimit(cfg.StorageMemoryLimitBytes)
+		})
+	}
 
-	// complete the config to get an API server
-	server, err := config.Complete(informerFactory).New()
+	// configure the providers further
+	config.ProviderConfig.NodeRouter = nodeRouter
+	config.ProviderConfig.NodeLabels = o.PropagatedNodeLabels
+	config.ProviderConfig.ServeUnmatchedPods = o.ServeUnmatchedPods
+	config.ProviderConfig.ServeProvenance = o.ServeProvenance
+	config.ProviderConfig.ServePodNodeNames = o.ServePodNodeNames
+	if o.ServeUnavailableNodes {
+		config.ProviderConfig.UnavailableNodes = func(node string) (time.Time, bool) {
+			status, ok := scrapeStatuses.Get(node)
+			return status.LastScrape, ok
+		}
+	}
+	config.ProviderConfig.Namespaces = servedNamespaces
+	if o.NamespaceAccessFiltering {
+		if config.GenericConfig.Authorization.Authorizer == nil {
+			glog.Warningf("not filtering lists across all namespaces by access, since authorization is disabled")
+		} else {
+			access := provider.NewNamespaceAccess(config.GenericConfig.Authorization.Authorizer, metrics.Resource("pods"), o.NamespaceAccessCacheTTL)
+			config.GenericConfig.Authorization.Authorizer = access
+			config.ProviderConfig.NamespaceAccess = access
+			namespaceUsage.FilterNamespaceAccess(access)
+		}
+	}
+	// authorize the debug endpoints, in place of the server's authorizer
+	debugConfig := debugauthz.Config{Delegate: config.GenericConfig.Authorization.Authorizer, CommonNames: o.DebugAuthorizationCommonNames}
+	if o.DebugAuthorizationTokenFile != "" {
+		token, err := ioutil.ReadFile(o.DebugAuthorizationTokenFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the debug authorization token: %v", err)
+		}
+		debugConfig.Token = strings.TrimSpace(string(token))
+	}
+	if o.DebugAuthorizationMode == debugauthz.ModeClientCert && !o.DisableAuthForTesting {
+		// the client CA the API server authenticates client certificates with, which may be
+		// looked up in the cluster
+		authnConfig, err := o.Authentication.ToAuthenticationConfig()
+		if err != nil {
+			return fmt.Errorf("unable to find the client CA to verify the client certificates of debug requests against: %v", err)
+		}
+		if authnConfig.ClientCAFile != "" {
+			if debugConfig.ClientCAs, err = certutil.NewPool(authnConfig.ClientCAFile); err != nil {
+				return fmt.Errorf("unable to load the client CA to verify the client certificates of debug requests against: %v", err)
+			}
+		}
+	}
+	debugAuthorizer, err := debugauthz.New(o.DebugAuthorizationMode, debugConfig)
 	if err != nil {
+		glog.Errorf("denying all access to the debug endpoints: %v", err)
+	}
+	debugGuard := debugauthz.NewGuard(o.DebugAuthorizationMode, debugAuthorizer)
+	if config.GenericConfig.Authorization.Authorizer != nil {
+		config.GenericConfig.Authorization.Authorizer = debugGuard.Defer(config.GenericConfig.Authorization.Authorizer)
+	}
+	config.ProviderConfig.InflightLimiter = provider.NewInflightLimiter(o.MaxInflightGets, o.MaxInflightLists, o.InflightQueueTimeout)
+	config.ProviderConfig.ResponseCompression = &provider.ResponseCompression{MinBytes: o.ResponseCompressionMinBytes}
+	if o.CachingHeaders {
+		config.ProviderConfig.UntilNextCommit = mgr.UntilNextCommit
+	}
+	config.Capabilities = &capabilities.Options{
+		MetricResolution:    o.MetricResolution,
+		EffectiveResolution: mgr.EffectiveResolution,
+		Features: capabilities.Features{
+			CachingHeaders:     o.CachingHeaders,
+			UnmatchedPods:      o.ServeUnmatchedPods,
+			UnavailableNodes:   o.ServeUnavailableNodes,
+			NamespaceAllowlist: servedNamespaces != nil,
+			NodePartitioning:   nodeRouter != nil,
+			PageFaultRates:     o.PageFaultRates,
+			CPUThrottlingRates: o.CPUThrottlingRates,
+			AcceleratorStats:   o.AcceleratorStats,
+			SwapStats:          o.SwapStats,
+			PodUsageCorrection: o.PodUsageTolerance > 0,
+			UsageSmoothing:     o.StorageSmoothingHalfLife > 0,
+			NamespaceAccess:    config.ProviderConfig.NamespaceAccess != nil,
+			PodMemoryOverhead:  o.PodMemoryOverhead,
+			Provenance:         o.ServeProvenance,
+			PodNodeNames:       o.ServePodNodeNames,
+		},
+	}
+
+	// once the node informer syncs (diagnosing why it hasn't, e.g. missing RBAC, if it doesn't)
+	srv.AddSyncedHook(func() error {
+		if insecureNodes != nil {
+			// after the node informer syncs, so that the nodes matching the selector are listed
+			insecureNodes.Warn()
+		}
+
+		// check that the Kubelets can be scraped before serving, now that the nodes are listed
+		_, err := preflight.Run(context.Background(), informerFactory.Core().V1().Nodes().Lister(), addrResolver, srv.KubeletClient(), preflight.Options{
+			Mode:       preflight.Mode(o.Preflight),
+			Nodes:      o.PreflightNodes,
+			Timeout:    o.PreflightTimeout,
+			NodeFilter: scrapedNodes,
+			// probing the same candidate addresses as scrapes
+			AddressFallback: o.KubeletAddressFallback,
+		})
 		return err
+	})
+
+	srv.AddServingHook(func(metricsServer *apiserver.MetricsServer) error {
+		// add health checks, besides those of the scrape loop and node informer
+		metricsServer.AddHealthzChecks(healthz.NamedCheck("capacity-coverage", capacityCoverage.Check))
+		if podCompleteness != nil {
+			metricsServer.AddHealthzChecks(healthz.NamedCheck("pod-metrics-completeness", podCompleteness.Check))
+		}
+
+		// serve the usage aggregated by namespace
+		metricsServer.GenericAPIServer.Handler.NonGoRestfulMux.Handle(nsusage.Path, namespaceUsage)
+
+		// add debug endpoints, each authorized by the debug authorization mode
+		handleDebug := func(path string, handler http.Handler) {
+			metricsServer.GenericAPIServer.Handler.NonGoRestfulMux.Handle(path, debugGuard.Handler(path, handler))
+		}
+		handleDebug("/debug/scrape-status", scrapeStatuses)
+		handleDebug("/debug/pod-counts", podCounts)
+		handleDebug("/debug/loglevel", loglevel.Default)
+		if bodyCapture != nil {
+			handleDebug("/debug/capture", bodyCapture)
+		}
+		if hpaCoverage != nil {
+			handleDebug("/debug/hpa-status", hpaCoverage)
+		}
+		return nil
+	})
+
+	// run everything
+	if tunablesWatcher != nil {
+		tunablesWatcher.RunUntil(stopCh)
 	}
+	summary.NewMetricsAgePublisher(scrapeStatuses, o.PerNodeMetricsAge).RunUntil(stopCh)
+	if hpaCoverage != nil {
+		hpaCoverage.RunUntil(stopCh)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return srv.Run(ctx)
+}
 
-	// add health checks
-	server.AddHealthzChecks(healthz.NamedCheck("healthz", mgr.CheckHealth))
+// applyKubeletTLS sets the TLS versions, cipher suites, and SAN policy of the given Kubelet client config.
+func (o MetricsServerOptions) applyKubeletTLS(kubeletConfig *summary.KubeletClientConfig) error {
+	var err error
+	if kubeletConfig.TLSMinVersion, err = summary.ParseTLSMinVersion(o.KubeletTLSMinVersion); err != nil {
+		return err
+	}
+	if kubeletConfig.TLSCipherSuites, err = summary.ParseTLSCipherSuites(o.KubeletTLSCipherSuites); err != nil {
+		return err
+	}
+	kubeletConfig.SANPolicy, err = summary.ParseSANPolicy(o.KubeletTLSSANPolicy)
+	return err
+}
+
+// loadClientConfig loads the config of the client for the API server, from --kubeconfig
+// if set, or the in-cluster config otherwise.
+func (o MetricsServerOptions) loadClientConfig() (*rest.Config, error) {
+	if len(o.Kubeconfig) > 0 {
+		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: o.Kubeconfig}
+		loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+		return loader.ClientConfig()
+	}
+	return rest.InClusterConfig()
+}
+
+// validateTunables checks reloaded parameters against the flags they depend on, which aren't reloadable.
+func (o MetricsServerOptions) validateTunables(cfg tuning.Config) error {
+	if err := tuning.CheckResolution(cfg.MetricResolution, o.KubeletHousekeepingInterval, o.ForceMetricResolution); err != nil {
+		return err
+	}
+	if o.MaxMetricResolution != 0 && o.MaxMetricResolution <= cfg.MetricResolution {
+		return fmt.Errorf("max metric resolution (%s) must be longer than the metric resolution (%s)", o.MaxMetricResolution, cfg.MetricResolution)
+	}
+	if v := checkHedgeDelayWithin(o.KubeletHedgeDelay, cfg.ScrapeTimeout); v != nil {
+		return &ValidationError{Violations: []Violation{*v}}
+	}
+	return nil
+}
+
+// partitioner sets up partitioning of the nodes between replicas, according to the partition options.
+func (o MetricsServerOptions) partitioner(clientConfig *rest.Config, kubeClient kubernetes.Interface, stopCh <-chan struct{}) (*partition.Partitioner, *partition.Router, error) {
+	parts := strings.Split(o.PartitionEndpoints, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, nil, fmt.Errorf("invalid partition endpoints %q, must be namespace/name", o.PartitionEndpoints)
+	}
+	if len(o.PartitionSelfIP) == 0 {
+		return nil, nil, fmt.Errorf("the IP of this replica must be set with --partition-self-ip (or the POD_IP environment variable) to partition nodes")
+	}
+
+	// authenticate to other replicas as ourselves, but verify their serving certificates, not the API server's
+	peerConfig := rest.CopyConfig(clientConfig)
+	peerConfig.TLSClientConfig.CAFile = o.PartitionPeerCAFile
+	peerConfig.TLSClientConfig.CAData = nil
+	peerConfig.TLSClientConfig.ServerName = o.PartitionPeerServerName
+	peerConfig.TLSClientConfig.Insecure = o.PartitionPeerInsecureTLS
+	transport, err := rest.TransportFor(peerConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to construct a transport to connect to other replicas: %v", err)
+	}
 
-	// run everything (the apiserver runs the shared informer factory for us)
-	mgr.RunUntil(stopCh)
-	return server.GenericAPIServer.PrepareRun().Run(stopCh)
+	// keep scraping nodes handed off to other replicas for a cycle, so that there's no gap
+	partitioner := partition.NewPartitioner(o.PartitionSelfIP, o.MetricResolution)
+	partitioner.WatchEndpoints(kubeClient, parts[0], parts[1], stopCh)
+	return partitioner, partition.NewRouter(partitioner, transport, o.PartitionProxyTimeout), nil
 }
@@ -0,0 +1,1039 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/debugauthz"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	"github.com/kubernetes-incubator/metrics-server/pkg/preflight"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+)
+
+// Many options only make sense in combination with others, and invalid combinations would
+// otherwise only surface at the first scrape, if at all.  So the options are checked against
+// every rule before anything is started, and all of the violations are reported at once, each
+// with a hint on how to fix it.  Each rule checks a single constraint.
+
+// defaultKubeletPort is the port Kubelets serve their API on by default.
+const defaultKubeletPort = 10250
+
+// Violation is a constraint on the options which they don't meet.
+type Violation struct {
+	// Problem describes what's wrong.
+	Problem string
+	// Hint suggests how to fix it.
+	Hint string
+}
+
+// ValidationError lists every constraint on the options which they don't meet.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	if len(e.Violations) == 1 {
+		b.WriteString("invalid options (1 problem):")
+	} else {
+		fmt.Fprintf(&b, "invalid options (%d problems):", len(e.Violations))
+	}
+	for _, v := range e.Violations {
+		fmt.Fprintf(&b, "\n  - %s", v.Problem)
+		if v.Hint != "" {
+			fmt.Fprintf(&b, "\n    hint: %s", v.Hint)
+		}
+	}
+	return b.String()
+}
+
+// optionsRule checks a single constraint on the options, returning its violation, if any.
+type optionsRule func(o *MetricsServerOptions) *Violation
+
+// optionsRules are the rules the options are validated against, in the order they're reported.
+var optionsRules = []optionsRule{
+	checkNodeNameVerification,
+	checkSummaryDecoder,
+	checkSkippedSubtrees,
+	checkExcludedContainers,
+	checkInformerSyncTimeout,
+	checkPreflight,
+	checkPreflightNodes,
+	checkPreflightTimeout,
+	checkMetricResolution,
+	checkMaxMetricResolution,
+	checkOverrunCycles,
+	checkScrapeOrder,
+	checkScrapePhaseMaxDrift,
+	checkLivenessMultipliers,
+	checkResumeDetectionThreshold,
+	checkKubeletPort,
+	checkKubeletPortWithProxy,
+	checkAddressFallbackTTL,
+	checkAddressFallbackWithProxy,
+	checkHedgesPerCycle,
+	checkHedgeDelay,
+	checkHedgingWithProxy,
+	checkMaxConcurrentRequestsPerNode,
+	checkProxyBreakerFailureRate,
+	checkProxyBreakerProbes,
+	checkProxyBreakerWithoutProxy,
+	checkAPIServerHostRefresh,
+	checkKubeletTLS,
+	checkKubeletSANPolicyCombination,
+	checkInsecureTLSNodesCombination,
+	checkInsecureTLSNodeNames,
+	checkInsecureTLSNodeSelector,
+	checkKubeletNodeProfiles,
+	checkKubeletReadOnlyPort,
+	checkKubeletProfilesCombination,
+	checkInsecureMigration,
+	checkSPIFFESocket,
+	checkSPIFFETrustDomain,
+	checkInflightLimits,
+	checkCachingHeaders,
+	checkPartitionOptions,
+	checkPartitionProxyTimeout,
+	checkStorageMemoryLimit,
+	checkStoragePodsPerNamespaceLimit,
+	checkStorageSmoothing,
+	checkPodCountTopNamespaces,
+	checkPodUtilizationTopNamespaces,
+	checkScrapeFailureEvents,
+	checkScrapeAuditLog,
+	checkPageFaultRateMaxGap,
+	checkCPURateConsistencyRatio,
+	checkWarmStart,
+	checkWarmStartScrapeCosts,
+	checkPodTimestampLagThreshold,
+	checkStaleSummaryWarningThreshold,
+	checkPodUsageTolerance,
+	checkMinCapacityCoverage,
+	checkMinPodMetricsCompleteness,
+	checkHPACoverageMetrics,
+	checkStandalone,
+	checkStandaloneClientAuth,
+	checkStandaloneIgnoredOptions,
+	checkNamespaceSelectors,
+	checkNamespaceAccessCacheTTL,
+	checkDebugAuthorization,
+	checkDebugCapture,
+	checkComponentLogLevels,
+	checkRuntimeLogLevelTTL,
+	checkSoftMemoryLimitRatio,
+	checkGCPercent,
+}
+
+// Validate checks the options against every rule, returning a ValidationError
+// listing all of the violations, if there are any.
+func (o MetricsServerOptions) Validate() error {
+	var violations []Violation
+	for _, rule := range optionsRules {
+		if v := rule(&o); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: violations}
+}
+
+func checkNodeNameVerification(o *MetricsServerOptions) *Violation {
+	mode := summary.NodeNameVerification(o.NodeNameVerification)
+	if mode == summary.NodeNameVerificationEnforce || mode == summary.NodeNameVerificationWarn {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("invalid node name verification mode %q, must be %q or %q", o.NodeNameVerification, summary.NodeNameVerificationEnforce, summary.NodeNameVerificationWarn),
+		Hint:    "set --node-name-verification to one of the modes listed",
+	}
+}
+
+func checkSummaryDecoder(o *MetricsServerOptions) *Violation {
+	decoder := summary.SummaryDecoder(o.KubeletSummaryDecoder)
+	if decoder == summary.SummaryDecoderFast || decoder == summary.SummaryDecoderFull {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("invalid Kubelet summary decoder %q, must be %q or %q", o.KubeletSummaryDecoder, summary.SummaryDecoderFast, summary.SummaryDecoderFull),
+		Hint:    "set --kubelet-summary-decoder to one of the decoders listed",
+	}
+}
+
+func checkSkippedSubtrees(o *MetricsServerOptions) *Violation {
+	if _, err := summary.NewSubtreeSkips(o.KubeletSummarySkippedSubtrees, false); err != nil {
+		return &Violation{
+			Problem: err.Error(),
+			Hint:    "only list subtrees that can be skipped in --kubelet-summary-skipped-subtrees: " + strings.Join(summary.SkippableSubtrees(), ", "),
+		}
+	}
+	return nil
+}
+
+func checkExcludedContainers(o *MetricsServerOptions) *Violation {
+	if len(o.ExcludedContainers) == 0 {
+		return nil
+	}
+	if _, err := summary.NewContainerFilter(o.ExcludedContainers, summary.ContainerExclusionMode(o.ExcludedContainerMode)); err != nil {
+		return &Violation{
+			Problem: err.Error(),
+			Hint:    "fix the names and patterns in --excluded-containers, and the mode in --excluded-container-mode",
+		}
+	}
+	return nil
+}
+
+func checkInformerSyncTimeout(o *MetricsServerOptions) *Violation {
+	if o.InformerSyncTimeout > 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("informer sync timeout must be positive, not %s", o.InformerSyncTimeout),
+		Hint:    "set --informer-sync-timeout to how long to wait for the node informer at startup, e.g. 1m",
+	}
+}
+
+func checkPreflight(o *MetricsServerOptions) *Violation {
+	switch preflight.Mode(o.Preflight) {
+	case preflight.ModeStrict, preflight.ModeWarn, preflight.ModeOff:
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("invalid preflight mode %q, must be %q, %q, or %q", o.Preflight, preflight.ModeStrict, preflight.ModeWarn, preflight.ModeOff),
+		Hint:    "set --preflight to one of the modes listed",
+	}
+}
+
+func checkPreflightNodes(o *MetricsServerOptions) *Violation {
+	if o.PreflightNodes > 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("preflight nodes must be positive, not %d", o.PreflightNodes),
+		Hint:    "set --preflight-nodes to the number of nodes to check at startup, or set --preflight=off to skip the checks",
+	}
+}
+
+func checkPreflightTimeout(o *MetricsServerOptions) *Violation {
+	if o.PreflightTimeout > 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("preflight timeout must be positive, not %s", o.PreflightTimeout),
+		Hint:    "set --preflight-timeout to how long the checks may delay startup, e.g. 15s",
+	}
+}
+
+func checkMetricResolution(o *MetricsServerOptions) *Violation {
+	if err := tuning.CheckResolution(o.MetricResolution, o.KubeletHousekeepingInterval, o.ForceMetricResolution); err != nil {
+		minimum := o.KubeletHousekeepingInterval
+		if o.MetricResolution < tuning.MinMetricResolution {
+			minimum = tuning.MinMetricResolution
+		}
+		return &Violation{Problem: err.Error(), Hint: fmt.Sprintf("raise --metric-resolution to at least %s", minimum)}
+	}
+	return nil
+}
+
+func checkMaxMetricResolution(o *MetricsServerOptions) *Violation {
+	if o.MaxMetricResolution == 0 || o.MaxMetricResolution > o.MetricResolution {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("max metric resolution (%s) must be longer than the metric resolution (%s)", o.MaxMetricResolution, o.MetricResolution),
+		Hint:    "raise --max-metric-resolution above --metric-resolution, or leave it unset to never stretch the resolution",
+	}
+}
+
+func checkOverrunCycles(o *MetricsServerOptions) *Violation {
+	if o.MaxMetricResolution == 0 || o.MetricResolutionOverrunCycles >= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("metric resolution overrun cycles must be at least 1, not %d", o.MetricResolutionOverrunCycles),
+		Hint:    "set --metric-resolution-overrun-cycles to the number of overrunning cycles after which to stretch the resolution",
+	}
+}
+
+func checkScrapeOrder(o *MetricsServerOptions) *Violation {
+	if o.ScrapeOrder == sources.ScrapeOrderCost || o.ScrapeOrder == sources.ScrapeOrderRandom {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("invalid scrape order %q, must be %q or %q", o.ScrapeOrder, sources.ScrapeOrderCost, sources.ScrapeOrderRandom),
+		Hint:    "set --scrape-order to one of the orders listed",
+	}
+}
+
+func checkScrapePhaseMaxDrift(o *MetricsServerOptions) *Violation {
+	if o.ScrapePhaseMaxDrift >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("scrape phase max drift must not be negative, not %s", o.ScrapePhaseMaxDrift),
+		Hint:    "set --scrape-phase-max-drift to zero to keep each node's scrape at a fixed phase",
+	}
+}
+
+func checkLivenessMultipliers(o *MetricsServerOptions) *Violation {
+	if (o.LivenessCycleMultiplier == 0 || o.LivenessCycleMultiplier >= 1) && (o.LivenessCommitMultiplier == 0 || o.LivenessCommitMultiplier >= 1) {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("liveness multipliers must be zero (disabled) or at least 1, not %v and %v", o.LivenessCycleMultiplier, o.LivenessCommitMultiplier),
+		Hint:    "a liveness check failing within a single metric resolution would fail on every slow cycle",
+	}
+}
+
+func checkResumeDetectionThreshold(o *MetricsServerOptions) *Violation {
+	if o.ResumeDetectionThreshold == 0 || o.ResumeDetectionThreshold >= manager.ResumeCheckInterval {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("resume detection threshold must be zero (disabled) or at least %s, not %s", manager.ResumeCheckInterval, o.ResumeDetectionThreshold),
+		Hint:    "a threshold within ordinary scheduling delays and wall clock adjustments would detect resumes that never happened",
+	}
+}
+
+func checkKubeletPort(o *MetricsServerOptions) *Violation {
+	if o.KubeletPort > 0 && o.KubeletPort <= 65535 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("Kubelet port must be between 1 and 65535, not %d", o.KubeletPort),
+		Hint:    fmt.Sprintf("set --kubelet-port to the port the Kubelets serve on, usually %d", defaultKubeletPort),
+	}
+}
+
+func checkKubeletPortWithProxy(o *MetricsServerOptions) *Violation {
+	if !o.UseAPIServerProxy || o.KubeletPort == defaultKubeletPort {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("the Kubelet port (%d) isn't used with --use-apiserver-proxy, which connects to the port each node reports for its Kubelet", o.KubeletPort),
+		Hint:    "drop --kubelet-port, or --use-apiserver-proxy to connect to the Kubelets directly",
+	}
+}
+
+func checkAddressFallbackTTL(o *MetricsServerOptions) *Violation {
+	if !o.KubeletAddressFallback || o.KubeletAddressFallbackTTL > 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("kubelet address fallback TTL must be positive, not %s", o.KubeletAddressFallbackTTL),
+		Hint:    "set --kubelet-address-fallback-ttl to how long to keep connecting to the address found working before retrying the preferred one",
+	}
+}
+
+func checkAddressFallbackWithProxy(o *MetricsServerOptions) *Violation {
+	if !o.KubeletAddressFallback || !o.UseAPIServerProxy {
+		return nil
+	}
+	return &Violation{
+		Problem: "kubelet addresses are never fallen back through with --use-apiserver-proxy, since the API server chooses the address to connect to",
+		Hint:    "drop --kubelet-address-fallback, or --use-apiserver-proxy to connect to the Kubelets directly",
+	}
+}
+
+func checkHedgesPerCycle(o *MetricsServerOptions) *Violation {
+	if o.KubeletHedgeDelay == 0 || o.KubeletMaxHedgesPerCycle >= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("kubelet max hedges per cycle must be at least 1, not %d", o.KubeletMaxHedgesPerCycle),
+		Hint:    "drop --kubelet-hedge-delay to disable hedging, rather than capping it at zero hedges",
+	}
+}
+
+func checkHedgeDelay(o *MetricsServerOptions) *Violation {
+	return checkHedgeDelayWithin(o.KubeletHedgeDelay, tuning.ScrapeTimeoutFor(o.MetricResolution))
+}
+
+// checkHedgeDelayWithin checks that the given hedge delay is shorter than the given scrape
+// timeout, which it's also checked against whenever the timeout is reloaded.
+func checkHedgeDelayWithin(hedgeDelay, scrapeTimeout time.Duration) *Violation {
+	if hedgeDelay <= 0 || hedgeDelay < scrapeTimeout {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("kubelet hedge delay (%s) must be shorter than the scrape timeout (%s), or scrapes time out before they're ever hedged", hedgeDelay, scrapeTimeout),
+		Hint:    "lower --kubelet-hedge-delay, or raise the metric resolution, which the scrape timeout follows",
+	}
+}
+
+func checkHedgingWithProxy(o *MetricsServerOptions) *Violation {
+	if o.KubeletHedgeDelay == 0 || !o.UseAPIServerProxy {
+		return nil
+	}
+	return &Violation{
+		Problem: "summary requests are never hedged with --use-apiserver-proxy, since every proxied request also loads the API server",
+		Hint:    "drop --kubelet-hedge-delay, or --use-apiserver-proxy to connect to the Kubelets directly",
+	}
+}
+
+func checkMaxConcurrentRequestsPerNode(o *MetricsServerOptions) *Violation {
+	if o.KubeletMaxRequestsPerNode >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("kubelet max concurrent requests per node must not be negative, not %d", o.KubeletMaxRequestsPerNode),
+		Hint:    "set --kubelet-max-concurrent-requests-per-node to zero to leave requests to each Kubelet unlimited",
+	}
+}
+
+func checkProxyBreakerFailureRate(o *MetricsServerOptions) *Violation {
+	if o.ProxyBreakerFailureRate >= 0 && o.ProxyBreakerFailureRate <= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("API server proxy breaker failure rate must be between 0 and 1, not %v", o.ProxyBreakerFailureRate),
+		Hint:    "set --apiserver-proxy-breaker-failure-rate to the fraction of failed requests that opens the breaker, e.g. 0.5",
+	}
+}
+
+func checkProxyBreakerProbes(o *MetricsServerOptions) *Violation {
+	if o.ProxyBreakerFailureRate <= 0 || o.ProxyBreakerProbes >= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("API server proxy breaker probes must be at least 1, not %d", o.ProxyBreakerProbes),
+		Hint:    "a breaker without probes would never close again once opened",
+	}
+}
+
+func checkProxyBreakerWithoutProxy(o *MetricsServerOptions) *Violation {
+	if o.ProxyBreakerFailureRate <= 0 || o.UseAPIServerProxy {
+		return nil
+	}
+	return &Violation{
+		Problem: "the API server proxy circuit breaker only applies with --use-apiserver-proxy",
+		Hint:    "drop --apiserver-proxy-breaker-failure-rate, or set --use-apiserver-proxy",
+	}
+}
+
+func checkAPIServerHostRefresh(o *MetricsServerOptions) *Violation {
+	if o.APIServerHostRefreshInterval >= 0 && o.APIServerHostRefreshFailures >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("API server proxy host refresh interval and failures must not be negative, not %v and %d", o.APIServerHostRefreshInterval, o.APIServerHostRefreshFailures),
+		Hint:    "set --apiserver-proxy-host-refresh-interval or --apiserver-proxy-host-refresh-failures to zero to only re-resolve the API server's address the other way",
+	}
+}
+
+func checkKubeletTLS(o *MetricsServerOptions) *Violation {
+	if _, err := summary.ParseTLSMinVersion(o.KubeletTLSMinVersion); err != nil {
+		return &Violation{Problem: err.Error(), Hint: "set --kubelet-tls-min-version to a version such as VersionTLS12"}
+	}
+	if _, err := summary.ParseTLSCipherSuites(o.KubeletTLSCipherSuites); err != nil {
+		return &Violation{Problem: err.Error(), Hint: "only list the Go names of cipher suites in --kubelet-tls-cipher-suites"}
+	}
+	if _, err := summary.ParseSANPolicy(o.KubeletTLSSANPolicy); err != nil {
+		return &Violation{Problem: err.Error(), Hint: "set --kubelet-tls-san-policy to one of the policies listed, or leave it unset"}
+	}
+	return nil
+}
+
+func checkKubeletSANPolicyCombination(o *MetricsServerOptions) *Violation {
+	if o.KubeletTLSSANPolicy == "" {
+		return nil
+	}
+	if !o.UseAPIServerProxy && !o.InsecureKubeletTLS && !o.DeprecatedCompletelyInsecureKubelet && o.KubeletSPIFFETrustDomain == "" {
+		return nil
+	}
+	return &Violation{
+		Problem: "a Kubelet SAN policy can't be used with --use-apiserver-proxy, --kubelet-insecure-tls, --deprecated-kubelet-completely-insecure, or --kubelet-spiffe-trust-domain",
+		Hint:    "drop --kubelet-tls-san-policy, since the Kubelets' serving certificates then aren't verified against a CA by metrics-server",
+	}
+}
+
+func checkInsecureTLSNodesCombination(o *MetricsServerOptions) *Violation {
+	if len(o.InsecureKubeletTLSNodes) == 0 && o.InsecureKubeletTLSSelector == "" {
+		return nil
+	}
+	if !o.InsecureKubeletTLS && !o.DeprecatedCompletelyInsecureKubelet && !o.UseAPIServerProxy {
+		return nil
+	}
+	return &Violation{
+		Problem: "insecure Kubelet TLS nodes can't be used with --kubelet-insecure-tls, --deprecated-kubelet-completely-insecure, or --use-apiserver-proxy",
+		Hint:    "drop --kubelet-insecure-tls-nodes and --kubelet-insecure-tls-node-selector, or the other flags, which apply to every node",
+	}
+}
+
+func checkInsecureTLSNodeNames(o *MetricsServerOptions) *Violation {
+	for _, name := range o.InsecureKubeletTLSNodes {
+		if strings.TrimSpace(name) == "" {
+			return &Violation{
+				Problem: fmt.Sprintf("insecure Kubelet TLS nodes must all be named, not %q", strings.Join(o.InsecureKubeletTLSNodes, ",")),
+				Hint:    "remove the empty entries from --kubelet-insecure-tls-nodes",
+			}
+		}
+	}
+	return nil
+}
+
+func checkInsecureTLSNodeSelector(o *MetricsServerOptions) *Violation {
+	return checkSelector("--kubelet-insecure-tls-node-selector", o.InsecureKubeletTLSSelector)
+}
+
+func checkKubeletNodeProfiles(o *MetricsServerOptions) *Violation {
+	if _, err := summary.ParseNodeProfiles(o.KubeletNodeProfiles); err != nil {
+		return &Violation{
+			Problem: err.Error(),
+			Hint:    "list each node once in --kubelet-node-profiles, as node=profile, with one of the profiles secure, read-only, or proxy",
+		}
+	}
+	return nil
+}
+
+func checkKubeletReadOnlyPort(o *MetricsServerOptions) *Violation {
+	if o.KubeletReadOnlyPort > 0 && o.KubeletReadOnlyPort <= 65535 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("Kubelet read-only port must be between 1 and 65535, not %d", o.KubeletReadOnlyPort),
+		Hint:    fmt.Sprintf("set --kubelet-read-only-port to the port the Kubelets serve their read-only API on, usually %d", summary.DefaultReadOnlyPort),
+	}
+}
+
+func checkKubeletProfilesCombination(o *MetricsServerOptions) *Violation {
+	if len(o.KubeletNodeProfiles) == 0 && !o.KubeletProfileAnnotations {
+		return nil
+	}
+	if !o.DeprecatedCompletelyInsecureKubelet {
+		return nil
+	}
+	return &Violation{
+		Problem: "Kubelet profiles can't be used with --deprecated-kubelet-completely-insecure, which already scrapes every node over plain HTTP",
+		Hint:    "drop --deprecated-kubelet-completely-insecure, selecting the read-only profile for just the nodes needing it",
+	}
+}
+
+func checkInsecureMigration(o *MetricsServerOptions) *Violation {
+	if !o.KubeletInsecureMigration {
+		return nil
+	}
+	if !o.DeprecatedCompletelyInsecureKubelet {
+		return &Violation{
+			Problem: "migrating off --deprecated-kubelet-completely-insecure requires it to be set",
+			Hint:    "drop --kubelet-insecure-migration, since every Kubelet is already requested over HTTPS",
+		}
+	}
+	if o.UseAPIServerProxy {
+		return &Violation{
+			Problem: "migrating off --deprecated-kubelet-completely-insecure can't be used with --use-apiserver-proxy",
+			Hint:    "drop --kubelet-insecure-migration, since the API server connects to the Kubelets itself",
+		}
+	}
+	return nil
+}
+
+func checkSPIFFESocket(o *MetricsServerOptions) *Violation {
+	if o.KubeletSPIFFESocket == "" || (!o.UseAPIServerProxy && !o.DeprecatedCompletelyInsecureKubelet && !o.InsecureKubeletTLS) {
+		return nil
+	}
+	return &Violation{
+		Problem: "a SPIFFE Workload API socket can't be used with --use-apiserver-proxy, --deprecated-kubelet-completely-insecure, or --kubelet-insecure-tls",
+		Hint:    "drop --kubelet-spiffe-workload-api-socket, or the other flags, which don't verify Kubelet certificates against SVIDs",
+	}
+}
+
+func checkSPIFFETrustDomain(o *MetricsServerOptions) *Violation {
+	if o.KubeletSPIFFETrustDomain == "" || o.KubeletSPIFFESocket != "" {
+		return nil
+	}
+	return &Violation{
+		Problem: "a SPIFFE trust domain requires a SPIFFE Workload API socket",
+		Hint:    "set --kubelet-spiffe-workload-api-socket to the SPIFFE Workload API socket, e.g. of the SPIRE agent",
+	}
+}
+
+func checkInflightLimits(o *MetricsServerOptions) *Violation {
+	if o.MaxInflightGets >= 0 && o.MaxInflightLists >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("metrics API max in-flight gets and lists must not be negative, not %d and %d", o.MaxInflightGets, o.MaxInflightLists),
+		Hint:    "set --metrics-api-max-inflight-gets and --metrics-api-max-inflight-lists to zero to leave them unlimited",
+	}
+}
+
+func checkCachingHeaders(o *MetricsServerOptions) *Violation {
+	if !o.CachingHeaders || len(o.PartitionEndpoints) == 0 {
+		return nil
+	}
+	// other replicas' nodes are served from other snapshots, with other versions
+	return &Violation{
+		Problem: "metrics API caching headers can't be used with partition endpoints",
+		Hint:    "drop --metrics-api-caching-headers, or --partition-endpoints",
+	}
+}
+
+func checkPartitionOptions(o *MetricsServerOptions) *Violation {
+	if o.PartitionEndpoints != "" || (o.PartitionPeerCAFile == "" && o.PartitionPeerServerName == "") {
+		return nil
+	}
+	return &Violation{
+		Problem: "the partition peer CA file and server name are only used with partition endpoints",
+		Hint:    "set --partition-endpoints to partition the nodes between replicas, or drop --partition-peer-ca-file and --partition-peer-server-name",
+	}
+}
+
+func checkPartitionProxyTimeout(o *MetricsServerOptions) *Violation {
+	if o.PartitionEndpoints == "" || (o.PartitionProxyTimeout > 0 && o.PartitionProxyTimeout < o.MetricResolution) {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("the partition proxy timeout (%s) must be positive, and shorter than the metric resolution (%s)", o.PartitionProxyTimeout, o.MetricResolution),
+		Hint:    "lower --partition-proxy-timeout, so that requests for other replicas' nodes fail over to local data within a cycle",
+	}
+}
+
+func checkStorageMemoryLimit(o *MetricsServerOptions) *Violation {
+	if o.StorageMemoryLimitBytes >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("storage memory limit must not be negative, not %d", o.StorageMemoryLimitBytes),
+		Hint:    "set --storage-memory-limit-bytes to zero to leave storage unlimited",
+	}
+}
+
+func checkStoragePodsPerNamespaceLimit(o *MetricsServerOptions) *Violation {
+	if o.StoragePodsPerNamespaceLimit >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("storage pods per namespace limit must not be negative, not %d", o.StoragePodsPerNamespaceLimit),
+		Hint:    "set --storage-pods-per-namespace-limit to zero to leave namespaces uncapped",
+	}
+}
+
+func checkStorageSmoothing(o *MetricsServerOptions) *Violation {
+	if o.StorageSmoothingHalfLife < 0 {
+		return &Violation{
+			Problem: fmt.Sprintf("storage smoothing half-life must not be negative, not %s", o.StorageSmoothingHalfLife),
+			Hint:    "set --storage-smoothing-half-life to zero to disable smoothing",
+		}
+	}
+	if o.StorageSmoothingHalfLife == 0 || len(o.PartitionEndpoints) == 0 {
+		return nil
+	}
+	// requests for other replicas' nodes are proxied without the smoothing parameter
+	return &Violation{
+		Problem: "storage smoothing can't be used with partition endpoints",
+		Hint:    "drop --storage-smoothing-half-life, or --partition-endpoints",
+	}
+}
+
+func checkPodCountTopNamespaces(o *MetricsServerOptions) *Violation {
+	if o.PodCountTopNamespaces >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("pod count top namespaces must not be negative, not %d", o.PodCountTopNamespaces),
+		Hint:    "set --pod-count-top-namespaces to zero to only count pods in total",
+	}
+}
+
+func checkPodUtilizationTopNamespaces(o *MetricsServerOptions) *Violation {
+	if o.PodUtilizationTopNamespaces >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("pod utilization top namespaces must not be negative, not %d", o.PodUtilizationTopNamespaces),
+		Hint:    "set --pod-utilization-top-namespaces to zero to leave out the per-namespace breakdown",
+	}
+}
+
+func checkScrapeFailureEvents(o *MetricsServerOptions) *Violation {
+	if !o.ScrapeFailureEvents || (o.ScrapeFailureEventThreshold >= 1 && o.ScrapeFailureEventWindow > 0) {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("the scrape failure event threshold must be at least 1, and the aggregation window positive, not %d and %s", o.ScrapeFailureEventThreshold, o.ScrapeFailureEventWindow),
+		Hint:    "fix --scrape-failure-event-threshold and --scrape-failure-event-aggregation-window, or set --scrape-failure-events=false",
+	}
+}
+
+func checkScrapeAuditLog(o *MetricsServerOptions) *Violation {
+	if o.ScrapeAuditLogMaxSizeBytes >= 0 && o.ScrapeAuditLogMaxBackups >= 0 && o.ScrapeAuditLogQueueSize >= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("the scrape audit log max size and backups must not be negative, and its queue size must be at least 1, not %d, %d, and %d", o.ScrapeAuditLogMaxSizeBytes, o.ScrapeAuditLogMaxBackups, o.ScrapeAuditLogQueueSize),
+		Hint:    "fix --scrape-audit-log-max-size-bytes, --scrape-audit-log-max-backups, and --scrape-audit-log-queue-size",
+	}
+}
+
+func checkPageFaultRateMaxGap(o *MetricsServerOptions) *Violation {
+	if o.PageFaultRateMaxGapCycles >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("page fault rate max gap cycles must not be negative, not %d", o.PageFaultRateMaxGapCycles),
+		Hint:    "set --page-fault-rate-max-gap-cycles to zero to report rates over any gap",
+	}
+}
+
+func checkCPURateConsistencyRatio(o *MetricsServerOptions) *Violation {
+	if o.CPURateConsistencyRatio == 0 || o.CPURateConsistencyRatio > 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("CPU rate consistency ratio must be zero (disabled) or more than 1, not %v", o.CPURateConsistencyRatio),
+		Hint:    "the ratio is between the larger and smaller rate, e.g. 2 flags rates that differ twofold",
+	}
+}
+
+func checkWarmStart(o *MetricsServerOptions) *Violation {
+	switch {
+	case o.WarmStartFile == "":
+		return nil
+	case o.CPURateConsistencyRatio == 0 && !o.WarmStartScrapeCosts:
+		return &Violation{
+			Problem: "a warm start file requires checking CPU rate consistency, or saving scrape costs",
+			Hint:    "set --cpu-rate-consistency-ratio or --warm-start-scrape-costs, since only the rates it derives, and the scrape cost estimates, are saved to it",
+		}
+	case o.WarmStartMaxAge < 0:
+		return &Violation{
+			Problem: fmt.Sprintf("warm start max age must not be negative, not %v", o.WarmStartMaxAge),
+			Hint:    "set --warm-start-max-age to zero to restore baselines of any age",
+		}
+	case o.WarmStartSaveInterval <= 0:
+		return &Violation{
+			Problem: fmt.Sprintf("warm start save interval must be positive, not %v", o.WarmStartSaveInterval),
+			Hint:    "set --warm-start-save-interval to e.g. " + summary.DefaultWarmStartSaveInterval.String(),
+		}
+	}
+	return nil
+}
+
+func checkWarmStartScrapeCosts(o *MetricsServerOptions) *Violation {
+	switch {
+	case !o.WarmStartScrapeCosts:
+		return nil
+	case o.WarmStartFile == "":
+		return &Violation{
+			Problem: "saving scrape costs requires a warm start file",
+			Hint:    "set --warm-start-file to a file on a volume that outlives the pod",
+		}
+	case o.ScrapeOrder != sources.ScrapeOrderCost:
+		return &Violation{
+			Problem: fmt.Sprintf("saving scrape costs requires the %q scrape order, not %q", sources.ScrapeOrderCost, o.ScrapeOrder),
+			Hint:    "set --scrape-order=" + sources.ScrapeOrderCost + ", since only it estimates the costs of scrapes",
+		}
+	}
+	return nil
+}
+
+func checkPodTimestampLagThreshold(o *MetricsServerOptions) *Violation {
+	if o.PodTimestampLagThreshold >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("pod timestamp lag threshold must not be negative, not %v", o.PodTimestampLagThreshold),
+		Hint:    "set --pod-timestamp-lag-threshold to zero to stop calling out lagging pods",
+	}
+}
+
+func checkStaleSummaryWarningThreshold(o *MetricsServerOptions) *Violation {
+	if o.StaleSummaryWarningThreshold >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("stale summary warning threshold must not be negative, not %d", o.StaleSummaryWarningThreshold),
+		Hint:    "set --stale-summary-warning-threshold to zero to disable the warning",
+	}
+}
+
+func checkPodUsageTolerance(o *MetricsServerOptions) *Violation {
+	if o.PodUsageTolerance >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("pod usage tolerance must not be negative, not %v", o.PodUsageTolerance),
+		Hint:    "set --pod-usage-tolerance to the fraction container usage may exceed pod-level usage by, e.g. 0.1, or zero to disable the check",
+	}
+}
+
+func checkStandalone(o *MetricsServerOptions) *Violation {
+	if !o.Standalone {
+		if o.StandaloneNodesFile == "" {
+			return nil
+		}
+		return &Violation{
+			Problem: "the standalone nodes file is only used when running standalone",
+			Hint:    "set --standalone, or drop --standalone-nodes-file",
+		}
+	}
+	var contradicting string
+	switch {
+	case o.StandaloneNodesFile == "":
+		return &Violation{
+			Problem: "running standalone needs a static list of nodes",
+			Hint:    "set --standalone-nodes-file to a file holding the NodeList to scrape",
+		}
+	case o.UseAPIServerProxy:
+		contradicting = "--use-apiserver-proxy"
+	case o.PartitionEndpoints != "":
+		contradicting = "--partition-endpoints"
+	case o.HPACoverageMetrics:
+		contradicting = "--hpa-coverage-metrics"
+	case o.MinPodMetricsCompleteness > 0:
+		contradicting = "--min-pod-metrics-completeness"
+	default:
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("running standalone contradicts %s, which needs an API server", contradicting),
+		Hint:    "drop " + contradicting + ", or --standalone",
+	}
+}
+
+func checkStandaloneClientAuth(o *MetricsServerOptions) *Violation {
+	clientCA := o.Authentication != nil && o.Authentication.ClientCert.ClientCA != ""
+	switch {
+	case !o.Standalone && o.StandaloneAllowUnauthenticated:
+		return &Violation{
+			Problem: "allowing unauthenticated clients only applies when running standalone",
+			Hint:    "set --standalone, or drop --standalone-allow-unauthenticated",
+		}
+	case o.Standalone && !clientCA && !o.StandaloneAllowUnauthenticated:
+		return &Violation{
+			Problem: "running standalone without a client CA would let any client read metrics",
+			Hint:    "set --client-ca-file to the CA clients' certificates must be signed by, or --standalone-allow-unauthenticated to allow any client",
+		}
+	case o.Standalone && clientCA && o.StandaloneAllowUnauthenticated:
+		return &Violation{
+			Problem: "running standalone with a client CA contradicts allowing unauthenticated clients",
+			Hint:    "drop --client-ca-file, or --standalone-allow-unauthenticated",
+		}
+	}
+	return nil
+}
+
+// standaloneIgnoredOptions are the options only used by parts of metrics-server which don't
+// run standalone, each with whether it's set.
+var standaloneIgnoredOptions = []struct {
+	flag string
+	set  func(o *MetricsServerOptions) bool
+}{
+	{"--reloadable-config-file", func(o *MetricsServerOptions) bool { return o.ReloadableConfigFile != "" }},
+	{"--max-metric-resolution", func(o *MetricsServerOptions) bool { return o.MaxMetricResolution != 0 }},
+	{"--kubelet-insecure-tls-nodes", func(o *MetricsServerOptions) bool { return len(o.InsecureKubeletTLSNodes) > 0 }},
+	{"--kubelet-insecure-tls-node-selector", func(o *MetricsServerOptions) bool { return o.InsecureKubeletTLSSelector != "" }},
+	{"--kubelet-node-profiles", func(o *MetricsServerOptions) bool { return len(o.KubeletNodeProfiles) > 0 }},
+	{"--kubelet-profile-annotations", func(o *MetricsServerOptions) bool { return o.KubeletProfileAnnotations }},
+	{"--kubelet-insecure-migration", func(o *MetricsServerOptions) bool { return o.KubeletInsecureMigration }},
+	{"--kubelet-spiffe-workload-api-socket", func(o *MetricsServerOptions) bool { return o.KubeletSPIFFESocket != "" }},
+	{"--kubelet-hedge-delay", func(o *MetricsServerOptions) bool { return o.KubeletHedgeDelay != 0 }},
+	{"--kubelet-coalesce-requests", func(o *MetricsServerOptions) bool { return o.KubeletCoalesceRequests }},
+	{"--cpu-rate-consistency-ratio", func(o *MetricsServerOptions) bool { return o.CPURateConsistencyRatio != 0 }},
+	{"--warm-start-file", func(o *MetricsServerOptions) bool { return o.WarmStartFile != "" }},
+	{"--scrape-audit-log-path", func(o *MetricsServerOptions) bool { return o.ScrapeAuditLogPath != "" }},
+	{"--scrape-status-socket", func(o *MetricsServerOptions) bool { return o.ScrapeStatusSocket != "" }},
+	{"--storage-memory-limit-bytes", func(o *MetricsServerOptions) bool { return o.StorageMemoryLimitBytes != 0 }},
+	{"--storage-smoothing-half-life", func(o *MetricsServerOptions) bool { return o.StorageSmoothingHalfLife != 0 }},
+	{"--pod-utilization-metrics", func(o *MetricsServerOptions) bool { return o.PodUtilizationMetrics }},
+	{"--namespace-access-filtering", func(o *MetricsServerOptions) bool { return o.NamespaceAccessFiltering }},
+	{"--debug-capture-dir", func(o *MetricsServerOptions) bool { return o.DebugCaptureDir != "" }},
+	{"--preflight", func(o *MetricsServerOptions) bool { return o.Preflight != string(preflight.ModeOff) }},
+}
+
+func checkStandaloneIgnoredOptions(o *MetricsServerOptions) *Violation {
+	if !o.Standalone {
+		return nil
+	}
+	var ignored []string
+	for _, option := range standaloneIgnoredOptions {
+		if option.set(o) {
+			ignored = append(ignored, option.flag)
+		}
+	}
+	if len(ignored) == 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("running standalone ignores %s", strings.Join(ignored, ", ")),
+		Hint:    "drop " + strings.Join(ignored, ", ") + ", or --standalone",
+	}
+}
+
+func checkHPACoverageMetrics(o *MetricsServerOptions) *Violation {
+	if !o.HPACoverageMetrics {
+		return nil
+	}
+	if o.HPASelectorRefreshInterval < 0 {
+		return &Violation{
+			Problem: fmt.Sprintf("the HPA selector refresh interval must not be negative, not %v", o.HPASelectorRefreshInterval),
+			Hint:    "set --hpa-selector-refresh-interval to zero to only resolve HPAs' selectors when they change",
+		}
+	}
+	if o.PartitionEndpoints != "" {
+		return &Violation{
+			Problem: "HPA coverage metrics are not supported with partitioning",
+			Hint:    "each replica only has the metrics of its share of the nodes, so drop either --hpa-coverage-metrics or --partition-endpoints",
+		}
+	}
+	return nil
+}
+
+func checkMinCapacityCoverage(o *MetricsServerOptions) *Violation {
+	if o.MinCapacityCoverage >= 0 && o.MinCapacityCoverage <= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("minimum capacity coverage must be between 0 and 1, not %v", o.MinCapacityCoverage),
+		Hint:    "set --min-capacity-coverage to a fraction of the cluster's capacity, e.g. 0.9",
+	}
+}
+
+func checkMinPodMetricsCompleteness(o *MetricsServerOptions) *Violation {
+	if o.MinPodMetricsCompleteness < 0 || o.MinPodMetricsCompleteness > 1 {
+		return &Violation{
+			Problem: fmt.Sprintf("minimum pod metrics completeness must be between 0 and 1, not %v", o.MinPodMetricsCompleteness),
+			Hint:    "set --min-pod-metrics-completeness to a fraction of the running pods, e.g. 0.9",
+		}
+	}
+	if o.MinPodMetricsCompleteness > 0 && o.PartitionEndpoints != "" {
+		return &Violation{
+			Problem: "a minimum pod metrics completeness is not supported with partitioning",
+			Hint:    "each replica only has the metrics of its share of the pods, so drop either --min-pod-metrics-completeness or --partition-endpoints",
+		}
+	}
+	return nil
+}
+
+func checkNamespaceSelectors(o *MetricsServerOptions) *Violation {
+	if v := checkSelector("--priority-namespace-selector", o.PriorityNamespaceSelector); v != nil {
+		return v
+	}
+	return checkSelector("--served-namespace-selector", o.ServedNamespaceSelector)
+}
+
+func checkNamespaceAccessCacheTTL(o *MetricsServerOptions) *Violation {
+	if o.NamespaceAccessCacheTTL >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("namespace access cache TTL must not be negative, not %v", o.NamespaceAccessCacheTTL),
+		Hint:    "set --namespace-access-cache-ttl to zero to ask about every namespace listed in every request",
+	}
+}
+
+func checkDebugAuthorization(o *MetricsServerOptions) *Violation {
+	known := false
+	for _, mode := range debugauthz.Modes() {
+		known = known || mode == o.DebugAuthorizationMode
+	}
+	switch {
+	case !known:
+		return &Violation{
+			Problem: fmt.Sprintf("unknown debug authorization mode %q", o.DebugAuthorizationMode),
+			Hint:    "set --debug-authorization-mode to one of " + strings.Join(debugauthz.Modes(), ", "),
+		}
+	case o.DebugAuthorizationMode == debugauthz.ModeToken && o.DebugAuthorizationTokenFile == "":
+		return &Violation{
+			Problem: "authorizing the debug endpoints by token requires a token",
+			Hint:    "set --debug-authorization-token-file to a file containing the token",
+		}
+	case o.DebugAuthorizationMode == debugauthz.ModeClientCert && len(o.DebugAuthorizationCommonNames) == 0:
+		return &Violation{
+			Problem: "authorizing the debug endpoints by client certificate requires common names to allow",
+			Hint:    "list them in --debug-authorization-client-cert-common-names",
+		}
+	case o.DebugAuthorizationMode != debugauthz.ModeToken && o.DebugAuthorizationTokenFile != "",
+		o.DebugAuthorizationMode != debugauthz.ModeClientCert && len(o.DebugAuthorizationCommonNames) > 0:
+		return &Violation{
+			Problem: fmt.Sprintf("the debug authorization token and client certificate common names aren't used with --debug-authorization-mode=%s", o.DebugAuthorizationMode),
+			Hint:    "set --debug-authorization-mode to " + debugauthz.ModeToken + " or " + debugauthz.ModeClientCert + " to use them",
+		}
+	}
+	return nil
+}
+
+func checkDebugCapture(o *MetricsServerOptions) *Violation {
+	if o.DebugCaptureNode == "" || o.DebugCaptureDir != "" {
+		return nil
+	}
+	return &Violation{
+		Problem: "capturing a node's summaries requires a directory to capture them into",
+		Hint:    "set --debug-capture-dir along with --debug-capture-node",
+	}
+}
+
+func checkComponentLogLevels(o *MetricsServerOptions) *Violation {
+	if _, err := loglevel.ParseOverrides(o.ComponentLogLevels); err != nil {
+		return &Violation{
+			Problem: fmt.Sprintf("unable to parse --component-log-levels: %v", err),
+			Hint:    "list component=level pairs, e.g. client=10,storage=4",
+		}
+	}
+	return nil
+}
+
+func checkRuntimeLogLevelTTL(o *MetricsServerOptions) *Violation {
+	if o.RuntimeLogLevelTTL >= 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("runtime log level TTL must not be negative, not %v", o.RuntimeLogLevelTTL),
+		Hint:    "set --runtime-log-level-ttl to zero to keep levels overridden at runtime until restarted",
+	}
+}
+
+func checkSoftMemoryLimitRatio(o *MetricsServerOptions) *Violation {
+	if o.SoftMemoryLimitRatio >= 0 && o.SoftMemoryLimitRatio <= 1 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("soft memory limit ratio must be between 0 and 1, not %v", o.SoftMemoryLimitRatio),
+		Hint:    "set --soft-memory-limit-ratio to the fraction of the container's memory limit the heap may grow to, e.g. 0.9",
+	}
+}
+
+func checkGCPercent(o *MetricsServerOptions) *Violation {
+	if o.GCPercent >= 0 || o.SoftMemoryLimitRatio != 0 {
+		return nil
+	}
+	return &Violation{
+		Problem: fmt.Sprintf("a negative GC percentage (%d) requires a soft memory limit, or garbage is never collected", o.GCPercent),
+		Hint:    "set --soft-memory-limit-ratio, or set --gc-percent to a positive percentage",
+	}
+}
+
+// checkSelector checks that the given flag, if set, is a valid label selector.
+func checkSelector(flag, selector string) *Violation {
+	if selector == "" {
+		return nil
+	}
+	if _, err := labels.Parse(selector); err != nil {
+		return &Violation{
+			Problem: fmt.Sprintf("unable to parse %s: %v", flag, err),
+			Hint:    "use the label selector syntax of kubectl's --selector, e.g. tier=frontend,environment!=dev",
+		}
+	}
+	return nil
+}
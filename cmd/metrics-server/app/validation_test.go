@@ -0,0 +1,307 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/cmd/metrics-server/app"
+)
+
+func TestOptions(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Options Suite")
+}
+
+// validationCase changes the default options, expecting a single violation
+// whose problem contains the given text, or none if it's empty.
+type validationCase struct {
+	name    string
+	change  func(o *MetricsServerOptions)
+	problem string
+}
+
+var validationCases = []validationCase{
+	{"the defaults", func(o *MetricsServerOptions) {}, ""},
+
+	{"an unknown node name verification mode", func(o *MetricsServerOptions) { o.NodeNameVerification = "maybe" }, "invalid node name verification mode"},
+	{"the warn node name verification mode", func(o *MetricsServerOptions) { o.NodeNameVerification = "warn" }, ""},
+	{"an unknown summary decoder", func(o *MetricsServerOptions) { o.KubeletSummaryDecoder = "fastest" }, "invalid Kubelet summary decoder"},
+	{"the full summary decoder", func(o *MetricsServerOptions) { o.KubeletSummaryDecoder = "full" }, ""},
+	{"an unskippable summary subtree", func(o *MetricsServerOptions) { o.KubeletSummarySkippedSubtrees = []string{"pods.cpu.usageNanoCores"} }, "pods.cpu.usageNanoCores"},
+	{"an invalid excluded container pattern", func(o *MetricsServerOptions) { o.ExcludedContainers = []string{"istio-["} }, "istio-["},
+	{"an excluded container", func(o *MetricsServerOptions) { o.ExcludedContainers = []string{"istio-proxy"} }, ""},
+	{"a zero informer sync timeout", func(o *MetricsServerOptions) { o.InformerSyncTimeout = 0 }, "informer sync timeout must be positive"},
+
+	{"a metric resolution below the minimum", func(o *MetricsServerOptions) { o.MetricResolution = 500 * time.Millisecond }, "metric resolution (500ms) must be at least"},
+	{"a metric resolution below the housekeeping interval", func(o *MetricsServerOptions) {
+		o.MetricResolution, o.KubeletHousekeepingInterval = 15*time.Second, 30*time.Second
+	}, "shorter than the Kubelets' cAdvisor housekeeping interval"},
+	{"a forced metric resolution below the housekeeping interval", func(o *MetricsServerOptions) {
+		o.MetricResolution, o.KubeletHousekeepingInterval, o.ForceMetricResolution = 15*time.Second, 30*time.Second, true
+	}, ""},
+	{"a max metric resolution below the metric resolution", func(o *MetricsServerOptions) { o.MaxMetricResolution = 30 * time.Second }, "max metric resolution (30s) must be longer"},
+	{"a max metric resolution above the metric resolution", func(o *MetricsServerOptions) { o.MaxMetricResolution = 5 * time.Minute }, ""},
+	{"no overrun cycles with a max metric resolution", func(o *MetricsServerOptions) {
+		o.MaxMetricResolution, o.MetricResolutionOverrunCycles = 5*time.Minute, 0
+	}, "overrun cycles must be at least 1"},
+	{"no overrun cycles without a max metric resolution", func(o *MetricsServerOptions) { o.MetricResolutionOverrunCycles = 0 }, ""},
+	{"an unknown scrape order", func(o *MetricsServerOptions) { o.ScrapeOrder = "alphabetical" }, "invalid scrape order"},
+	{"a negative scrape phase max drift", func(o *MetricsServerOptions) { o.ScrapePhaseMaxDrift = -time.Second }, "scrape phase max drift must not be negative"},
+	{"a fractional liveness multiplier", func(o *MetricsServerOptions) { o.LivenessCycleMultiplier = 0.5 }, "liveness multipliers"},
+	{"disabled liveness multipliers", func(o *MetricsServerOptions) { o.LivenessCycleMultiplier, o.LivenessCommitMultiplier = 0, 0 }, ""},
+	{"a sub-second resume detection threshold", func(o *MetricsServerOptions) { o.ResumeDetectionThreshold = 500 * time.Millisecond }, "resume detection threshold must be zero (disabled) or at least 1s"},
+	{"a negative resume detection threshold", func(o *MetricsServerOptions) { o.ResumeDetectionThreshold = -time.Minute }, "resume detection threshold must be zero"},
+	{"disabled resume detection", func(o *MetricsServerOptions) { o.ResumeDetectionThreshold = 0 }, ""},
+
+	{"an out of range Kubelet port", func(o *MetricsServerOptions) { o.KubeletPort = 70000 }, "Kubelet port must be between 1 and 65535"},
+	{"a Kubelet port with the API server proxy", func(o *MetricsServerOptions) { o.UseAPIServerProxy, o.KubeletPort = true, 10255 }, "isn't used with --use-apiserver-proxy"},
+	{"address fallback with no TTL", func(o *MetricsServerOptions) {
+		o.KubeletAddressFallback, o.KubeletAddressFallbackTTL = true, 0
+	}, "address fallback TTL must be positive"},
+	{"address fallback with the API server proxy", func(o *MetricsServerOptions) {
+		o.KubeletAddressFallback, o.UseAPIServerProxy = true, true
+	}, "never fallen back through with --use-apiserver-proxy"},
+	{"the default Kubelet port with the API server proxy", func(o *MetricsServerOptions) { o.UseAPIServerProxy = true }, ""},
+	{"hedging capped at zero hedges", func(o *MetricsServerOptions) {
+		o.KubeletHedgeDelay, o.KubeletMaxHedgesPerCycle = 2*time.Second, 0
+	}, "max hedges per cycle must be at least 1"},
+	{"a hedge delay beyond the scrape timeout", func(o *MetricsServerOptions) { o.KubeletHedgeDelay = time.Minute }, "must be shorter than the scrape timeout"},
+	{"a hedge delay within the scrape timeout", func(o *MetricsServerOptions) { o.KubeletHedgeDelay = 2 * time.Second }, ""},
+	{"hedging with the API server proxy", func(o *MetricsServerOptions) {
+		o.KubeletHedgeDelay, o.UseAPIServerProxy = 2*time.Second, true
+	}, "never hedged with --use-apiserver-proxy"},
+	{"negative max concurrent requests per node", func(o *MetricsServerOptions) { o.KubeletMaxRequestsPerNode = -1 }, "max concurrent requests per node must not be negative"},
+	{"unlimited concurrent requests per node", func(o *MetricsServerOptions) { o.KubeletMaxRequestsPerNode = 0 }, ""},
+	{"a proxy breaker failure rate above 1", func(o *MetricsServerOptions) {
+		o.ProxyBreakerFailureRate, o.UseAPIServerProxy = 1.5, true
+	}, "failure rate must be between 0 and 1"},
+	{"a proxy breaker without probes", func(o *MetricsServerOptions) {
+		o.ProxyBreakerFailureRate, o.ProxyBreakerProbes, o.UseAPIServerProxy = 0.5, 0, true
+	}, "breaker probes must be at least 1"},
+	{"a proxy breaker without the API server proxy", func(o *MetricsServerOptions) { o.ProxyBreakerFailureRate = 0.5 }, "only applies with --use-apiserver-proxy"},
+	{"a negative API server proxy host refresh interval", func(o *MetricsServerOptions) { o.APIServerHostRefreshInterval = -time.Minute }, "must not be negative"},
+	{"a proxy breaker with the API server proxy", func(o *MetricsServerOptions) { o.ProxyBreakerFailureRate, o.UseAPIServerProxy = 0.5, true }, ""},
+
+	{"an unknown TLS min version", func(o *MetricsServerOptions) { o.KubeletTLSMinVersion = "VersionSSL3" }, "VersionSSL3"},
+	{"an unknown cipher suite", func(o *MetricsServerOptions) { o.KubeletTLSCipherSuites = []string{"TLS_ROT13"} }, "TLS_ROT13"},
+	{"an unknown SAN policy", func(o *MetricsServerOptions) { o.KubeletTLSSANPolicy = "require-both" }, "unknown Kubelet SAN policy"},
+	{"a SAN policy", func(o *MetricsServerOptions) { o.KubeletTLSSANPolicy = "require-name" }, ""},
+	{"a SAN policy with insecure TLS", func(o *MetricsServerOptions) {
+		o.KubeletTLSSANPolicy, o.InsecureKubeletTLS = "either", true
+	}, "a Kubelet SAN policy can't be used"},
+	{"insecure TLS nodes with insecure TLS for every node", func(o *MetricsServerOptions) {
+		o.InsecureKubeletTLSNodes, o.InsecureKubeletTLS = []string{"node1"}, true
+	}, "insecure Kubelet TLS nodes can't be used"},
+	{"an insecure TLS node selector with the API server proxy", func(o *MetricsServerOptions) {
+		o.InsecureKubeletTLSSelector, o.UseAPIServerProxy = "legacy=true", true
+	}, "insecure Kubelet TLS nodes can't be used"},
+	{"an empty insecure TLS node name", func(o *MetricsServerOptions) { o.InsecureKubeletTLSNodes = []string{"node1", ""} }, "insecure Kubelet TLS nodes must all be named"},
+	{"insecure TLS nodes", func(o *MetricsServerOptions) { o.InsecureKubeletTLSNodes = []string{"node1"} }, ""},
+	{"an invalid insecure TLS node selector", func(o *MetricsServerOptions) { o.InsecureKubeletTLSSelector = "legacy in (" }, "--kubelet-insecure-tls-node-selector"},
+	{"a malformed Kubelet node profile", func(o *MetricsServerOptions) { o.KubeletNodeProfiles = []string{"node1"} }, "must be of the form node=profile"},
+	{"an unknown Kubelet node profile", func(o *MetricsServerOptions) { o.KubeletNodeProfiles = []string{"node1=plaintext"} }, "unknown Kubelet profile"},
+	{"Kubelet node profiles", func(o *MetricsServerOptions) { o.KubeletNodeProfiles = []string{"node1=read-only", "node2=proxy"} }, ""},
+	{"an out of range Kubelet read-only port", func(o *MetricsServerOptions) { o.KubeletReadOnlyPort = 0 }, "read-only port must be between 1 and 65535"},
+	{"Kubelet profile annotations with the completely insecure flag", func(o *MetricsServerOptions) {
+		o.KubeletProfileAnnotations, o.DeprecatedCompletelyInsecureKubelet = true, true
+	}, "can't be used with --deprecated-kubelet-completely-insecure"},
+	{"insecure migration without the insecure flag", func(o *MetricsServerOptions) { o.KubeletInsecureMigration = true }, "requires it to be set"},
+	{"insecure migration with the API server proxy", func(o *MetricsServerOptions) {
+		o.KubeletInsecureMigration, o.DeprecatedCompletelyInsecureKubelet, o.UseAPIServerProxy = true, true, true
+	}, "can't be used with --use-apiserver-proxy"},
+	{"insecure migration", func(o *MetricsServerOptions) {
+		o.KubeletInsecureMigration, o.DeprecatedCompletelyInsecureKubelet = true, true
+	}, ""},
+	{"a SPIFFE socket with the API server proxy", func(o *MetricsServerOptions) {
+		o.KubeletSPIFFESocket, o.UseAPIServerProxy = "/run/spire/agent.sock", true
+	}, "SPIFFE Workload API socket can't be used"},
+	{"a SPIFFE socket with insecure TLS", func(o *MetricsServerOptions) {
+		o.KubeletSPIFFESocket, o.InsecureKubeletTLS = "/run/spire/agent.sock", true
+	}, "SPIFFE Workload API socket can't be used"},
+	{"a SPIFFE trust domain without a socket", func(o *MetricsServerOptions) { o.KubeletSPIFFETrustDomain = "example.org" }, "SPIFFE trust domain requires"},
+	{"a SPIFFE trust domain with a socket", func(o *MetricsServerOptions) {
+		o.KubeletSPIFFESocket, o.KubeletSPIFFETrustDomain = "/run/spire/agent.sock", "example.org"
+	}, ""},
+
+	{"a negative in-flight limit", func(o *MetricsServerOptions) { o.MaxInflightLists = -1 }, "max in-flight gets and lists must not be negative"},
+	{"caching headers with partition endpoints", func(o *MetricsServerOptions) {
+		o.CachingHeaders, o.PartitionEndpoints = true, "kube-system/metrics-server"
+	}, "caching headers can't be used with partition endpoints"},
+	{"a partition peer CA without partition endpoints", func(o *MetricsServerOptions) { o.PartitionPeerCAFile = "/etc/peers/ca.crt" }, "only used with partition endpoints"},
+	{"a partition proxy timeout beyond the metric resolution", func(o *MetricsServerOptions) {
+		o.PartitionEndpoints, o.PartitionProxyTimeout = "kube-system/metrics-server", 2*time.Minute
+	}, "partition proxy timeout (2m0s) must be positive, and shorter"},
+	{"partition endpoints", func(o *MetricsServerOptions) { o.PartitionEndpoints = "kube-system/metrics-server" }, ""},
+	{"a negative storage memory limit", func(o *MetricsServerOptions) { o.StorageMemoryLimitBytes = -1 }, "storage memory limit must not be negative"},
+	{"a negative storage pods per namespace limit", func(o *MetricsServerOptions) { o.StoragePodsPerNamespaceLimit = -1 }, "storage pods per namespace limit must not be negative"},
+	{"a negative storage smoothing half-life", func(o *MetricsServerOptions) { o.StorageSmoothingHalfLife = -time.Minute }, "storage smoothing half-life must not be negative"},
+	{"storage smoothing with partition endpoints", func(o *MetricsServerOptions) {
+		o.StorageSmoothingHalfLife, o.PartitionEndpoints = 5*time.Minute, "kube-system/metrics-server"
+	}, "storage smoothing can't be used with partition endpoints"},
+	{"negative pod count top namespaces", func(o *MetricsServerOptions) { o.PodCountTopNamespaces = -1 }, "pod count top namespaces must not be negative"},
+	{"negative pod utilization top namespaces", func(o *MetricsServerOptions) {
+		o.PodUtilizationMetrics, o.PodUtilizationTopNamespaces = true, -1
+	}, "pod utilization top namespaces must not be negative"},
+	{"a zero scrape failure event threshold", func(o *MetricsServerOptions) { o.ScrapeFailureEventThreshold = 0 }, "scrape failure event threshold must be at least 1"},
+	{"a zero scrape failure event threshold, with events disabled", func(o *MetricsServerOptions) {
+		o.ScrapeFailureEventThreshold, o.ScrapeFailureEvents = 0, false
+	}, ""},
+	{"an empty scrape audit log queue", func(o *MetricsServerOptions) { o.ScrapeAuditLogQueueSize = 0 }, "scrape audit log max size and backups"},
+	{"negative page fault rate max gap cycles", func(o *MetricsServerOptions) { o.PageFaultRateMaxGapCycles = -1 }, "page fault rate max gap cycles must not be negative"},
+	{"a CPU rate consistency ratio of 1", func(o *MetricsServerOptions) { o.CPURateConsistencyRatio = 1 }, "CPU rate consistency ratio must be zero"},
+	{"a CPU rate consistency ratio of 2", func(o *MetricsServerOptions) { o.CPURateConsistencyRatio = 2 }, ""},
+	{"a warm start file without checking CPU rate consistency", func(o *MetricsServerOptions) { o.WarmStartFile = "/var/run/metrics-server/warm-start.json" }, "a warm start file requires checking CPU rate consistency"},
+	{"a negative warm start max age", func(o *MetricsServerOptions) {
+		o.WarmStartFile, o.CPURateConsistencyRatio, o.WarmStartMaxAge = "/var/run/metrics-server/warm-start.json", 2, -time.Minute
+	}, "warm start max age must not be negative"},
+	{"a zero warm start save interval", func(o *MetricsServerOptions) {
+		o.WarmStartFile, o.CPURateConsistencyRatio, o.WarmStartSaveInterval = "/var/run/metrics-server/warm-start.json", 2, 0
+	}, "warm start save interval must be positive"},
+	{"a warm start file", func(o *MetricsServerOptions) {
+		o.WarmStartFile, o.CPURateConsistencyRatio = "/var/run/metrics-server/warm-start.json", 2
+	}, ""},
+	{"saving scrape costs without a warm start file", func(o *MetricsServerOptions) { o.WarmStartScrapeCosts = true }, "saving scrape costs requires a warm start file"},
+	{"saving scrape costs with the random scrape order", func(o *MetricsServerOptions) {
+		o.WarmStartFile, o.WarmStartScrapeCosts, o.ScrapeOrder = "/var/run/metrics-server/warm-start.json", true, "random"
+	}, "saving scrape costs requires the \"cost\" scrape order"},
+	{"a warm start file saving just scrape costs", func(o *MetricsServerOptions) {
+		o.WarmStartFile, o.WarmStartScrapeCosts = "/var/run/metrics-server/warm-start.json", true
+	}, ""},
+	{"a negative pod timestamp lag threshold", func(o *MetricsServerOptions) { o.PodTimestampLagThreshold = -time.Second }, "pod timestamp lag threshold must not be negative"},
+	{"a pod timestamp lag threshold of zero", func(o *MetricsServerOptions) { o.PodTimestampLagThreshold = 0 }, ""},
+	{"a negative stale summary warning threshold", func(o *MetricsServerOptions) { o.StaleSummaryWarningThreshold = -1 }, "stale summary warning threshold must not be negative"},
+	{"a negative pod usage tolerance", func(o *MetricsServerOptions) { o.PodUsageTolerance = -0.1 }, "pod usage tolerance must not be negative"},
+	{"a pod usage tolerance", func(o *MetricsServerOptions) { o.PodUsageTolerance = 0.1 }, ""},
+	{"HPA coverage metrics with partitioning", func(o *MetricsServerOptions) {
+		o.HPACoverageMetrics, o.PartitionEndpoints = true, "kube-system/metrics-server"
+	}, "not supported with partitioning"},
+	{"a negative HPA selector refresh interval", func(o *MetricsServerOptions) {
+		o.HPACoverageMetrics, o.HPASelectorRefreshInterval = true, -time.Minute
+	}, "must not be negative"},
+	{"running standalone", runStandaloneWithClientCA, ""},
+	{"running standalone without a nodes file", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.StandaloneNodesFile = ""
+	}, "needs a static list of nodes"},
+	{"a standalone nodes file without running standalone", func(o *MetricsServerOptions) { o.StandaloneNodesFile = "nodes.yaml" }, "only used when running standalone"},
+	{"running standalone through the API server proxy", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.UseAPIServerProxy = true
+	}, "contradicts --use-apiserver-proxy"},
+	{"running standalone partitioned", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.PartitionEndpoints = "kube-system/metrics-server"
+	}, "contradicts --partition-endpoints"},
+	{"running standalone with a minimum pod metrics completeness", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.MinPodMetricsCompleteness = 0.7
+	}, "contradicts --min-pod-metrics-completeness"},
+	{"running standalone without a client CA", func(o *MetricsServerOptions) {
+		o.Standalone, o.StandaloneNodesFile = true, "nodes.yaml"
+	}, "would let any client read metrics"},
+	{"running standalone allowing unauthenticated clients", func(o *MetricsServerOptions) {
+		o.Standalone, o.StandaloneNodesFile, o.StandaloneAllowUnauthenticated = true, "nodes.yaml", true
+	}, ""},
+	{"running standalone with a client CA allowing unauthenticated clients", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.StandaloneAllowUnauthenticated = true
+	}, "contradicts allowing unauthenticated clients"},
+	{"allowing unauthenticated clients without running standalone", func(o *MetricsServerOptions) { o.StandaloneAllowUnauthenticated = true }, "only applies when running standalone"},
+	{"running standalone with options it ignores", func(o *MetricsServerOptions) {
+		runStandaloneWithClientCA(o)
+		o.ReloadableConfigFile, o.KubeletCoalesceRequests = "tunables.yaml", true
+	}, "ignores --reloadable-config-file, --kubelet-coalesce-requests"},
+	{"a minimum capacity coverage above 1", func(o *MetricsServerOptions) { o.MinCapacityCoverage = 90 }, "minimum capacity coverage must be between 0 and 1"},
+	{"a negative minimum pod metrics completeness", func(o *MetricsServerOptions) { o.MinPodMetricsCompleteness = -0.5 }, "minimum pod metrics completeness must be between 0 and 1"},
+	{"a minimum pod metrics completeness with partitioning", func(o *MetricsServerOptions) {
+		o.MinPodMetricsCompleteness, o.PartitionEndpoints = 0.7, "kube-system/metrics-server"
+	}, "not supported with partitioning"},
+	{"a minimum pod metrics completeness", func(o *MetricsServerOptions) { o.MinPodMetricsCompleteness = 0.7 }, ""},
+	{"an invalid priority namespace selector", func(o *MetricsServerOptions) { o.PriorityNamespaceSelector = "=frontend" }, "--priority-namespace-selector"},
+	{"an invalid served namespace selector", func(o *MetricsServerOptions) { o.ServedNamespaceSelector = "tenant in (" }, "--served-namespace-selector"},
+	{"a served namespace selector", func(o *MetricsServerOptions) { o.ServedNamespaceSelector = "tenant=a" }, ""},
+	{"a negative namespace access cache TTL", func(o *MetricsServerOptions) {
+		o.NamespaceAccessFiltering, o.NamespaceAccessCacheTTL = true, -time.Second
+	}, "namespace access cache TTL must not be negative"},
+	{"namespace access filtering without a cache", func(o *MetricsServerOptions) {
+		o.NamespaceAccessFiltering, o.NamespaceAccessCacheTTL = true, 0
+	}, ""},
+	{"an unknown debug authorization mode", func(o *MetricsServerOptions) { o.DebugAuthorizationMode = "anyone" }, "unknown debug authorization mode"},
+	{"debug authorization by token without a token", func(o *MetricsServerOptions) { o.DebugAuthorizationMode = "token" }, "requires a token"},
+	{"debug authorization by token", func(o *MetricsServerOptions) {
+		o.DebugAuthorizationMode, o.DebugAuthorizationTokenFile = "token", "/etc/debug/token"
+	}, ""},
+	{"debug authorization by client certificate without common names", func(o *MetricsServerOptions) { o.DebugAuthorizationMode = "client-cert" }, "requires common names"},
+	{"a debug authorization token when delegating", func(o *MetricsServerOptions) { o.DebugAuthorizationTokenFile = "/etc/debug/token" }, "aren't used with"},
+	{"a debug capture node without a directory", func(o *MetricsServerOptions) { o.DebugCaptureNode = "node1" }, "requires a directory"},
+	{"a debug capture node with a directory", func(o *MetricsServerOptions) { o.DebugCaptureNode, o.DebugCaptureDir = "node1", "/tmp/captures" }, ""},
+	{"a log level for an unknown component", func(o *MetricsServerOptions) { o.ComponentLogLevels = "client=10,kubelet=4" }, `unknown component "kubelet"`},
+	{"component log levels", func(o *MetricsServerOptions) { o.ComponentLogLevels = "client=10,storage=4" }, ""},
+	{"a negative runtime log level TTL", func(o *MetricsServerOptions) { o.RuntimeLogLevelTTL = -time.Minute }, "runtime log level TTL must not be negative"},
+	{"a soft memory limit ratio above 1", func(o *MetricsServerOptions) { o.SoftMemoryLimitRatio = 1.5 }, "must be between 0 and 1"},
+	{"a negative GC percentage without a soft memory limit", func(o *MetricsServerOptions) { o.GCPercent = -1 }, "requires a soft memory limit"},
+	{"a negative GC percentage with a soft memory limit", func(o *MetricsServerOptions) { o.GCPercent, o.SoftMemoryLimitRatio = -1, 0.9 }, ""},
+	{"an unknown preflight mode", func(o *MetricsServerOptions) { o.Preflight = "lenient" }, "invalid preflight mode"},
+	{"the strict preflight mode", func(o *MetricsServerOptions) { o.Preflight = "strict" }, ""},
+	{"no preflight nodes", func(o *MetricsServerOptions) { o.PreflightNodes = 0 }, "preflight nodes must be positive"},
+	{"a zero preflight timeout", func(o *MetricsServerOptions) { o.PreflightTimeout = 0 }, "preflight timeout must be positive"},
+}
+
+// runStandaloneWithClientCA sets the options running standalone needs.
+func runStandaloneWithClientCA(o *MetricsServerOptions) {
+	o.Standalone, o.StandaloneNodesFile = true, "nodes.yaml"
+	o.Authentication.ClientCert.ClientCA = "ca.crt"
+}
+
+var _ = Describe("Options Validation", func() {
+	for _, tc := range validationCases {
+		tc := tc
+		if tc.problem == "" {
+			It("should accept "+tc.name, func() {
+				o := NewMetricsServerOptions()
+				tc.change(o)
+				Expect(o.Validate()).To(Succeed())
+			})
+			continue
+		}
+		It("should reject "+tc.name+", with a hint", func() {
+			o := NewMetricsServerOptions()
+			tc.change(o)
+			err := o.Validate()
+			Expect(err).To(BeAssignableToTypeOf(&ValidationError{}))
+			violations := err.(*ValidationError).Violations
+			Expect(violations).To(HaveLen(1))
+			Expect(violations[0].Problem).To(ContainSubstring(tc.problem))
+			Expect(violations[0].Hint).NotTo(BeEmpty())
+		})
+	}
+
+	It("should report every violation at once", func() {
+		o := NewMetricsServerOptions()
+		o.ScrapeOrder = "alphabetical"
+		o.KubeletSPIFFETrustDomain = "example.org"
+		o.StorageMemoryLimitBytes = -1
+		err := o.Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*ValidationError).Violations).To(HaveLen(3))
+		Expect(err.Error()).To(HavePrefix("invalid options (3 problems):\n  - invalid scrape order"))
+		Expect(err.Error()).To(ContainSubstring("\n    hint: set --kubelet-spiffe-workload-api-socket"))
+	})
+})
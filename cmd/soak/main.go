@@ -0,0 +1,166 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// soak runs the metrics-server scrape, storage, and API paths against a
+// fleet of in-process fake Kubelets, and reports cycle durations, memory
+// usage, and API latencies.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/fakefleet"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/nodemetrics"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/podmetrics"
+)
+
+func main() {
+	var config fakefleet.Config
+	flag.IntVar(&config.Nodes, "nodes", 100, "The number of fake nodes.")
+	flag.IntVar(&config.PodsPerNode, "pods-per-node", 30, "The number of pods on each fake node.")
+	flag.IntVar(&config.ContainersPerPod, "containers-per-pod", 2, "The number of containers in each fake pod.")
+	flag.IntVar(&config.Namespaces, "namespaces", 20, "The number of namespaces that fake pods are spread across.")
+	flag.Float64Var(&config.ChurnRate, "churn-rate", 0.01, "The fraction of each node's pods replaced each scrape.")
+	flag.DurationVar(&config.Latency.Base, "latency", 20*time.Millisecond, "The base latency of the fake Kubelets.")
+	flag.DurationVar(&config.Latency.Jitter, "latency-jitter", 20*time.Millisecond, "The mean of the exponentially distributed jitter added to the base latency.")
+	flag.Float64Var(&config.ErrorRate, "error-rate", 0, "The fraction of scrapes that fail with an internal server error.")
+	flag.Int64Var(&config.Seed, "seed", 1, "The seed for generating metrics, churn, latency, and errors.")
+	cycles := flag.Int("cycles", 10, "The number of scrape cycles to run.")
+	resolution := flag.Duration("metric-resolution", 60*time.Second, "The metric resolution to derive the scrape timeout from.")
+	apiRequests := flag.Int("api-requests", 100, "The number of list requests to make against each of the node and pod metrics APIs.")
+	flag.Parse()
+
+	if err := run(config, *cycles, *resolution, *apiRequests); err != nil {
+		fmt.Fprintf(os.Stderr, "soak test failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(config fakefleet.Config, cycles int, resolution time.Duration, apiRequests int) error {
+	fmt.Printf("starting %d fake nodes, with %d pods of %d containers each...\n", config.Nodes, config.PodsPerNode, config.ContainersPerPod)
+	fleet, err := fakefleet.New(config)
+	if err != nil {
+		return fmt.Errorf("unable to start fake Kubelets: %v", err)
+	}
+	defer fleet.Close()
+
+	// wire up the real components, as in cmd/metrics-server, but with the fleet
+	// standing in for the Kubelets and the informers
+	kubeletClient, err := summary.KubeletClientFor(&summary.KubeletClientConfig{
+		Port: 10250,
+		RESTConfig: &restclient.Config{
+			Host: "https://localhost:6443",
+			TLSClientConfig: restclient.TLSClientConfig{
+				CAData:     fleet.CAData(),
+				ServerName: fakefleet.ServerName,
+			},
+		},
+		Dial: fleet.Dial,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to construct a client to connect to the fake Kubelets: %v", err)
+	}
+	addrResolver := summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority)
+	sourceProvider := summary.NewSummaryProvider(fleet.NodeLister(), kubeletClient, addrResolver, summary.SourceOptions{
+		Statuses:       summary.NewScrapeStatusTracker(),
+		MaxPodsPerNode: summary.DefaultMaxPodsPerNode,
+	})
+	scrapeTimeout := time.Duration(float64(resolution) * 0.90)
+	sources.RegisterDurationMetrics(scrapeTimeout)
+	sourceManager := sources.NewSourceManager(sourceProvider, scrapeTimeout)
+	metricSink, metricsProvider := sink.NewSinkProvider()
+
+	cycleDurations := make([]time.Duration, 0, cycles)
+	for i := 0; i < cycles; i++ {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), resolution)
+		data, err := sourceManager.Collect(ctx)
+		cancel()
+		if err != nil {
+			glog.Errorf("unable to fully collect metrics: %v", err)
+		}
+		if err := metricSink.Receive(data); err != nil {
+			return fmt.Errorf("unable to save metrics: %v", err)
+		}
+		cycleDurations = append(cycleDurations, time.Since(start))
+		fmt.Printf("cycle %d: %v, %d nodes, %d pods\n", i+1, time.Since(start), len(data.Nodes), len(data.Pods))
+	}
+
+	nodeStorage := nodemetrics.NewStorage(metrics.Resource("nodemetrics"), metricsProvider, fleet.NodeLister(), nil)
+	podStorage := podmetrics.NewStorage(metrics.Resource("podmetrics"), metricsProvider, fleet.PodLister())
+	nodeLatencies, err := timeLists(nodeStorage, apiRequests)
+	if err != nil {
+		return err
+	}
+	podLatencies, err := timeLists(podStorage, apiRequests)
+	if err != nil {
+		return err
+	}
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	fleetStats := fleet.Stats()
+	fmt.Printf("\nsummary requests served: %d (%d injected errors), over %d connections\n", fleetStats.Requests, fleetStats.Errors, fleetStats.Connections)
+	printPercentiles("cycle duration", cycleDurations)
+	printPercentiles("node metrics list latency", nodeLatencies)
+	printPercentiles("pod metrics list latency", podLatencies)
+	// NB: this includes the fake Kubelets, which share the process
+	fmt.Printf("memory: heap in use %d MiB, total obtained from the OS %d MiB\n", mem.HeapInuse>>20, mem.Sys>>20)
+
+	return nil
+}
+
+// timeLists times the given number of cluster-wide list requests against the given storage.
+func timeLists(storage rest.Lister, num int) ([]time.Duration, error) {
+	ctx := genericapirequest.WithNamespace(genericapirequest.NewContext(), "")
+	latencies := make([]time.Duration, num)
+	for i := range latencies {
+		start := time.Now()
+		if _, err := storage.List(ctx, nil); err != nil {
+			return nil, fmt.Errorf("unable to list metrics: %v", err)
+		}
+		latencies[i] = time.Since(start)
+	}
+	return latencies, nil
+}
+
+func printPercentiles(name string, durations []time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	fmt.Printf("%s: p50 %v, p90 %v, p99 %v, max %v\n", name, percentile(0.5), percentile(0.9), percentile(0.99), sorted[len(sorted)-1])
+}
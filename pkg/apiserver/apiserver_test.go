@@ -0,0 +1,250 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apiserver_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver"
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver/generic"
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver/openapiv3"
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	metricsink "github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update the golden files in testdata instead of comparing against them")
+
+func TestAPIServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "API Server Suite")
+}
+
+// get fetches the given path from the handler, returning the response
+// after checking that it succeeded.
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	Expect(resp.Code).To(Equal(http.StatusOK), "response body: %s", resp.Body.String())
+	return resp
+}
+
+var _ = Describe("Metrics API Server", func() {
+	var (
+		handler    http.Handler
+		metricSink metricsink.MetricSink
+	)
+
+	BeforeEach(func() {
+		var metricsProvider provider.MetricsProvider
+		metricSink, metricsProvider = sink.NewSinkProvider()
+		serverConfig := genericapiserver.NewConfig(generic.Codecs)
+		// we never connect to ourselves, but the generic server requires this
+		serverConfig.LoopbackClientConfig = &rest.Config{Host: "http://127.0.0.1:1"}
+		config := &apiserver.Config{
+			GenericConfig: serverConfig,
+			ProviderConfig: generic.ProviderConfig{
+				Node:            metricsProvider,
+				Pod:             metricsProvider,
+				UntilNextCommit: func() time.Duration { return 42500 * time.Millisecond },
+				// compressing every response gzip is accepted for, however small
+				ResponseCompression: &provider.ResponseCompression{MinBytes: 0},
+			},
+			Capabilities: &capabilities.Options{
+				MetricResolution: time.Minute,
+				Features:         capabilities.Features{CachingHeaders: true},
+			},
+		}
+		// the informers are never started, we just need their listers to exist
+		kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: "http://127.0.0.1:1"})
+		Expect(err).NotTo(HaveOccurred())
+		server, err := config.Complete(informers.NewSharedInformerFactory(kubeClient, 0)).New()
+		Expect(err).NotTo(HaveOccurred())
+		handler = server.GenericAPIServer.Handler
+	})
+
+	It("should advertise get and list for node and pod metrics in discovery", func() {
+		resp := get(handler, "/apis/metrics.k8s.io/v1beta1")
+
+		var resources metav1.APIResourceList
+		Expect(json.Unmarshal(resp.Body.Bytes(), &resources)).To(Succeed())
+		verbs := make(map[string][]string)
+		for _, resource := range resources.APIResources {
+			verbs[resource.Name] = resource.Verbs
+		}
+		Expect(verbs).To(Equal(map[string][]string{
+			"nodes": {"get", "list"},
+			"pods":  {"get", "list"},
+		}))
+	})
+
+	It("should serve a capabilities document consistent with discovery", func() {
+		var resources metav1.APIResourceList
+		Expect(json.Unmarshal(get(handler, "/apis/metrics.k8s.io/v1beta1").Body.Bytes(), &resources)).To(Succeed())
+		discovered := make(map[string][]string)
+		for _, resource := range resources.APIResources {
+			discovered[resource.Name] = resource.Verbs
+		}
+
+		var doc capabilities.Document
+		Expect(json.Unmarshal(get(handler, capabilities.Path).Body.Bytes(), &doc)).To(Succeed())
+		Expect(doc.APIs).To(HaveLen(1))
+		Expect(doc.APIs[0].GroupVersion).To(Equal(resources.GroupVersion))
+		described := make(map[string][]string)
+		for _, resource := range doc.APIs[0].Resources {
+			described[resource.Name] = resource.Verbs
+		}
+		Expect(described).To(Equal(discovered))
+		Expect(doc.Features).To(HaveKeyWithValue(capabilities.FeatureCachingHeaders, true))
+		Expect(doc.MetricResolutionSeconds).To(Equal(60.0))
+	})
+
+	It("should list the OpenAPI v3 document for the metrics API in the v3 discovery document", func() {
+		resp := get(handler, openapiv3.Path)
+
+		var discovery openapiv3.Discovery
+		Expect(json.Unmarshal(resp.Body.Bytes(), &discovery)).To(Succeed())
+		Expect(discovery.Paths).To(HaveKey("apis/metrics.k8s.io/v1beta1"))
+
+		By("fetching the listed document, which should be cacheable")
+		docResp := get(handler, discovery.Paths["apis/metrics.k8s.io/v1beta1"].ServerRelativeURL)
+		Expect(docResp.Header().Get("Cache-Control")).To(ContainSubstring("immutable"))
+	})
+
+	It("should serve OpenAPI v3 schemas for the metrics API matching the golden file", func() {
+		resp := get(handler, openapiv3.Path+"/apis/metrics.k8s.io/v1beta1")
+
+		By("normalizing the build-dependent version")
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(resp.Body.Bytes(), &doc)).To(Succeed())
+		doc["info"].(map[string]interface{})["version"] = "unversioned"
+		actual, err := json.MarshalIndent(doc, "", "  ")
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying the schemas for node and pod metrics are present")
+		schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		Expect(schemas).To(HaveKey("io.k8s.metrics.pkg.apis.metrics.v1beta1.NodeMetrics"))
+		Expect(schemas).To(HaveKey("io.k8s.metrics.pkg.apis.metrics.v1beta1.PodMetrics"))
+
+		By("comparing against the golden file")
+		goldenPath := filepath.Join("testdata", "openapi-v3-metrics.k8s.io-v1beta1.json")
+		if *updateGolden {
+			Expect(ioutil.WriteFile(goldenPath, append(actual, '\n'), 0644)).To(Succeed())
+		}
+		golden, err := ioutil.ReadFile(goldenPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(actual) + "\n").To(Equal(string(golden)))
+	})
+
+	It("should answer conditional requests for node and pod metrics with a 304 until the next commit", func() {
+		for _, path := range []string{"/apis/metrics.k8s.io/v1beta1/nodes", "/apis/metrics.k8s.io/v1beta1/namespaces/ns1/pods"} {
+			By("fetching " + path + " for the first time")
+			resp := get(handler, path)
+			etag := resp.Header().Get("ETag")
+			Expect(etag).To(HavePrefix(`W/"`))
+			Expect(resp.Header().Get("Cache-Control")).To(Equal("private, max-age=42"))
+
+			By("fetching it again, conditionally, from the same snapshot")
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("If-None-Match", etag)
+			notModified := httptest.NewRecorder()
+			handler.ServeHTTP(notModified, req)
+			Expect(notModified.Code).To(Equal(http.StatusNotModified))
+			Expect(notModified.Body.Len()).To(BeZero())
+			Expect(notModified.Header().Get("ETag")).To(Equal(etag))
+
+			By("fetching a fresh body once a batch has been committed")
+			Expect(metricSink.Receive(&sources.MetricsBatch{})).To(Succeed())
+			fresh := httptest.NewRecorder()
+			handler.ServeHTTP(fresh, req)
+			Expect(fresh.Code).To(Equal(http.StatusOK))
+			Expect(fresh.Header().Get("ETag")).NotTo(Equal(etag))
+			var list metav1.List
+			Expect(json.Unmarshal(fresh.Body.Bytes(), &list)).To(Succeed())
+			Expect(`W/"` + list.ResourceVersion + `"`).To(Equal(fresh.Header().Get("ETag")))
+		}
+	})
+
+	It("should only answer conditional requests for any ETag with a 304 if what's requested exists", func() {
+		Expect(metricSink.Receive(&sources.MetricsBatch{Nodes: []sources.NodeMetricsPoint{
+			{Name: "node1", MetricsPoint: sources.MetricsPoint{Timestamp: time.Now()}},
+		}})).To(Succeed())
+
+		req := httptest.NewRequest("GET", "/apis/metrics.k8s.io/v1beta1/nodes/node1", nil)
+		req.Header.Set("If-None-Match", "*")
+		notModified := httptest.NewRecorder()
+		handler.ServeHTTP(notModified, req)
+		Expect(notModified.Code).To(Equal(http.StatusNotModified))
+		Expect(notModified.Body.Len()).To(BeZero())
+		Expect(notModified.Header().Get("ETag")).To(HavePrefix(`W/"`))
+
+		req = httptest.NewRequest("GET", "/apis/metrics.k8s.io/v1beta1/nodes/node2", nil)
+		req.Header.Set("If-None-Match", "*")
+		missing := httptest.NewRecorder()
+		handler.ServeHTTP(missing, req)
+		Expect(missing.Code).To(Equal(http.StatusNotFound))
+		Expect(missing.Header().Get("ETag")).To(BeEmpty())
+	})
+
+	It("should leave caching headers off discovery and errors", func() {
+		resp := get(handler, "/apis/metrics.k8s.io/v1beta1")
+		Expect(resp.Header().Get("ETag")).To(BeEmpty())
+
+		req := httptest.NewRequest("GET", "/apis/metrics.k8s.io/v1beta1/nodes?resourceVersion=1", nil)
+		expired := httptest.NewRecorder()
+		handler.ServeHTTP(expired, req)
+		Expect(expired.Code).To(Equal(http.StatusGone))
+		Expect(expired.Header().Get("ETag")).To(BeEmpty())
+	})
+	It("should compress metrics responses for clients accepting gzip, but not for those asking for identity", func() {
+		req := httptest.NewRequest("GET", "/apis/metrics.k8s.io/v1beta1/nodes", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		compressed := httptest.NewRecorder()
+		handler.ServeHTTP(compressed, req)
+		Expect(compressed.Code).To(Equal(http.StatusOK))
+		Expect(compressed.Header().Get("Content-Encoding")).To(Equal("gzip"))
+		gz, err := gzip.NewReader(compressed.Body)
+		Expect(err).NotTo(HaveOccurred())
+		var list metav1.List
+		Expect(json.NewDecoder(gz).Decode(&list)).To(Succeed())
+		Expect(`W/"` + list.ResourceVersion + `"`).To(Equal(compressed.Header().Get("ETag")))
+
+		req.Header.Set("Accept-Encoding", "identity")
+		identity := httptest.NewRecorder()
+		handler.ServeHTTP(identity, req)
+		Expect(identity.Code).To(Equal(http.StatusOK))
+		Expect(identity.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(json.Unmarshal(identity.Body.Bytes(), &list)).To(Succeed())
+	})
+})
@@ -15,14 +15,22 @@
 package apiserver
 
 import (
+	"fmt"
+	"net/http"
 	"strings"
 
+	"github.com/golang/glog"
 	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/informers"
 
 	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver/generic"
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver/openapiv3"
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
 	generatedopenapi "github.com/kubernetes-incubator/metrics-server/pkg/generated/openapi"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/listing"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/podmetrics"
 	"github.com/kubernetes-incubator/metrics-server/pkg/version"
 )
 
@@ -30,11 +38,14 @@ import (
 type Config struct {
 	GenericConfig  *genericapiserver.Config
 	ProviderConfig generic.ProviderConfig
+	// Capabilities, if non-nil, enables serving the capabilities document (at capabilities.Path).
+	Capabilities *capabilities.Options
 }
 
 type completedConfig struct {
 	genericapiserver.CompletedConfig
 	ProviderConfig *generic.ProviderConfig
+	Capabilities   *capabilities.Options
 }
 
 // Complete fills in any fields not set that are required to have valid data. It's mutating the receiver.
@@ -47,9 +58,43 @@ func (c *Config) Complete(informers informers.SharedInformerFactory) completedCo
 	c.GenericConfig.OpenAPIConfig.Info.Version = strings.Split(c.GenericConfig.Version.String(), "-")[0] // TODO(directxman12): remove this once autosetting this doesn't require security definitions
 	c.GenericConfig.SwaggerConfig = genericapiserver.DefaultSwaggerConfig()
 
+	providers := c.ProviderConfig
+	c.GenericConfig.BuildHandlerChainFunc = func(apiHandler http.Handler, config *genericapiserver.Config) http.Handler {
+		// serve each request from a single pinned snapshot, so that lists don't mix collections
+		// (only possible when node and pod metrics share a provider, since the snapshot serves both)
+		snapshots, ok := providers.Pod.(provider.SnapshotProvider)
+		if ok && interface{}(providers.Node) == interface{}(snapshots) {
+			// within the pinned snapshot, so that the ETag matches what's served
+			if providers.UntilNextCommit != nil {
+				apiHandler = provider.WithCachingHeaders(apiHandler, snapshots, providers.UntilNextCommit, providers.AvailabilityCheck)
+			}
+			apiHandler = provider.WithPinnedSnapshot(apiHandler, snapshots)
+		} else if providers.UntilNextCommit != nil {
+			glog.Warningf("not serving caching headers, since node and pod metrics aren't served from the same snapshots")
+		}
+		// don't proxy requests that other replicas proxied to us
+		if providers.NodeRouter != nil {
+			apiHandler = provider.WithLocalOnlyRequests(apiHandler)
+		}
+		// let PodMetrics lists see the explicit list of pod names requested, if any
+		apiHandler = podmetrics.WithNamesParam(apiHandler)
+		// let lists see the order requested, if any
+		apiHandler = listing.WithSortParam(apiHandler)
+		// let gets and lists see the smoothing requested, if any
+		apiHandler = provider.WithSmoothingParam(apiHandler)
+		// let gets and lists see the debugging information requested, if any
+		apiHandler = provider.WithDebugParam(apiHandler)
+		// around everything else, so that whole responses (and only metrics responses) are compressed
+		if providers.ResponseCompression != nil {
+			apiHandler = provider.WithResponseCompression(apiHandler, *providers.ResponseCompression)
+		}
+		return genericapiserver.DefaultBuildHandlerChain(apiHandler, config)
+	}
+
 	return completedConfig{
 		CompletedConfig: c.GenericConfig.Complete(informers),
 		ProviderConfig:  &c.ProviderConfig,
+		Capabilities:    c.Capabilities,
 	}
 }
 
@@ -64,9 +109,21 @@ func (c completedConfig) New() (*MetricsServer, error) {
 		return nil, err
 	}
 
-	if err := generic.InstallStorage(c.ProviderConfig, c.SharedInformerFactory.Core().V1(), genericServer); err != nil {
+	storage := generic.BuildStorage(c.ProviderConfig, c.SharedInformerFactory.Core().V1())
+	if err := genericServer.InstallAPIGroup(&storage); err != nil {
 		return nil, err
 	}
+	if c.Capabilities != nil {
+		capabilitiesHandler := capabilities.NewHandler(c.Version, generic.DescribeAPIs(&storage), *c.Capabilities)
+		genericServer.Handler.NonGoRestfulMux.Handle(capabilities.Path, capabilitiesHandler)
+	}
+
+	// the vendored generic API server only serves OpenAPI v2, so serve v3 ourselves
+	openAPIV3, err := openapiv3.NewService(genericServer.Handler.GoRestfulContainer.RegisteredWebServices(), c.OpenAPIConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build OpenAPI v3 documents: %v", err)
+	}
+	openAPIV3.Install(genericServer.Handler.NonGoRestfulMux)
 
 	return &MetricsServer{
 		GenericAPIServer: genericServer,
@@ -15,6 +15,9 @@
 package generic
 
 import (
+	"sort"
+	"time"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -26,6 +29,7 @@ import (
 	"k8s.io/metrics/pkg/apis/metrics/install"
 	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
 	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
 	nodemetricsstorage "github.com/kubernetes-incubator/metrics-server/pkg/storage/nodemetrics"
 	podmetricsstorage "github.com/kubernetes-incubator/metrics-server/pkg/storage/podmetrics"
@@ -48,14 +52,58 @@ func init() {
 type ProviderConfig struct {
 	Node provider.NodeMetricsProvider
 	Pod  provider.PodMetricsProvider
+	// NodeRouter, if non-nil, fetches the metrics of nodes owned by other replicas.
+	NodeRouter provider.NodeRouter
+	// NodeLabels lists the node labels copied onto the labels of each node's metrics.
+	NodeLabels []string
+	// ServeUnmatchedPods enables serving the metrics of pods with no pod object (see
+	// podmetrics.MetricStorage.ServeUnmatchedPods).
+	ServeUnmatchedPods bool
+	// UnavailableNodes, if non-nil, enables serving nodes with no metrics as unavailable (see
+	// nodemetrics.MetricStorage.ServeUnavailableNodes).
+	UnavailableNodes nodemetricsstorage.LastAttemptFunc
+	// InflightLimiter, if non-nil, limits the gets and lists of node and pod metrics in flight.
+	InflightLimiter *provider.InflightLimiter
+	// AvailabilityCheck, if non-nil, is checked before serving node and pod metrics,
+	// serving its error instead while it fails (e.g. while degraded).
+	AvailabilityCheck provider.AvailabilityCheck
+	// Namespaces, if non-nil, restricts the namespaces whose pod metrics are served.
+	Namespaces *provider.NamespaceAllowlist
+	// NamespaceAccess, if non-nil, filters lists of pod metrics across all namespaces
+	// to the namespaces the requesting user may list them in.
+	NamespaceAccess *provider.NamespaceAccess
+	// UntilNextCommit, if non-nil, estimates how long it is until the next batch is committed,
+	// enabling caching headers and conditional requests (see provider.WithCachingHeaders).
+	UntilNextCommit func() time.Duration
+	// ServeProvenance enables annotating node and pod metrics with their provenance for
+	// requests asking for it (see provider.DebugProvenance).
+	ServeProvenance bool
+	// ServePodNodeNames enables annotating pod metrics with the node they were measured on
+	// (see podmetrics.NodeNameAnnotation).
+	ServePodNodeNames bool
+	// ResponseCompression, if non-nil, takes over compressing the responses to gets and lists
+	// of node and pod metrics from the generic API server (see provider.WithResponseCompression).
+	ResponseCompression *provider.ResponseCompression
 }
 
 // BuildStorage constructs APIGroupInfo the metrics.k8s.io API group using the given providers.
 func BuildStorage(providers *ProviderConfig, informers coreinf.Interface) genericapiserver.APIGroupInfo {
 	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(metrics.GroupName, Scheme, metav1.ParameterCodec, Codecs)
 
-	nodemetricsStorage := nodemetricsstorage.NewStorage(metrics.Resource("nodemetrics"), providers.Node, informers.Nodes().Lister())
+	nodemetricsStorage := nodemetricsstorage.NewStorage(metrics.Resource("nodemetrics"), providers.Node, informers.Nodes().Lister(), providers.NodeRouter)
+	nodemetricsStorage.PropagateLabels(providers.NodeLabels)
+	nodemetricsStorage.LimitInflight(providers.InflightLimiter)
+	nodemetricsStorage.SetAvailabilityCheck(providers.AvailabilityCheck)
+	nodemetricsStorage.ServeUnavailableNodes(providers.UnavailableNodes)
+	nodemetricsStorage.ServeProvenance(providers.ServeProvenance)
 	podmetricsStorage := podmetricsstorage.NewStorage(metrics.Resource("podmetrics"), providers.Pod, informers.Pods().Lister())
+	podmetricsStorage.ServeUnmatchedPods(providers.ServeUnmatchedPods)
+	podmetricsStorage.LimitInflight(providers.InflightLimiter)
+	podmetricsStorage.SetAvailabilityCheck(providers.AvailabilityCheck)
+	podmetricsStorage.AllowNamespaces(providers.Namespaces)
+	podmetricsStorage.FilterNamespaceAccess(providers.NamespaceAccess)
+	podmetricsStorage.ServeProvenance(providers.ServeProvenance)
+	podmetricsStorage.ServeNodeNames(providers.ServePodNodeNames)
 	metricsServerResources := map[string]rest.Storage{
 		"nodes": nodemetricsStorage,
 		"pods":  podmetricsStorage,
@@ -65,6 +113,34 @@ func BuildStorage(providers *ProviderConfig, informers coreinf.Interface) generi
 	return apiGroupInfo
 }
 
+// DescribeAPIs describes the resources of each version of the given API group, and the verbs
+// each supports, determined from the interfaces their storage implements, just as for discovery.
+func DescribeAPIs(info *genericapiserver.APIGroupInfo) []capabilities.APIGroupVersion {
+	var res []capabilities.APIGroupVersion
+	for _, groupVersion := range info.PrioritizedVersions {
+		storage := info.VersionedResourcesStorageMap[groupVersion.Version]
+		api := capabilities.APIGroupVersion{GroupVersion: groupVersion.String()}
+		for name, resourceStorage := range storage {
+			resource := capabilities.APIResource{Name: name, Verbs: []string{}}
+			if _, ok := resourceStorage.(rest.Getter); ok {
+				resource.Verbs = append(resource.Verbs, "get")
+			}
+			if _, ok := resourceStorage.(rest.Lister); ok {
+				resource.Verbs = append(resource.Verbs, "list")
+			}
+			if _, ok := resourceStorage.(rest.Watcher); ok {
+				resource.Verbs = append(resource.Verbs, "watch")
+			}
+			api.Resources = append(api.Resources, resource)
+		}
+		sort.Slice(api.Resources, func(i, j int) bool {
+			return api.Resources[i].Name < api.Resources[j].Name
+		})
+		res = append(res, api)
+	}
+	return res
+}
+
 // InstallStorage builds the storage for the metrics.k8s.io API, and then installs it into the given API server.
 func InstallStorage(providers *ProviderConfig, informers coreinf.Interface, server *genericapiserver.GenericAPIServer) error {
 	info := BuildStorage(providers, informers)
@@ -0,0 +1,323 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openapiv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-openapi/spec"
+)
+
+const (
+	v2DefinitionsPrefix = "#/definitions/"
+	v3SchemasPrefix     = "#/components/schemas/"
+)
+
+// document is a generic JSON document, which keeps the output deterministic
+// (the JSON encoder sorts map keys) without needing Go types for all of OpenAPI v3.
+type document = map[string]interface{}
+
+var httpMethods = []string{"get", "put", "post", "delete", "options", "head", "patch"}
+
+// splitByGroupVersion converts the given OpenAPI v2 spec into a set of
+// OpenAPI v3 documents, one per group-version (or other top-level path,
+// like "version"), each containing only the schemas it references.
+func splitByGroupVersion(swagger *spec.Swagger) (map[string]document, error) {
+	raw, err := json.Marshal(swagger)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize OpenAPI v2 spec: %v", err)
+	}
+	var v2 document
+	if err := json.Unmarshal(raw, &v2); err != nil {
+		return nil, fmt.Errorf("unable to deserialize OpenAPI v2 spec: %v", err)
+	}
+
+	definitions, _ := v2["definitions"].(document)
+	produces := stringList(v2["produces"])
+	consumes := stringList(v2["consumes"])
+
+	docs := make(map[string]document)
+	paths, _ := v2["paths"].(document)
+	for path, rawItem := range paths {
+		item, ok := rawItem.(document)
+		if !ok {
+			continue
+		}
+		key := groupVersionKey(path)
+		if key == "" {
+			continue
+		}
+		doc, ok := docs[key]
+		if !ok {
+			doc = document{
+				"openapi": "3.0.0",
+				"info":    v2["info"],
+				"paths":   document{},
+			}
+			docs[key] = doc
+		}
+		doc["paths"].(document)[path] = convertPathItem(item, produces, consumes)
+	}
+
+	for _, doc := range docs {
+		rewriteRefs(doc)
+		schemas := document{}
+		collectSchemas(doc["paths"], definitions, schemas)
+		components := document{"schemas": schemas}
+		if securityDefs, ok := v2["securityDefinitions"]; ok {
+			components["securitySchemes"] = securityDefs
+		}
+		doc["components"] = components
+	}
+
+	return docs, nil
+}
+
+// groupVersionKey determines which document a path belongs in, following the same
+// layout as the Kubernetes API server (e.g. "apis/metrics.k8s.io/v1beta1").
+func groupVersionKey(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 0 || parts[0] == "":
+		return ""
+	case parts[0] == "apis" && len(parts) >= 3:
+		return strings.Join(parts[:3], "/")
+	case parts[0] == "apis" && len(parts) == 2:
+		return strings.Join(parts[:2], "/")
+	case parts[0] == "api" && len(parts) >= 2:
+		return strings.Join(parts[:2], "/")
+	default:
+		return parts[0]
+	}
+}
+
+func convertPathItem(item document, produces, consumes []string) document {
+	res := document{}
+	for key, val := range item {
+		if key == "parameters" {
+			res[key] = convertParameters(val)
+			continue
+		}
+		res[key] = val
+	}
+	for _, method := range httpMethods {
+		if op, ok := item[method].(document); ok {
+			res[method] = convertOperation(op, produces, consumes)
+		}
+	}
+	return res
+}
+
+func convertOperation(op document, produces, consumes []string) document {
+	if opProduces, ok := op["produces"]; ok {
+		produces = stringList(opProduces)
+	}
+	if opConsumes, ok := op["consumes"]; ok {
+		consumes = stringList(opConsumes)
+	}
+
+	res := document{}
+	for key, val := range op {
+		switch key {
+		case "produces", "consumes", "schemes":
+			// these are expressed through content types in OpenAPI v3
+		case "parameters":
+			var params []interface{}
+			rawParams, _ := val.([]interface{})
+			for _, rawParam := range rawParams {
+				param, ok := rawParam.(document)
+				if !ok {
+					continue
+				}
+				if param["in"] == "body" {
+					res["requestBody"] = convertBodyParameter(param, consumes)
+					continue
+				}
+				params = append(params, convertParameter(param))
+			}
+			if len(params) > 0 {
+				res["parameters"] = params
+			}
+		case "responses":
+			responses := document{}
+			rawResponses, _ := val.(document)
+			for code, rawResp := range rawResponses {
+				resp, ok := rawResp.(document)
+				if !ok {
+					continue
+				}
+				responses[code] = convertResponse(resp, produces)
+			}
+			res["responses"] = responses
+		default:
+			res[key] = val
+		}
+	}
+	return res
+}
+
+func convertParameters(val interface{}) []interface{} {
+	rawParams, _ := val.([]interface{})
+	res := make([]interface{}, 0, len(rawParams))
+	for _, rawParam := range rawParams {
+		if param, ok := rawParam.(document); ok {
+			res = append(res, convertParameter(param))
+		}
+	}
+	return res
+}
+
+// convertParameter converts a non-body parameter, moving its type information into a schema.
+func convertParameter(param document) document {
+	res := document{}
+	schema := document{}
+	for key, val := range param {
+		switch key {
+		case "name", "in", "description", "required", "deprecated", "allowEmptyValue":
+			res[key] = val
+		case "collectionFormat":
+			// OpenAPI v3 uses style/explode instead, and the defaults match "csv"
+		default:
+			if strings.HasPrefix(key, "x-") {
+				res[key] = val
+				continue
+			}
+			schema[key] = val
+		}
+	}
+	if len(schema) > 0 {
+		res["schema"] = schema
+	}
+	return res
+}
+
+func convertBodyParameter(param document, consumes []string) document {
+	if len(consumes) == 0 {
+		consumes = []string{"*/*"}
+	}
+	content := document{}
+	for _, mediaType := range consumes {
+		content[mediaType] = document{"schema": param["schema"]}
+	}
+	res := document{"content": content}
+	if desc, ok := param["description"]; ok {
+		res["description"] = desc
+	}
+	if required, ok := param["required"]; ok {
+		res["required"] = required
+	}
+	return res
+}
+
+func convertResponse(resp document, produces []string) document {
+	res := document{}
+	for key, val := range resp {
+		if key != "schema" {
+			res[key] = val
+		}
+	}
+	if schema, ok := resp["schema"]; ok {
+		if len(produces) == 0 {
+			produces = []string{"*/*"}
+		}
+		content := document{}
+		for _, mediaType := range produces {
+			content[mediaType] = document{"schema": schema}
+		}
+		res["content"] = content
+	}
+	return res
+}
+
+// rewriteRefs rewrites any references to OpenAPI v2 definitions to point at v3 component schemas.
+func rewriteRefs(val interface{}) {
+	switch val := val.(type) {
+	case document:
+		for key, child := range val {
+			if ref, ok := child.(string); ok && key == "$ref" && strings.HasPrefix(ref, v2DefinitionsPrefix) {
+				val[key] = v3SchemasPrefix + strings.TrimPrefix(ref, v2DefinitionsPrefix)
+				continue
+			}
+			rewriteRefs(child)
+		}
+	case []interface{}:
+		for _, child := range val {
+			rewriteRefs(child)
+		}
+	}
+}
+
+// collectSchemas finds all the schemas transitively referenced by the given value,
+// converting them and adding them to the given set of schemas.
+func collectSchemas(val interface{}, definitions document, schemas document) {
+	switch val := val.(type) {
+	case document:
+		for key, child := range val {
+			if ref, ok := child.(string); ok && key == "$ref" && strings.HasPrefix(ref, v3SchemasPrefix) {
+				name := strings.TrimPrefix(ref, v3SchemasPrefix)
+				if _, seen := schemas[name]; seen {
+					continue
+				}
+				def, ok := definitions[name]
+				if !ok {
+					continue
+				}
+				// NB: definitions are shared between docs, so copy before rewriting
+				def = deepCopy(def)
+				rewriteRefs(def)
+				schemas[name] = def
+				collectSchemas(def, definitions, schemas)
+				continue
+			}
+			collectSchemas(child, definitions, schemas)
+		}
+	case []interface{}:
+		for _, child := range val {
+			collectSchemas(child, definitions, schemas)
+		}
+	}
+}
+
+func deepCopy(val interface{}) interface{} {
+	switch val := val.(type) {
+	case document:
+		res := make(document, len(val))
+		for key, child := range val {
+			res[key] = deepCopy(child)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, child := range val {
+			res[i] = deepCopy(child)
+		}
+		return res
+	default:
+		return val
+	}
+}
+
+func stringList(val interface{}) []string {
+	rawList, _ := val.([]interface{})
+	res := make([]string, 0, len(rawList))
+	for _, rawItem := range rawList {
+		if item, ok := rawItem.(string); ok {
+			res = append(res, item)
+		}
+	}
+	return res
+}
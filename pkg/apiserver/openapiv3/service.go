@@ -0,0 +1,129 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapiv3 serves OpenAPI v3 documents for the API server, in the same
+// layout as newer Kubernetes API servers: a discovery document at /openapi/v3
+// pointing at one document per group-version under /openapi/v3/<path>.
+//
+// The vendored API server only knows how to produce OpenAPI v2, so the v3
+// documents are converted from the v2 spec built from the registered web services.
+package openapiv3
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	restful "github.com/emicklei/go-restful"
+	"k8s.io/apiserver/pkg/server/mux"
+	"k8s.io/kube-openapi/pkg/builder"
+	"k8s.io/kube-openapi/pkg/common"
+)
+
+// Path is the path of the OpenAPI v3 discovery document.
+const Path = "/openapi/v3"
+
+// Discovery lists the available OpenAPI v3 documents.
+type Discovery struct {
+	Paths map[string]DiscoveryPath `json:"paths"`
+}
+
+// DiscoveryPath locates the OpenAPI v3 document for a single group-version.
+type DiscoveryPath struct {
+	// ServerRelativeURL is the URL of the document, including a hash of its
+	// contents, so that clients can cache it.
+	ServerRelativeURL string `json:"serverRelativeURL"`
+}
+
+type servedDocument struct {
+	data []byte
+	hash string
+}
+
+// Service serves the OpenAPI v3 documents.
+type Service struct {
+	discovery []byte
+	docs      map[string]servedDocument
+}
+
+// NewService builds the OpenAPI v3 documents for the given web services.
+func NewService(webServices []*restful.WebService, config *common.Config) (*Service, error) {
+	swagger, err := builder.BuildOpenAPISpec(webServices, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build OpenAPI v2 spec: %v", err)
+	}
+	docs, err := splitByGroupVersion(swagger)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &Service{docs: make(map[string]servedDocument, len(docs))}
+	discovery := Discovery{Paths: make(map[string]DiscoveryPath, len(docs))}
+	for key, doc := range docs {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to serialize OpenAPI v3 document for %q: %v", key, err)
+		}
+		hash := fmt.Sprintf("%X", sha512.Sum512(data))
+		svc.docs[key] = servedDocument{data: data, hash: hash}
+		discovery.Paths[key] = DiscoveryPath{ServerRelativeURL: Path + "/" + key + "?hash=" + hash}
+	}
+	svc.discovery, err = json.Marshal(discovery)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize OpenAPI v3 discovery document: %v", err)
+	}
+	return svc, nil
+}
+
+// Install registers the discovery document and group-version documents with the given mux.
+func (s *Service) Install(m *mux.PathRecorderMux) {
+	m.Handle(Path, s)
+	m.HandlePrefix(Path+"/", s)
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.Trim(strings.TrimPrefix(req.URL.Path, Path), "/")
+	if key == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache, private")
+		w.Write(s.discovery)
+		return
+	}
+
+	doc, ok := s.docs[key]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+doc.hash+`"`)
+	if req.URL.Query().Get("hash") == doc.hash {
+		// the URL uniquely identifies the contents, so they can be cached indefinitely
+		w.Header().Set("Cache-Control", "public, immutable, max-age=31536000")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache, private")
+	}
+	if match := req.Header.Get("If-None-Match"); match == `"`+doc.hash+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(doc.data)
+}
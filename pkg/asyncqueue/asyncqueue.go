@@ -0,0 +1,112 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package asyncqueue queues items to be handled asynchronously, by a single goroutine, so
+// that producers on the scrape path (e.g. the scrape audit log and status socket) never block
+// on a slow consumer: items that don't fit in the bounded queue, or are queued once it's
+// closed, are dropped instead, with the reason passed to the queue's Drop callback.
+package asyncqueue
+
+import (
+	"sync"
+)
+
+const (
+	// DropReasonQueueFull is why items are dropped when the queue's full.
+	DropReasonQueueFull = "queue_full"
+	// DropReasonClosed is why items are dropped when they're queued after the queue's closed.
+	DropReasonClosed = "closed"
+)
+
+// Options configures a Queue.
+type Options struct {
+	// Size is the number of items which may be waiting to be handled,
+	// beyond which items are dropped.  It must be positive.
+	Size int
+	// Handle handles each item in turn, on the queue's goroutine.  drained is set if
+	// there are no more items waiting (e.g. to flush what's been handled so far).
+	Handle func(item interface{}, drained bool)
+	// Stop, if set, is called on the queue's goroutine once it's closed, and every queued
+	// item's been handled (e.g. to close what they were handled with).
+	Stop func()
+	// Drop, if set, is called with the reason for every item dropped instead of being queued.
+	Drop func(reason string)
+}
+
+// Queue is a bounded queue of items to be handled asynchronously.
+type Queue struct {
+	opts  Options
+	items chan interface{}
+	done  chan struct{}
+
+	// closeMu guards against queueing items once the queue's closed.
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// New starts handling the items queued with the given options.
+func New(opts Options) *Queue {
+	q := &Queue{
+		opts:  opts,
+		items: make(chan interface{}, opts.Size),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Push queues the given item to be handled, dropping it if the queue's full (or closed),
+// so it never blocks.
+func (q *Queue) Push(item interface{}) {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+	if q.closed {
+		q.drop(DropReasonClosed)
+		return
+	}
+	select {
+	case q.items <- item:
+	default:
+		q.drop(DropReasonQueueFull)
+	}
+}
+
+func (q *Queue) drop(reason string) {
+	if q.opts.Drop != nil {
+		q.opts.Drop(reason)
+	}
+}
+
+// Close stops queueing items, and waits for those already queued to be handled,
+// and for Stop to return.  It's safe to call more than once.
+func (q *Queue) Close() {
+	q.closeMu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.closeMu.Unlock()
+	<-q.done
+}
+
+// run handles queued items until the queue's closed.
+func (q *Queue) run() {
+	defer close(q.done)
+	for item := range q.items {
+		q.opts.Handle(item, len(q.items) == 0)
+	}
+	if q.opts.Stop != nil {
+		q.opts.Stop()
+	}
+}
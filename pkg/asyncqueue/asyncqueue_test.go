@@ -0,0 +1,114 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asyncqueue_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/asyncqueue"
+)
+
+func TestAsyncQueue(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Async Queue Suite")
+}
+
+// recorder records what a queue handles and drops.
+type recorder struct {
+	release chan struct{}
+	started chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	handled []interface{}
+	drained []bool
+	dropped []string
+	stopped bool
+}
+
+func newRecorder() *recorder {
+	return &recorder{release: make(chan struct{}), started: make(chan struct{})}
+}
+
+func (r *recorder) options(size int) Options {
+	return Options{
+		Size: size,
+		Handle: func(item interface{}, drained bool) {
+			r.once.Do(func() { close(r.started) })
+			<-r.release
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.handled = append(r.handled, item)
+			r.drained = append(r.drained, drained)
+		},
+		Stop: func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.stopped = true
+		},
+		Drop: func(reason string) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.dropped = append(r.dropped, reason)
+		},
+	}
+}
+
+var _ = Describe("Async Queue", func() {
+	It("should handle queued items in order, dropping those beyond its size rather than block", func() {
+		r := newRecorder()
+		q := New(r.options(2))
+
+		By("getting the queue stuck handling the first item")
+		q.Push(0)
+		Eventually(r.started).Should(BeClosed())
+
+		By("pushing more items than fit in the queue")
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			for i := 1; i <= 5; i++ {
+				q.Push(i)
+			}
+		}()
+		Eventually(pushed, time.Second).Should(BeClosed())
+
+		By("handling the queued items, once unstuck, before stopping")
+		close(r.release)
+		q.Close()
+		Expect(r.handled).To(Equal([]interface{}{0, 1, 2}))
+		// the first was handled before the rest were queued
+		Expect(r.drained[1:]).To(Equal([]bool{false, true}))
+		Expect(r.dropped).To(Equal([]string{DropReasonQueueFull, DropReasonQueueFull, DropReasonQueueFull}))
+		Expect(r.stopped).To(BeTrue())
+	})
+
+	It("should drop items pushed once it's closed, for being closed", func() {
+		r := newRecorder()
+		close(r.release)
+		q := New(r.options(2))
+		q.Close()
+		q.Close()
+
+		q.Push(1)
+		Expect(r.handled).To(BeEmpty())
+		Expect(r.dropped).To(Equal([]string{DropReasonClosed}))
+	})
+})
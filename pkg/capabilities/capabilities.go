@@ -0,0 +1,231 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capabilities serves a machine-readable description of what a metrics-server
+// deployment supports, for tools integrating with it: its build, the configured and effective
+// metric resolutions, the metrics API resources and verbs it serves (derived from the installed
+// storage, just like discovery), the API extensions and optional features enabled (derived from
+// its flags), and the additional usage entries it serves.
+package capabilities
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	genericversion "k8s.io/apimachinery/pkg/version"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+)
+
+// Path is the path the capabilities document is served at.
+const Path = "/capabilities"
+
+// The names of the features listed in the capabilities document.
+const (
+	// FeatureWatch is whether any metrics API resource can be watched.
+	FeatureWatch = "watch"
+	// FeaturePagination is whether lists can be paged with limit and continue.
+	FeaturePagination = "pagination"
+	// FeatureFieldSelectors is whether lists can be filtered with field selectors.
+	FeatureFieldSelectors = "fieldSelectors"
+	// FeatureResourceVersions is whether gets and lists honor resourceVersion (see provider/version.go).
+	FeatureResourceVersions = "resourceVersions"
+	// FeatureSortParam is whether lists can be ordered with the listing.SortParam parameter.
+	FeatureSortParam = "sortParam"
+	// FeatureNamesParam is whether PodMetrics lists can be restricted to the pods named
+	// with the podmetrics.NamesParam parameter.
+	FeatureNamesParam = "namesParam"
+	// FeatureOpenAPIV3 is whether OpenAPI v3 documents are served for the metrics API.
+	FeatureOpenAPIV3 = "openAPIV3"
+	// FeatureCachingHeaders is whether caching headers are served, and conditional requests answered.
+	FeatureCachingHeaders = "cachingHeaders"
+	// FeatureUnmatchedPods is whether metrics of pods with no pod object are served.
+	FeatureUnmatchedPods = "unmatchedPods"
+	// FeatureUnavailableNodes is whether nodes with no metrics are served, marked as unavailable.
+	FeatureUnavailableNodes = "unavailableNodes"
+	// FeatureNamespaceAllowlist is whether the namespaces served are restricted.
+	FeatureNamespaceAllowlist = "namespaceAllowlist"
+	// FeatureNodePartitioning is whether nodes are partitioned between replicas.
+	FeatureNodePartitioning = "nodePartitioning"
+	// FeaturePageFaultRates is whether container page fault rates are served.
+	FeaturePageFaultRates = "pageFaultRates"
+	// FeatureCPUThrottlingRates is whether container CPU throttling rates are served.
+	FeatureCPUThrottlingRates = "cpuThrottlingRates"
+	// FeatureAcceleratorStats is whether container accelerator usage is served.
+	FeatureAcceleratorStats = "acceleratorStats"
+	// FeatureSwapStats is whether node and container swap usage is served.
+	FeatureSwapStats = "swapStats"
+	// FeaturePodUsageCorrection is whether container usage exceeding the pod-level usage is corrected.
+	FeaturePodUsageCorrection = "podUsageCorrection"
+	// FeatureUsageSmoothing is whether smoothed usage can be requested with the provider.SmoothingParam parameter.
+	FeatureUsageSmoothing = "usageSmoothing"
+	// FeatureNamespaceAccess is whether PodMetrics lists across all namespaces are filtered
+	// to the namespaces the user may list them in, rather than forbidden.
+	FeatureNamespaceAccess = "namespaceAccess"
+	// FeaturePodMemoryOverhead is whether PodMetrics are annotated with the pod-level memory
+	// beyond their containers' (see podmetrics.MemoryOverheadAnnotation).
+	FeaturePodMemoryOverhead = "podMemoryOverhead"
+	// FeatureProvenance is whether the provenance of node and pod metrics can be requested
+	// with the provider.DebugParam parameter.
+	FeatureProvenance = "provenance"
+	// FeaturePodNodeNames is whether PodMetrics are annotated with the node they were
+	// measured on (see podmetrics.NodeNameAnnotation).
+	FeaturePodNodeNames = "podNodeNames"
+)
+
+// Features are the optional features enabled by flags.
+type Features struct {
+	CachingHeaders     bool
+	UnmatchedPods      bool
+	UnavailableNodes   bool
+	NamespaceAllowlist bool
+	NodePartitioning   bool
+	PageFaultRates     bool
+	CPUThrottlingRates bool
+	AcceleratorStats   bool
+	SwapStats          bool
+	PodUsageCorrection bool
+	UsageSmoothing     bool
+	NamespaceAccess    bool
+	PodMemoryOverhead  bool
+	Provenance         bool
+	PodNodeNames       bool
+}
+
+// Options configures the capabilities document.
+type Options struct {
+	// MetricResolution is the configured metric resolution.
+	MetricResolution time.Duration
+	// EffectiveResolution, if non-nil, returns the current interval between collection
+	// cycles, which may be stretched beyond, or reloaded from, the configured resolution.
+	EffectiveResolution func() time.Duration
+	// Features are the optional features enabled.
+	Features Features
+}
+
+// Document is the capabilities document.
+type Document struct {
+	Version                          *genericversion.Info `json:"version"`
+	MetricResolutionSeconds          float64              `json:"metricResolutionSeconds"`
+	EffectiveMetricResolutionSeconds float64              `json:"effectiveMetricResolutionSeconds"`
+	APIs                             []APIGroupVersion    `json:"apis"`
+	// Features lists every known feature, and whether it's enabled.
+	Features map[string]bool `json:"features"`
+	// ExtraUsageResources lists the usage entries served besides CPU and memory, where
+	// an asterisk stands for the make of an accelerator (see sink.AcceleratorResources).
+	ExtraUsageResources []string `json:"extraUsageResources"`
+}
+
+// APIGroupVersion describes the resources served for an API group version.
+type APIGroupVersion struct {
+	GroupVersion string        `json:"groupVersion"`
+	Resources    []APIResource `json:"resources"`
+}
+
+// APIResource describes a resource served, and the verbs it supports.
+type APIResource struct {
+	Name  string   `json:"name"`
+	Verbs []string `json:"verbs"`
+}
+
+// Handler serves the capabilities document.
+type Handler struct {
+	version *genericversion.Info
+	apis    []APIGroupVersion
+	opts    Options
+}
+
+// NewHandler returns a handler serving the capabilities of a metrics-server with the
+// given version, serving the given APIs, configured with the given options.
+func NewHandler(version *genericversion.Info, apis []APIGroupVersion, opts Options) *Handler {
+	return &Handler{version: version, apis: apis, opts: opts}
+}
+
+// Document returns the capabilities document, as of now.
+func (h *Handler) Document() Document {
+	features := map[string]bool{
+		FeatureWatch:              false,
+		FeaturePagination:         true,
+		FeatureFieldSelectors:     false,
+		FeatureResourceVersions:   true,
+		FeatureSortParam:          true,
+		FeatureNamesParam:         true,
+		FeatureOpenAPIV3:          true,
+		FeatureCachingHeaders:     h.opts.Features.CachingHeaders,
+		FeatureUnmatchedPods:      h.opts.Features.UnmatchedPods,
+		FeatureUnavailableNodes:   h.opts.Features.UnavailableNodes,
+		FeatureNamespaceAllowlist: h.opts.Features.NamespaceAllowlist,
+		FeatureNodePartitioning:   h.opts.Features.NodePartitioning,
+		FeaturePageFaultRates:     h.opts.Features.PageFaultRates,
+		FeatureCPUThrottlingRates: h.opts.Features.CPUThrottlingRates,
+		FeatureAcceleratorStats:   h.opts.Features.AcceleratorStats,
+		FeatureSwapStats:          h.opts.Features.SwapStats,
+		FeaturePodUsageCorrection: h.opts.Features.PodUsageCorrection,
+		FeatureUsageSmoothing:     h.opts.Features.UsageSmoothing,
+		FeatureNamespaceAccess:    h.opts.Features.NamespaceAccess,
+		FeaturePodMemoryOverhead:  h.opts.Features.PodMemoryOverhead,
+		FeatureProvenance:         h.opts.Features.Provenance,
+		FeaturePodNodeNames:       h.opts.Features.PodNodeNames,
+	}
+	for _, api := range h.apis {
+		for _, resource := range api.Resources {
+			for _, verb := range resource.Verbs {
+				if verb == "watch" {
+					features[FeatureWatch] = true
+				}
+			}
+		}
+	}
+
+	extraResources := []string{}
+	if h.opts.Features.PageFaultRates {
+		extraResources = append(extraResources, string(sink.ResourcePageFaults), string(sink.ResourceMajorPageFaults), string(sink.ResourcePageFaultWindow))
+	}
+	if h.opts.Features.CPUThrottlingRates {
+		extraResources = append(extraResources, string(sink.ResourceCPUThrottled))
+	}
+	if h.opts.Features.AcceleratorStats {
+		memory, memoryTotal, dutyCycle := sink.AcceleratorResources("*")
+		extraResources = append(extraResources, string(memory), string(memoryTotal), string(dutyCycle))
+	}
+	if h.opts.Features.SwapStats {
+		extraResources = append(extraResources, string(sink.ResourceSwap))
+	}
+	sort.Strings(extraResources)
+
+	effective := h.opts.MetricResolution
+	if h.opts.EffectiveResolution != nil {
+		effective = h.opts.EffectiveResolution()
+	}
+	return Document{
+		Version:                          h.version,
+		MetricResolutionSeconds:          h.opts.MetricResolution.Seconds(),
+		EffectiveMetricResolutionSeconds: effective.Seconds(),
+		APIs:                             h.apis,
+		Features:                         features,
+		ExtraUsageResources:              extraResources,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, private")
+	json.NewEncoder(w).Encode(h.Document())
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capabilities_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	genericversion "k8s.io/apimachinery/pkg/version"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
+)
+
+func TestCapabilities(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Capabilities Suite")
+}
+
+var metricsAPIs = []APIGroupVersion{
+	{GroupVersion: "metrics.k8s.io/v1beta1", Resources: []APIResource{
+		{Name: "nodes", Verbs: []string{"get", "list"}},
+		{Name: "pods", Verbs: []string{"get", "list"}},
+	}},
+}
+
+var _ = Describe("Capabilities Document", func() {
+	version := &genericversion.Info{GitVersion: "v0.3.0"}
+
+	It("should list the features enabled by flags, and the usage entries they add", func() {
+		doc := NewHandler(version, metricsAPIs, Options{MetricResolution: time.Minute}).Document()
+		Expect(doc.Features).To(HaveKeyWithValue(FeaturePagination, true))
+		Expect(doc.Features).To(HaveKeyWithValue(FeatureWatch, false))
+		Expect(doc.Features).To(HaveKeyWithValue(FeatureCachingHeaders, false))
+		Expect(doc.Features).To(HaveKeyWithValue(FeaturePageFaultRates, false))
+		Expect(doc.ExtraUsageResources).To(BeEmpty())
+
+		By("enabling some features")
+		toggled := NewHandler(version, metricsAPIs, Options{
+			MetricResolution: time.Minute,
+			Features:         Features{CachingHeaders: true, PageFaultRates: true, AcceleratorStats: true},
+		}).Document()
+		Expect(toggled.Features).To(HaveLen(len(doc.Features)))
+		Expect(toggled.Features).To(HaveKeyWithValue(FeatureCachingHeaders, true))
+		Expect(toggled.Features).To(HaveKeyWithValue(FeaturePageFaultRates, true))
+		Expect(toggled.Features).To(HaveKeyWithValue(FeatureAcceleratorStats, true))
+		Expect(toggled.Features).To(HaveKeyWithValue(FeatureCPUThrottlingRates, false))
+		Expect(toggled.ExtraUsageResources).To(Equal([]string{
+			"*.com/gpu-duty-cycle",
+			"*.com/gpu-memory",
+			"*.com/gpu-memory-total",
+			"metrics-server.kubernetes.io/major-page-faults",
+			"metrics-server.kubernetes.io/page-fault-window",
+			"metrics-server.kubernetes.io/page-faults",
+		}))
+	})
+
+	It("should report watch support from the verbs of the APIs served", func() {
+		watchable := []APIGroupVersion{{GroupVersion: "metrics.k8s.io/v1beta1", Resources: []APIResource{
+			{Name: "pods", Verbs: []string{"get", "list", "watch"}},
+		}}}
+		Expect(NewHandler(version, watchable, Options{}).Document().Features).To(HaveKeyWithValue(FeatureWatch, true))
+	})
+
+	It("should serve the document as JSON, with the effective resolution as of each request", func() {
+		effective := time.Minute
+		handler := NewHandler(version, metricsAPIs, Options{
+			MetricResolution:    time.Minute,
+			EffectiveResolution: func() time.Duration { return effective },
+		})
+		effective = 90 * time.Second
+
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest("GET", Path, nil))
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Header().Get("Content-Type")).To(Equal("application/json"))
+		var doc Document
+		Expect(json.Unmarshal(resp.Body.Bytes(), &doc)).To(Succeed())
+		Expect(doc.Version.GitVersion).To(Equal("v0.3.0"))
+		Expect(doc.MetricResolutionSeconds).To(Equal(60.0))
+		Expect(doc.EffectiveMetricResolutionSeconds).To(Equal(90.0))
+		Expect(doc.APIs).To(Equal(metricsAPIs))
+	})
+})
@@ -0,0 +1,614 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conformance checks that a live metrics-server deployment yields a working metrics
+// pipeline, for distributions verifying that their RBAC, certificates and flags add up: that the
+// metrics API is discoverable, that fresh and sane metrics are served for the cluster's nodes and
+// for a deployment it creates, and that selectors and (if advertised) pagination are honored.
+// Each result names its check, and failures say what's likely to be wrong, since "no metrics"
+// alone sends people down the wrong path more often than not.
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+// The names of the checks, in the order they're run.
+const (
+	// CheckDiscovery checks that the metrics API is discoverable, serving gets and lists of nodes and pods.
+	CheckDiscovery = "discovery"
+	// CheckNodeMetrics checks that NodeMetrics are served for enough of the Ready nodes.
+	CheckNodeMetrics = "node-metrics"
+	// CheckFreshness checks that the NodeMetrics served are no older than twice the metric resolution.
+	CheckFreshness = "freshness"
+	// CheckPodMetrics checks that PodMetrics are served for the pod of a test deployment.
+	CheckPodMetrics = "pod-metrics"
+	// CheckUsageSanity checks that the usage served is plausible, given the nodes' capacity
+	// and the test pod's requests and limits.
+	CheckUsageSanity = "usage-sanity"
+	// CheckLabelSelector checks that PodMetrics lists honor label selectors.
+	CheckLabelSelector = "label-selector"
+	// CheckPagination checks that NodeMetrics lists can be paged, if pagination is advertised.
+	CheckPagination = "pagination"
+)
+
+// metricsAPIPath is the path of the metrics API version checked.
+const metricsAPIPath = "/apis/metrics.k8s.io/v1beta1"
+
+// testContainerName is the name of the test deployment's container.
+const testContainerName = "pause"
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	// StatusPassed is the status of a check which passed.
+	StatusPassed Status = "passed"
+	// StatusFailed is the status of a check which failed.
+	StatusFailed Status = "failed"
+	// StatusSkipped is the status of a check which wasn't applicable, or which
+	// couldn't be run because a check it requires didn't pass.
+	StatusSkipped Status = "skipped"
+)
+
+// Result is the outcome of a check, and what was found.
+type Result struct {
+	Check   string
+	Status  Status
+	Message string
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%s %s: %s", r.Check, r.Status, r.Message)
+}
+
+// Failed returns the results of the checks which failed.
+func Failed(results []Result) []Result {
+	var res []Result
+	for _, result := range results {
+		if result.Status == StatusFailed {
+			res = append(res, result)
+		}
+	}
+	return res
+}
+
+// Config configures the checks.
+type Config struct {
+	// Namespace is the namespace the test deployment is created in.
+	Namespace string
+	// ServiceNamespace and ServiceName name metrics-server's service, through
+	// which its capabilities document is fetched.
+	ServiceNamespace string
+	ServiceName      string
+	// MinNodeCoverage is the minimum fraction of the Ready nodes which must have NodeMetrics.
+	MinNodeCoverage float64
+	// MetricResolution is the metric resolution assumed if the capabilities document can't be fetched.
+	MetricResolution time.Duration
+	// Timeout bounds how long to wait for the test deployment's pod to run, and for its metrics to be served.
+	Timeout time.Duration
+	// PollInterval is how often to check while waiting.
+	PollInterval time.Duration
+	// Image is the image of the test deployment's container.
+	Image string
+	// Checks, if non-empty, restricts the checks run to those named, and the checks they require.
+	Checks []string
+}
+
+// DefaultConfig returns the configuration for checking a metrics-server deployed from
+// the manifests in this repository.
+func DefaultConfig() Config {
+	return Config{
+		Namespace:        metav1.NamespaceDefault,
+		ServiceNamespace: metav1.NamespaceSystem,
+		ServiceName:      "metrics-server",
+		MinNodeCoverage:  0.9,
+		MetricResolution: 60 * time.Second,
+		Timeout:          5 * time.Minute,
+		PollInterval:     5 * time.Second,
+		Image:            "k8s.gcr.io/pause:3.1",
+	}
+}
+
+// check is a check run by the suite, and the checks which must pass before it's run.
+type check struct {
+	name     string
+	requires []string
+	run      func(ctx context.Context) Result
+}
+
+// Suite runs the checks against the metrics-server serving the metrics API of a cluster.
+type Suite struct {
+	client kubernetes.Interface
+	cfg    Config
+	now    func() time.Time
+
+	// what's found by the checks, for the checks requiring them
+	capabilities *capabilities.Document
+	resolution   time.Duration
+	nodes        []corev1.Node
+	nodeMetrics  []v1beta1.NodeMetrics
+	deployment   *appsv1.Deployment
+	testPod      *corev1.Pod
+	podMetrics   *v1beta1.PodMetrics
+}
+
+// NewSuite returns a suite checking the metrics API of the cluster the given client talks to.
+func NewSuite(client kubernetes.Interface, cfg Config) *Suite {
+	return &Suite{client: client, cfg: cfg, now: time.Now}
+}
+
+func (s *Suite) checks() []check {
+	return []check{
+		{name: CheckDiscovery, run: s.checkDiscovery},
+		{name: CheckNodeMetrics, requires: []string{CheckDiscovery}, run: s.checkNodeMetrics},
+		{name: CheckFreshness, requires: []string{CheckNodeMetrics}, run: s.checkFreshness},
+		{name: CheckPodMetrics, requires: []string{CheckDiscovery}, run: s.checkPodMetrics},
+		{name: CheckUsageSanity, requires: []string{CheckNodeMetrics, CheckPodMetrics}, run: s.checkUsageSanity},
+		{name: CheckLabelSelector, requires: []string{CheckPodMetrics}, run: s.checkLabelSelector},
+		{name: CheckPagination, requires: []string{CheckNodeMetrics}, run: s.checkPagination},
+	}
+}
+
+// selected returns the names of the checks to run: those configured, and the checks they require.
+func (s *Suite) selected(checks []check) (map[string]bool, error) {
+	res := make(map[string]bool, len(checks))
+	if len(s.cfg.Checks) == 0 {
+		for _, c := range checks {
+			res[c.name] = true
+		}
+		return res, nil
+	}
+	byName := make(map[string]check, len(checks))
+	for _, c := range checks {
+		byName[c.name] = c
+	}
+	var add func(name string) error
+	add = func(name string) error {
+		c, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown check %q", name)
+		}
+		res[name] = true
+		for _, required := range c.requires {
+			if err := add(required); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range s.cfg.Checks {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Run runs the checks in order, returning the result of each, and then deletes the test
+// deployment, if one was created.  A check whose required checks didn't pass is skipped.
+func (s *Suite) Run(ctx context.Context) ([]Result, error) {
+	checks := s.checks()
+	selected, err := s.selected(checks)
+	if err != nil {
+		return nil, err
+	}
+	defer s.cleanUp()
+
+	var results []Result
+	passed := make(map[string]bool, len(checks))
+	for _, c := range checks {
+		if !selected[c.name] {
+			continue
+		}
+		var unmet []string
+		for _, required := range c.requires {
+			if !passed[required] {
+				unmet = append(unmet, required)
+			}
+		}
+		var result Result
+		if len(unmet) > 0 {
+			result = Result{Status: StatusSkipped, Message: fmt.Sprintf("requires the %s check(s) to pass", strings.Join(unmet, ", "))}
+		} else {
+			result = c.run(ctx)
+		}
+		result.Check = c.name
+		passed[c.name] = result.Status == StatusPassed
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func passed(format string, args ...interface{}) Result {
+	return Result{Status: StatusPassed, Message: fmt.Sprintf(format, args...)}
+}
+
+func failed(format string, args ...interface{}) Result {
+	return Result{Status: StatusFailed, Message: fmt.Sprintf(format, args...)}
+}
+
+func skipped(format string, args ...interface{}) Result {
+	return Result{Status: StatusSkipped, Message: fmt.Sprintf(format, args...)}
+}
+
+// getMetrics gets the given path of the metrics API, with the given parameters, into obj.
+func (s *Suite) getMetrics(obj interface{}, params map[string]string, segments ...string) error {
+	req := s.client.Discovery().RESTClient().Get().AbsPath(append([]string{metricsAPIPath}, segments...)...)
+	for name, value := range params {
+		req = req.Param(name, value)
+	}
+	body, err := req.DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, obj)
+}
+
+func (s *Suite) checkDiscovery(ctx context.Context) Result {
+	resources, err := s.client.Discovery().ServerResourcesForGroupVersion(v1beta1.SchemeGroupVersion.String())
+	if err != nil {
+		return failed("the %s API isn't discoverable: %v; check that the v1beta1.metrics.k8s.io APIService exists and is Available (its conditions say why not: usually that the aggregator can't reach metrics-server's service, or doesn't trust its serving certificate)", v1beta1.SchemeGroupVersion, err)
+	}
+	var problems []string
+	for _, name := range []string{"nodes", "pods"} {
+		var found *metav1.APIResource
+		for i := range resources.APIResources {
+			if resources.APIResources[i].Name == name {
+				found = &resources.APIResources[i]
+			}
+		}
+		if found == nil {
+			problems = append(problems, fmt.Sprintf("the %s resource isn't served", name))
+			continue
+		}
+		for _, verb := range []string{"get", "list"} {
+			if !containsString(found.Verbs, verb) {
+				problems = append(problems, fmt.Sprintf("the %s resource doesn't support %s", name, verb))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return failed("the %s API is discoverable, but %s; check that the APIService points at metrics-server, rather than another metrics API server", v1beta1.SchemeGroupVersion, strings.Join(problems, ", and "))
+	}
+
+	s.resolution = s.cfg.MetricResolution
+	body, err := s.client.CoreV1().Services(s.cfg.ServiceNamespace).ProxyGet("https", s.cfg.ServiceName, "", capabilities.Path, nil).DoRaw()
+	if err == nil {
+		var doc capabilities.Document
+		if err = json.Unmarshal(body, &doc); err == nil {
+			s.capabilities = &doc
+			s.resolution = time.Duration(doc.EffectiveMetricResolutionSeconds * float64(time.Second))
+			return passed("the %s API serves nodes and pods, with an effective metric resolution of %v", v1beta1.SchemeGroupVersion, s.resolution)
+		}
+	}
+	return passed("the %s API serves nodes and pods, but the capabilities document couldn't be fetched through the %s/%s service (%v), so a metric resolution of %v is assumed, and pagination isn't known to be advertised", v1beta1.SchemeGroupVersion, s.cfg.ServiceNamespace, s.cfg.ServiceName, err, s.resolution)
+}
+
+func (s *Suite) checkNodeMetrics(ctx context.Context) Result {
+	nodes, err := s.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return failed("unable to list nodes: %v", err)
+	}
+	var metrics v1beta1.NodeMetricsList
+	if err := s.getMetrics(&metrics, nil, "nodes"); err != nil {
+		return failed("unable to list NodeMetrics: %v; check metrics-server's logs, and that it's authorized to list nodes and pods (its ClusterRole)", err)
+	}
+	s.nodes = nodes.Items
+	s.nodeMetrics = metrics.Items
+
+	served := make(map[string]bool, len(metrics.Items))
+	for _, m := range metrics.Items {
+		served[m.Name] = true
+	}
+	var ready int
+	var missing []string
+	for _, node := range nodes.Items {
+		if !nodeReady(node) {
+			continue
+		}
+		ready++
+		if !served[node.Name] {
+			missing = append(missing, node.Name)
+		}
+	}
+	if ready == 0 {
+		return skipped("there are no Ready nodes")
+	}
+	coverage := float64(ready-len(missing)) / float64(ready)
+	if coverage < s.cfg.MinNodeCoverage {
+		sort.Strings(missing)
+		return failed("only %d of the %d Ready nodes (%.0f%%, under the minimum of %.0f%%) have NodeMetrics, missing %s; check metrics-server's logs for errors scraping these nodes, which usually mean it can't reach their Kubelets (see --kubelet-preferred-address-types) or verify their serving certificates (see --kubelet-insecure-tls)",
+			ready-len(missing), ready, 100*coverage, 100*s.cfg.MinNodeCoverage, strings.Join(missing, ", "))
+	}
+	return passed("%d of the %d Ready nodes have NodeMetrics", ready-len(missing), ready)
+}
+
+// sampleAge returns the age of the sample of the given metrics, from their sample age
+// annotation if served, so as not to depend on the clocks agreeing, or else from their timestamp.
+func (s *Suite) sampleAge(meta metav1.ObjectMeta, timestamp metav1.Time) time.Duration {
+	if age, err := time.ParseDuration(meta.Annotations[provider.SampleAgeAnnotation]); err == nil {
+		return age
+	}
+	return s.now().Sub(timestamp.Time)
+}
+
+func (s *Suite) checkFreshness(ctx context.Context) Result {
+	maxAge := 2 * s.resolution
+	var stale []string
+	for _, m := range s.nodeMetrics {
+		if age := s.sampleAge(m.ObjectMeta, m.Timestamp); age > maxAge {
+			stale = append(stale, fmt.Sprintf("%s (%v old)", m.Name, age.Round(time.Second)))
+		}
+	}
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		return failed("the NodeMetrics of %s are older than twice the metric resolution (%v); metrics-server is serving the last metrics it managed to scrape, so check its logs for errors scraping these nodes, or for collection cycles overrunning the resolution", strings.Join(stale, ", "), maxAge)
+	}
+	return passed("the NodeMetrics of all %d nodes are no older than twice the metric resolution (%v)", len(s.nodeMetrics), maxAge)
+}
+
+// testDeployment returns the test deployment, with the given name.
+func (s *Suite) testDeployment(name string) *appsv1.Deployment {
+	replicas := int32(1)
+	labels := map[string]string{"app": name}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.cfg.Namespace, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  testContainerName,
+						Image: s.cfg.Image,
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("10m"),
+								corev1.ResourceMemory: resource.MustParse("16Mi"),
+							},
+							Limits: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("100m"),
+								corev1.ResourceMemory: resource.MustParse("64Mi"),
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func (s *Suite) checkPodMetrics(ctx context.Context) Result {
+	deployment, err := s.client.AppsV1().Deployments(s.cfg.Namespace).Create(s.testDeployment("metrics-server-conformance-" + rand.String(5)))
+	if err != nil {
+		return failed("unable to create the test deployment in the %s namespace: %v", s.cfg.Namespace, err)
+	}
+	s.deployment = deployment
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	selector := metav1.FormatLabelSelector(deployment.Spec.Selector)
+	err = wait.PollImmediateUntil(s.cfg.PollInterval, func() (bool, error) {
+		pods, err := s.client.CoreV1().Pods(s.cfg.Namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return false, err
+		}
+		for i := range pods.Items {
+			if pods.Items[i].Status.Phase == corev1.PodRunning {
+				s.testPod = &pods.Items[i]
+				return true, nil
+			}
+		}
+		return false, nil
+	}, ctx.Done())
+	if err != nil {
+		return failed("the pod of the test deployment %s/%s wasn't running within %v: %v; this isn't metrics-server's fault, so check the deployment's events (e.g. that its image can be pulled)", s.cfg.Namespace, deployment.Name, s.cfg.Timeout, err)
+	}
+
+	var lastErr error
+	err = wait.PollImmediateUntil(s.cfg.PollInterval, func() (bool, error) {
+		var metrics v1beta1.PodMetrics
+		if lastErr = s.getMetrics(&metrics, nil, "namespaces", s.cfg.Namespace, "pods", s.testPod.Name); lastErr != nil {
+			return false, nil
+		}
+		for _, container := range metrics.Containers {
+			if container.Name == testContainerName {
+				s.podMetrics = &metrics
+				return true, nil
+			}
+		}
+		lastErr = fmt.Errorf("no metrics for its %s container", testContainerName)
+		return false, nil
+	}, ctx.Done())
+	if err != nil {
+		return failed("no PodMetrics were served for the running test pod %s/%s on node %s within %v (last: %v); check metrics-server's logs for errors scraping that node, and that it's authorized to list pods",
+			s.cfg.Namespace, s.testPod.Name, s.testPod.Spec.NodeName, s.cfg.Timeout, lastErr)
+	}
+	return passed("PodMetrics were served for the test pod %s/%s", s.cfg.Namespace, s.testPod.Name)
+}
+
+func (s *Suite) checkUsageSanity(ctx context.Context) Result {
+	var problems []string
+	capacities := make(map[string]corev1.ResourceList, len(s.nodes))
+	for _, node := range s.nodes {
+		capacities[node.Name] = node.Status.Capacity
+	}
+	for _, m := range s.nodeMetrics {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			usage, capacity := m.Usage[name], capacities[m.Name][name]
+			if usage.Sign() < 0 {
+				problems = append(problems, fmt.Sprintf("the %s usage of node %s is negative (%s)", name, m.Name, usage.String()))
+			} else if !capacity.IsZero() && usage.Cmp(capacity) > 0 {
+				problems = append(problems, fmt.Sprintf("the %s usage of node %s (%s) exceeds its capacity (%s)", name, m.Name, usage.String(), capacity.String()))
+			}
+		}
+	}
+
+	resources := s.deployment.Spec.Template.Spec.Containers[0].Resources
+	for _, container := range s.podMetrics.Containers {
+		if container.Name != testContainerName {
+			continue
+		}
+		memory := container.Usage[corev1.ResourceMemory]
+		if memory.Sign() <= 0 {
+			problems = append(problems, fmt.Sprintf("the memory usage of the test pod's container is %s, while a running container always uses some", memory.String()))
+		}
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			usage, limit := container.Usage[name], resources.Limits[name]
+			if usage.Sign() < 0 {
+				problems = append(problems, fmt.Sprintf("the %s usage of the test pod's container is negative (%s)", name, usage.String()))
+			} else if usage.Cmp(limit) > 0 {
+				request := resources.Requests[name]
+				problems = append(problems, fmt.Sprintf("the %s usage of the test pod's idle container (%s) exceeds its limit (%s, requesting %s)", name, usage.String(), limit.String(), request.String()))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return failed("%s; metrics-server may be misreading the Kubelet's stats (check metrics-server's and the Kubelet's versions are compatible)", strings.Join(problems, ", and "))
+	}
+	return passed("the usage of %d nodes and of the test pod is within their capacity and limits", len(s.nodeMetrics))
+}
+
+func (s *Suite) checkLabelSelector(ctx context.Context) Result {
+	selector := metav1.FormatLabelSelector(s.deployment.Spec.Selector)
+	var matching v1beta1.PodMetricsList
+	if err := s.getMetrics(&matching, map[string]string{"labelSelector": selector}, "namespaces", s.cfg.Namespace, "pods"); err != nil {
+		return failed("unable to list PodMetrics in the %s namespace with the label selector %q: %v", s.cfg.Namespace, selector, err)
+	}
+	if len(matching.Items) != 1 || matching.Items[0].Name != s.testPod.Name {
+		return failed("listing PodMetrics in the %s namespace with the label selector %q returned %s, rather than just the test pod %s; check that metrics-server's pod informer is synced, and that it's authorized to watch pods", s.cfg.Namespace, selector, podNames(matching.Items), s.testPod.Name)
+	}
+
+	excluding := selector + ",metrics-server-conformance-unmatched=true"
+	var none v1beta1.PodMetricsList
+	if err := s.getMetrics(&none, map[string]string{"labelSelector": excluding}, "namespaces", s.cfg.Namespace, "pods"); err != nil {
+		return failed("unable to list PodMetrics in the %s namespace with the label selector %q: %v", s.cfg.Namespace, excluding, err)
+	}
+	if len(none.Items) > 0 {
+		return failed("listing PodMetrics in the %s namespace with the label selector %q, matching no pods, returned %s", s.cfg.Namespace, excluding, podNames(none.Items))
+	}
+	return passed("PodMetrics lists honor label selectors")
+}
+
+func (s *Suite) checkPagination(ctx context.Context) Result {
+	if s.capabilities == nil {
+		return skipped("the capabilities document couldn't be fetched, so pagination isn't known to be advertised")
+	}
+	if !s.capabilities.Features[capabilities.FeaturePagination] {
+		return skipped("pagination isn't advertised")
+	}
+
+	seen := make(map[string]bool, len(s.nodeMetrics))
+	var continueToken string
+	for pages := 0; ; pages++ {
+		if pages > len(s.nodeMetrics) {
+			return failed("paging through NodeMetrics one at a time took more pages than there are NodeMetrics (%d); the continue tokens aren't making progress", len(s.nodeMetrics))
+		}
+		params := map[string]string{"limit": "1"}
+		if continueToken != "" {
+			params["continue"] = continueToken
+		}
+		var page v1beta1.NodeMetricsList
+		if err := s.getMetrics(&page, params, "nodes"); err != nil {
+			return failed("unable to list NodeMetrics with a limit of 1 (page %d): %v", pages+1, err)
+		}
+		if len(page.Items) > 1 {
+			return failed("listing NodeMetrics with a limit of 1 returned %d of them (page %d); pagination is advertised, but limits aren't honored", len(page.Items), pages+1)
+		}
+		for _, m := range page.Items {
+			if seen[m.Name] {
+				return failed("paging through NodeMetrics returned %s twice (page %d)", m.Name, pages+1)
+			}
+			seen[m.Name] = true
+		}
+		continueToken = page.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	var missing []string
+	for _, m := range s.nodeMetrics {
+		if !seen[m.Name] {
+			missing = append(missing, m.Name)
+		}
+	}
+	// nodes may come and go between the lists, but not so many as to hide a broken continue token
+	if len(missing) > len(s.nodeMetrics)/10 {
+		sort.Strings(missing)
+		return failed("paging through NodeMetrics one at a time skipped %s, which an unpaged list returned", strings.Join(missing, ", "))
+	}
+	return passed("paging through NodeMetrics one at a time returned %d of them", len(seen))
+}
+
+// cleanUp deletes the test deployment, if one was created, along with its pods.
+func (s *Suite) cleanUp() {
+	if s.deployment == nil {
+		return
+	}
+	propagation := metav1.DeletePropagationForeground
+	if err := s.client.AppsV1().Deployments(s.deployment.Namespace).Delete(s.deployment.Name, &metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil {
+		glog.Warningf("Unable to delete the test deployment %s/%s: %v", s.deployment.Namespace, s.deployment.Name, err)
+	}
+	s.deployment = nil
+}
+
+func nodeReady(node corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func podNames(items []v1beta1.PodMetrics) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+	return false
+}
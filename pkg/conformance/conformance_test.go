@@ -0,0 +1,235 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/capabilities"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/conformance"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+func TestConformance(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Conformance Suite")
+}
+
+// fakeAPIServer serves just enough of the Kubernetes and metrics APIs for the checks
+// not needing a test deployment.
+type fakeAPIServer struct {
+	// resources are the metrics API resources discovered, or nil if the API isn't served.
+	resources    []metav1.APIResource
+	nodes        []corev1.Node
+	nodeMetrics  []v1beta1.NodeMetrics
+	capabilities *capabilities.Document
+	// ignoreLimit serves every NodeMetrics in each list, regardless of the limit.
+	ignoreLimit bool
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var obj interface{}
+	switch r.URL.Path {
+	case "/apis/metrics.k8s.io/v1beta1":
+		if f.resources == nil {
+			http.NotFound(w, r)
+			return
+		}
+		obj = &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "metrics.k8s.io/v1beta1",
+			APIResources: f.resources,
+		}
+	case "/api/v1/nodes":
+		obj = &corev1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}, Items: f.nodes}
+	case "/apis/metrics.k8s.io/v1beta1/nodes":
+		list := &v1beta1.NodeMetricsList{TypeMeta: metav1.TypeMeta{Kind: "NodeMetricsList", APIVersion: "metrics.k8s.io/v1beta1"}}
+		start, _ := strconv.Atoi(r.URL.Query().Get("continue"))
+		end := len(f.nodeMetrics)
+		if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && !f.ignoreLimit && start+limit < end {
+			end = start + limit
+			list.Continue = strconv.Itoa(end)
+		}
+		list.Items = f.nodeMetrics[start:end]
+		obj = list
+	case "/api/v1/namespaces/kube-system/services/https:metrics-server:/proxy/capabilities":
+		if f.capabilities == nil {
+			http.Error(w, "no endpoints available for service \"metrics-server\"", http.StatusServiceUnavailable)
+			return
+		}
+		obj = f.capabilities
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+func readyNode(name string, ready bool) corev1.Node {
+	status := corev1.ConditionTrue
+	if !ready {
+		status = corev1.ConditionFalse
+	}
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}},
+			Capacity: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("4"),
+				corev1.ResourceMemory: resource.MustParse("16Gi"),
+			},
+		},
+	}
+}
+
+func nodeMetrics(name string, age time.Duration) v1beta1.NodeMetrics {
+	return v1beta1.NodeMetrics{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{provider.SampleAgeAnnotation: age.String()}},
+		Timestamp:  metav1.Time{Time: time.Now().Add(-age)},
+		Window:     metav1.Duration{Duration: 30 * time.Second},
+		Usage: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("500m"),
+			corev1.ResourceMemory: resource.MustParse("2Gi"),
+		},
+	}
+}
+
+var _ = Describe("Conformance Checks", func() {
+	var (
+		apiServer *fakeAPIServer
+		server    *httptest.Server
+		cfg       Config
+	)
+
+	BeforeEach(func() {
+		verbs := metav1.Verbs{"get", "list"}
+		apiServer = &fakeAPIServer{
+			resources: []metav1.APIResource{
+				{Name: "nodes", Kind: "NodeMetrics", Verbs: verbs},
+				{Name: "pods", Namespaced: true, Kind: "PodMetrics", Verbs: verbs},
+			},
+			nodes:       []corev1.Node{readyNode("node-a", true), readyNode("node-b", true), readyNode("node-c", true)},
+			nodeMetrics: []v1beta1.NodeMetrics{nodeMetrics("node-a", 10*time.Second), nodeMetrics("node-b", 20*time.Second), nodeMetrics("node-c", 5*time.Second)},
+			capabilities: &capabilities.Document{
+				EffectiveMetricResolutionSeconds: 30,
+				Features:                         map[string]bool{capabilities.FeaturePagination: true},
+			},
+		}
+		server = httptest.NewServer(apiServer)
+		cfg = DefaultConfig()
+		cfg.Checks = []string{CheckFreshness, CheckPagination}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	run := func() map[string]Result {
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		results, err := NewSuite(client, cfg).Run(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		byCheck := make(map[string]Result, len(results))
+		for _, result := range results {
+			byCheck[result.Check] = result
+		}
+		return byCheck
+	}
+
+	It("should pass the selected checks, and those they require, against a working metrics-server", func() {
+		results := run()
+		Expect(results).To(HaveLen(4))
+		for _, check := range []string{CheckDiscovery, CheckNodeMetrics, CheckFreshness, CheckPagination} {
+			Expect(results[check].Status).To(Equal(StatusPassed), results[check].String())
+		}
+		Expect(results[CheckDiscovery].Message).To(ContainSubstring("effective metric resolution of 30s"))
+		Expect(results[CheckPagination].Message).To(ContainSubstring("returned 3 of them"))
+	})
+
+	It("should fail discovery when the metrics API isn't served, skipping the checks requiring it", func() {
+		apiServer.resources = nil
+
+		results := run()
+		Expect(results[CheckDiscovery].Status).To(Equal(StatusFailed))
+		Expect(results[CheckDiscovery].Message).To(ContainSubstring("APIService"))
+		Expect(results[CheckNodeMetrics].Status).To(Equal(StatusSkipped))
+		Expect(results[CheckNodeMetrics].Message).To(ContainSubstring("requires the discovery check(s) to pass"))
+		Expect(results[CheckFreshness].Status).To(Equal(StatusSkipped))
+	})
+
+	It("should fail when too few of the Ready nodes have NodeMetrics, naming those missing", func() {
+		apiServer.nodes = append(apiServer.nodes, readyNode("node-d", true), readyNode("node-e", false))
+		apiServer.nodeMetrics = apiServer.nodeMetrics[:2]
+
+		results := run()
+		Expect(results[CheckNodeMetrics].Status).To(Equal(StatusFailed))
+		Expect(results[CheckNodeMetrics].Message).To(HavePrefix("only 2 of the 4 Ready nodes (50%, under the minimum of 90%) have NodeMetrics, missing node-c, node-d;"))
+
+		cfg.MinNodeCoverage = 0.5
+		Expect(run()[CheckNodeMetrics].Status).To(Equal(StatusPassed))
+	})
+
+	It("should fail freshness when NodeMetrics are older than twice the metric resolution", func() {
+		apiServer.nodeMetrics[1] = nodeMetrics("node-b", 90*time.Second)
+
+		result := run()[CheckFreshness]
+		Expect(result.Status).To(Equal(StatusFailed))
+		Expect(result.Message).To(HavePrefix("the NodeMetrics of node-b (1m30s old) are older than twice the metric resolution (1m0s);"))
+	})
+
+	It("should assume the configured resolution, and skip pagination, without the capabilities document", func() {
+		apiServer.capabilities = nil
+		apiServer.nodeMetrics[1] = nodeMetrics("node-b", 90*time.Second)
+
+		results := run()
+		Expect(results[CheckDiscovery].Status).To(Equal(StatusPassed))
+		Expect(results[CheckDiscovery].Message).To(ContainSubstring("a metric resolution of 1m0s is assumed"))
+		Expect(results[CheckFreshness].Status).To(Equal(StatusPassed))
+		Expect(results[CheckPagination].Status).To(Equal(StatusSkipped))
+	})
+
+	It("should fail pagination when it's advertised, but limits aren't honored", func() {
+		apiServer.ignoreLimit = true
+
+		result := run()[CheckPagination]
+		Expect(result.Status).To(Equal(StatusFailed))
+		Expect(result.Message).To(ContainSubstring("limits aren't honored"))
+
+		apiServer.capabilities.Features[capabilities.FeaturePagination] = false
+		Expect(run()[CheckPagination].Status).To(Equal(StatusSkipped))
+	})
+
+	It("should refuse to run unknown checks", func() {
+		cfg.Checks = []string{"no-such-check"}
+		_, err := NewSuite(nil, cfg).Run(context.Background())
+		Expect(err).To(MatchError(`unknown check "no-such-check"`))
+	})
+})
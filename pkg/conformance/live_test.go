@@ -0,0 +1,64 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conformance_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/conformance"
+)
+
+var (
+	kubeconfig      = flag.String("kubeconfig", "", "the kubeconfig of a live cluster whose metrics-server to check; the live checks are skipped unless given")
+	namespace       = flag.String("namespace", DefaultConfig().Namespace, "the namespace to create the test deployment in")
+	minNodeCoverage = flag.Float64("min-node-coverage", DefaultConfig().MinNodeCoverage, "the minimum fraction of the Ready nodes which must have NodeMetrics")
+	checks          = flag.String("checks", "", "a comma-separated list of the checks to run (and those they require), rather than all of them")
+)
+
+// Run against a live cluster with e.g.:
+//
+//	go test ./pkg/conformance/ -args -kubeconfig=$HOME/.kube/config
+var _ = Describe("Conformance of a live metrics-server", func() {
+	It("should pass every check", func() {
+		if *kubeconfig == "" {
+			Skip("no -kubeconfig given")
+		}
+		restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		Expect(err).NotTo(HaveOccurred())
+		client, err := kubernetes.NewForConfig(restConfig)
+		Expect(err).NotTo(HaveOccurred())
+
+		cfg := DefaultConfig()
+		cfg.Namespace = *namespace
+		cfg.MinNodeCoverage = *minNodeCoverage
+		if *checks != "" {
+			cfg.Checks = strings.Split(*checks, ",")
+		}
+		results, err := NewSuite(client, cfg).Run(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		for _, result := range results {
+			fmt.Fprintln(GinkgoWriter, result)
+		}
+		Expect(Failed(results)).To(BeEmpty())
+	})
+})
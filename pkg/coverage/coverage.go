@@ -0,0 +1,154 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package coverage tracks how much of the cluster's capacity the stored metrics cover,
+// weighting each node by its allocatable CPU and memory, since a gap on one huge node
+// matters more than gaps on several tiny ones.
+package coverage
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+var (
+	cpuCoverage = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "cpu_capacity_coverage_ratio",
+			Help:      "The fraction of the allocatable CPU of the scraped nodes belonging to nodes with fresh metrics in the last committed batch",
+		},
+	)
+	memoryCoverage = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "memory_capacity_coverage_ratio",
+			Help:      "The fraction of the allocatable memory of the scraped nodes belonging to nodes with fresh metrics in the last committed batch",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cpuCoverage)
+	prometheus.MustRegister(memoryCoverage)
+}
+
+// Coverage is the fraction of the cluster's allocatable capacity covered by fresh metrics.
+type Coverage struct {
+	CPU    float64
+	Memory float64
+}
+
+// Tracker publishes the capacity coverage of each committed batch, and acts as a health
+// check failing while the coverage is below a minimum.
+type Tracker struct {
+	nodes  v1listers.NodeLister
+	filter sources.NodeFilter
+	maxAge time.Duration
+	min    float64
+
+	mu        sync.RWMutex
+	committed bool
+	coverage  Coverage
+}
+
+var _ sink.NodeTimestampObserver = &Tracker{}
+
+// NewTracker returns a tracker weighing nodes by their allocatable capacity from the given
+// lister, counting only those selected by the given filter (if any) towards the total.  Nodes
+// count as covered if their metrics are no older than the given age when committed.  The
+// health check fails while either ratio is below the given minimum, or never if it's zero.
+func NewTracker(nodes v1listers.NodeLister, filter sources.NodeFilter, maxAge time.Duration, min float64) *Tracker {
+	return &Tracker{nodes: nodes, filter: filter, maxAge: maxAge, min: min}
+}
+
+// NodesCommitted publishes the capacity coverage of the batch just committed.
+func (t *Tracker) NodesCommitted(timestamps map[string]time.Time) {
+	nodes, err := t.nodes.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("unable to list nodes to compute the capacity covered by metrics: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var totalCPU, freshCPU, totalMemory, freshMemory int64
+	for _, node := range nodes {
+		if t.filter != nil && !t.filter(node) {
+			continue
+		}
+		cpu := node.Status.Allocatable[corev1.ResourceCPU]
+		memory := node.Status.Allocatable[corev1.ResourceMemory]
+		totalCPU += cpu.MilliValue()
+		totalMemory += memory.Value()
+		if ts, ok := timestamps[node.Name]; ok && now.Sub(ts) <= t.maxAge {
+			freshCPU += cpu.MilliValue()
+			freshMemory += memory.Value()
+		}
+	}
+
+	coverage := Coverage{CPU: ratio(freshCPU, totalCPU), Memory: ratio(freshMemory, totalMemory)}
+	cpuCoverage.Set(coverage.CPU)
+	memoryCoverage.Set(coverage.Memory)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.committed = true
+	t.coverage = coverage
+}
+
+// ratio divides the fresh capacity by the total, with nothing to cover counting as fully covered.
+func ratio(fresh, total int64) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(fresh) / float64(total)
+}
+
+// Coverage returns the capacity coverage of the last committed batch, and
+// whether a batch has been committed yet.
+func (t *Tracker) Coverage() (Coverage, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.coverage, t.committed
+}
+
+// Check fails if the capacity coverage of the last committed batch is below the minimum.
+// It passes until the first batch is committed, so that it doesn't fail during startup.
+// It implements the health checker func part of the healthz checker.
+func (t *Tracker) Check(_ *http.Request) error {
+	if t.min == 0 {
+		return nil
+	}
+	coverage, committed := t.Coverage()
+	if !committed {
+		return nil
+	}
+	if coverage.CPU < t.min || coverage.Memory < t.min {
+		return fmt.Errorf("fresh metrics only cover %.1f%% of the allocatable CPU and %.1f%% of the allocatable memory, below the minimum of %.1f%%", coverage.CPU*100, coverage.Memory*100, t.min*100)
+	}
+	return nil
+}
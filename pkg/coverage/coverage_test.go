@@ -0,0 +1,182 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coverage_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/coverage"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestCoverage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Capacity Coverage Suite")
+}
+
+// gaugeValue fetches the value of the given gauge from the default registry.
+func gaugeValue(name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	Fail("no gauge named " + name)
+	return 0
+}
+
+// node returns a node with the given allocatable CPU and memory.
+func node(name, cpu, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse(cpu),
+				corev1.ResourceMemory: resource.MustParse(memory),
+			},
+		},
+	}
+}
+
+var _ = Describe("Capacity Coverage Tracker", func() {
+	var (
+		nodes   v1listers.NodeLister
+		now     time.Time
+		metrics sink.MetricSink
+	)
+
+	// batchOf returns a batch with metrics for each of the given nodes, taken the given time ago.
+	batchOf := func(ages map[string]time.Duration) *sources.MetricsBatch {
+		batch := &sources.MetricsBatch{}
+		for name, age := range ages {
+			batch.Nodes = append(batch.Nodes, sources.NodeMetricsPoint{
+				Name: name,
+				MetricsPoint: sources.MetricsPoint{
+					Timestamp:   now.Add(-age),
+					CpuUsage:    *resource.NewMilliQuantity(100, resource.DecimalSI),
+					MemoryUsage: *resource.NewQuantity(1000, resource.BinarySI),
+				},
+			})
+		}
+		return batch
+	}
+
+	BeforeEach(func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		for _, n := range []*corev1.Node{
+			node("huge", "64", "256Gi"),
+			node("small1", "2", "8Gi"),
+			node("small2", "2", "8Gi"),
+			node("medium", "12", "40Gi"),
+		} {
+			Expect(indexer.Add(n)).To(Succeed())
+		}
+		nodes = v1listers.NewNodeLister(indexer)
+		now = time.Now()
+		metrics, _ = provsink.NewSinkProvider()
+	})
+
+	observe := func(tracker *Tracker) {
+		observingSink, ok := metrics.(sink.NodeObservingSink)
+		Expect(ok).To(BeTrue())
+		observingSink.ObserveNodes(tracker)
+	}
+
+	It("should weigh fresh nodes by their allocatable capacity, ignoring stale and missing ones", func() {
+		tracker := NewTracker(nodes, nil, time.Minute, 0)
+		observe(tracker)
+
+		// the huge node's metrics are stale, and the medium node's are missing
+		Expect(metrics.Receive(batchOf(map[string]time.Duration{
+			"huge":   5 * time.Minute,
+			"small1": 10 * time.Second,
+			"small2": 30 * time.Second,
+		}))).To(Succeed())
+
+		coverage, committed := tracker.Coverage()
+		Expect(committed).To(BeTrue())
+		Expect(coverage.CPU).To(BeNumerically("~", 4.0/80, 1e-9))
+		Expect(coverage.Memory).To(BeNumerically("~", 16.0/312, 1e-9))
+		Expect(gaugeValue("metrics_server_storage_cpu_capacity_coverage_ratio")).To(BeNumerically("~", 4.0/80, 1e-9))
+		Expect(gaugeValue("metrics_server_storage_memory_capacity_coverage_ratio")).To(BeNumerically("~", 16.0/312, 1e-9))
+
+		By("covering nearly everything once the huge node is fresh again")
+		Expect(metrics.Receive(batchOf(map[string]time.Duration{
+			"huge":   10 * time.Second,
+			"small1": 10 * time.Second,
+			"small2": 10 * time.Second,
+		}))).To(Succeed())
+		coverage, _ = tracker.Coverage()
+		Expect(coverage.CPU).To(BeNumerically("~", 68.0/80, 1e-9))
+		Expect(coverage.Memory).To(BeNumerically("~", 272.0/312, 1e-9))
+	})
+
+	It("should leave nodes excluded by the filter out of the total", func() {
+		tracker := NewTracker(nodes, func(node *corev1.Node) bool { return node.Name != "huge" }, time.Minute, 0)
+		observe(tracker)
+
+		Expect(metrics.Receive(batchOf(map[string]time.Duration{
+			"small1": 10 * time.Second,
+			"medium": 10 * time.Second,
+		}))).To(Succeed())
+
+		coverage, _ := tracker.Coverage()
+		Expect(coverage.CPU).To(BeNumerically("~", 14.0/16, 1e-9))
+		Expect(coverage.Memory).To(BeNumerically("~", 48.0/56, 1e-9))
+	})
+
+	It("should fail the health check while either ratio is below the minimum", func() {
+		tracker := NewTracker(nodes, nil, time.Minute, 0.8)
+		observe(tracker)
+
+		By("passing until the first batch is committed")
+		Expect(tracker.Check(nil)).To(Succeed())
+
+		// without the medium node, 85% of the CPU and 87% of the memory are still covered
+		Expect(metrics.Receive(batchOf(map[string]time.Duration{
+			"huge":   10 * time.Second,
+			"small1": 10 * time.Second,
+			"small2": 10 * time.Second,
+		}))).To(Succeed())
+		Expect(tracker.Check(nil)).To(Succeed())
+
+		// without the huge node, hardly anything is covered, despite most nodes being fresh
+		Expect(metrics.Receive(batchOf(map[string]time.Duration{
+			"small1": 10 * time.Second,
+			"small2": 10 * time.Second,
+			"medium": 10 * time.Second,
+		}))).To(Succeed())
+		err := tracker.Check(nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("20.0% of the allocatable CPU"))
+
+		By("never failing without a minimum")
+		Expect(NewTracker(nodes, nil, time.Minute, 0).Check(nil)).To(Succeed())
+	})
+})
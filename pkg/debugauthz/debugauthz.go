@@ -0,0 +1,236 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package debugauthz authorizes access to metrics-server's debug endpoints (such as
+// /debug/scrape-status and /debug/loglevel) consistently, in one of several modes selected
+// by flag: by delegating to the API server with SubjectAccessReviews, by a static token, or
+// by an allowlist of client certificate common names.  Modes are registered by name, so that
+// other builds can add their own.  Every decision is audited, and anything misconfigured
+// denies all access rather than allowing it.
+package debugauthz
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// Permission is what a request to a debug endpoint needs permission to do.
+type Permission string
+
+const (
+	// PermissionView is the permission to read the state a debug endpoint serves (GET and HEAD).
+	PermissionView Permission = "view"
+	// PermissionTrigger is the permission to change something through a debug endpoint,
+	// or trigger an action (any other method, e.g. setting a log level, or arming a capture).
+	PermissionTrigger Permission = "trigger"
+)
+
+// PermissionFor returns the permission needed by requests with the given method.
+func PermissionFor(method string) Permission {
+	if method == http.MethodGet || method == http.MethodHead {
+		return PermissionView
+	}
+	return PermissionTrigger
+}
+
+// Request is a request for access to a debug endpoint.
+type Request struct {
+	// HTTP is the request made, if any.  Without one, ModeDelegated authorizes modifying
+	// requests as "post", while ModeToken and ModeClientCert deny them, as presenting nothing.
+	HTTP *http.Request
+	// Endpoint is the path of the endpoint requested.
+	Endpoint string
+	// Permission is what the request needs permission to do.
+	Permission Permission
+	// User is who the API server authenticated the request as, if anyone.
+	User user.Info
+}
+
+// Authorizer decides whether requests may access debug endpoints.
+type Authorizer interface {
+	// Authorize decides whether the given request is allowed, returning why, either way.
+	Authorize(req Request) (allowed bool, reason string)
+}
+
+// AuthorizerFunc is an Authorizer implemented by a func.
+type AuthorizerFunc func(req Request) (bool, string)
+
+// Authorize calls the func.
+func (f AuthorizerFunc) Authorize(req Request) (bool, string) {
+	return f(req)
+}
+
+// denyAll denies every request, for the given reason.
+func denyAll(reason string) Authorizer {
+	return AuthorizerFunc(func(Request) (bool, string) {
+		return false, reason
+	})
+}
+
+// Config is what the modes need to build their authorizers.  Not every mode uses every field.
+type Config struct {
+	// Delegate is the API server's authorizer (e.g. making SubjectAccessReviews), for ModeDelegated.
+	Delegate authorizer.Authorizer
+	// Token is the static token requests must present in TokenHeader, for ModeToken.
+	Token string
+	// CommonNames are the common names of the client certificates allowed, for ModeClientCert.
+	CommonNames []string
+	// ClientCAs are the CAs client certificates are verified against, for ModeClientCert.
+	ClientCAs *x509.CertPool
+}
+
+// Factory builds the authorizer of a mode from the given config, failing if it's misconfigured.
+type Factory func(config Config) (Authorizer, error)
+
+var (
+	modesMu sync.RWMutex
+	modes   = make(map[string]Factory)
+)
+
+// Register registers a mode under the given name, e.g. from the init of a file only built with
+// some build tag.  Registering a mode twice panics.
+func Register(mode string, factory Factory) {
+	modesMu.Lock()
+	defer modesMu.Unlock()
+	if _, ok := modes[mode]; ok {
+		panic(fmt.Sprintf("debug authorization mode %q registered twice", mode))
+	}
+	modes[mode] = factory
+}
+
+// Modes returns the names of the registered modes, sorted.
+func Modes() []string {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+	res := make([]string, 0, len(modes))
+	for mode := range modes {
+		res = append(res, mode)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// New builds the authorizer of the given mode from the given config.  If the mode is unknown, or
+// misconfigured, it returns the error along with an authorizer denying everything, so that callers
+// carrying on regardless still deny access.
+func New(mode string, config Config) (Authorizer, error) {
+	modesMu.RLock()
+	factory, ok := modes[mode]
+	modesMu.RUnlock()
+	if !ok {
+		err := fmt.Errorf("unknown debug authorization mode %q, must be one of %s", mode, strings.Join(Modes(), ", "))
+		return denyAll(err.Error()), err
+	}
+	authz, err := factory(config)
+	if err != nil {
+		err = fmt.Errorf("debug authorization mode %q is misconfigured: %v", mode, err)
+		return denyAll(err.Error()), err
+	}
+	return authz, nil
+}
+
+var debugAccess = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "debug",
+		Name:      "access_total",
+		Help:      "The number of requests to debug endpoints, by endpoint, the permission needed (view or trigger), and whether they were allowed",
+	},
+	[]string{"endpoint", "permission", "decision"},
+)
+
+func init() {
+	prometheus.MustRegister(debugAccess)
+}
+
+// Guard serves debug endpoints, authorizing every request to them with an authorizer first, and
+// auditing each decision.  The API server's authorizer should be wrapped with Defer, so that the
+// guard decides alone.
+type Guard struct {
+	mode       string
+	authorizer Authorizer
+
+	mu        sync.RWMutex
+	endpoints map[string]struct{}
+}
+
+// NewGuard returns a guard authorizing requests with the given authorizer, of the given mode.
+func NewGuard(mode string, authz Authorizer) *Guard {
+	return &Guard{mode: mode, authorizer: authz, endpoints: make(map[string]struct{})}
+}
+
+// Handler returns the given handler of the debug endpoint at the given path, authorizing each
+// request to it first.
+func (g *Guard) Handler(path string, handler http.Handler) http.Handler {
+	g.mu.Lock()
+	g.endpoints[path] = struct{}{}
+	g.mu.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, httpReq *http.Request) {
+		req := Request{HTTP: httpReq, Endpoint: path, Permission: PermissionFor(httpReq.Method)}
+		if requester, ok := genericapirequest.UserFrom(httpReq.Context()); ok {
+			req.User = requester
+		}
+		allowed, reason := g.authorizer.Authorize(req)
+		g.audit(req, allowed, reason)
+		if !allowed {
+			http.Error(w, fmt.Sprintf("%s access to %s is forbidden: %s", req.Permission, path, reason), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, httpReq)
+	})
+}
+
+// audit logs, and counts, the decision on the given request.
+func (g *Guard) audit(req Request, allowed bool, reason string) {
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+	debugAccess.WithLabelValues(req.Endpoint, string(req.Permission), decision).Inc()
+	userName := ""
+	if req.User != nil {
+		userName = req.User.GetName()
+	}
+	glog.Infof("debug access %s: %s %s (%s) by user %q from %s, in mode %q: %s", decision, req.HTTP.Method, req.Endpoint, req.Permission, userName, req.HTTP.RemoteAddr, g.mode, reason)
+}
+
+// guards checks if the given path is that of a debug endpoint the guard authorizes.
+func (g *Guard) guards(path string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.endpoints[path]
+	return ok
+}
+
+// Defer wraps the given authorizer (the API server's) so that it allows every non-resource request
+// to the guard's endpoints, deferring to the guard, which authorizes them itself.  Requests to any
+// other path (including other debug paths, such as profiling) are authorized as before.
+func (g *Guard) Defer(delegate authorizer.Authorizer) authorizer.Authorizer {
+	return authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+		if !attrs.IsResourceRequest() && g.guards(attrs.GetPath()) {
+			return authorizer.DecisionAllow, "debug endpoints are authorized by the debug authorization mode", nil
+		}
+		return delegate.Authorize(attrs)
+	})
+}
@@ -0,0 +1,312 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugauthz_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/debugauthz"
+)
+
+func TestDebugAuthz(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Debug Authorization Suite")
+}
+
+// accessCount fetches the number of requests to the given endpoint with the given decision from the default registry.
+func accessCount(endpoint, decision string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != "metrics_server_debug_access_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["endpoint"] == endpoint && labels["decision"] == decision {
+				total += metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return total
+}
+
+// sarAuthorizer allows alice to get anything, carol to get or delete anything, and bob to do anything.
+var sarAuthorizer = authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	if attrs.GetUser().GetName() == "mallory" {
+		return authorizer.DecisionDeny, "", errors.New("the SubjectAccessReview failed")
+	}
+	if attrs.GetPath() != "/debug/loglevel" || attrs.IsResourceRequest() {
+		return authorizer.DecisionNoOpinion, "", nil
+	}
+	switch {
+	case attrs.GetUser().GetName() == "bob":
+		return authorizer.DecisionAllow, "bob may do anything", nil
+	case attrs.GetUser().GetName() == "alice" && attrs.GetVerb() == "get":
+		return authorizer.DecisionAllow, "alice may get", nil
+	case attrs.GetUser().GetName() == "carol" && (attrs.GetVerb() == "get" || attrs.GetVerb() == "delete"):
+		return authorizer.DecisionAllow, "carol may get or delete", nil
+	}
+	return authorizer.DecisionNoOpinion, "", nil
+})
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return &testCA{cert: cert, key: key}
+}
+
+// issue issues a certificate with the given common name, for the given usage.
+func (ca *testCA) issue(commonName string, usage x509.ExtKeyUsage) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+var _ = Describe("Debug Authorization", func() {
+	// serve makes a request with the given method to /debug/loglevel, guarded in the given mode,
+	// as the given user (if any), after changing the request as given, returning the status.
+	serve := func(mode string, config Config, method, userName string, change func(*http.Request)) int {
+		authz, _ := New(mode, config)
+		guard := NewGuard(mode, authz)
+		handler := guard.Handler("/debug/loglevel", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		req := httptest.NewRequest(method, "/debug/loglevel", nil)
+		if userName != "" {
+			req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: userName}))
+		}
+		if change != nil {
+			change(req)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	It("should need permission to view for GETs and HEADs, and to trigger for anything else", func() {
+		Expect(PermissionFor(http.MethodGet)).To(Equal(PermissionView))
+		Expect(PermissionFor(http.MethodHead)).To(Equal(PermissionView))
+		Expect(PermissionFor(http.MethodPut)).To(Equal(PermissionTrigger))
+		Expect(PermissionFor(http.MethodPost)).To(Equal(PermissionTrigger))
+		Expect(PermissionFor(http.MethodDelete)).To(Equal(PermissionTrigger))
+	})
+
+	It("should list the built-in modes", func() {
+		Expect(Modes()).To(Equal([]string{ModeClientCert, ModeDelegated, ModeToken}))
+	})
+
+	Context("delegating to the API server", func() {
+		config := Config{Delegate: sarAuthorizer}
+
+		It("should authorize viewing as get, and triggering as the request's method, of the endpoint's path", func() {
+			Expect(serve(ModeDelegated, config, http.MethodGet, "alice", nil)).To(Equal(http.StatusOK))
+			Expect(serve(ModeDelegated, config, http.MethodPut, "alice", nil)).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeDelegated, config, http.MethodPut, "bob", nil)).To(Equal(http.StatusOK))
+			Expect(serve(ModeDelegated, config, http.MethodGet, "eve", nil)).To(Equal(http.StatusForbidden))
+
+			By("authorizing each method for its own verb")
+			Expect(serve(ModeDelegated, config, http.MethodHead, "carol", nil)).To(Equal(http.StatusOK))
+			Expect(serve(ModeDelegated, config, http.MethodDelete, "carol", nil)).To(Equal(http.StatusOK))
+			Expect(serve(ModeDelegated, config, http.MethodPut, "carol", nil)).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeDelegated, config, http.MethodPost, "carol", nil)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should deny unauthenticated requests, and requests that couldn't be authorized", func() {
+			Expect(serve(ModeDelegated, config, http.MethodGet, "", nil)).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeDelegated, config, http.MethodGet, "mallory", nil)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should deny everything with authorization disabled", func() {
+			_, err := New(ModeDelegated, Config{})
+			Expect(err).To(HaveOccurred())
+			Expect(serve(ModeDelegated, Config{}, http.MethodGet, "bob", nil)).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Context("with a static token", func() {
+		config := Config{Token: "s3cret"}
+		withToken := func(token string) func(*http.Request) {
+			return func(req *http.Request) { req.Header.Set(TokenHeader, token) }
+		}
+
+		It("should allow requests presenting the token, whoever makes them", func() {
+			Expect(serve(ModeToken, config, http.MethodPut, "", withToken("s3cret"))).To(Equal(http.StatusOK))
+		})
+
+		It("should deny requests presenting the wrong token, or none", func() {
+			Expect(serve(ModeToken, config, http.MethodGet, "", withToken("guess"))).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeToken, config, http.MethodGet, "bob", nil)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should deny everything without a token configured", func() {
+			_, err := New(ModeToken, Config{})
+			Expect(err).To(HaveOccurred())
+			Expect(serve(ModeToken, Config{}, http.MethodGet, "", withToken(""))).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Context("with a client certificate common name allowlist", func() {
+		var (
+			clientCA, otherCA          *testCA
+			config                     Config
+			debugger, intruder, server *x509.Certificate
+			untrusted                  *x509.Certificate
+		)
+
+		BeforeEach(func() {
+			clientCA, otherCA = newTestCA(), newTestCA()
+			config = Config{CommonNames: []string{"debugger"}, ClientCAs: x509.NewCertPool()}
+			config.ClientCAs.AddCert(clientCA.cert)
+			debugger = clientCA.issue("debugger", x509.ExtKeyUsageClientAuth)
+			intruder = clientCA.issue("intruder", x509.ExtKeyUsageClientAuth)
+			server = clientCA.issue("debugger", x509.ExtKeyUsageServerAuth)
+			untrusted = otherCA.issue("debugger", x509.ExtKeyUsageClientAuth)
+		})
+
+		// withCert presents the given client certificate, which the API server only requests,
+		// so never verifies itself unless it's used to authenticate.
+		withCert := func(cert *x509.Certificate) func(*http.Request) {
+			return func(req *http.Request) {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			}
+		}
+
+		It("should allow requests with a client certificate from the client CA whose common name is allowed", func() {
+			Expect(serve(ModeClientCert, config, http.MethodPost, "", withCert(debugger))).To(Equal(http.StatusOK))
+		})
+
+		It("should deny requests with other common names, certificates the client CA didn't issue for client authentication, or none", func() {
+			Expect(serve(ModeClientCert, config, http.MethodGet, "", withCert(intruder))).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeClientCert, config, http.MethodGet, "", withCert(untrusted))).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeClientCert, config, http.MethodGet, "", withCert(server))).To(Equal(http.StatusForbidden))
+			Expect(serve(ModeClientCert, config, http.MethodGet, "bob", nil)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should deny everything without any common names allowed, or a client CA", func() {
+			_, err := New(ModeClientCert, Config{ClientCAs: config.ClientCAs})
+			Expect(err).To(HaveOccurred())
+			Expect(serve(ModeClientCert, Config{ClientCAs: config.ClientCAs}, http.MethodGet, "", withCert(debugger))).To(Equal(http.StatusForbidden))
+			_, err = New(ModeClientCert, Config{CommonNames: config.CommonNames})
+			Expect(err).To(HaveOccurred())
+			Expect(serve(ModeClientCert, Config{CommonNames: config.CommonNames}, http.MethodGet, "", withCert(debugger))).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	It("should authorize requests without an HTTP request in every built-in mode, without presenting anything", func() {
+		clientCAs := x509.NewCertPool()
+		clientCAs.AddCert(newTestCA().cert)
+		configs := map[string]Config{
+			ModeDelegated:  {Delegate: sarAuthorizer},
+			ModeToken:      {Token: "s3cret"},
+			ModeClientCert: {CommonNames: []string{"debugger"}, ClientCAs: clientCAs},
+		}
+		req := Request{Endpoint: "/debug/loglevel", Permission: PermissionTrigger, User: &user.DefaultInfo{Name: "bob"}}
+		for _, mode := range Modes() {
+			authz, err := New(mode, configs[mode])
+			Expect(err).NotTo(HaveOccurred())
+			allowed, _ := authz.Authorize(req)
+			// bob may trigger anything, when delegating, as "post"
+			Expect(allowed).To(Equal(mode == ModeDelegated), "in mode %s", mode)
+		}
+	})
+
+	It("should deny everything in an unknown mode", func() {
+		_, err := New("anyone", Config{Token: "s3cret"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("must be one of client-cert, delegated, token"))
+		Expect(serve("anyone", Config{Token: "s3cret"}, http.MethodGet, "bob", func(req *http.Request) {
+			req.Header.Set(TokenHeader, "s3cret")
+		})).To(Equal(http.StatusForbidden))
+	})
+
+	It("should audit every decision", func() {
+		allowedBefore, deniedBefore := accessCount("/debug/loglevel", "allowed"), accessCount("/debug/loglevel", "denied")
+		serve(ModeDelegated, Config{Delegate: sarAuthorizer}, http.MethodGet, "alice", nil)
+		serve(ModeDelegated, Config{Delegate: sarAuthorizer}, http.MethodPut, "alice", nil)
+		serve(ModeDelegated, Config{Delegate: sarAuthorizer}, http.MethodPut, "eve", nil)
+		Expect(accessCount("/debug/loglevel", "allowed") - allowedBefore).To(BeNumerically("==", 1))
+		Expect(accessCount("/debug/loglevel", "denied") - deniedBefore).To(BeNumerically("==", 2))
+	})
+
+	It("should let the API server's authorizer defer to the guard only for the endpoints guarded", func() {
+		authz, err := New(ModeToken, Config{Token: "s3cret"})
+		Expect(err).NotTo(HaveOccurred())
+		guard := NewGuard(ModeToken, authz)
+		guard.Handler("/debug/loglevel", http.NotFoundHandler())
+		deferring := guard.Defer(sarAuthorizer)
+
+		decision, _, err := deferring.Authorize(authorizer.AttributesRecord{User: &user.DefaultInfo{Name: "eve"}, Verb: "put", Path: "/debug/loglevel"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(Equal(authorizer.DecisionAllow))
+
+		decision, _, err = deferring.Authorize(authorizer.AttributesRecord{User: &user.DefaultInfo{Name: "eve"}, Verb: "get", Path: "/debug/pprof/heap"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(Equal(authorizer.DecisionNoOpinion))
+	})
+})
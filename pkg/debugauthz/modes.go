@@ -0,0 +1,145 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debugauthz
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+// The built-in modes.
+const (
+	// ModeDelegated authorizes requests as the user the API server authenticated them as, with
+	// its authorizer (i.e. SubjectAccessReviews, when delegating), as non-resource requests for
+	// the endpoint's path: "get" to view, and otherwise the request's method, in lower case, as
+	// the API server authorizes non-resource requests (e.g. "put" to set a log level).
+	ModeDelegated = "delegated"
+	// ModeToken authorizes requests presenting a static token in TokenHeader.
+	ModeToken = "token"
+	// ModeClientCert authorizes requests made with a client certificate for client
+	// authentication, verified against the client CA, whose common name is in an allowlist.
+	ModeClientCert = "client-cert"
+)
+
+// TokenHeader is the header requests present the token in, in ModeToken.  It isn't the
+// Authorization header, so that the API server's own authentication never sees the token.
+const TokenHeader = "X-Metrics-Server-Debug-Token"
+
+// delegatedVerb returns the verb the given request is authorized for when delegating.
+func delegatedVerb(req Request) string {
+	if req.Permission == PermissionView {
+		return "get"
+	}
+	if req.HTTP == nil {
+		return strings.ToLower(http.MethodPost)
+	}
+	return strings.ToLower(req.HTTP.Method)
+}
+
+func init() {
+	Register(ModeDelegated, newDelegated)
+	Register(ModeToken, newToken)
+	Register(ModeClientCert, newClientCert)
+}
+
+func newDelegated(config Config) (Authorizer, error) {
+	if config.Delegate == nil {
+		return nil, errors.New("authorization is disabled, so there's nothing to delegate to")
+	}
+	return AuthorizerFunc(func(req Request) (bool, string) {
+		if req.User == nil {
+			return false, "the request wasn't authenticated"
+		}
+		verb := delegatedVerb(req)
+		decision, reason, err := config.Delegate.Authorize(authorizer.AttributesRecord{
+			User: req.User,
+			Verb: verb,
+			Path: req.Endpoint,
+		})
+		if err != nil {
+			return false, fmt.Sprintf("unable to authorize the request: %v", err)
+		}
+		if decision != authorizer.DecisionAllow {
+			if reason == "" {
+				reason = fmt.Sprintf("the user may not %s %s", verb, req.Endpoint)
+			}
+			return false, reason
+		}
+		return true, reason
+	}), nil
+}
+
+func newToken(config Config) (Authorizer, error) {
+	if config.Token == "" {
+		return nil, errors.New("no token is configured")
+	}
+	token := []byte(config.Token)
+	return AuthorizerFunc(func(req Request) (bool, string) {
+		var presented string
+		if req.HTTP != nil {
+			presented = req.HTTP.Header.Get(TokenHeader)
+		}
+		if presented == "" {
+			return false, "no token was presented in " + TokenHeader
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), token) != 1 {
+			return false, "the token presented is wrong"
+		}
+		return true, "the token presented is right"
+	}), nil
+}
+
+func newClientCert(config Config) (Authorizer, error) {
+	if len(config.CommonNames) == 0 {
+		return nil, errors.New("no client certificate common names are allowed")
+	}
+	if config.ClientCAs == nil {
+		return nil, errors.New("no client CA is configured to verify client certificates against")
+	}
+	allowed := make(map[string]struct{}, len(config.CommonNames))
+	for _, name := range config.CommonNames {
+		allowed[name] = struct{}{}
+	}
+	return AuthorizerFunc(func(req Request) (bool, string) {
+		// the API server only requests client certificates, verifying them itself if they're
+		// used to authenticate, so they're verified here, against the client CA alone
+		if req.HTTP == nil || req.HTTP.TLS == nil || len(req.HTTP.TLS.PeerCertificates) == 0 {
+			return false, "no client certificate was presented"
+		}
+		cert := req.HTTP.TLS.PeerCertificates[0]
+		opts := x509.VerifyOptions{
+			Roots:         config.ClientCAs,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		for _, intermediate := range req.HTTP.TLS.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(intermediate)
+		}
+		if _, err := cert.Verify(opts); err != nil {
+			return false, fmt.Sprintf("the client certificate couldn't be verified against the client CA: %v", err)
+		}
+		name := cert.Subject.CommonName
+		if _, ok := allowed[name]; !ok {
+			return false, fmt.Sprintf("the client certificate's common name %q isn't allowed", name)
+		}
+		return true, fmt.Sprintf("the client certificate's common name %q is allowed", name)
+	}), nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events records Kubernetes Events about the objects metrics-server observes,
+// so that operators see problems in `kubectl get events`, not just in the logs.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// DefaultAggregationWindow is the default window within which repeated events
+// about the same object, with the same reason, are aggregated.
+const DefaultAggregationWindow = 10 * time.Minute
+
+// queueSize bounds the events waiting to be recorded, beyond which new ones are dropped.
+const queueSize = 100
+
+// Recorder records events about objects.  Recording never blocks, and failures
+// to record events are logged, rather than returned.
+type Recorder interface {
+	// Eventf records an event of the given type (normal or warning) about the given object.
+	Eventf(ref *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{})
+}
+
+// AggregatingRecorder is a Recorder which creates Events with the API server, aggregating
+// repeats of an event about the same object, with the same reason, within a window into
+// the existing Event (updating its count, message, and last timestamp), so that an object
+// flapping between states doesn't spam its events.
+type AggregatingRecorder struct {
+	client    v1core.EventsGetter
+	component string
+	window    time.Duration
+	queue     chan *corev1.Event
+	// forbidden is used to only log once that recording events is forbidden.
+	forbidden sync.Once
+
+	// recent holds the last Event recorded for each object and reason, for aggregation.
+	// It's only used by the goroutine recording the events.
+	recent map[aggregationKey]*corev1.Event
+}
+
+type aggregationKey struct {
+	kind, namespace, name, reason string
+}
+
+var _ Recorder = &AggregatingRecorder{}
+
+// NewRecorder returns a recorder creating Events from the given component (e.g. "metrics-server")
+// with the given client, aggregating repeats within the given window.  Events are only recorded
+// once RunUntil is called.
+func NewRecorder(client v1core.EventsGetter, component string, window time.Duration) *AggregatingRecorder {
+	return &AggregatingRecorder{
+		client:    client,
+		component: component,
+		window:    window,
+		queue:     make(chan *corev1.Event, queueSize),
+		recent:    make(map[aggregationKey]*corev1.Event),
+	}
+}
+
+// Eventf queues an event about the given object to be recorded.
+func (r *AggregatingRecorder) Eventf(ref *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	now := metav1.Now()
+	namespace := ref.Namespace
+	if namespace == "" {
+		// events about cluster-scoped objects, like nodes, go in the default namespace
+		namespace = metav1.NamespaceDefault
+	}
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: r.component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	select {
+	case r.queue <- event:
+	default:
+		glog.Warningf("dropping event %s about %s %q, since too many events are waiting to be recorded", reason, ref.Kind, ref.Name)
+	}
+}
+
+// RunUntil records queued events until the given channel is closed.
+func (r *AggregatingRecorder) RunUntil(stopCh <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case event := <-r.queue:
+				r.record(event)
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// record creates the given event, or aggregates it into a recent one about the same object with the same reason.
+func (r *AggregatingRecorder) record(event *corev1.Event) {
+	key := aggregationKey{
+		kind:      event.InvolvedObject.Kind,
+		namespace: event.InvolvedObject.Namespace,
+		name:      event.InvolvedObject.Name,
+		reason:    event.Reason,
+	}
+	if prev, ok := r.recent[key]; ok && event.LastTimestamp.Sub(prev.LastTimestamp.Time) < r.window {
+		aggregated := prev.DeepCopy()
+		aggregated.Count++
+		aggregated.Message = event.Message
+		aggregated.LastTimestamp = event.LastTimestamp
+		updated, err := r.client.Events(aggregated.Namespace).Update(aggregated)
+		if err == nil {
+			r.recent[key] = updated
+			return
+		}
+		if !errors.IsNotFound(err) {
+			r.logFailure(event, err)
+			return
+		}
+		// the previous event was garbage collected, so start again
+	}
+
+	created, err := r.client.Events(event.Namespace).Create(event)
+	if err != nil {
+		r.logFailure(event, err)
+		return
+	}
+	r.recent[key] = created
+	r.pruneRecent(event.LastTimestamp.Time)
+}
+
+// pruneRecent forgets events last recorded longer than the window before the given time.
+func (r *AggregatingRecorder) pruneRecent(now time.Time) {
+	for key, event := range r.recent {
+		if now.Sub(event.LastTimestamp.Time) >= r.window {
+			delete(r.recent, key)
+		}
+	}
+}
+
+// logFailure logs a failure to record the given event.  Missing permissions are only logged
+// once, since they'll affect every event, and metrics-server works fine without events.
+func (r *AggregatingRecorder) logFailure(event *corev1.Event, err error) {
+	if errors.IsForbidden(err) {
+		r.forbidden.Do(func() {
+			glog.Warningf("unable to record events, so they'll only be logged: grant metrics-server's service account the \"create\" and \"update\" verbs on \"events\" in the core API group to record them: %v", err)
+		})
+		glog.V(2).Infof("unable to record event %s about %s %q (%s): %v", event.Reason, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Message, err)
+		return
+	}
+	glog.Errorf("unable to record event %s about %s %q (%s): %v", event.Reason, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Message, err)
+}
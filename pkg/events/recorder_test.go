@@ -0,0 +1,146 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/events"
+)
+
+func TestEvents(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Events Suite")
+}
+
+// fakeAPIServer records the events created and updated in the default namespace,
+// or forbids them when forbidden is set.
+type fakeAPIServer struct {
+	mu        sync.Mutex
+	forbidden bool
+	requests  int
+	events    map[string]corev1.Event
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	w.Header().Set("Content-Type", "application/json")
+
+	if f.forbidden {
+		statusErr := apierrors.NewForbidden(schema.GroupResource{Resource: "events"}, "", fmt.Errorf("User \"system:serviceaccount:kube-system:metrics-server\" cannot create events in the namespace \"default\""))
+		w.WriteHeader(int(statusErr.ErrStatus.Code))
+		json.NewEncoder(w).Encode(&statusErr.ErrStatus)
+		return
+	}
+
+	var event corev1.Event
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Method == http.MethodPost && req.URL.Path == "/api/v1/namespaces/default/events":
+	case req.Method == http.MethodPut && req.URL.Path == "/api/v1/namespaces/default/events/"+event.Name:
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	f.events[event.Name] = event
+	json.NewEncoder(w).Encode(&event)
+}
+
+// recorded returns the events recorded so far, and the number of requests made.
+func (f *fakeAPIServer) recorded() ([]corev1.Event, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var events []corev1.Event
+	for _, event := range f.events {
+		events = append(events, event)
+	}
+	return events, f.requests
+}
+
+var _ = Describe("Aggregating Recorder", func() {
+	var (
+		apiServer *fakeAPIServer
+		server    *httptest.Server
+		stopCh    chan struct{}
+		recorder  *AggregatingRecorder
+		node      *corev1.ObjectReference
+	)
+
+	BeforeEach(func() {
+		stopCh = make(chan struct{})
+		apiServer = &fakeAPIServer{events: make(map[string]corev1.Event)}
+		server = httptest.NewServer(apiServer)
+
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		recorder = NewRecorder(client.CoreV1(), "metrics-server", time.Minute)
+		recorder.RunUntil(stopCh)
+		node = &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: "node1"}
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		server.Close()
+	})
+
+	It("should aggregate repeats of an event within the window into a single event", func() {
+		recorder.Eventf(node, corev1.EventTypeWarning, "MetricsScrapeFailing", "failed %d times", 3)
+		recorder.Eventf(node, corev1.EventTypeWarning, "MetricsScrapeFailing", "failed %d times", 4)
+		Eventually(func() int { _, requests := apiServer.recorded(); return requests }).Should(Equal(2))
+
+		events, _ := apiServer.recorded()
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Namespace).To(Equal("default"))
+		Expect(events[0].InvolvedObject.Name).To(Equal("node1"))
+		Expect(events[0].Source.Component).To(Equal("metrics-server"))
+		Expect(events[0].Count).To(BeEquivalentTo(2))
+		Expect(events[0].Message).To(Equal("failed 4 times"))
+
+		By("recording events with other reasons separately")
+		recorder.Eventf(node, corev1.EventTypeNormal, "MetricsScrapeRecovered", "recovered")
+		Eventually(func() []corev1.Event { events, _ := apiServer.recorded(); return events }).Should(HaveLen(2))
+	})
+
+	It("should carry on without blocking when recording events is forbidden", func() {
+		apiServer.mu.Lock()
+		apiServer.forbidden = true
+		apiServer.mu.Unlock()
+		for i := 0; i < 3; i++ {
+			recorder.Eventf(node, corev1.EventTypeWarning, "MetricsScrapeFailing", "failed")
+		}
+		Eventually(func() int { _, requests := apiServer.recorded(); return requests }).Should(Equal(3))
+		events, _ := apiServer.recorded()
+		Expect(events).To(BeEmpty())
+	})
+})
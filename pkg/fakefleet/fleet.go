@@ -0,0 +1,249 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakefleet runs a fleet of in-process fake Kubelets serving generated
+// summaries, so that metrics-server can be soak-tested against a synthetic
+// large cluster without any real nodes.
+package fakefleet
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ServerName is the name that the fake Kubelets' serving certificates are valid for.
+// Clients should verify against this name, and the certificate from CAData.
+const ServerName = "example.com"
+
+// ZoneLabel is the label recording the availability zone of each fake node, if they have zones.
+const ZoneLabel = "topology.kubernetes.io/zone"
+
+// Latency describes the distribution of response latencies for the fake
+// Kubelets: a fixed base latency, plus exponentially distributed jitter
+// with the given mean, which gives a realistic long tail.
+type Latency struct {
+	Base   time.Duration
+	Jitter time.Duration
+}
+
+// Config describes the fleet to generate.
+type Config struct {
+	// Nodes is the number of fake Kubelets to run.
+	Nodes int
+	// PodsPerNode is the number of pods running on each node.
+	PodsPerNode int
+	// ContainersPerPod is the number of containers in each pod.
+	ContainersPerPod int
+	// Namespaces is the number of namespaces that pods are spread across.
+	Namespaces int
+	// Zones is the number of availability zones that nodes are spread across, as recorded
+	// in their zone labels.  Without any, nodes have no zone labels.
+	Zones int
+	// Gzip compresses the summaries served to clients that accept compressed responses.
+	Gzip bool
+
+	// ChurnRate is the fraction of each node's pods that are replaced by
+	// new pods each time the node's summary is fetched.
+	ChurnRate float64
+	// Latency is the distribution of summary response latencies.
+	Latency Latency
+	// ErrorRate is the fraction of summary requests that fail with
+	// an internal server error.
+	ErrorRate float64
+	// Failures breaks the Kubelets of the named nodes in the given ways, deterministically,
+	// unlike ErrorRate, so that a partially misconfigured cluster can be simulated.
+	Failures map[string]Failure
+
+	// Seed seeds the random generation of metrics, churn, latency, and errors.
+	Seed int64
+}
+
+// Failure is a way in which a fake Kubelet is broken.
+type Failure string
+
+const (
+	// FailureUnreachable refuses connections to the Kubelet, as a firewall would.
+	FailureUnreachable Failure = "unreachable"
+	// FailureUnauthorized rejects every request's credentials (HTTP 401).
+	FailureUnauthorized Failure = "unauthorized"
+	// FailureForbidden authenticates every request, but doesn't authorize it (HTTP 403).
+	FailureForbidden Failure = "forbidden"
+	// FailureHang never responds, until the request is canceled.
+	FailureHang Failure = "hang"
+)
+
+// Stats contains counts of the requests served by the fleet, and of the
+// connections they were made over.
+type Stats struct {
+	Requests    int64
+	Errors      int64
+	Connections int64
+	// SummaryBytes is the number of bytes of summaries served, as transferred (so
+	// compressed, if they were), and UncompressedSummaryBytes before any compression.
+	SummaryBytes             int64
+	UncompressedSummaryBytes int64
+}
+
+// Fleet is a set of running fake Kubelets.  It implements a dialer that
+// routes connections for the fake nodes' addresses to the right Kubelet,
+// and provides listers for the fake nodes and the pods running on them.
+type Fleet struct {
+	config   Config
+	kubelets map[string]*kubelet
+	caData   []byte
+
+	nodes cache.Indexer
+	pods  cache.Indexer
+
+	requests          int64
+	errors            int64
+	connections       int64
+	summaryBytes      int64
+	uncompressedBytes int64
+}
+
+// New starts a new fleet of fake Kubelets with the given configuration.
+// The fleet must be closed once it's no longer needed.
+func New(config Config) (*Fleet, error) {
+	if config.Nodes <= 0 {
+		return nil, fmt.Errorf("a fleet must have at least one node")
+	}
+	if config.Nodes > 1<<24 {
+		return nil, fmt.Errorf("a fleet must have at most %d nodes", 1<<24)
+	}
+	if config.ContainersPerPod <= 0 {
+		config.ContainersPerPod = 1
+	}
+	if config.Namespaces <= 0 {
+		config.Namespaces = 1
+	}
+
+	fleet := &Fleet{
+		config:   config,
+		kubelets: make(map[string]*kubelet, config.Nodes),
+		nodes:    cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		pods:     cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+	}
+
+	created := metav1.NewTime(time.Now().Add(-1 * time.Hour))
+	for i := 0; i < config.Nodes; i++ {
+		name := fmt.Sprintf("fake-node-%d", i)
+		// give each node a unique address in 10.0.0.0/8
+		addr := fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+
+		kl := newKubelet(fleet, name, config.Seed+int64(i))
+		kl.failure = config.Failures[name]
+		kl.server = httptest.NewUnstartedServer(kl)
+		kl.server.Config.ConnState = fleet.countConnections
+		kl.server.StartTLS()
+		fleet.kubelets[addr] = kl
+		if fleet.caData == nil {
+			fleet.caData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kl.server.Certificate().Raw})
+		}
+
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				CreationTimestamp: created,
+			},
+			Status: corev1.NodeStatus{
+				Addresses: []corev1.NodeAddress{
+					{Type: corev1.NodeInternalIP, Address: addr},
+				},
+				Conditions: []corev1.NodeCondition{
+					{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+				},
+			},
+		}
+		if config.Zones > 0 {
+			node.Labels = map[string]string{ZoneLabel: fmt.Sprintf("zone-%d", i%config.Zones)}
+		}
+		if err := fleet.nodes.Add(node); err != nil {
+			fleet.Close()
+			return nil, fmt.Errorf("unable to add node %q: %v", name, err)
+		}
+	}
+
+	return fleet, nil
+}
+
+// countConnections counts new connections to the fake Kubelets.
+func (f *Fleet) countConnections(_ net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		atomic.AddInt64(&f.connections, 1)
+	}
+}
+
+// Close shuts down all the fake Kubelets.
+func (f *Fleet) Close() {
+	for _, kl := range f.kubelets {
+		kl.server.Close()
+	}
+}
+
+// Dial connects to the fake Kubelet for the node with the given address.
+// It's suitable for use as the custom dialer for the Kubelet client.
+func (f *Fleet) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	kl, ok := f.kubelets[host]
+	if !ok {
+		return nil, fmt.Errorf("no fake Kubelet with address %q", host)
+	}
+	if kl.failure == FailureUnreachable {
+		return nil, fmt.Errorf("dial %s %s: connection refused", network, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, kl.server.Listener.Addr().String())
+}
+
+// CAData returns the PEM-encoded CA that signed the fake Kubelets' serving certificates.
+func (f *Fleet) CAData() []byte {
+	return f.caData
+}
+
+// NodeLister lists the fake nodes.
+func (f *Fleet) NodeLister() v1listers.NodeLister {
+	return v1listers.NewNodeLister(f.nodes)
+}
+
+// PodLister lists the pods currently running on the fake nodes.
+func (f *Fleet) PodLister() v1listers.PodLister {
+	return v1listers.NewPodLister(f.pods)
+}
+
+// Stats returns counts of the requests served by the fleet so far.
+func (f *Fleet) Stats() Stats {
+	return Stats{
+		Requests:    atomic.LoadInt64(&f.requests),
+		Errors:      atomic.LoadInt64(&f.errors),
+		Connections: atomic.LoadInt64(&f.connections),
+
+		SummaryBytes:             atomic.LoadInt64(&f.summaryBytes),
+		UncompressedSummaryBytes: atomic.LoadInt64(&f.uncompressedBytes),
+	}
+}
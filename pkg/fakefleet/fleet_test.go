@@ -0,0 +1,436 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakefleet_test
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/fakefleet"
+	"github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+func TestFakeFleet(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fake Fleet Suite")
+}
+
+// zoneBytes fetches the values of the given metric of bytes transferred from the default
+// registry, by "zone/stage".
+func zoneBytes(name string) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	res := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			value := metric.GetCounter().GetValue()
+			if metric.GetGauge() != nil {
+				value = metric.GetGauge().GetValue()
+			}
+			res[labels["zone"]+"/"+labels["stage"]] = value
+		}
+	}
+	return res
+}
+
+// nodeAddress fetches the internal IP of the given node.
+func nodeAddress(node *corev1.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+// committingSink passes batches on to the wrapped sink, signaling once each is committed.
+type committingSink struct {
+	sink.MetricSink
+	committed chan struct{}
+}
+
+func (s *committingSink) Receive(batch *sources.MetricsBatch) error {
+	err := s.MetricSink.Receive(batch)
+	s.committed <- struct{}{}
+	return err
+}
+
+// signalingSink discards batches, signaling the time of the fake clock as each is received.
+type signalingSink struct {
+	clock    clock.Clock
+	received chan time.Time
+}
+
+var _ sink.MetricSink = &signalingSink{}
+
+func (s *signalingSink) Receive(batch *sources.MetricsBatch) error {
+	s.received <- s.clock.Now()
+	return nil
+}
+
+var _ = Describe("Fake Fleet", func() {
+	var (
+		config Config
+		fleet  *Fleet
+		client summary.KubeletInterface
+	)
+
+	BeforeEach(func() {
+		config = Config{
+			Nodes:            3,
+			PodsPerNode:      10,
+			ContainersPerPod: 2,
+			Namespaces:       2,
+			Seed:             1,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		fleet, err = New(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		client, err = summary.KubeletClientFor(&summary.KubeletClientConfig{
+			Port: 10250,
+			RESTConfig: &rest.Config{
+				Host: "https://localhost:6443",
+				TLSClientConfig: rest.TLSClientConfig{
+					CAData:     fleet.CAData(),
+					ServerName: ServerName,
+				},
+			},
+			Dial: fleet.Dial,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fleet.Close()
+	})
+
+	It("should serve a summary for each node with the configured pods, over verified TLS", func() {
+		By("listing the fake nodes")
+		nodes, err := fleet.NodeLister().List(labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodes).To(HaveLen(3))
+
+		By("fetching the summary of each node by its address")
+		for _, node := range nodes {
+			sum, _, err := client.GetSummary(context.Background(), nodeAddress(node))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(sum.Node.NodeName).To(Equal(node.Name))
+			Expect(sum.Node.CPU.UsageNanoCores).NotTo(BeNil())
+			Expect(sum.Pods).To(HaveLen(10))
+			for _, pod := range sum.Pods {
+				Expect(pod.Containers).To(HaveLen(2))
+			}
+		}
+
+		By("verifying that the pod lister contains all the pods")
+		pods, err := fleet.PodLister().List(labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pods).To(HaveLen(30))
+	})
+
+	Context("with churn", func() {
+		BeforeEach(func() {
+			config.ChurnRate = 0.5
+		})
+
+		It("should replace pods between scrapes, keeping the pod lister in sync", func() {
+			nodes, err := fleet.NodeLister().List(labels.Everything())
+			Expect(err).NotTo(HaveOccurred())
+			addr := nodeAddress(nodes[0])
+
+			By("fetching the summary twice")
+			first, _, err := client.GetSummary(context.Background(), addr)
+			Expect(err).NotTo(HaveOccurred())
+			second, _, err := client.GetSummary(context.Background(), addr)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that some pods were replaced, but the count stayed the same")
+			Expect(second.Pods).To(HaveLen(10))
+			firstPods := make(map[string]struct{}, len(first.Pods))
+			for _, pod := range first.Pods {
+				firstPods[pod.PodRef.Name] = struct{}{}
+			}
+			replaced := 0
+			for _, pod := range second.Pods {
+				if _, ok := firstPods[pod.PodRef.Name]; !ok {
+					replaced++
+				}
+			}
+			Expect(replaced).To(BeNumerically(">", 0))
+
+			By("verifying that the pod lister has the latest pods")
+			for _, pod := range second.Pods {
+				_, err := fleet.PodLister().Pods(pod.PodRef.Namespace).Get(pod.PodRef.Name)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	})
+
+	Context("with latency and error injection", func() {
+		BeforeEach(func() {
+			config.Latency = Latency{Base: 50 * time.Millisecond}
+			config.ErrorRate = 1
+		})
+
+		It("should delay and fail requests", func() {
+			nodes, err := fleet.NodeLister().List(labels.Everything())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("fetching a summary")
+			start := time.Now()
+			_, _, err = client.GetSummary(context.Background(), nodeAddress(nodes[0]))
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+
+			By("verifying that the error was counted")
+			Expect(fleet.Stats()).To(Equal(Stats{Requests: 1, Errors: 1, Connections: 1}))
+		})
+	})
+
+	Context("when collected by the manager at a 1s resolution", func() {
+		It("should run one cycle per second without drifting, reusing connections to the Kubelets", func() {
+			clk := clock.NewFakeClock(time.Now())
+			start := clk.Now()
+			provider := summary.NewSummaryProvider(fleet.NodeLister(), client, summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority), summary.SourceOptions{})
+			received := &signalingSink{clock: clk, received: make(chan time.Time)}
+			mgr := manager.NewManagerWithClock(sources.NewSourceManager(provider, 900*time.Millisecond), received, time.Second, clk)
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			mgr.RunUntil(stopCh)
+
+			By("stepping the clock unevenly, as a busy process would see it")
+			var cycles []time.Duration
+			for _, step := range []time.Duration{1300 * time.Millisecond, 700 * time.Millisecond, time.Second, 1100 * time.Millisecond, 900 * time.Millisecond} {
+				Eventually(clk.HasWaiters).Should(BeTrue())
+				clk.Step(step)
+				var at time.Time
+				Eventually(received.received, 5*time.Second).Should(Receive(&at))
+				cycles = append(cycles, at.Sub(start))
+			}
+
+			By("verifying that each cycle was scheduled on its own second")
+			Expect(cycles).To(Equal([]time.Duration{1300 * time.Millisecond, 2 * time.Second, 3 * time.Second, 4100 * time.Millisecond, 5 * time.Second}))
+			Expect(mgr.CheckHealth(nil)).To(Succeed())
+
+			By("verifying that every scrape reused the first connection to each Kubelet")
+			stats := fleet.Stats()
+			Expect(stats.Requests).To(BeEquivalentTo(15))
+			Expect(stats.Connections).To(BeEquivalentTo(3))
+		})
+	})
+
+	Context("with broken nodes", func() {
+		BeforeEach(func() {
+			config.Failures = map[string]Failure{
+				"fake-node-0": FailureUnreachable,
+				"fake-node-1": FailureForbidden,
+			}
+		})
+
+		It("should fail requests to the broken nodes' Kubelets in the configured ways", func() {
+			_, _, err := client.GetSummary(context.Background(), "10.0.0.0")
+			Expect(summary.IsDialError(err)).To(BeTrue(), "unexpected error %v", err)
+			_, _, err = client.GetSummary(context.Background(), "10.0.0.1")
+			Expect(summary.IsForbiddenError(err)).To(BeTrue(), "unexpected error %v", err)
+			_, _, err = client.GetSummary(context.Background(), "10.0.0.2")
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Context("with nodes across zones, compressing summaries", func() {
+		BeforeEach(func() {
+			config.Nodes = 4
+			config.Zones = 2
+			config.Gzip = true
+		})
+
+		It("should count the bytes read from each zone, before and after decompression, in total and per cycle", func() {
+			provider := summary.NewSummaryProvider(fleet.NodeLister(), client, summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority), summary.SourceOptions{})
+			src := sources.NewSourceManager(provider, 5*time.Second)
+			before := zoneBytes("metrics_server_kubelet_response_bytes_total")
+
+			By("collecting two cycles")
+			_, err := src.Collect(sources.WithCycleID(context.Background(), "transfer-1"))
+			Expect(err).NotTo(HaveOccurred())
+			firstCycle := fleet.Stats()
+			_, err = src.Collect(sources.WithCycleID(context.Background(), "transfer-2"))
+			Expect(err).NotTo(HaveOccurred())
+			served := fleet.Stats()
+			Expect(served.SummaryBytes).To(BeNumerically("<", served.UncompressedSummaryBytes))
+
+			By("verifying that the bytes counted add up to the bytes the fleet served")
+			after := zoneBytes("metrics_server_kubelet_response_bytes_total")
+			for _, zone := range []string{"zone-0", "zone-1"} {
+				Expect(after[zone+"/"+summary.TransferStageWire]).To(BeNumerically(">", before[zone+"/"+summary.TransferStageWire]), zone)
+			}
+			total := func(values map[string]float64, stage string) float64 {
+				return values["zone-0/"+stage] + values["zone-1/"+stage]
+			}
+			Expect(total(after, summary.TransferStageWire) - total(before, summary.TransferStageWire)).To(BeEquivalentTo(served.SummaryBytes))
+			Expect(total(after, summary.TransferStageDecompressed) - total(before, summary.TransferStageDecompressed)).To(BeEquivalentTo(served.UncompressedSummaryBytes))
+
+			By("verifying that the first cycle's bytes were published once the second started")
+			cycle := zoneBytes("metrics_server_kubelet_cycle_response_bytes")
+			Expect(total(cycle, summary.TransferStageWire)).To(BeEquivalentTo(firstCycle.SummaryBytes))
+			Expect(total(cycle, summary.TransferStageDecompressed)).To(BeEquivalentTo(firstCycle.UncompressedSummaryBytes))
+		})
+	})
+
+	It("should refuse to connect to unknown addresses", func() {
+		_, err := fleet.Dial(context.Background(), "tcp", "192.168.0.1:10250")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// benchmarkServeDuringCommits collects a fleet of 5000 pods once per iteration, committing each
+// batch to the real sink provider, while readers repeatedly fetch the metrics of 100 pods at a
+// time, as a namespace's worth of API requests would, and reports the latencies they saw.
+func benchmarkServeDuringCommits(b *testing.B, gcAfterCommit bool) {
+	const readers = 4
+	fleet, err := New(Config{Nodes: 20, PodsPerNode: 250, ContainersPerPod: 2, Namespaces: 50, Seed: 1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fleet.Close()
+	client, err := summary.KubeletClientFor(&summary.KubeletClientConfig{
+		Port: 10250,
+		RESTConfig: &rest.Config{
+			Host: "https://localhost:6443",
+			TLSClientConfig: rest.TLSClientConfig{
+				CAData:     fleet.CAData(),
+				ServerName: ServerName,
+			},
+		},
+		Dial: fleet.Dial,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	pods, err := fleet.PodLister().List(labels.Everything())
+	if err != nil {
+		b.Fatal(err)
+	}
+	names := make([]apitypes.NamespacedName, len(pods))
+	for i, pod := range pods {
+		names[i] = apitypes.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	}
+
+	clk := clock.NewFakeClock(time.Now())
+	provider := summary.NewSummaryProvider(fleet.NodeLister(), client, summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority), summary.SourceOptions{})
+	metricSink, prov := provsink.NewSinkProvider()
+	committing := &committingSink{MetricSink: metricSink, committed: make(chan struct{})}
+	mgr := manager.NewManagerWithClock(sources.NewSourceManager(provider, 900*time.Millisecond), committing, time.Second, clk)
+	if gcAfterCommit {
+		mgr.EnableGCAfterCommit()
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	mgr.RunUntil(stopCh)
+
+	// a cycle to fill the provider before serving from it
+	step := func() {
+		for !clk.HasWaiters() {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Step(time.Second)
+		<-committing.committed
+	}
+	step()
+	if _, containers, err := prov.GetContainerMetrics(names[0]); err != nil || len(containers[0]) != 2 {
+		b.Fatalf("expected the metrics of both containers of %v after the first commit, got %v (err: %v)", names[0], containers, err)
+	}
+
+	done := make(chan struct{})
+	latencies := make([][]time.Duration, readers)
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				offset := rng.Intn(len(names) - 100)
+				start := time.Now()
+				if _, _, err := prov.GetContainerMetrics(names[offset : offset+100]...); err != nil {
+					b.Error(err)
+					return
+				}
+				latencies[r] = append(latencies[r], time.Since(start))
+			}
+		}(r)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		step()
+	}
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	if len(all) == 0 {
+		b.Fatal("no requests were served")
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	b.ReportMetric(float64(all[len(all)/2].Microseconds()), "p50-us")
+	b.ReportMetric(float64(all[len(all)*99/100].Microseconds()), "p99-us")
+	b.ReportMetric(float64(all[len(all)-1].Microseconds()), "max-us")
+}
+
+func BenchmarkServeDuringCommits5kPods(b *testing.B) {
+	benchmarkServeDuringCommits(b, false)
+}
+
+func BenchmarkServeDuringCommits5kPodsGCAfterCommit(b *testing.B) {
+	benchmarkServeDuringCommits(b, true)
+}
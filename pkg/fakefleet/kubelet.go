@@ -0,0 +1,235 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakefleet
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+const summaryPath = "/stats/summary/"
+
+// kubelet is a single fake Kubelet, serving generated summaries for the pods on its node.
+type kubelet struct {
+	fleet  *Fleet
+	node   string
+	server *httptest.Server
+	// failure is how this Kubelet is broken, if it is.
+	failure Failure
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	pods    []*corev1.Pod
+	nextPod int
+}
+
+func newKubelet(fleet *Fleet, node string, seed int64) *kubelet {
+	kl := &kubelet{
+		fleet: fleet,
+		node:  node,
+		rand:  rand.New(rand.NewSource(seed)),
+		pods:  make([]*corev1.Pod, fleet.config.PodsPerNode),
+	}
+	for i := range kl.pods {
+		kl.pods[i] = kl.newPod()
+	}
+	return kl
+}
+
+// newPod creates a new pod on this node, adding it to the fleet's pods.
+// The caller must hold mu.
+func (kl *kubelet) newPod() *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              fmt.Sprintf("%s-pod-%d", kl.node, kl.nextPod),
+			Namespace:         fmt.Sprintf("ns-%d", kl.rand.Intn(kl.fleet.config.Namespaces)),
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   kl.node,
+			Containers: make([]corev1.Container, kl.fleet.config.ContainersPerPod),
+		},
+	}
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Name = fmt.Sprintf("container-%d", i)
+	}
+	kl.nextPod++
+	if err := kl.fleet.pods.Add(pod); err != nil {
+		glog.Errorf("unable to add fake pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	return pod
+}
+
+// churn replaces a ChurnRate fraction of this node's pods with new ones.
+// The caller must hold mu.
+func (kl *kubelet) churn() {
+	expected := kl.fleet.config.ChurnRate * float64(len(kl.pods))
+	num := int(expected)
+	// deal with the fractional part probabilistically, so that low churn rates still churn
+	if kl.rand.Float64() < expected-float64(num) {
+		num++
+	}
+	for i := 0; i < num && i < len(kl.pods); i++ {
+		ind := kl.rand.Intn(len(kl.pods))
+		if err := kl.fleet.pods.Delete(kl.pods[ind]); err != nil {
+			glog.Errorf("unable to remove fake pod %s/%s: %v", kl.pods[ind].Namespace, kl.pods[ind].Name, err)
+		}
+		kl.pods[ind] = kl.newPod()
+	}
+}
+
+// latency picks the latency for the next response.  The caller must hold mu.
+func (kl *kubelet) latency() time.Duration {
+	latency := kl.fleet.config.Latency
+	return latency.Base + time.Duration(kl.rand.ExpFloat64()*float64(latency.Jitter))
+}
+
+// summary generates a summary for the pods currently on this node.  The caller must hold mu.
+func (kl *kubelet) summary() *stats.Summary {
+	now := metav1.Now()
+	summary := &stats.Summary{
+		Node: stats.NodeStats{
+			NodeName: kl.node,
+			CPU:      kl.cpuStats(now, 4e9),
+			Memory:   kl.memStats(now, 16<<30),
+		},
+		Pods: make([]stats.PodStats, len(kl.pods)),
+	}
+	for i, pod := range kl.pods {
+		podStats := stats.PodStats{
+			PodRef: stats.PodReference{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+				UID:       string(pod.UID),
+			},
+			StartTime:  pod.CreationTimestamp,
+			Containers: make([]stats.ContainerStats, len(pod.Spec.Containers)),
+		}
+		for j, container := range pod.Spec.Containers {
+			podStats.Containers[j] = stats.ContainerStats{
+				Name:      container.Name,
+				StartTime: pod.CreationTimestamp,
+				CPU:       kl.cpuStats(now, 1e9),
+				Memory:    kl.memStats(now, 1<<30),
+			}
+		}
+		summary.Pods[i] = podStats
+	}
+	return summary
+}
+
+func (kl *kubelet) cpuStats(now metav1.Time, maxNanoCores uint64) *stats.CPUStats {
+	usage := uint64(kl.rand.Int63n(int64(maxNanoCores)))
+	return &stats.CPUStats{
+		Time:           now,
+		UsageNanoCores: &usage,
+	}
+}
+
+func (kl *kubelet) memStats(now metav1.Time, maxBytes uint64) *stats.MemoryStats {
+	workingSet := uint64(kl.rand.Int63n(int64(maxBytes)))
+	return &stats.MemoryStats{
+		Time:            now,
+		WorkingSetBytes: &workingSet,
+	}
+}
+
+func (kl *kubelet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != summaryPath {
+		http.NotFound(w, req)
+		return
+	}
+	atomic.AddInt64(&kl.fleet.requests, 1)
+
+	switch kl.failure {
+	case FailureUnauthorized:
+		atomic.AddInt64(&kl.fleet.errors, 1)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	case FailureForbidden:
+		atomic.AddInt64(&kl.fleet.errors, 1)
+		http.Error(w, "Forbidden (user=system:serviceaccount:kube-system:metrics-server, verb=get, resource=nodes, subresource=stats)", http.StatusForbidden)
+		return
+	case FailureHang:
+		<-req.Context().Done()
+		return
+	}
+
+	kl.mu.Lock()
+	latency := kl.latency()
+	fail := kl.rand.Float64() < kl.fleet.config.ErrorRate
+	var summary *stats.Summary
+	if !fail {
+		kl.churn()
+		summary = kl.summary()
+	}
+	kl.mu.Unlock()
+
+	select {
+	case <-time.After(latency):
+	case <-req.Context().Done():
+		return
+	}
+
+	if fail {
+		atomic.AddInt64(&kl.fleet.errors, 1)
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	wire := &countingWriter{w: w, n: &kl.fleet.summaryBytes}
+	var out io.Writer = wire
+	var gz *gzip.Writer
+	if kl.fleet.config.Gzip && strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(wire)
+		out = gz
+	}
+	if err := json.NewEncoder(&countingWriter{w: out, n: &kl.fleet.uncompressedBytes}).Encode(summary); err != nil {
+		glog.Errorf("unable to write summary for fake node %q: %v", kl.node, err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			glog.Errorf("unable to write summary for fake node %q: %v", kl.node, err)
+		}
+	}
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gctuning configures the Go garbage collector from flags: its target percentage
+// (as GOGC would), and a soft memory limit sized from the container's cgroup memory limit,
+// so that on very large clusters the heap can grow to use the memory the container was
+// given, collecting less often, without being OOM-killed.
+package gctuning
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultCgroupRoot is where the cgroup filesystem is mounted in a container.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+// unlimitedV1 is the least cgroup v1 memory limit treated as no limit, since an unlimited
+// cgroup reports the largest page-aligned int64 rather than anything recognizable.
+const unlimitedV1 = 1 << 62
+
+var softMemoryLimit = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "runtime",
+		Name:      "soft_memory_limit_bytes",
+		Help:      "The soft memory limit of the Go runtime, if set by --soft-memory-limit-ratio",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(softMemoryLimit)
+}
+
+// Options configures the garbage collector.
+type Options struct {
+	// GCPercent, if non-zero, sets the garbage collection target percentage, as GOGC does,
+	// where a negative percentage only collects when the soft memory limit is reached.
+	GCPercent int
+	// SoftMemoryLimitRatio, if non-zero, sets the soft memory limit of the Go runtime
+	// to this fraction of the cgroup memory limit.
+	SoftMemoryLimitRatio float64
+	// CgroupRoot is where the cgroup filesystem is mounted, or DefaultCgroupRoot if empty.
+	CgroupRoot string
+}
+
+// Apply configures the garbage collector with the given options.  It fails if a soft memory
+// limit is asked for, but the cgroup memory limit can't be read, or there isn't one.
+func Apply(opts Options) error {
+	if opts.SoftMemoryLimitRatio != 0 {
+		root := opts.CgroupRoot
+		if root == "" {
+			root = DefaultCgroupRoot
+		}
+		cgroupLimit, limited, err := CgroupMemoryLimit(root)
+		if err != nil {
+			return fmt.Errorf("unable to read the cgroup memory limit to size the soft memory limit from: %v", err)
+		}
+		if !limited {
+			return fmt.Errorf("unable to size the soft memory limit from the cgroup memory limit, since the container's memory isn't limited")
+		}
+		limit := int64(float64(cgroupLimit) * opts.SoftMemoryLimitRatio)
+		debug.SetMemoryLimit(limit)
+		softMemoryLimit.Set(float64(limit))
+		glog.Infof("set the soft memory limit to %d bytes, %v of the cgroup memory limit of %d bytes", limit, opts.SoftMemoryLimitRatio, cgroupLimit)
+	}
+	if opts.GCPercent != 0 {
+		debug.SetGCPercent(opts.GCPercent)
+		glog.Infof("set the garbage collection target percentage to %d", opts.GCPercent)
+	}
+	return nil
+}
+
+// CgroupMemoryLimit reads the memory limit of the process's cgroup from the cgroup filesystem
+// mounted at the given root, for either cgroup v2 (memory.max) or v1 (memory/memory.limit_in_bytes),
+// as seen from within a container, returning false if the memory isn't limited.
+func CgroupMemoryLimit(root string) (int64, bool, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(root, "memory.max"))
+	if os.IsNotExist(err) {
+		raw, err = ioutil.ReadFile(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	value := strings.TrimSpace(string(raw))
+	if value == "max" {
+		return 0, false, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to parse the cgroup memory limit %q: %v", value, err)
+	}
+	if limit >= unlimitedV1 {
+		return 0, false, nil
+	}
+	return limit, true, nil
+}
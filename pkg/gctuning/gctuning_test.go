@@ -0,0 +1,95 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gctuning_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/gctuning"
+)
+
+func TestGCTuning(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GC Tuning Suite")
+}
+
+var _ = Describe("GC Tuning", func() {
+	var root string
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "cgroup")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(root)).To(Succeed())
+		debug.SetMemoryLimit(math.MaxInt64)
+		debug.SetGCPercent(100)
+	})
+
+	writeFile := func(path, contents string) {
+		Expect(os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, path), []byte(contents), 0644)).To(Succeed())
+	}
+
+	It("should read the cgroup v2 memory limit, if there is one", func() {
+		writeFile("memory.max", "2147483648\n")
+		limit, limited, err := CgroupMemoryLimit(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limited).To(BeTrue())
+		Expect(limit).To(BeEquivalentTo(2 << 30))
+
+		writeFile("memory.max", "max\n")
+		_, limited, err = CgroupMemoryLimit(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limited).To(BeFalse())
+	})
+
+	It("should fall back to the cgroup v1 memory limit, treating the huge default as unlimited", func() {
+		writeFile("memory/memory.limit_in_bytes", "1073741824\n")
+		limit, limited, err := CgroupMemoryLimit(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limited).To(BeTrue())
+		Expect(limit).To(BeEquivalentTo(1 << 30))
+
+		writeFile("memory/memory.limit_in_bytes", "9223372036854771712\n")
+		_, limited, err = CgroupMemoryLimit(root)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(limited).To(BeFalse())
+	})
+
+	It("should set the soft memory limit to a fraction of the cgroup memory limit, and the GC percentage", func() {
+		writeFile("memory.max", "1073741824\n")
+		Expect(Apply(Options{GCPercent: 200, SoftMemoryLimitRatio: 0.75, CgroupRoot: root})).To(Succeed())
+		Expect(debug.SetMemoryLimit(-1)).To(BeEquivalentTo(3 << 28))
+		Expect(debug.SetGCPercent(100)).To(Equal(200))
+	})
+
+	It("should refuse to size a soft memory limit without a cgroup memory limit", func() {
+		Expect(Apply(Options{SoftMemoryLimitRatio: 0.9, CgroupRoot: root})).To(HaveOccurred())
+		writeFile("memory.max", "max\n")
+		Expect(Apply(Options{SoftMemoryLimitRatio: 0.9, CgroupRoot: root})).To(MatchError(ContainSubstring("memory isn't limited")))
+		Expect(debug.SetMemoryLimit(-1)).To(BeEquivalentTo(math.MaxInt64))
+	})
+})
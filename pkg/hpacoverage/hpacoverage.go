@@ -0,0 +1,337 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hpacoverage tracks whether the pods targeted by HorizontalPodAutoscalers have fresh
+// metrics, since a gap in those stalls autoscaling, while a gap for a batch pod goes unnoticed.
+// HPAs are only watched, and their targets' scale subresources only read, when enabled.
+package hpacoverage
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	autoscalinginformers "k8s.io/client-go/informers/autoscaling/v1"
+	autoscalinglisters "k8s.io/client-go/listers/autoscaling/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// DefaultSelectorRefreshInterval is the default interval at which the pod selectors of
+// every HPA's target are re-resolved, besides whenever an HPA is added or retargeted.
+const DefaultSelectorRefreshInterval = 5 * time.Minute
+
+var (
+	hpaPods = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "hpa_pods",
+			Help:      "The number of running pods targeted by HorizontalPodAutoscalers, as of the last committed batch",
+		},
+	)
+	hpaPodsMissing = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "hpa_pods_missing_metrics",
+			Help:      "The number of running pods targeted by HorizontalPodAutoscalers without fresh metrics in the last committed batch",
+		},
+	)
+	hpaUnresolved = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "hpa_unresolved_targets",
+			Help:      "The number of HorizontalPodAutoscalers whose target's pod selector couldn't be resolved, so whose pods weren't counted, as of the last committed batch",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(hpaPods)
+	prometheus.MustRegister(hpaPodsMissing)
+	prometheus.MustRegister(hpaUnresolved)
+}
+
+// SelectorResolver resolves the pod selector of the given target of an HPA in the given namespace.
+type SelectorResolver func(namespace string, ref autoscalingv1.CrossVersionObjectReference) (labels.Selector, error)
+
+// Config configures a Tracker.
+type Config struct {
+	// HPAs is the informer watching HorizontalPodAutoscalers.
+	HPAs autoscalinginformers.HorizontalPodAutoscalerInformer
+	// Pods lists the pods each HPA's target selects.
+	Pods v1listers.PodLister
+	// Nodes looks up the nodes pods run on, for the NodeFilter.
+	Nodes v1listers.NodeLister
+	// NodeFilter, if non-nil, selects the nodes scraped, with pods on other nodes not counted.
+	NodeFilter sources.NodeFilter
+	// Namespaces, if non-nil, restricts the namespaces whose HPAs are tracked to those whose
+	// pods' metrics are stored.
+	Namespaces *provider.NamespaceAllowlist
+	// Resolve resolves the pod selector of an HPA's target (see NewScaleSelectorResolver).
+	Resolve SelectorResolver
+	// MaxAge is how old a pod's metrics may be when committed to still count as fresh.
+	MaxAge time.Duration
+	// RefreshInterval is how often every HPA's target's selector is re-resolved.
+	RefreshInterval time.Duration
+}
+
+// HPAStatus is the coverage of the pods targeted by one HPA, as of the last committed batch.
+type HPAStatus struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Target is the kind and name of the HPA's target.
+	Target string `json:"target"`
+	// Selector is the pod selector of the target, if resolved.
+	Selector string `json:"selector,omitempty"`
+	// Pods is the number of running pods targeted.
+	Pods int `json:"pods"`
+	// MissingPods names the running pods targeted without fresh metrics.
+	MissingPods []string `json:"missingPods,omitempty"`
+	// Error is why the target's selector couldn't be resolved, if it couldn't.
+	Error string `json:"error,omitempty"`
+}
+
+// target is the resolved pod selector of an HPA's target.
+type target struct {
+	ref      autoscalingv1.CrossVersionObjectReference
+	selector labels.Selector
+	err      error
+}
+
+// Tracker publishes how many pods targeted by HPAs lack fresh metrics in each committed batch,
+// serving the breakdown by HPA.  Resolving targets' selectors needs API requests, so is done
+// as HPAs change, and periodically, rather than while batches are committed.
+type Tracker struct {
+	config Config
+	hpas   autoscalinglisters.HorizontalPodAutoscalerLister
+
+	mu sync.Mutex
+	// targets are the resolved selectors of the targets of the HPAs, by HPA.
+	targets map[apitypes.NamespacedName]target
+	// statuses are the coverage of each HPA as of the last committed batch.
+	statuses []HPAStatus
+}
+
+var _ sink.PodTimestampObserver = &Tracker{}
+
+// NewTracker returns a tracker watching HPAs with the given config's informer, which
+// must be started (along with those behind its listers) separately.
+func NewTracker(config Config) *Tracker {
+	t := &Tracker{
+		config:  config,
+		hpas:    config.HPAs.Lister(),
+		targets: make(map[apitypes.NamespacedName]target),
+	}
+	config.HPAs.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if hpa, ok := obj.(*autoscalingv1.HorizontalPodAutoscaler); ok {
+				t.resolve(hpa, false)
+			}
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if hpa, ok := obj.(*autoscalingv1.HorizontalPodAutoscaler); ok {
+				t.resolve(hpa, false)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if hpa, ok := obj.(*autoscalingv1.HorizontalPodAutoscaler); ok {
+				t.mu.Lock()
+				defer t.mu.Unlock()
+				delete(t.targets, apitypes.NamespacedName{Namespace: hpa.Namespace, Name: hpa.Name})
+			}
+		},
+	})
+	return t
+}
+
+// RunUntil periodically re-resolves the selectors of every HPA's target until the given channel is closed.
+func (t *Tracker) RunUntil(stopCh <-chan struct{}) {
+	if t.config.RefreshInterval <= 0 {
+		return
+	}
+	go wait.Until(t.Refresh, t.config.RefreshInterval, stopCh)
+}
+
+// Refresh re-resolves the selectors of every HPA's target, e.g. in case a target's selector changed.
+func (t *Tracker) Refresh() {
+	hpas, err := t.hpas.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("unable to list HorizontalPodAutoscalers to resolve their targets: %v", err)
+		return
+	}
+	for _, hpa := range hpas {
+		t.resolve(hpa, true)
+	}
+}
+
+// resolve resolves the selector of the given HPA's target, unless it's already resolved for
+// the same target and not forced to.  HPAs in namespaces not tracked are skipped.
+func (t *Tracker) resolve(hpa *autoscalingv1.HorizontalPodAutoscaler, force bool) {
+	if !t.config.Namespaces.Allows(hpa.Namespace) {
+		return
+	}
+	key := apitypes.NamespacedName{Namespace: hpa.Namespace, Name: hpa.Name}
+	ref := hpa.Spec.ScaleTargetRef
+	t.mu.Lock()
+	current, known := t.targets[key]
+	t.mu.Unlock()
+	if known && current.ref == ref && current.err == nil && !force {
+		return
+	}
+
+	selector, err := t.config.Resolve(hpa.Namespace, ref)
+	if err != nil {
+		glog.V(2).Infof("unable to resolve the pod selector of %s/%s targeted by HorizontalPodAutoscaler %s: %v", ref.Kind, ref.Name, key, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.targets[key] = target{ref: ref, selector: selector, err: err}
+}
+
+// PodTimestampsCommitted publishes the coverage of the pods targeted by HPAs in the batch just committed.
+func (t *Tracker) PodTimestampsCommitted(timestamps map[apitypes.NamespacedName]time.Time) {
+	hpas, err := t.hpas.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("unable to list HorizontalPodAutoscalers to check their pods have metrics: %v", err)
+		return
+	}
+	sort.Slice(hpas, func(i, j int) bool {
+		if hpas[i].Namespace != hpas[j].Namespace {
+			return hpas[i].Namespace < hpas[j].Namespace
+		}
+		return hpas[i].Name < hpas[j].Name
+	})
+
+	t.mu.Lock()
+	targets := make(map[apitypes.NamespacedName]target, len(t.targets))
+	for key, resolved := range t.targets {
+		targets[key] = resolved
+	}
+	t.mu.Unlock()
+
+	now := time.Now()
+	// pods targeted by several HPAs are only counted once
+	targeted := make(map[apitypes.NamespacedName]bool)
+	unresolved := 0
+	statuses := make([]HPAStatus, 0, len(hpas))
+	for _, hpa := range hpas {
+		if !t.config.Namespaces.Allows(hpa.Namespace) {
+			continue
+		}
+		ref := hpa.Spec.ScaleTargetRef
+		status := HPAStatus{Namespace: hpa.Namespace, Name: hpa.Name, Target: ref.Kind + "/" + ref.Name}
+		resolved, ok := targets[apitypes.NamespacedName{Namespace: hpa.Namespace, Name: hpa.Name}]
+		switch {
+		case !ok || resolved.ref != ref:
+			status.Error = "not yet resolved"
+		case resolved.err != nil:
+			status.Error = resolved.err.Error()
+		}
+		if status.Error != "" {
+			unresolved++
+			statuses = append(statuses, status)
+			continue
+		}
+
+		status.Selector = resolved.selector.String()
+		pods, err := t.config.Pods.Pods(hpa.Namespace).List(resolved.selector)
+		if err != nil {
+			glog.Errorf("unable to list the pods targeted by HorizontalPodAutoscaler %s/%s: %v", hpa.Namespace, hpa.Name, err)
+			continue
+		}
+		for _, pod := range pods {
+			if !t.scraped(pod) {
+				continue
+			}
+			podIdent := apitypes.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+			status.Pods++
+			ts, ok := timestamps[podIdent]
+			fresh := ok && now.Sub(ts) <= t.config.MaxAge
+			if !fresh {
+				status.MissingPods = append(status.MissingPods, pod.Name)
+			}
+			targeted[podIdent] = targeted[podIdent] || !fresh
+		}
+		sort.Strings(status.MissingPods)
+		statuses = append(statuses, status)
+	}
+
+	missing := 0
+	for _, isMissing := range targeted {
+		if isMissing {
+			missing++
+		}
+	}
+	hpaPods.Set(float64(len(targeted)))
+	hpaPodsMissing.Set(float64(missing))
+	hpaUnresolved.Set(float64(unresolved))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.statuses = statuses
+}
+
+// scraped checks if the given pod is running on a node which is scraped, so should have metrics.
+func (t *Tracker) scraped(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.Spec.NodeName == "" {
+		return false
+	}
+	if t.config.NodeFilter == nil {
+		return true
+	}
+	node, err := t.config.Nodes.Get(pod.Spec.NodeName)
+	if err != nil {
+		// the node is either gone or not yet known to the informer, so isn't scraped either
+		return false
+	}
+	return t.config.NodeFilter(node)
+}
+
+// Statuses returns the coverage of each HPA as of the last committed batch, ordered by namespace and name.
+func (t *Tracker) Statuses() []HPAStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]HPAStatus, len(t.statuses))
+	copy(res, t.statuses)
+	return res
+}
+
+// ServeHTTP serves the coverage of each HPA as of the last committed batch as JSON.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.Statuses()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
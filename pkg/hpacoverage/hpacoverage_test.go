@@ -0,0 +1,269 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hpacoverage_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	autoscalinglisters "k8s.io/client-go/listers/autoscaling/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/hpacoverage"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestHPACoverage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HPA Coverage Suite")
+}
+
+// gaugeValue fetches the value of the given gauge from the default registry.
+func gaugeValue(name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+// fakeHPAInformer is a HorizontalPodAutoscaler informer fed by a fake watch.
+type fakeHPAInformer struct {
+	informer cache.SharedIndexInformer
+	watcher  *watch.FakeWatcher
+}
+
+func newFakeHPAInformer() *fakeHPAInformer {
+	watcher := watch.NewFakeWithChanSize(10, false)
+	lw := &cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &autoscalingv1.HorizontalPodAutoscalerList{}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return watcher, nil
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &autoscalingv1.HorizontalPodAutoscaler{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return &fakeHPAInformer{informer: informer, watcher: watcher}
+}
+
+func (i *fakeHPAInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i *fakeHPAInformer) Lister() autoscalinglisters.HorizontalPodAutoscalerLister {
+	return autoscalinglisters.NewHorizontalPodAutoscalerLister(i.informer.GetIndexer())
+}
+
+// hpaTargeting returns an HPA in ns1 targeting the given deployment.
+func hpaTargeting(name, deployment string) *autoscalingv1.HorizontalPodAutoscaler {
+	return &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns1"},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: deployment},
+		},
+	}
+}
+
+// addPods adds the given number of running pods in ns1 labelled as belonging to the given app, named app-0...app-N.
+func addPods(indexer cache.Indexer, app string, count int) {
+	for i := 0; i < count; i++ {
+		Expect(indexer.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", app, i), Namespace: "ns1", Labels: map[string]string{"app": app}},
+			Spec:       corev1.PodSpec{NodeName: "node1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		})).To(Succeed())
+	}
+}
+
+// batchWith returns a batch with metrics for the given pods in ns1, measured at the given time.
+func batchWith(ts time.Time, names ...string) *sources.MetricsBatch {
+	batch := &sources.MetricsBatch{}
+	for _, name := range names {
+		batch.Pods = append(batch.Pods, sources.PodMetricsPoint{
+			Name:       name,
+			Namespace:  "ns1",
+			Containers: []sources.ContainerMetricsPoint{{Name: "app", MetricsPoint: sources.MetricsPoint{Timestamp: ts}}},
+		})
+	}
+	return batch
+}
+
+var _ = Describe("HPA coverage tracker", func() {
+	var (
+		hpas       *fakeHPAInformer
+		pods       cache.Indexer
+		metricSink sink.MetricSink
+		tracker    *Tracker
+		stopCh     chan struct{}
+
+		mu        sync.Mutex
+		resolved  map[string]int
+		selectors map[string]string
+	)
+
+	BeforeEach(func() {
+		hpas = newFakeHPAInformer()
+		pods = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		addPods(pods, "web", 3)
+		addPods(pods, "api", 2)
+		resolved = make(map[string]int)
+		selectors = map[string]string{"web": "app=web", "api": "app=api", "web-canary": "app=web"}
+
+		tracker = NewTracker(Config{
+			HPAs: hpas,
+			Pods: v1listers.NewPodLister(pods),
+			Resolve: func(namespace string, ref autoscalingv1.CrossVersionObjectReference) (labels.Selector, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				resolved[ref.Name]++
+				selector, ok := selectors[ref.Name]
+				if !ok {
+					return nil, fmt.Errorf("deployments.apps %q not found", ref.Name)
+				}
+				return labels.Parse(selector)
+			},
+			MaxAge: 2 * time.Minute,
+		})
+		metricSink, _ = provsink.NewSinkProvider()
+		metricSink.(sink.PodObservingSink).ObservePods(tracker)
+
+		stopCh = make(chan struct{})
+		go hpas.informer.Run(stopCh)
+		Eventually(hpas.informer.HasSynced).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+	})
+
+	// watchHPAs adds the given HPAs through the watch, waiting until each is resolved.
+	watchHPAs := func(added ...*autoscalingv1.HorizontalPodAutoscaler) {
+		for _, hpa := range added {
+			hpas.watcher.Add(hpa)
+			target := hpa.Spec.ScaleTargetRef.Name
+			Eventually(func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return resolved[target]
+			}).Should(BeNumerically(">", 0))
+		}
+	}
+
+	It("should track the pods targeted by HPAs lacking fresh metrics", func() {
+		watchHPAs(hpaTargeting("web", "web"), hpaTargeting("api", "api"))
+		now := time.Now()
+
+		By("covering every targeted pod")
+		Expect(metricSink.Receive(batchWith(now, "web-0", "web-1", "web-2", "api-0", "api-1", "batch-0"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods")).To(Equal(5.0))
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(BeZero())
+
+		By("missing some targeted pods, and having stale metrics for another")
+		Expect(metricSink.Receive(batchWith(now, "web-0", "batch-0"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(Equal(4.0))
+		Expect(metricSink.Receive(batchWith(now.Add(-5*time.Minute), "web-0", "web-1", "web-2", "api-0", "api-1"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(Equal(5.0))
+
+		By("clearing once the gap closes")
+		Expect(metricSink.Receive(batchWith(now, "web-0", "web-1", "web-2", "api-0", "api-1"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(BeZero())
+	})
+
+	It("should only count pods targeted by several HPAs once, while breaking them down by HPA", func() {
+		watchHPAs(hpaTargeting("web", "web"), hpaTargeting("web-canary", "web-canary"))
+		Expect(metricSink.Receive(batchWith(time.Now(), "web-0"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods")).To(Equal(3.0))
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(Equal(2.0))
+
+		statuses := tracker.Statuses()
+		Expect(statuses).To(HaveLen(2))
+		for _, status := range statuses {
+			Expect(status.Target).To(HavePrefix("Deployment/web"))
+			Expect(status.Selector).To(Equal("app=web"))
+			Expect(status.Pods).To(Equal(3))
+			Expect(status.MissingPods).To(Equal([]string{"web-1", "web-2"}))
+		}
+	})
+
+	It("should report HPAs whose targets can't be resolved, without counting their pods", func() {
+		watchHPAs(hpaTargeting("web", "web"), hpaTargeting("gone", "gone"))
+		Expect(metricSink.Receive(batchWith(time.Now()))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(Equal(3.0))
+		Expect(gaugeValue("metrics_server_storage_hpa_unresolved_targets")).To(Equal(1.0))
+
+		By("serving the breakdown as JSON")
+		recorder := httptest.NewRecorder()
+		tracker.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/hpa-status", nil))
+		var statuses []HPAStatus
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &statuses)).To(Succeed())
+		Expect(statuses).To(HaveLen(2))
+		Expect(statuses[0].Name).To(Equal("gone"))
+		Expect(statuses[0].Error).To(ContainSubstring("not found"))
+		Expect(statuses[1].Name).To(Equal("web"))
+		Expect(statuses[1].MissingPods).To(HaveLen(3))
+	})
+
+	It("should only re-resolve targets when retargeted, or refreshed", func() {
+		watchHPAs(hpaTargeting("web", "web"))
+
+		By("ignoring updates which leave the target alone")
+		updated := hpaTargeting("web", "web")
+		updated.Status.CurrentReplicas = 3
+		hpas.watcher.Modify(updated)
+		retargeted := hpaTargeting("web", "api")
+		hpas.watcher.Modify(retargeted)
+		Eventually(func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return resolved["api"]
+		}).Should(Equal(1))
+		Expect(resolved["web"]).To(Equal(1))
+
+		Expect(metricSink.Receive(batchWith(time.Now(), "api-0", "api-1"))).To(Succeed())
+		Expect(gaugeValue("metrics_server_storage_hpa_pods")).To(Equal(2.0))
+		Expect(gaugeValue("metrics_server_storage_hpa_pods_missing_metrics")).To(BeZero())
+
+		By("re-resolving every target when refreshed")
+		tracker.Refresh()
+		Expect(resolved["api"]).To(Equal(2))
+
+		By("forgetting deleted HPAs")
+		hpas.watcher.Delete(retargeted)
+		Eventually(func() []HPAStatus {
+			Expect(metricSink.Receive(batchWith(time.Now()))).To(Succeed())
+			return tracker.Statuses()
+		}).Should(BeEmpty())
+	})
+})
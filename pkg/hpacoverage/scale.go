@@ -0,0 +1,121 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hpacoverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+// scale is a scale subresource in any of the versions served: autoscaling/v1 has a string
+// selector, while the older extensions and apps versions have a map of labels, with any
+// set-based selector in targetSelector.
+type scale struct {
+	Status struct {
+		Selector       json.RawMessage `json:"selector,omitempty"`
+		TargetSelector string          `json:"targetSelector,omitempty"`
+	} `json:"status"`
+}
+
+// selector parses the scale's pod selector.
+func (s *scale) selector() (labels.Selector, error) {
+	if s.Status.TargetSelector != "" {
+		return labels.Parse(s.Status.TargetSelector)
+	}
+	var str string
+	if err := json.Unmarshal(s.Status.Selector, &str); err == nil {
+		if str == "" {
+			return nil, fmt.Errorf("the scale subresource has no selector")
+		}
+		return labels.Parse(str)
+	}
+	var set map[string]string
+	if err := json.Unmarshal(s.Status.Selector, &set); err != nil || len(set) == 0 {
+		return nil, fmt.Errorf("the scale subresource has no selector")
+	}
+	return labels.SelectorFromSet(set), nil
+}
+
+// NewScaleSelectorResolver returns a SelectorResolver reading the selector from the scale
+// subresource of each target, like the HPA controller, with the given client, after looking
+// up the resource of its kind with the given discovery client.  The resources of kinds are
+// cached once found.
+func NewScaleSelectorResolver(client rest.Interface, discoveryClient discovery.DiscoveryInterface) SelectorResolver {
+	var mu sync.Mutex
+	resources := make(map[autoscalingv1.CrossVersionObjectReference]string)
+	return func(namespace string, ref autoscalingv1.CrossVersionObjectReference) (labels.Selector, error) {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil {
+			return nil, err
+		}
+		kind := autoscalingv1.CrossVersionObjectReference{APIVersion: ref.APIVersion, Kind: ref.Kind}
+		mu.Lock()
+		resource, ok := resources[kind]
+		mu.Unlock()
+		if !ok {
+			if resource, err = scalableResource(discoveryClient, ref); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			resources[kind] = resource
+			mu.Unlock()
+		}
+
+		prefix := "/apis/" + gv.String()
+		if gv.Group == "" {
+			prefix = "/api/" + gv.Version
+		}
+		raw, err := client.Get().AbsPath(prefix, "namespaces", namespace, resource, ref.Name, "scale").Do().Raw()
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the scale of %s %s: %v", resource, ref.Name, err)
+		}
+		res := &scale{}
+		if err := json.Unmarshal(raw, res); err != nil {
+			return nil, fmt.Errorf("unable to decode the scale of %s %s: %v", resource, ref.Name, err)
+		}
+		return res.selector()
+	}
+}
+
+// scalableResource looks up the resource of the given target's kind, checking it has a scale subresource.
+func scalableResource(discoveryClient discovery.DiscoveryInterface, ref autoscalingv1.CrossVersionObjectReference) (string, error) {
+	list, err := discoveryClient.ServerResourcesForGroupVersion(ref.APIVersion)
+	if err != nil {
+		return "", fmt.Errorf("unable to discover the resources of %s: %v", ref.APIVersion, err)
+	}
+	resource := ""
+	for _, apiResource := range list.APIResources {
+		if apiResource.Kind == ref.Kind && !strings.Contains(apiResource.Name, "/") {
+			resource = apiResource.Name
+		}
+	}
+	if resource == "" {
+		return "", fmt.Errorf("no resource of kind %s in %s", ref.Kind, ref.APIVersion)
+	}
+	for _, apiResource := range list.APIResources {
+		if apiResource.Name == resource+"/scale" {
+			return resource, nil
+		}
+	}
+	return "", fmt.Errorf("%s in %s have no scale subresource", resource, ref.APIVersion)
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hpacoverage_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/hpacoverage"
+)
+
+// fakeScaleAPIServer serves discovery for apps/v1 and extensions/v1beta1, and the scale of the deployment "web" in both.
+type fakeScaleAPIServer struct {
+	discoveries int
+}
+
+func (s *fakeScaleAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/apis/apps/v1":
+		s.discoveries++
+		w.Write([]byte(`{"kind": "APIResourceList", "apiVersion": "v1", "groupVersion": "apps/v1", "resources": [
+			{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get"]},
+			{"name": "deployments/scale", "namespaced": true, "group": "autoscaling", "version": "v1", "kind": "Scale", "verbs": ["get"]},
+			{"name": "controllerrevisions", "namespaced": true, "kind": "ControllerRevision", "verbs": ["get"]}
+		]}`))
+	case "/apis/extensions/v1beta1":
+		w.Write([]byte(`{"kind": "APIResourceList", "apiVersion": "v1", "groupVersion": "extensions/v1beta1", "resources": [
+			{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get"]},
+			{"name": "deployments/scale", "namespaced": true, "kind": "Scale", "verbs": ["get"]}
+		]}`))
+	case "/apis/apps/v1/namespaces/ns1/deployments/web/scale":
+		w.Write([]byte(`{"kind": "Scale", "apiVersion": "autoscaling/v1", "status": {"replicas": 3, "selector": "app=web,tier in (frontend)"}}`))
+	case "/apis/extensions/v1beta1/namespaces/ns1/deployments/web/scale":
+		w.Write([]byte(`{"kind": "Scale", "apiVersion": "extensions/v1beta1", "status": {"replicas": 3, "selector": {"app": "web"}}}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+	}
+}
+
+var _ = Describe("Scale selector resolver", func() {
+	var (
+		apiServer *fakeScaleAPIServer
+		server    *httptest.Server
+		resolve   SelectorResolver
+	)
+
+	BeforeEach(func() {
+		apiServer = &fakeScaleAPIServer{}
+		server = httptest.NewServer(apiServer)
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		resolve = NewScaleSelectorResolver(client.CoreV1().RESTClient(), client.Discovery())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should resolve the selector from the scale subresource, caching the resource of the kind", func() {
+		for i := 0; i < 2; i++ {
+			selector, err := resolve("ns1", autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(selector.String()).To(Equal("app=web,tier in (frontend)"))
+		}
+		Expect(apiServer.discoveries).To(Equal(1))
+	})
+
+	It("should resolve the map selectors of older scale versions", func() {
+		selector, err := resolve("ns1", autoscalingv1.CrossVersionObjectReference{APIVersion: "extensions/v1beta1", Kind: "Deployment", Name: "web"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selector.String()).To(Equal("app=web"))
+	})
+
+	It("should fail for kinds without a scale subresource, and missing targets", func() {
+		_, err := resolve("ns1", autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "ControllerRevision", Name: "web"})
+		Expect(err).To(MatchError(ContainSubstring("no scale subresource")))
+		_, err = resolve("ns1", autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web"})
+		Expect(err).To(MatchError(ContainSubstring("no resource of kind StatefulSet")))
+		_, err = resolve("ns1", autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "gone"})
+		Expect(err).To(MatchError(ContainSubstring("unable to get the scale of deployments gone")))
+	})
+})
@@ -0,0 +1,172 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package informersync waits for informers to sync at startup, diagnosing why they haven't
+// (such as missing RBAC permissions) so that metrics-server can report it, rather than
+// leaving users to work it out from a generic sync timeout.
+package informersync
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultTimeout is the default time to wait for an informer to sync at startup.
+const DefaultTimeout = time.Minute
+
+// degradedRetryAfter is how long clients are asked to wait before retrying while degraded.
+const degradedRetryAfter = 10
+
+// Cause is the diagnosed cause of an informer failing to sync.
+type Cause string
+
+const (
+	// CauseForbidden means that listing the resource is forbidden, normally because
+	// metrics-server's service account is missing an RBAC permission.
+	CauseForbidden Cause = "forbidden"
+	// CauseTimeout means that the resource can't be listed in time, or at all, for a
+	// reason other than authorization, such as the API server being unreachable.
+	CauseTimeout Cause = "timeout"
+)
+
+var informerSyncFailed = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "informer",
+		Name:      "sync_failed",
+		Help:      "1 while an informer which failed to sync at startup still hasn't synced, by resource and diagnosed cause",
+	},
+	[]string{"resource", "cause"},
+)
+
+func init() {
+	prometheus.MustRegister(informerSyncFailed)
+}
+
+// Status tracks whether an informer has synced, and if it failed to sync at startup, why.
+// The informer keeps retrying after a failure, so the failure is cleared once it syncs
+// (e.g. once a missing permission is granted).
+type Status struct {
+	resource  string
+	hasSynced cache.InformerSynced
+	// probe lists the resource directly, to find out why the informer can't.
+	probe func() error
+
+	mu      sync.Mutex
+	cause   Cause
+	failure error
+}
+
+// NewStatus tracks the sync status of the informer of the given resource (e.g. "nodes"),
+// using the given function, which lists the resource directly (e.g. with a limit of 1),
+// to diagnose sync failures.
+func NewStatus(resource string, hasSynced cache.InformerSynced, probe func() error) *Status {
+	return &Status{resource: resource, hasSynced: hasSynced, probe: probe}
+}
+
+// Wait waits up to the given timeout for the informer to sync.  If it doesn't, Wait diagnoses
+// why, logs a targeted error, records the failure to be reported by Check and Available
+// until the informer does sync, and returns it.
+func (s *Status) Wait(timeout time.Duration, stopCh <-chan struct{}) error {
+	// stop waiting at the timeout, or when told to stop
+	waitCh := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(waitCh)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stopCh:
+		case <-done:
+		}
+	}()
+	if cache.WaitForCacheSync(waitCh, s.hasSynced) {
+		return nil
+	}
+
+	cause, failure := s.diagnose(timeout)
+	glog.Errorf("%v", failure)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cause, s.failure = cause, failure
+	informerSyncFailed.WithLabelValues(s.resource, string(cause)).Set(1)
+	return failure
+}
+
+// diagnose works out why the informer didn't sync within the given timeout, returning the
+// cause, along with an error explaining it.
+func (s *Status) diagnose(timeout time.Duration) (Cause, error) {
+	err := s.probe()
+	switch {
+	case errors.IsForbidden(err):
+		return CauseForbidden, fmt.Errorf("the %s informer can't sync because listing %s is forbidden: grant metrics-server's service account the \"list\" and \"watch\" verbs on %q in the core API group (e.g. in the system:metrics-server ClusterRole): %v", s.resource, s.resource, s.resource, err)
+	case err != nil:
+		return CauseTimeout, fmt.Errorf("timed out after %s waiting for the %s informer to sync, and listing %s failed: %v", timeout, s.resource, s.resource, err)
+	default:
+		// listing works, so the watch (or a slow list of a large cluster) is the problem
+		return CauseTimeout, fmt.Errorf("timed out after %s waiting for the %s informer to sync, although %s can be listed, so watching them may be failing", timeout, s.resource, s.resource)
+	}
+}
+
+// Failure returns the diagnosed cause and error of the informer failing to sync at
+// startup, if it did, and hasn't synced since.
+func (s *Status) Failure() (Cause, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failure == nil {
+		return "", nil
+	}
+	if s.hasSynced() {
+		glog.Infof("the %s informer has now synced, recovering from: %v", s.resource, s.failure)
+		informerSyncFailed.WithLabelValues(s.resource, string(s.cause)).Set(0)
+		s.cause, s.failure = "", nil
+		return "", nil
+	}
+	return s.cause, s.failure
+}
+
+// Check reports the informer's sync failure, if any.
+// It implements the health checker func part of the healthz checker.
+func (s *Status) Check(_ *http.Request) error {
+	_, err := s.Failure()
+	return err
+}
+
+// Available returns a 503 error with the reason, suitable for serving from the metrics API,
+// while the informer's sync failure lasts, and nil otherwise.
+func (s *Status) Available() error {
+	_, err := s.Failure()
+	if err == nil {
+		return nil
+	}
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusServiceUnavailable,
+		Reason:  metav1.StatusReasonServiceUnavailable,
+		Message: fmt.Sprintf("metrics-server is degraded: %v", err),
+		Details: &metav1.StatusDetails{
+			RetryAfterSeconds: degradedRetryAfter,
+		},
+	}}
+}
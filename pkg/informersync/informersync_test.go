@@ -0,0 +1,167 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package informersync_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/informersync"
+)
+
+func TestInformerSync(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Informer Sync Suite")
+}
+
+// fakeAPIServer serves node lists and watches, or fails them with the given status code.
+type fakeAPIServer struct {
+	mu     sync.Mutex
+	status int
+	stopCh chan struct{}
+}
+
+func (f *fakeAPIServer) setStatus(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/api/v1/nodes" {
+		http.NotFound(w, req)
+		return
+	}
+	f.mu.Lock()
+	status := f.status
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	var statusErr *apierrors.StatusError
+	switch status {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		statusErr = apierrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, "", fmt.Errorf("User \"system:serviceaccount:kube-system:metrics-server\" cannot list nodes at the cluster scope"))
+	default:
+		statusErr = apierrors.NewInternalError(fmt.Errorf("etcd is on fire"))
+	}
+	if statusErr != nil {
+		w.WriteHeader(int(statusErr.ErrStatus.Code))
+		json.NewEncoder(w).Encode(&statusErr.ErrStatus)
+		return
+	}
+
+	if req.URL.Query().Get("watch") == "true" {
+		// hold the watch open, without any events
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-req.Context().Done():
+		case <-f.stopCh:
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(&corev1.NodeList{
+		TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		Items:    []corev1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node1", ResourceVersion: "1"}}},
+	})
+}
+
+var _ = Describe("Informer Sync Status", func() {
+	var (
+		apiServer *fakeAPIServer
+		server    *httptest.Server
+		stopCh    chan struct{}
+		status    *Status
+	)
+
+	BeforeEach(func() {
+		stopCh = make(chan struct{})
+		apiServer = &fakeAPIServer{status: http.StatusForbidden, stopCh: stopCh}
+		server = httptest.NewServer(apiServer)
+
+		client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+		factory := informers.NewSharedInformerFactory(client, 0)
+		status = NewStatus("nodes", factory.Core().V1().Nodes().Informer().HasSynced, func() error {
+			_, err := client.CoreV1().Nodes().List(metav1.ListOptions{Limit: 1})
+			return err
+		})
+		factory.Start(stopCh)
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		server.Close()
+	})
+
+	It("should diagnose missing permissions to list nodes, reporting them until the informer syncs", func() {
+		err := status.Wait(200*time.Millisecond, stopCh)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("listing nodes is forbidden"))
+		Expect(err.Error()).To(ContainSubstring(`"list" and "watch" verbs on "nodes"`))
+		cause, _ := status.Failure()
+		Expect(cause).To(Equal(CauseForbidden))
+
+		By("failing the health check with the same reason")
+		Expect(status.Check(nil)).To(Equal(err))
+
+		By("serving 503s explaining the reason from the metrics API")
+		unavailable := status.Available()
+		Expect(apierrors.IsServiceUnavailable(unavailable)).To(BeTrue())
+		Expect(unavailable.Error()).To(ContainSubstring("listing nodes is forbidden"))
+		retryAfter, ok := apierrors.SuggestsClientDelay(unavailable)
+		Expect(ok).To(BeTrue())
+		Expect(retryAfter).To(BeNumerically(">", 0))
+
+		By("recovering once the permission is granted")
+		apiServer.setStatus(http.StatusOK)
+		Eventually(func() error { return status.Check(nil) }, 5*time.Second).Should(Succeed())
+		Expect(status.Available()).To(Succeed())
+	})
+
+	It("should report other failures to list nodes as timeouts", func() {
+		apiServer.setStatus(http.StatusInternalServerError)
+		err := status.Wait(200*time.Millisecond, stopCh)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("timed out after 200ms waiting for the nodes informer to sync"))
+		Expect(err.Error()).To(ContainSubstring("listing nodes failed"))
+		cause, _ := status.Failure()
+		Expect(cause).To(Equal(CauseTimeout))
+	})
+
+	It("should report nothing once the informer has synced", func() {
+		apiServer.setStatus(http.StatusOK)
+		Expect(status.Wait(5*time.Second, stopCh)).To(Succeed())
+		Expect(status.Check(nil)).To(Succeed())
+		Expect(status.Available()).To(Succeed())
+	})
+})
@@ -0,0 +1,91 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// callDepth is the number of frames between the caller of a Logger's method and glog:
+// the Logger method and the GlogSink method.
+const callDepth = 2
+
+// GlogSink writes lines to glog, as the message followed by each field as key="value",
+// attributed to the caller of the Logger.  It logs Info lines enabled for their component
+// by its levels, or loglevel.Default if nil.
+type GlogSink struct {
+	Levels *loglevel.Levels
+}
+
+func (s GlogSink) Enabled(component loglevel.Component, level glog.Level) bool {
+	if s.Levels == nil {
+		return bool(loglevel.V(component, level))
+	}
+	return bool(s.Levels.V(component, level))
+}
+
+func (s GlogSink) Info(_ loglevel.Component, _ glog.Level, msg string, keysAndValues []interface{}) {
+	glog.InfoDepth(callDepth, FormatLine(msg, nil, keysAndValues))
+}
+
+func (s GlogSink) Warning(_ loglevel.Component, msg string, keysAndValues []interface{}) {
+	glog.WarningDepth(callDepth, FormatLine(msg, nil, keysAndValues))
+}
+
+func (s GlogSink) Error(_ loglevel.Component, err error, msg string, keysAndValues []interface{}) {
+	glog.ErrorDepth(callDepth, FormatLine(msg, err, keysAndValues))
+}
+
+// FormatLine formats a line as the message, then the error (if any) as err="...", then
+// each key/value pair as key=value, quoting strings, errors and fmt.Stringers.  The message
+// is left unquoted, so that it matches whatever matched it before it had fields.
+func FormatLine(msg string, err error, keysAndValues []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	if err != nil {
+		buf.WriteString(" err=")
+		buf.WriteString(strconv.Quote(err.Error()))
+	}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		buf.WriteByte(' ')
+		fmt.Fprint(&buf, keysAndValues[i])
+		buf.WriteByte('=')
+		if i+1 == len(keysAndValues) {
+			buf.WriteString(`"(MISSING)"`)
+			break
+		}
+		writeValue(&buf, keysAndValues[i+1])
+	}
+	return buf.String()
+}
+
+func writeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		buf.WriteString(strconv.Quote(v))
+	case error:
+		buf.WriteString(strconv.Quote(v.Error()))
+	case fmt.Stringer:
+		buf.WriteString(strconv.Quote(v.String()))
+	default:
+		fmt.Fprintf(buf, "%+v", v)
+	}
+}
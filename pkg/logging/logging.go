@@ -0,0 +1,172 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging provides structured, contextual logging.  A Logger carries key/value fields
+// (such as the node and cycle being scraped) attached to every line it logs, and is threaded
+// through contexts, so that code deep in a scrape logs with the fields of the scrape without
+// being passed them.  Each line keeps the text it had before it had fields, in full, so that
+// alerts matching it keep matching, with the fields following it.
+//
+// Loggers mirror the shape of logr's, rather than using it: neither logr nor klog v2 is
+// vendored, and the vendored Kubernetes libraries still log with glog, so adopting them
+// belongs with bumping those libraries, which moves them to klog.  Until then, Loggers
+// write to a Sink, which is glog (honoring the component levels of package loglevel)
+// unless embedders of these packages supply their own, with SetDefaultSink or NewContext,
+// and a logr.LogSink can be adapted to a Sink without changing any of the lines logged.
+package logging
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// Sink receives the lines logged by Loggers, along with all of their fields.
+type Sink interface {
+	// Enabled reports whether lines at the given verbosity are logged for the given component.
+	Enabled(component loglevel.Component, level glog.Level) bool
+	// Info logs a line at the given verbosity.
+	Info(component loglevel.Component, level glog.Level, msg string, keysAndValues []interface{})
+	// Warning logs a warning.  Sinks without warnings (such as logr's) may log them as Info
+	// lines at verbosity zero.
+	Warning(component loglevel.Component, msg string, keysAndValues []interface{})
+	// Error logs an error, which may be nil when the line reports a failure without one.
+	Error(component loglevel.Component, err error, msg string, keysAndValues []interface{})
+}
+
+var (
+	defaultSinkMu sync.RWMutex
+	defaultSink   Sink = GlogSink{}
+)
+
+// SetDefaultSink sets the sink written to by loggers not taken from a context holding
+// one (see NewContext), which is a GlogSink unless set.
+func SetDefaultSink(sink Sink) {
+	defaultSinkMu.Lock()
+	defer defaultSinkMu.Unlock()
+	defaultSink = sink
+}
+
+func currentDefaultSink() Sink {
+	defaultSinkMu.RLock()
+	defer defaultSinkMu.RUnlock()
+	return defaultSink
+}
+
+// Logger logs lines for a component, with the fields it was given.  The zero Logger
+// writes to the default sink.  Loggers are immutable values: WithValues and V return
+// new loggers, leaving the original as it was.
+type Logger struct {
+	sink      Sink
+	component loglevel.Component
+	level     glog.Level
+	values    []interface{}
+}
+
+// Background returns a logger for the given component, writing to the default sink, for
+// code running outside of any context (e.g. background loops).
+func Background(component loglevel.Component) Logger {
+	return Logger{component: component}
+}
+
+// NewLogger returns a logger for the given component, writing to the given sink.
+func NewLogger(sink Sink, component loglevel.Component) Logger {
+	return Logger{sink: sink, component: component}
+}
+
+func (l Logger) currentSink() Sink {
+	if l.sink != nil {
+		return l.sink
+	}
+	return currentDefaultSink()
+}
+
+// WithValues returns a logger attaching the given key/value pairs to every line it logs,
+// after those of this logger.
+func (l Logger) WithValues(keysAndValues ...interface{}) Logger {
+	if len(keysAndValues) == 0 {
+		return l
+	}
+	values := make([]interface{}, 0, len(l.values)+len(keysAndValues))
+	values = append(values, l.values...)
+	l.values = append(values, keysAndValues...)
+	return l
+}
+
+// WithComponent returns a logger for the given component, with the same sink and fields.
+func (l Logger) WithComponent(component loglevel.Component) Logger {
+	l.component = component
+	return l
+}
+
+// V returns a logger logging Info lines at the given verbosity, more than this logger's.
+func (l Logger) V(level glog.Level) Logger {
+	l.level += level
+	return l
+}
+
+// Enabled reports whether Info lines from this logger are logged, so that costly fields
+// need only be computed when they are.
+func (l Logger) Enabled() bool {
+	return l.currentSink().Enabled(l.component, l.level)
+}
+
+// Info logs a line with the given key/value pairs, if enabled at this logger's verbosity.
+func (l Logger) Info(msg string, keysAndValues ...interface{}) {
+	sink := l.currentSink()
+	if !sink.Enabled(l.component, l.level) {
+		return
+	}
+	sink.Info(l.component, l.level, msg, l.merge(keysAndValues))
+}
+
+// Warning logs a warning with the given key/value pairs, regardless of verbosity.
+func (l Logger) Warning(msg string, keysAndValues ...interface{}) {
+	l.currentSink().Warning(l.component, msg, l.merge(keysAndValues))
+}
+
+// Error logs an error with the given message and key/value pairs, regardless of verbosity.
+func (l Logger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.currentSink().Error(l.component, err, msg, l.merge(keysAndValues))
+}
+
+func (l Logger) merge(keysAndValues []interface{}) []interface{} {
+	if len(l.values) == 0 {
+		return keysAndValues
+	}
+	res := make([]interface{}, 0, len(l.values)+len(keysAndValues))
+	res = append(res, l.values...)
+	return append(res, keysAndValues...)
+}
+
+type loggerKey struct{}
+
+// NewContext returns a context holding the given logger, for FromContext to retrieve.
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	logger.level = 0
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger held by the given context, for the given component,
+// or a Background logger for the component if the context holds none.
+func FromContext(ctx context.Context, component loglevel.Component) Logger {
+	logger, ok := ctx.Value(loggerKey{}).(Logger)
+	if !ok {
+		return Background(component)
+	}
+	return logger.WithComponent(component)
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+func TestLogging(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Logging Suite")
+}
+
+var _ = Describe("Logger", func() {
+	var recorder *Recorder
+
+	BeforeEach(func() {
+		recorder = &Recorder{MaxLevel: 2}
+	})
+
+	It("should attach its fields to every line, before those of the line", func() {
+		logger := NewLogger(recorder, loglevel.Scraper).WithValues("node", "node1")
+		logger.WithValues("cycle", "c1").Info("scraped", "pods", 3)
+		logger.Error(errors.New("boom"), "failed")
+
+		entries := recorder.Entries()
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Fields).To(Equal(map[string]interface{}{"node": "node1", "cycle": "c1", "pods": 3}))
+		Expect(entries[0].Component).To(Equal(loglevel.Scraper))
+		Expect(entries[1].Severity).To(Equal("error"))
+		Expect(entries[1].Err).To(MatchError("boom"))
+		Expect(entries[1].Fields).To(Equal(map[string]interface{}{"node": "node1"}))
+	})
+
+	It("should only log Info lines at enabled verbosities, but always log warnings and errors", func() {
+		logger := NewLogger(recorder, loglevel.Client)
+		Expect(logger.V(2).Enabled()).To(BeTrue())
+		Expect(logger.V(1).V(2).Enabled()).To(BeFalse())
+		logger.V(3).Info("too verbose")
+		logger.V(3).Warning("warned")
+		logger.V(3).Error(nil, "failed")
+		Expect(recorder.Find("too verbose")).To(BeEmpty())
+		Expect(recorder.Find("warned")).To(HaveLen(1))
+		Expect(recorder.Find("failed")).To(HaveLen(1))
+	})
+
+	It("should carry its sink and fields through contexts, for whichever component takes it", func() {
+		ctx := NewContext(context.Background(), NewLogger(recorder, loglevel.Scraper).V(2).WithValues("cycle", "c1"))
+		logger := FromContext(ctx, loglevel.Client)
+		logger.Info("requested")
+
+		entries := recorder.Find("requested")
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Component).To(Equal(loglevel.Client))
+		Expect(entries[0].Level).To(BeZero())
+		Expect(entries[0].Fields).To(HaveKeyWithValue("cycle", "c1"))
+	})
+
+	It("should write to the default sink from contexts without a logger", func() {
+		SetDefaultSink(recorder)
+		defer SetDefaultSink(GlogSink{})
+		FromContext(context.Background(), loglevel.Storage).Info("stored")
+		Expect(recorder.Find("stored")).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("FormatLine", func() {
+	It("should leave the message as it is, quoting strings, errors and Stringers among the fields", func() {
+		line := FormatLine("Raw response from Kubelet", errors.New("bad \"thing\""), []interface{}{"node", "node1", "duration", 1500 * time.Millisecond, "bytes", 42})
+		Expect(line).To(Equal(`Raw response from Kubelet err="bad \"thing\"" node="node1" duration="1.5s" bytes=42`))
+	})
+
+	It("should mark keys missing their values", func() {
+		Expect(FormatLine("msg", nil, []interface{}{"node"})).To(Equal(`msg node="(MISSING)"`))
+	})
+})
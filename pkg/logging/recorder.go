@@ -0,0 +1,103 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// Entry is a line recorded by a Recorder.
+type Entry struct {
+	Component loglevel.Component
+	// Severity is "info", "warning" or "error".
+	Severity string
+	Level    glog.Level
+	Message  string
+	Err      error
+	// Fields are the key/value pairs of the line, by key; later pairs win.
+	Fields map[string]interface{}
+}
+
+// Recorder is a Sink recording every line up to a verbosity, so that tests (and embedders)
+// can check the fields attached to them.
+type Recorder struct {
+	// MaxLevel is the highest verbosity recorded.
+	MaxLevel glog.Level
+
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (r *Recorder) Enabled(_ loglevel.Component, level glog.Level) bool {
+	return level <= r.MaxLevel
+}
+
+func (r *Recorder) Info(component loglevel.Component, level glog.Level, msg string, keysAndValues []interface{}) {
+	r.record(Entry{Component: component, Severity: "info", Level: level, Message: msg}, keysAndValues)
+}
+
+func (r *Recorder) Warning(component loglevel.Component, msg string, keysAndValues []interface{}) {
+	r.record(Entry{Component: component, Severity: "warning", Message: msg}, keysAndValues)
+}
+
+func (r *Recorder) Error(component loglevel.Component, err error, msg string, keysAndValues []interface{}) {
+	r.record(Entry{Component: component, Severity: "error", Message: msg, Err: err}, keysAndValues)
+}
+
+func (r *Recorder) record(entry Entry, keysAndValues []interface{}) {
+	entry.Fields = make(map[string]interface{}, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if key, ok := keysAndValues[i].(string); ok {
+			entry.Fields[key] = keysAndValues[i+1]
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// Entries returns the lines recorded so far.
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry(nil), r.entries...)
+}
+
+// Find returns the lines recorded so far with the given message.
+func (r *Recorder) Find(msg string) []Entry {
+	var res []Entry
+	for _, entry := range r.Entries() {
+		if entry.Message == msg {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// FindPrefix returns the lines recorded so far with messages starting with the given prefix.
+func (r *Recorder) FindPrefix(prefix string) []Entry {
+	var res []Entry
+	for _, entry := range r.Entries() {
+		if strings.HasPrefix(entry.Message, prefix) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
@@ -0,0 +1,297 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loglevel overrides the glog verbosity (-v) of individual components, so that
+// turning on, say, the raw Kubelet responses logged by the client at V(10) doesn't also
+// flood the logs with everything else logged at that level.  Overrides are set from flags
+// at startup, or at runtime through Levels' handler, optionally reverting after a TTL so
+// that a debug level isn't forgotten.
+package loglevel
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultRuntimeTTL is the default TTL of overrides set at runtime.
+const DefaultRuntimeTTL = time.Hour
+
+// Component is a part of metrics-server whose verbosity can be overridden.
+type Component string
+
+const (
+	// Client is the Kubelet client: its requests, and the responses to them.
+	Client Component = "client"
+	// Scraper is the scrape loop, and the translation of the stats scraped.
+	Scraper Component = "scraper"
+	// Storage is the storage of the metrics scraped.
+	Storage Component = "storage"
+	// Provider is the serving of the metrics API.
+	Provider Component = "provider"
+)
+
+// Components are the components whose verbosity can be overridden.
+var Components = []Component{Client, Scraper, Storage, Provider}
+
+func knownComponent(component Component) bool {
+	for _, known := range Components {
+		if component == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOverrides parses a comma-separated list of component=level pairs, e.g. "client=10,storage=4".
+func ParseOverrides(spec string) (map[Component]glog.Level, error) {
+	res := make(map[Component]glog.Level)
+	if spec == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q isn't of the form component=level", pair)
+		}
+		component := Component(strings.TrimSpace(parts[0]))
+		if !knownComponent(component) {
+			return nil, fmt.Errorf("unknown component %q (must be one of %s)", component, ComponentNames())
+		}
+		level, err := parseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level for component %q: %v", component, err)
+		}
+		res[component] = level
+	}
+	return res, nil
+}
+
+func parseLevel(raw string) (glog.Level, error) {
+	level, err := strconv.ParseInt(raw, 10, 32)
+	if err != nil || level < 0 {
+		return 0, fmt.Errorf("%q isn't a non-negative integer", raw)
+	}
+	return glog.Level(level), nil
+}
+
+// ComponentNames lists the names of the components, comma-separated.
+func ComponentNames() string {
+	names := make([]string, len(Components))
+	for i, component := range Components {
+		names[i] = string(component)
+	}
+	return strings.Join(names, ", ")
+}
+
+// override is a component's overridden level, and when it reverts, if ever.
+type override struct {
+	level   glog.Level
+	expires time.Time
+	timer   *time.Timer
+}
+
+// Levels holds the overridden verbosity of each component.  It also serves as an http.Handler
+// for viewing the levels (GET), overriding a component's level at runtime (PUT with `component`,
+// `level` and optionally `ttl` query parameters), and reverting it to -v (DELETE with `component`).
+// It's meant to be served behind the API server's authentication and authorization, like
+// the other debug endpoints.
+type Levels struct {
+	mu sync.RWMutex
+	// defaultTTL is the TTL of overrides set through the handler without a ttl parameter.
+	defaultTTL time.Duration
+	overrides  map[Component]*override
+}
+
+// NewLevels constructs a new Levels with no overrides, whose overrides set through its
+// handler revert after the given TTL unless given one (zero meaning never).
+func NewLevels(defaultTTL time.Duration) *Levels {
+	return &Levels{defaultTTL: defaultTTL, overrides: make(map[Component]*override)}
+}
+
+// Default holds the levels consulted by V.
+var Default = NewLevels(DefaultRuntimeTTL)
+
+// V reports whether logging at the given level is enabled for the given component
+// with the default levels, like glog.V.
+func V(component Component, level glog.Level) glog.Verbose {
+	return Default.V(component, level)
+}
+
+// V reports whether logging at the given level is enabled for the given component: against its
+// overridden level, if any, and otherwise against -v.  Note that -vmodule can't tell apart
+// the callers of components without overrides, since glog sees the call as coming from here.
+func (l *Levels) V(component Component, level glog.Level) glog.Verbose {
+	l.mu.RLock()
+	o, overridden := l.overrides[component]
+	var overriddenLevel glog.Level
+	if overridden {
+		overriddenLevel = o.level
+	}
+	l.mu.RUnlock()
+	if overridden {
+		return glog.Verbose(level <= overriddenLevel)
+	}
+	return glog.V(level)
+}
+
+// Set overrides the level of the given component, reverting it to -v after the given TTL,
+// unless it's zero.  It replaces any previous override of the component, along with its TTL.
+func (l *Levels) Set(component Component, level glog.Level, ttl time.Duration) error {
+	if !knownComponent(component) {
+		return fmt.Errorf("unknown component %q (must be one of %s)", component, ComponentNames())
+	}
+	if ttl < 0 {
+		return fmt.Errorf("TTL must not be negative, not %v", ttl)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopLocked(component)
+	o := &override{level: level}
+	if ttl > 0 {
+		o.expires = time.Now().Add(ttl)
+		o.timer = time.AfterFunc(ttl, func() { l.expire(component, o) })
+		glog.Infof("logging at level %d for the %s component for the next %v", level, component, ttl)
+	} else {
+		glog.Infof("logging at level %d for the %s component", level, component)
+	}
+	l.overrides[component] = o
+	return nil
+}
+
+// SetDefaultTTL sets the TTL of overrides set through the handler without a ttl parameter.
+func (l *Levels) SetDefaultTTL(ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.defaultTTL = ttl
+}
+
+// Reset reverts the level of the given component to -v.
+func (l *Levels) Reset(component Component) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopLocked(component) {
+		glog.Infof("logging at the default level for the %s component", component)
+	}
+}
+
+// stopLocked removes the override of the given component, if any, reporting whether it had one.
+func (l *Levels) stopLocked(component Component) bool {
+	o, ok := l.overrides[component]
+	if !ok {
+		return false
+	}
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	delete(l.overrides, component)
+	return true
+}
+
+// expire removes the given override once its TTL passes, unless it's already been replaced.
+func (l *Levels) expire(component Component, o *override) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.overrides[component] != o {
+		return
+	}
+	delete(l.overrides, component)
+	glog.Infof("the level %d override of the %s component expired, logging at the default level again", o.level, component)
+}
+
+type componentLevel struct {
+	Component Component `json:"component"`
+	// Level is the overridden level, or -v if not overridden.
+	Level      glog.Level `json:"level"`
+	Overridden bool       `json:"overridden"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+func (l *Levels) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		query := req.URL.Query()
+		level, err := parseLevel(query.Get("level"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid level: %v", err), http.StatusBadRequest)
+			return
+		}
+		l.mu.RLock()
+		ttl := l.defaultTTL
+		l.mu.RUnlock()
+		if rawTTL := query.Get("ttl"); rawTTL != "" {
+			if ttl, err = time.ParseDuration(rawTTL); err != nil {
+				http.Error(w, fmt.Sprintf("invalid ttl %q", rawTTL), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := l.Set(Component(query.Get("component")), level, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		component := Component(req.URL.Query().Get("component"))
+		if !knownComponent(component) {
+			http.Error(w, fmt.Sprintf("unknown component %q (must be one of %s)", component, ComponentNames()), http.StatusBadRequest)
+			return
+		}
+		l.Reset(component)
+	default:
+		http.Error(w, "only GET, PUT and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.levels()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// levels returns the level of every component.
+func (l *Levels) levels() []componentLevel {
+	defaultLevel := currentVerbosity()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	res := make([]componentLevel, 0, len(Components))
+	for _, component := range Components {
+		level := componentLevel{Component: component, Level: defaultLevel}
+		if o, ok := l.overrides[component]; ok {
+			level.Level, level.Overridden = o.level, true
+			if o.timer != nil {
+				expires := o.expires
+				level.Expires = &expires
+			}
+		}
+		res = append(res, level)
+	}
+	return res
+}
+
+// currentVerbosity returns -v, which glog only exposes through its flag.
+func currentVerbosity() glog.Level {
+	var level glog.Level
+	if f := flag.Lookup("v"); f != nil {
+		level, _ = parseLevel(f.Value.String())
+	}
+	return level
+}
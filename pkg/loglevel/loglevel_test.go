@@ -0,0 +1,149 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loglevel_test
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/glog"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+func TestLogLevel(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Log Level Suite")
+}
+
+type componentLevel struct {
+	Component  string     `json:"component"`
+	Level      int        `json:"level"`
+	Overridden bool       `json:"overridden"`
+	Expires    *time.Time `json:"expires"`
+}
+
+var _ = Describe("Component Log Levels", func() {
+	var levels *Levels
+
+	BeforeEach(func() {
+		Expect(flag.Set("v", "2")).To(Succeed())
+		levels = NewLevels(time.Hour)
+	})
+
+	AfterEach(func() {
+		Expect(flag.Set("v", "0")).To(Succeed())
+	})
+
+	It("should follow -v for components without overrides", func() {
+		Expect(bool(levels.V(Client, 2))).To(BeTrue())
+		Expect(bool(levels.V(Client, 3))).To(BeFalse())
+	})
+
+	It("should raise or lower the level of just the component overridden at runtime", func() {
+		Expect(levels.Set(Client, 10, 0)).To(Succeed())
+		Expect(bool(levels.V(Client, 10))).To(BeTrue())
+		Expect(bool(levels.V(Client, 11))).To(BeFalse())
+		Expect(bool(levels.V(Scraper, 10))).To(BeFalse())
+
+		Expect(levels.Set(Storage, 0, 0)).To(Succeed())
+		Expect(bool(levels.V(Storage, 1))).To(BeFalse())
+		Expect(bool(levels.V(Provider, 1))).To(BeTrue())
+
+		levels.Reset(Client)
+		Expect(bool(levels.V(Client, 10))).To(BeFalse())
+		Expect(bool(levels.V(Client, 2))).To(BeTrue())
+	})
+
+	It("should revert overrides once their TTL passes, unless replaced", func() {
+		Expect(levels.Set(Client, 10, 50*time.Millisecond)).To(Succeed())
+		Expect(levels.Set(Scraper, 10, 50*time.Millisecond)).To(Succeed())
+		Expect(levels.Set(Scraper, 8, 0)).To(Succeed())
+		Expect(bool(levels.V(Client, 10))).To(BeTrue())
+
+		Eventually(func() bool { return bool(levels.V(Client, 10)) }).Should(BeFalse())
+		Consistently(func() bool { return bool(levels.V(Scraper, 8)) }, 100*time.Millisecond).Should(BeTrue())
+	})
+
+	It("should refuse unknown components and negative TTLs", func() {
+		Expect(levels.Set("kubelet", 4, 0)).To(MatchError(`unknown component "kubelet" (must be one of client, scraper, storage, provider)`))
+		Expect(levels.Set(Client, 4, -time.Second)).To(HaveOccurred())
+	})
+
+	Context("serving HTTP", func() {
+		serve := func(method, target string) (*httptest.ResponseRecorder, []componentLevel) {
+			recorder := httptest.NewRecorder()
+			levels.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+			var res []componentLevel
+			if recorder.Code == http.StatusOK {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &res)).To(Succeed())
+			}
+			return recorder, res
+		}
+
+		It("should override a component's level, for the default TTL unless given one", func() {
+			recorder, res := serve(http.MethodPut, "/debug/loglevel?component=client&level=8")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(res).To(HaveLen(4))
+			Expect(res[0].Component).To(Equal("client"))
+			Expect(res[0].Level).To(Equal(8))
+			Expect(res[0].Overridden).To(BeTrue())
+			Expect(res[0].Expires).NotTo(BeNil())
+			Expect(*res[0].Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+			Expect(res[1]).To(Equal(componentLevel{Component: "scraper", Level: 2}))
+			Expect(bool(levels.V(Client, 8))).To(BeTrue())
+
+			_, res = serve(http.MethodPut, "/debug/loglevel?component=client&level=6&ttl=0s")
+			Expect(res[0].Level).To(Equal(6))
+			Expect(res[0].Expires).To(BeNil())
+
+			_, res = serve(http.MethodDelete, "/debug/loglevel?component=client")
+			Expect(res[0]).To(Equal(componentLevel{Component: "client", Level: 2}))
+			Expect(bool(levels.V(Client, 8))).To(BeFalse())
+		})
+
+		It("should reject invalid components, levels and TTLs", func() {
+			for _, target := range []string{
+				"/debug/loglevel?component=kubelet&level=8",
+				"/debug/loglevel?component=client&level=-1",
+				"/debug/loglevel?component=client",
+				"/debug/loglevel?component=client&level=8&ttl=soon",
+			} {
+				recorder, _ := serve(http.MethodPut, target)
+				Expect(recorder.Code).To(Equal(http.StatusBadRequest), target)
+			}
+			recorder, _ := serve(http.MethodPost, "/debug/loglevel?component=client&level=8")
+			Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+			Expect(bool(levels.V(Client, 8))).To(BeFalse())
+		})
+	})
+
+	It("should parse overrides given as flags", func() {
+		overrides, err := ParseOverrides("client=10, storage=4")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(overrides).To(Equal(map[Component]glog.Level{Client: 10, Storage: 4}))
+
+		for _, spec := range []string{"client", "kubelet=4", "client=high", "client=-1"} {
+			_, err := ParseOverrides(spec)
+			Expect(err).To(HaveOccurred(), spec)
+		}
+	})
+})
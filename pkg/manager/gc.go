@@ -0,0 +1,123 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The phases GC pauses are attributed to.
+const (
+	// GCPhaseCycle is while a collection cycle is scraping, storing and committing metrics.
+	GCPhaseCycle = "cycle"
+	// GCPhaseServe is between collection cycles, when the process is only serving.
+	GCPhaseServe = "serve"
+)
+
+var (
+	gcPauseSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "manager",
+			Name:      "gc_pause_seconds_total",
+			Help:      "The total time the process was stopped for garbage collection, by whether a collection cycle was running (cycle) or not (serve).",
+		},
+		[]string{"phase"},
+	)
+	gcAfterCommitDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "metrics_server",
+			Subsystem: "manager",
+			Name:      "gc_after_commit_duration_seconds",
+			Help:      "The time taken by the garbage collections forced after each committed batch.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gcPauseSeconds)
+	prometheus.MustRegister(gcAfterCommitDuration)
+}
+
+// gcScheduler attributes the time the process was stopped for garbage collection to
+// collection cycles or to serving in between them, and, if enabled, forces a collection
+// once each batch is committed.  The scrape and the batch built from it are most of what's
+// allocated, and are garbage once the previous batch is replaced, so collecting then is
+// meant to leave less garbage for collections to find while serving.
+//
+// Reading the memory stats stops the world too, so they're read just once per cycle, once
+// it's ended, attributing each pause since the last read by when it ended.  The runtime
+// only remembers the last 256 pauses, so any before those are attributed to serving.
+type gcScheduler struct {
+	afterCommit bool
+
+	mu         sync.Mutex
+	started    bool
+	cycleStart time.Time
+	lastNumGC  uint32
+	lastPause  uint64
+}
+
+// cycleStarted records that a collection cycle started, ending the serve phase.
+func (g *gcScheduler) cycleStarted() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cycleStart = time.Now()
+}
+
+// cycleEnded attributes the GC pauses since the last cycle ended to serving, or to
+// the cycle that just ended, by whether they ended before or after it started.
+func (g *gcScheduler) cycleEnded() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	g.mu.Lock()
+	first := !g.started
+	cycleStart, lastNumGC, lastPause := g.cycleStart, g.lastNumGC, g.lastPause
+	g.started, g.lastNumGC, g.lastPause = true, stats.NumGC, stats.PauseTotalNs
+	g.mu.Unlock()
+	if first {
+		// whatever paused before the first cycle ended happened during startup
+		return
+	}
+
+	var cycle uint64
+	for n := stats.NumGC; n > lastNumGC && stats.NumGC-n < uint32(len(stats.PauseEnd)); n-- {
+		// the pause of the nth collection is at (n+255)%256
+		i := (n + uint32(len(stats.PauseEnd)) - 1) % uint32(len(stats.PauseEnd))
+		if time.Unix(0, int64(stats.PauseEnd[i])).Before(cycleStart) {
+			break
+		}
+		cycle += stats.PauseNs[i]
+	}
+	serve := stats.PauseTotalNs - lastPause - cycle
+	gcPauseSeconds.WithLabelValues(GCPhaseCycle).Add(float64(cycle) / float64(time.Second))
+	gcPauseSeconds.WithLabelValues(GCPhaseServe).Add(float64(serve) / float64(time.Second))
+}
+
+// committed forces a collection, if enabled, once a batch has been committed.
+func (g *gcScheduler) committed() {
+	if !g.afterCommit {
+		return
+	}
+	start := time.Now()
+	runtime.GC()
+	gcAfterCommitDuration.Observe(time.Since(start).Seconds())
+}
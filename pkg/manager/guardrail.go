@@ -0,0 +1,106 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"time"
+)
+
+// stretchHeadroom is how much longer than the slowest recent cycle a stretched resolution is.
+const stretchHeadroom = 1.1
+
+// maxStretchStep is the granularity of stretched resolutions, for resolutions of
+// at least ten times it.  Shorter resolutions are stretched in tenths of themselves,
+// so that a 1s resolution isn't doubled by stretching it by a whole step.
+const maxStretchStep = time.Second
+
+// resolutionGuardrail decides the effective resolution from the durations of recent cycles.
+// It is only used from the manager's collection goroutine.
+type resolutionGuardrail struct {
+	configured time.Duration
+	max        time.Duration
+	cycles     int
+	step       time.Duration
+
+	effective time.Duration
+	// recent holds the durations of the last few cycles, oldest first.
+	recent []time.Duration
+}
+
+func newResolutionGuardrail(configured, max time.Duration, cycles int) *resolutionGuardrail {
+	if cycles < 1 {
+		cycles = 1
+	}
+	step := configured / 10
+	if step > maxStretchStep || step <= 0 {
+		step = maxStretchStep
+	}
+	return &resolutionGuardrail{
+		configured: configured,
+		max:        max,
+		cycles:     cycles,
+		step:       step,
+		effective:  configured,
+	}
+}
+
+// observe records the duration of a cycle, returning the new effective resolution.
+//
+// The resolution is stretched (to just over the slowest of them, but no more than the maximum)
+// once the last few cycles have all overrun it, and reverted once they all fit within the
+// configured resolution again.
+func (g *resolutionGuardrail) observe(cycleDuration time.Duration) time.Duration {
+	g.recent = append(g.recent, cycleDuration)
+	if len(g.recent) > g.cycles {
+		g.recent = g.recent[1:]
+	}
+	if len(g.recent) < g.cycles {
+		return g.effective
+	}
+
+	allOverran, allRecovered := true, true
+	slowest := time.Duration(0)
+	for _, duration := range g.recent {
+		if duration <= g.effective {
+			allOverran = false
+		}
+		if duration > g.configured {
+			allRecovered = false
+		}
+		if duration > slowest {
+			slowest = duration
+		}
+	}
+
+	switch {
+	case allOverran && g.effective < g.max:
+		stretched := time.Duration(float64(slowest) * stretchHeadroom).Round(g.step)
+		if stretched <= g.effective {
+			stretched = g.effective + g.step
+		}
+		if stretched > g.max {
+			stretched = g.max
+		}
+		g.effective = stretched
+	case allRecovered && g.effective != g.configured:
+		g.effective = g.configured
+	default:
+		return g.effective
+	}
+
+	// wait for a full set of cycles at the new resolution before changing it again
+	g.recent = g.recent[:0]
+	return g.effective
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The liveness check catches a wedged collection loop (e.g. one deadlocked mid-cycle), which
+// otherwise leaves metrics-server serving ever staler metrics while its HTTP server is fine.
+// It fails once no cycle has started for a number of effective resolutions, or no cycle has
+// committed its batch to storage for a (usually larger) number of them, both measured from
+// when the manager started running until the first cycle.  Unlike CheckHealth, it ignores
+// scrape failures, so it only trips when restarting could help: a cycle which scrapes no
+// nodes, say in an empty cluster, still commits its (empty) batch, so it counts as a success.
+
+// DefaultLivenessCycleMultiplier is the default number of effective resolutions
+// without a collection cycle starting after which the liveness check fails.
+const DefaultLivenessCycleMultiplier = 3
+
+// DefaultLivenessCommitMultiplier is the default number of effective resolutions
+// without a batch being committed to storage after which the liveness check fails.
+const DefaultLivenessCommitMultiplier = 5
+
+// EnableLivenessCheck makes CheckLiveness fail once no collection cycle has started for
+// cycleMultiplier effective resolutions, or no batch has been committed for commitMultiplier
+// of them.  Either multiplier may be zero to skip that check.  It must be called before RunUntil.
+func (rm *Manager) EnableLivenessCheck(cycleMultiplier, commitMultiplier float64) {
+	rm.livenessCycleMultiplier = cycleMultiplier
+	rm.livenessCommitMultiplier = commitMultiplier
+}
+
+// CheckLiveness checks that the collection loop is still making progress, as described above.
+// It always succeeds if the liveness check isn't enabled, or the manager isn't running yet.
+// It implements the health checker func part of the healthz checker.
+func (rm *Manager) CheckLiveness(_ *http.Request) error {
+	rm.healthMu.RLock()
+	started := rm.started
+	lastTick := rm.lastTickStart
+	lastCommit := rm.lastCommit
+	resolution := rm.effectiveResolution
+	rm.healthMu.RUnlock()
+
+	if started.IsZero() {
+		return nil
+	}
+	if lastTick.IsZero() {
+		lastTick = started
+	}
+	if lastCommit.IsZero() {
+		lastCommit = started
+	}
+
+	if maxWait := time.Duration(rm.livenessCycleMultiplier * float64(resolution)); maxWait > 0 {
+		if wait := rm.clock.Since(lastTick); wait > maxWait {
+			return fmt.Errorf("no collection cycle has started for %s, over %v times the metric resolution of %s; the collection loop may be stuck", wait, rm.livenessCycleMultiplier, resolution)
+		}
+	}
+	if maxWait := time.Duration(rm.livenessCommitMultiplier * float64(resolution)); maxWait > 0 {
+		if wait := rm.clock.Since(lastCommit); wait > maxWait {
+			return fmt.Errorf("no metrics have been stored for %s, over %v times the metric resolution of %s; the collection loop may be stuck", wait, rm.livenessCommitMultiplier, resolution)
+		}
+	}
+	return nil
+}
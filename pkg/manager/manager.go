@@ -21,12 +21,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	utilmetrics "github.com/kubernetes-incubator/metrics-server/pkg/metrics"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
 
 	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
 )
 
 var (
@@ -36,8 +40,36 @@ var (
 	tickDuration prometheus.Histogram = prometheus.NewHistogram(prometheus.HistogramOpts{})
 )
 
+// minTickSlack is the least time past the resolution a tick may be late before the manager is unhealthy.
+const minTickSlack = time.Second
+
+var (
+	cyclesOverran = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "manager",
+			Name:      "cycles_overran_resolution_total",
+			Help:      "The number of collection cycles which took longer than the effective metric resolution.",
+		},
+	)
+	effectiveResolution = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "manager",
+			Name:      "effective_resolution_seconds",
+			Help:      "The current interval between collection cycles, which may be stretched beyond the configured metric resolution.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cyclesOverran)
+	prometheus.MustRegister(effectiveResolution)
+}
+
 // RegisterTickDuration creates and registers a histogram metric for
-// scrape duration, suitable for use in the overall manager.
+// scrape duration, suitable for use in the overall manager.  The given
+// resolution should be the longest the manager may stretch its resolution to.
 func RegisterDurationMetrics(resolution time.Duration) {
 	tickDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
@@ -58,84 +90,325 @@ type Runnable interface {
 	RunUntil(stopCh <-chan struct{})
 }
 
+// TunablesSource supplies reloaded scrape and storage parameters.
+type TunablesSource interface {
+	// Next returns the new parameters, if they've changed since it was last called.
+	Next() (tuning.Config, bool)
+}
+
 type Manager struct {
 	source     sources.MetricSource
 	sink       sink.MetricSink
 	resolution time.Duration
+	// scrapeTimeout is the source's scrape timeout at the configured resolution, which
+	// is stretched in proportion along with the resolution.
+	scrapeTimeout time.Duration
+	clock         clock.Clock
+	guardrail     *resolutionGuardrail
+	resume        *resumeDetector
+	gc            *gcScheduler
+
+	tunables      TunablesSource
+	applyTunables func(tuning.Config)
 
-	healthMu      sync.RWMutex
-	lastTickStart time.Time
-	lastOk        bool
+	// these are all read from the clock with their monotonic readings, so that
+	// wall clock jumps (e.g. on resuming from suspend) don't skew the health checks
+	healthMu            sync.RWMutex
+	started             time.Time
+	lastTickStart       time.Time
+	lastCommit          time.Time
+	lastOk              bool
+	effectiveResolution time.Duration
+
+	// see liveness.go
+	livenessCycleMultiplier  float64
+	livenessCommitMultiplier float64
 }
 
 func NewManager(metricSrc sources.MetricSource, metricSink sink.MetricSink, resolution time.Duration) *Manager {
+	return NewManagerWithClock(metricSrc, metricSink, resolution, clock.RealClock{})
+}
+
+// NewManagerWithClock is like NewManager, but uses the given clock to schedule and time collection cycles.
+func NewManagerWithClock(metricSrc sources.MetricSource, metricSink sink.MetricSink, resolution time.Duration, clk clock.Clock) *Manager {
 	manager := Manager{
-		source:     metricSrc,
-		sink:       metricSink,
-		resolution: resolution,
+		source:              metricSrc,
+		sink:                metricSink,
+		resolution:          resolution,
+		scrapeTimeout:       tuning.ScrapeTimeoutFor(resolution),
+		clock:               clk,
+		effectiveResolution: resolution,
+		gc:                  &gcScheduler{},
 	}
 
 	return &manager
 }
 
+// EnableAutoResolution makes the manager stretch its effective resolution, up to the given
+// maximum, once the given number of consecutive cycles have all taken longer than it, and
+// revert to the configured resolution once that many consecutive cycles have fit within it
+// again.  The scrape timeout of the source, if it's a sources.ScrapeTimeoutSetter, is stretched
+// and reverted along with it (see SetConfiguredScrapeTimeout).  It must be called before RunUntil.
+func (rm *Manager) EnableAutoResolution(maxResolution time.Duration, cycles int) {
+	rm.guardrail = newResolutionGuardrail(rm.resolution, maxResolution, cycles)
+}
+
+// SetConfiguredScrapeTimeout sets the scrape timeout the source was given for the configured
+// resolution, tuning.ScrapeTimeoutFor the resolution by default, which the manager stretches in
+// proportion to the resolution.  It must be called before RunUntil.
+func (rm *Manager) SetConfiguredScrapeTimeout(timeout time.Duration) {
+	rm.scrapeTimeout = timeout
+}
+
+// applyScrapeTimeout sets the scrape timeout of the source in proportion to the given effective
+// resolution, so that stretched cycles aren't still cut short by the configured scrape timeout.
+func (rm *Manager) applyScrapeTimeout(resolution time.Duration) {
+	setter, ok := rm.source.(sources.ScrapeTimeoutSetter)
+	if !ok || rm.resolution <= 0 {
+		return
+	}
+	setter.SetScrapeTimeout(time.Duration(float64(rm.scrapeTimeout) * float64(resolution) / float64(rm.resolution)))
+}
+
+// EnableResumeDetection makes the manager take a reading of the wall and monotonic clocks
+// every ResumeCheckInterval, and treat the wall clock jumping ahead of the monotonic clock by
+// at least the given threshold as the host resuming from suspend: the rate baselines of the
+// source are discarded (if it's a sources.BaselineResetter), since they span the suspend, and
+// a cycle is started immediately, rather than waiting for the next tick.  It must be called
+// before RunUntil.
+func (rm *Manager) EnableResumeDetection(threshold time.Duration, read func() ClockReading) {
+	rm.resume = newResumeDetector(threshold, read)
+}
+
+// EnableGCAfterCommit makes the manager force a garbage collection once each batch is committed,
+// rather than leaving the collections triggered by allocating the next batch to land while
+// serving.  It must be called before RunUntil.
+func (rm *Manager) EnableGCAfterCommit() {
+	rm.gc.afterCommit = true
+}
+
+// ReloadTunables makes the manager check the given source for reloaded parameters after each
+// collection cycle, so that they all take effect together before the next one.  The manager
+// applies the resolution (resetting any automatic adjustment) and the scrape timeout itself, and
+// passes the parameters to the given function to apply the rest.  It must be called before RunUntil.
+func (rm *Manager) ReloadTunables(source TunablesSource, apply func(tuning.Config)) {
+	rm.tunables = source
+	rm.applyTunables = apply
+}
+
+// EffectiveResolution returns the current interval between collection cycles.
+func (rm *Manager) EffectiveResolution() time.Duration {
+	rm.healthMu.RLock()
+	defer rm.healthMu.RUnlock()
+	return rm.effectiveResolution
+}
+
+// UntilNextCommit estimates how long it is until the next batch is committed, as one effective
+// resolution after the last commit, or zero if none has been committed yet, or the next is overdue.
+func (rm *Manager) UntilNextCommit() time.Duration {
+	rm.healthMu.RLock()
+	defer rm.healthMu.RUnlock()
+	if rm.lastCommit.IsZero() {
+		return 0
+	}
+	remaining := rm.effectiveResolution - rm.clock.Since(rm.lastCommit)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
 func (rm *Manager) RunUntil(stopCh <-chan struct{}) {
+	effectiveResolution.Set(rm.resolution.Seconds())
+	rm.healthMu.Lock()
+	rm.started = rm.clock.Now()
+	rm.healthMu.Unlock()
+	// cancel any cycle in progress when stopped, saying why
+	ctx, cancel := context.WithCancelCause(context.Background())
 	go func() {
-		ticker := time.NewTicker(rm.resolution)
-		defer ticker.Stop()
+		<-stopCh
+		cancel(&sources.ErrCanceled{Reason: sources.CancelReasonShutdown, Detail: "metrics-server is shutting down"})
+	}()
+	go func() {
+		var resumeCh <-chan time.Time
+		if rm.resume != nil {
+			resumeTicker := rm.clock.NewTicker(ResumeCheckInterval)
+			defer resumeTicker.Stop()
+			resumeCh = resumeTicker.C()
+		}
+		ticker := rm.clock.NewTicker(rm.resolution)
+		defer func() { ticker.Stop() }()
 
 		for {
-			func() {
-				select {
-				case startTime := <-ticker.C:
-					rm.healthMu.Lock()
-					rm.lastTickStart = startTime
-					rm.healthMu.Unlock()
-
-					healthyTick := true
-
-					ctx, cancelTimeout := context.WithTimeout(context.Background(), rm.resolution)
-					defer cancelTimeout()
-
-					glog.V(6).Infof("Beginning cycle, collecting metrics...")
-					data, collectErr := rm.source.Collect(ctx)
-					if collectErr != nil {
-						glog.Errorf("unable to fully collect metrics: %v", collectErr)
-
-						// only consider this an indication of bad health if we
-						// couldn't collect from any nodes -- one node going down
-						// shouldn't indicate that metrics-server is unhealthy
-						if len(data.Nodes) == 0 {
-							healthyTick = false
-						}
-
-						// NB: continue on so that we don't lose all metrics
-						// if one node goes down
-					}
-
-					glog.V(6).Infof("...Storing metrics...")
-					recvErr := rm.sink.Receive(data)
-					if recvErr != nil {
-						glog.Errorf("unable to save metrics: %v", recvErr)
-
-						// any failure to save means we're unhealthy
-						healthyTick = false
-					}
-
-					collectTime := time.Now().Sub(startTime)
-					tickDuration.Observe(float64(collectTime) / float64(time.Second))
-					glog.V(6).Infof("...Cycle complete")
-
-					rm.healthMu.Lock()
-					rm.lastOk = healthyTick
-					rm.healthMu.Unlock()
-				case <-stopCh:
-					return
+			select {
+			case startTime := <-ticker.C():
+				cycleDuration := rm.collect(ctx, startTime)
+				newResolution, changed := rm.observeCycle(cycleDuration)
+				if reloaded, reloadedChanged := rm.reloadTunables(); reloadedChanged {
+					newResolution, changed = reloaded, true
 				}
-			}()
+				if changed {
+					ticker.Stop()
+					ticker = rm.clock.NewTicker(newResolution)
+				}
+			case <-resumeCh:
+				jump, resumed := rm.resume.check()
+				if !resumed {
+					continue
+				}
+				rm.collectAfterResume(ctx, jump)
+				// count the next cycle from this one
+				ticker.Stop()
+				ticker = rm.clock.NewTicker(rm.EffectiveResolution())
+			case <-stopCh:
+				return
+			}
 		}
 	}()
 }
 
+// collect runs a single collection cycle within the given context, returning how long it took.
+func (rm *Manager) collect(ctx context.Context, startTime time.Time) time.Duration {
+	rm.healthMu.Lock()
+	rm.lastTickStart = startTime
+	resolution := rm.effectiveResolution
+	rm.healthMu.Unlock()
+
+	rm.gc.cycleStarted()
+	healthyTick := true
+
+	ctx, cancelTimeout := context.WithTimeoutCause(ctx, resolution, &sources.ErrCanceled{
+		Reason: sources.CancelReasonTimeout,
+		Detail: fmt.Sprintf("the cycle overran the metric resolution of %s", resolution),
+	})
+	defer cancelTimeout()
+	ctx = sources.WithCycleID(ctx, sources.NewCycleID())
+	logger := logging.FromContext(ctx, loglevel.Scraper)
+
+	logger.V(6).Info("Beginning cycle, collecting metrics...")
+	data, collectErr := rm.source.Collect(ctx)
+	if collectErr != nil {
+		logger.Error(collectErr, fmt.Sprintf("unable to fully collect metrics: %v", collectErr))
+
+		// only consider this an indication of bad health if we
+		// couldn't collect from any nodes -- one node going down
+		// shouldn't indicate that metrics-server is unhealthy
+		if len(data.Nodes) == 0 {
+			healthyTick = false
+		}
+
+		// NB: continue on so that we don't lose all metrics
+		// if one node goes down
+	}
+
+	logger.V(6).Info("...Storing metrics...")
+	recvErr := rm.sink.Receive(data)
+	if recvErr != nil {
+		logger.WithComponent(loglevel.Storage).Error(recvErr, fmt.Sprintf("unable to save metrics: %v", recvErr))
+
+		// any failure to save means we're unhealthy
+		healthyTick = false
+	}
+
+	collectTime := rm.clock.Since(startTime)
+	tickDuration.Observe(float64(collectTime) / float64(time.Second))
+	if recvErr == nil {
+		rm.gc.committed()
+	}
+	rm.gc.cycleEnded()
+	logger.V(6).Info("...Cycle complete", "duration", collectTime)
+
+	rm.healthMu.Lock()
+	rm.lastOk = healthyTick
+	if recvErr == nil {
+		rm.lastCommit = rm.clock.Now()
+	}
+	rm.healthMu.Unlock()
+
+	return collectTime
+}
+
+// collectAfterResume runs a collection cycle straight after the host resumed from suspend
+// (detected by the wall clock jumping ahead by the given amount), once the rate baselines
+// spanning the suspend have been discarded.
+func (rm *Manager) collectAfterResume(ctx context.Context, jump time.Duration) {
+	glog.Warningf("the wall clock jumped %s ahead of the monotonic clock, so the host likely resumed from suspend: discarding rate baselines and collecting metrics immediately", jump.Round(time.Second))
+	resumesDetected.Inc()
+	if resetter, ok := rm.source.(sources.BaselineResetter); ok {
+		resetter.ResetBaselines()
+	}
+	rm.collect(ctx, rm.clock.Now())
+}
+
+// observeCycle records the duration of a cycle, adjusting the effective resolution if
+// auto-adjustment is enabled.  It returns the new effective resolution, if it changed.
+func (rm *Manager) observeCycle(cycleDuration time.Duration) (time.Duration, bool) {
+	rm.healthMu.RLock()
+	resolution := rm.effectiveResolution
+	rm.healthMu.RUnlock()
+
+	if cycleDuration > resolution {
+		cyclesOverran.Inc()
+	}
+	if rm.guardrail == nil {
+		return resolution, false
+	}
+
+	newResolution := rm.guardrail.observe(cycleDuration)
+	if newResolution == resolution {
+		return resolution, false
+	}
+	if newResolution > rm.resolution {
+		glog.Warningf("the last %d collection cycles took longer than the metric resolution of %s, stretching it to %s", rm.guardrail.cycles, resolution, newResolution)
+	} else {
+		glog.Infof("the last %d collection cycles fit within the configured metric resolution again, reverting to %s", rm.guardrail.cycles, newResolution)
+	}
+
+	rm.healthMu.Lock()
+	rm.effectiveResolution = newResolution
+	rm.healthMu.Unlock()
+	effectiveResolution.Set(newResolution.Seconds())
+	if resAware, ok := rm.sink.(sink.ResolutionAwareSink); ok {
+		resAware.SetResolutionStretch(newResolution - rm.resolution)
+	}
+	rm.applyScrapeTimeout(newResolution)
+	return newResolution, true
+}
+
+// reloadTunables applies any reloaded parameters, returning the new resolution, if it changed.
+func (rm *Manager) reloadTunables() (time.Duration, bool) {
+	if rm.tunables == nil {
+		return 0, false
+	}
+	cfg, reloaded := rm.tunables.Next()
+	if !reloaded {
+		return 0, false
+	}
+	if rm.applyTunables != nil {
+		rm.applyTunables(cfg)
+	}
+	rm.scrapeTimeout = cfg.ScrapeTimeout
+	if cfg.MetricResolution == rm.resolution {
+		rm.applyScrapeTimeout(rm.EffectiveResolution())
+		return 0, false
+	}
+
+	glog.Infof("changing the metric resolution from %s to %s", rm.resolution, cfg.MetricResolution)
+	rm.resolution = cfg.MetricResolution
+	if rm.guardrail != nil {
+		rm.guardrail = newResolutionGuardrail(rm.resolution, rm.guardrail.max, rm.guardrail.cycles)
+	}
+	rm.healthMu.Lock()
+	rm.effectiveResolution = rm.resolution
+	rm.healthMu.Unlock()
+	effectiveResolution.Set(rm.resolution.Seconds())
+	if resAware, ok := rm.sink.(sink.ResolutionAwareSink); ok {
+		resAware.SetResolutionStretch(0)
+	}
+	rm.applyScrapeTimeout(rm.resolution)
+	return rm.resolution, true
+}
+
 // CheckHealth checks the health of the manager by looking at tick times,
 // and checking if we have at least one node in the collected data.
 // It implements the health checker func part of the healthz checker.
@@ -143,11 +416,16 @@ func (rm *Manager) CheckHealth(_ *http.Request) error {
 	rm.healthMu.RLock()
 	lastTick := rm.lastTickStart
 	healthyTick := rm.lastOk
+	resolution := rm.effectiveResolution
 	rm.healthMu.RUnlock()
 
-	// use 1.1 for a bit of wiggle room
-	maxTickWait := time.Duration(1.1 * float64(rm.resolution))
-	tickWait := time.Now().Sub(lastTick)
+	// use 1.1 for a bit of wiggle room, but at least minTickSlack, since
+	// at short resolutions a tenth is within ordinary scheduling delays
+	maxTickWait := time.Duration(1.1 * float64(resolution))
+	if maxTickWait < resolution+minTickSlack {
+		maxTickWait = resolution + minTickSlack
+	}
+	tickWait := rm.clock.Since(lastTick)
 
 	if tickWait > maxTickWait {
 		return fmt.Errorf("time since last tick (%s) was greater than expected metrics resolution (%s)", tickWait, maxTickWait)
@@ -0,0 +1,686 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	fakesrc "github.com/kubernetes-incubator/metrics-server/pkg/sources/fake"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+)
+
+const (
+	resolution    = 10 * time.Second
+	maxResolution = 30 * time.Second
+	defaultWindow = 30 * time.Second
+)
+
+func TestManager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Manager Suite")
+}
+
+// manualClock is a fake clock whose tickers only fire when told to,
+// so that tests can hand each tick directly to the manager.
+type manualClock struct {
+	*clock.FakeClock
+
+	mu        sync.Mutex
+	tickers   []*manualTicker
+	intervals []time.Duration
+}
+
+type manualTicker struct {
+	c chan time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.c }
+func (t *manualTicker) Stop()               {}
+
+func (c *manualClock) NewTicker(d time.Duration) clock.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &manualTicker{c: make(chan time.Time)}
+	c.tickers = append(c.tickers, ticker)
+	c.intervals = append(c.intervals, d)
+	return ticker
+}
+
+// latest returns the most recently created ticker.
+func (c *manualClock) latest() *manualTicker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tickers) == 0 {
+		return nil
+	}
+	return c.tickers[len(c.tickers)-1]
+}
+
+// tick hands a tick to the manager, waiting for it to be ready for one, which
+// means that any previous cycles have completed.
+func (c *manualClock) tick() {
+	deadline := time.After(5 * time.Second)
+	for {
+		ticker := c.latest()
+		if ticker == nil {
+			select {
+			case <-deadline:
+				Fail("manager never created a ticker")
+			case <-time.After(time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case ticker.c <- c.Now():
+			return
+		case <-deadline:
+			Fail("manager never became ready for another tick")
+		case <-time.After(time.Millisecond):
+			// the manager may have replaced the ticker, so check again
+		}
+	}
+}
+
+// first returns the first ticker created, waiting for there to be one.
+func (c *manualClock) first() *manualTicker {
+	var ticker *manualTicker
+	Eventually(func() *manualTicker {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.tickers) > 0 {
+			ticker = c.tickers[0]
+		}
+		return ticker
+	}).ShouldNot(BeNil(), "manager never created a ticker")
+	return ticker
+}
+
+func (c *manualClock) numTickers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tickers)
+}
+
+func (c *manualClock) lastInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.intervals[len(c.intervals)-1]
+}
+
+// slowSource is a fake source standing in for Kubelets which each
+// take a configured amount of (fake) time to respond.
+type slowSource struct {
+	clock  *manualClock
+	delays chan time.Duration
+	resets int32
+}
+
+func (s *slowSource) Name() string { return "slow_source" }
+
+func (s *slowSource) Collect(_ context.Context) (*sources.MetricsBatch, error) {
+	delay := <-s.delays
+	s.clock.Step(delay)
+	return &sources.MetricsBatch{
+		Nodes: []sources.NodeMetricsPoint{
+			{Name: "node1", MetricsPoint: sources.MetricsPoint{
+				Timestamp:   s.clock.Now(),
+				CpuUsage:    *resource.NewMilliQuantity(100, resource.DecimalSI),
+				MemoryUsage: *resource.NewQuantity(200, resource.BinarySI),
+			}},
+		},
+	}, nil
+}
+
+func (s *slowSource) ResetBaselines() { atomic.AddInt32(&s.resets, 1) }
+
+// deadlineSource is a slowSource recording how long each of its scrapes had until its deadline.
+type deadlineSource struct {
+	*slowSource
+
+	mu       sync.Mutex
+	timeouts []time.Duration
+}
+
+func (s *deadlineSource) Collect(ctx context.Context) (*sources.MetricsBatch, error) {
+	deadline, _ := ctx.Deadline()
+	s.mu.Lock()
+	s.timeouts = append(s.timeouts, time.Until(deadline))
+	s.mu.Unlock()
+	return s.slowSource.Collect(ctx)
+}
+
+func (s *deadlineSource) timeout(cycle int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeouts[cycle]
+}
+
+// failingSink is a fake sink which rejects every batch.
+type failingSink struct{}
+
+func (failingSink) Receive(_ *sources.MetricsBatch) error {
+	return errors.New("injected storage failure")
+}
+
+var _ = Describe("Manager", func() {
+	var (
+		clk    *manualClock
+		src    *slowSource
+		prov   provider.MetricsProvider
+		mgr    *Manager
+		stopCh chan struct{}
+		// pending is set when a cycle has started, and is waiting for its delay
+		pending bool
+	)
+
+	BeforeEach(func() {
+		clk = &manualClock{FakeClock: clock.NewFakeClock(time.Now())}
+		src = &slowSource{clock: clk, delays: make(chan time.Duration)}
+		var metricSink sink.MetricSink
+		metricSink, prov = provsink.NewSinkProvider()
+		mgr = NewManagerWithClock(src, metricSink, resolution, clk)
+		stopCh = make(chan struct{})
+		pending = false
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		close(src.delays)
+	})
+
+	// runCycles runs one collection cycle for each of the given Kubelet delays,
+	// waiting for each to complete.  The manager is only ready for another tick
+	// once a cycle completes, so the tick after each one starts the next cycle,
+	// which then waits for its delay.
+	runCycles := func(delays ...time.Duration) {
+		for _, delay := range delays {
+			if !pending {
+				clk.tick()
+			}
+			src.delays <- delay
+			clk.tick()
+			pending = true
+		}
+	}
+
+	// reportedWindow returns the window reported for the node in the most recent batch.
+	reportedWindow := func() time.Duration {
+		timeInfos, _, err := prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		return timeInfos[0].Window
+	}
+
+	It("should cancel the cycle in progress when stopped, giving shutdown as the cause", func() {
+		started := make(chan struct{})
+		causes := make(chan error, 1)
+		hung := &fakesrc.FunctionSource{
+			SourceName: "hung_source",
+			GenerateBatch: func(ctx context.Context) (*sources.MetricsBatch, error) {
+				close(started)
+				<-ctx.Done()
+				causes <- context.Cause(ctx)
+				return &sources.MetricsBatch{}, ctx.Err()
+			},
+		}
+		metricSink, _ := provsink.NewSinkProvider()
+		hungMgr := NewManagerWithClock(hung, metricSink, resolution, clk)
+		stop := make(chan struct{})
+		hungMgr.RunUntil(stop)
+		clk.tick()
+		Eventually(started).Should(BeClosed())
+
+		close(stop)
+		var cause error
+		Eventually(causes).Should(Receive(&cause))
+		canceled, ok := sources.CancelCause(cause)
+		Expect(ok).To(BeTrue(), "expected a cancellation cause, got %v", cause)
+		Expect(canceled.Reason).To(Equal(sources.CancelReasonShutdown))
+	})
+
+	It("should estimate the time until the next commit from the last one", func() {
+		Expect(mgr.UntilNextCommit()).To(BeZero())
+		mgr.RunUntil(stopCh)
+		runCycles(5 * time.Second)
+		Expect(mgr.UntilNextCommit()).To(Equal(resolution))
+
+		clk.Step(4 * time.Second)
+		Expect(mgr.UntilNextCommit()).To(Equal(6 * time.Second))
+		By("reporting zero once the next commit is overdue")
+		clk.Step(7 * time.Second)
+		Expect(mgr.UntilNextCommit()).To(BeZero())
+	})
+
+	Context("with automatic resolution adjustment", func() {
+		BeforeEach(func() {
+			mgr.EnableAutoResolution(maxResolution, 2)
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should keep the configured resolution while cycles fit within it", func() {
+			runCycles(5*time.Second, 5*time.Second, 5*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+			Expect(reportedWindow()).To(Equal(defaultWindow))
+		})
+
+		It("should not stretch the resolution unless enough consecutive cycles overrun it", func() {
+			runCycles(15*time.Second, 5*time.Second, 15*time.Second, 5*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+		})
+
+		It("should stretch the resolution to just over the slowest cycle once enough consecutive cycles overrun it", func() {
+			runCycles(12*time.Second, 15*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(17 * time.Second))
+			Expect(clk.lastInterval()).To(Equal(17 * time.Second))
+		})
+
+		It("should reflect the stretch in the window of subsequent batches", func() {
+			runCycles(15*time.Second, 15*time.Second)
+			Expect(reportedWindow()).To(Equal(defaultWindow))
+
+			runCycles(5 * time.Second)
+			Expect(reportedWindow()).To(Equal(defaultWindow + 7*time.Second))
+		})
+
+		It("should not stretch the resolution beyond the maximum", func() {
+			runCycles(time.Minute, time.Minute)
+			Expect(mgr.EffectiveResolution()).To(Equal(maxResolution))
+
+			runCycles(time.Minute, time.Minute)
+			Expect(mgr.EffectiveResolution()).To(Equal(maxResolution))
+		})
+
+		It("should stretch further if cycles keep overrunning the stretched resolution", func() {
+			runCycles(15*time.Second, 15*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(17 * time.Second))
+
+			runCycles(20*time.Second, 20*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(22 * time.Second))
+		})
+
+		It("should revert to the configured resolution once cycles recover", func() {
+			runCycles(15*time.Second, 15*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(17 * time.Second))
+
+			By("staying stretched while cycles still take longer than the configured resolution")
+			runCycles(12*time.Second, 12*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(17 * time.Second))
+
+			By("reverting once enough cycles fit within it again")
+			runCycles(5*time.Second, 5*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+			Expect(clk.lastInterval()).To(Equal(resolution))
+
+			runCycles(5 * time.Second)
+			Expect(reportedWindow()).To(Equal(defaultWindow))
+		})
+	})
+
+	Context("with automatic resolution adjustment of a source manager", func() {
+		var deadlines *deadlineSource
+
+		BeforeEach(func() {
+			deadlines = &deadlineSource{slowSource: src}
+			srcMgr := sources.NewSourceManager(fakesrc.StaticSourceProvider{deadlines}, tuning.ScrapeTimeoutFor(resolution))
+			var metricSink sink.MetricSink
+			metricSink, prov = provsink.NewSinkProvider()
+			mgr = NewManagerWithClock(srcMgr, metricSink, resolution, clk)
+			mgr.EnableAutoResolution(maxResolution, 2)
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should stretch and revert the scrape timeout along with the resolution", func() {
+			runCycles(15*time.Second, 15*time.Second, 5*time.Second, 5*time.Second, 5*time.Second)
+			Expect(deadlines.timeout(0)).To(BeNumerically("~", 9*time.Second, 100*time.Millisecond))
+			By("stretching it in proportion to the resolution")
+			Expect(deadlines.timeout(2)).To(BeNumerically("~", 15300*time.Millisecond, 100*time.Millisecond))
+			Expect(deadlines.timeout(3)).To(BeNumerically("~", 15300*time.Millisecond, 100*time.Millisecond))
+			By("reverting it once the resolution is reverted")
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+			Expect(deadlines.timeout(4)).To(BeNumerically("~", 9*time.Second, 100*time.Millisecond))
+		})
+	})
+
+	Context("with automatic adjustment of a 1s resolution", func() {
+		BeforeEach(func() {
+			var metricSink sink.MetricSink
+			metricSink, prov = provsink.NewSinkProvider()
+			mgr = NewManagerWithClock(src, metricSink, time.Second, clk)
+			mgr.EnableAutoResolution(3*time.Second, 2)
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should stretch the resolution in tenths of a second, rather than whole seconds", func() {
+			runCycles(1200*time.Millisecond, 1200*time.Millisecond)
+			Expect(mgr.EffectiveResolution()).To(Equal(1300 * time.Millisecond))
+			Expect(clk.lastInterval()).To(Equal(1300 * time.Millisecond))
+		})
+
+		It("should stay healthy while ticks are late by less than a second", func() {
+			runCycles(100 * time.Millisecond)
+			clk.Step(1500 * time.Millisecond)
+			Expect(mgr.CheckHealth(nil)).To(Succeed())
+		})
+	})
+
+	Context("without automatic resolution adjustment", func() {
+		BeforeEach(func() {
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should never stretch the resolution", func() {
+			runCycles(15*time.Second, 15*time.Second, 15*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+			Expect(reportedWindow()).To(Equal(defaultWindow))
+		})
+	})
+
+	Context("with garbage collection after each commit", func() {
+		BeforeEach(func() {
+			mgr.EnableGCAfterCommit()
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should collect garbage once each batch is committed", func() {
+			numGC := func() uint32 {
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				return stats.NumGC
+			}
+			before := numGC()
+			runCycles(5 * time.Second)
+			Eventually(reportedWindow).Should(Equal(defaultWindow))
+			Eventually(numGC).Should(BeNumerically(">", before))
+		})
+
+		It("should attribute the pauses of the collections after each commit to the cycle", func() {
+			cyclePauses := func() float64 {
+				families, err := prometheus.DefaultGatherer.Gather()
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range families {
+					if family.GetName() != "metrics_server_manager_gc_pause_seconds_total" {
+						continue
+					}
+					for _, metric := range family.GetMetric() {
+						for _, label := range metric.GetLabel() {
+							if label.GetName() == "phase" && label.GetValue() == GCPhaseCycle {
+								return metric.GetCounter().GetValue()
+							}
+						}
+					}
+				}
+				return 0
+			}
+			before := cyclePauses()
+			runCycles(5*time.Second, 5*time.Second, 5*time.Second)
+			Eventually(cyclePauses).Should(BeNumerically(">", before))
+		})
+	})
+
+	Context("with the liveness check", func() {
+		// emptySource stands in for an empty cluster, with no nodes to scrape.
+		emptySource := &fakesrc.FunctionSource{
+			SourceName: "empty_source",
+			GenerateBatch: func(_ context.Context) (*sources.MetricsBatch, error) {
+				return &sources.MetricsBatch{}, nil
+			},
+		}
+
+		// runIdleCycles runs the given number of cycles, a resolution apart, on a manager whose
+		// cycles don't block, waiting for all of them to complete (the manager's only ready for
+		// another tick once they have).
+		runIdleCycles := func(mgr *Manager, cycles int) {
+			for i := 0; i < cycles; i++ {
+				clk.Step(resolution)
+				clk.tick()
+			}
+			clk.tick()
+		}
+
+		It("should stay live before the first cycle, until it's overdue", func() {
+			mgr.EnableLivenessCheck(3, 5)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+			mgr.RunUntil(stopCh)
+
+			clk.Step(3 * resolution)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+			clk.Step(time.Second)
+			Expect(mgr.CheckLiveness(nil)).To(MatchError(ContainSubstring("no collection cycle has started for 31s")))
+		})
+
+		It("should fail once the scrape loop is stuck", func() {
+			mgr.EnableLivenessCheck(3, 5)
+			mgr.RunUntil(stopCh)
+			runCycles(5*time.Second, 5*time.Second)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+
+			By("leaving the cycle in progress stuck waiting on its Kubelet, so no more start")
+			// the tick starting it may have been sent before the previous cycle's delay
+			clk.Step(2 * resolution)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+			clk.Step(2 * resolution)
+			Expect(mgr.CheckLiveness(nil)).To(MatchError(ContainSubstring("no collection cycle has started")))
+
+			By("recovering once it gets unstuck")
+			runCycles(5 * time.Second)
+			// the next cycle records its start just after taking its tick
+			Eventually(func() error { return mgr.CheckLiveness(nil) }).Should(Succeed())
+		})
+
+		It("should fail once cycles stop storing metrics, even while they keep starting", func() {
+			failingMgr := NewManagerWithClock(emptySource, failingSink{}, resolution, clk)
+			failingMgr.EnableLivenessCheck(3, 5)
+			failingMgr.RunUntil(stopCh)
+
+			runIdleCycles(failingMgr, 5)
+			Expect(failingMgr.CheckLiveness(nil)).To(Succeed())
+			runIdleCycles(failingMgr, 1)
+			Expect(failingMgr.CheckLiveness(nil)).To(MatchError(ContainSubstring("no metrics have been stored for 1m0s")))
+		})
+
+		It("should count cycles in an empty cluster as successful", func() {
+			metricSink, _ := provsink.NewSinkProvider()
+			emptyMgr := NewManagerWithClock(emptySource, metricSink, resolution, clk)
+			emptyMgr.EnableLivenessCheck(3, 5)
+			emptyMgr.RunUntil(stopCh)
+
+			runIdleCycles(emptyMgr, 10)
+			Expect(emptyMgr.CheckLiveness(nil)).To(Succeed())
+		})
+
+		It("should measure against the stretched resolution", func() {
+			mgr.EnableAutoResolution(maxResolution, 2)
+			mgr.EnableLivenessCheck(3, 5)
+			mgr.RunUntil(stopCh)
+			runCycles(15*time.Second, 15*time.Second, time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(17 * time.Second))
+
+			clk.Step(45 * time.Second)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+		})
+
+		It("should never fail when disabled", func() {
+			mgr.RunUntil(stopCh)
+			clk.Step(time.Hour)
+			Expect(mgr.CheckLiveness(nil)).To(Succeed())
+		})
+	})
+
+	Context("with a reloadable config file", func() {
+		var (
+			dir     string
+			watcher *tuning.Watcher
+			mu      sync.Mutex
+			applied []tuning.Config
+		)
+
+		writeConfig := func(contents string) {
+			Expect(ioutil.WriteFile(filepath.Join(dir, "config.yaml"), []byte(contents), 0644)).To(Succeed())
+		}
+
+		appliedConfigs := func() []tuning.Config {
+			mu.Lock()
+			defer mu.Unlock()
+			return applied
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "manager-config")
+			Expect(err).NotTo(HaveOccurred())
+			writeConfig("metricResolution: 10s\n")
+			watcher, err = tuning.NewWatcherWithClock(filepath.Join(dir, "config.yaml"), tuning.Config{
+				MetricResolution: resolution,
+				ScrapeTimeout:    tuning.ScrapeTimeoutFor(resolution),
+			}, nil, clk)
+			Expect(err).NotTo(HaveOccurred())
+
+			applied = nil
+			mgr.EnableAutoResolution(maxResolution, 2)
+			mgr.ReloadTunables(watcher, func(cfg tuning.Config) {
+				mu.Lock()
+				defer mu.Unlock()
+				applied = append(applied, cfg)
+			})
+			mgr.RunUntil(stopCh)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should apply a rewritten resolution at the next cycle boundary, without restarting", func() {
+			runCycles(5 * time.Second)
+
+			By("rewriting the file while a cycle is in progress")
+			writeConfig("metricResolution: 20s\nscrapeTimeout: 15s\n")
+			watcher.Reload()
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+
+			By("checking that it takes effect once the cycle completes")
+			runCycles(5 * time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(20 * time.Second))
+			Expect(clk.lastInterval()).To(Equal(20 * time.Second))
+			Expect(appliedConfigs()).To(Equal([]tuning.Config{{MetricResolution: 20 * time.Second, ScrapeTimeout: 15 * time.Second}}))
+
+			By("checking that automatic adjustment now starts from the new resolution")
+			runCycles(15*time.Second, 15*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(20 * time.Second))
+			runCycles(25*time.Second, 25*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(28 * time.Second))
+		})
+
+		It("should keep the previous config when the file is rewritten with invalid values", func() {
+			runCycles(5 * time.Second)
+			writeConfig("metricResolution: 20s\nscrapeTimeout: 30s\n")
+			watcher.Reload()
+
+			runCycles(5*time.Second, 5*time.Second)
+			Expect(mgr.EffectiveResolution()).To(Equal(resolution))
+			Expect(clk.lastInterval()).To(Equal(resolution))
+			Expect(appliedConfigs()).To(BeEmpty())
+		})
+	})
+
+	Context("with resume detection", func() {
+		var (
+			readingMu sync.Mutex
+			reading   ClockReading
+		)
+
+		// advance moves the injected clock reading on by the given wall and monotonic times.
+		advance := func(wall, monotonic time.Duration) {
+			readingMu.Lock()
+			defer readingMu.Unlock()
+			reading.Wall = reading.Wall.Add(wall)
+			reading.Monotonic += monotonic
+		}
+
+		// checkClocks hands a tick to the manager's resume check, whose ticker is its first,
+		// waiting for it to be ready for one, which means any previous check has completed.
+		checkClocks := func() {
+			select {
+			case clk.first().c <- clk.Now():
+			case <-time.After(5 * time.Second):
+				Fail("manager never became ready for another resume check")
+			}
+		}
+
+		resets := func() int32 { return atomic.LoadInt32(&src.resets) }
+
+		BeforeEach(func() {
+			reading = ClockReading{Wall: time.Now(), Monotonic: time.Hour}
+			mgr.EnableResumeDetection(30*time.Second, func() ClockReading {
+				readingMu.Lock()
+				defer readingMu.Unlock()
+				return reading
+			})
+			mgr.RunUntil(stopCh)
+		})
+
+		It("should ignore the wall clock keeping pace with the monotonic clock, or being adjusted slightly", func() {
+			advance(time.Second, time.Second)
+			checkClocks()
+			By("stepping the wall clock a few seconds, as NTP might")
+			advance(4*time.Second, time.Second)
+			checkClocks()
+			// this check is only handed over once the previous ones completed without collecting
+			checkClocks()
+
+			Expect(resets()).To(BeZero())
+			Expect(clk.numTickers()).To(Equal(2))
+			runCycles(time.Second)
+		})
+
+		It("should discard the rate baselines, and collect immediately, once the host resumes", func() {
+			By("jumping the wall clock an hour ahead over a second of monotonic time")
+			advance(time.Hour, time.Second)
+			checkClocks()
+			Eventually(resets).Should(Equal(int32(1)))
+
+			By("completing the immediate collection, without a tick")
+			src.delays <- time.Second
+			Eventually(func() error {
+				_, _, err := prov.GetNodeMetrics("node1")
+				return err
+			}).Should(Succeed())
+
+			By("restarting the ticker, to count the next cycle from this one")
+			Eventually(clk.numTickers).Should(Equal(3))
+			Expect(clk.lastInterval()).To(Equal(resolution))
+			checkClocks()
+			Expect(resets()).To(Equal(int32(1)))
+		})
+	})
+})
@@ -0,0 +1,84 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ResumeCheckInterval is how often the manager compares the wall clock against
+// the monotonic clock, when detecting resumes.
+const ResumeCheckInterval = time.Second
+
+// DefaultResumeDetectionThreshold is the default for how far the wall clock must jump ahead of
+// the monotonic clock to be treated as a resume: far beyond any wall clock adjustment by NTP,
+// but well within any suspend long enough to skew rates.
+const DefaultResumeDetectionThreshold = 30 * time.Second
+
+var resumesDetected = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "manager",
+		Name:      "resumes_detected_total",
+		Help:      "The number of times the host was detected resuming from suspend, by the wall clock jumping ahead of the monotonic clock.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(resumesDetected)
+}
+
+// ClockReading is a reading of the wall clock, and of the monotonic clock
+// (as the time elapsed since some fixed point), taken together.
+type ClockReading struct {
+	Wall      time.Time
+	Monotonic time.Duration
+}
+
+// ReadClocks takes a ClockReading of the real clocks.
+func ReadClocks() ClockReading {
+	now := time.Now()
+	// Round(0) strips the monotonic reading, leaving just the wall clock
+	return ClockReading{Wall: now.Round(0), Monotonic: now.Sub(processStart)}
+}
+
+var processStart = time.Now()
+
+// resumeDetector detects the host resuming from suspend, during which the wall clock keeps
+// running while the monotonic clock (which all local scheduling and staleness is based on)
+// stops, so the wall clock jumps ahead of it between consecutive readings.  Ordinary wall
+// clock adjustments (e.g. by NTP) are far smaller than the threshold.  It is only used from
+// the manager's collection goroutine.
+type resumeDetector struct {
+	threshold time.Duration
+	read      func() ClockReading
+
+	last ClockReading
+}
+
+func newResumeDetector(threshold time.Duration, read func() ClockReading) *resumeDetector {
+	return &resumeDetector{threshold: threshold, read: read, last: read()}
+}
+
+// check takes another reading, returning how far the wall clock jumped ahead of the
+// monotonic clock since the last one, if it was by at least the threshold.
+func (d *resumeDetector) check() (time.Duration, bool) {
+	cur := d.read()
+	jump := cur.Wall.Sub(d.last.Wall) - (cur.Monotonic - d.last.Monotonic)
+	d.last = cur
+	return jump, jump >= d.threshold
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nsusage aggregates the CPU and memory usage of the pods in each namespace as of each
+// committed batch, for chargeback tooling, which otherwise lists every PodMetrics on every poll
+// to sum a handful of numbers.  The aggregates are computed once per batch and served from cache,
+// along with the fraction of each namespace's running pods they cover, since the pods of nodes
+// which couldn't be scraped are left out, so that consumers can normalize them.
+package nsusage
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+)
+
+// Path is the path the namespace usage is served at.
+const Path = "/namespace-usage"
+
+// NamespaceUsage is the usage of the pods with metrics in a namespace.
+type NamespaceUsage struct {
+	Namespace string `json:"namespace"`
+	// Usage is the CPU and memory usage summed over the pods with metrics.
+	Usage corev1.ResourceList `json:"usage"`
+	// Pods is the number of pods with metrics.
+	Pods int `json:"pods"`
+	// RunningPods is the number of running pods, and Coverage the fraction of them with metrics
+	// (one if none are running).  Both are only set when the running pods are known.
+	RunningPods *int     `json:"runningPods,omitempty"`
+	Coverage    *float64 `json:"coverage,omitempty"`
+}
+
+// Status is the usage of each namespace as of the last committed batch.
+type Status struct {
+	Committed  time.Time        `json:"committed"`
+	Namespaces []NamespaceUsage `json:"namespaces"`
+}
+
+// Aggregator sums the usage of the pods in each namespace of each committed batch.  It also
+// serves as an http.Handler for the aggregates (GET, optionally with a `namespace` query
+// parameter to serve just that one), meant to be served behind the API server's authentication
+// and authorization.
+type Aggregator struct {
+	pods       v1listers.PodLister
+	namespaces *provider.NamespaceAllowlist
+	access     *provider.NamespaceAccess
+
+	mu      sync.RWMutex
+	status  Status
+	encoded []byte
+}
+
+var _ sink.PodUsageObserver = &Aggregator{}
+
+// NewAggregator returns an aggregator computing the coverage of each namespace from the running
+// pods found by the given lister, or not at all if it's nil (e.g. when only some of the nodes are
+// scraped).  The running pods of namespaces not allowed by the given allowlist aren't counted.
+func NewAggregator(pods v1listers.PodLister, namespaces *provider.NamespaceAllowlist) *Aggregator {
+	return &Aggregator{pods: pods, namespaces: namespaces}
+}
+
+// FilterNamespaceAccess serves each user just the namespaces they may list PodMetrics in, as
+// decided by the given access, which may be nil to serve every namespace to everyone.
+func (a *Aggregator) FilterNamespaceAccess(access *provider.NamespaceAccess) {
+	a.access = access
+}
+
+// PodUsageCommitted aggregates the usage of the batch just committed.
+func (a *Aggregator) PodUsageCommitted(usage map[apitypes.NamespacedName]corev1.ResourceList) {
+	type aggregate struct {
+		cpu, memory      resource.Quantity
+		pods             int
+		running, covered int
+	}
+	aggregates := make(map[string]*aggregate)
+	aggregateFor := func(namespace string) *aggregate {
+		agg, ok := aggregates[namespace]
+		if !ok {
+			agg = &aggregate{}
+			aggregates[namespace] = agg
+		}
+		return agg
+	}
+	for podIdent, podUsage := range usage {
+		agg := aggregateFor(podIdent.Namespace)
+		agg.cpu.Add(*podUsage.Cpu())
+		agg.memory.Add(*podUsage.Memory())
+		agg.pods++
+	}
+
+	knowRunning := a.pods != nil
+	if knowRunning {
+		running, err := a.runningPods()
+		if err != nil {
+			glog.Errorf("unable to list the running pods to compute the coverage of each namespace's usage: %v", err)
+			knowRunning = false
+		}
+		for _, pod := range running {
+			agg := aggregateFor(pod.Namespace)
+			agg.running++
+			if _, ok := usage[apitypes.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]; ok {
+				agg.covered++
+			}
+		}
+	}
+
+	status := Status{Committed: time.Now(), Namespaces: make([]NamespaceUsage, 0, len(aggregates))}
+	for namespace, agg := range aggregates {
+		nsUsage := NamespaceUsage{
+			Namespace: namespace,
+			Usage:     corev1.ResourceList{corev1.ResourceCPU: agg.cpu, corev1.ResourceMemory: agg.memory},
+			Pods:      agg.pods,
+		}
+		if knowRunning {
+			running, coverage := agg.running, 1.0
+			if running > 0 {
+				coverage = float64(agg.covered) / float64(running)
+			}
+			nsUsage.RunningPods, nsUsage.Coverage = &running, &coverage
+		}
+		status.Namespaces = append(status.Namespaces, nsUsage)
+	}
+	sort.Slice(status.Namespaces, func(i, j int) bool { return status.Namespaces[i].Namespace < status.Namespaces[j].Namespace })
+
+	encoded, err := json.Marshal(status)
+	if err != nil {
+		glog.Errorf("unable to encode the usage of each namespace: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status, a.encoded = status, encoded
+}
+
+// runningPods lists the running pods in the allowed namespaces, which are those a Kubelet should
+// be reporting (unlike pods still starting, whose containers may not have stats yet).
+func (a *Aggregator) runningPods() ([]*corev1.Pod, error) {
+	pods, err := a.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var res []*corev1.Pod
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodRunning && a.namespaces.Allows(pod.Namespace) {
+			res = append(res, pod)
+		}
+	}
+	return res, nil
+}
+
+// Status returns the usage of each namespace as of the last committed batch.
+func (a *Aggregator) Status() Status {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.status
+}
+
+// ServeHTTP serves the usage of each namespace as of the last committed batch as JSON,
+// or of just the one given by the namespace query parameter, leaving out the namespaces
+// the requesting user may not list PodMetrics in, when filtering by access.
+func (a *Aggregator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	namespace := req.URL.Query().Get("namespace")
+	allowed := a.access.Filter(req.Context())
+
+	a.mu.RLock()
+	status, encoded := a.status, a.encoded
+	a.mu.RUnlock()
+	if encoded == nil {
+		http.Error(w, "no batch has been committed yet", http.StatusServiceUnavailable)
+		return
+	}
+	if namespace != "" || allowed != nil {
+		filtered := Status{Committed: status.Committed, Namespaces: []NamespaceUsage{}}
+		for _, nsUsage := range status.Namespaces {
+			if (namespace == "" || nsUsage.Namespace == namespace) && (allowed == nil || allowed(nsUsage.Namespace)) {
+				filtered.Namespaces = append(filtered.Namespaces, nsUsage)
+			}
+		}
+		var err error
+		if encoded, err = json.Marshal(filtered); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(encoded)
+}
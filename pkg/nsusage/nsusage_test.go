@@ -0,0 +1,217 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nsusage_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/nsusage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestNamespaceUsage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Namespace Usage Suite")
+}
+
+// fixturePod is a pod of the fixtures, running on a node, with the metrics it's scraped with.
+type fixturePod struct {
+	namespace, name, node string
+	phase                 corev1.PodPhase
+	cpu, memory           string
+}
+
+// fixturePods are spread over two nodes, where node-b's data is missing from the batch.
+var fixturePods = []fixturePod{
+	{"billing", "api-1", "node-a", corev1.PodRunning, "100m", "100Mi"},
+	{"billing", "api-2", "node-a", corev1.PodRunning, "200m", "200Mi"},
+	{"billing", "api-3", "node-b", corev1.PodRunning, "300m", "300Mi"},
+	{"billing", "api-4", "node-b", corev1.PodPending, "", ""},
+	{"search", "indexer", "node-b", corev1.PodRunning, "1", "1Gi"},
+	{"web", "frontend", "node-a", corev1.PodRunning, "50m", "64Mi"},
+	{"web", "migration", "node-a", corev1.PodSucceeded, "", ""},
+}
+
+func podPoint(pod fixturePod) sources.PodMetricsPoint {
+	return sources.PodMetricsPoint{Name: pod.name, Namespace: pod.namespace, Containers: []sources.ContainerMetricsPoint{
+		{Name: "main", MetricsPoint: sources.MetricsPoint{CpuUsage: resource.MustParse(pod.cpu), MemoryUsage: resource.MustParse(pod.memory)}},
+	}}
+}
+
+func usage(cpu, memory string) corev1.ResourceList {
+	return corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu), corev1.ResourceMemory: resource.MustParse(memory)}
+}
+
+var _ = Describe("Namespace usage aggregator", func() {
+	var (
+		indexer    cache.Indexer
+		metricSink sink.MetricSink
+		batch      *sources.MetricsBatch
+	)
+
+	BeforeEach(func() {
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		metricSink, _ = provsink.NewSinkProvider()
+		batch = &sources.MetricsBatch{}
+		for _, pod := range fixturePods {
+			Expect(indexer.Add(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: pod.namespace, Name: pod.name},
+				Spec:       corev1.PodSpec{NodeName: pod.node},
+				Status:     corev1.PodStatus{Phase: pod.phase},
+			})).To(Succeed())
+			if pod.node == "node-a" && pod.cpu != "" {
+				batch.Pods = append(batch.Pods, podPoint(pod))
+			}
+		}
+	})
+
+	commit := func(aggregator *Aggregator) Status {
+		metricSink.(sink.PodUsageObservingSink).ObservePodUsage(aggregator)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		return aggregator.Status()
+	}
+
+	// expectUsage checks the aggregated usage, pod counts and coverage of a namespace, where
+	// the coverage is -1 if it shouldn't be known.
+	expectUsage := func(nsUsage NamespaceUsage, namespace string, expected corev1.ResourceList, pods, running int, coverage float64) {
+		Expect(nsUsage.Namespace).To(Equal(namespace))
+		for name, quantity := range expected {
+			actual := nsUsage.Usage[name]
+			Expect(actual.Cmp(quantity)).To(BeZero(), "%s usage of %s: %s", name, namespace, actual.String())
+		}
+		Expect(nsUsage.Pods).To(Equal(pods), namespace)
+		if coverage < 0 {
+			Expect(nsUsage.RunningPods).To(BeNil(), namespace)
+			Expect(nsUsage.Coverage).To(BeNil(), namespace)
+			return
+		}
+		Expect(nsUsage.RunningPods).NotTo(BeNil(), namespace)
+		Expect(*nsUsage.RunningPods).To(Equal(running), namespace)
+		Expect(nsUsage.Coverage).NotTo(BeNil(), namespace)
+		Expect(*nsUsage.Coverage).To(BeNumerically("~", coverage, 0.001), namespace)
+	}
+
+	It("should sum the usage in each namespace, reporting the coverage of those whose pods are partly missing", func() {
+		status := commit(NewAggregator(v1listers.NewPodLister(indexer), nil))
+
+		Expect(status.Namespaces).To(HaveLen(3))
+		// api-3 is running on node-b, but the pending api-4 isn't expected to have metrics yet
+		expectUsage(status.Namespaces[0], "billing", usage("300m", "300Mi"), 2, 3, 2.0/3)
+		// every pod is on node-b, so nothing's covered
+		expectUsage(status.Namespaces[1], "search", usage("0", "0"), 0, 1, 0)
+		// the migration has completed
+		expectUsage(status.Namespaces[2], "web", usage("50m", "64Mi"), 1, 1, 1)
+	})
+
+	It("should count pods with metrics but no running pod object, without counting them as covering", func() {
+		batch.Pods = append(batch.Pods, podPoint(fixturePod{namespace: "web", name: "unmatched", cpu: "10m", memory: "10Mi"}))
+		status := commit(NewAggregator(v1listers.NewPodLister(indexer), nil))
+		expectUsage(status.Namespaces[2], "web", usage("60m", "74Mi"), 2, 1, 1)
+	})
+
+	It("should leave out the coverage when the running pods aren't known, and the namespaces not allowed", func() {
+		status := commit(NewAggregator(nil, nil))
+		Expect(status.Namespaces).To(HaveLen(2))
+		expectUsage(status.Namespaces[0], "billing", usage("300m", "300Mi"), 2, 0, -1)
+		expectUsage(status.Namespaces[1], "web", usage("50m", "64Mi"), 1, 0, -1)
+
+		status = commit(NewAggregator(v1listers.NewPodLister(indexer), provider.NewNamespaceAllowlist([]string{"billing", "web"}, nil, nil)))
+		Expect(status.Namespaces).To(HaveLen(2))
+		expectUsage(status.Namespaces[0], "billing", usage("300m", "300Mi"), 2, 3, 2.0/3)
+	})
+
+	It("should serve the cached aggregates of all namespaces, or of just the one asked for", func() {
+		aggregator := NewAggregator(v1listers.NewPodLister(indexer), nil)
+		serve := func(target string) (*httptest.ResponseRecorder, Status) {
+			recorder := httptest.NewRecorder()
+			aggregator.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+			var status Status
+			if recorder.Code == http.StatusOK {
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+			}
+			return recorder, status
+		}
+
+		recorder, _ := serve(Path)
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+
+		commit(aggregator)
+		recorder, status := serve(Path)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(status.Namespaces).To(HaveLen(3))
+		expectUsage(status.Namespaces[1], "search", usage("0", "0"), 0, 1, 0)
+
+		_, status = serve(Path + "?namespace=billing")
+		Expect(status.Namespaces).To(HaveLen(1))
+		expectUsage(status.Namespaces[0], "billing", usage("300m", "300Mi"), 2, 3, 2.0/3)
+
+		_, status = serve(Path + "?namespace=unknown")
+		Expect(status.Namespaces).To(BeEmpty())
+
+		recorder = httptest.NewRecorder()
+		aggregator.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, Path, nil))
+		Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should serve each user just the namespaces they may list pod metrics in, when filtering by access", func() {
+		aggregator := NewAggregator(v1listers.NewPodLister(indexer), nil)
+		aggregator.FilterNamespaceAccess(provider.NewNamespaceAccess(authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if attrs.GetUser().GetName() == "admin" || attrs.GetNamespace() == "web" {
+				return authorizer.DecisionAllow, "", nil
+			}
+			return authorizer.DecisionNoOpinion, "", nil
+		}), metrics.Resource("pods"), 0))
+		commit(aggregator)
+		namespacesFor := func(requester user.Info, target string) []string {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if requester != nil {
+				req = req.WithContext(genericapirequest.WithUser(req.Context(), requester))
+			}
+			recorder := httptest.NewRecorder()
+			aggregator.ServeHTTP(recorder, req)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var status Status
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+			res := []string{}
+			for _, nsUsage := range status.Namespaces {
+				res = append(res, nsUsage.Namespace)
+			}
+			return res
+		}
+
+		Expect(namespacesFor(&user.DefaultInfo{Name: "admin"}, Path)).To(Equal([]string{"billing", "search", "web"}))
+		Expect(namespacesFor(&user.DefaultInfo{Name: "tenant"}, Path)).To(Equal([]string{"web"}))
+		Expect(namespacesFor(&user.DefaultInfo{Name: "tenant"}, Path+"?namespace=billing")).To(BeEmpty())
+		Expect(namespacesFor(nil, Path)).To(BeEmpty())
+	})
+})
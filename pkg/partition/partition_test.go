@@ -0,0 +1,215 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/partition"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+func TestPartition(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Partition Suite")
+}
+
+func nodeNames(num int) []string {
+	res := make([]string, num)
+	for i := range res {
+		res[i] = fmt.Sprintf("node-%d", i)
+	}
+	return res
+}
+
+// ownedBy returns the first node out of many owned by the given member.
+func ownedBy(p *Partitioner, member string) string {
+	for _, node := range nodeNames(1000) {
+		if p.Owner(node) == member {
+			return node
+		}
+	}
+	Fail("no node owned by " + member)
+	return ""
+}
+
+var _ = Describe("Consistent Hash Ring", func() {
+	It("should spread nodes roughly evenly between members", func() {
+		ring := NewRing([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+		counts := map[string]int{}
+		for _, node := range nodeNames(3000) {
+			counts[ring.Owner(node)]++
+		}
+		Expect(counts).To(HaveLen(3))
+		for _, count := range counts {
+			Expect(count).To(BeNumerically("~", 1000, 250))
+		}
+	})
+
+	It("should only move the nodes of a removed member", func() {
+		before := NewRing([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+		after := NewRing([]string{"10.0.0.1", "10.0.0.3"})
+		for _, node := range nodeNames(1000) {
+			if owner := before.Owner(node); owner != "10.0.0.2" {
+				Expect(after.Owner(node)).To(Equal(owner))
+			}
+		}
+	})
+
+	It("should not assign nodes in an empty ring", func() {
+		Expect(NewRing(nil).Owner("node-1")).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Partitioner", func() {
+	It("should own every node until it learns of other replicas", func() {
+		p := NewPartitioner("10.0.0.1", time.Minute)
+		for _, node := range nodeNames(100) {
+			Expect(p.Owns(node)).To(BeTrue())
+		}
+	})
+
+	It("should keep scraping nodes handed off to other replicas for the handoff period", func() {
+		By("adding another replica, with a short handoff period")
+		p := NewPartitioner("10.0.0.1", 100*time.Millisecond)
+		p.SetMembers(map[string]string{"10.0.0.1": "10.0.0.1:443", "10.0.0.2": "10.0.0.2:443"})
+		node := ownedBy(p, "10.0.0.2")
+
+		By("verifying that the handed off node is still scraped, but not owned")
+		Expect(p.Owns(node)).To(BeFalse())
+		Expect(p.Scrapes(node)).To(BeTrue())
+		Expect(p.NodeFilter()(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: node}})).To(BeTrue())
+
+		By("verifying that it stops being scraped after the handoff period")
+		Eventually(func() bool { return p.Scrapes(node) }).Should(BeFalse())
+		Expect(p.Scrapes(ownedBy(p, "10.0.0.1"))).To(BeTrue())
+	})
+
+	It("should not restart the handoff if only addresses change", func() {
+		p := NewPartitioner("10.0.0.1", time.Hour)
+		p.SetMembers(map[string]string{"10.0.0.2": "10.0.0.2:443"})
+		p.SetMembers(map[string]string{"10.0.0.2": "10.0.0.2:8443"})
+		addr, ok := p.Address("10.0.0.2")
+		Expect(ok).To(BeTrue())
+		Expect(addr).To(Equal("10.0.0.2:8443"))
+		Expect(p.Peers()).To(Equal([]string{"10.0.0.2"}))
+	})
+})
+
+var _ = Describe("Router", func() {
+	var (
+		partitioner *Partitioner
+		router      *Router
+		peer        *httptest.Server
+		items       []v1beta1.NodeMetrics
+
+		// mu guards delay and localOnly, which the peer's handlers use concurrently
+		mu        sync.Mutex
+		delay     time.Duration
+		localOnly []string
+	)
+
+	localOnlyHeaders := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), localOnly...)
+	}
+
+	nodeMetrics := func(name string, cpu int64) v1beta1.NodeMetrics {
+		return v1beta1.NodeMetrics{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Usage:      corev1.ResourceList{corev1.ResourceCPU: *resource.NewMilliQuantity(cpu, resource.DecimalSI)},
+		}
+	}
+
+	BeforeEach(func() {
+		mu.Lock()
+		delay, localOnly = 0, nil
+		mu.Unlock()
+		partitioner = NewPartitioner("10.0.0.1", 0)
+		peer = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			wait := delay
+			localOnly = append(localOnly, req.Header.Get(provider.LocalOnlyHeader))
+			mu.Unlock()
+			time.Sleep(wait)
+			name := strings.TrimPrefix(req.URL.Path, "/apis/metrics.k8s.io/v1beta1/nodes")
+			if name == "" {
+				json.NewEncoder(w).Encode(&v1beta1.NodeMetricsList{Items: items})
+				return
+			}
+			for _, item := range items {
+				if "/"+item.Name == name {
+					json.NewEncoder(w).Encode(&item)
+					return
+				}
+			}
+			http.NotFound(w, req)
+		}))
+		partitioner.SetMembers(map[string]string{"10.0.0.2": strings.TrimPrefix(peer.URL, "https://")})
+		router = NewRouter(partitioner, peer.Client().Transport, 100*time.Millisecond)
+	})
+
+	AfterEach(func() {
+		peer.Close()
+	})
+
+	It("should proxy gets to the owning replica, asking it to only serve local data", func() {
+		node := ownedBy(partitioner, "10.0.0.2")
+		items = []v1beta1.NodeMetrics{nodeMetrics(node, 100)}
+
+		res, err := router.ProxyGet(context.Background(), node)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Name).To(Equal(node))
+		Expect(res.Usage.Cpu().MilliValue()).To(Equal(int64(100)))
+		Expect(localOnlyHeaders()).To(Equal([]string{"true"}))
+	})
+
+	It("should only keep the nodes each replica owns from proxied lists", func() {
+		owned, handedOff := ownedBy(partitioner, "10.0.0.2"), ownedBy(partitioner, "10.0.0.1")
+		items = []v1beta1.NodeMetrics{nodeMetrics(owned, 100), nodeMetrics(handedOff, 200)}
+
+		res, err := router.ProxyList(context.Background(), labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(HaveLen(1))
+		Expect(res[0].Name).To(Equal(owned))
+	})
+
+	It("should give up on replicas that take too long", func() {
+		mu.Lock()
+		delay = 500 * time.Millisecond
+		mu.Unlock()
+		_, err := router.ProxyGet(context.Background(), ownedBy(partitioner, "10.0.0.2"))
+		Expect(err).To(HaveOccurred())
+		_, err = router.ProxyList(context.Background(), labels.Everything())
+		Expect(err).To(HaveOccurred())
+	})
+})
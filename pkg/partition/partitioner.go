@@ -0,0 +1,228 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package partition splits the nodes of a cluster between several active
+// metrics-server replicas by consistent hashing, so that each replica only
+// scrapes its own share of the nodes, and fetches the rest from their owners.
+package partition
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+var (
+	partitionMembers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "partition",
+			Name:      "members",
+			Help:      "Number of metrics-server replicas the nodes are partitioned between.",
+		},
+	)
+	membershipChangesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "partition",
+			Name:      "membership_changes_total",
+			Help:      "Total number of changes to the set of replicas the nodes are partitioned between.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(partitionMembers)
+	prometheus.MustRegister(membershipChangesTotal)
+}
+
+// Partitioner tracks the set of replicas, and which of them owns each node.
+//
+// When the membership changes, each replica keeps scraping the nodes it lost
+// for a handoff period (normally one collection cycle), so that the new owners
+// have scraped them before the old owners stop, and no node goes unscraped.
+type Partitioner struct {
+	self    string
+	handoff time.Duration
+
+	mu sync.RWMutex
+	// addrs maps member IPs to the addresses to reach them at.
+	addrs    map[string]string
+	ring     *Ring
+	prevRing *Ring
+	changed  time.Time
+}
+
+// NewPartitioner constructs a partitioner for the replica with the given IP,
+// which starts out owning every node until it learns of other replicas.
+func NewPartitioner(self string, handoff time.Duration) *Partitioner {
+	p := &Partitioner{
+		self:    self,
+		handoff: handoff,
+		addrs:   map[string]string{},
+		ring:    NewRing([]string{self}),
+	}
+	partitionMembers.Set(1)
+	return p
+}
+
+// Self returns the IP of this replica.
+func (p *Partitioner) Self() string {
+	return p.self
+}
+
+// SetMembers updates the set of replicas, given as a map from their IPs to the
+// addresses to reach them at.  This replica is always considered a member.
+func (p *Partitioner) SetMembers(addrs map[string]string) {
+	members := make([]string, 0, len(addrs)+1)
+	members = append(members, p.self)
+	for member := range addrs {
+		if member != p.self {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(members) == len(p.addrs)+1 && sameMembers(members, p.addrs, p.self) {
+		// just update any changed addresses
+		p.addrs = copyAddrs(addrs, p.self)
+		return
+	}
+
+	p.prevRing = p.ring
+	p.ring = NewRing(members)
+	p.changed = time.Now()
+	p.addrs = copyAddrs(addrs, p.self)
+	partitionMembers.Set(float64(len(members)))
+	membershipChangesTotal.Inc()
+	glog.Infof("partitioning nodes between %d replicas: %v", len(members), members)
+}
+
+// Owner returns the IP of the replica that owns the given node.
+func (p *Partitioner) Owner(node string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.Owner(node)
+}
+
+// Owns checks if this replica owns the given node.
+func (p *Partitioner) Owns(node string) bool {
+	return p.Owner(node) == p.self
+}
+
+// Address returns the address to reach the given member at, if known.
+func (p *Partitioner) Address(member string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addr, ok := p.addrs[member]
+	return addr, ok
+}
+
+// Peers returns the IPs of all other replicas.
+func (p *Partitioner) Peers() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]string, 0, len(p.addrs))
+	for member := range p.addrs {
+		res = append(res, member)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Scrapes checks if this replica should scrape the given node, either because it owns
+// it, or because it owned it until recently, and is still handing it off.
+func (p *Partitioner) Scrapes(node string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.ring.Owner(node) == p.self {
+		return true
+	}
+	return p.prevRing != nil && time.Since(p.changed) < p.handoff && p.prevRing.Owner(node) == p.self
+}
+
+// NodeFilter returns a sources.NodeFilter selecting the nodes this replica should scrape.
+func (p *Partitioner) NodeFilter() sources.NodeFilter {
+	return func(node *corev1.Node) bool {
+		return p.Scrapes(node.Name)
+	}
+}
+
+// WatchEndpoints keeps the set of replicas in sync with the ready addresses
+// of the given Endpoints object (normally that of the metrics-server Service),
+// until the given channel is closed.
+func (p *Partitioner) WatchEndpoints(client kubernetes.Interface, namespace, name string, stopCh <-chan struct{}) {
+	listWatch := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "endpoints", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	update := func(obj interface{}) {
+		if endpoints, ok := obj.(*corev1.Endpoints); ok {
+			p.SetMembers(endpointAddresses(endpoints))
+		}
+	}
+	_, informer := cache.NewInformer(listWatch, &corev1.Endpoints{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(_ interface{}) { p.SetMembers(nil) },
+	})
+	go informer.Run(stopCh)
+}
+
+// endpointAddresses extracts the ready addresses from the given Endpoints,
+// as a map from IP to IP and port.
+func endpointAddresses(endpoints *corev1.Endpoints) map[string]string {
+	res := map[string]string{}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Ports) == 0 {
+			continue
+		}
+		port := strconv.Itoa(int(subset.Ports[0].Port))
+		for _, addr := range subset.Addresses {
+			res[addr.IP] = net.JoinHostPort(addr.IP, port)
+		}
+	}
+	return res
+}
+
+func sameMembers(members []string, addrs map[string]string, self string) bool {
+	for _, member := range members {
+		if _, ok := addrs[member]; !ok && member != self {
+			return false
+		}
+	}
+	return true
+}
+
+// copyAddrs copies the given addresses, excluding that of this replica.
+func copyAddrs(addrs map[string]string, self string) map[string]string {
+	res := make(map[string]string, len(addrs))
+	for member, addr := range addrs {
+		if member != self {
+			res[member] = addr
+		}
+	}
+	return res
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodesPerMember is the number of points each member has on the ring.
+// More points spread nodes more evenly, at the cost of a larger ring.
+const virtualNodesPerMember = 64
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// Ring is a consistent hash ring, assigning keys to members such that
+// adding or removing a member only moves the keys it gains or loses.
+type Ring struct {
+	points []ringPoint
+}
+
+// NewRing constructs a ring with the given members.
+func NewRing(members []string) *Ring {
+	ring := &Ring{points: make([]ringPoint, 0, len(members)*virtualNodesPerMember)}
+	for _, member := range members {
+		for i := 0; i < virtualNodesPerMember; i++ {
+			ring.points = append(ring.points, ringPoint{hash: hashKey(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash == ring.points[j].hash {
+			// keep collisions deterministic
+			return ring.points[i].member < ring.points[j].member
+		}
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// Owner returns the member owning the given key, or the empty string if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	ind := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if ind == len(r.points) {
+		ind = 0
+	}
+	return r.points[ind].member
+}
+
+func hashKey(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	// FNV barely changes the high bits for keys differing only at the end
+	// (like "node-1" and "node-2"), so finish with a mixing step (from
+	// splitmix64) to spread similar keys around the ring.
+	h := hasher.Sum64()
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
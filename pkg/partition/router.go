@@ -0,0 +1,163 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package partition
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/metrics/pkg/apis/metrics"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+const nodeMetricsPath = "/apis/metrics.k8s.io/v1beta1/nodes"
+
+var proxyRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "partition",
+		Name:      "proxy_requests_total",
+		Help:      "Total number of node metrics requests proxied to other replicas, by operation and success.",
+	},
+	[]string{"operation", "success"},
+)
+
+func init() {
+	prometheus.MustRegister(proxyRequestsTotal)
+}
+
+// Router is a provider.NodeRouter which proxies requests for nodes
+// owned by other replicas to those replicas.
+type Router struct {
+	partitioner *Partitioner
+	client      *http.Client
+}
+
+var _ provider.NodeRouter = &Router{}
+
+// NewRouter constructs a router using the given partitioner to locate the owners of
+// nodes, and the given transport (which must authenticate to the other replicas)
+// to reach them, giving up on each request after the given timeout.
+func NewRouter(partitioner *Partitioner, transport http.RoundTripper, timeout time.Duration) *Router {
+	return &Router{
+		partitioner: partitioner,
+		client:      &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+func (r *Router) Owns(node string) bool {
+	return r.partitioner.Owns(node)
+}
+
+func (r *Router) ProxyGet(ctx context.Context, node string) (*metrics.NodeMetrics, error) {
+	owner := r.partitioner.Owner(node)
+	var external v1beta1.NodeMetrics
+	err := r.fetch(ctx, owner, nodeMetricsPath+"/"+url.PathEscape(node), &external)
+	proxyRequestsTotal.WithLabelValues("get", fmt.Sprintf("%t", err == nil)).Inc()
+	if err != nil {
+		return nil, err
+	}
+	var res metrics.NodeMetrics
+	if err := v1beta1.Convert_v1beta1_NodeMetrics_To_metrics_NodeMetrics(&external, &res, nil); err != nil {
+		return nil, fmt.Errorf("unable to convert node metrics from replica %s: %v", owner, err)
+	}
+	return &res, nil
+}
+
+func (r *Router) ProxyList(ctx context.Context, selector labels.Selector) ([]metrics.NodeMetrics, error) {
+	path := nodeMetricsPath
+	if selector != nil && !selector.Empty() {
+		path += "?labelSelector=" + url.QueryEscape(selector.String())
+	}
+
+	peers := r.partitioner.Peers()
+	results := make([][]metrics.NodeMetrics, len(peers))
+	errs := make([]error, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			var external v1beta1.NodeMetricsList
+			errs[i] = r.fetch(ctx, peer, path, &external)
+			proxyRequestsTotal.WithLabelValues("list", fmt.Sprintf("%t", errs[i] == nil)).Inc()
+			if errs[i] != nil {
+				return
+			}
+			for j := range external.Items {
+				// peers may still be handing off nodes they no longer own, so skip those
+				if r.partitioner.Owner(external.Items[j].Name) != peer {
+					continue
+				}
+				var item metrics.NodeMetrics
+				if err := v1beta1.Convert_v1beta1_NodeMetrics_To_metrics_NodeMetrics(&external.Items[j], &item, nil); err != nil {
+					errs[i] = fmt.Errorf("unable to convert node metrics from replica %s: %v", peer, err)
+					return
+				}
+				results[i] = append(results[i], item)
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+
+	var res []metrics.NodeMetrics
+	for _, items := range results {
+		res = append(res, items...)
+	}
+	return res, utilerrors.NewAggregate(errs)
+}
+
+// fetch fetches the given path from the given replica, only serving local data, into the given object.
+func (r *Router) fetch(ctx context.Context, member, path string, into interface{}) error {
+	addr, ok := r.partitioner.Address(member)
+	if !ok {
+		return fmt.Errorf("no known address for replica %s", member)
+	}
+	req, err := http.NewRequest("GET", "https://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(provider.LocalOnlyHeader, "true")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach replica %s: %v", member, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response from replica %s: %v", member, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to replica %s failed - %q, response: %q", member, resp.Status, string(body))
+	}
+	if err := json.Unmarshal(body, into); err != nil {
+		return fmt.Errorf("unable to decode response from replica %s: %v", member, err)
+	}
+	return nil
+}
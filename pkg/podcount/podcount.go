@@ -0,0 +1,235 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package podcount tracks how many pods metrics-server holds metrics for in each
+// namespace, compared to how many pods are actually scheduled there, so that
+// scrape gaps can be spotted (and alerted on) per namespace.
+package podcount
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+)
+
+// OtherNamespaces is the namespace label of the bucket holding the namespaces beyond the
+// top N.  Namespace names can't contain underscores, so it can't clash with a real one.
+const OtherNamespaces = "_other"
+
+// DefaultTopNamespaces is the default number of namespaces given their own series.
+const DefaultTopNamespaces = 10
+
+var (
+	trackedPods = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "tracked_pods",
+			Help:      "The number of pods with metrics in the last committed batch, for the namespaces with the most pods, and the rest together as \"" + OtherNamespaces + "\"",
+		},
+		[]string{"namespace"},
+	)
+	trackedPodsAllNamespaces = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "tracked_pods_all_namespaces",
+			Help:      "The number of pods with metrics in the last committed batch, across all namespaces",
+		},
+	)
+	trackedPodsDivergence = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "tracked_pods_divergence",
+			Help:      "The number of running pods assigned to nodes, minus the number of pods with metrics, as of the last committed batch, for the most divergent namespaces, and the rest together as \"" + OtherNamespaces + "\"",
+		},
+		[]string{"namespace"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(trackedPods)
+	prometheus.MustRegister(trackedPodsAllNamespaces)
+	prometheus.MustRegister(trackedPodsDivergence)
+}
+
+// NamespaceCount is the number of pods tracked in a namespace, alongside the
+// number expected from the pod informer.
+type NamespaceCount struct {
+	Namespace string `json:"namespace"`
+	Tracked   int    `json:"tracked"`
+	// Expected and Divergence are only set when the expected counts are known.
+	Expected   *int `json:"expected,omitempty"`
+	Divergence *int `json:"divergence,omitempty"`
+}
+
+// Status is the exact per-namespace pod counts as of the last committed batch.
+type Status struct {
+	Committed time.Time        `json:"committed"`
+	Tracked   int              `json:"tracked"`
+	Expected  *int             `json:"expected,omitempty"`
+	Counts    []NamespaceCount `json:"namespaces"`
+}
+
+// Tracker publishes the per-namespace pod counts of each committed batch, along with
+// how much they diverge from the pods the scheduler has assigned to nodes.  It also
+// serves as an http.Handler for the pod-counts debug endpoint.
+type Tracker struct {
+	topN int
+	pods v1listers.PodLister
+
+	mu     sync.RWMutex
+	status Status
+}
+
+var _ sink.PodCountObserver = &Tracker{}
+
+// NewTracker returns a tracker giving the top N namespaces their own series.
+// The expected counts are taken from the given pod lister, and aren't computed
+// if it's nil (e.g. when only some of the nodes are scraped).
+func NewTracker(topN int, pods v1listers.PodLister) *Tracker {
+	return &Tracker{topN: topN, pods: pods}
+}
+
+// PodsCommitted publishes the pod counts of the batch just committed.
+func (t *Tracker) PodsCommitted(tracked map[string]int) {
+	status := Status{Committed: time.Now()}
+
+	var expected map[string]int
+	if t.pods != nil {
+		var err error
+		if expected, err = t.expectedCounts(); err != nil {
+			glog.Errorf("unable to count the pods scheduled in each namespace: %v", err)
+			expected = nil
+		}
+	}
+
+	namespaces := make(map[string]struct{}, len(tracked))
+	for ns, count := range tracked {
+		namespaces[ns] = struct{}{}
+		status.Tracked += count
+	}
+	if expected != nil {
+		total := 0
+		for ns, count := range expected {
+			namespaces[ns] = struct{}{}
+			total += count
+		}
+		status.Expected = &total
+	}
+	for ns := range namespaces {
+		count := NamespaceCount{Namespace: ns, Tracked: tracked[ns]}
+		if expected != nil {
+			expectedCount, divergence := expected[ns], expected[ns]-tracked[ns]
+			count.Expected, count.Divergence = &expectedCount, &divergence
+		}
+		status.Counts = append(status.Counts, count)
+	}
+	sort.Slice(status.Counts, func(i, j int) bool { return status.Counts[i].Namespace < status.Counts[j].Namespace })
+
+	t.publish(status)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status = status
+}
+
+// expectedCounts counts the pods assigned to nodes which haven't terminated,
+// which are those a Kubelet should be reporting, in each namespace.
+func (t *Tracker) expectedCounts() (map[string]int, error) {
+	pods, err := t.pods.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		counts[pod.Namespace]++
+	}
+	return counts, nil
+}
+
+// publish sets the gauges from the given status, bounding their cardinality to the top N namespaces.
+func (t *Tracker) publish(status Status) {
+	trackedPodsAllNamespaces.Set(float64(status.Tracked))
+
+	trackedPods.Reset()
+	for ns, count := range t.bucket(status.Counts, func(count NamespaceCount) int { return count.Tracked }) {
+		trackedPods.WithLabelValues(ns).Set(float64(count))
+	}
+
+	trackedPodsDivergence.Reset()
+	if status.Expected == nil {
+		return
+	}
+	divergence := func(count NamespaceCount) int { return *count.Divergence }
+	for ns, count := range t.bucket(status.Counts, divergence) {
+		trackedPodsDivergence.WithLabelValues(ns).Set(float64(count))
+	}
+}
+
+// bucket returns the given value of each of the top N namespaces (by magnitude), with
+// the values of the remaining namespaces summed into the OtherNamespaces bucket, if any.
+func (t *Tracker) bucket(counts []NamespaceCount, value func(NamespaceCount) int) map[string]int {
+	ranked := make([]NamespaceCount, len(counts))
+	copy(ranked, counts)
+	sort.SliceStable(ranked, func(i, j int) bool { return abs(value(ranked[i])) > abs(value(ranked[j])) })
+
+	res := make(map[string]int, t.topN+1)
+	for i, count := range ranked {
+		if i < t.topN {
+			res[count.Namespace] = value(count)
+			continue
+		}
+		res[OtherNamespaces] += value(count)
+	}
+	return res
+}
+
+func abs(val int) int {
+	if val < 0 {
+		return -val
+	}
+	return val
+}
+
+// Status returns the exact counts as of the last committed batch.
+func (t *Tracker) Status() Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.status
+}
+
+// ServeHTTP serves the exact counts as of the last committed batch as JSON.
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.Status()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podcount_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/podcount"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestPodCount(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pod Count Suite")
+}
+
+// gaugeValues fetches the values of the given gauge from the default registry, by namespace label.
+func gaugeValues(name string) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	res := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			ns := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "namespace" {
+					ns = label.GetValue()
+				}
+			}
+			res[ns] = metric.GetGauge().GetValue()
+		}
+	}
+	return res
+}
+
+// scheduledPods holds the given number of running pods in each namespace, named pod0...podN.
+func scheduledPods(indexer cache.Indexer, counts map[string]int) {
+	for ns, count := range counts {
+		for i := 0; i < count; i++ {
+			Expect(indexer.Add(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod%d", i), Namespace: ns},
+				Spec:       corev1.PodSpec{NodeName: "node1"},
+				Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+			})).To(Succeed())
+		}
+	}
+}
+
+// batchOf returns a batch with metrics for the given number of pods in each namespace, named pod0...podN.
+func batchOf(counts map[string]int) *sources.MetricsBatch {
+	batch := &sources.MetricsBatch{}
+	for ns, count := range counts {
+		for i := 0; i < count; i++ {
+			batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: fmt.Sprintf("pod%d", i), Namespace: ns})
+		}
+	}
+	return batch
+}
+
+var _ = Describe("Pod count tracker", func() {
+	var (
+		indexer    cache.Indexer
+		metricSink sink.MetricSink
+		tracker    *Tracker
+	)
+
+	BeforeEach(func() {
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		scheduledPods(indexer, map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1})
+
+		metricSink, _ = provsink.NewSinkProvider()
+		tracker = NewTracker(2, v1listers.NewPodLister(indexer))
+		metricSink.(sink.PodCountingSink).ObservePodCounts(tracker)
+	})
+
+	It("should publish the tracked pods of the top namespaces, and the rest together", func() {
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1}))).To(Succeed())
+
+		Expect(gaugeValues("metrics_server_storage_tracked_pods")).To(Equal(map[string]float64{
+			"ns1": 5, "ns2": 3, OtherNamespaces: 3,
+		}))
+		Expect(gaugeValues("metrics_server_storage_tracked_pods_all_namespaces")).To(Equal(map[string]float64{"": 11}))
+	})
+
+	It("should report no divergence when every scheduled pod is tracked", func() {
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1}))).To(Succeed())
+
+		for ns, divergence := range gaugeValues("metrics_server_storage_tracked_pods_divergence") {
+			Expect(divergence).To(BeZero(), "divergence for %s", ns)
+		}
+	})
+
+	It("should report the divergence of the namespaces affected by a scrape gap", func() {
+		By("committing a batch missing some pods in ns1 and all of ns3")
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 2, "ns2": 3, "ns4": 1}))).To(Succeed())
+
+		Expect(gaugeValues("metrics_server_storage_tracked_pods_divergence")).To(Equal(map[string]float64{
+			"ns1": 3, "ns3": 2, OtherNamespaces: 0,
+		}))
+
+		By("verifying the exact counts")
+		status := tracker.Status()
+		Expect(status.Tracked).To(Equal(6))
+		Expect(*status.Expected).To(Equal(11))
+		Expect(status.Counts).To(HaveLen(4))
+		Expect(status.Counts[2].Namespace).To(Equal("ns3"))
+		Expect(status.Counts[2].Tracked).To(BeZero())
+		Expect(*status.Counts[2].Expected).To(Equal(2))
+		Expect(*status.Counts[2].Divergence).To(Equal(2))
+
+		By("clearing the divergence once the gap closes")
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1}))).To(Succeed())
+		Expect(gaugeValues("metrics_server_storage_tracked_pods_divergence")).NotTo(HaveKeyWithValue("ns1", BeNumerically(">", 0)))
+		Expect(*tracker.Status().Counts[0].Divergence).To(BeZero())
+	})
+
+	It("should report negative divergence for pods tracked but no longer scheduled", func() {
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1, "gone": 4}))).To(Succeed())
+
+		Expect(gaugeValues("metrics_server_storage_tracked_pods_divergence")).To(HaveKeyWithValue("gone", float64(-4)))
+	})
+
+	It("should only expect pods assigned to nodes which haven't terminated", func() {
+		Expect(indexer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "unscheduled", Namespace: "ns1"}})).To(Succeed())
+		Expect(indexer.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "done", Namespace: "ns1"},
+			Spec:       corev1.PodSpec{NodeName: "node1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+		})).To(Succeed())
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 5, "ns2": 3, "ns3": 2, "ns4": 1}))).To(Succeed())
+
+		Expect(*tracker.Status().Expected).To(Equal(11))
+	})
+
+	It("should serve the exact counts of every namespace", func() {
+		Expect(metricSink.Receive(batchOf(map[string]int{"ns1": 4, "ns2": 3, "ns3": 2, "ns4": 1}))).To(Succeed())
+
+		recorder := httptest.NewRecorder()
+		tracker.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/pod-counts", nil))
+		var status Status
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(Succeed())
+		Expect(status.Counts).To(HaveLen(4))
+		Expect(status.Counts[0].Namespace).To(Equal("ns1"))
+		Expect(status.Counts[0].Tracked).To(Equal(4))
+		Expect(*status.Counts[0].Divergence).To(Equal(1))
+		Expect(status.Counts[3].Namespace).To(Equal("ns4"))
+	})
+
+	It("should not compute the divergence without a pod lister", func() {
+		tracker := NewTracker(2, nil)
+		tracker.PodsCommitted(map[string]int{"ns1": 3})
+
+		Expect(tracker.Status().Expected).To(BeNil())
+		Expect(tracker.Status().Counts[0].Divergence).To(BeNil())
+		Expect(gaugeValues("metrics_server_storage_tracked_pods_divergence")).To(BeEmpty())
+	})
+})
@@ -0,0 +1,197 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package podcoverage tracks the fraction of running pods with fresh metrics in each committed
+// batch, the single number behind "some pods are missing metrics", and acts as a health check
+// failing while it's systematically below a minimum.
+package podcoverage
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+var (
+	completenessRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "pod_metrics_completeness_ratio",
+			Help:      "The fraction of the running pods expected to have metrics with fresh metrics in the last committed batch",
+		},
+	)
+	completeness = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "pod_metrics_completeness",
+			Help:      "The fraction of the running pods expected to have metrics with fresh metrics in each committed batch",
+			Buckets:   []float64{0.5, 0.7, 0.8, 0.9, 0.95, 0.99, 1},
+		},
+	)
+	podsMissing = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "running_pods_missing_metrics",
+			Help:      "The number of running pods expected to have metrics without fresh metrics in the last committed batch",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(completenessRatio)
+	prometheus.MustRegister(completeness)
+	prometheus.MustRegister(podsMissing)
+}
+
+// Config configures a Tracker.
+type Config struct {
+	// Pods lists the pods expected to have metrics.
+	Pods v1listers.PodLister
+	// Nodes looks up the nodes pods run on, for the NodeFilter.
+	Nodes v1listers.NodeLister
+	// NodeFilter, if non-nil, selects the nodes scraped, with pods on other nodes not expected
+	// to have metrics.
+	NodeFilter sources.NodeFilter
+	// Namespaces, if non-nil, restricts the pods expected to have metrics to those in the
+	// namespaces whose pods' metrics are stored.
+	Namespaces *provider.NamespaceAllowlist
+	// MaxAge is how old a pod's metrics may be when committed to still count as fresh.
+	MaxAge time.Duration
+	// Min is the fraction of pods with fresh metrics below which the health check fails,
+	// or never if it's zero.
+	Min float64
+}
+
+// Completeness is how many of the pods expected to have metrics have fresh metrics.
+type Completeness struct {
+	// Pods is the number of running pods expected to have metrics.
+	Pods int
+	// Fresh is the number of them with fresh metrics.
+	Fresh int
+}
+
+// Ratio is the fraction of the pods with fresh metrics, with no pods counting as complete.
+func (c Completeness) Ratio() float64 {
+	if c.Pods == 0 {
+		return 1
+	}
+	return float64(c.Fresh) / float64(c.Pods)
+}
+
+// Tracker publishes the pod metrics completeness of each committed batch.
+type Tracker struct {
+	config Config
+
+	mu           sync.RWMutex
+	committed    bool
+	completeness Completeness
+}
+
+var _ sink.PodTimestampObserver = &Tracker{}
+
+// NewTracker returns a tracker with the given config.
+func NewTracker(config Config) *Tracker {
+	return &Tracker{config: config}
+}
+
+// PodTimestampsCommitted publishes the pod metrics completeness of the batch just committed.
+func (t *Tracker) PodTimestampsCommitted(timestamps map[apitypes.NamespacedName]time.Time) {
+	pods, err := t.config.Pods.List(labels.Everything())
+	if err != nil {
+		glog.Errorf("unable to list pods to compute the fraction with metrics: %v", err)
+		return
+	}
+
+	now := time.Now()
+	var res Completeness
+	for _, pod := range pods {
+		if !t.expected(pod) {
+			continue
+		}
+		res.Pods++
+		if ts, ok := timestamps[apitypes.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]; ok && now.Sub(ts) <= t.config.MaxAge {
+			res.Fresh++
+		}
+	}
+
+	ratio := res.Ratio()
+	completenessRatio.Set(ratio)
+	completeness.Observe(ratio)
+	podsMissing.Set(float64(res.Pods - res.Fresh))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.committed = true
+	t.completeness = res
+}
+
+// expected checks if the given pod is expected to have metrics: running on a node which
+// is scraped, in a namespace whose pods' metrics are stored.
+func (t *Tracker) expected(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.Spec.NodeName == "" {
+		return false
+	}
+	if !t.config.Namespaces.Allows(pod.Namespace) {
+		return false
+	}
+	if t.config.NodeFilter == nil {
+		return true
+	}
+	node, err := t.config.Nodes.Get(pod.Spec.NodeName)
+	if err != nil {
+		// the node is either gone or not yet known to the informer, so isn't scraped either
+		return false
+	}
+	return t.config.NodeFilter(node)
+}
+
+// Completeness returns the pod metrics completeness of the last committed batch, and
+// whether a batch has been committed yet.
+func (t *Tracker) Completeness() (Completeness, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.completeness, t.committed
+}
+
+// Check fails if the pod metrics completeness of the last committed batch is below the
+// minimum.  It passes until the first batch is committed, so that it doesn't fail during
+// startup.  It implements the health checker func part of the healthz checker.
+func (t *Tracker) Check(_ *http.Request) error {
+	if t.config.Min == 0 {
+		return nil
+	}
+	res, committed := t.Completeness()
+	if !committed {
+		return nil
+	}
+	if ratio := res.Ratio(); ratio < t.config.Min {
+		return fmt.Errorf("only %d of %d running pods (%.1f%%) have fresh metrics, below the minimum of %.1f%%", res.Fresh, res.Pods, ratio*100, t.config.Min*100)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podcoverage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/podcoverage"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestPodCoverage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Pod Metrics Completeness Suite")
+}
+
+// metric fetches the named metric from the default registry.
+func metric(name string) *dto.Metric {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0]
+		}
+	}
+	Fail("no metric named " + name)
+	return nil
+}
+
+// addPods adds the given number of pods in the given phase and namespace on the given node, named prefix-0...prefix-N.
+func addPods(indexer cache.Indexer, namespace, prefix, node string, phase corev1.PodPhase, count int) {
+	for i := 0; i < count; i++ {
+		Expect(indexer.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", prefix, i), Namespace: namespace},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: phase},
+		})).To(Succeed())
+	}
+}
+
+// batchWith returns a batch with metrics for the given pods (as namespace/name), measured at the given time.
+func batchWith(ts time.Time, pods ...[2]string) *sources.MetricsBatch {
+	batch := &sources.MetricsBatch{}
+	for _, pod := range pods {
+		batch.Pods = append(batch.Pods, sources.PodMetricsPoint{
+			Namespace:  pod[0],
+			Name:       pod[1],
+			Containers: []sources.ContainerMetricsPoint{{Name: "app", MetricsPoint: sources.MetricsPoint{Timestamp: ts}}},
+		})
+	}
+	return batch
+}
+
+var _ = Describe("Pod Metrics Completeness Tracker", func() {
+	var (
+		pods       cache.Indexer
+		nodes      cache.Indexer
+		metricSink sink.MetricSink
+	)
+
+	BeforeEach(func() {
+		pods = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		addPods(pods, "ns1", "web", "node1", corev1.PodRunning, 8)
+		addPods(pods, "ns1", "job", "node1", corev1.PodSucceeded, 3)
+		addPods(pods, "ns2", "db", "node2", corev1.PodRunning, 2)
+		nodes = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		for _, name := range []string{"node1", "node2"} {
+			Expect(nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})).To(Succeed())
+		}
+		metricSink, _ = provsink.NewSinkProvider()
+	})
+
+	track := func(config Config) *Tracker {
+		config.Pods = v1listers.NewPodLister(pods)
+		config.Nodes = v1listers.NewNodeLister(nodes)
+		config.MaxAge = 2 * time.Minute
+		tracker := NewTracker(config)
+		metricSink.(sink.PodObservingSink).ObservePods(tracker)
+		return tracker
+	}
+
+	It("should count the running pods with fresh metrics, exporting the ratio of each cycle", func() {
+		tracker := track(Config{})
+		before := metric("metrics_server_storage_pod_metrics_completeness").GetHistogram().GetSampleCount()
+
+		// of the 10 running pods, web-0 is stale, web-1 and db-1 are missing, and finished pods don't count
+		now := time.Now()
+		batch := batchWith(now, [2]string{"ns1", "web-2"}, [2]string{"ns1", "web-3"}, [2]string{"ns1", "web-4"}, [2]string{"ns1", "web-5"},
+			[2]string{"ns1", "web-6"}, [2]string{"ns1", "web-7"}, [2]string{"ns1", "job-0"}, [2]string{"ns2", "db-0"})
+		batch.Pods = append(batch.Pods, batchWith(now.Add(-5*time.Minute), [2]string{"ns1", "web-0"}).Pods...)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		res, committed := tracker.Completeness()
+		Expect(committed).To(BeTrue())
+		Expect(res).To(Equal(Completeness{Pods: 10, Fresh: 7}))
+		Expect(res.Ratio()).To(BeNumerically("~", 0.7, 1e-9))
+		Expect(metric("metrics_server_storage_pod_metrics_completeness_ratio").GetGauge().GetValue()).To(BeNumerically("~", 0.7, 1e-9))
+		Expect(metric("metrics_server_storage_running_pods_missing_metrics").GetGauge().GetValue()).To(BeNumerically("==", 3))
+
+		By("observing every cycle's ratio in the histogram")
+		Expect(metricSink.Receive(batchWith(now, [2]string{"ns1", "web-0"}))).To(Succeed())
+		histogram := metric("metrics_server_storage_pod_metrics_completeness").GetHistogram()
+		Expect(histogram.GetSampleCount() - before).To(BeNumerically("==", 2))
+		res, _ = tracker.Completeness()
+		Expect(res).To(Equal(Completeness{Pods: 10, Fresh: 1}))
+	})
+
+	It("should leave pods excluded by configuration out of the total", func() {
+		tracker := track(Config{
+			Namespaces: provider.NewNamespaceAllowlist([]string{"ns1"}, nil, nil),
+			NodeFilter: func(node *corev1.Node) bool { return node.Name != "node2" },
+		})
+		Expect(pods.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "ns1"},
+			Spec:       corev1.PodSpec{NodeName: "node2"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		})).To(Succeed())
+
+		Expect(metricSink.Receive(batchWith(time.Now(), [2]string{"ns1", "web-0"}, [2]string{"ns1", "web-1"}))).To(Succeed())
+		res, _ := tracker.Completeness()
+		Expect(res).To(Equal(Completeness{Pods: 8, Fresh: 2}))
+	})
+
+	It("should fail the health check while the ratio is below the minimum", func() {
+		tracker := track(Config{Min: 0.75})
+
+		By("passing until the first batch is committed")
+		Expect(tracker.Check(nil)).To(Succeed())
+
+		// systematically missing 30% of the pods
+		now := time.Now()
+		batch := batchWith(now, [2]string{"ns1", "web-0"}, [2]string{"ns1", "web-1"}, [2]string{"ns1", "web-2"}, [2]string{"ns1", "web-3"},
+			[2]string{"ns1", "web-4"}, [2]string{"ns1", "web-5"}, [2]string{"ns1", "web-6"})
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		err := tracker.Check(nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("only 7 of 10 running pods (70.0%) have fresh metrics"))
+
+		By("passing again once enough pods have fresh metrics")
+		batch.Pods = append(batch.Pods, batchWith(now, [2]string{"ns1", "web-7"}).Pods...)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		Expect(tracker.Check(nil)).To(Succeed())
+
+		By("never failing without a minimum")
+		Expect(track(Config{}).Check(nil)).To(Succeed())
+	})
+})
@@ -0,0 +1,242 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package preflight checks that metrics-server can fetch summaries from the Kubelets before it
+// starts serving, by sampling a few nodes and fetching each one's summary, so that a missing
+// permission or a blocked Kubelet port is reported clearly at startup, rather than discovered
+// later from an empty metrics API.
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+const (
+	// DefaultNodes is the default number of nodes sampled.
+	DefaultNodes = 3
+	// DefaultTimeout is the default bound on how long the checks may take, and so on
+	// how long they may delay startup.
+	DefaultTimeout = 15 * time.Second
+)
+
+// Mode controls what happens when the checks fail.
+type Mode string
+
+const (
+	// ModeStrict fails startup, with a report of the failures, if any sampled node fails.
+	ModeStrict Mode = "strict"
+	// ModeWarn logs a report of the failures, but starts anyway.
+	ModeWarn Mode = "warn"
+	// ModeOff skips the checks.
+	ModeOff Mode = "off"
+)
+
+// Options configures the checks.
+type Options struct {
+	Mode Mode
+	// Nodes is the number of nodes to sample.
+	Nodes int
+	// Timeout bounds how long the checks take, after which any still in progress fail.
+	Timeout time.Duration
+	// NodeFilter, if non-nil, restricts the nodes sampled to those it accepts
+	// (e.g. those this replica scrapes).
+	NodeFilter sources.NodeFilter
+	// AddressFallback, if true, falls back through each node's candidate addresses, as scrapes
+	// do with it enabled, when the address resolver lists several.
+	AddressFallback bool
+}
+
+// Result is the result of checking a single node.
+type Result struct {
+	Node string
+	// Address is the address the summary was fetched from, or the last one tried.
+	Address  string
+	Duration time.Duration
+	// Err is why the check failed, if it did.
+	Err error
+	// Class classifies Err, as scrape errors are classified in logs and metrics.
+	Class string
+	// Remediation suggests how to fix Err, if it's of a class with a known fix.
+	Remediation string
+}
+
+// Report describes the results of the checks.
+type Report struct {
+	// Total is the number of nodes that could have been sampled.
+	Total   int
+	Results []Result
+}
+
+// Failed returns the results of the checks that failed.
+func (r *Report) Failed() []Result {
+	var failed []Result
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// String describes the report in detail, grouping the failures by class, so that a
+// misconfiguration affecting every node reads as one problem, with one remediation.
+func (r *Report) String() string {
+	failed := r.Failed()
+	var b strings.Builder
+	fmt.Fprintf(&b, "checked %d of %d ready node(s): %d succeeded, %d failed", len(r.Results), r.Total, len(r.Results)-len(failed), len(failed))
+
+	byClass := make(map[string][]Result)
+	for _, res := range failed {
+		byClass[res.Class] = append(byClass[res.Class], res)
+	}
+	classes := make([]string, 0, len(byClass))
+	for class := range byClass {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		results := byClass[class]
+		fmt.Fprintf(&b, "\n  %s (%d node(s)):", class, len(results))
+		for _, res := range results {
+			fmt.Fprintf(&b, "\n    %s (%s, after %s): %v", res.Node, res.Address, res.Duration.Round(time.Millisecond), res.Err)
+		}
+		if remediation := results[0].Remediation; remediation != "" {
+			fmt.Fprintf(&b, "\n    remediation: %s", remediation)
+		}
+	}
+	return b.String()
+}
+
+// ErrFailed is returned in strict mode when any sampled node fails its check.
+type ErrFailed struct {
+	Report *Report
+}
+
+func (err *ErrFailed) Error() string {
+	return fmt.Sprintf("preflight checks of Kubelet connectivity failed (set --preflight=warn to start anyway): %s", err.Report)
+}
+
+// Run checks the given mode's sample of the ready nodes, fetching each one's summary with the
+// given client, concurrently, all within the timeout.  In strict mode, it returns an ErrFailed
+// if any fail; otherwise failures are only logged.  The report is nil if the checks were skipped.
+func Run(ctx context.Context, nodeLister v1listers.NodeLister, addrResolver summary.NodeAddressResolver, client summary.KubeletInterface, opts Options) (*Report, error) {
+	if opts.Mode == ModeOff {
+		return nil, nil
+	}
+
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes for preflight checks: %v", err)
+	}
+	var candidates []*corev1.Node
+	for _, node := range nodes {
+		if nodeReady(node) && (opts.NodeFilter == nil || opts.NodeFilter(node)) {
+			candidates = append(candidates, node)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sampled := candidates
+	if len(sampled) > opts.Nodes {
+		sampled = sampled[:opts.Nodes]
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, opts.Timeout, &sources.ErrCanceled{
+		Reason: sources.CancelReasonTimeout,
+		Detail: fmt.Sprintf("the preflight timeout of %s was reached", opts.Timeout),
+	})
+	defer cancel()
+
+	report := &Report{Total: len(candidates), Results: make([]Result, len(sampled))}
+	var wg sync.WaitGroup
+	for i, node := range sampled {
+		wg.Add(1)
+		go func(res *Result, node *corev1.Node) {
+			defer wg.Done()
+			*res = check(ctx, addrResolver, client, node, opts.AddressFallback)
+		}(&report.Results[i], node)
+	}
+	wg.Wait()
+
+	if len(report.Failed()) == 0 {
+		glog.Infof("Preflight checks of Kubelet connectivity passed: %s", report)
+		return report, nil
+	}
+	if opts.Mode == ModeStrict {
+		return report, &ErrFailed{Report: report}
+	}
+	glog.Warningf("Preflight checks of Kubelet connectivity failed, starting anyway: %s", report)
+	return report, nil
+}
+
+// check fetches the summary of a single node, falling back through its candidate
+// addresses, if enabled, just like it's scraped.
+func check(ctx context.Context, addrResolver summary.NodeAddressResolver, client summary.KubeletInterface, node *corev1.Node, fallback bool) Result {
+	res := Result{Node: node.Name}
+	start := time.Now()
+	ctx = summary.WithNodeName(ctx, node.Name)
+	fetch := func(ctx context.Context, addr string) error {
+		_, _, err := client.GetSummary(ctx, addr)
+		return err
+	}
+	var candidates []string
+	addr, err := addrResolver.NodeAddress(node)
+	if resolver, ok := addrResolver.(summary.CandidateNodeAddressResolver); ok && fallback && err == nil {
+		candidates, err = resolver.NodeAddresses(node)
+	}
+	if err == nil {
+		if len(candidates) > 1 {
+			res.Address, err = summary.FetchFromCandidates(ctx, node.Name, candidates, fetch)
+		} else {
+			res.Address, err = addr, fetch(ctx, addr)
+		}
+	}
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Err = err
+		res.Class = summary.ErrorClass(err)
+		var classified sources.ClassifiedError
+		if errors.As(err, &classified) {
+			res.Remediation = classified.Remediation()
+		}
+	}
+	return res
+}
+
+// nodeReady checks whether the given node's Ready condition is true, since nodes that
+// aren't ready aren't expected to have reachable Kubelets.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preflight_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/fakefleet"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/preflight"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+func TestPreflight(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Preflight Suite")
+}
+
+var _ = Describe("Preflight checks", func() {
+	var (
+		fleet  *fakefleet.Fleet
+		client summary.KubeletInterface
+		opts   Options
+	)
+
+	BeforeEach(func() {
+		var err error
+		// a partially broken fleet: one node unreachable, one forbidden, one hanging, and two healthy
+		fleet, err = fakefleet.New(fakefleet.Config{
+			Nodes:       5,
+			PodsPerNode: 2,
+			Seed:        1,
+			Failures: map[string]fakefleet.Failure{
+				"fake-node-0": fakefleet.FailureUnreachable,
+				"fake-node-1": fakefleet.FailureForbidden,
+				"fake-node-2": fakefleet.FailureHang,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		client, err = summary.KubeletClientFor(&summary.KubeletClientConfig{
+			Port: 10250,
+			RESTConfig: &rest.Config{
+				Host: "https://localhost:6443",
+				TLSClientConfig: rest.TLSClientConfig{
+					CAData:     fleet.CAData(),
+					ServerName: fakefleet.ServerName,
+				},
+			},
+			Dial: fleet.Dial,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		opts = Options{Nodes: 5, Timeout: 500 * time.Millisecond}
+	})
+
+	AfterEach(func() {
+		fleet.Close()
+	})
+
+	run := func() (*Report, error) {
+		return Run(context.Background(), fleet.NodeLister(), summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority), client, opts)
+	}
+
+	// classes returns the class of each sampled node's result, by node.
+	classes := func(report *Report) map[string]string {
+		res := make(map[string]string)
+		for _, result := range report.Results {
+			res[result.Node] = result.Class
+		}
+		return res
+	}
+
+	It("should fail in strict mode with a report classifying each failure, within the timeout", func() {
+		opts.Mode = ModeStrict
+		start := time.Now()
+		report, err := run()
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+
+		Expect(err).To(HaveOccurred())
+		Expect(err).To(BeAssignableToTypeOf(&ErrFailed{}))
+		Expect(classes(report)).To(Equal(map[string]string{
+			"fake-node-0": summary.ErrorClassDial,
+			"fake-node-1": summary.ErrorClassForbidden,
+			"fake-node-2": "timeout",
+			"fake-node-3": "",
+			"fake-node-4": "",
+		}))
+		Expect(report.Failed()).To(HaveLen(3))
+
+		By("reporting each class of failure with its remediation")
+		Expect(err.Error()).To(ContainSubstring("checked 5 of 5 ready node(s): 2 succeeded, 3 failed"))
+		Expect(err.Error()).To(ContainSubstring("forbidden (1 node(s)):\n    fake-node-1 (10.0.0.1"))
+		Expect(err.Error()).To(ContainSubstring("system:kubelet-api-admin"))
+		Expect(err.Error()).To(ContainSubstring("the preflight timeout of 500ms was reached"))
+	})
+
+	It("should only warn in warn mode, returning the same report", func() {
+		opts.Mode = ModeWarn
+		report, err := run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Failed()).To(HaveLen(3))
+		Expect(classes(report)).To(HaveKeyWithValue("fake-node-1", summary.ErrorClassForbidden))
+	})
+
+	It("should skip the checks entirely when off", func() {
+		opts.Mode = ModeOff
+		report, err := run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report).To(BeNil())
+		Expect(fleet.Stats().Requests).To(BeZero())
+	})
+
+	It("should sample only the configured number of ready nodes accepted by the filter", func() {
+		opts.Mode = ModeStrict
+		opts.Nodes = 1
+		opts.NodeFilter = func(node *corev1.Node) bool {
+			return node.Name == "fake-node-3" || node.Name == "fake-node-4"
+		}
+		report, err := run()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Total).To(Equal(2))
+		Expect(report.Results).To(HaveLen(1))
+		Expect(fleet.Stats().Requests).To(BeEquivalentTo(1))
+	})
+
+	It("should fall back through the candidate addresses of each node, when enabled, just like scrapes", func() {
+		By("preferring an unreachable address of one healthy node")
+		node, err := fleet.NodeLister().Get("fake-node-3")
+		Expect(err).NotTo(HaveOccurred())
+		reachable := node.Status.Addresses[0].Address
+		node = node.DeepCopy()
+		node.Status.Addresses = append([]corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.0.2.1"}}, node.Status.Addresses...)
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		Expect(indexer.Add(node)).To(Succeed())
+		lister := v1listers.NewNodeLister(indexer)
+		resolver := summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority)
+		opts.Mode = ModeStrict
+
+		report, err := Run(context.Background(), lister, resolver, client, opts)
+		Expect(err).To(HaveOccurred())
+		Expect(classes(report)).To(Equal(map[string]string{"fake-node-3": summary.ErrorClassDial}))
+
+		opts.AddressFallback = true
+		report, err = Run(context.Background(), lister, resolver, client, opts)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Results).To(HaveLen(1))
+		Expect(report.Results[0].Address).To(Equal(reachable))
+	})
+})
@@ -0,0 +1,72 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package priority
+
+import (
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// DefaultNamespaces is the default list of priority namespaces.
+var DefaultNamespaces = []string{"kube-system"}
+
+// Namespaces knows which namespaces contain priority workloads (such as
+// control plane components), whose metrics should never be dropped in order
+// to shed load.
+type Namespaces interface {
+	// IsPriority checks if the given namespace is a priority namespace.
+	IsPriority(namespace string) bool
+}
+
+type staticAndSelectorNamespaces struct {
+	names    map[string]struct{}
+	selector labels.Selector
+	lister   v1listers.NamespaceLister
+}
+
+func (n *staticAndSelectorNamespaces) IsPriority(namespace string) bool {
+	if _, isListed := n.names[namespace]; isListed {
+		return true
+	}
+	if n.selector == nil || n.selector.Empty() || n.lister == nil {
+		return false
+	}
+
+	ns, err := n.lister.Get(namespace)
+	if err != nil {
+		// the namespace is either gone or not yet known to the informer,
+		// so assume it's not a priority namespace
+		return false
+	}
+	return n.selector.Matches(labels.Set(ns.Labels))
+}
+
+// NewNamespaces returns a set of priority namespaces consisting of the
+// given namespace names, plus any namespaces (as found by the given lister)
+// whose labels match the given selector.  The selector and lister may be nil.
+func NewNamespaces(names []string, selector labels.Selector, lister v1listers.NamespaceLister) Namespaces {
+	nameSet := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		nameSet[name] = struct{}{}
+	}
+	return &staticAndSelectorNamespaces{
+		names:    nameSet,
+		selector: selector,
+		lister:   lister,
+	}
+}
+
+// None is a set of priority namespaces that contains no namespaces.
+var None Namespaces = NewNamespaces(nil, nil, nil)
@@ -0,0 +1,104 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package priority_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/priority"
+)
+
+func TestPriority(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Priority Namespaces Suite")
+}
+
+type fakeNamespaceLister struct {
+	namespaces []*corev1.Namespace
+}
+
+func (l *fakeNamespaceLister) List(selector labels.Selector) ([]*corev1.Namespace, error) {
+	var res []*corev1.Namespace
+	for _, ns := range l.namespaces {
+		if selector.Matches(labels.Set(ns.Labels)) {
+			res = append(res, ns)
+		}
+	}
+	return res, nil
+}
+
+func (l *fakeNamespaceLister) Get(name string) (*corev1.Namespace, error) {
+	for _, ns := range l.namespaces {
+		if ns.Name == name {
+			return ns, nil
+		}
+	}
+	return nil, fmt.Errorf("no such namespace %q", name)
+}
+
+var _ v1listers.NamespaceLister = &fakeNamespaceLister{}
+
+var _ = Describe("Priority Namespaces", func() {
+	var lister *fakeNamespaceLister
+
+	BeforeEach(func() {
+		lister = &fakeNamespaceLister{
+			namespaces: []*corev1.Namespace{
+				{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "monitoring", Labels: map[string]string{"critical": "true"}}},
+				{ObjectMeta: metav1.ObjectMeta{Name: "batch", Labels: map[string]string{"critical": "false"}}},
+			},
+		}
+	})
+
+	It("should consider explicitly listed namespaces to be priority namespaces", func() {
+		prio := NewNamespaces(DefaultNamespaces, nil, nil)
+		Expect(prio.IsPriority("kube-system")).To(BeTrue())
+		Expect(prio.IsPriority("monitoring")).To(BeFalse())
+	})
+
+	It("should consider namespaces matching the selector to be priority namespaces", func() {
+		selector, err := labels.Parse("critical=true")
+		Expect(err).NotTo(HaveOccurred())
+		prio := NewNamespaces(DefaultNamespaces, selector, lister)
+
+		Expect(prio.IsPriority("kube-system")).To(BeTrue())
+		Expect(prio.IsPriority("monitoring")).To(BeTrue())
+		Expect(prio.IsPriority("batch")).To(BeFalse())
+		Expect(prio.IsPriority("unknown")).To(BeFalse())
+	})
+
+	It("should pick up label changes on namespaces", func() {
+		selector, err := labels.Parse("critical=true")
+		Expect(err).NotTo(HaveOccurred())
+		prio := NewNamespaces(nil, selector, lister)
+
+		Expect(prio.IsPriority("batch")).To(BeFalse())
+		lister.namespaces[2].Labels["critical"] = "true"
+		Expect(prio.IsPriority("batch")).To(BeTrue())
+	})
+
+	It("should not consider any namespace a priority namespace when using None", func() {
+		Expect(None.IsPriority("kube-system")).To(BeFalse())
+	})
+})
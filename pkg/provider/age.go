@@ -0,0 +1,35 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"time"
+)
+
+// SampleAgeAnnotation is set on each served NodeMetrics and PodMetrics to the age of its
+// sample (the time since its timestamp) when it was served, as a duration (e.g. "12.5s"),
+// so that tooling can show how fresh the metrics are without comparing clocks.
+const SampleAgeAnnotation = "metrics-server.kubernetes.io/sample-age"
+
+// SampleAgeAnnotations returns the annotations carrying the age, as of now,
+// of a sample taken at the given time.
+func SampleAgeAnnotations(now, timestamp time.Time) map[string]string {
+	age := now.Sub(timestamp)
+	if age < 0 {
+		// the Kubelet's clock is ahead of ours
+		age = 0
+	}
+	return map[string]string{SampleAgeAnnotation: age.Round(time.Millisecond).String()}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+// AvailabilityCheck checks if the metrics API can be served at the moment, returning the
+// error to serve instead (normally a 503 explaining why) if it can't.
+//
+// A nil AvailabilityCheck is always available.
+type AvailabilityCheck func() error
+
+// Check runs the availability check, if there is one.
+func (c AvailabilityCheck) Check() error {
+	if c == nil {
+		return nil
+	}
+	return c()
+}
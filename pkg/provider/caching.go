@@ -0,0 +1,160 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/metrics/pkg/apis/metrics"
+)
+
+// Node and pod metrics only change when a batch is committed, so responses serving them are
+// valid until the next commit, and are identified by the version of the snapshot they were
+// served from.  With caching headers enabled, successful gets and lists carry a Cache-Control
+// header whose max-age is the time until the next commit is expected, and a weak ETag derived
+// from the snapshot's resource version (weak, since the sample age annotations, and anything
+// taken from pod and node objects, may still differ between responses from the same snapshot).
+// Requests whose If-None-Match lists the current ETag get a 304 without anything being fetched
+// or serialized.  "If-None-Match: *" only matches what exists, so those requests are served, and
+// successful responses replaced by a 304, letting a 404 through.  Responses are private, since
+// what's served depends on who's asking.
+
+// WithCachingHeaders wraps the given handler, adding caching headers to the metrics API responses
+// it serves from the snapshot pinned for each request (pinning one of the given provider if none
+// is), and answering conditional requests for an unchanged snapshot with a 304.  The given function
+// estimates how long it is until the next batch is committed.  Conditional requests are only
+// answered while the given availability check passes and the provider's been populated, so that
+// clients see the errors served in the meantime.
+func WithCachingHeaders(handler http.Handler, snapshots SnapshotProvider, untilNextCommit func() time.Duration, available AvailabilityCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isMetricsRead(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		ctx := req.Context()
+		snapshot := SnapshotFrom(ctx)
+		if snapshot == nil {
+			snapshot = snapshots.Snapshot()
+			req = req.WithContext(WithSnapshot(ctx, snapshot))
+		}
+		version := ResourceVersionOf(snapshot)
+		if version == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		// requests for other versions fail, so only requests for the current one are cacheable
+		if requested := req.URL.Query().Get("resourceVersion"); requested != "" && requested != "0" && requested != version {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		etag := `W/"` + version + `"`
+		maxAge := int64(untilNextCommit() / time.Second)
+		setHeaders := func(header http.Header) {
+			header.Set("ETag", etag)
+			header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+			// JSON and protobuf responses differ
+			header.Add("Vary", "Accept")
+		}
+		cw := &cachingResponseWriter{ResponseWriter: w, setHeaders: setHeaders}
+		if matches, wildcard := matchesETag(req.Header.Get("If-None-Match"), etag); matches && available.Check() == nil && CheckPopulated(snapshots) == nil {
+			if !wildcard {
+				setHeaders(w.Header())
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// whether what's requested exists is only known once it's served
+			cw.notModified = true
+		}
+		handler.ServeHTTP(cw, req)
+	})
+}
+
+// isMetricsRead checks if the given request is a get or list of node or pod metrics
+// (as opposed to discovery of the metrics API, or anything else).
+func isMetricsRead(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if watch, _ := strconv.ParseBool(req.URL.Query().Get("watch")); watch {
+		return false
+	}
+	prefix := "/apis/" + metrics.GroupName + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		return false
+	}
+	// the path continues with the version, then the resource (or namespaces/<namespace>/pods)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, prefix), "/"), "/")
+	return len(parts) >= 2
+}
+
+// matchesETag checks if the given If-None-Match header lists the given ETag, using the weak
+// comparison that If-None-Match calls for, and if it only matches by being the wildcard, which
+// matches any ETag, but only of something that exists.
+func matchesETag(ifNoneMatch, etag string) (matches, wildcard bool) {
+	if ifNoneMatch == "" {
+		return false, false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true, false
+		}
+		if candidate == "*" {
+			wildcard = true
+		}
+	}
+	return wildcard, wildcard
+}
+
+// cachingResponseWriter adds the caching headers to successful responses only,
+// so that they're never set on errors.  If notModified is set, successful responses
+// are replaced by a 304, discarding their body.
+type cachingResponseWriter struct {
+	http.ResponseWriter
+	setHeaders  func(http.Header)
+	notModified bool
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *cachingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK {
+			w.setHeaders(w.Header())
+			if w.notModified {
+				w.Header().Del("Content-Length")
+				code, w.discard = http.StatusNotModified, true
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cachingResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,294 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultCompressionMinBytes is the default size of the smallest response compressed,
+// below which gzip's framing and CPU cost outweigh any savings.
+const DefaultCompressionMinBytes = 1024
+
+// The encodings metrics API responses are sent with.
+const (
+	EncodingGzip     = "gzip"
+	EncodingIdentity = "identity"
+)
+
+// The reasons metrics API responses were, or weren't, compressed.
+const (
+	// CompressionReasonCompressed is the reason for responses compressed.
+	CompressionReasonCompressed = "compressed"
+	// CompressionReasonBelowThreshold is the reason for responses under the minimum size compressed.
+	CompressionReasonBelowThreshold = "below_threshold"
+	// CompressionReasonNotAccepted is the reason for responses to clients not accepting
+	// gzip, or preferring identity (e.g. Accept-Encoding: identity, or gzip;q=0).
+	CompressionReasonNotAccepted = "not_accepted"
+	// CompressionReasonDisabled is the reason for responses while compression is disabled.
+	CompressionReasonDisabled = "disabled"
+)
+
+// The stages at which the bytes of compressed metrics API responses are counted.
+const (
+	// CompressionStageUncompressed counts the bytes before compression.
+	CompressionStageUncompressed = "uncompressed"
+	// CompressionStageCompressed counts the bytes once compressed, as sent.
+	CompressionStageCompressed = "compressed"
+)
+
+var (
+	apiResponsesByEncoding = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "responses_by_encoding_total",
+			Help:      "The number of responses to gets and lists of node and pod metrics, by the encoding they were sent with (gzip or identity) and why (compressed, below_threshold, not_accepted, or disabled)",
+		},
+		[]string{"encoding", "reason"},
+	)
+	apiCompressedResponseBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "compressed_response_bytes_total",
+			Help:      "The number of bytes of compressed responses to gets and lists of node and pod metrics, by the stage counted at (uncompressed, or compressed)",
+		},
+		[]string{"stage"},
+	)
+	apiCompressionSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "response_compression_seconds_total",
+			Help:      "The time spent compressing responses to gets and lists of node and pod metrics",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiResponsesByEncoding)
+	prometheus.MustRegister(apiCompressedResponseBytes)
+	prometheus.MustRegister(apiCompressionSeconds)
+}
+
+// ResponseCompression configures the compression of responses to gets and lists of node and pod metrics.
+type ResponseCompression struct {
+	// MinBytes is the size of the smallest response compressed.  Smaller responses aren't
+	// worth the CPU, so are sent uncompressed.  Negative disables compression entirely.
+	MinBytes int
+}
+
+// WithResponseCompression wraps the given handler so that it compresses the responses to gets and
+// lists of node and pod metrics itself, according to the given configuration, instead of leaving it
+// to the generic API server.  Responses are only compressed (with gzip) when at least the minimum
+// size, and when the client accepts gzip, honoring its q-values, so clients asking for identity
+// (e.g. controllers on the same node, with no need to save bandwidth) are sent uncompressed
+// responses.  The request's Accept-Encoding is removed before passing it on, so that the generic
+// API server's own compression, which ignores q-values, never applies too.
+func WithResponseCompression(handler http.Handler, config ResponseCompression) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isMetricsRead(req) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		reason := ""
+		switch {
+		case config.MinBytes < 0:
+			reason = CompressionReasonDisabled
+		case !acceptsGzip(req.Header.Get("Accept-Encoding")):
+			reason = CompressionReasonNotAccepted
+		}
+		if req.Header.Get("Accept-Encoding") != "" {
+			// a shallow copy, so that the headers can be replaced without changing the original request
+			req = req.WithContext(req.Context())
+			req.Header = cloneHeader(req.Header)
+			req.Header.Del("Accept-Encoding")
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		cw := &compressingResponseWriter{ResponseWriter: w, minBytes: config.MinBytes, reason: reason}
+		handler.ServeHTTP(cw, req)
+		cw.Close()
+	})
+}
+
+// acceptsGzip checks if the given Accept-Encoding header accepts gzip at least as much as identity.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, identityQ, anyQ := -1.0, -1.0, -1.0
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		name, q := parseCoding(coding)
+		switch name {
+		case EncodingGzip:
+			gzipQ = q
+		case EncodingIdentity:
+			identityQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	// codings not listed take the q-value of *, if listed, and identity is otherwise always acceptable
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if identityQ < 0 {
+		identityQ = anyQ
+	}
+	return gzipQ > 0 && gzipQ >= identityQ
+}
+
+// parseCoding parses a single coding of an Accept-Encoding header into its name and q-value.
+func parseCoding(coding string) (string, float64) {
+	parts := strings.Split(coding, ";")
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+	q := 1.0
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+		if err != nil {
+			parsed = 0
+		}
+		q = parsed
+	}
+	return name, q
+}
+
+// cloneHeader copies the given headers, so that they can be changed without changing the original.
+func cloneHeader(header http.Header) http.Header {
+	res := make(http.Header, len(header))
+	for key, values := range header {
+		res[key] = append([]string(nil), values...)
+	}
+	return res
+}
+
+// compressingResponseWriter buffers the start of a response until either it reaches the minimum
+// size compressed, when it starts compressing, or the response ends, when it sends it uncompressed.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	minBytes int
+	// reason, if set, is why the response isn't compressed, whatever its size.
+	reason string
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+	wire    countingWriter
+	written int64
+}
+
+func (w *compressingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *compressingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if w.reason == "" {
+			if len(w.buf) < w.minBytes {
+				return len(b), nil
+			}
+			w.reason = CompressionReasonCompressed
+		}
+		return len(b), w.flush()
+	}
+	return w.write(b)
+}
+
+// flush decides on the encoding of the response, writing the header and everything buffered.
+func (w *compressingResponseWriter) flush() error {
+	w.decided = true
+	if w.reason == CompressionReasonCompressed {
+		w.Header().Set("Content-Encoding", EncodingGzip)
+		w.Header().Del("Content-Length")
+		w.wire.w = w.ResponseWriter
+		w.gz = gzip.NewWriter(&w.wire)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.write(buf)
+	return err
+}
+
+// write writes the given bytes, compressing them if the response is compressed.
+func (w *compressingResponseWriter) write(b []byte) (int, error) {
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	start := time.Now()
+	n, err := w.gz.Write(b)
+	apiCompressionSeconds.Add(time.Since(start).Seconds())
+	w.written += int64(n)
+	return n, err
+}
+
+// Close ends the response, sending anything still buffered, and recording how it was encoded.
+func (w *compressingResponseWriter) Close() error {
+	if w.status == 0 {
+		// nothing was written, e.g. a 304 wrote only its header
+		w.status = http.StatusOK
+	}
+	var err error
+	if !w.decided {
+		if w.reason == "" {
+			w.reason = CompressionReasonBelowThreshold
+		}
+		err = w.flush()
+	}
+	if w.gz == nil {
+		apiResponsesByEncoding.WithLabelValues(EncodingIdentity, w.reason).Inc()
+		return err
+	}
+	start := time.Now()
+	if closeErr := w.gz.Close(); err == nil {
+		err = closeErr
+	}
+	apiCompressionSeconds.Add(time.Since(start).Seconds())
+	apiResponsesByEncoding.WithLabelValues(EncodingGzip, w.reason).Inc()
+	apiCompressedResponseBytes.WithLabelValues(CompressionStageUncompressed).Add(float64(w.written))
+	apiCompressedResponseBytes.WithLabelValues(CompressionStageCompressed).Add(float64(w.wire.n))
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+// compressedBytes fetches the bytes of compressed responses counted at the given stage from the default registry.
+func compressedBytes(stage string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_api_compressed_response_bytes_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == stage {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Response Compression", func() {
+	var (
+		body          string
+		seenEncodings []string
+		handler       http.Handler
+	)
+
+	BeforeEach(func() {
+		body = strings.Repeat(`{"kind":"PodMetrics"}`, 100)
+		seenEncodings = nil
+		handler = WithResponseCompression(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			seenEncodings = append(seenEncodings, req.Header.Get("Accept-Encoding"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			// in pieces, as the API server's serializers write
+			for i := 0; i < len(body); i += 64 {
+				end := i + 64
+				if end > len(body) {
+					end = len(body)
+				}
+				w.Write([]byte(body[i:end]))
+			}
+		}), ResponseCompression{MinBytes: 1024})
+	})
+
+	// get fetches the given path with the given Accept-Encoding, returning the response
+	// and its body, decompressed if it was compressed.
+	get := func(path, acceptEncoding string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		if resp.Header().Get("Content-Encoding") != "gzip" {
+			return resp, resp.Body.String()
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(resp.Body.Bytes()))
+		Expect(err).NotTo(HaveOccurred())
+		decompressed, err := ioutil.ReadAll(gz)
+		Expect(err).NotTo(HaveOccurred())
+		return resp, string(decompressed)
+	}
+
+	It("should compress responses above the minimum size for clients accepting gzip", func() {
+		uncompressedBefore, compressedBefore := compressedBytes("uncompressed"), compressedBytes("compressed")
+		resp, served := get("/apis/metrics.k8s.io/v1beta1/pods", "gzip, deflate")
+		Expect(resp.Header().Get("Content-Encoding")).To(Equal("gzip"))
+		Expect(resp.Header().Get("Vary")).To(Equal("Accept-Encoding"))
+		Expect(served).To(Equal(body))
+		Expect(resp.Body.Len()).To(BeNumerically("<", len(body)))
+
+		By("hiding the Accept-Encoding from the generic API server's own compression")
+		Expect(seenEncodings).To(Equal([]string{""}))
+
+		By("counting the bytes before and after compression")
+		Expect(compressedBytes("uncompressed") - uncompressedBefore).To(BeNumerically("==", len(body)))
+		Expect(compressedBytes("compressed") - compressedBefore).To(BeNumerically("==", resp.Body.Len()))
+	})
+
+	It("should send identity responses to clients asking for them", func() {
+		for _, acceptEncoding := range []string{"", "identity", "gzip;q=0", "identity, gzip;q=0.5", "*;q=0, identity"} {
+			resp, served := get("/apis/metrics.k8s.io/v1beta1/pods", acceptEncoding)
+			Expect(resp.Header().Get("Content-Encoding")).To(BeEmpty(), acceptEncoding)
+			Expect(served).To(Equal(body), acceptEncoding)
+		}
+	})
+
+	It("should send responses below the minimum size uncompressed", func() {
+		body = `{"kind":"PodMetrics"}`
+		resp, served := get("/apis/metrics.k8s.io/v1beta1/namespaces/default/pods/pod1", "gzip")
+		Expect(resp.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(served).To(Equal(body))
+	})
+
+	It("should send every response uncompressed while disabled", func() {
+		handler = WithResponseCompression(handler, ResponseCompression{MinBytes: -1})
+		resp, served := get("/apis/metrics.k8s.io/v1beta1/pods", "gzip")
+		Expect(resp.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(served).To(Equal(body))
+	})
+
+	It("should leave requests besides gets and lists of metrics alone", func() {
+		resp, served := get("/apis/metrics.k8s.io/v1beta1", "gzip")
+		Expect(resp.Header().Get("Content-Encoding")).To(BeEmpty())
+		Expect(served).To(Equal(body))
+		Expect(seenEncodings).To(Equal([]string{"gzip"}))
+	})
+})
@@ -0,0 +1,231 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// DefaultInflightQueueTimeout is the default time requests wait for an in-flight slot.
+const DefaultInflightQueueTimeout = time.Second
+
+// RequestKind is the kind of metrics API request being limited.
+type RequestKind string
+
+const (
+	// GetRequest is a request for a single object (e.g. from the HPA).
+	GetRequest RequestKind = "get"
+	// ListRequest is a request for a list of objects (e.g. from dashboards).
+	ListRequest RequestKind = "list"
+)
+
+var (
+	inflightQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "inflight_queue_depth",
+			Help:      "The number of metrics API requests waiting for an in-flight slot, by kind",
+		},
+		[]string{"kind"},
+	)
+	inflightRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "inflight_rejections_total",
+			Help:      "The number of metrics API requests rejected with 429 after waiting too long for an in-flight slot, by kind",
+		},
+		[]string{"kind"},
+	)
+	inflightWaitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "metrics_server",
+			Subsystem: "api",
+			Name:      "inflight_wait_duration_seconds",
+			Help:      "The time metrics API requests waited for an in-flight slot, whether or not they got one, by kind",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(inflightQueueDepth)
+	prometheus.MustRegister(inflightRejectionsTotal)
+	prometheus.MustRegister(inflightWaitDuration)
+}
+
+// InflightLimiter limits the number of metrics API gets and lists served concurrently,
+// separately from the API server's own limits, so that storms of lists can't starve the
+// HPA's gets.  Requests over the limit queue for a slot until a timeout, then fail with
+// a 429.  Gets take priority: they may borrow idle list slots, and queued gets are
+// admitted before queued lists, but lists never use get slots.
+//
+// A nil *InflightLimiter doesn't limit anything.
+type InflightLimiter struct {
+	maxGets      int
+	maxLists     int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	gets  int
+	lists int
+	// queues hold the channels of waiting requests by kind, in order of arrival,
+	// each closed when its request is admitted.
+	queues map[RequestKind][]chan struct{}
+}
+
+// NewInflightLimiter returns a limiter allowing up to the given number of gets and lists in
+// flight at once (with zero meaning no limit on that kind), queueing requests over the limit
+// for up to the given timeout.  It returns nil (limiting nothing) if neither kind is limited.
+func NewInflightLimiter(maxGets, maxLists int, queueTimeout time.Duration) *InflightLimiter {
+	if maxGets == 0 && maxLists == 0 {
+		return nil
+	}
+	return &InflightLimiter{
+		maxGets:      maxGets,
+		maxLists:     maxLists,
+		queueTimeout: queueTimeout,
+		queues:       make(map[RequestKind][]chan struct{}),
+	}
+}
+
+// Acquire waits for an in-flight slot for a request of the given kind, returning a function
+// to release it once the request is done.  If no slot frees up before the queue timeout, it
+// returns a 429 error asking the client to retry later.
+func (l *InflightLimiter) Acquire(ctx context.Context, kind RequestKind) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if len(l.queues[kind]) == 0 && l.canAdmit(kind) {
+		l.admit(kind)
+		l.mu.Unlock()
+		inflightWaitDuration.WithLabelValues(string(kind)).Observe(0)
+		return l.releaser(kind), nil
+	}
+	admitted := make(chan struct{})
+	l.queues[kind] = append(l.queues[kind], admitted)
+	inflightQueueDepth.WithLabelValues(string(kind)).Inc()
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-admitted:
+	case <-timer.C:
+		err = l.tooManyRequests(kind)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	inflightWaitDuration.WithLabelValues(string(kind)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return l.releaser(kind), nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-admitted:
+		// admitted just as we gave up, so use the slot anyway
+		return l.releaser(kind), nil
+	default:
+	}
+	l.dequeue(kind, admitted)
+	if errors.IsTooManyRequests(err) {
+		inflightRejectionsTotal.WithLabelValues(string(kind)).Inc()
+	}
+	return nil, err
+}
+
+// canAdmit checks if a request of the given kind can be admitted now.
+// It must be called with the lock held.
+func (l *InflightLimiter) canAdmit(kind RequestKind) bool {
+	// gets over their own limit borrow list slots
+	borrowed := 0
+	if l.maxGets != 0 && l.gets > l.maxGets {
+		borrowed = l.gets - l.maxGets
+	}
+	switch kind {
+	case GetRequest:
+		return l.maxGets == 0 || l.gets < l.maxGets || (l.maxLists != 0 && l.lists+borrowed < l.maxLists)
+	default:
+		// lists wait for any queued gets, which would otherwise be starved
+		return l.maxLists == 0 || (l.lists+borrowed < l.maxLists && len(l.queues[GetRequest]) == 0)
+	}
+}
+
+// admit counts a request of the given kind as in flight.
+// It must be called with the lock held.
+func (l *InflightLimiter) admit(kind RequestKind) {
+	if kind == GetRequest {
+		l.gets++
+	} else {
+		l.lists++
+	}
+}
+
+// dequeue removes the given waiting request from its queue.
+// It must be called with the lock held.
+func (l *InflightLimiter) dequeue(kind RequestKind, waiter chan struct{}) {
+	queue := l.queues[kind]
+	for i, queued := range queue {
+		if queued == waiter {
+			l.queues[kind] = append(queue[:i:i], queue[i+1:]...)
+			inflightQueueDepth.WithLabelValues(string(kind)).Dec()
+			return
+		}
+	}
+}
+
+// releaser returns a function which releases a slot of the given kind once,
+// admitting as many queued requests as now fit, gets first.
+func (l *InflightLimiter) releaser(kind RequestKind) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if kind == GetRequest {
+				l.gets--
+			} else {
+				l.lists--
+			}
+			for _, next := range []RequestKind{GetRequest, ListRequest} {
+				for len(l.queues[next]) != 0 && l.canAdmit(next) {
+					waiter := l.queues[next][0]
+					l.dequeue(next, waiter)
+					l.admit(next)
+					close(waiter)
+				}
+			}
+		})
+	}
+}
+
+// tooManyRequests returns the 429 error for a request of the given kind that timed out in the queue.
+func (l *InflightLimiter) tooManyRequests(kind RequestKind) error {
+	return errors.NewTooManyRequests(fmt.Sprintf("too many metrics API %ss in flight, waited %s for a slot", kind, l.queueTimeout), 1)
+}
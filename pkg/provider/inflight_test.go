@@ -0,0 +1,169 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+func TestProvider(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Provider Suite")
+}
+
+var _ = Describe("In-flight Request Limiter", func() {
+	// acquireAsync acquires a slot in the background, sending the result once it's done
+	acquireAsync := func(limiter *InflightLimiter, kind RequestKind) <-chan error {
+		done := make(chan error, 1)
+		go func() {
+			_, err := limiter.Acquire(context.Background(), kind)
+			done <- err
+		}()
+		return done
+	}
+
+	It("should keep admitting gets while a burst of lists is throttled", func() {
+		limiter := NewInflightLimiter(2, 2, 50*time.Millisecond)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var listErrs, getErrs []error
+		By("holding each admitted list for longer than the queue timeout")
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				release, err := limiter.Acquire(context.Background(), ListRequest)
+				if err == nil {
+					time.Sleep(200 * time.Millisecond)
+					release()
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				listErrs = append(listErrs, err)
+			}()
+		}
+		By("sending a burst of quick gets alongside them")
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					release, err := limiter.Acquire(context.Background(), GetRequest)
+					if err == nil {
+						time.Sleep(time.Millisecond)
+						release()
+					}
+					mu.Lock()
+					getErrs = append(getErrs, err)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		By("checking that every get succeeded")
+		Expect(getErrs).To(HaveLen(100))
+		for _, err := range getErrs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		By("checking that the lists over the limit were rejected with 429s asking clients to retry")
+		rejected := 0
+		for _, err := range listErrs {
+			if err == nil {
+				continue
+			}
+			rejected++
+			Expect(errors.IsTooManyRequests(err)).To(BeTrue())
+			retryAfter, ok := errors.SuggestsClientDelay(err)
+			Expect(ok).To(BeTrue())
+			Expect(retryAfter).To(Equal(1))
+		}
+		Expect(rejected).To(BeNumerically(">=", 16))
+	})
+
+	It("should let gets borrow idle list slots, but not the other way round", func() {
+		limiter := NewInflightLimiter(1, 1, 50*time.Millisecond)
+		_, err := limiter.Acquire(context.Background(), GetRequest)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("admitting a second get into the idle list slot")
+		releaseBorrowed, err := limiter.Acquire(context.Background(), GetRequest)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("rejecting lists while the list slot is borrowed")
+		_, err = limiter.Acquire(context.Background(), ListRequest)
+		Expect(errors.IsTooManyRequests(err)).To(BeTrue())
+
+		By("admitting lists once the borrowed slot is released")
+		releaseBorrowed()
+		_, err = limiter.Acquire(context.Background(), ListRequest)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should admit queued gets before queued lists", func() {
+		limiter := NewInflightLimiter(1, 1, 5*time.Second)
+		_, err := limiter.Acquire(context.Background(), GetRequest)
+		Expect(err).NotTo(HaveOccurred())
+		releaseList, err := limiter.Acquire(context.Background(), ListRequest)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("queueing a list, and then a get")
+		list := acquireAsync(limiter, ListRequest)
+		Consistently(list, 50*time.Millisecond).ShouldNot(Receive())
+		get := acquireAsync(limiter, GetRequest)
+		Consistently(get, 50*time.Millisecond).ShouldNot(Receive())
+
+		By("freeing up a slot, and checking that the get gets it")
+		releaseList()
+		Eventually(get).Should(Receive(BeNil()))
+		Consistently(list, 50*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should stop waiting when the request's context is done", func() {
+		limiter := NewInflightLimiter(0, 1, 5*time.Second)
+		_, err := limiter.Acquire(context.Background(), ListRequest)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = limiter.Acquire(ctx, ListRequest)
+		Expect(err).To(Equal(context.Canceled))
+
+		By("not limiting the other kind at all")
+		for i := 0; i < 10; i++ {
+			_, err := limiter.Acquire(context.Background(), GetRequest)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should not limit anything when neither kind has a limit", func() {
+		limiter := NewInflightLimiter(0, 0, time.Second)
+		Expect(limiter).To(BeNil())
+		release, err := limiter.Acquire(context.Background(), ListRequest)
+		Expect(err).NotTo(HaveOccurred())
+		release()
+	})
+})
@@ -18,8 +18,11 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	apitypes "k8s.io/apimachinery/pkg/types"
 	metrics "k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
 )
 
 // MetricsProvider is both a PodMetricsProvider and a NodeMetricsProvider
@@ -44,6 +47,19 @@ type TimeInfo struct {
 	// Window represents the window used to calculate rate metrics associated
 	// with this timestamp.
 	Window time.Duration
+
+	// CorrectedResources lists the resources whose usage was corrected, for pods
+	// whose containers reported more usage than the pods themselves.
+	CorrectedResources []string
+
+	// MemoryOverhead, if non-nil, is the pod-level memory usage beyond its containers'.
+	MemoryOverhead *resource.Quantity
+
+	// Provenance, if non-nil, records where the metrics came from.
+	Provenance *sources.Provenance
+
+	// NodeName is the name of the node the pod's metrics were measured on, if known.
+	NodeName string
 }
 
 // PodMetricsProvider knows how to fetch metrics for the containers in a pod.
@@ -51,13 +67,34 @@ type PodMetricsProvider interface {
 	// GetContainerMetrics gets the latest metrics for all containers in each listed pod,
 	// returning both the metrics and the associated collection timestamp.
 	// If a pod is missing, the container metrics should be nil for that pod.
+	// Each pod's containers should be sorted by name, so that they're served in a stable order.
+	// The returned container metrics may be shared with the provider's storage,
+	// and must be deep-copied before being modified.
 	GetContainerMetrics(pods ...apitypes.NamespacedName) ([]TimeInfo, [][]metrics.ContainerMetrics, error)
 }
 
+// PodListingProvider is implemented by PodMetricsProviders which can list the pods
+// they have metrics for, including pods with no matching pod object (such as static
+// pods whose mirror pods haven't been created).
+type PodListingProvider interface {
+	// ListPods lists the pods with metrics in the given namespace, or in all namespaces if it's empty.
+	ListPods(namespace string) []apitypes.NamespacedName
+}
+
+// NamespaceCappingProvider is implemented by PodMetricsProviders which may have left out
+// pods' metrics to keep the number stored for each namespace under a cap.
+type NamespaceCappingProvider interface {
+	// NamespaceEvictions returns the number of pods whose metrics were left out of the
+	// given namespace by the cap, which is zero if the namespace wasn't capped.
+	NamespaceEvictions(namespace string) int
+}
+
 // NodeMetricsProvider knows how to fetch metrics for a node.
 type NodeMetricsProvider interface {
 	// GetNodeMetrics gets the latest metrics for the given nodes,
 	// returning both the metrics and the associated collection timestamp.
 	// If a node is missing, the resourcelist should be nil for that node.
+	// The returned resource lists may be shared with the provider's storage,
+	// and must be deep-copied before being modified.
 	GetNodeMetrics(nodes ...string) ([]TimeInfo, []corev1.ResourceList, error)
 }
@@ -0,0 +1,199 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// DefaultNamespaceAccessTTL is how long the default NamespaceAccess caches each decision.
+const DefaultNamespaceAccessTTL = 10 * time.Second
+
+// NamespaceAccess lets users who may only list a resource in some namespaces still list it
+// across all namespaces, getting just the items in the namespaces they may list it in, rather
+// than being forbidden.  It authorizes such lists in place of the server's authorizer, and then
+// filters them, asking the authorizer (i.e. with SubjectAccessReviews, when delegating) about
+// each namespace listed, caching the decisions per user and namespace to bound the load on the
+// API server.  Users who may list the resource across all namespaces aren't filtered at all.
+//
+// This changes what lists across all namespaces mean, so is only used when asked for.
+// A nil NamespaceAccess filters nothing.
+type NamespaceAccess struct {
+	delegate authorizer.Authorizer
+	resource schema.GroupResource
+	ttl      time.Duration
+	clock    clock.Clock
+
+	mu        sync.Mutex
+	decisions map[accessKey]accessDecision
+	lastSweep time.Time
+}
+
+// accessKey identifies a user (by name and groups) and the namespace they list in,
+// which is empty for all namespaces.
+type accessKey struct {
+	user      string
+	namespace string
+}
+
+type accessDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+var _ authorizer.Authorizer = &NamespaceAccess{}
+
+// NewNamespaceAccess filters lists of the given resource across all namespaces with the
+// given authorizer, caching its decisions for the given TTL (or not at all, if zero).
+func NewNamespaceAccess(delegate authorizer.Authorizer, resource schema.GroupResource, ttl time.Duration) *NamespaceAccess {
+	return &NamespaceAccess{
+		delegate:  delegate,
+		resource:  resource,
+		ttl:       ttl,
+		clock:     clock.RealClock{},
+		decisions: make(map[accessKey]accessDecision),
+	}
+}
+
+// SetClock sets the clock used to expire cached decisions.
+func (a *NamespaceAccess) SetClock(clk clock.Clock) {
+	a.clock = clk
+}
+
+// Authorize authorizes requests with the delegate authorizer, except for lists of the resource
+// across all namespaces, which are always allowed, since they're filtered instead.
+func (a *NamespaceAccess) Authorize(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	decision, reason, err := a.delegate.Authorize(attrs)
+	if !a.filters(attrs) {
+		return decision, reason, err
+	}
+	allowed := decision == authorizer.DecisionAllow
+	if err == nil && attrs.GetUser() != nil {
+		a.remember(accessKeyFor(attrs.GetUser(), ""), allowed)
+	}
+	if allowed {
+		return decision, reason, err
+	}
+	return authorizer.DecisionAllow, "lists across all namespaces are filtered to the namespaces the user may list in", nil
+}
+
+// filters checks if the given request is a list of the resource across all namespaces.
+func (a *NamespaceAccess) filters(attrs authorizer.Attributes) bool {
+	return attrs.IsResourceRequest() && attrs.GetVerb() == "list" && attrs.GetNamespace() == "" && attrs.GetSubresource() == "" &&
+		attrs.GetAPIGroup() == a.resource.Group && attrs.GetResource() == a.resource.Resource
+}
+
+// Filter returns the func checking which namespaces the user making the given request may list
+// the resource in, or nil if they may list it in every namespace (or nothing is filtered).
+// Requests without a user may list it in none, since lists are authorized to be filtered here.
+func (a *NamespaceAccess) Filter(ctx context.Context) func(namespace string) bool {
+	if a == nil {
+		return nil
+	}
+	requester, ok := genericapirequest.UserFrom(ctx)
+	if !ok || requester == nil {
+		return denyAll
+	}
+	attrs := authorizer.AttributesRecord{
+		User:            requester,
+		Verb:            "list",
+		APIGroup:        a.resource.Group,
+		Resource:        a.resource.Resource,
+		ResourceRequest: true,
+	}
+	if info, ok := genericapirequest.RequestInfoFrom(ctx); ok {
+		attrs.APIVersion = info.APIVersion
+	}
+	if a.allowed(attrs) {
+		return nil
+	}
+	return func(namespace string) bool {
+		attrs.Namespace = namespace
+		return a.allowed(attrs)
+	}
+}
+
+func denyAll(string) bool {
+	return false
+}
+
+// allowed checks if the given request is allowed, from the cache if decided recently.
+func (a *NamespaceAccess) allowed(attrs authorizer.AttributesRecord) bool {
+	key := accessKeyFor(attrs.User, attrs.Namespace)
+	a.mu.Lock()
+	decision, ok := a.decisions[key]
+	a.mu.Unlock()
+	if ok && a.clock.Now().Before(decision.expires) {
+		return decision.allowed
+	}
+
+	authorized, _, err := a.delegate.Authorize(attrs)
+	if err != nil {
+		// not remembered, so that it's asked again
+		glog.Errorf("unable to authorize %s to list %s in namespace %q, leaving it out: %v", attrs.User.GetName(), a.resource, attrs.Namespace, err)
+		return false
+	}
+	allowed := authorized == authorizer.DecisionAllow
+	a.remember(key, allowed)
+	return allowed
+}
+
+// remember caches the given decision, sweeping out expired decisions at most once per TTL.
+func (a *NamespaceAccess) remember(key accessKey, allowed bool) {
+	if a.ttl <= 0 {
+		return
+	}
+	now := a.clock.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) > a.ttl {
+		for cached, decision := range a.decisions {
+			if !now.Before(decision.expires) {
+				delete(a.decisions, cached)
+			}
+		}
+		a.lastSweep = now
+	}
+	a.decisions[key] = accessDecision{allowed: allowed, expires: now.Add(a.ttl)}
+}
+
+// accessKeyFor returns the cache key of the given user listing in the given namespace,
+// covering everything about the user that authorizers may decide by.
+func accessKeyFor(requester user.Info, namespace string) accessKey {
+	groups := append([]string(nil), requester.GetGroups()...)
+	sort.Strings(groups)
+	parts := []string{requester.GetName(), strings.Join(groups, ",")}
+	extra := requester.GetExtra()
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, key+"="+strings.Join(extra[key], ","))
+	}
+	return accessKey{user: strings.Join(parts, "\x00"), namespace: namespace}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+// fakeAuthorizer allows each user to list in the given namespaces (where the empty namespace
+// is all of them), counting the requests it's asked about, by namespace.
+type fakeAuthorizer struct {
+	allowed map[string][]string
+	asked   map[string]int
+}
+
+func (a *fakeAuthorizer) Authorize(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	a.asked[attrs.GetNamespace()]++
+	for _, ns := range a.allowed[attrs.GetUser().GetName()] {
+		if ns == attrs.GetNamespace() {
+			return authorizer.DecisionAllow, "", nil
+		}
+	}
+	return authorizer.DecisionNoOpinion, "", nil
+}
+
+var _ = Describe("Namespace Access", func() {
+	var (
+		authz     *fakeAuthorizer
+		access    *NamespaceAccess
+		fakeClock *clock.FakeClock
+		podList   = authorizer.AttributesRecord{Verb: "list", APIGroup: "metrics.k8s.io", Resource: "pods", ResourceRequest: true}
+	)
+
+	BeforeEach(func() {
+		authz = &fakeAuthorizer{
+			allowed: map[string][]string{"admin": {""}, "tenant-a": {"ns1", "ns3"}},
+			asked:   make(map[string]int),
+		}
+		fakeClock = clock.NewFakeClock(time.Now())
+		access = NewNamespaceAccess(authz, schema.GroupResource{Group: "metrics.k8s.io", Resource: "pods"}, 10*time.Second)
+		access.SetClock(fakeClock)
+	})
+
+	filterFor := func(name string) func(string) bool {
+		return access.Filter(genericapirequest.WithUser(context.Background(), &user.DefaultInfo{Name: name}))
+	}
+
+	It("should allow lists across all namespaces, since they're filtered, but nothing else", func() {
+		attrs := podList
+		attrs.User = &user.DefaultInfo{Name: "tenant-a"}
+		decision, _, err := access.Authorize(attrs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(Equal(authorizer.DecisionAllow))
+
+		attrs.Namespace = "ns2"
+		decision, _, err = access.Authorize(attrs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(Equal(authorizer.DecisionNoOpinion))
+
+		attrs.Namespace, attrs.Resource = "", "nodes"
+		decision, _, err = access.Authorize(attrs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(Equal(authorizer.DecisionNoOpinion))
+	})
+
+	It("should filter to the namespaces the user may list in, or not at all when they may list in all of them", func() {
+		Expect(filterFor("admin")).To(BeNil())
+
+		allows := filterFor("tenant-a")
+		Expect(allows).NotTo(BeNil())
+		Expect(allows("ns1")).To(BeTrue())
+		Expect(allows("ns2")).To(BeFalse())
+		Expect(allows("ns3")).To(BeTrue())
+		Expect(filterFor("nobody")("ns1")).To(BeFalse())
+	})
+
+	It("should filter out every namespace for requests without a user", func() {
+		allows := access.Filter(context.Background())
+		Expect(allows).NotTo(BeNil())
+		Expect(allows("ns1")).To(BeFalse())
+		Expect(allows("ns3")).To(BeFalse())
+	})
+
+	It("should cache decisions per user and namespace until they expire", func() {
+		// the decision for all namespaces made authorizing the list is reused by the filter
+		attrs := podList
+		attrs.User = &user.DefaultInfo{Name: "tenant-a"}
+		_, _, err := access.Authorize(attrs)
+		Expect(err).NotTo(HaveOccurred())
+		filterFor("tenant-a")("ns1")
+		filterFor("tenant-a")("ns1")
+		Expect(authz.asked).To(Equal(map[string]int{"": 1, "ns1": 1}))
+
+		By("asking separately for each user")
+		filterFor("tenant-b")("ns1")
+		Expect(authz.asked).To(Equal(map[string]int{"": 2, "ns1": 2}))
+
+		By("asking again once the decisions expire")
+		fakeClock.Step(11 * time.Second)
+		authz.allowed["tenant-a"] = nil
+		Expect(filterFor("tenant-a")("ns1")).To(BeFalse())
+		Expect(authz.asked).To(Equal(map[string]int{"": 3, "ns1": 3}))
+	})
+})
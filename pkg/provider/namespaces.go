@@ -0,0 +1,75 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// NamespaceAllowlist is the set of namespaces whose pod metrics may be collected and served,
+// e.g. by a metrics-server dedicated to a single tenant of a shared cluster.
+//
+// A nil NamespaceAllowlist allows every namespace.
+type NamespaceAllowlist struct {
+	names    map[string]struct{}
+	selector labels.Selector
+	lister   v1listers.NamespaceLister
+}
+
+// NewNamespaceAllowlist allows the given namespace names, plus any namespaces (as found
+// by the given lister) whose labels match the given selector.  The selector and lister
+// may be nil.
+func NewNamespaceAllowlist(names []string, selector labels.Selector, lister v1listers.NamespaceLister) *NamespaceAllowlist {
+	nameSet := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		nameSet[name] = struct{}{}
+	}
+	return &NamespaceAllowlist{names: nameSet, selector: selector, lister: lister}
+}
+
+// Allows checks if the given namespace is allowed.
+func (a *NamespaceAllowlist) Allows(namespace string) bool {
+	if a == nil {
+		return true
+	}
+	if _, isListed := a.names[namespace]; isListed {
+		return true
+	}
+	if a.selector == nil || a.selector.Empty() || a.lister == nil {
+		return false
+	}
+	ns, err := a.lister.Get(namespace)
+	if err != nil {
+		// the namespace is either gone or not yet known to the informer,
+		// so don't allow it until it's known to match
+		return false
+	}
+	return a.selector.Matches(labels.Set(ns.Labels))
+}
+
+// Check returns a forbidden error for requests for the given resource in
+// the given namespace, if it isn't allowed.  The empty namespace (i.e. all
+// namespaces) is always allowed, since its lists are filtered instead.
+func (a *NamespaceAllowlist) Check(resource schema.GroupResource, namespace, name string) error {
+	if namespace == "" || a.Allows(namespace) {
+		return nil
+	}
+	return errors.NewForbidden(resource, name, fmt.Errorf("namespace %q isn't served by this metrics-server", namespace))
+}
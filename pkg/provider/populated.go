@@ -0,0 +1,61 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PopulationAware is implemented by providers which can tell if they've never been
+// populated with metrics (e.g. during cold start), as opposed to having been
+// populated with no metrics.
+type PopulationAware interface {
+	// Populated checks if the provider has ever been populated, and if not,
+	// estimates how long it will be until it is.
+	Populated() (bool, time.Duration)
+}
+
+// CheckPopulated returns a 503 error with a Retry-After period if the given
+// provider knows that it's never been populated, and nil otherwise.
+func CheckPopulated(prov interface{}) error {
+	aware, ok := prov.(PopulationAware)
+	if !ok {
+		return nil
+	}
+	populated, remaining := aware.Populated()
+	if populated {
+		return nil
+	}
+	// always ask clients to wait at least a second, even if we're overdue
+	retryAfter := int32(math.Ceil(remaining.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusServiceUnavailable,
+		Reason:  metav1.StatusReasonServiceUnavailable,
+		Message: fmt.Sprintf("metrics not yet available, the first collection is expected to complete within %ds", retryAfter),
+		Details: &metav1.StatusDetails{
+			RetryAfterSeconds: retryAfter,
+		},
+	}}
+}
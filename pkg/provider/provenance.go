@@ -0,0 +1,98 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// DebugParam is the query parameter asking gets and lists of node and pod metrics
+// for debugging information, when serving it is enabled.
+const DebugParam = "debug"
+
+// DebugProvenance is the value of the DebugParam asking for the provenance of each object
+// served, as annotations (see ProvenanceAnnotations).
+const DebugProvenance = "provenance"
+
+// The annotations set on node and pod metrics served with provenance, recording where
+// their metrics came from (see sources.Provenance).  Objects whose metrics have no known
+// provenance get none of them.
+const (
+	// ProvenanceCycleAnnotation is set to the collection cycle the metrics were scraped in.
+	ProvenanceCycleAnnotation = "metrics-server.kubernetes.io/provenance-cycle"
+	// ProvenanceSourceAnnotation is set to the type of source that produced the metrics.
+	ProvenanceSourceAnnotation = "metrics-server.kubernetes.io/provenance-source"
+	// ProvenanceEndpointAnnotation is set to the endpoint that was scraped.
+	ProvenanceEndpointAnnotation = "metrics-server.kubernetes.io/provenance-endpoint"
+	// ProvenanceCollectedAnnotation is set to when the scrape was started, in RFC 3339 format.
+	ProvenanceCollectedAnnotation = "metrics-server.kubernetes.io/provenance-collected"
+	// ProvenanceKindAnnotation is set to how the metrics were obtained: "direct", "fallback"
+	// (from another of the node's candidate addresses), or "stale" (the last-known metrics,
+	// served again since the node's scrape failed).
+	ProvenanceKindAnnotation = "metrics-server.kubernetes.io/provenance-kind"
+)
+
+type debugKey struct{}
+
+// WithDebug records the raw value of the DebugParam for the request.
+func WithDebug(ctx context.Context, debug string) context.Context {
+	return context.WithValue(ctx, debugKey{}, debug)
+}
+
+// ProvenanceRequested checks if the DebugParam recorded for the request asks for provenance,
+// returning a bad request error if it's not a known value, or serving provenance isn't enabled.
+func ProvenanceRequested(ctx context.Context, enabled bool) (bool, error) {
+	switch raw, _ := ctx.Value(debugKey{}).(string); raw {
+	case "":
+		return false, nil
+	case DebugProvenance:
+		if !enabled {
+			return false, errors.NewBadRequest(fmt.Sprintf("serving %q isn't enabled on this server", DebugProvenance))
+		}
+		return true, nil
+	default:
+		return false, errors.NewBadRequest(fmt.Sprintf("unknown %q value %q: only %q may be requested", DebugParam, raw, DebugProvenance))
+	}
+}
+
+// AddProvenanceAnnotations sets the annotations recording the given provenance, if any.
+func AddProvenanceAnnotations(annotations map[string]string, prov *sources.Provenance) {
+	if prov == nil {
+		return
+	}
+	annotations[ProvenanceCycleAnnotation] = prov.CycleID
+	annotations[ProvenanceSourceAnnotation] = prov.Source
+	annotations[ProvenanceEndpointAnnotation] = prov.Endpoint
+	annotations[ProvenanceCollectedAnnotation] = prov.Collected.UTC().Format(time.RFC3339Nano)
+	annotations[ProvenanceKindAnnotation] = prov.Kind.String()
+}
+
+// WithDebugParam wraps the given handler, recording the DebugParam of requests
+// in their contexts, since the storage doesn't see the raw query otherwise.
+func WithDebugParam(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if debug := req.URL.Query().Get(DebugParam); debug != "" {
+			req = req.WithContext(WithDebug(req.Context(), debug))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/labels"
+	metrics "k8s.io/metrics/pkg/apis/metrics"
+)
+
+// LocalOnlyHeader marks requests proxied from another replica, which must
+// be served from local data only, rather than being proxied again.
+const LocalOnlyHeader = "X-Metrics-Server-Local-Only"
+
+// NodeRouter fetches node metrics from other replicas, when nodes are partitioned
+// between several replicas, each only collecting metrics for its own nodes.
+type NodeRouter interface {
+	// Owns checks if this replica is responsible for the given node.
+	Owns(node string) bool
+	// ProxyGet fetches the metrics for the given node from the replica responsible for it.
+	ProxyGet(ctx context.Context, node string) (*metrics.NodeMetrics, error)
+	// ProxyList fetches the metrics for the nodes matching the given selector from all
+	// other replicas, keeping only those for the nodes each replica is responsible for.
+	// It may return partial results alongside an error.
+	ProxyList(ctx context.Context, selector labels.Selector) ([]metrics.NodeMetrics, error)
+}
+
+type localOnlyKey struct{}
+
+// WithLocalOnly marks the context as belonging to a request that must only be served from local data.
+func WithLocalOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localOnlyKey{}, true)
+}
+
+// LocalOnlyFrom checks if the context belongs to a request that must only be served from local data.
+func LocalOnlyFrom(ctx context.Context) bool {
+	localOnly, _ := ctx.Value(localOnlyKey{}).(bool)
+	return localOnly
+}
+
+// WithLocalOnlyRequests wraps the given handler, marking the contexts of requests
+// carrying the LocalOnlyHeader as local-only.
+func WithLocalOnlyRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(LocalOnlyHeader) != "" {
+			req = req.WithContext(WithLocalOnly(req.Context()))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+)
+
+// Estimated memory used to store each kind of entry, including the map
+// overhead and the quantities of its usage lists.  These were measured
+// with typical name lengths, and are only meant to be roughly right.
+const (
+	// NodeEntryBytes is the estimated memory used to store a node's metrics, including its smoothed usage.
+	NodeEntryBytes = 830
+	// PodEntryBytes is the estimated memory used to store a pod's metrics, not counting its containers.
+	PodEntryBytes = 160
+	// ContainerEntryBytes is the estimated memory used to store each of a pod's containers' metrics.
+	ContainerEntryBytes = 710
+	// SmoothedUsageBytes is the estimated memory used to store each container's smoothed usage,
+	// when smoothing is enabled.
+	SmoothedUsageBytes = 40
+)
+
+// Reasons for evicting pods' metrics from storage.
+const (
+	evictedTerminated = "terminated"
+	evictedStale      = "stale"
+)
+
+var (
+	storageMemoryBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "memory_estimate_bytes",
+			Help:      "The estimated memory used to store the most recently committed batch, after any evictions",
+		},
+	)
+	storageEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "evictions_total",
+			Help:      "The number of pods' metrics evicted from storage to stay under the memory limit, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageMemoryBytes)
+	prometheus.MustRegister(storageEvictionsTotal)
+}
+
+func (e podEntry) estimatedBytes() int64 {
+	return PodEntryBytes + int64(len(e.containers))*ContainerEntryBytes + int64(len(e.smoothed))*SmoothedUsageBytes
+}
+
+// estimateMemory returns the estimated memory used to store the given entries.
+func estimateMemory(nodes map[string]nodeEntry, pods map[apitypes.NamespacedName]podEntry) int64 {
+	size := int64(len(nodes)) * NodeEntryBytes
+	for _, entry := range pods {
+		size += entry.estimatedBytes()
+	}
+	return size
+}
+
+// evictionCandidate is a pod that may be evicted to stay under the memory limit.
+type evictionCandidate struct {
+	name       apitypes.NamespacedName
+	entry      podEntry
+	terminated bool
+}
+
+// evictForLimit removes pods from the given map until the estimated memory is under
+// the limit, returning the estimate afterwards.  Pods in priority namespaces are never
+// evicted, nor are nodes.  Pods known to be in a terminal phase go first, since nobody
+// is going to autoscale on them, then the pods with the stalest samples.
+func evictForLimit(limit sink.MemoryLimit, size int64, pods map[apitypes.NamespacedName]podEntry) int64 {
+	if limit.Bytes <= 0 || size <= limit.Bytes {
+		return size
+	}
+
+	var candidates []evictionCandidate
+	for name, entry := range pods {
+		if limit.Priority != nil && limit.Priority.IsPriority(name.Namespace) {
+			continue
+		}
+		candidate := evictionCandidate{name: name, entry: entry}
+		if limit.PodPhase != nil {
+			phase, known := limit.PodPhase(name.Namespace, name.Name)
+			candidate.terminated = known && (phase == corev1.PodSucceeded || phase == corev1.PodFailed)
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.terminated != b.terminated {
+			return a.terminated
+		}
+		if !a.entry.timeInfo.Timestamp.Equal(b.entry.timeInfo.Timestamp) {
+			return a.entry.timeInfo.Timestamp.Before(b.entry.timeInfo.Timestamp)
+		}
+		return a.name.String() < b.name.String()
+	})
+
+	evicted := map[string]int{}
+	for _, candidate := range candidates {
+		if size <= limit.Bytes {
+			break
+		}
+		delete(pods, candidate.name)
+		size -= candidate.entry.estimatedBytes()
+		reason := evictedStale
+		if candidate.terminated {
+			reason = evictedTerminated
+		}
+		evicted[reason]++
+		storageEvictionsTotal.WithLabelValues(reason).Inc()
+	}
+
+	if size > limit.Bytes {
+		logging.Background(loglevel.Storage).Warning(fmt.Sprintf("estimated storage memory of %d bytes is still over the limit of %d bytes after evicting %d terminated and %d stale pods, since the rest are nodes or in priority namespaces", size, limit.Bytes, evicted[evictedTerminated], evicted[evictedStale]),
+			"bytes", size, "limitBytes", limit.Bytes, "evictedTerminated", evicted[evictedTerminated], "evictedStale", evicted[evictedStale])
+	} else {
+		logging.Background(loglevel.Storage).V(1).Info(fmt.Sprintf("evicted %d terminated and %d stale pods to keep estimated storage memory under the limit of %d bytes", evicted[evictedTerminated], evicted[evictedStale], limit.Bytes),
+			"limitBytes", limit.Bytes, "evictedTerminated", evicted[evictedTerminated], "evictedStale", evicted[evictedStale])
+	}
+	return size
+}
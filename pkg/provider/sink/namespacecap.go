@@ -0,0 +1,126 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+)
+
+const (
+	// maxCapEvictionNamespaces bounds the number of namespaces labelled on the namespace cap
+	// eviction counter.  Evictions from namespaces beyond the first this many are counted
+	// under otherNamespace.
+	maxCapEvictionNamespaces = 50
+	otherNamespace           = "other"
+)
+
+var (
+	namespaceCapEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "storage",
+			Name:      "namespace_cap_evictions_total",
+			Help:      "The number of pods' metrics evicted from storage to keep their namespace under the per-namespace cap, by namespace (up to 50 namespaces, then \"other\")",
+		},
+		[]string{"namespace"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(namespaceCapEvictionsTotal)
+}
+
+// capEvictionLabels assigns label values to the namespaces pods are evicted from,
+// so that the eviction counter's cardinality stays bounded.
+var capEvictionLabels = struct {
+	mu         sync.Mutex
+	namespaces map[string]struct{}
+}{namespaces: make(map[string]struct{})}
+
+// capEvictionLabel returns the label value to count evictions from the given namespace under.
+func capEvictionLabel(namespace string) string {
+	capEvictionLabels.mu.Lock()
+	defer capEvictionLabels.mu.Unlock()
+	if _, ok := capEvictionLabels.namespaces[namespace]; ok {
+		return namespace
+	}
+	if len(capEvictionLabels.namespaces) >= maxCapEvictionNamespaces {
+		return otherNamespace
+	}
+	capEvictionLabels.namespaces[namespace] = struct{}{}
+	return namespace
+}
+
+// evictForNamespaceCap removes pods from the given map until no namespace has more than the
+// cap, returning the number evicted from each namespace that was capped.  Pods in priority
+// namespaces are never evicted.  The pods with the stalest samples go first, with ties broken
+// by name, so that the same pods are kept from one batch to the next.
+func evictForNamespaceCap(limit sink.NamespaceCap, pods map[apitypes.NamespacedName]podEntry) map[string]int {
+	if limit.PodsPerNamespace <= 0 {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for name := range pods {
+		counts[name.Namespace]++
+	}
+	over := make(map[string][]evictionCandidate)
+	for namespace, count := range counts {
+		if count <= limit.PodsPerNamespace {
+			continue
+		}
+		if limit.Priority != nil && limit.Priority.IsPriority(namespace) {
+			continue
+		}
+		over[namespace] = make([]evictionCandidate, 0, count)
+	}
+	if len(over) == 0 {
+		return nil
+	}
+	for name, entry := range pods {
+		if candidates, ok := over[name.Namespace]; ok {
+			over[name.Namespace] = append(candidates, evictionCandidate{name: name, entry: entry})
+		}
+	}
+
+	evicted := make(map[string]int, len(over))
+	for namespace, candidates := range over {
+		sort.Slice(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if !a.entry.timeInfo.Timestamp.Equal(b.entry.timeInfo.Timestamp) {
+				return a.entry.timeInfo.Timestamp.Before(b.entry.timeInfo.Timestamp)
+			}
+			return a.name.Name < b.name.Name
+		})
+		excess := len(candidates) - limit.PodsPerNamespace
+		for _, candidate := range candidates[:excess] {
+			delete(pods, candidate.name)
+		}
+		evicted[namespace] = excess
+		namespaceCapEvictionsTotal.WithLabelValues(capEvictionLabel(namespace)).Add(float64(excess))
+		logging.Background(loglevel.Storage).V(1).Info(fmt.Sprintf("evicted %d of the %d pods in namespace %q to keep it under the cap of %d pods per namespace", excess, len(candidates), namespace, limit.PodsPerNamespace),
+			"namespace", namespace, "evicted", excess, "pods", len(candidates), "cap", limit.PodsPerNamespace)
+	}
+	return evicted
+}
@@ -16,10 +16,12 @@ package sink
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	apitypes "k8s.io/apimachinery/pkg/types"
 	metrics "k8s.io/metrics/pkg/apis/metrics"
 
@@ -34,113 +36,502 @@ import (
 // nice if the kubelet told us this in the summary API...
 var kubernetesCadvisorWindow = 30 * time.Second
 
+const (
+	// ResourcePageFaults is the usage entry for a container's rate of memory page faults,
+	// in faults per second, which is only present when page fault rates are enabled.
+	ResourcePageFaults corev1.ResourceName = "metrics-server.kubernetes.io/page-faults"
+	// ResourceMajorPageFaults is the usage entry for a container's rate of major memory page faults,
+	// in faults per second, which is only present when page fault rates are enabled.
+	ResourceMajorPageFaults corev1.ResourceName = "metrics-server.kubernetes.io/major-page-faults"
+	// ResourcePageFaultWindow is the usage entry for the window a container's page fault rates
+	// were calculated over, in seconds, which is only present alongside the rates.  It's longer
+	// than the metric resolution if the scrapes in between failed.
+	ResourcePageFaultWindow corev1.ResourceName = "metrics-server.kubernetes.io/page-fault-window"
+	// ResourceCPUThrottled is the usage entry for the rate at which a container was CPU throttled,
+	// in seconds per second, which is only present when CPU throttling rates are enabled.
+	ResourceCPUThrottled corev1.ResourceName = "metrics-server.kubernetes.io/cpu-throttled"
+	// ResourceSwap is the usage entry for the swap usage of a node or container, in bytes,
+	// which is only present when swap stats are enabled, and its Kubelet reports them.
+	ResourceSwap corev1.ResourceName = "metrics-server.kubernetes.io/swap"
+)
+
+// AcceleratorResources returns the usage entries for the accelerators of the given make
+// (e.g. nvidia.com/gpu-memory, for "nvidia"), which are only present for containers with
+// accelerators when accelerator stats are enabled: the accelerator memory allocated, and the
+// total accelerator memory, both in bytes and summed over the container's accelerators of
+// that make, and the percentage of time they were active, averaged over those accelerators.
+func AcceleratorResources(accelMake string) (memory, memoryTotal, dutyCycle corev1.ResourceName) {
+	prefix := accelMake + ".com/gpu-"
+	return corev1.ResourceName(prefix + "memory"), corev1.ResourceName(prefix + "memory-total"), corev1.ResourceName(prefix + "duty-cycle")
+}
+
 // sinkMetricsProvider is a provider.MetricsProvider that also acts as a sink.MetricSink
 type sinkMetricsProvider struct {
-	mu    sync.RWMutex
-	nodes map[string]sources.NodeMetricsPoint
-	pods  map[apitypes.NamespacedName]sources.PodMetricsPoint
+	mu      sync.RWMutex
+	current *storageSnapshot
+	// populated is set once the first batch is committed, even if it's empty.
+	populated bool
+	// expectedBy is when the first batch is expected to be committed.
+	expectedBy time.Time
+	// stretch is how far the manager has currently stretched the metric resolution,
+	// which is added to the window of subsequently received batches.
+	stretch time.Duration
+	// podCountObservers are notified of the pod counts of each committed batch.
+	podCountObservers []sink.PodCountObserver
+	// nodeObservers are notified of the node timestamps of each committed batch.
+	nodeObservers []sink.NodeTimestampObserver
+	// podObservers are notified of the pod timestamps of each committed batch.
+	podObservers []sink.PodTimestampObserver
+	// podUsageObservers are notified of the pod usage of each committed batch.
+	podUsageObservers []sink.PodUsageObserver
+	// memoryLimit bounds the estimated memory used by each committed batch.
+	memoryLimit sink.MemoryLimit
+	// namespaceCap caps the number of pods stored for each namespace by each committed batch.
+	namespaceCap sink.NamespaceCap
+	// version is the resource version of the most recently committed batch.
+	version uint64
+	// halfLife is the half-life of the smoothed usage, which is disabled if it's zero.
+	halfLife time.Duration
+}
+
+// storageSnapshot holds the metrics from a single batch.  It is never modified after
+// being committed, so readers can keep using it while newer batches are committed.
+type storageSnapshot struct {
+	nodes map[string]nodeEntry
+	pods  map[apitypes.NamespacedName]podEntry
+	// version is the batch's resource version, which is stamped on everything served from it.
+	version uint64
+	// halfLife is the half-life of the smoothed usage, which is disabled if it's zero.
+	halfLife time.Duration
+	// capped is the number of pods evicted from each namespace by the namespace cap.
+	capped map[string]int
+}
+
+// nodeEntry holds the metrics for a node, pre-assembled at commit time
+// so that serving requests doesn't need to rebuild them.
+type nodeEntry struct {
+	timeInfo provider.TimeInfo
+	usage    corev1.ResourceList
+	// smoothed is the node's smoothed usage, if smoothing is enabled.
+	smoothed smoothedUsage
+}
+
+// podEntry holds the metrics for a pod's containers, pre-assembled at commit time
+// so that serving requests doesn't need to rebuild them.
+type podEntry struct {
+	timeInfo   provider.TimeInfo
+	containers []metrics.ContainerMetrics
+	// smoothed is the smoothed usage of each container, in the same order, if smoothing is enabled.
+	smoothed []smoothedUsage
 }
 
+var _ provider.SnapshotProvider = &sinkMetricsProvider{}
+var _ provider.PopulationAware = &sinkMetricsProvider{}
+var _ provider.PodListingProvider = &sinkMetricsProvider{}
+var _ provider.PodListingProvider = &storageSnapshot{}
+var _ provider.VersionedProvider = &sinkMetricsProvider{}
+var _ provider.VersionedProvider = &storageSnapshot{}
+var _ sink.ResolutionAwareSink = &sinkMetricsProvider{}
+var _ sink.PodCountingSink = &sinkMetricsProvider{}
+var _ sink.NodeObservingSink = &sinkMetricsProvider{}
+var _ sink.PodObservingSink = &sinkMetricsProvider{}
+var _ sink.PodUsageObservingSink = &sinkMetricsProvider{}
+var _ sink.MemoryBoundedSink = &sinkMetricsProvider{}
+var _ sink.NamespaceCappedSink = &sinkMetricsProvider{}
+var _ provider.NamespaceCappingProvider = &sinkMetricsProvider{}
+var _ provider.NamespaceCappingProvider = &storageSnapshot{}
+var _ sink.SmoothingSink = &sinkMetricsProvider{}
+
 // NewSinkProvider returns a MetricSink that feeds into a MetricsProvider.
+// The MetricsProvider is also a provider.SnapshotProvider.
 func NewSinkProvider() (sink.MetricSink, provider.MetricsProvider) {
-	prov := &sinkMetricsProvider{}
+	return NewSinkProviderExpectingData(time.Time{})
+}
+
+// NewSinkProviderExpectingData is like NewSinkProvider, but the MetricsProvider is
+// also a provider.PopulationAware, reporting that it hasn't been populated until
+// the first batch is received, which is expected by the given time.
+func NewSinkProviderExpectingData(expectedBy time.Time) (sink.MetricSink, provider.MetricsProvider) {
+	// versions start from the start time, rather than zero, so that they keep
+	// increasing across restarts, and old versions are still reported as old
+	version := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	prov := &sinkMetricsProvider{current: &storageSnapshot{version: version}, expectedBy: expectedBy, version: version}
+	if expectedBy.IsZero() {
+		// nobody's expecting anything, so don't claim to be unpopulated
+		prov.populated = true
+	}
 	return prov, prov
 }
 
-// TODO(directxman12): figure out what the right value is for "window" --
-// we don't get the actual window from cAdvisor, so we could just
-// plumb down metric resolution, but that wouldn't be actually correct.
+// Populated checks if any batch (possibly restored from a snapshot) has been received yet,
+// and if not, how long it is until the first one is expected.
+func (p *sinkMetricsProvider) Populated() (bool, time.Duration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.populated, time.Until(p.expectedBy)
+}
 
-func (p *sinkMetricsProvider) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo, []corev1.ResourceList, error) {
+// SetResolutionStretch sets how much longer than the configured resolution the
+// metrics in subsequent batches may have been collected over.  Since points are
+// served until the next batch, the reported window grows to match.
+func (p *sinkMetricsProvider) SetResolutionStretch(stretch time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stretch = stretch
+}
+
+// ObservePodCounts registers an observer to be notified of the number
+// of pods in each namespace whenever a batch is committed.
+func (p *sinkMetricsProvider) ObservePodCounts(observer sink.PodCountObserver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.podCountObservers = append(p.podCountObservers, observer)
+}
+
+// ObserveNodes registers an observer to be notified of the timestamp
+// of each node's metrics whenever a batch is committed.
+func (p *sinkMetricsProvider) ObserveNodes(observer sink.NodeTimestampObserver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodeObservers = append(p.nodeObservers, observer)
+}
+
+// ObservePods registers an observer to be notified of the timestamp
+// of each pod's metrics whenever a batch is committed.
+func (p *sinkMetricsProvider) ObservePods(observer sink.PodTimestampObserver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.podObservers = append(p.podObservers, observer)
+}
+
+// ObservePodUsage registers an observer to be notified of the usage
+// of each pod whenever a batch is committed.
+func (p *sinkMetricsProvider) ObservePodUsage(observer sink.PodUsageObserver) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.podUsageObservers = append(p.podUsageObservers, observer)
+}
+
+// SetMemoryLimit sets the soft limit on the estimated memory used by subsequently
+// committed batches, beyond which pods' metrics are evicted before committing.
+func (p *sinkMetricsProvider) SetMemoryLimit(limit sink.MemoryLimit) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.memoryLimit = limit
+}
+
+// SetNamespaceCap sets the cap on the number of pods stored for each namespace by
+// subsequently committed batches, beyond which the stalest are evicted before committing.
+func (p *sinkMetricsProvider) SetNamespaceCap(limit sink.NamespaceCap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.namespaceCap = limit
+}
+
+// SetSmoothingHalfLife enables smoothing the usage of subsequently committed batches
+// with the given half-life (see smoothing.go), or disables it if it's zero.
+func (p *sinkMetricsProvider) SetSmoothingHalfLife(halfLife time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.halfLife = halfLife
+}
+
+// Snapshot returns the data from the most recently committed batch, which is
+// unaffected by any batches committed afterwards.
+func (p *sinkMetricsProvider) Snapshot() provider.MetricsProvider {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
+	return p.current
+}
+
+// ResourceVersion returns the resource version of the most recently committed batch.
+func (p *sinkMetricsProvider) ResourceVersion() uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current.version
+}
+
+func (p *sinkMetricsProvider) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo, []corev1.ResourceList, error) {
+	return p.Snapshot().GetNodeMetrics(nodes...)
+}
+
+func (p *sinkMetricsProvider) GetContainerMetrics(pods ...apitypes.NamespacedName) ([]provider.TimeInfo, [][]metrics.ContainerMetrics, error) {
+	return p.Snapshot().GetContainerMetrics(pods...)
+}
+
+func (p *sinkMetricsProvider) NamespaceEvictions(namespace string) int {
+	return p.Snapshot().(*storageSnapshot).NamespaceEvictions(namespace)
+}
+
+func (p *sinkMetricsProvider) ListPods(namespace string) []apitypes.NamespacedName {
+	p.mu.RLock()
+	current := p.current
+	p.mu.RUnlock()
+	return current.ListPods(namespace)
+}
+
+// TODO(directxman12): figure out what the right value is for "window" --
+// we don't get the actual window from cAdvisor, so we could just
+// plumb down metric resolution, but that wouldn't be actually correct.
 
+func (s *storageSnapshot) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo, []corev1.ResourceList, error) {
 	timestamps := make([]provider.TimeInfo, len(nodes))
 	resMetrics := make([]corev1.ResourceList, len(nodes))
 
 	for i, node := range nodes {
-		metricPoint, present := p.nodes[node]
+		entry, present := s.nodes[node]
 		if !present {
 			continue
 		}
 
-		timestamps[i] = provider.TimeInfo{
-			Timestamp: metricPoint.Timestamp,
-			Window:    kubernetesCadvisorWindow,
-		}
-		resMetrics[i] = corev1.ResourceList{
-			corev1.ResourceName(corev1.ResourceCPU):    metricPoint.CpuUsage,
-			corev1.ResourceName(corev1.ResourceMemory): metricPoint.MemoryUsage,
-		}
+		timestamps[i] = entry.timeInfo
+		resMetrics[i] = entry.usage
 	}
 
 	return timestamps, resMetrics, nil
 }
 
-func (p *sinkMetricsProvider) GetContainerMetrics(pods ...apitypes.NamespacedName) ([]provider.TimeInfo, [][]metrics.ContainerMetrics, error) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-
+func (s *storageSnapshot) GetContainerMetrics(pods ...apitypes.NamespacedName) ([]provider.TimeInfo, [][]metrics.ContainerMetrics, error) {
 	timestamps := make([]provider.TimeInfo, len(pods))
 	resMetrics := make([][]metrics.ContainerMetrics, len(pods))
 
 	for i, pod := range pods {
-		metricPoint, present := p.pods[pod]
+		entry, present := s.pods[pod]
 		if !present {
 			continue
 		}
 
-		contMetrics := make([]metrics.ContainerMetrics, len(metricPoint.Containers))
-		var earliestTS *time.Time
-		for i, contPoint := range metricPoint.Containers {
-			contMetrics[i] = metrics.ContainerMetrics{
-				Name: contPoint.Name,
-				Usage: corev1.ResourceList{
-					corev1.ResourceName(corev1.ResourceCPU):    contPoint.CpuUsage,
-					corev1.ResourceName(corev1.ResourceMemory): contPoint.MemoryUsage,
-				},
-			}
-			if earliestTS == nil || earliestTS.After(contPoint.Timestamp) {
-				ts := contPoint.Timestamp // copy to avoid loop iteration variable issues
-				earliestTS = &ts
-			}
-		}
-		if earliestTS == nil {
-			// we had no containers
-			earliestTS = &time.Time{}
-		}
-		timestamps[i] = provider.TimeInfo{
-			Timestamp: *earliestTS,
-			Window:    kubernetesCadvisorWindow,
-		}
-		resMetrics[i] = contMetrics
+		timestamps[i] = entry.timeInfo
+		resMetrics[i] = entry.containers
 	}
 	return timestamps, resMetrics, nil
 }
 
+func (s *storageSnapshot) ResourceVersion() uint64 {
+	return s.version
+}
+
+func (s *storageSnapshot) NamespaceEvictions(namespace string) int {
+	return s.capped[namespace]
+}
+
+func (s *storageSnapshot) ListPods(namespace string) []apitypes.NamespacedName {
+	var res []apitypes.NamespacedName
+	for pod := range s.pods {
+		if namespace == "" || pod.Namespace == namespace {
+			res = append(res, pod)
+		}
+	}
+	return res
+}
+
 func (p *sinkMetricsProvider) Receive(batch *sources.MetricsBatch) error {
-	newNodes := make(map[string]sources.NodeMetricsPoint, len(batch.Nodes))
+	p.mu.RLock()
+	window := kubernetesCadvisorWindow + p.stretch
+	memoryLimit := p.memoryLimit
+	namespaceCap := p.namespaceCap
+	halfLife := p.halfLife
+	prev := p.current
+	p.mu.RUnlock()
+
+	newNodes := make(map[string]nodeEntry, len(batch.Nodes))
+	nodeTimestamps := make(map[string]time.Time, len(batch.Nodes))
 	for _, nodePoint := range batch.Nodes {
 		if _, exists := newNodes[nodePoint.Name]; exists {
 			return fmt.Errorf("duplicate node %s received", nodePoint.Name)
 		}
-		newNodes[nodePoint.Name] = nodePoint
+		newNodes[nodePoint.Name] = nodeEntry{
+			timeInfo: provider.TimeInfo{
+				Timestamp:  nodePoint.Timestamp,
+				Window:     servedWindow(nodePoint.Window, window),
+				Provenance: nodePoint.Provenance,
+			},
+			usage: corev1.ResourceList{
+				corev1.ResourceName(corev1.ResourceCPU):    nodePoint.CpuUsage,
+				corev1.ResourceName(corev1.ResourceMemory): nodePoint.MemoryUsage,
+			},
+		}
+		if nodePoint.SwapUsage != nil {
+			newNodes[nodePoint.Name].usage[ResourceSwap] = *nodePoint.SwapUsage
+		}
+		if halfLife > 0 {
+			entry := newNodes[nodePoint.Name]
+			entry.smoothed = smoothNode(prev.nodes[nodePoint.Name], nodePoint, halfLife)
+			newNodes[nodePoint.Name] = entry
+		}
+		nodeTimestamps[nodePoint.Name] = nodePoint.Timestamp
 	}
 
-	newPods := make(map[apitypes.NamespacedName]sources.PodMetricsPoint, len(batch.Pods))
+	newPods := make(map[apitypes.NamespacedName]podEntry, len(batch.Pods))
 	for _, podPoint := range batch.Pods {
 		podIdent := apitypes.NamespacedName{Name: podPoint.Name, Namespace: podPoint.Namespace}
 		if _, exists := newPods[podIdent]; exists {
 			return fmt.Errorf("duplicate pod %s received", podIdent)
 		}
-		newPods[podIdent] = podPoint
+		entry := newPodEntry(podPoint, window)
+		if halfLife > 0 {
+			entry.smoothed = smoothPod(entry, prev.pods[podIdent], podPoint, halfLife)
+		}
+		newPods[podIdent] = entry
+	}
+
+	capped := evictForNamespaceCap(namespaceCap, newPods)
+	size := evictForLimit(memoryLimit, estimateMemory(newNodes, newPods), newPods)
+	storageMemoryBytes.Set(float64(size))
+
+	podCounts := make(map[string]int)
+	for podIdent := range newPods {
+		podCounts[podIdent.Namespace]++
 	}
 
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	p.version++
+	p.current = &storageSnapshot{nodes: newNodes, pods: newPods, version: p.version, halfLife: halfLife, capped: capped}
+	p.populated = true
+	observers := p.podCountObservers
+	nodeObservers := p.nodeObservers
+	podObservers := p.podObservers
+	usageObservers := p.podUsageObservers
+	p.mu.Unlock()
 
-	p.nodes = newNodes
-	p.pods = newPods
+	// notify observers outside the lock, so that slow ones don't hold up readers
+	for _, observer := range observers {
+		observer.PodsCommitted(podCounts)
+	}
+	for _, observer := range nodeObservers {
+		observer.NodesCommitted(nodeTimestamps)
+	}
+	if len(podObservers) > 0 {
+		podTimestamps := make(map[apitypes.NamespacedName]time.Time, len(newPods))
+		for podIdent, entry := range newPods {
+			podTimestamps[podIdent] = entry.timeInfo.Timestamp
+		}
+		for _, observer := range podObservers {
+			observer.PodTimestampsCommitted(podTimestamps)
+		}
+	}
+	if len(usageObservers) > 0 {
+		podUsage := sumPodUsage(newPods)
+		for _, observer := range usageObservers {
+			observer.PodUsageCommitted(podUsage)
+		}
+	}
 
 	return nil
 }
+
+// sumPodUsage sums the CPU and memory usage of each of the given pods over its containers.
+func sumPodUsage(pods map[apitypes.NamespacedName]podEntry) map[apitypes.NamespacedName]corev1.ResourceList {
+	res := make(map[apitypes.NamespacedName]corev1.ResourceList, len(pods))
+	for podIdent, entry := range pods {
+		var cpu, memory resource.Quantity
+		for _, container := range entry.containers {
+			cpu.Add(*container.Usage.Cpu())
+			memory.Add(*container.Usage.Memory())
+		}
+		res[podIdent] = corev1.ResourceList{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}
+	}
+	return res
+}
+
+// newPodEntry assembles the container metrics for a pod, sorted by name so that they're
+// served in the same order whatever order the Kubelet reported them in, with the overall
+// timestamp being the pod's sample time (see PodMetricsPoint.SampleTime).
+func newPodEntry(podPoint sources.PodMetricsPoint, window time.Duration) podEntry {
+	contMetrics := make([]metrics.ContainerMetrics, len(podPoint.Containers))
+	for i, contPoint := range podPoint.Containers {
+		contMetrics[i] = metrics.ContainerMetrics{
+			Name: contPoint.Name,
+			Usage: corev1.ResourceList{
+				corev1.ResourceName(corev1.ResourceCPU):    contPoint.CpuUsage,
+				corev1.ResourceName(corev1.ResourceMemory): contPoint.MemoryUsage,
+			},
+		}
+		if contPoint.PageFaults != nil {
+			contMetrics[i].Usage[ResourcePageFaults] = contPoint.PageFaults.PageFaults
+			contMetrics[i].Usage[ResourceMajorPageFaults] = contPoint.PageFaults.MajorPageFaults
+			contMetrics[i].Usage[ResourcePageFaultWindow] = windowQuantity(servedWindow(contPoint.PageFaults.Window, window))
+		}
+		if contPoint.CPUThrottling != nil {
+			contMetrics[i].Usage[ResourceCPUThrottled] = contPoint.CPUThrottling.ThrottledSeconds
+		}
+		if contPoint.SwapUsage != nil {
+			contMetrics[i].Usage[ResourceSwap] = *contPoint.SwapUsage
+		}
+		if len(contPoint.Accelerators) > 0 {
+			addAcceleratorUsage(contMetrics[i].Usage, contPoint.Accelerators)
+		}
+	}
+	sort.Slice(contMetrics, func(i, j int) bool {
+		return contMetrics[i].Name < contMetrics[j].Name
+	})
+	return podEntry{
+		timeInfo: provider.TimeInfo{
+			Timestamp:          podPoint.SampleTime(),
+			Window:             servedWindow(podWindow(podPoint), window),
+			CorrectedResources: podPoint.CorrectedResources,
+			MemoryOverhead:     podPoint.MemoryOverhead,
+			Provenance:         podPoint.Provenance,
+			NodeName:           podPoint.NodeName,
+		},
+		containers: contMetrics,
+	}
+}
+
+// Rates derived by metrics-server from the cumulative counters in successive summaries (page
+// faults, and CPU usage when checking its consistency) carry the window they were actually derived
+// over, which spans more than one cycle after failed scrapes, or a restart restored from a warm
+// start.  Every one of them is served with that window, the one served for the rates the Kubelet
+// reports itself being assumed.
+
+// servedWindow returns the window to serve for a rate derived over the given window, or
+// reported by the Kubelet (for a zero derived window), for which the assumed window is served.
+func servedWindow(derived, assumed time.Duration) time.Duration {
+	if derived > 0 {
+		return derived
+	}
+	return assumed
+}
+
+// podWindow returns the longest window the CPU usage rates of the given pod's containers
+// were derived over, or zero if none were derived.
+func podWindow(podPoint sources.PodMetricsPoint) time.Duration {
+	var longest time.Duration
+	for _, cont := range podPoint.Containers {
+		if cont.Window > longest {
+			longest = cont.Window
+		}
+	}
+	return longest
+}
+
+// windowQuantity returns the given window as a usage entry, in seconds.
+func windowQuantity(window time.Duration) resource.Quantity {
+	return *resource.NewMilliQuantity(window.Nanoseconds()/int64(time.Millisecond), resource.DecimalSI)
+}
+
+// addAcceleratorUsage adds the usage entries for the given accelerators, by make.
+func addAcceleratorUsage(usage corev1.ResourceList, accels []sources.AcceleratorUsage) {
+	counts := make(map[string]int64)
+	for _, accel := range accels {
+		memory, memoryTotal, dutyCycle := AcceleratorResources(accel.Make)
+		for name, quantity := range map[corev1.ResourceName]resource.Quantity{memory: accel.MemoryUsed, memoryTotal: accel.MemoryTotal, dutyCycle: accel.DutyCycle} {
+			sum, ok := usage[name]
+			if !ok {
+				usage[name] = quantity
+				continue
+			}
+			sum.Add(quantity)
+			usage[name] = sum
+		}
+		counts[accel.Make]++
+	}
+	for accelMake, count := range counts {
+		if count == 1 {
+			continue
+		}
+		_, _, dutyCycle := AcceleratorResources(accelMake)
+		sum := usage[dutyCycle]
+		usage[dutyCycle] = *resource.NewQuantity(sum.Value()/count, resource.DecimalSI)
+	}
+}
@@ -15,19 +15,26 @@
 package sink_test
 
 import (
+	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	apitypes "k8s.io/apimachinery/pkg/types"
 	metrics "k8s.io/metrics/pkg/apis/metrics"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
 	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
 	. "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/snapshot"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
 )
 
@@ -183,6 +190,34 @@ var _ = Describe("In-memory Sink Provider", func() {
 		))
 	})
 
+	It("should not let modifications to deep copies of served metrics affect stored values", func() {
+		By("sending the batch to the sink")
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		By("fetching and modifying deep copies of a pod's and a node's metrics")
+		podName := apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"}
+		_, containerMetrics, err := prov.GetContainerMetrics(podName)
+		Expect(err).NotTo(HaveOccurred())
+		podMetrics := metrics.PodMetrics{Containers: containerMetrics[0]}
+		podCopy := podMetrics.DeepCopy()
+		podCopy.Containers[0].Usage[corev1.ResourceCPU] = *resource.NewMilliQuantity(1, resource.DecimalSI)
+		podCopy.Containers[1].Name = "modified"
+
+		_, nodeMetrics, err := prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		nodeCopy := nodeMetrics[0].DeepCopy()
+		nodeCopy[corev1.ResourceMemory] = *resource.NewMilliQuantity(1, resource.BinarySI)
+
+		By("verifying that the stored values are unchanged")
+		_, containerMetrics, err = prov.GetContainerMetrics(podName)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerMetrics[0][0].Usage[corev1.ResourceCPU]).To(Equal(*resource.NewMilliQuantity(410, resource.DecimalSI)))
+		Expect(containerMetrics[0][1].Name).To(Equal("container2"))
+		_, nodeMetrics, err = prov.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodeMetrics[0][corev1.ResourceMemory]).To(Equal(*resource.NewMilliQuantity(120, resource.BinarySI)))
+	})
+
 	It("should return nil metrics for missing pods", func() {
 		By("sending the batch to the sink")
 		Expect(provSink.Receive(batch)).To(Succeed())
@@ -278,4 +313,597 @@ var _ = Describe("In-memory Sink Provider", func() {
 		))
 
 	})
+
+	It("should only serve page fault rate usage entries for containers that have them", func() {
+		By("adding page fault rates to one container")
+		batch.Pods[0].Containers[0].PageFaults = &sources.PageFaultRates{
+			PageFaults:      *resource.NewMilliQuantity(50000, resource.DecimalSI),
+			MajorPageFaults: *resource.NewMilliQuantity(2500, resource.DecimalSI),
+			Window:          90 * time.Second,
+		}
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		By("fetching the pod's metrics")
+		_, containerMetrics, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that only the container with rates has the extra entries")
+		Expect(containerMetrics[0][0].Usage).To(HaveKeyWithValue(ResourcePageFaults, *resource.NewMilliQuantity(50000, resource.DecimalSI)))
+		Expect(containerMetrics[0][0].Usage).To(HaveKeyWithValue(ResourceMajorPageFaults, *resource.NewMilliQuantity(2500, resource.DecimalSI)))
+		Expect(containerMetrics[0][0].Usage).To(HaveKeyWithValue(ResourcePageFaultWindow, *resource.NewMilliQuantity(90000, resource.DecimalSI)))
+		Expect(containerMetrics[0][1].Usage).To(HaveLen(2))
+	})
+
+	It("should serve the windows metrics-server derived CPU usage rates over, in place of the assumed window", func() {
+		batch.Nodes[0].Window = 45 * time.Second
+		batch.Pods[0].Containers[0].Window = 40 * time.Second
+		batch.Pods[0].Containers[1].Window = 50 * time.Second
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		ts, _, err := prov.GetNodeMetrics("node1", "node2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ts[0].Window).To(Equal(45 * time.Second))
+		Expect(ts[1].Window).To(Equal(defaultWindow))
+
+		By("serving the longest window of a pod's containers for the pod")
+		ts, _, err = prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"}, apitypes.NamespacedName{Name: "pod2", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ts[0].Window).To(Equal(50 * time.Second))
+		Expect(ts[1].Window).To(Equal(defaultWindow))
+	})
+
+	It("should only serve a CPU throttling usage entry for containers that have one", func() {
+		batch.Pods[0].Containers[1].CPUThrottling = &sources.ThrottlingRate{
+			ThrottledSeconds: *resource.NewMilliQuantity(250, resource.DecimalSI),
+			Window:           time.Minute,
+		}
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		_, containerMetrics, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerMetrics[0][0].Usage).To(HaveLen(2))
+		Expect(containerMetrics[0][1].Usage).To(HaveKeyWithValue(ResourceCPUThrottled, *resource.NewMilliQuantity(250, resource.DecimalSI)))
+	})
+
+	It("should only serve accelerator usage entries, by make, for containers that have accelerators", func() {
+		accelerator := func(accelMake string, memoryUsed, dutyCycle int64) sources.AcceleratorUsage {
+			return sources.AcceleratorUsage{
+				Make:        accelMake,
+				MemoryTotal: *resource.NewQuantity(16000, resource.BinarySI),
+				MemoryUsed:  *resource.NewQuantity(memoryUsed, resource.BinarySI),
+				DutyCycle:   *resource.NewQuantity(dutyCycle, resource.DecimalSI),
+			}
+		}
+		batch.Pods[0].Containers[1].Accelerators = []sources.AcceleratorUsage{
+			accelerator("nvidia", 12000, 90),
+			accelerator("nvidia", 10000, 81),
+			accelerator("amd", 2000, 15),
+		}
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		_, containerMetrics, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerMetrics[0][0].Usage).To(HaveLen(2))
+
+		By("summing the memory of each make's accelerators, and averaging their duty cycles")
+		usage := containerMetrics[0][1].Usage
+		Expect(usage).To(HaveLen(8))
+		value := func(name corev1.ResourceName) int64 {
+			quantity := usage[name]
+			return quantity.Value()
+		}
+		memory, memoryTotal, dutyCycle := AcceleratorResources("nvidia")
+		Expect(memory).To(BeEquivalentTo("nvidia.com/gpu-memory"))
+		Expect(value(memory)).To(BeEquivalentTo(22000))
+		Expect(value(memoryTotal)).To(BeEquivalentTo(32000))
+		Expect(value(dutyCycle)).To(BeEquivalentTo(85))
+		memory, memoryTotal, dutyCycle = AcceleratorResources("amd")
+		Expect(value(memory)).To(BeEquivalentTo(2000))
+		Expect(value(memoryTotal)).To(BeEquivalentTo(16000))
+		Expect(value(dutyCycle)).To(BeEquivalentTo(15))
+	})
+
+	It("should only serve swap usage entries for the nodes and containers that report swap usage", func() {
+		batch.Nodes[0].SwapUsage = resource.NewQuantity(4096, resource.BinarySI)
+		batch.Pods[0].Containers[1].SwapUsage = resource.NewQuantity(1024, resource.BinarySI)
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		_, nodeUsage, err := prov.GetNodeMetrics(batch.Nodes[0].Name, batch.Nodes[1].Name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodeUsage[0]).To(HaveKeyWithValue(ResourceSwap, *resource.NewQuantity(4096, resource.BinarySI)))
+		Expect(nodeUsage[1]).NotTo(HaveKey(ResourceSwap))
+
+		_, containerMetrics, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(containerMetrics[0][0].Usage).NotTo(HaveKey(ResourceSwap))
+		Expect(containerMetrics[0][1].Usage).To(HaveKeyWithValue(ResourceSwap, *resource.NewQuantity(1024, resource.BinarySI)))
+	})
+
+	It("should leave containers excluded from pod totals out of the pod's timestamp", func() {
+		batch.Pods[0].Containers = append(batch.Pods[0].Containers, sources.ContainerMetricsPoint{
+			Name:                  "istio-proxy",
+			MetricsPoint:          newMilliPoint(now, 10, 20),
+			ExcludedFromPodTotals: true,
+		})
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		timestamps, containerMetrics, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timestamps[0].Timestamp).To(Equal(now.Add(400 * time.Millisecond)))
+		Expect(containerMetrics[0]).To(HaveLen(3))
+		Expect(containerMetrics[0][2].Name).To(Equal("istio-proxy"))
+	})
+
+	It("should fall back to excluded containers for the timestamp of a pod with nothing else", func() {
+		batch.Pods[1].Containers[0].ExcludedFromPodTotals = true
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		timestamps, _, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod2", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timestamps[0].Timestamp).To(Equal(now.Add(600 * time.Millisecond)))
+	})
+
+	It("should time a pod whose sample lags its node's by the pod's own sample", func() {
+		batch.Pods[1].Containers[0].Timestamp = now.Add(-30 * time.Second)
+		Expect(provSink.Receive(batch)).To(Succeed())
+
+		timestamps, _, err := prov.GetContainerMetrics(apitypes.NamespacedName{Name: "pod2", Namespace: "ns1"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timestamps).To(ConsistOf(provider.TimeInfo{Timestamp: now.Add(-30 * time.Second), Window: defaultWindow}))
+	})
+
+	Context("with a memory limit", func() {
+		// 3 nodes, and pods with 2, 1, and 2 containers
+		fullSize := int64(3*NodeEntryBytes + 3*PodEntryBytes + 5*ContainerEntryBytes)
+
+		limitTo := func(bytes int64) {
+			provSink.(sink.MemoryBoundedSink).SetMemoryLimit(sink.MemoryLimit{
+				Bytes:    bytes,
+				Priority: priority.NewNamespaces([]string{"ns2"}, nil, nil),
+				PodPhase: func(namespace, name string) (corev1.PodPhase, bool) {
+					if namespace == "ns1" && name == "pod2" {
+						return corev1.PodSucceeded, true
+					}
+					return "", false
+				},
+			})
+		}
+
+		storedPods := func() []apitypes.NamespacedName {
+			return prov.(provider.PodListingProvider).ListPods("")
+		}
+
+		It("should keep everything while under the limit", func() {
+			limitTo(fullSize)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(storedPods()).To(HaveLen(3))
+		})
+
+		It("should evict terminated pods first", func() {
+			limitTo(fullSize - 1)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(storedPods()).To(ConsistOf(
+				apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"},
+				apitypes.NamespacedName{Name: "pod1", Namespace: "ns2"},
+			))
+		})
+
+		It("should evict the stalest pods after terminated ones", func() {
+			By("making a priority pod the stalest, and adding a pod fresher than the rest")
+			batch.Pods[2].Containers[0].Timestamp = now.Add(-time.Minute)
+			batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: "pod3", Namespace: "ns1", Containers: []sources.ContainerMetricsPoint{
+				{Name: "container1", MetricsPoint: newMilliPoint(now.Add(time.Second), 910, 920)},
+			}})
+
+			By("limiting the store to one pod fewer than would be left once the terminated pod is evicted")
+			limitTo(fullSize - PodEntryBytes - ContainerEntryBytes)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(storedPods()).To(ConsistOf(
+				apitypes.NamespacedName{Name: "pod3", Namespace: "ns1"},
+				apitypes.NamespacedName{Name: "pod1", Namespace: "ns2"},
+			))
+		})
+
+		It("should never evict nodes or pods in priority namespaces", func() {
+			limitTo(1)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(storedPods()).To(ConsistOf(apitypes.NamespacedName{Name: "pod1", Namespace: "ns2"}))
+			_, res, err := prov.GetNodeMetrics("node1", "node2", "node3")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).NotTo(ContainElement(corev1.ResourceList(nil)))
+		})
+	})
+
+	Context("with a per-namespace cap", func() {
+		BeforeEach(func() {
+			// ns1 gets a fresher pod3, and ns2 (a priority namespace) two more pods
+			for i, pod := range []apitypes.NamespacedName{{Name: "pod3", Namespace: "ns1"}, {Name: "pod2", Namespace: "ns2"}, {Name: "pod3", Namespace: "ns2"}} {
+				batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: pod.Name, Namespace: pod.Namespace, Containers: []sources.ContainerMetricsPoint{
+					{Name: "container1", MetricsPoint: newMilliPoint(now.Add(time.Duration(i+1)*time.Second), 910, 920)},
+				}})
+			}
+		})
+
+		capTo := func(pods int) {
+			provSink.(sink.NamespaceCappedSink).SetNamespaceCap(sink.NamespaceCap{
+				PodsPerNamespace: pods,
+				Priority:         priority.NewNamespaces([]string{"ns2"}, nil, nil),
+			})
+		}
+
+		evictions := func(namespace string) float64 {
+			families, err := prometheus.DefaultGatherer.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			for _, family := range families {
+				if family.GetName() != "metrics_server_storage_namespace_cap_evictions_total" {
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					if metric.GetLabel()[0].GetValue() == namespace {
+						return metric.GetCounter().GetValue()
+					}
+				}
+			}
+			return 0
+		}
+
+		It("should keep every pod of namespaces at the cap", func() {
+			capTo(3)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(prov.(provider.PodListingProvider).ListPods("ns1")).To(HaveLen(3))
+			Expect(prov.(provider.NamespaceCappingProvider).NamespaceEvictions("ns1")).To(BeZero())
+		})
+
+		It("should evict the stalest pods of namespaces over the cap, counting them", func() {
+			before := evictions("ns1")
+			capTo(2)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(prov.(provider.PodListingProvider).ListPods("ns1")).To(ConsistOf(
+				apitypes.NamespacedName{Name: "pod2", Namespace: "ns1"},
+				apitypes.NamespacedName{Name: "pod3", Namespace: "ns1"},
+			))
+			Expect(prov.(provider.NamespaceCappingProvider).NamespaceEvictions("ns1")).To(Equal(1))
+			Expect(evictions("ns1") - before).To(Equal(1.0))
+
+			By("evicting the same pods again from the next batch")
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(prov.(provider.PodListingProvider).ListPods("ns1")).NotTo(ContainElement(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"}))
+			Expect(evictions("ns1") - before).To(Equal(2.0))
+		})
+
+		It("should never cap priority namespaces", func() {
+			capTo(1)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(prov.(provider.PodListingProvider).ListPods("ns1")).To(ConsistOf(apitypes.NamespacedName{Name: "pod3", Namespace: "ns1"}))
+			Expect(prov.(provider.PodListingProvider).ListPods("ns2")).To(HaveLen(3))
+			Expect(prov.(provider.NamespaceCappingProvider).NamespaceEvictions("ns2")).To(BeZero())
+		})
+
+		It("should cap nothing by default", func() {
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(prov.(provider.PodListingProvider).ListPods("")).To(HaveLen(6))
+		})
+	})
+
+	Context("with smoothing", func() {
+		var (
+			started    time.Time
+			contStart  time.Time
+			smoothProv provider.SmoothingProvider
+			// corrected and overhead are the corrections and memory overhead of ns1/pod1
+			corrected []string
+			overhead  *resource.Quantity
+		)
+
+		BeforeEach(func() {
+			started = now.Add(-time.Hour)
+			contStart = started
+			corrected = nil
+			overhead = nil
+			provSink.(sink.SmoothingSink).SetSmoothingHalfLife(time.Minute)
+			smoothProv = prov.(provider.SmoothingProvider)
+		})
+
+		// receiveAt commits a batch sampled the given time after now, with the given usage
+		// (in millicores, and bytes) for node1, and the only container of ns1/pod1.
+		receiveAt := func(offset time.Duration, milliCPU, memory int64) {
+			point := sources.MetricsPoint{
+				Timestamp:   now.Add(offset),
+				CpuUsage:    *resource.NewMilliQuantity(milliCPU, resource.DecimalSI),
+				MemoryUsage: *resource.NewQuantity(memory, resource.BinarySI),
+				StartTime:   started,
+			}
+			contPoint := point
+			contPoint.StartTime = contStart
+			Expect(provSink.Receive(&sources.MetricsBatch{
+				Nodes: []sources.NodeMetricsPoint{{Name: "node1", MetricsPoint: point}},
+				Pods: []sources.PodMetricsPoint{{Name: "pod1", Namespace: "ns1", CorrectedResources: corrected, MemoryOverhead: overhead, Containers: []sources.ContainerMetricsPoint{
+					{Name: "container1", MetricsPoint: contPoint},
+				}}},
+			})).To(Succeed())
+		}
+
+		// smoothed returns the smoothed usage of node1 and ns1/pod1's container, nil if they're missing.
+		smoothed := func() (corev1.ResourceList, corev1.ResourceList) {
+			view := smoothProv.Smoothed()
+			Expect(view).NotTo(BeNil())
+			_, nodes, err := view.GetNodeMetrics("node1")
+			Expect(err).NotTo(HaveOccurred())
+			_, pods, err := view.GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+			Expect(err).NotTo(HaveOccurred())
+			if pods[0] == nil {
+				return nodes[0], nil
+			}
+			return nodes[0], pods[0][0].Usage
+		}
+
+		usage := func(milliCPU, memory int64) corev1.ResourceList {
+			return corev1.ResourceList{
+				corev1.ResourceCPU:    *resource.NewMilliQuantity(milliCPU, resource.DecimalSI),
+				corev1.ResourceMemory: *resource.NewQuantity(memory, resource.BinarySI),
+			}
+		}
+
+		It("should have no smoothed view when disabled", func() {
+			provSink.(sink.SmoothingSink).SetSmoothingHalfLife(0)
+			Expect(provSink.Receive(batch)).To(Succeed())
+			Expect(smoothProv.Smoothed()).To(BeNil())
+		})
+
+		It("should converge on the latest usage, halving the weight of older usage every half-life", func() {
+			By("leaving out everything until a half-life of history is smoothed")
+			receiveAt(0, 1000, 1024)
+			node, pod := smoothed()
+			Expect(node).To(BeNil())
+			Expect(pod).To(BeNil())
+
+			By("weighting the older usage by half after a half-life")
+			receiveAt(time.Minute, 0, 0)
+			node, pod = smoothed()
+			Expect(node).To(Equal(usage(500, 512)))
+			Expect(pod).To(Equal(usage(500, 512)))
+			ts, _, err := smoothProv.Smoothed().GetNodeMetrics("node1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ts[0].Window).To(Equal(time.Minute))
+
+			By("not counting the same sample twice")
+			receiveAt(time.Minute, 0, 0)
+			node, _ = smoothed()
+			Expect(node).To(Equal(usage(500, 512)))
+
+			By("weighting by the time elapsed, however long it is between batches")
+			receiveAt(time.Minute+30*time.Second, 0, 0)
+			receiveAt(2*time.Minute, 0, 0)
+			node, pod = smoothed()
+			Expect(node).To(Equal(usage(250, 256)))
+			Expect(pod).To(Equal(usage(250, 256)))
+			receiveAt(10*time.Minute, 0, 0)
+			node, _ = smoothed()
+			Expect(node).To(Equal(usage(1, 1)))
+
+			By("still serving the latest usage outside the smoothed view")
+			_, latest, err := prov.GetNodeMetrics("node1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(latest[0]).To(Equal(usage(0, 0)))
+		})
+
+		It("should keep the corrections and memory overhead of the latest sample of each pod", func() {
+			overhead = resource.NewQuantity(4096, resource.BinarySI)
+			receiveAt(0, 1000, 1024)
+			corrected = []string{"cpu"}
+			receiveAt(time.Minute, 1000, 1024)
+
+			ts, pods, err := smoothProv.Smoothed().GetContainerMetrics(apitypes.NamespacedName{Name: "pod1", Namespace: "ns1"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pods[0]).NotTo(BeNil())
+			Expect(ts[0].Window).To(Equal(time.Minute))
+			Expect(ts[0].CorrectedResources).To(Equal([]string{"cpu"}))
+			Expect(ts[0].MemoryOverhead).To(Equal(overhead))
+		})
+
+		It("should start smoothing afresh after a restart, leaving it out until it has enough history again", func() {
+			receiveAt(0, 1000, 1024)
+			receiveAt(time.Minute, 1000, 1024)
+			_, pod := smoothed()
+			Expect(pod).To(Equal(usage(1000, 1024)))
+
+			By("restarting the container")
+			contStart = now.Add(time.Minute + 30*time.Second)
+			receiveAt(2*time.Minute, 200, 256)
+			node, pod := smoothed()
+			Expect(pod).To(BeNil())
+			Expect(node).To(Equal(usage(600, 640)))
+
+			By("serving its fresh average once it has enough history")
+			receiveAt(3*time.Minute, 200, 256)
+			_, pod = smoothed()
+			Expect(pod).To(Equal(usage(200, 256)))
+		})
+	})
+
+	Context("when expecting data after startup", func() {
+		// statusOf converts an error into the API status it'd be served as.
+		statusOf := func(err error) metav1.Status {
+			statusErr, ok := err.(apierrors.APIStatus)
+			Expect(ok).To(BeTrue(), "expected an API status error, got %v", err)
+			return statusErr.Status()
+		}
+
+		BeforeEach(func() {
+			provSink, prov = NewSinkProviderExpectingData(time.Now().Add(30 * time.Second))
+		})
+
+		It("should report service unavailable, with the time until the first cycle, during cold start", func() {
+			err := provider.CheckPopulated(prov)
+			Expect(err).To(HaveOccurred())
+			status := statusOf(err)
+			Expect(status.Code).To(Equal(int32(http.StatusServiceUnavailable)))
+			Expect(status.Details.RetryAfterSeconds).To(BeNumerically("~", 30, 1))
+		})
+
+		It("should ask clients to retry after at least a second once the first cycle is overdue", func() {
+			provSink, prov = NewSinkProviderExpectingData(time.Now().Add(-time.Minute))
+			Expect(statusOf(provider.CheckPopulated(prov)).Details.RetryAfterSeconds).To(Equal(int32(1)))
+		})
+
+		It("should behave normally after the first cycle, even if it had no metrics", func() {
+			Expect(provSink.Receive(&sources.MetricsBatch{})).To(Succeed())
+			Expect(provider.CheckPopulated(prov)).To(Succeed())
+		})
+
+		It("should count a batch restored from a snapshot as populated", func() {
+			restored, err := snapshot.Decode(snapshot.Encode(batch))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provSink.Receive(restored)).To(Succeed())
+
+			Expect(provider.CheckPopulated(prov)).To(Succeed())
+			_, nodeMetrics, err := prov.GetNodeMetrics("node1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nodeMetrics[0]).NotTo(BeNil())
+		})
+
+		It("should not report being unpopulated when not expecting data", func() {
+			_, prov = NewSinkProvider()
+			Expect(provider.CheckPopulated(prov)).To(Succeed())
+		})
+	})
+
+	It("should keep serving a snapshot's data after newer batches are committed", func() {
+		By("committing a batch and pinning a snapshot of it")
+		Expect(provSink.Receive(batch)).To(Succeed())
+		snapshot := prov.(provider.SnapshotProvider).Snapshot()
+
+		By("committing a newer batch")
+		newer, names := benchmarkBatch(2, now.Add(time.Minute))
+		Expect(provSink.Receive(newer)).To(Succeed())
+
+		By("verifying that the snapshot still has the original data")
+		ts, nodeMetrics, err := snapshot.GetNodeMetrics("node1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nodeMetrics[0]).NotTo(BeNil())
+		Expect(ts[0].Timestamp).To(Equal(batch.Nodes[0].Timestamp))
+		_, podMetrics, err := snapshot.GetContainerMetrics(names[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics[0]).To(BeNil())
+
+		By("verifying that the provider itself serves the newer data")
+		_, podMetrics, err = prov.GetContainerMetrics(names[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(podMetrics[0]).NotTo(BeNil())
+	})
+
+	It("should give each committed batch a higher resource version, kept by its snapshots", func() {
+		versioned := prov.(provider.VersionedProvider)
+		last := versioned.ResourceVersion()
+		Expect(last).NotTo(BeZero())
+		var snapshots []provider.MetricsProvider
+		for i := 0; i < 3; i++ {
+			Expect(provSink.Receive(batch)).To(Succeed())
+			version := versioned.ResourceVersion()
+			Expect(version).To(BeNumerically(">", last))
+			last = version
+
+			snapshot := prov.(provider.SnapshotProvider).Snapshot()
+			Expect(snapshot.(provider.VersionedProvider).ResourceVersion()).To(Equal(version))
+			snapshots = append(snapshots, snapshot)
+		}
+		Expect(snapshots[0].(provider.VersionedProvider).ResourceVersion()).To(BeNumerically("<", last))
+
+		By("not versioning rejected batches")
+		duplicate := &sources.MetricsBatch{Nodes: []sources.NodeMetricsPoint{batch.Nodes[0], batch.Nodes[0]}}
+		Expect(provSink.Receive(duplicate)).NotTo(Succeed())
+		Expect(versioned.ResourceVersion()).To(Equal(last))
+
+		By("starting from a higher version after a restart")
+		_, restarted := NewSinkProvider()
+		Expect(restarted.(provider.VersionedProvider).ResourceVersion()).To(BeNumerically(">", last))
+	})
+
+	It("should serve internally consistent responses from pinned snapshots during concurrent commits", func() {
+		const (
+			numPods    = 50
+			numCommits = 200
+			numReaders = 4
+		)
+		initial, names := benchmarkBatch(numPods, now)
+		Expect(provSink.Receive(initial)).To(Succeed())
+		snapshots := prov.(provider.SnapshotProvider)
+
+		By("committing batches from successive cycles, while concurrently reading pinned snapshots piecemeal")
+		done := make(chan struct{})
+		readerErrs := make(chan error, numReaders)
+		for r := 0; r < numReaders; r++ {
+			go func() {
+				defer GinkgoRecover()
+				for {
+					select {
+					case <-done:
+						readerErrs <- nil
+						return
+					default:
+					}
+					// read the pods one at a time, like a handler serving items individually would
+					snapshot := snapshots.Snapshot()
+					var cycle time.Time
+					for i, name := range names {
+						ts, podMetrics, err := snapshot.GetContainerMetrics(name)
+						if err != nil {
+							readerErrs <- err
+							return
+						}
+						if podMetrics[0] == nil {
+							readerErrs <- fmt.Errorf("pod %s missing from snapshot", name)
+							return
+						}
+						if i == 0 {
+							cycle = ts[0].Timestamp
+						} else if !ts[0].Timestamp.Equal(cycle) {
+							readerErrs <- fmt.Errorf("pod %s is from cycle %v, but pod %s is from cycle %v", name, ts[0].Timestamp, names[0], cycle)
+							return
+						}
+					}
+				}
+			}()
+		}
+		for i := 1; i <= numCommits; i++ {
+			cycleBatch, _ := benchmarkBatch(numPods, now.Add(time.Duration(i)*time.Second))
+			Expect(provSink.Receive(cycleBatch)).To(Succeed())
+		}
+		close(done)
+
+		By("verifying that every response came from a single cycle")
+		for r := 0; r < numReaders; r++ {
+			Expect(<-readerErrs).NotTo(HaveOccurred())
+		}
+	})
 })
+
+// benchmarkBatch generates a batch with a single namespace of the given number of pods, all collected at the given time.
+func benchmarkBatch(numPods int, now time.Time) (*sources.MetricsBatch, []apitypes.NamespacedName) {
+	batch := &sources.MetricsBatch{Pods: make([]sources.PodMetricsPoint, numPods)}
+	names := make([]apitypes.NamespacedName, numPods)
+	for i := range batch.Pods {
+		names[i] = apitypes.NamespacedName{Name: fmt.Sprintf("pod%d", i), Namespace: "ns1"}
+		batch.Pods[i] = sources.PodMetricsPoint{Name: names[i].Name, Namespace: names[i].Namespace, Containers: []sources.ContainerMetricsPoint{
+			{Name: "container1", MetricsPoint: newMilliPoint(now, int64(100+i), int64(200+i))},
+			{Name: "container2", MetricsPoint: newMilliPoint(now, int64(300+i), int64(400+i))},
+		}}
+	}
+	return batch, names
+}
+
+func BenchmarkGetContainerMetrics5kPods(b *testing.B) {
+	batch, names := benchmarkBatch(5000, time.Now())
+	provSink, prov := NewSinkProvider()
+	if err := provSink.Receive(batch); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := prov.GetContainerMetrics(names...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sink
+
+import (
+	"math"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	metrics "k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// Smoothed usage is an exponentially weighted moving average of the CPU and memory usage of each
+// node and container, updated as each batch is committed: the weight of each older sample halves
+// every half-life, however often batches are committed.  Averages start afresh (from the latest
+// usage) for new nodes and containers, and for those which restarted since their average started,
+// as told by the start times reported with their metrics.  Anything whose average started less than
+// a half-life ago is left out of the smoothed view, since its average is still mostly its latest usage.
+
+// smoothedUsage is the smoothed usage of a node or container.
+type smoothedUsage struct {
+	// cpu is the smoothed CPU usage, in cores, and memory is the smoothed memory usage, in bytes.
+	cpu, memory float64
+	// since is the time of the first sample in the average.
+	since time.Time
+}
+
+// smooth folds the given point, sampled at the given time, into the previous smoothed usage
+// sampled at prevTime, returning the new smoothed usage.  The previous usage is zero if the
+// node or container is new.
+func smooth(prev smoothedUsage, prevTime time.Time, point sources.MetricsPoint, sampleTime time.Time, halfLife time.Duration) smoothedUsage {
+	cpu, memory := float64(point.CpuUsage.MilliValue())/1000, float64(point.MemoryUsage.Value())
+	if prev.since.IsZero() || point.StartTime.After(prev.since) {
+		return smoothedUsage{cpu: cpu, memory: memory, since: sampleTime}
+	}
+	elapsed := sampleTime.Sub(prevTime)
+	if elapsed <= 0 {
+		// the same sample (e.g. of a node which couldn't be scraped) isn't counted twice
+		return prev
+	}
+	alpha := 1 - math.Exp2(-float64(elapsed)/float64(halfLife))
+	return smoothedUsage{
+		cpu:    prev.cpu + alpha*(cpu-prev.cpu),
+		memory: prev.memory + alpha*(memory-prev.memory),
+		since:  prev.since,
+	}
+}
+
+// usage returns the smoothed usage as a resource list.
+func (s smoothedUsage) usage() corev1.ResourceList {
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    *resource.NewMilliQuantity(int64(math.Round(s.cpu*1000)), resource.DecimalSI),
+		corev1.ResourceMemory: *translate.FloatBytes("smoothed memory usage", s.memory),
+	}
+}
+
+// smoothNode returns the smoothed usage of the given node point, from its previous entry
+// (which is empty if the node is new).
+func smoothNode(prev nodeEntry, point sources.NodeMetricsPoint, halfLife time.Duration) smoothedUsage {
+	return smooth(prev.smoothed, prev.timeInfo.Timestamp, point.MetricsPoint, point.Timestamp, halfLife)
+}
+
+// smoothPod returns the smoothed usage of each container of the given new pod entry, in the
+// same order as its containers, from the previous entry (which is empty if the pod is new).
+// Every container is sampled at the pod's sample time, which is what its averages are weighted by.
+func smoothPod(entry podEntry, prev podEntry, point sources.PodMetricsPoint, halfLife time.Duration) []smoothedUsage {
+	points := make(map[string]sources.MetricsPoint, len(point.Containers))
+	for _, contPoint := range point.Containers {
+		points[contPoint.Name] = contPoint.MetricsPoint
+	}
+	prevUsages := make(map[string]smoothedUsage, len(prev.smoothed))
+	for i, usage := range prev.smoothed {
+		prevUsages[prev.containers[i].Name] = usage
+	}
+	res := make([]smoothedUsage, len(entry.containers))
+	for i, container := range entry.containers {
+		res[i] = smooth(prevUsages[container.Name], prev.timeInfo.Timestamp, points[container.Name], entry.timeInfo.Timestamp, halfLife)
+	}
+	return res
+}
+
+// smoothedSnapshot is the smoothed view of a storageSnapshot.
+type smoothedSnapshot struct {
+	*storageSnapshot
+}
+
+var _ provider.SmoothingProvider = &sinkMetricsProvider{}
+var _ provider.SmoothingProvider = &storageSnapshot{}
+var _ provider.VersionedProvider = smoothedSnapshot{}
+var _ provider.PodListingProvider = smoothedSnapshot{}
+
+// Smoothed returns the smoothed view of the most recently committed batch,
+// or nil if smoothing is disabled.
+func (p *sinkMetricsProvider) Smoothed() provider.MetricsProvider {
+	p.mu.RLock()
+	current := p.current
+	p.mu.RUnlock()
+	return current.Smoothed()
+}
+
+// Smoothed returns the smoothed view of the snapshot, or nil if smoothing is disabled.
+func (s *storageSnapshot) Smoothed() provider.MetricsProvider {
+	if s.halfLife <= 0 {
+		return nil
+	}
+	return smoothedSnapshot{s}
+}
+
+// settled checks if an average which started at the given time, and was last
+// updated at the given sample time, has enough history to be served.
+func (s smoothedSnapshot) settled(since, sampleTime time.Time) bool {
+	return !since.IsZero() && sampleTime.Sub(since) >= s.halfLife
+}
+
+// GetNodeMetrics returns the smoothed usage of the given nodes, whose window is the half-life.
+func (s smoothedSnapshot) GetNodeMetrics(nodes ...string) ([]provider.TimeInfo, []corev1.ResourceList, error) {
+	timestamps := make([]provider.TimeInfo, len(nodes))
+	resMetrics := make([]corev1.ResourceList, len(nodes))
+	for i, node := range nodes {
+		entry, present := s.nodes[node]
+		if !present || !s.settled(entry.smoothed.since, entry.timeInfo.Timestamp) {
+			continue
+		}
+		timestamps[i] = entry.timeInfo
+		timestamps[i].Window = s.halfLife
+		resMetrics[i] = entry.smoothed.usage()
+	}
+	return timestamps, resMetrics, nil
+}
+
+// GetContainerMetrics returns the smoothed usage of the containers of the given pods, whose
+// window is the half-life.  Pods with any container whose average hasn't settled are missing.
+// The rest of their time info (e.g. the resources corrected, and the memory overhead) is that
+// of their latest sample.
+func (s smoothedSnapshot) GetContainerMetrics(pods ...apitypes.NamespacedName) ([]provider.TimeInfo, [][]metrics.ContainerMetrics, error) {
+	timestamps := make([]provider.TimeInfo, len(pods))
+	resMetrics := make([][]metrics.ContainerMetrics, len(pods))
+	for i, pod := range pods {
+		entry, present := s.pods[pod]
+		if !present || len(entry.smoothed) != len(entry.containers) {
+			continue
+		}
+		containers := make([]metrics.ContainerMetrics, len(entry.containers))
+		settled := true
+		for j, usage := range entry.smoothed {
+			if !s.settled(usage.since, entry.timeInfo.Timestamp) {
+				settled = false
+				break
+			}
+			containers[j] = metrics.ContainerMetrics{Name: entry.containers[j].Name, Usage: usage.usage()}
+		}
+		if !settled {
+			continue
+		}
+		timestamps[i] = entry.timeInfo
+		timestamps[i].Window = s.halfLife
+		resMetrics[i] = containers
+	}
+	return timestamps, resMetrics, nil
+}
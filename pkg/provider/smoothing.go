@@ -0,0 +1,100 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// SmoothingParam is the query parameter choosing whether gets and lists of node and pod
+// metrics serve the latest usage, or usage smoothed over a longer window.
+const SmoothingParam = "smoothing"
+
+// Smoothing is a way of smoothing the usage served.
+type Smoothing string
+
+const (
+	// SmoothingNone serves the latest usage, and is the default.
+	SmoothingNone Smoothing = ""
+	// SmoothingExponential serves an exponentially weighted moving average of the usage,
+	// for consumers which would rather not react to short spikes.
+	SmoothingExponential Smoothing = "exponential"
+)
+
+// SmoothingProvider is a MetricsProvider which can also serve smoothed CPU and memory usage.
+type SmoothingProvider interface {
+	MetricsProvider
+	// Smoothed returns a view of the provider's data serving the smoothed usage of each node
+	// and container, or nil if smoothing is disabled.  Nodes and pods without enough history
+	// to be smoothed are missing from it.
+	Smoothed() MetricsProvider
+}
+
+type smoothingKey struct{}
+
+// WithSmoothing records the raw value of the SmoothingParam for the request.
+func WithSmoothing(ctx context.Context, smoothing string) context.Context {
+	return context.WithValue(ctx, smoothingKey{}, smoothing)
+}
+
+// SmoothingFrom returns the smoothing requested by the SmoothingParam recorded for the request,
+// or a bad request error if it's not a known smoothing, or the given provider can't serve it.
+func SmoothingFrom(ctx context.Context, prov interface{}) (Smoothing, error) {
+	raw, _ := ctx.Value(smoothingKey{}).(string)
+	switch smoothing := Smoothing(raw); smoothing {
+	case SmoothingNone:
+		return smoothing, nil
+	case SmoothingExponential:
+		if smoothed := smoothedView(prov); smoothed == nil {
+			return "", errors.NewBadRequest(fmt.Sprintf("%q smoothing isn't enabled on this server", smoothing))
+		}
+		return smoothing, nil
+	default:
+		return "", errors.NewBadRequest(fmt.Sprintf("unknown %q value %q: usage may only be smoothed with %q", SmoothingParam, raw, SmoothingExponential))
+	}
+}
+
+// SmoothedFrom returns the smoothed view of the given provider if the request asked for
+// smoothed usage (and the provider can serve it), or nil if the latest usage is wanted.
+func SmoothedFrom(ctx context.Context, prov interface{}) MetricsProvider {
+	if raw, _ := ctx.Value(smoothingKey{}).(string); Smoothing(raw) != SmoothingExponential {
+		return nil
+	}
+	return smoothedView(prov)
+}
+
+// smoothedView returns the smoothed view of the given provider, if it has one.
+func smoothedView(prov interface{}) MetricsProvider {
+	smoothing, ok := prov.(SmoothingProvider)
+	if !ok {
+		return nil
+	}
+	return smoothing.Smoothed()
+}
+
+// WithSmoothingParam wraps the given handler, recording the SmoothingParam of requests
+// in their contexts, since the storage doesn't see the raw query otherwise.
+func WithSmoothingParam(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if smoothing := req.URL.Query().Get(SmoothingParam); smoothing != "" {
+			req = req.WithContext(WithSmoothing(req.Context(), smoothing))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
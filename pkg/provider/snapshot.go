@@ -0,0 +1,51 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"net/http"
+)
+
+// SnapshotProvider is a MetricsProvider which can pin its current data,
+// so that several reads see the same collection, regardless of any
+// data committed in between.
+type SnapshotProvider interface {
+	MetricsProvider
+	// Snapshot returns an immutable view of the provider's current data.
+	Snapshot() MetricsProvider
+}
+
+type snapshotKey struct{}
+
+// WithSnapshot records a pinned snapshot in the context.
+func WithSnapshot(ctx context.Context, snapshot MetricsProvider) context.Context {
+	return context.WithValue(ctx, snapshotKey{}, snapshot)
+}
+
+// SnapshotFrom fetches the pinned snapshot from the context, if present.
+func SnapshotFrom(ctx context.Context) MetricsProvider {
+	snapshot, _ := ctx.Value(snapshotKey{}).(MetricsProvider)
+	return snapshot
+}
+
+// WithPinnedSnapshot wraps the given handler, pinning a snapshot of the given
+// provider at the start of each request and carrying it in the request context,
+// so that everything served by the request comes from a single collection.
+func WithPinnedSnapshot(handler http.Handler, prov SnapshotProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req.WithContext(WithSnapshot(req.Context(), prov.Snapshot())))
+	})
+}
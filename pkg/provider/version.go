@@ -0,0 +1,88 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Resource versions of NodeMetrics and PodMetrics identify the committed batch (the snapshot)
+// they were served from.  Every object served from a snapshot, and every list, carries that
+// snapshot's version, and each snapshot committed has a higher version than the last, so
+// clients can tell if anything has changed since they last looked by comparing versions (or
+// by asking for the version they saw, and getting a 410 once it's been replaced).  Following
+// Kubernetes conventions for lists and gets:
+//
+//   - an unset resourceVersion, or "0", is served from the current snapshot;
+//   - the resourceVersion of the current snapshot is served from it;
+//   - older resource versions fail with 410 Gone (ResourceExpired), since only the current
+//     snapshot is retained, and newer ones fail with 504 (Timeout), to be retried.
+//
+// Versions are only comparable between objects served by the same replica, and pages of a
+// list are each served from the snapshot current at the time, with its version.  Watches
+// aren't supported.
+
+// VersionedProvider is implemented by MetricsProviders (and their snapshots)
+// whose data has a resource version, which increases with each commit.
+type VersionedProvider interface {
+	// ResourceVersion returns the version of the data currently served.
+	ResourceVersion() uint64
+}
+
+// PinVersion pins the current snapshot of the given provider (which may be nil) for the
+// request, unless one's pinned already, returning the context to serve the request with,
+// and the resource version to stamp on everything served from it.  The snapshot is checked
+// against the requested resource version, failing as described above if it doesn't match.
+// Unversioned providers ignore the requested version, and return an empty one.
+func PinVersion(ctx context.Context, snapshots SnapshotProvider, requested string) (context.Context, string, error) {
+	snapshot := SnapshotFrom(ctx)
+	if snapshot == nil && snapshots != nil {
+		snapshot = snapshots.Snapshot()
+		ctx = WithSnapshot(ctx, snapshot)
+	}
+	versioned, ok := snapshot.(VersionedProvider)
+	if !ok {
+		return ctx, "", nil
+	}
+	current := versioned.ResourceVersion()
+	if requested == "" || requested == "0" {
+		return ctx, strconv.FormatUint(current, 10), nil
+	}
+	version, err := strconv.ParseUint(requested, 10, 64)
+	if err != nil {
+		return nil, "", errors.NewBadRequest(fmt.Sprintf("invalid resourceVersion %q: metrics resource versions are unsigned integers", requested))
+	}
+	switch {
+	case version < current:
+		return nil, "", errors.NewResourceExpired(fmt.Sprintf("too old resource version: %d (%d)", version, current))
+	case version > current:
+		return nil, "", errors.NewTimeoutError(fmt.Sprintf("Too large resource version: %d, current: %d", version, current), 1)
+	}
+	return ctx, strconv.FormatUint(current, 10), nil
+}
+
+// ResourceVersionOf returns the resource version to stamp on data served by
+// the given provider (or snapshot), or an empty one if it's unversioned.
+func ResourceVersionOf(prov interface{}) string {
+	versioned, ok := prov.(VersionedProvider)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(versioned.ResourceVersion(), 10)
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scrapeaudit writes an audit log of every request metrics-server makes to the
+// Kubelets, as JSON lines, for environments that must account for every outbound connection.
+// Records are queued and written asynchronously, so that a slow filesystem never holds up
+// scrapes: records that don't fit in the queue are dropped (and counted) instead.  The log is
+// rotated by size, and synced to disk whenever it's rotated, and when the writer's closed.
+package scrapeaudit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/asyncqueue"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+const (
+	// DefaultMaxSizeBytes is the default size beyond which the log is rotated.
+	DefaultMaxSizeBytes = 100 << 20
+	// DefaultMaxBackups is the default number of rotated logs kept.
+	DefaultMaxBackups = 5
+	// DefaultQueueSize is the default number of records which may be waiting to be written.
+	DefaultQueueSize = 10000
+
+	// errorLogInterval is the minimum time between logged write errors, so that a
+	// broken filesystem doesn't log an error for every record.
+	errorLogInterval = time.Minute
+)
+
+var (
+	recordsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "scrape_audit",
+			Name:      "records_dropped_total",
+			Help:      "The number of scrape audit records dropped, because the queue of records waiting to be written was full, the log was closed, or it couldn't be written",
+		},
+	)
+	writeErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "scrape_audit",
+			Name:      "write_errors_total",
+			Help:      "The number of errors writing, syncing, or rotating the scrape audit log",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recordsDropped)
+	prometheus.MustRegister(writeErrors)
+}
+
+// Record is a single line of the audit log, describing one request to a Kubelet.
+type Record struct {
+	// Timestamp is when the request was made.
+	Timestamp time.Time `json:"timestamp"`
+	Node      string    `json:"node"`
+	URL       string    `json:"url"`
+	// Endpoint is the Kubelet endpoint requested ("summary" or "cadvisor").
+	Endpoint string `json:"endpoint"`
+	// Reason and CycleID identify the operation that triggered the request.
+	Reason  string `json:"reason,omitempty"`
+	CycleID string `json:"cycleID,omitempty"`
+	// Status is the status of the response, or zero if none was received.
+	Status int `json:"status"`
+	// Bytes is the size of the response body read.
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// ErrorClass classifies the error the request failed with (see summary.ErrorClass), if it did.
+	ErrorClass string `json:"errorClass,omitempty"`
+}
+
+// File is an open audit log.
+type File interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// Options configures a Writer.
+type Options struct {
+	// Path is the path of the log.  Rotated logs are kept alongside it, as Path.1
+	// (the most recent) to Path.MaxBackups.
+	Path string
+	// MaxSizeBytes is the size beyond which the log is rotated.  Zero means it's never rotated.
+	MaxSizeBytes int64
+	// MaxBackups is the number of rotated logs kept.  Zero discards the log when it's rotated.
+	MaxBackups int
+	// QueueSize is the number of records which may be waiting to be written,
+	// beyond which records are dropped.  It defaults to DefaultQueueSize.
+	QueueSize int
+	// OpenFile, if set, opens the log for appending, in place of os.OpenFile (e.g. for tests).
+	OpenFile func(path string) (File, error)
+}
+
+// Writer writes the requests it observes to an audit log.  It's a summary.RequestObserver.
+type Writer struct {
+	opts    Options
+	queue   *asyncqueue.Queue
+	dropped uint64
+
+	// the following are only used by the goroutine writing the log (and New)
+	file     File
+	buf      *bufio.Writer
+	size     int64
+	closeErr error
+	// lastErrorLogged is when a write error was last logged.
+	lastErrorLogged time.Time
+}
+
+var _ summary.RequestObserver = &Writer{}
+
+// New opens the log with the given options, and starts writing to it.
+// The log must be closed with Close to flush and sync the last records.
+func New(opts Options) (*Writer, error) {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.OpenFile == nil {
+		opts.OpenFile = openFile
+	}
+	w := &Writer{opts: opts}
+	if err := w.open(); err != nil {
+		return nil, fmt.Errorf("unable to open scrape audit log %q: %v", opts.Path, err)
+	}
+	w.queue = asyncqueue.New(asyncqueue.Options{
+		Size: opts.QueueSize,
+		// flush whenever the queue's drained
+		Handle: func(record interface{}, drained bool) {
+			w.write(record.(Record))
+			if drained {
+				w.flush()
+			}
+		},
+		Stop: func() {
+			w.closeErr = w.closeFile()
+		},
+		Drop: func(string) {
+			w.drop()
+		},
+	})
+	return w, nil
+}
+
+func openFile(path string) (File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+// ObserveRequest queues a record of the given request to be written,
+// dropping it if the queue's full (or the log's closed), so it never blocks.
+func (w *Writer) ObserveRequest(info summary.RequestInfo) {
+	record := Record{
+		Timestamp:       info.Start,
+		Node:            info.Node,
+		URL:             info.URL,
+		Endpoint:        info.Endpoint,
+		Reason:          string(info.Reason),
+		CycleID:         info.CycleID,
+		Status:          info.StatusCode,
+		Bytes:           info.Bytes,
+		DurationSeconds: info.Duration.Seconds(),
+	}
+	if info.Err != nil {
+		record.ErrorClass = summary.ErrorClass(info.Err)
+	}
+	w.queue.Push(record)
+}
+
+// Dropped returns the number of records dropped so far.
+func (w *Writer) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+func (w *Writer) drop() {
+	atomic.AddUint64(&w.dropped, 1)
+	recordsDropped.Inc()
+}
+
+// Close writes any queued records, then syncs and closes the log.  Records
+// observed afterwards are dropped.  It's safe to call more than once.
+func (w *Writer) Close() error {
+	w.queue.Close()
+	return w.closeErr
+}
+
+func (w *Writer) write(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		// can't happen, since records only contain strings and numbers
+		w.writeError("encode", err)
+		w.drop()
+		return
+	}
+	line = append(line, '\n')
+
+	if w.opts.MaxSizeBytes > 0 && w.size > 0 && w.size+int64(len(line)) > w.opts.MaxSizeBytes {
+		if err := w.rotate(); err != nil {
+			w.writeError("rotate", err)
+		}
+	}
+	if w.file == nil {
+		// try again for each record, in case whatever stopped us reopening it has cleared
+		if err := w.open(); err != nil {
+			w.writeError("reopen", err)
+			w.drop()
+			return
+		}
+	}
+	n, err := w.buf.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		w.writeError("write", err)
+		w.drop()
+		w.reset()
+	}
+}
+
+func (w *Writer) flush() {
+	if w.file == nil {
+		return
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.writeError("write", err)
+		w.reset()
+	}
+}
+
+// reset closes the log after a failed write, since the buffer stays failed,
+// so that it's reopened for the next record.
+func (w *Writer) reset() {
+	file := w.file
+	w.file = nil
+	file.Close()
+}
+
+// open opens the log, picking up from its current size.
+func (w *Writer) open() error {
+	file, err := w.opts.OpenFile(w.opts.Path)
+	if err != nil {
+		return err
+	}
+	w.size = 0
+	if info, err := os.Stat(w.opts.Path); err == nil {
+		w.size = info.Size()
+	}
+	w.file = file
+	w.buf = bufio.NewWriter(file)
+	return nil
+}
+
+// closeFile flushes, syncs, and closes the log, if it's open.
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	file := w.file
+	w.file = nil
+	err := w.buf.Flush()
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rotate closes the log, shifts it and its backups along, and opens a new one.
+func (w *Writer) rotate() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+	if w.opts.MaxBackups <= 0 {
+		if err := os.Remove(w.opts.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := w.opts.MaxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(backupPath(w.opts.Path, i), backupPath(w.opts.Path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(w.opts.Path, backupPath(w.opts.Path, 1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return w.open()
+}
+
+func backupPath(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+func (w *Writer) writeError(op string, err error) {
+	writeErrors.Inc()
+	if time.Since(w.lastErrorLogged) < errorLogInterval {
+		return
+	}
+	w.lastErrorLogged = time.Now()
+	glog.Errorf("unable to %s scrape audit log %q: %v", op, w.opts.Path, err)
+}
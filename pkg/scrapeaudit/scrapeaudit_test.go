@@ -0,0 +1,253 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scrapeaudit_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/scrapeaudit"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+func TestScrapeAudit(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Scrape Audit Suite")
+}
+
+// slowFile simulates a slow filesystem, blocking writes until released.
+type slowFile struct {
+	*os.File
+	release chan struct{}
+	writing chan struct{}
+	once    sync.Once
+
+	mu             sync.Mutex
+	synced, closed bool
+}
+
+func (f *slowFile) Write(p []byte) (int, error) {
+	f.once.Do(func() { close(f.writing) })
+	<-f.release
+	return f.File.Write(p)
+}
+
+func (f *slowFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.synced = true
+	return f.File.Sync()
+}
+
+func (f *slowFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return f.File.Close()
+}
+
+// request returns the info of a successful summary request for the given node.
+func request(node string) summary.RequestInfo {
+	return summary.RequestInfo{
+		Start:      time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+		Duration:   250 * time.Millisecond,
+		Node:       node,
+		URL:        "https://" + node + ":10250/stats/summary/",
+		Endpoint:   summary.EndpointSummary,
+		Reason:     sources.ScrapeReasonCycle,
+		CycleID:    "cycle1",
+		StatusCode: 200,
+		Bytes:      1234,
+	}
+}
+
+// readLines reads the lines of the given log, each decoded as a generic JSON object.
+func readLines(path string) []map[string]interface{} {
+	contents, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	var lines []map[string]interface{}
+	for _, line := range strings.SplitAfter(string(contents), "\n") {
+		if line == "" {
+			continue
+		}
+		Expect(line).To(HaveSuffix("\n"))
+		var obj map[string]interface{}
+		Expect(json.Unmarshal([]byte(line), &obj)).To(Succeed(), line)
+		lines = append(lines, obj)
+	}
+	return lines
+}
+
+// keys returns the keys of the given object.
+func keys(obj map[string]interface{}) []string {
+	var res []string
+	for key := range obj {
+		res = append(res, key)
+	}
+	return res
+}
+
+var _ = Describe("Scrape Audit Writer", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "scrape-audit")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "audit.jsonl")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should write a JSON object per line, with the documented schema", func() {
+		w, err := New(Options{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		w.ObserveRequest(request("node1"))
+		w.ObserveRequest(summary.RequestInfo{
+			Start:    time.Date(2018, 6, 1, 12, 0, 1, 500, time.UTC),
+			Duration: 3 * time.Second,
+			Node:     "node2",
+			URL:      "https://node2:10250/metrics/cadvisor",
+			Endpoint: summary.EndpointCadvisor,
+			Err:      &summary.ErrDial{},
+		})
+		Expect(w.Close()).To(Succeed())
+
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]).To(Equal(map[string]interface{}{
+			"timestamp":       "2018-06-01T12:00:00Z",
+			"node":            "node1",
+			"url":             "https://node1:10250/stats/summary/",
+			"endpoint":        "summary",
+			"reason":          "cycle",
+			"cycleID":         "cycle1",
+			"status":          200.0,
+			"bytes":           1234.0,
+			"durationSeconds": 0.25,
+		}))
+		Expect(keys(lines[1])).To(ConsistOf("timestamp", "node", "url", "endpoint", "status", "bytes", "durationSeconds", "errorClass"))
+		Expect(lines[1]["timestamp"]).To(Equal("2018-06-01T12:00:01.0000005Z"))
+		Expect(lines[1]["status"]).To(BeZero())
+		Expect(lines[1]["errorClass"]).To(Equal(summary.ErrorClassDial))
+	})
+
+	It("should append to an existing log", func() {
+		Expect(ioutil.WriteFile(path, []byte(`{"node":"earlier"}`+"\n"), 0600)).To(Succeed())
+		w, err := New(Options{Path: path})
+		Expect(err).NotTo(HaveOccurred())
+		w.ObserveRequest(request("node1"))
+		Expect(w.Close()).To(Succeed())
+
+		lines := readLines(path)
+		Expect(lines).To(HaveLen(2))
+		Expect(lines[0]["node"]).To(Equal("earlier"))
+		Expect(lines[1]["node"]).To(Equal("node1"))
+	})
+
+	It("should drop records rather than block when the filesystem is slow, syncing the rest on close", func() {
+		file := &slowFile{release: make(chan struct{}), writing: make(chan struct{})}
+		w, err := New(Options{
+			Path:      path,
+			QueueSize: 2,
+			OpenFile: func(path string) (File, error) {
+				var err error
+				file.File, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+				return file, err
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("getting the writer stuck writing the first record")
+		w.ObserveRequest(request("node0"))
+		Eventually(file.writing).Should(BeClosed())
+
+		By("observing more records than fit in the queue")
+		observed := make(chan struct{})
+		go func() {
+			defer close(observed)
+			for i := 1; i <= 10; i++ {
+				w.ObserveRequest(request(fmt.Sprintf("node%d", i)))
+			}
+		}()
+		Eventually(observed, time.Second).Should(BeClosed())
+		Expect(w.Dropped()).To(BeEquivalentTo(8))
+
+		By("writing the queued records once the filesystem catches up")
+		close(file.release)
+		Expect(w.Close()).To(Succeed())
+		var nodes []interface{}
+		for _, line := range readLines(path) {
+			nodes = append(nodes, line["node"])
+		}
+		Expect(nodes).To(Equal([]interface{}{"node0", "node1", "node2"}))
+		Expect(file.synced).To(BeTrue())
+		Expect(file.closed).To(BeTrue())
+
+		By("dropping records observed after it's closed")
+		w.ObserveRequest(request("node11"))
+		Expect(w.Dropped()).To(BeEquivalentTo(9))
+		Expect(w.Close()).To(Succeed())
+	})
+
+	It("should rotate the log once it reaches its maximum size, keeping the configured number of backups", func() {
+		lineSize := func() int64 {
+			line, err := json.Marshal(Record{
+				Timestamp: request("node00").Start, Node: "node00", URL: request("node00").URL, Endpoint: "summary",
+				Reason: "cycle", CycleID: "cycle1", Status: 200, Bytes: 1234, DurationSeconds: 0.25,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return int64(len(line) + 1)
+		}()
+		w, err := New(Options{Path: path, MaxSizeBytes: 3 * lineSize, MaxBackups: 2})
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 10; i++ {
+			w.ObserveRequest(request(fmt.Sprintf("node%02d", i)))
+		}
+		Expect(w.Close()).To(Succeed())
+
+		nodesIn := func(path string) []interface{} {
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Size()).To(BeNumerically("<=", 3*lineSize))
+			var nodes []interface{}
+			for _, line := range readLines(path) {
+				nodes = append(nodes, line["node"])
+			}
+			return nodes
+		}
+		Expect(nodesIn(path)).To(Equal([]interface{}{"node09"}))
+		Expect(nodesIn(path + ".1")).To(Equal([]interface{}{"node06", "node07", "node08"}))
+		Expect(nodesIn(path + ".2")).To(Equal([]interface{}{"node03", "node04", "node05"}))
+		_, err = os.Stat(path + ".3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
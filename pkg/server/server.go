@@ -0,0 +1,319 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server assembles metrics-server's scraper, storage, and providers into a Server that
+// can be run on its own, by the metrics-server binary, or embedded in another binary (such as
+// an all-in-one distribution), which can serve the metrics API through its own API server.
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver"
+	"github.com/kubernetes-incubator/metrics-server/pkg/apiserver/generic"
+	"github.com/kubernetes-incubator/metrics-server/pkg/informersync"
+	"github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+)
+
+const (
+	// DefaultMetricResolution is the default interval at which metrics are scraped.
+	DefaultMetricResolution = 60 * time.Second
+	// DefaultKubeletPort is the default port that the Kubelets are connected to on.
+	DefaultKubeletPort = 10250
+)
+
+// Config configures a Server.  Only the connection to the API server is required.
+type Config struct {
+	// RESTConfig connects to the API server, to list and watch nodes and pods, and, unless
+	// Kubelet is set, to derive the configuration of the client connecting to the Kubelets.
+	RESTConfig *rest.Config
+	// KubeClient, if non-nil, is used instead of a client constructed from RESTConfig.
+	KubeClient kubernetes.Interface
+	// Informers, if non-nil, is the shared informer factory to list nodes and pods with
+	// (e.g. the embedding binary's own), instead of a new one.
+	Informers informers.SharedInformerFactory
+
+	// Kubelet configures the client connecting to the Kubelets.  If nil, the Kubelets are
+	// connected to directly on DefaultKubeletPort, with the credentials of RESTConfig.
+	Kubelet *summary.KubeletClientConfig
+	// AddressResolver, if non-nil, finds the address to connect to each node's Kubelet at,
+	// instead of the address of the first of summary.DefaultAddressTypePriority it has.
+	AddressResolver summary.NodeAddressResolver
+	// SourceOptions configures the summary sources scraping the Kubelets.
+	SourceOptions summary.SourceOptions
+	// NodeFilter, if non-nil, restricts the nodes scraped to those it accepts.
+	NodeFilter sources.NodeFilter
+
+	// MetricResolution is the interval at which metrics are scraped, DefaultMetricResolution
+	// if zero.
+	MetricResolution time.Duration
+	// MaxMetricResolution, if non-zero, is the longest interval that the resolution may be
+	// stretched to (see manager.Manager.EnableAutoResolution), which sizes the duration
+	// histograms.
+	MaxMetricResolution time.Duration
+	// ScrapeTimeout bounds each scrape, tuning.ScrapeTimeoutFor(MetricResolution) if zero.
+	ScrapeTimeout time.Duration
+	// ScrapeOrdering, if non-nil, staggers the start of each cycle's scrapes, instead of
+	// sources.RandomOrdering.
+	ScrapeOrdering sources.ScrapeOrdering
+
+	// InformerSyncTimeout is how long Run waits for the node informer to sync before
+	// diagnosing why it hasn't, informersync.DefaultTimeout if zero.
+	InformerSyncTimeout time.Duration
+	// DegradedOnInformerSyncFailure keeps Run running if the node informer fails to sync,
+	// with the metrics API unavailable until it does, rather than returning the failure.
+	DegradedOnInformerSyncFailure bool
+
+	// Serving, if non-nil, is the configuration of the API server (and its listeners) for Run
+	// to serve the metrics API with.  If nil, nothing is served, and the embedding binary can
+	// serve the metrics API itself, with ProviderConfig or APIGroupInfo.
+	Serving *apiserver.Config
+}
+
+// Server collects metrics from the Kubelets, storing them to be served by the metrics API.
+type Server struct {
+	config        Config
+	kubeClient    kubernetes.Interface
+	informers     informers.SharedInformerFactory
+	kubeletClient summary.KubeletInterface
+	addrResolver  summary.NodeAddressResolver
+	sourceManager sources.MetricSource
+	sink          sink.MetricSink
+	provider      provider.MetricsProvider
+	manager       *manager.Manager
+	nodeSync      *informersync.Status
+	// providers holds the providers to serve, in Serving, if set.
+	providers *generic.ProviderConfig
+
+	syncedHooks  []func() error
+	servingHooks []func(server *apiserver.MetricsServer) error
+}
+
+// registerDurationMetrics registers the duration histograms of the source manager and
+// manager, whose buckets are sized for the first server in the process.
+var registerDurationMetrics sync.Once
+
+// NewServer constructs a new Server from the given config, which it takes ownership of.
+func NewServer(config Config) (*Server, error) {
+	if config.MetricResolution == 0 {
+		config.MetricResolution = DefaultMetricResolution
+	}
+	if config.ScrapeTimeout == 0 {
+		config.ScrapeTimeout = tuning.ScrapeTimeoutFor(config.MetricResolution)
+	}
+	if config.ScrapeOrdering == nil {
+		config.ScrapeOrdering = sources.RandomOrdering()
+	}
+	if config.InformerSyncTimeout == 0 {
+		config.InformerSyncTimeout = informersync.DefaultTimeout
+	}
+	s := &Server{config: config, kubeClient: config.KubeClient, informers: config.Informers, addrResolver: config.AddressResolver}
+
+	if s.kubeClient == nil {
+		if config.RESTConfig == nil {
+			return nil, fmt.Errorf("either a REST config or a client is required to connect to the API server")
+		}
+		var err error
+		s.kubeClient, err = kubernetes.NewForConfig(config.RESTConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct lister client: %v", err)
+		}
+	}
+	if s.informers == nil {
+		// we should never need to resync, since we're not worried about missing events,
+		// and resync is actually for regular interval-based reconciliation these days,
+		// so set the default resync interval to 0
+		s.informers = informers.NewSharedInformerFactory(s.kubeClient, 0)
+	}
+	nodes := s.informers.Core().V1().Nodes()
+
+	kubeletConfig := config.Kubelet
+	if kubeletConfig == nil {
+		if config.RESTConfig == nil {
+			return nil, fmt.Errorf("either a REST config or a Kubelet client config is required to connect to the Kubelets")
+		}
+		kubeletConfig = summary.GetKubeletConfig(config.RESTConfig, DefaultKubeletPort, false, false, false)
+	}
+	var err error
+	s.kubeletClient, err = summary.KubeletClientFor(kubeletConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct a client to connect to the kubelets: %v", err)
+	}
+	if s.addrResolver == nil {
+		s.addrResolver = summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority)
+	}
+
+	// the summary source scrapes every node not claimed by a compiled-in source
+	summaryFactory := summary.NewProviderFactory(s.kubeletClient, s.addrResolver, config.SourceOptions)
+	registrations := sources.Registrations()
+	if config.NodeFilter != nil {
+		summaryFactory = sources.FilteredFactory(summaryFactory, config.NodeFilter)
+		for i := range registrations {
+			registrations[i].Factory = sources.FilteredFactory(registrations[i].Factory, config.NodeFilter)
+		}
+	}
+	sourceProvider, err := sources.NewRegisteredSourceProvider(nodes.Lister(), summaryFactory, registrations)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up metrics sources: %v", err)
+	}
+	registerDurationMetrics.Do(func() {
+		sources.RegisterDurationMetrics(config.ScrapeTimeout)
+		if config.MaxMetricResolution != 0 {
+			manager.RegisterDurationMetrics(config.MaxMetricResolution)
+		} else {
+			manager.RegisterDurationMetrics(config.MetricResolution)
+		}
+	})
+	s.sourceManager = sources.NewOrderedSourceManager(sourceProvider, config.ScrapeTimeout, config.ScrapeOrdering)
+
+	// the first cycle starts after one resolution, and takes up to the scrape timeout
+	s.sink, s.provider = provsink.NewSinkProviderExpectingData(time.Now().Add(config.MetricResolution + config.ScrapeTimeout))
+	s.manager = manager.NewManager(s.sourceManager, s.sink, config.MetricResolution)
+	s.manager.SetConfiguredScrapeTimeout(config.ScrapeTimeout)
+
+	// diagnose why the node informer hasn't synced (e.g. missing RBAC) if it doesn't
+	s.nodeSync = informersync.NewStatus("nodes", nodes.Informer().HasSynced, func() error {
+		_, err := s.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{Limit: 1})
+		return err
+	})
+
+	s.providers = &generic.ProviderConfig{}
+	if config.Serving != nil {
+		s.providers = &config.Serving.ProviderConfig
+	}
+	s.providers.Node = s.provider
+	s.providers.Pod = s.provider
+	s.providers.AvailabilityCheck = s.nodeSync.Available
+	return s, nil
+}
+
+// Run collects metrics until the given context is done, once the node informer has synced,
+// serving them if configured to (see Config.Serving).
+func (s *Server) Run(ctx context.Context) error {
+	stopCh := ctx.Done()
+	s.informers.Start(stopCh)
+	if err := s.nodeSync.Wait(s.config.InformerSyncTimeout, stopCh); err != nil {
+		if !s.config.DegradedOnInformerSyncFailure {
+			return err
+		}
+		glog.Warningf("continuing in degraded mode, serving 503s from the metrics API until the node informer syncs")
+	}
+	for _, hook := range s.syncedHooks {
+		if err := hook(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Serving == nil {
+		s.manager.RunUntil(stopCh)
+		<-stopCh
+		return nil
+	}
+
+	server, err := s.config.Serving.Complete(s.informers).New()
+	if err != nil {
+		return err
+	}
+	server.AddHealthzChecks(healthz.NamedCheck("healthz", s.manager.CheckHealth), healthz.NamedCheck("scrape-loop", s.manager.CheckLiveness), healthz.NamedCheck("node-informer", s.nodeSync.Check))
+	for _, hook := range s.servingHooks {
+		if err := hook(server); err != nil {
+			return err
+		}
+	}
+	// the apiserver runs the shared informer factory for us
+	s.manager.RunUntil(stopCh)
+	return server.GenericAPIServer.PrepareRun().Run(stopCh)
+}
+
+// AddSyncedHook adds a hook for Run to call once the node informer has synced (or failed to,
+// if degraded), before collecting or serving metrics.  Run fails with its error, if any.
+func (s *Server) AddSyncedHook(hook func() error) {
+	s.syncedHooks = append(s.syncedHooks, hook)
+}
+
+// AddServingHook adds a hook for Run to call with the API server once it's built, before it
+// runs (e.g. to add health checks or handlers), if serving.  Run fails with its error, if any.
+func (s *Server) AddServingHook(hook func(server *apiserver.MetricsServer) error) {
+	s.servingHooks = append(s.servingHooks, hook)
+}
+
+// ProviderConfig returns the providers to serve the metrics API from (those of Config.Serving,
+// if set), so that they can be configured further, or served by the embedding binary's own API
+// server (see generic.InstallStorage).
+func (s *Server) ProviderConfig() *generic.ProviderConfig {
+	return s.providers
+}
+
+// APIGroupInfo builds the storage for the metrics API, for installing into the embedding
+// binary's own API server (see genericapiserver.GenericAPIServer.InstallAPIGroup).
+func (s *Server) APIGroupInfo() genericapiserver.APIGroupInfo {
+	return generic.BuildStorage(s.providers, s.informers.Core().V1())
+}
+
+// Provider returns the provider of the stored node and pod metrics.
+func (s *Server) Provider() provider.MetricsProvider {
+	return s.provider
+}
+
+// Sink returns the sink storing the metrics collected, for registering observers with.
+func (s *Server) Sink() sink.MetricSink {
+	return s.sink
+}
+
+// Manager returns the manager scheduling the collection of metrics, for configuring further.
+func (s *Server) Manager() *manager.Manager {
+	return s.manager
+}
+
+// SourceManager returns the source scraping all the nodes, for configuring further.
+func (s *Server) SourceManager() sources.MetricSource {
+	return s.sourceManager
+}
+
+// KubeletClient returns the client connecting to the Kubelets.
+func (s *Server) KubeletClient() summary.KubeletInterface {
+	return s.kubeletClient
+}
+
+// AddressResolver returns the resolver of the address to connect to each node's Kubelet at.
+func (s *Server) AddressResolver() summary.NodeAddressResolver {
+	return s.addrResolver
+}
+
+// Informers returns the shared informer factory that nodes and pods are listed with.
+func (s *Server) Informers() informers.SharedInformerFactory {
+	return s.informers
+}
+
+// NodeSync returns the sync status of the node informer, which Run waits for.
+func (s *Server) NodeSync() *informersync.Status {
+	return s.nodeSync
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/fakefleet"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/server"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+func TestServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Server Suite")
+}
+
+// fakeAPIServer serves lists of the fleet's nodes and pods, holding watches open without any events.
+type fakeAPIServer struct {
+	fleet *fakefleet.Fleet
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.URL.Query().Get("watch") == "true" {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+		return
+	}
+
+	switch req.URL.Path {
+	case "/api/v1/nodes":
+		nodes, _ := f.fleet.NodeLister().List(labels.Everything())
+		list := &corev1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}, ListMeta: metav1.ListMeta{ResourceVersion: "1"}}
+		for _, node := range nodes {
+			list.Items = append(list.Items, *node)
+		}
+		json.NewEncoder(w).Encode(list)
+	case "/api/v1/pods":
+		pods, _ := f.fleet.PodLister().List(labels.Everything())
+		list := &corev1.PodList{TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"}, ListMeta: metav1.ListMeta{ResourceVersion: "1"}}
+		for _, pod := range pods {
+			list.Items = append(list.Items, *pod)
+		}
+		json.NewEncoder(w).Encode(list)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+var _ = Describe("Embedded Server", func() {
+	var (
+		fleet     *fakefleet.Fleet
+		apiServer *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		fleet, err = fakefleet.New(fakefleet.Config{Nodes: 3, PodsPerNode: 2, Seed: 1})
+		Expect(err).NotTo(HaveOccurred())
+		apiServer = httptest.NewServer(&fakeAPIServer{fleet: fleet})
+	})
+
+	AfterEach(func() {
+		apiServer.Close()
+		fleet.Close()
+	})
+
+	It("should collect the fleet's metrics without serving them, for the embedding binary to serve", func() {
+		srv, err := NewServer(Config{
+			RESTConfig: &rest.Config{Host: apiServer.URL},
+			Kubelet: &summary.KubeletClientConfig{
+				Port: 10250,
+				RESTConfig: &rest.Config{
+					Host: apiServer.URL,
+					TLSClientConfig: rest.TLSClientConfig{
+						CAData:     fleet.CAData(),
+						ServerName: fakefleet.ServerName,
+					},
+				},
+				Dial: fleet.Dial,
+			},
+			MetricResolution: time.Second,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("exposing the providers and storage for the embedding binary's API server")
+		providers := srv.ProviderConfig()
+		Expect(providers.Node).To(BeIdenticalTo(srv.Provider()))
+		Expect(providers.Pod).To(BeIdenticalTo(srv.Provider()))
+		info := srv.APIGroupInfo()
+		Expect(info.VersionedResourcesStorageMap["v1beta1"]).To(HaveKey("nodes"))
+		Expect(info.VersionedResourcesStorageMap["v1beta1"]).To(HaveKey("pods"))
+
+		By("running it until canceled")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- srv.Run(ctx) }()
+
+		By("collecting the metrics of every node in the fleet")
+		Eventually(func() int {
+			_, usages, err := srv.Provider().GetNodeMetrics("fake-node-0", "fake-node-1", "fake-node-2")
+			Expect(err).NotTo(HaveOccurred())
+			collected := 0
+			for _, usage := range usages {
+				if _, ok := usage[corev1.ResourceCPU]; ok {
+					collected++
+				}
+			}
+			return collected
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(3))
+
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
@@ -15,6 +15,12 @@
 package sink
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
 )
 
@@ -23,3 +29,123 @@ type MetricSink interface {
 	// Receive ingests a new batch of metrics.
 	Receive(*sources.MetricsBatch) error
 }
+
+// ResolutionAwareSink is a MetricSink which needs to know when batches are
+// being received less often than the configured metric resolution.
+type ResolutionAwareSink interface {
+	MetricSink
+	// SetResolutionStretch sets how much longer than the configured metric
+	// resolution the interval before each subsequently received batch may be.
+	SetResolutionStretch(stretch time.Duration)
+}
+
+// PodCountObserver is notified of the number of pods in each namespace
+// of each batch committed by a PodCountingSink.
+type PodCountObserver interface {
+	// PodsCommitted receives the number of pods in each namespace of the batch just committed.
+	// The counts must not be modified.
+	PodsCommitted(counts map[string]int)
+}
+
+// PodCountingSink is a MetricSink which can report the number of pods
+// in each namespace of the batches it commits.
+type PodCountingSink interface {
+	MetricSink
+	// ObservePodCounts registers an observer to be notified of the pod counts of each
+	// subsequently committed batch.  It must be called before any batches are received.
+	ObservePodCounts(observer PodCountObserver)
+}
+
+// PodUsageObserver is notified of the usage of each pod of each batch
+// committed by a PodUsageObservingSink.
+type PodUsageObserver interface {
+	// PodUsageCommitted receives the CPU and memory usage of each pod in the batch just
+	// committed, summed over its containers, by pod.  The usage must not be modified.
+	PodUsageCommitted(usage map[apitypes.NamespacedName]corev1.ResourceList)
+}
+
+// PodUsageObservingSink is a MetricSink which can report the usage of the pods of the batches it commits.
+type PodUsageObservingSink interface {
+	MetricSink
+	// ObservePodUsage registers an observer to be notified of the pod usage of each subsequently
+	// committed batch.  It must be called before any batches are received.
+	ObservePodUsage(observer PodUsageObserver)
+}
+
+// NodeTimestampObserver is notified of the nodes of each batch committed
+// by a NodeObservingSink.
+type NodeTimestampObserver interface {
+	// NodesCommitted receives the timestamp of each node's metrics in the batch just committed,
+	// by node name.  The timestamps must not be modified.
+	NodesCommitted(timestamps map[string]time.Time)
+}
+
+// NodeObservingSink is a MetricSink which can report the nodes of the batches it commits.
+type NodeObservingSink interface {
+	MetricSink
+	// ObserveNodes registers an observer to be notified of the nodes of each subsequently
+	// committed batch.  It must be called before any batches are received.
+	ObserveNodes(observer NodeTimestampObserver)
+}
+
+// PodTimestampObserver is notified of the pods of each batch committed
+// by a PodObservingSink.
+type PodTimestampObserver interface {
+	// PodTimestampsCommitted receives the timestamp of each pod's metrics in the batch just
+	// committed, by pod.  The timestamps must not be modified.
+	PodTimestampsCommitted(timestamps map[apitypes.NamespacedName]time.Time)
+}
+
+// PodObservingSink is a MetricSink which can report the pods of the batches it commits.
+type PodObservingSink interface {
+	MetricSink
+	// ObservePods registers an observer to be notified of the pods of each subsequently
+	// committed batch.  It must be called before any batches are received.
+	ObservePods(observer PodTimestampObserver)
+}
+
+// MemoryLimit is a soft limit on the estimated memory used to store
+// the batches committed by a MemoryBoundedSink.
+type MemoryLimit struct {
+	// Bytes is the limit itself.  Zero means unlimited.
+	Bytes int64
+	// Priority is the set of namespaces whose pods are never evicted.
+	Priority priority.Namespaces
+	// PodPhase looks up the phase of the given pod, returning false if it's unknown.
+	// It may be nil, in which case no pods are known to be terminated.
+	PodPhase func(namespace, name string) (corev1.PodPhase, bool)
+}
+
+// MemoryBoundedSink is a MetricSink which estimates the memory used to store
+// the batches it commits, and can evict entries to keep it under a limit.
+type MemoryBoundedSink interface {
+	MetricSink
+	// SetMemoryLimit sets the limit applied to subsequently committed batches.
+	SetMemoryLimit(limit MemoryLimit)
+}
+
+// NamespaceCap is a limit on the number of pods whose metrics are stored for each
+// namespace by a NamespaceCappedSink.
+type NamespaceCap struct {
+	// PodsPerNamespace is the cap itself.  Zero means unlimited.
+	PodsPerNamespace int
+	// Priority is the set of namespaces which aren't capped.
+	Priority priority.Namespaces
+}
+
+// NamespaceCappedSink is a MetricSink which can cap the number of pods stored for each
+// namespace, evicting the pods with the stalest metrics beyond the cap.
+type NamespaceCappedSink interface {
+	MetricSink
+	// SetNamespaceCap sets the cap applied to subsequently committed batches.
+	SetNamespaceCap(limit NamespaceCap)
+}
+
+// SmoothingSink is a MetricSink which can also smooth the usage of the batches it commits
+// over a longer window than the latest batch (see provider.SmoothingProvider).
+type SmoothingSink interface {
+	MetricSink
+	// SetSmoothingHalfLife sets the half-life of the smoothed usage, or disables smoothing if
+	// it's zero.  It must be called before any batches are received.
+	SetSmoothingHalfLife(halfLife time.Duration)
+}
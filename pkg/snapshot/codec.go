@@ -0,0 +1,301 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot implements a compact binary encoding of MetricsBatches,
+// suitable for persisting them or sending them between metrics-server instances.
+//
+// The encoding is laid out as follows (all integers are varints):
+//
+//	magic ("MSSB"), major version, minor version
+//	base timestamp (unix nanoseconds)
+//	string table: count, then (length, bytes) for each string
+//	nodes: count, then (name index, point) for each node
+//	pods: count, then (name index, namespace index, container count,
+//	      (name index, point) for each container) for each pod
+//
+// where a point is (timestamp delta from the base, CPU in nanocores, memory in bytes).
+// Decoders must ignore any trailing data, which later minor versions may add.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+const (
+	// MajorVersion is the major version of the encoding produced by Encode.
+	// Decode rejects payloads with a newer major version.
+	MajorVersion = 1
+	// MinorVersion is the minor version of the encoding produced by Encode.
+	// Newer minor versions only append data, so they're always decodable.
+	MinorVersion = 0
+)
+
+var magic = []byte("MSSB")
+
+// ErrUnsupportedVersion indicates that a payload was encoded with a newer,
+// incompatible, version of the encoding.
+type ErrUnsupportedVersion struct {
+	Major, Minor uint64
+}
+
+func (err *ErrUnsupportedVersion) Error() string {
+	return fmt.Sprintf("snapshot encoding version %d.%d is not supported (newest supported major version is %d)", err.Major, err.Minor, MajorVersion)
+}
+
+var errTruncated = errors.New("snapshot is truncated or corrupt")
+
+// Encode encodes the given batch.
+func Encode(batch *sources.MetricsBatch) []byte {
+	enc := &encoder{strings: make(map[string]uint64)}
+
+	// intern the strings and find the base timestamp first, so that the
+	// string table can be written before the points that reference it.
+	// The string references are saved in order of use, to avoid looking
+	// them up again when writing the points.
+	var base time.Time
+	observe := func(ts time.Time) {
+		if base.IsZero() || ts.Before(base) {
+			base = ts
+		}
+	}
+	numContainers := 0
+	for _, pod := range batch.Pods {
+		numContainers += len(pod.Containers)
+	}
+	refs := make([]uint64, 0, len(batch.Nodes)+2*len(batch.Pods)+numContainers)
+	for _, node := range batch.Nodes {
+		refs = append(refs, enc.intern(node.Name))
+		observe(node.Timestamp)
+	}
+	for _, pod := range batch.Pods {
+		refs = append(refs, enc.intern(pod.Name), enc.intern(pod.Namespace))
+		for _, container := range pod.Containers {
+			refs = append(refs, enc.intern(container.Name))
+			observe(container.Timestamp)
+		}
+	}
+
+	// assume roughly 16 bytes per point, plus the string table
+	enc.buf = make([]byte, 0, enc.tableSize+16*(len(batch.Nodes)+numContainers)+4*len(batch.Pods)+32)
+	enc.buf = append(enc.buf, magic...)
+	enc.uvarint(MajorVersion)
+	enc.uvarint(MinorVersion)
+	baseNanos := timeToNanos(base)
+	enc.varint(baseNanos)
+
+	enc.uvarint(uint64(len(enc.table)))
+	for _, str := range enc.table {
+		enc.uvarint(uint64(len(str)))
+		enc.buf = append(enc.buf, str...)
+	}
+
+	nextRef := func() uint64 {
+		ref := refs[0]
+		refs = refs[1:]
+		return ref
+	}
+
+	enc.uvarint(uint64(len(batch.Nodes)))
+	for i := range batch.Nodes {
+		enc.uvarint(nextRef())
+		enc.point(baseNanos, &batch.Nodes[i].MetricsPoint)
+	}
+
+	enc.uvarint(uint64(len(batch.Pods)))
+	for i := range batch.Pods {
+		pod := &batch.Pods[i]
+		enc.uvarint(nextRef())
+		enc.uvarint(nextRef())
+		enc.uvarint(uint64(len(pod.Containers)))
+		for j := range pod.Containers {
+			enc.uvarint(nextRef())
+			enc.point(baseNanos, &pod.Containers[j].MetricsPoint)
+		}
+	}
+
+	return enc.buf
+}
+
+// Decode decodes a batch encoded by Encode.
+func Decode(data []byte) (*sources.MetricsBatch, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, fmt.Errorf("data is not a metrics snapshot")
+	}
+	dec := &decoder{data: data[len(magic):]}
+
+	major := dec.uvarint()
+	minor := dec.uvarint()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if major > MajorVersion {
+		return nil, &ErrUnsupportedVersion{Major: major, Minor: minor}
+	}
+	base := dec.varint()
+
+	numStrings := dec.count()
+	table := make([]string, numStrings)
+	for i := range table {
+		table[i] = dec.string()
+	}
+	str := func() string {
+		ind := dec.uvarint()
+		if ind >= uint64(len(table)) {
+			dec.fail()
+			return ""
+		}
+		return table[ind]
+	}
+
+	batch := &sources.MetricsBatch{}
+	if numNodes := dec.count(); numNodes > 0 {
+		batch.Nodes = make([]sources.NodeMetricsPoint, numNodes)
+	}
+	for i := range batch.Nodes {
+		batch.Nodes[i].Name = str()
+		dec.point(base, &batch.Nodes[i].MetricsPoint)
+	}
+
+	if numPods := dec.count(); numPods > 0 {
+		batch.Pods = make([]sources.PodMetricsPoint, numPods)
+	}
+	for i := range batch.Pods {
+		pod := &batch.Pods[i]
+		pod.Name = str()
+		pod.Namespace = str()
+		pod.Containers = make([]sources.ContainerMetricsPoint, dec.count())
+		for j := range pod.Containers {
+			pod.Containers[j].Name = str()
+			dec.point(base, &pod.Containers[j].MetricsPoint)
+		}
+	}
+
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return batch, nil
+}
+
+type encoder struct {
+	buf       []byte
+	strings   map[string]uint64
+	table     []string
+	tableSize int
+}
+
+// intern adds the given string to the string table, if needed, returning its index.
+func (e *encoder) intern(str string) uint64 {
+	if ind, present := e.strings[str]; present {
+		return ind
+	}
+	ind := uint64(len(e.table))
+	e.strings[str] = ind
+	e.table = append(e.table, str)
+	e.tableSize += len(str) + 1
+	return ind
+}
+
+func (e *encoder) uvarint(val uint64) {
+	e.buf = binary.AppendUvarint(e.buf, val)
+}
+
+func (e *encoder) varint(val int64) {
+	e.buf = binary.AppendVarint(e.buf, val)
+}
+
+func (e *encoder) point(base int64, point *sources.MetricsPoint) {
+	e.varint(timeToNanos(point.Timestamp) - base)
+	e.varint(point.CpuUsage.ScaledValue(resource.Nano))
+	e.varint(point.MemoryUsage.Value())
+}
+
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errTruncated
+	}
+	d.data = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	val, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return val
+}
+
+func (d *decoder) varint() int64 {
+	val, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return val
+}
+
+// count reads a count of items, bounding it by the remaining data
+// (each item takes at least a byte) to avoid huge allocations on corrupt input.
+func (d *decoder) count() int {
+	val := d.uvarint()
+	if val > uint64(len(d.data)) {
+		d.fail()
+		return 0
+	}
+	return int(val)
+}
+
+func (d *decoder) string() string {
+	length := d.count()
+	str := string(d.data[:length])
+	d.data = d.data[length:]
+	return str
+}
+
+func (d *decoder) point(base int64, point *sources.MetricsPoint) {
+	point.Timestamp = nanosToTime(base + d.varint())
+	point.CpuUsage = *resource.NewScaledQuantity(d.varint(), resource.Nano)
+	point.MemoryUsage = *resource.NewQuantity(d.varint(), resource.BinarySI)
+}
+
+// timeToNanos converts a time to unix nanoseconds, mapping the zero time to zero
+// (since the zero time is outside the range of unix nanoseconds).
+func timeToNanos(ts time.Time) int64 {
+	if ts.IsZero() {
+		return 0
+	}
+	return ts.UnixNano()
+}
+
+func nanosToTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
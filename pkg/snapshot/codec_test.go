@@ -0,0 +1,246 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/snapshot"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+func TestSnapshot(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Snapshot Encoding Suite")
+}
+
+func point(ts time.Time, nanocores, bytes int64) sources.MetricsPoint {
+	mem := *resource.NewQuantity(bytes, resource.BinarySI)
+	return sources.MetricsPoint{
+		Timestamp:   ts,
+		CpuUsage:    *resource.NewScaledQuantity(nanocores, resource.Nano),
+		MemoryUsage: mem,
+	}
+}
+
+// largeBatch generates a batch spread over 100 nodes with the given number of pods.
+func largeBatch(numPods int) *sources.MetricsBatch {
+	now := time.Now()
+	batch := &sources.MetricsBatch{}
+	for i := 0; i < 100; i++ {
+		batch.Nodes = append(batch.Nodes, sources.NodeMetricsPoint{
+			Name:         fmt.Sprintf("node-%d.us-east-1.compute.internal", i),
+			MetricsPoint: point(now.Add(time.Duration(i)*time.Millisecond), int64(1000000000+i), int64(8<<30+i)),
+		})
+	}
+	for i := 0; i < numPods; i++ {
+		ts := now.Add(time.Duration(i%1000) * time.Millisecond)
+		batch.Pods = append(batch.Pods, sources.PodMetricsPoint{
+			Name:      fmt.Sprintf("frontend-7d9f8c6b5-%05d", i),
+			Namespace: fmt.Sprintf("team-%d", i%20),
+			Containers: []sources.ContainerMetricsPoint{
+				{Name: "app", MetricsPoint: point(ts, int64(50000000+i), int64(256<<20+i))},
+				{Name: "istio-proxy", MetricsPoint: point(ts, int64(5000000+i), int64(64<<20+i))},
+			},
+		})
+	}
+	return batch
+}
+
+// expectEquivalent checks that two batches contain the same values.
+func expectEquivalent(actual, expected *sources.MetricsBatch) {
+	expectPoint := func(actual, expected sources.MetricsPoint) {
+		Expect(actual.Timestamp.Equal(expected.Timestamp)).To(BeTrue(), "timestamp %v should equal %v", actual.Timestamp, expected.Timestamp)
+		Expect(actual.CpuUsage.Cmp(expected.CpuUsage)).To(BeZero(), "cpu %v should equal %v", actual.CpuUsage.String(), expected.CpuUsage.String())
+		Expect(actual.MemoryUsage.Cmp(expected.MemoryUsage)).To(BeZero(), "memory %v should equal %v", actual.MemoryUsage.String(), expected.MemoryUsage.String())
+	}
+
+	Expect(actual.Nodes).To(HaveLen(len(expected.Nodes)))
+	for i := range expected.Nodes {
+		Expect(actual.Nodes[i].Name).To(Equal(expected.Nodes[i].Name))
+		expectPoint(actual.Nodes[i].MetricsPoint, expected.Nodes[i].MetricsPoint)
+	}
+	Expect(actual.Pods).To(HaveLen(len(expected.Pods)))
+	for i := range expected.Pods {
+		Expect(actual.Pods[i].Name).To(Equal(expected.Pods[i].Name))
+		Expect(actual.Pods[i].Namespace).To(Equal(expected.Pods[i].Namespace))
+		Expect(actual.Pods[i].Containers).To(HaveLen(len(expected.Pods[i].Containers)))
+		for j := range expected.Pods[i].Containers {
+			Expect(actual.Pods[i].Containers[j].Name).To(Equal(expected.Pods[i].Containers[j].Name))
+			expectPoint(actual.Pods[i].Containers[j].MetricsPoint, expected.Pods[i].Containers[j].MetricsPoint)
+		}
+	}
+}
+
+var _ = Describe("Snapshot Encoding", func() {
+	It("should round-trip a batch", func() {
+		now := time.Now()
+		batch := &sources.MetricsBatch{
+			Nodes: []sources.NodeMetricsPoint{
+				{Name: "node1", MetricsPoint: point(now, 100, 200)},
+			},
+			Pods: []sources.PodMetricsPoint{
+				{Name: "pod1", Namespace: "ns1", Containers: []sources.ContainerMetricsPoint{
+					{Name: "container1", MetricsPoint: point(now.Add(-time.Second), 300, 400)},
+					{Name: "container2", MetricsPoint: point(now.Add(time.Second), 500, 600)},
+				}},
+				{Name: "pod2", Namespace: "ns1"},
+			},
+		}
+
+		decoded, err := Decode(Encode(batch))
+		Expect(err).NotTo(HaveOccurred())
+		expectEquivalent(decoded, batch)
+	})
+
+	It("should round-trip an empty batch, and zero timestamps", func() {
+		batch := &sources.MetricsBatch{
+			Nodes: []sources.NodeMetricsPoint{{Name: "node1", MetricsPoint: point(time.Time{}, 1, 2)}},
+		}
+		decoded, err := Decode(Encode(batch))
+		Expect(err).NotTo(HaveOccurred())
+		expectEquivalent(decoded, batch)
+		Expect(decoded.Nodes[0].Timestamp.IsZero()).To(BeTrue())
+
+		decoded, err = Decode(Encode(&sources.MetricsBatch{}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded.Nodes).To(BeEmpty())
+		Expect(decoded.Pods).To(BeEmpty())
+	})
+
+	It("should reject payloads with a newer major version", func() {
+		data := append([]byte("MSSB"), binary.AppendUvarint(binary.AppendUvarint(nil, MajorVersion+1), 0)...)
+		_, err := Decode(data)
+		Expect(err).To(HaveOccurred())
+		Expect(err).To(BeAssignableToTypeOf(&ErrUnsupportedVersion{}))
+		Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("%d.0 is not supported", MajorVersion+1)))
+	})
+
+	It("should accept payloads with a newer minor version, ignoring trailing data", func() {
+		batch := &sources.MetricsBatch{
+			Nodes: []sources.NodeMetricsPoint{{Name: "node1", MetricsPoint: point(time.Now(), 1, 2)}},
+		}
+		data := Encode(batch)
+		data[5] = MinorVersion + 1 // the minor version directly follows the magic and single-byte major version
+		data = append(data, 0xde, 0xad, 0xbe, 0xef)
+
+		decoded, err := Decode(data)
+		Expect(err).NotTo(HaveOccurred())
+		expectEquivalent(decoded, batch)
+	})
+
+	It("should reject truncated payloads", func() {
+		data := Encode(largeBatch(10))
+		for _, length := range []int{0, 3, 6, len(data) / 2, len(data) - 1} {
+			_, err := Decode(data[:length])
+			Expect(err).To(HaveOccurred(), "length %d should fail", length)
+		}
+	})
+
+	It("should be at least 5x smaller and faster to encode and decode than JSON for 10k pods", func() {
+		batch := largeBatch(10000)
+
+		start := time.Now()
+		binData := Encode(batch)
+		binEncode := time.Since(start)
+		start = time.Now()
+		_, err := Decode(binData)
+		binDecode := time.Since(start)
+		Expect(err).NotTo(HaveOccurred())
+
+		start = time.Now()
+		jsonData, err := json.Marshal(batch)
+		jsonEncode := time.Since(start)
+		Expect(err).NotTo(HaveOccurred())
+		start = time.Now()
+		Expect(json.Unmarshal(jsonData, &sources.MetricsBatch{})).To(Succeed())
+		jsonDecode := time.Since(start)
+
+		fmt.Fprintf(GinkgoWriter, "10k pods: binary %d bytes, encode %v, decode %v; JSON %d bytes, encode %v, decode %v\n",
+			len(binData), binEncode, binDecode, len(jsonData), jsonEncode, jsonDecode)
+
+		// timings are too noisy to assert on here; see the benchmarks for those
+		Expect(len(jsonData) / len(binData)).To(BeNumerically(">=", 5))
+	})
+})
+
+func FuzzDecode(f *testing.F) {
+	f.Add(Encode(&sources.MetricsBatch{}))
+	f.Add(Encode(largeBatch(3)))
+	f.Add([]byte("MSSB"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		batch, err := Decode(data)
+		if err != nil {
+			return
+		}
+		// anything that decodes must survive a round-trip
+		if _, err := Decode(Encode(batch)); err != nil {
+			t.Fatalf("unable to decode re-encoded batch: %v", err)
+		}
+	})
+}
+
+func BenchmarkEncodeBinary10kPods(b *testing.B) {
+	batch := largeBatch(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(batch)
+	}
+}
+
+func BenchmarkEncodeJSON10kPods(b *testing.B) {
+	batch := largeBatch(10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeBinary10kPods(b *testing.B) {
+	data := Encode(largeBatch(10000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeJSON10kPods(b *testing.B) {
+	data, err := json.Marshal(largeBatch(10000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := json.Unmarshal(data, &sources.MetricsBatch{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
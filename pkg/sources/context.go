@@ -0,0 +1,71 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// ScrapeReason describes the operation that triggered a scrape.
+type ScrapeReason string
+
+const (
+	// ScrapeReasonCycle indicates a scrape done as part of the regular collection cycle.
+	ScrapeReasonCycle ScrapeReason = "cycle"
+	// ScrapeReasonDebug indicates an on-demand scrape requested through a debug endpoint.
+	ScrapeReasonDebug ScrapeReason = "debug"
+)
+
+type scrapeReasonKey struct{}
+type cycleIDKey struct{}
+
+// WithScrapeReason records the reason for a scrape in the context.
+func WithScrapeReason(ctx context.Context, reason ScrapeReason) context.Context {
+	return context.WithValue(ctx, scrapeReasonKey{}, reason)
+}
+
+// ScrapeReasonFrom fetches the reason for a scrape from the context, if present.
+func ScrapeReasonFrom(ctx context.Context) ScrapeReason {
+	reason, _ := ctx.Value(scrapeReasonKey{}).(ScrapeReason)
+	return reason
+}
+
+// WithCycleID records the ID of the collection cycle that a scrape is part of in the context,
+// attaching it to the context's logger as the "cycle" field.
+func WithCycleID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, cycleIDKey{}, id)
+	return logging.NewContext(ctx, logging.FromContext(ctx, loglevel.Scraper).WithValues("cycle", id))
+}
+
+// CycleIDFrom fetches the ID of the collection cycle from the context, if present.
+func CycleIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(cycleIDKey{}).(string)
+	return id
+}
+
+var cycleSeq uint64
+
+// NewCycleID generates a new cycle ID, unique within this process and
+// unlikely to collide with those from previous runs.
+func NewCycleID() string {
+	seq := atomic.AddUint64(&cycleSeq, 1)
+	return strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.FormatUint(seq, 10)
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+)
+
+// ClassifiedError is an error from a source which falls into a known class
+// of failure, with a known remediation.
+type ClassifiedError interface {
+	error
+	// ErrorClass names the class of failure (e.g. "unauthorized").
+	ErrorClass() string
+	// Remediation is a short, human-readable hint on how to fix the failure.
+	Remediation() string
+}
+
+// CancelReason is why a scrape was canceled, as used in logs, metrics, and scrape statuses.
+type CancelReason string
+
+const (
+	// CancelReasonTimeout means that the scrape timeout, or the cycle's deadline, was reached.
+	CancelReasonTimeout CancelReason = "timeout"
+	// CancelReasonNodeDeleted means that the node was deleted during its scrape.
+	CancelReasonNodeDeleted CancelReason = "node_deleted"
+	// CancelReasonShutdown means that metrics-server is shutting down.
+	CancelReasonShutdown CancelReason = "shutdown"
+	// CancelReasonCircuitOpen means that the API server proxy circuit breaker opened during the scrape.
+	CancelReasonCircuitOpen CancelReason = "circuit_open"
+	// CancelReasonHedgeLost means that another (hedged) request for the same summary won.
+	CancelReasonHedgeLost CancelReason = "hedge_lost"
+)
+
+// cancelRemediations contains the remediation hint for each reason for canceling scrapes.
+var cancelRemediations = map[CancelReason]string{
+	CancelReasonTimeout:     "the Kubelets didn't respond within the scrape timeout; check their load and connectivity, or raise --metric-resolution (and with it the scrape timeout)",
+	CancelReasonNodeDeleted: "the nodes were deleted during their scrapes, so there's nothing to fix",
+	CancelReasonShutdown:    "metrics-server is shutting down, so there's nothing to fix",
+	CancelReasonCircuitOpen: "too many recent requests through the API server proxy failed, so the requests in flight were abandoned to let the API server recover; check the API server's health and load",
+	CancelReasonHedgeLost:   "a hedged request for the same summary answered first, so there's nothing to fix",
+}
+
+// ErrCanceled is the cause given when canceling a scrape's context (see context.Cause),
+// so that the error the scrape fails with can say why it was canceled, rather than
+// just that it was.
+type ErrCanceled struct {
+	Reason CancelReason
+	// Detail describes the cancellation (e.g. the timeout reached).
+	Detail string
+}
+
+func (err *ErrCanceled) Error() string {
+	return fmt.Sprintf("scrape canceled (%s): %s", err.Reason, err.Detail)
+}
+
+func (err *ErrCanceled) ErrorClass() string { return string(err.Reason) }
+func (err *ErrCanceled) Remediation() string {
+	return cancelRemediations[err.Reason]
+}
+
+// CancelCause returns the cause of the cancellation that the given error (or any error it
+// wraps) came from, if it did.
+func CancelCause(err error) (*ErrCanceled, bool) {
+	var canceled *ErrCanceled
+	if errors.As(err, &canceled) {
+		return canceled, true
+	}
+	return nil, false
+}
+
+// logClassifiedErrors logs a single summary line for each class of error
+// present in the given errors, so that a fleet-wide misconfiguration shows
+// up as one actionable message instead of one error per node.  Their text is kept
+// as it was before lines had fields, since operators alert on it.
+func logClassifiedErrors(logger logging.Logger, cycleID string, errs []error) {
+	type classSummary struct {
+		count       int
+		remediation string
+	}
+	classes := make(map[string]*classSummary)
+	for _, err := range errs {
+		var classified ClassifiedError
+		if !errors.As(err, &classified) {
+			continue
+		}
+		summary, ok := classes[classified.ErrorClass()]
+		if !ok {
+			summary = &classSummary{remediation: classified.Remediation()}
+			classes[classified.ErrorClass()] = summary
+		}
+		summary.count++
+	}
+
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logger.Error(nil, fmt.Sprintf("%d source(s) failed with %s errors (cycle %s): %s", classes[name].count, name, cycleID, classes[name].remediation), "class", name, "remediation", classes[name].remediation)
+	}
+}
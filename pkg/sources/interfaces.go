@@ -31,20 +31,112 @@ type MetricsBatch struct {
 type NodeMetricsPoint struct {
 	Name string
 	MetricsPoint
+	// Provenance, if non-nil, records where the node's metrics came from.  It's only
+	// recorded when enabled, so is normally nil.
+	Provenance *Provenance
 }
 
 // PodMetricsPoint contains the metrics for some pod's containers.
 type PodMetricsPoint struct {
 	Name      string
 	Namespace string
+	// NodeName is the name of the node the pod's metrics were measured on, i.e. that of the
+	// node whose source reported them, which may differ between batches as pods move.
+	NodeName string
 
 	Containers []ContainerMetricsPoint
+	// SwapUsage, if non-nil, is the pod's swap usage, in bytes.  It is only collected
+	// when enabled, and only reported by Kubelets with swap enabled, so is normally nil.
+	SwapUsage *resource.Quantity
+	// CorrectedResources lists the resources (e.g. "cpu") whose container usage added up
+	// to more than the pod-level usage reported, and so was scaled down to it.  It's only
+	// checked when enabled, so is normally nil.
+	CorrectedResources []string
+	// MemoryOverhead, if non-nil, is how far the pod-level working set exceeds the sum of its
+	// containers' (e.g. the sandbox, and tmpfs volumes charged to the pod), in bytes.  It's
+	// only calculated when enabled, so is normally nil.
+	MemoryOverhead *resource.Quantity
+	// Provenance, if non-nil, records where the pod's metrics came from, and is shared with
+	// the node the pod runs on, and the other pods on it.  It's only recorded when enabled,
+	// so is normally nil.
+	Provenance *Provenance
+}
+
+// SampleTime returns the time of the pod's sample, which is what the pod's window is
+// measured to: the earliest timestamp amongst its containers not excluded from pod
+// totals (or amongst all of them, if they're all excluded).  It's never the timestamp
+// of the node the pod runs on, which may differ.  It's zero if there are no containers.
+func (p *PodMetricsPoint) SampleTime() time.Time {
+	var earliest, earliestExcluded time.Time
+	for _, cont := range p.Containers {
+		if cont.ExcludedFromPodTotals {
+			if earliestExcluded.IsZero() || earliestExcluded.After(cont.Timestamp) {
+				earliestExcluded = cont.Timestamp
+			}
+			continue
+		}
+		if earliest.IsZero() || earliest.After(cont.Timestamp) {
+			earliest = cont.Timestamp
+		}
+	}
+	if earliest.IsZero() {
+		return earliestExcluded
+	}
+	return earliest
 }
 
 // ContainerMetricsPoint contains the metrics for some container at some point in time.
 type ContainerMetricsPoint struct {
 	Name string
 	MetricsPoint
+	// PageFaults, if non-nil, contains the container's memory page fault rates.
+	// It is only collected when enabled, so is normally nil.
+	PageFaults *PageFaultRates
+	// CPUThrottling, if non-nil, contains the container's CPU throttling rate.
+	// It is only collected when enabled, so is normally nil.
+	CPUThrottling *ThrottlingRate
+	// Accelerators, if non-nil, contains the usage of the accelerators (e.g. GPUs) attached
+	// to the container.  It is only collected when enabled, so is normally nil.
+	Accelerators []AcceleratorUsage
+	// ExcludedFromPodTotals is set for containers (such as service mesh sidecars)
+	// which are still listed, but left out of pod-level aggregates.
+	ExcludedFromPodTotals bool
+}
+
+// PageFaultRates contains the rates of memory page faults over the window before a metrics point.
+type PageFaultRates struct {
+	// PageFaults is the rate of all page faults, in faults per second.
+	PageFaults resource.Quantity
+	// MajorPageFaults is the rate of major page faults (those requiring disk IO), in faults per second.
+	MajorPageFaults resource.Quantity
+	// Window is the time between the two samples the rates were calculated from, which
+	// spans more than one collection cycle if the node's scrapes failed in between.
+	Window time.Duration
+}
+
+// ThrottlingRate contains the rate at which a container was CPU throttled over the window before a metrics point.
+type ThrottlingRate struct {
+	// ThrottledSeconds is the rate of time throttled, in seconds per second.
+	ThrottledSeconds resource.Quantity
+	// Window is the time between the two samples the rate was calculated from.
+	Window time.Duration
+}
+
+// AcceleratorUsage contains the usage of a single accelerator attached to a container.
+type AcceleratorUsage struct {
+	// Make is the accelerator's vendor, e.g. "nvidia".
+	Make string
+	// Model is the accelerator's model, e.g. "tesla-p100".
+	Model string
+	// ID identifies the accelerator on its node.
+	ID string
+	// MemoryTotal is the accelerator's total memory, in bytes.
+	MemoryTotal resource.Quantity
+	// MemoryUsed is the accelerator memory allocated, in bytes.
+	MemoryUsed resource.Quantity
+	// DutyCycle is the percentage of the Kubelet's last sample period (10s)
+	// during which the accelerator was actively processing.
+	DutyCycle resource.Quantity
 }
 
 // MetricsPoint represents the a set of specific metrics at some point in time.
@@ -54,6 +146,16 @@ type MetricsPoint struct {
 	CpuUsage resource.Quantity
 	// MemoryUsage is the working set size, in bytes.
 	MemoryUsage resource.Quantity
+	// SwapUsage, if non-nil, is the swap usage, in bytes.  It is only collected when
+	// enabled, and only reported by Kubelets with swap enabled, so is normally nil.
+	SwapUsage *resource.Quantity
+	// StartTime, if non-zero, is when the node or container started, so that consumers
+	// can tell when it restarted between batches.  It's zero if the Kubelet didn't report
+	// it (or its summary subtree was skipped).
+	StartTime time.Time
+	// Window, if non-zero, is the time between the two samples metrics-server derived
+	// CpuUsage from itself, rather than taking the Kubelet's rate, whose window is unknown.
+	Window time.Duration
 }
 
 // MetricSource knows how to collect pod, container, and node metrics from some location.
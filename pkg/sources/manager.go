@@ -17,19 +17,23 @@ package sources
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/prometheus/client_golang/prometheus"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	utilmetrics "github.com/kubernetes-incubator/metrics-server/pkg/metrics"
 )
 
 const (
 	maxDelayMs       = 4 * 1000
 	delayPerSourceMs = 8
+	// maxDelayFraction bounds the staggering to a fraction of the scrape timeout,
+	// so that at short resolutions most of the timeout is left for the scrapes.
+	maxDelayFraction = 0.1
 )
 
 var (
@@ -70,29 +74,89 @@ func RegisterDurationMetrics(scrapeTimeout time.Duration) {
 }
 
 func NewSourceManager(srcProv MetricSourceProvider, scrapeTimeout time.Duration) MetricSource {
+	return NewOrderedSourceManager(srcProv, scrapeTimeout, RandomOrdering())
+}
+
+// NewOrderedSourceManager returns a source manager which staggers
+// the start of its sources' scrapes according to the given ordering.
+func NewOrderedSourceManager(srcProv MetricSourceProvider, scrapeTimeout time.Duration, ordering ScrapeOrdering) MetricSource {
 	return &sourceManager{
 		srcProv:       srcProv,
+		ordering:      ordering,
 		scrapeTimeout: scrapeTimeout,
 	}
 }
 
+// ScrapeTimeoutSetter is implemented by MetricSources whose scrape timeout
+// can be changed between collections.
+type ScrapeTimeoutSetter interface {
+	// SetScrapeTimeout sets the timeout of subsequent collections.
+	SetScrapeTimeout(timeout time.Duration)
+}
+
+// BaselineResetter is implemented by MetricSources and MetricSourceProviders which derive
+// rates from successive samples, so that the baselines they keep can be discarded when
+// they can no longer be trusted (e.g. after the host resumed from suspend).
+type BaselineResetter interface {
+	// ResetBaselines discards every sample kept for deriving rates, so that each
+	// rate is derived afresh from the next two samples.
+	ResetBaselines()
+}
+
+// CycleEndObserver is implemented by MetricSourceProviders which aggregate what their
+// sources find over each collection cycle, reporting it once the cycle is over.
+type CycleEndObserver interface {
+	// CycleEnded is called once every source has been collected in the given cycle.
+	CycleEnded(cycleID string)
+}
+
 type sourceManager struct {
-	srcProv       MetricSourceProvider
+	srcProv  MetricSourceProvider
+	ordering ScrapeOrdering
+
+	mu            sync.RWMutex
 	scrapeTimeout time.Duration
 }
 
+var _ ScrapeTimeoutSetter = &sourceManager{}
+
+func (m *sourceManager) SetScrapeTimeout(timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scrapeTimeout = timeout
+}
+
+var _ BaselineResetter = &sourceManager{}
+
+func (m *sourceManager) ResetBaselines() {
+	if resetter, ok := m.srcProv.(BaselineResetter); ok {
+		resetter.ResetBaselines()
+	}
+}
+
 func (m *sourceManager) Name() string {
 	return "source_manager"
 }
 
 func (m *sourceManager) Collect(baseCtx context.Context) (*MetricsBatch, error) {
+	// tag the scrapes so that Kubelet requests can be traced back to this collection
+	if ScrapeReasonFrom(baseCtx) == "" {
+		baseCtx = WithScrapeReason(baseCtx, ScrapeReasonCycle)
+	}
+	cycleID := CycleIDFrom(baseCtx)
+	if cycleID == "" {
+		cycleID = NewCycleID()
+		baseCtx = WithCycleID(baseCtx, cycleID)
+	}
+	logger := logging.FromContext(baseCtx, loglevel.Scraper)
+
 	sources, err := m.srcProv.GetMetricSources()
 	var errs []error
 	if err != nil {
 		// save the error, and continue on in case of partial results
 		errs = append(errs, err)
 	}
-	glog.V(1).Infof("Scraping metrics from %v sources", len(sources))
+	logger.V(1).Info(fmt.Sprintf("Scraping metrics from %v sources (cycle %s)", len(sources), cycleID), "sources", len(sources))
 
 	responseChannel := make(chan *MetricsBatch, len(sources))
 	errChannel := make(chan error, len(sources))
@@ -100,33 +164,45 @@ func (m *sourceManager) Collect(baseCtx context.Context) (*MetricsBatch, error)
 	defer close(errChannel)
 
 	startTime := time.Now()
+	m.mu.RLock()
+	scrapeTimeout := m.scrapeTimeout
+	m.mu.RUnlock()
 
 	// TODO(directxman12): re-evaluate this code -- do we really need to stagger fetches like this?
 	delayMs := delayPerSourceMs * len(sources)
 	if delayMs > maxDelayMs {
 		delayMs = maxDelayMs
 	}
+	if timeoutDelayMs := int(maxDelayFraction * float64(scrapeTimeout) / float64(time.Millisecond)); delayMs > timeoutDelayMs {
+		delayMs = timeoutDelayMs
+	}
 
-	for _, source := range sources {
-		go func(source MetricSource) {
-			// Prevents network congestion.
-			sleepDuration := time.Duration(rand.Intn(delayMs)) * time.Millisecond
+	// Prevents network congestion.
+	offsets := m.ordering.Offsets(sources, time.Duration(delayMs)*time.Millisecond)
+
+	for i, source := range sources {
+		go func(source MetricSource, sleepDuration time.Duration) {
 			time.Sleep(sleepDuration)
 			// make the timeout a bit shorter to account for staggering, so we still preserve
 			// the overall timeout
-			ctx, cancelTimeout := context.WithTimeout(baseCtx, m.scrapeTimeout-sleepDuration)
+			ctx, cancelTimeout := context.WithTimeoutCause(baseCtx, scrapeTimeout-sleepDuration, &ErrCanceled{
+				Reason: CancelReasonTimeout,
+				Detail: fmt.Sprintf("the scrape timeout of %s was reached", scrapeTimeout),
+			})
 			defer cancelTimeout()
 
-			glog.V(2).Infof("Querying source: %s", source)
+			logger.V(2).Info(fmt.Sprintf("Querying source: %s (cycle %s)", source, cycleID), "source", source)
+			scrapeStart := time.Now()
 			metrics, err := scrapeWithMetrics(ctx, source)
+			m.ordering.Observe(source, time.Since(scrapeStart), metrics)
 			if err != nil {
-				errChannel <- fmt.Errorf("unable to fully scrape metrics from source %s: %v", source.Name(), err)
+				errChannel <- fmt.Errorf("unable to fully scrape metrics from source %s (cycle %s): %w", source.Name(), cycleID, err)
 				responseChannel <- metrics
 				return
 			}
 			responseChannel <- metrics
 			errChannel <- nil
-		}(source)
+		}(source, offsets[i])
 	}
 
 	res := &MetricsBatch{}
@@ -147,7 +223,12 @@ func (m *sourceManager) Collect(baseCtx context.Context) (*MetricsBatch, error)
 		res.Pods = append(res.Pods, srcBatch.Pods...)
 	}
 
-	glog.V(1).Infof("ScrapeMetrics: time: %s, nodes: %v, pods: %v", time.Since(startTime), len(res.Nodes), len(res.Pods))
+	if observer, ok := m.srcProv.(CycleEndObserver); ok {
+		observer.CycleEnded(cycleID)
+	}
+	logClassifiedErrors(logger, cycleID, errs)
+	duration := time.Since(startTime)
+	logger.V(1).Info(fmt.Sprintf("ScrapeMetrics: cycle: %s, time: %s, nodes: %v, pods: %v", cycleID, duration, len(res.Nodes), len(res.Pods)), "duration", duration, "nodes", len(res.Nodes), "pods", len(res.Pods))
 	return res, utilerrors.NewAggregate(errs)
 }
 
@@ -24,6 +24,8 @@ import (
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/resource"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	. "github.com/kubernetes-incubator/metrics-server/pkg/sources"
 	fakesrc "github.com/kubernetes-incubator/metrics-server/pkg/sources/fake"
 )
@@ -101,6 +103,16 @@ func fullSource(ts time.Time, nodeInd, podStartInd, numPods int) MetricSource {
 	}
 }
 
+// observingProvider is a StaticSourceProvider recording the cycles it's told have ended.
+type observingProvider struct {
+	fakesrc.StaticSourceProvider
+	ended []string
+}
+
+func (p *observingProvider) CycleEnded(cycleID string) {
+	p.ended = append(p.ended, cycleID)
+}
+
 var _ = Describe("Source Manager", func() {
 	var (
 		scrapeTime    = time.Now()
@@ -172,6 +184,79 @@ var _ = Describe("Source Manager", func() {
 		})
 	})
 
+	Context("when tagging scrapes", func() {
+		// recordingSource records the scrape reason and cycle ID it was collected with.
+		recordingSource := func(name string, reasons *[]ScrapeReason, cycles *[]string) MetricSource {
+			return &fakesrc.FunctionSource{
+				SourceName: "recording_source:" + name,
+				GenerateBatch: func(ctx context.Context) (*MetricsBatch, error) {
+					*reasons = append(*reasons, ScrapeReasonFrom(ctx))
+					*cycles = append(*cycles, CycleIDFrom(ctx))
+					return &MetricsBatch{}, nil
+				},
+			}
+		}
+
+		It("should tag scrapes as part of a regular cycle, with a unique cycle ID per collection", func() {
+			By("running the source manager twice")
+			var reasons []ScrapeReason
+			var cycles []string
+			manager := NewSourceManager(fakesrc.StaticSourceProvider{recordingSource("node1", &reasons, &cycles)}, 1*time.Second)
+			_, err := manager.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = manager.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying the reason and cycle IDs seen by the source")
+			Expect(reasons).To(Equal([]ScrapeReason{ScrapeReasonCycle, ScrapeReasonCycle}))
+			Expect(cycles[0]).NotTo(BeEmpty())
+			Expect(cycles[1]).NotTo(Equal(cycles[0]))
+		})
+
+		It("should preserve a reason and cycle ID already set by the caller", func() {
+			By("running the source manager with a debug scrape context")
+			var reasons []ScrapeReason
+			var cycles []string
+			manager := NewSourceManager(fakesrc.StaticSourceProvider{recordingSource("node1", &reasons, &cycles)}, 1*time.Second)
+			ctx := WithCycleID(WithScrapeReason(context.Background(), ScrapeReasonDebug), "debug-1")
+			_, err := manager.Collect(ctx)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying the reason and cycle IDs seen by the source")
+			Expect(reasons).To(Equal([]ScrapeReason{ScrapeReasonDebug}))
+			Expect(cycles).To(Equal([]string{"debug-1"}))
+		})
+
+		It("should tell the provider each cycle ended once all of its sources were collected", func() {
+			var reasons []ScrapeReason
+			var cycles []string
+			provider := &observingProvider{StaticSourceProvider: fakesrc.StaticSourceProvider{recordingSource("node1", &reasons, &cycles)}}
+			manager := NewSourceManager(provider, 1*time.Second)
+			_, err := manager.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provider.ended).To(Equal(cycles))
+		})
+
+		It("should log each collection, and the sources it queries, with the cycle ID", func() {
+			recorder := &logging.Recorder{MaxLevel: 2}
+			var reasons []ScrapeReason
+			var cycles []string
+			manager := NewSourceManager(fakesrc.StaticSourceProvider{recordingSource("node1", &reasons, &cycles)}, 1*time.Second)
+			ctx := logging.NewContext(context.Background(), logging.NewLogger(recorder, loglevel.Scraper))
+			_, err := manager.Collect(ctx)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, prefix := range []string{"Scraping metrics from 1 sources (cycle " + cycles[0] + ")", "Querying source: ", "ScrapeMetrics: cycle: " + cycles[0] + ", time: "} {
+				entries := recorder.FindPrefix(prefix)
+				Expect(entries).To(HaveLen(1), prefix)
+				Expect(entries[0].Fields).To(HaveKeyWithValue("cycle", cycles[0]), prefix)
+			}
+			scraped := recorder.FindPrefix("ScrapeMetrics: ")[0]
+			Expect(scraped.Message).To(HaveSuffix(", nodes: 0, pods: 0"))
+			Expect(scraped.Fields).To(HaveKey("duration"))
+		})
+	})
+
 	Context("when some sources take too long", func() {
 		It("should pass the scrape timeout to the source context, so that sources can time out", func() {
 			By("setting up one source to take 4 seconds, and another to take 2")
@@ -195,6 +280,30 @@ var _ = Describe("Source Manager", func() {
 			))
 		})
 
+		It("should give the scrape timeout as the cause of the cancellation", func() {
+			causes := make(chan error, 1)
+			metricsSourceProvider := fakesrc.StaticSourceProvider{
+				&fakesrc.FunctionSource{
+					SourceName: "hung_source:node1",
+					GenerateBatch: func(ctx context.Context) (*MetricsBatch, error) {
+						<-ctx.Done()
+						causes <- context.Cause(ctx)
+						return nil, ctx.Err()
+					},
+				},
+			}
+
+			manager := NewSourceManager(metricsSourceProvider, 100*time.Millisecond)
+			_, errs := manager.Collect(context.Background())
+			Expect(errs).To(HaveOccurred())
+			var cause error
+			Expect(causes).To(Receive(&cause))
+			canceled, ok := CancelCause(cause)
+			Expect(ok).To(BeTrue(), "expected a cancellation cause, got %v", cause)
+			Expect(canceled.Reason).To(Equal(CancelReasonTimeout))
+			Expect(canceled.Detail).To(ContainSubstring("scrape timeout of 100ms"))
+		})
+
 		It("should respect the parent context's general timeout, even with a longer scrape timeout", func() {
 			By("setting up some sources with 4 second delays")
 			metricsSourceProvider := fakesrc.StaticSourceProvider{
@@ -215,4 +324,20 @@ var _ = Describe("Source Manager", func() {
 			Expect(dataBatch.Nodes).To(BeEmpty())
 		})
 	})
+
+	Context("when scraping many sources at a short resolution", func() {
+		It("should stagger the scrapes by only a fraction of the scrape timeout", func() {
+			By("setting up enough sources to stagger them by the full maximum delay, each taking half a second")
+			var metricsSourceProvider fakesrc.StaticSourceProvider
+			for i := 0; i < 600; i++ {
+				metricsSourceProvider = append(metricsSourceProvider, sleepySource(500*time.Millisecond, fmt.Sprintf("node%d", i), nodeDataPoint))
+			}
+
+			By("running the source manager with the scrape timeout of a 1s resolution")
+			manager := NewSourceManager(metricsSourceProvider, 900*time.Millisecond)
+			dataBatch, errs := manager.Collect(context.Background())
+			Expect(errs).NotTo(HaveOccurred())
+			Expect(dataBatch.Nodes).To(HaveLen(600))
+		})
+	})
 })
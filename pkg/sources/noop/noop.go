@@ -0,0 +1,87 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package noop is an example of an additional, compiled-in metrics source.
+// It takes over the nodes labeled with metrics-server.kubernetes.io/source=noop,
+// and reports no metrics for them.
+//
+// Additional sources are compiled in by importing their package for its side
+// effects from the metrics-server command:
+//
+//	import _ "github.com/kubernetes-incubator/metrics-server/pkg/sources/noop"
+//
+// A real source would follow the same pattern, with its MetricSource fetching
+// metrics for its node from wherever they're served (e.g. a virtual-kubelet
+// provider's own endpoint).
+package noop
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+const (
+	// Name is the name of the no-op source provider registration.
+	Name = "noop"
+	// NodeLabel is the node label selecting the source for a node.
+	NodeLabel = "metrics-server.kubernetes.io/source"
+)
+
+func init() {
+	sources.Register(sources.Registration{
+		Name:         Name,
+		NodeSelector: labels.SelectorFromSet(labels.Set{NodeLabel: Name}),
+		Factory:      NewProvider,
+	})
+}
+
+// NewProvider constructs a provider producing a no-op source for each selected node.
+func NewProvider(opts sources.ProviderOptions) (sources.MetricSourceProvider, error) {
+	return &provider{opts: opts}, nil
+}
+
+type provider struct {
+	opts sources.ProviderOptions
+}
+
+func (p *provider) GetMetricSources() ([]sources.MetricSource, error) {
+	nodes, err := p.opts.NodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	var res []sources.MetricSource
+	for _, node := range nodes {
+		if p.opts.NodeFilter(node) {
+			res = append(res, source{node: node.Name})
+		}
+	}
+	return res, nil
+}
+
+// source is a MetricSource which collects nothing for its node.
+type source struct {
+	node string
+}
+
+func (s source) Name() string {
+	return "noop:" + s.node
+}
+
+func (s source) Collect(_ context.Context) (*sources.MetricsBatch, error) {
+	return &sources.MetricsBatch{}, nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
+)
+
+const (
+	// ScrapeOrderRandom starts each source's scrape at a random point in the staggering window.
+	ScrapeOrderRandom = "random"
+	// ScrapeOrderCost starts the scrapes of the sources expected to take longest first.
+	ScrapeOrderCost = "cost"
+
+	// DefaultMaxPhaseDrift is the default bound on how far a source's scrape may
+	// move within the staggering window from one collection to the next.
+	DefaultMaxPhaseDrift = time.Second
+
+	// costSmoothing is the weight of the latest scrape in the rolling cost estimates.
+	costSmoothing = 0.3
+)
+
+// ScrapeOrdering decides when, within a collection's staggering window, to start scraping each source.
+type ScrapeOrdering interface {
+	// Offsets returns how long after the start of the collection to start
+	// scraping each of the given sources, each less than the given window.
+	Offsets(sources []MetricSource, window time.Duration) []time.Duration
+	// Observe records how long scraping the given source took, and the batch it
+	// returned (which may be nil, or partial, if the scrape failed).
+	Observe(source MetricSource, duration time.Duration, batch *MetricsBatch)
+}
+
+// RandomOrdering returns a ScrapeOrdering which starts each scrape at a random point in the window.
+func RandomOrdering() ScrapeOrdering {
+	return randomOrdering{}
+}
+
+type randomOrdering struct{}
+
+func (randomOrdering) Offsets(sources []MetricSource, window time.Duration) []time.Duration {
+	offsets := make([]time.Duration, len(sources))
+	if windowMs := int(window / time.Millisecond); windowMs > 0 {
+		for i := range offsets {
+			offsets[i] = time.Duration(rand.Intn(windowMs)) * time.Millisecond
+		}
+	}
+	return offsets
+}
+
+func (randomOrdering) Observe(MetricSource, time.Duration, *MetricsBatch) {}
+
+// CostOrdering returns a ScrapeOrdering which spreads the scrapes evenly over the window, starting
+// those expected to take longest first, so that when a collection overruns, the biggest nodes (whose
+// metrics cover the most pods) are the most likely to have finished.  Sources whose last batch
+// contained pods from priority namespaces go ahead of the rest, regardless of cost.  Sources not
+// scraped before go after those, since there's no telling how long they'll take.
+//
+// The expected cost of a source is a rolling average of how long it took to scrape, with ties (e.g.
+// all scrapes finishing in the same instant in tests) broken by a rolling average of its pod count.
+// Since moving a source's scrape within the window stretches or shrinks the window over which its
+// rates are computed, each source's scrape moves at most maxDrift from one collection to the next
+// (zero meaning it's unbounded), so a source which becomes more expensive only gradually gets to the
+// front.  That bound only gives way when the window shrinks past a source's previous offset.  The
+// estimates can be saved, and restored after a restart (see CostEstimator).
+func CostOrdering(prio priority.Namespaces, maxDrift time.Duration) ScrapeOrdering {
+	if prio == nil {
+		prio = priority.None
+	}
+	return &costOrdering{
+		prio:      prio,
+		maxDrift:  maxDrift,
+		estimates: make(map[string]*costEstimate),
+	}
+}
+
+type costOrdering struct {
+	prio     priority.Namespaces
+	maxDrift time.Duration
+
+	mu        sync.Mutex
+	estimates map[string]*costEstimate
+}
+
+// costEstimate is what's known about a source from its previous scrapes.
+type costEstimate struct {
+	observed    bool
+	latency     float64
+	pods        float64
+	hasPriority bool
+
+	// smoothing, if non-zero, replaces costSmoothing for the next scrape, which is
+	// weighted more after a restored estimate has aged (see RestoreEstimates).
+	smoothing float64
+	// savedAt is when a restored estimate was saved, until its source is scraped again.
+	savedAt *time.Time
+
+	// scheduled is whether offset is the offset given for the previous collection.
+	scheduled bool
+	offset    time.Duration
+}
+
+// CostEstimator is implemented by ScrapeOrderings whose estimates of the cost of scraping
+// each source can be saved, and restored after a restart, so that the first collections
+// after it are ordered as well as those before it.
+type CostEstimator interface {
+	// Estimates returns the estimates of the sources observed, by source name.
+	Estimates() map[string]CostEstimate
+	// RestoreEstimates restores the given estimates, by source name, saved the given number
+	// of collections ago, for the sources not observed since.
+	RestoreEstimates(estimates map[string]CostEstimate, missed int)
+}
+
+// CostEstimate is the saved estimate of the cost of scraping a source.
+type CostEstimate struct {
+	// Latency is the rolling average of how long scraping the source took.
+	Latency time.Duration `json:"latency"`
+	// Pods is the rolling average of the number of pods in its batches.
+	Pods float64 `json:"pods"`
+	// HasPriority is whether its last batch contained pods from priority namespaces.
+	HasPriority bool `json:"hasPriority,omitempty"`
+	// SavedAt is when the estimate was saved, if it was restored and its source hasn't been
+	// scraped since, so that saving it again doesn't make it look any fresher.
+	SavedAt *time.Time `json:"savedAt,omitempty"`
+}
+
+var _ CostEstimator = &costOrdering{}
+
+func (o *costOrdering) Estimates() map[string]CostEstimate {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make(map[string]CostEstimate, len(o.estimates))
+	for name, est := range o.estimates {
+		if est.observed {
+			res[name] = CostEstimate{Latency: time.Duration(est.latency), Pods: est.pods, HasPriority: est.hasPriority, SavedAt: est.savedAt}
+		}
+	}
+	return res
+}
+
+// RestoreEstimates ages each restored estimate by the collections missed, as though each of
+// them had been observed to cost just what the next scrape of its source does: the weight of
+// the estimate in the rolling averages then decays just as it would have over them.  The
+// estimates of sources that are gone are forgotten at the next collection, as usual.
+func (o *costOrdering) RestoreEstimates(estimates map[string]CostEstimate, missed int) {
+	if missed < 0 {
+		missed = 0
+	}
+	smoothing := 1 - math.Pow(1-costSmoothing, float64(missed+1))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for name, saved := range estimates {
+		est, ok := o.estimates[name]
+		if !ok {
+			est = &costEstimate{}
+			o.estimates[name] = est
+		} else if est.observed {
+			continue
+		}
+		est.observed = true
+		est.latency = float64(saved.Latency)
+		est.pods = saved.Pods
+		est.hasPriority = saved.HasPriority
+		est.smoothing = smoothing
+		est.savedAt = saved.SavedAt
+	}
+}
+
+func (o *costOrdering) Observe(source MetricSource, duration time.Duration, batch *MetricsBatch) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	est, ok := o.estimates[source.Name()]
+	if !ok {
+		est = &costEstimate{}
+		o.estimates[source.Name()] = est
+	}
+
+	var pods float64
+	hasPriority := false
+	if batch != nil {
+		pods = float64(len(batch.Pods))
+		for _, pod := range batch.Pods {
+			if o.prio.IsPriority(pod.Namespace) {
+				hasPriority = true
+				break
+			}
+		}
+	}
+	est.savedAt = nil
+	if !est.observed {
+		est.observed = true
+		est.latency = float64(duration)
+		est.pods = pods
+	} else {
+		smoothing := costSmoothing
+		if est.smoothing != 0 {
+			smoothing, est.smoothing = est.smoothing, 0
+		}
+		est.latency += smoothing * (float64(duration) - est.latency)
+		est.pods += smoothing * (pods - est.pods)
+	}
+	// a failed scrape says nothing about which pods are on the node
+	if batch != nil {
+		est.hasPriority = hasPriority
+	}
+}
+
+func (o *costOrdering) Offsets(sources []MetricSource, window time.Duration) []time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// forget the sources which are gone
+	current := make(map[string]*costEstimate, len(sources))
+	for _, source := range sources {
+		est, ok := o.estimates[source.Name()]
+		if !ok {
+			est = &costEstimate{}
+		}
+		current[source.Name()] = est
+	}
+	o.estimates = current
+
+	order := make([]int, len(sources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		iName, jName := sources[order[i]].Name(), sources[order[j]].Name()
+		iEst, jEst := current[iName], current[jName]
+		if iEst.hasPriority != jEst.hasPriority {
+			return iEst.hasPriority
+		}
+		if iEst.observed != jEst.observed {
+			return !iEst.observed
+		}
+		if iEst.latency != jEst.latency {
+			return iEst.latency > jEst.latency
+		}
+		if iEst.pods != jEst.pods {
+			return iEst.pods > jEst.pods
+		}
+		return iName < jName
+	})
+
+	offsets := make([]time.Duration, len(sources))
+	for rank, i := range order {
+		est := current[sources[i].Name()]
+		offset := window * time.Duration(rank) / time.Duration(len(sources))
+		if est.scheduled && o.maxDrift > 0 {
+			if offset > est.offset+o.maxDrift {
+				offset = est.offset + o.maxDrift
+			} else if offset < est.offset-o.maxDrift {
+				offset = est.offset - o.maxDrift
+			}
+		}
+		if offset >= window {
+			offset = window - 1
+		}
+		if offset < 0 {
+			offset = 0
+		}
+		est.scheduled = true
+		est.offset = offset
+		offsets[i] = offset
+	}
+	return offsets
+}
@@ -0,0 +1,226 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	fakesrc "github.com/kubernetes-incubator/metrics-server/pkg/sources/fake"
+)
+
+// namedSource returns a MetricSource with the given name, which returns an empty batch.
+func namedSource(name string) MetricSource {
+	return &fakesrc.FunctionSource{
+		SourceName: name,
+		GenerateBatch: func(context.Context) (*MetricsBatch, error) {
+			return &MetricsBatch{}, nil
+		},
+	}
+}
+
+// podsIn returns a batch with the given number of pods in the given namespace.
+func podsIn(namespace string, count int) *MetricsBatch {
+	batch := &MetricsBatch{}
+	for i := 0; i < count; i++ {
+		batch.Pods = append(batch.Pods, PodMetricsPoint{Name: fmt.Sprintf("pod%d", i), Namespace: namespace})
+	}
+	return batch
+}
+
+// recordingOrdering is a ScrapeOrdering which records the scrapes it observes.
+type recordingOrdering struct {
+	mu       sync.Mutex
+	observed map[string]*MetricsBatch
+}
+
+func (o *recordingOrdering) Offsets(sources []MetricSource, _ time.Duration) []time.Duration {
+	return make([]time.Duration, len(sources))
+}
+
+func (o *recordingOrdering) Observe(source MetricSource, _ time.Duration, batch *MetricsBatch) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.observed[source.Name()] = batch
+}
+
+var _ = Describe("Cost Ordering", func() {
+	var (
+		small, medium, large, fresh MetricSource
+		sources                     []MetricSource
+	)
+
+	BeforeEach(func() {
+		small, medium, large, fresh = namedSource("src:small"), namedSource("src:medium"), namedSource("src:large"), namedSource("src:fresh")
+		sources = []MetricSource{small, medium, large}
+	})
+
+	// offsetsBy returns the offsets of the given sources, by source name.
+	offsetsBy := func(ordering ScrapeOrdering, sources []MetricSource, window time.Duration) map[string]time.Duration {
+		offsets := ordering.Offsets(sources, window)
+		Expect(offsets).To(HaveLen(len(sources)))
+		res := make(map[string]time.Duration, len(sources))
+		for i, source := range sources {
+			res[source.Name()] = offsets[i]
+		}
+		return res
+	}
+
+	It("should start the most expensive sources first, spread evenly over the window", func() {
+		ordering := CostOrdering(nil, 0)
+		ordering.Observe(small, 100*time.Millisecond, podsIn("ns1", 100))
+		ordering.Observe(medium, 2*time.Second, podsIn("ns1", 10))
+		ordering.Observe(large, 2*time.Second, podsIn("ns1", 300))
+
+		Expect(offsetsBy(ordering, sources, 3*time.Second)).To(Equal(map[string]time.Duration{
+			"src:large":  0,
+			"src:medium": time.Second,
+			"src:small":  2 * time.Second,
+		}))
+
+		By("putting sources not scraped before ahead of the ones with estimates")
+		Expect(offsetsBy(ordering, append(sources, fresh), 4*time.Second)).To(Equal(map[string]time.Duration{
+			"src:fresh":  0,
+			"src:large":  time.Second,
+			"src:medium": 2 * time.Second,
+			"src:small":  3 * time.Second,
+		}))
+	})
+
+	It("should start the sources with priority pods first, regardless of cost", func() {
+		ordering := CostOrdering(priority.NewNamespaces([]string{"kube-system"}, nil, nil), 0)
+		ordering.Observe(small, 100*time.Millisecond, podsIn("kube-system", 1))
+		ordering.Observe(medium, time.Second, podsIn("ns1", 10))
+		ordering.Observe(large, 2*time.Second, podsIn("ns1", 300))
+		Expect(offsetsBy(ordering, sources, 3*time.Second)).To(Equal(map[string]time.Duration{
+			"src:small":  0,
+			"src:large":  time.Second,
+			"src:medium": 2 * time.Second,
+		}))
+
+		By("remembering the priority pods through a failed scrape")
+		ordering.Observe(small, 3*time.Second, nil)
+		Expect(offsetsBy(ordering, sources, 3*time.Second)["src:small"]).To(BeZero())
+	})
+
+	It("should move each source at most the drift bound from one collection to the next", func() {
+		maxDrift := 200 * time.Millisecond
+		ordering := CostOrdering(nil, maxDrift)
+		ordering.Observe(small, 100*time.Millisecond, nil)
+		ordering.Observe(medium, time.Second, nil)
+		ordering.Observe(large, 2*time.Second, nil)
+		previous := offsetsBy(ordering, sources, 3*time.Second)
+		Expect(previous).To(Equal(map[string]time.Duration{
+			"src:large":  0,
+			"src:medium": time.Second,
+			"src:small":  2 * time.Second,
+		}))
+
+		By("making the small source the most expensive, and collecting until it's first")
+		for i := 0; i < 20 && previous["src:small"] != 0; i++ {
+			ordering.Observe(small, 10*time.Second, nil)
+			ordering.Observe(medium, time.Second, nil)
+			ordering.Observe(large, 2*time.Second, nil)
+			offsets := offsetsBy(ordering, sources, 3*time.Second)
+			for name, offset := range offsets {
+				Expect(offset-previous[name]).To(BeNumerically("<=", maxDrift), name)
+				Expect(previous[name]-offset).To(BeNumerically("<=", maxDrift), name)
+			}
+			previous = offsets
+		}
+		Expect(previous).To(Equal(map[string]time.Duration{
+			"src:small":  0,
+			"src:large":  time.Second,
+			"src:medium": 2 * time.Second,
+		}))
+	})
+
+	It("should keep the offsets within a shrinking window", func() {
+		ordering := CostOrdering(nil, 200*time.Millisecond)
+		ordering.Observe(small, 100*time.Millisecond, nil)
+		ordering.Observe(medium, time.Second, nil)
+		ordering.Observe(large, 2*time.Second, nil)
+		offsetsBy(ordering, sources, 3*time.Second)
+
+		for _, offset := range ordering.Offsets(sources, 300*time.Millisecond) {
+			Expect(offset).To(BeNumerically("<", 300*time.Millisecond))
+		}
+		Expect(ordering.Offsets(sources, 0)).To(Equal([]time.Duration{0, 0, 0}))
+	})
+
+	It("should order the sources by the estimates restored after a restart, forgetting those gone", func() {
+		before := CostOrdering(nil, 0)
+		before.Observe(small, 100*time.Millisecond, podsIn("ns1", 100))
+		before.Observe(medium, 2*time.Second, podsIn("ns1", 10))
+		before.Observe(large, 2*time.Second, podsIn("ns1", 300))
+		saved := before.(CostEstimator).Estimates()
+		Expect(saved).To(Equal(map[string]CostEstimate{
+			"src:small":  {Latency: 100 * time.Millisecond, Pods: 100},
+			"src:medium": {Latency: 2 * time.Second, Pods: 10},
+			"src:large":  {Latency: 2 * time.Second, Pods: 300},
+		}))
+		saved["src:gone"] = CostEstimate{Latency: 5 * time.Second, Pods: 500}
+
+		after := CostOrdering(nil, 0)
+		after.(CostEstimator).RestoreEstimates(saved, 0)
+		Expect(offsetsBy(after, sources, 3*time.Second)).To(Equal(map[string]time.Duration{
+			"src:large":  0,
+			"src:medium": time.Second,
+			"src:small":  2 * time.Second,
+		}))
+		Expect(after.(CostEstimator).Estimates()).NotTo(HaveKey("src:gone"))
+		Expect(after.(CostEstimator).Estimates()).To(HaveLen(3))
+	})
+
+	It("should weight the first scrape after a restart more the more collections were missed", func() {
+		saved := map[string]CostEstimate{"src:large": {Latency: 2 * time.Second, Pods: 300}}
+		latencyAfter := func(missed int, scrapes ...time.Duration) time.Duration {
+			ordering := CostOrdering(nil, 0)
+			ordering.(CostEstimator).RestoreEstimates(saved, missed)
+			for _, duration := range scrapes {
+				ordering.Observe(large, duration, podsIn("ns1", 300))
+			}
+			return ordering.(CostEstimator).Estimates()["src:large"].Latency
+		}
+
+		Expect(latencyAfter(0, time.Second)).To(BeNumerically("~", 1700*time.Millisecond, time.Millisecond))
+		// the saved estimate is left 0.7^4 of its weight
+		Expect(latencyAfter(3, time.Second)).To(BeNumerically("~", 1240*time.Millisecond, time.Millisecond))
+		By("weighting the scrapes after the first as usual")
+		Expect(latencyAfter(3, time.Second, time.Second)).To(BeNumerically("~", 1168*time.Millisecond, time.Millisecond))
+
+		By("keeping the estimates of sources observed before they were restored")
+		ordering := CostOrdering(nil, 0)
+		ordering.Observe(large, time.Second, podsIn("ns1", 300))
+		ordering.(CostEstimator).RestoreEstimates(saved, 0)
+		Expect(ordering.(CostEstimator).Estimates()["src:large"].Latency).To(Equal(time.Second))
+	})
+
+	It("should be informed of each scrape by the source manager", func() {
+		ordering := &recordingOrdering{observed: make(map[string]*MetricsBatch)}
+		manager := NewOrderedSourceManager(fakesrc.StaticSourceProvider{fullSource(time.Now(), 1, 0, 2)}, time.Second, ordering)
+		_, err := manager.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ordering.observed).To(HaveKey("static_source:node1"))
+		Expect(ordering.observed["static_source:node1"].Pods).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,117 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"sync"
+	"time"
+)
+
+// ProvenanceKind is how the metrics a Provenance is attached to were obtained.
+type ProvenanceKind uint8
+
+const (
+	// ProvenanceDirect is for metrics scraped from the node's preferred endpoint.
+	ProvenanceDirect ProvenanceKind = iota
+	// ProvenanceFallback is for metrics scraped from another of the node's candidate
+	// endpoints, after connecting to those preferred to it failed.
+	ProvenanceFallback
+	// ProvenanceStale is for the last-known metrics of a node, served again since
+	// its scrape failed, or was rejected.
+	ProvenanceStale
+)
+
+func (k ProvenanceKind) String() string {
+	switch k {
+	case ProvenanceDirect:
+		return "direct"
+	case ProvenanceFallback:
+		return "fallback"
+	case ProvenanceStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// Provenance records where a node's metrics, and those of the pods on it, came from, so
+// that a suspicious value can be traced back to the scrape that produced it.  A single
+// Provenance is shared by everything scraped together, and its strings are interned, so
+// that storing it costs little more than a pointer per node and pod.  It must not be
+// modified once attached to a batch.
+type Provenance struct {
+	// CycleID is the collection cycle the metrics were scraped in.
+	CycleID string
+	// Source is the type of source that produced the metrics, e.g. "kubelet_summary".
+	Source string
+	// Endpoint is what was scraped, e.g. "https://10.0.0.1:10250/stats/summary".
+	Endpoint string
+	// Collected is when the scrape was started.
+	Collected time.Time
+	// Kind is how the metrics were obtained.
+	Kind ProvenanceKind
+}
+
+// NewProvenance returns a new Provenance with the given fields, interning its strings.
+func NewProvenance(cycleID, source, endpoint string, collected time.Time, kind ProvenanceKind) *Provenance {
+	return &Provenance{
+		CycleID:   provenanceStrings.intern(cycleID),
+		Source:    provenanceStrings.intern(source),
+		Endpoint:  provenanceStrings.intern(endpoint),
+		Collected: collected,
+		Kind:      kind,
+	}
+}
+
+// WithKind returns a copy of the provenance with the given kind.
+func (p *Provenance) WithKind(kind ProvenanceKind) *Provenance {
+	res := *p
+	res.Kind = kind
+	return &res
+}
+
+// maxInternedStrings bounds each generation of interned provenance strings.  Cycle IDs are
+// new each cycle, so the strings are kept for two generations, rather than forever: enough
+// to span several cycles of endpoints, even on the largest clusters.
+const maxInternedStrings = 16384
+
+var provenanceStrings = &stringInterner{current: make(map[string]string)}
+
+// stringInterner deduplicates strings, keeping those recently interned.
+type stringInterner struct {
+	mu       sync.Mutex
+	current  map[string]string
+	previous map[string]string
+}
+
+func (in *stringInterner) intern(s string) string {
+	if s == "" {
+		return ""
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if interned, ok := in.current[s]; ok {
+		return interned
+	}
+	interned, ok := in.previous[s]
+	if !ok {
+		interned = s
+	}
+	if len(in.current) >= maxInternedStrings {
+		in.previous, in.current = in.current, make(map[string]string, maxInternedStrings)
+	}
+	in.current[interned] = interned
+	return interned
+}
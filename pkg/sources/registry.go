@@ -0,0 +1,182 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	v1listers "k8s.io/client-go/listers/core/v1"
+)
+
+// NodeFilter decides whether a given node is scraped by a particular source provider.
+type NodeFilter func(node *corev1.Node) bool
+
+// ProviderOptions are passed to a ProviderFactory when constructing its source provider.
+type ProviderOptions struct {
+	// NodeLister lists the nodes in the cluster.
+	NodeLister v1listers.NodeLister
+	// NodeFilter selects the nodes that the provider is responsible for.
+	// Providers must not produce sources for any other nodes, since each
+	// node may only be reported by a single source.
+	NodeFilter NodeFilter
+}
+
+// ProviderFactory constructs a MetricSourceProvider with the given options.
+type ProviderFactory func(opts ProviderOptions) (MetricSourceProvider, error)
+
+// Registration describes an additional source provider, responsible for the
+// nodes selected by its node selector (e.g. nodes that don't serve the Kubelet
+// summary API).  Nodes not selected by any registration are left to the default
+// provider (normally the Kubelet summary provider).
+type Registration struct {
+	// Name identifies the registration in logs and errors.
+	Name string
+	// NodeSelector selects the nodes that this provider is responsible for.
+	NodeSelector labels.Selector
+	// Factory constructs the provider.
+	Factory ProviderFactory
+}
+
+var (
+	registrationsMu sync.Mutex
+	registrations   []Registration
+)
+
+// Register makes an additional source provider available to metrics-server.
+// It is intended to be called from the init function of a compiled-in package.
+// It panics if the registration is incomplete, or its name is already registered.
+func Register(reg Registration) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	if reg.Name == "" || reg.NodeSelector == nil || reg.Factory == nil {
+		panic(fmt.Sprintf("incomplete source provider registration %q", reg.Name))
+	}
+	for _, existing := range registrations {
+		if existing.Name == reg.Name {
+			panic(fmt.Sprintf("source provider %q registered twice", reg.Name))
+		}
+	}
+	registrations = append(registrations, reg)
+}
+
+// Registrations returns all registered source providers, in registration order.
+func Registrations() []Registration {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	res := make([]Registration, len(registrations))
+	copy(res, registrations)
+	return res
+}
+
+// NewRegisteredSourceProvider constructs a MetricSourceProvider which combines the sources
+// from the given registrations with those of the default provider.  Each node is assigned
+// to the first registration whose selector matches it, or to the default provider
+// if none do, so the providers never produce sources for the same node.
+func NewRegisteredSourceProvider(nodeLister v1listers.NodeLister, defaultFactory ProviderFactory, regs []Registration) (MetricSourceProvider, error) {
+	res := make(multiSourceProvider, 0, len(regs)+1)
+	for i, reg := range regs {
+		prov, err := reg.Factory(ProviderOptions{
+			NodeLister: nodeLister,
+			NodeFilter: selectedFilter(regs[:i], reg.NodeSelector),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct source provider %q: %v", reg.Name, err)
+		}
+		res = append(res, namedSourceProvider{name: reg.Name, MetricSourceProvider: prov})
+	}
+
+	prov, err := defaultFactory(ProviderOptions{
+		NodeLister: nodeLister,
+		NodeFilter: selectedFilter(regs, labels.Everything()),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct default source provider: %v", err)
+	}
+	res = append(res, namedSourceProvider{name: "default", MetricSourceProvider: prov})
+
+	return res, nil
+}
+
+// FilteredFactory wraps the given factory, further restricting the nodes
+// its providers are responsible for to those selected by the given filter.
+func FilteredFactory(factory ProviderFactory, filter NodeFilter) ProviderFactory {
+	return func(opts ProviderOptions) (MetricSourceProvider, error) {
+		optsFilter := opts.NodeFilter
+		opts.NodeFilter = func(node *corev1.Node) bool {
+			return filter(node) && (optsFilter == nil || optsFilter(node))
+		}
+		return factory(opts)
+	}
+}
+
+// selectedFilter returns a NodeFilter selecting the nodes matched by the given
+// selector, but not by any of the given (earlier) registrations.
+func selectedFilter(earlier []Registration, selector labels.Selector) NodeFilter {
+	return func(node *corev1.Node) bool {
+		nodeLabels := labels.Set(node.Labels)
+		for _, reg := range earlier {
+			if reg.NodeSelector.Matches(nodeLabels) {
+				return false
+			}
+		}
+		return selector.Matches(nodeLabels)
+	}
+}
+
+type namedSourceProvider struct {
+	name string
+	MetricSourceProvider
+}
+
+// multiSourceProvider combines the sources of several providers.
+type multiSourceProvider []namedSourceProvider
+
+func (p multiSourceProvider) GetMetricSources() ([]MetricSource, error) {
+	var res []MetricSource
+	var errs []error
+	for _, prov := range p {
+		// NB: providers may return partial results alongside an error
+		srcs, err := prov.GetMetricSources()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("source provider %q: %v", prov.name, err))
+		}
+		res = append(res, srcs...)
+	}
+	return res, utilerrors.NewAggregate(errs)
+}
+
+// ResetBaselines resets the baselines of each provider which keeps them.
+func (p multiSourceProvider) ResetBaselines() {
+	for _, prov := range p {
+		if resetter, ok := prov.MetricSourceProvider.(BaselineResetter); ok {
+			resetter.ResetBaselines()
+		}
+	}
+}
+
+// CycleEnded tells each provider which observes them that the given cycle ended.
+func (p multiSourceProvider) CycleEnded(cycleID string) {
+	for _, prov := range p {
+		if observer, ok := prov.MetricSourceProvider.(CycleEndObserver); ok {
+			observer.CycleEnded(cycleID)
+		}
+	}
+}
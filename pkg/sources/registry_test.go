@@ -0,0 +1,136 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	fakesrc "github.com/kubernetes-incubator/metrics-server/pkg/sources/fake"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/noop"
+)
+
+// perNodeFactory returns a ProviderFactory producing a source, named with the given prefix,
+// for each node selected by the filter, which reports a single pod on its node.
+func perNodeFactory(prefix string) ProviderFactory {
+	return func(opts ProviderOptions) (MetricSourceProvider, error) {
+		nodes, err := opts.NodeLister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		var prov fakesrc.StaticSourceProvider
+		for _, node := range nodes {
+			if !opts.NodeFilter(node) {
+				continue
+			}
+			nodeName := node.Name
+			prov = append(prov, &fakesrc.FunctionSource{
+				SourceName: prefix + ":" + nodeName,
+				GenerateBatch: func(_ context.Context) (*MetricsBatch, error) {
+					point := MetricsPoint{
+						Timestamp:   time.Now(),
+						CpuUsage:    *resource.NewQuantity(100, resource.DecimalSI),
+						MemoryUsage: *resource.NewQuantity(200, resource.DecimalSI),
+					}
+					return &MetricsBatch{
+						Nodes: []NodeMetricsPoint{{Name: nodeName, MetricsPoint: point}},
+						Pods: []PodMetricsPoint{{Name: "pod-on-" + nodeName, Namespace: "ns1", Containers: []ContainerMetricsPoint{
+							{Name: "container1", MetricsPoint: point},
+						}}},
+					}, nil
+				},
+			})
+		}
+		return prov, nil
+	}
+}
+
+func sourceNames(srcs []MetricSource) []string {
+	names := make([]string, len(srcs))
+	for i, src := range srcs {
+		names[i] = src.Name()
+	}
+	return names
+}
+
+var _ = Describe("Registered Source Provider", func() {
+	var nodeLister v1listers.NodeLister
+
+	BeforeEach(func() {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		for name, nodeLabels := range map[string]map[string]string{
+			"node1": nil,
+			"node2": {noop.NodeLabel: noop.Name},
+			"node3": {"source": "virtual"},
+			"node4": {"source": "virtual", "virtual-json": "true"},
+		} {
+			Expect(indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels}})).To(Succeed())
+		}
+		nodeLister = v1listers.NewNodeLister(indexer)
+	})
+
+	It("should assign each node to the first matching registration, or the default provider", func() {
+		prov, err := NewRegisteredSourceProvider(nodeLister, perNodeFactory("default"), []Registration{
+			{Name: "virtual", NodeSelector: labels.SelectorFromSet(labels.Set{"source": "virtual"}), Factory: perNodeFactory("virtual")},
+			{Name: "virtual-json", NodeSelector: labels.SelectorFromSet(labels.Set{"virtual-json": "true"}), Factory: perNodeFactory("virtual-json")},
+			{Name: noop.Name, NodeSelector: labels.SelectorFromSet(labels.Set{noop.NodeLabel: noop.Name}), Factory: noop.NewProvider},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		srcs, err := prov.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sourceNames(srcs)).To(ConsistOf("default:node1", "noop:node2", "virtual:node3", "virtual:node4"))
+	})
+
+	It("should merge batches from several sources without conflicts", func() {
+		By("collecting from a default provider and an additional source provider")
+		prov, err := NewRegisteredSourceProvider(nodeLister, perNodeFactory("default"), []Registration{
+			{Name: "virtual", NodeSelector: labels.SelectorFromSet(labels.Set{"source": "virtual"}), Factory: perNodeFactory("virtual")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		batch, err := NewSourceManager(prov, 5*time.Second).Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that each node and pod was reported exactly once")
+		nodeNames := make([]string, len(batch.Nodes))
+		for i, node := range batch.Nodes {
+			nodeNames[i] = node.Name
+		}
+		Expect(nodeNames).To(ConsistOf("node1", "node2", "node3", "node4"))
+		Expect(batch.Pods).To(HaveLen(4))
+
+		By("verifying that the sink accepts the merged batch")
+		metricSink, _ := sink.NewSinkProvider()
+		Expect(metricSink.Receive(batch)).To(Succeed())
+	})
+
+	It("should register compiled-in source providers", func() {
+		Expect(Registrations()).To(ContainElement(WithTransform(func(reg Registration) string { return reg.Name }, Equal(noop.Name))))
+		Expect(func() {
+			Register(Registration{Name: noop.Name, NodeSelector: labels.Everything(), Factory: noop.NewProvider})
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,112 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Accelerator Stats", func() {
+	var (
+		server *httptest.Server
+		client KubeletInterface
+		host   string
+	)
+
+	BeforeEach(func() {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "summaries", "gpu-node.json"))
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewServer(&fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: string(body)})
+
+		skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		client, host = directClientWith(server, KubeletClientConfig{SkippedSubtrees: skips.Retaining(AcceleratorSubtrees)})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// collect collects the fixture with the given options, returning the accelerators of each container, by pod/container.
+	collect := func(opts SourceOptions) map[string][]sources.AcceleratorUsage {
+		src := NewSummaryMetricsSource(NodeInfo{Name: "gpu-node1", ConnectAddress: host}, client, opts)
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		res := make(map[string][]sources.AcceleratorUsage)
+		for _, pod := range batch.Pods {
+			for _, container := range pod.Containers {
+				res[pod.Name+"/"+container.Name] = container.Accelerators
+			}
+		}
+		return res
+	}
+
+	bytes := func(value int64) resource.Quantity {
+		return *resource.NewQuantity(value, resource.BinarySI)
+	}
+
+	It("should pass through the accelerators of containers that have them", func() {
+		Expect(collect(SourceOptions{AcceleratorStats: true})).To(Equal(map[string][]sources.AcceleratorUsage{
+			"trainer-0/trainer": {
+				{
+					Make:        "nvidia",
+					Model:       "tesla-v100-sxm2-16gb",
+					ID:          "GPU-2b8d7a6e-0c1f-4f3a-9e5d-7c6b5a4f3e2d",
+					MemoryTotal: bytes(16945512448),
+					MemoryUsed:  bytes(12884901888),
+					DutyCycle:   *resource.NewQuantity(92, resource.DecimalSI),
+				},
+				{
+					Make:        "nvidia",
+					Model:       "tesla-v100-sxm2-16gb",
+					ID:          "GPU-7e6d5c4b-3a2f-4e1d-8c9b-0a1f2e3d4c5b",
+					MemoryTotal: bytes(16945512448),
+					MemoryUsed:  bytes(11811160064),
+					DutyCycle:   *resource.NewQuantity(87, resource.DecimalSI),
+				},
+			},
+			"trainer-0/log-shipper": nil,
+			"inference-7d9f8c6b5-xk2lp/server": {
+				{
+					Make:        "nvidia",
+					Model:       "tesla-t4",
+					ID:          "GPU-0f1e2d3c-4b5a-4697-8877-665544332211",
+					MemoryTotal: bytes(15843721216),
+					MemoryUsed:  bytes(4294967296),
+					DutyCycle:   *resource.NewQuantity(35, resource.DecimalSI),
+				},
+			},
+		}))
+	})
+
+	It("should leave accelerators out when disabled", func() {
+		Expect(collect(SourceOptions{})).To(Equal(map[string][]sources.AcceleratorUsage{
+			"trainer-0/trainer":                nil,
+			"trainer-0/log-shipper":            nil,
+			"inference-7d9f8c6b5-xk2lp/server": nil,
+		}))
+	})
+})
@@ -15,11 +15,27 @@
 package summary
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"time"
 
+	"github.com/golang/glog"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
 )
 
+// hostLookupTimeout bounds how long checking that a node's hostnames resolve may take, altogether.
+const hostLookupTimeout = 2 * time.Second
+
+// TemporaryLookupFailureTTL is how long the address chosen for a node is remembered when
+// looking up its hostname failed temporarily (e.g. the DNS server timed out), rather than
+// until its addresses change, before it's looked up again.
+const TemporaryLookupFailureTTL = time.Minute
+
 var (
 	// DefaultAddressTypePriority is the default node address type
 	// priority list, as taken from the Kubernetes API server options.
@@ -47,12 +63,53 @@ type NodeAddressResolver interface {
 	NodeAddress(node *corev1.Node) (address string, err error)
 }
 
+// CandidateNodeAddressResolver is implemented by NodeAddressResolvers which can list every
+// address they'd consider connecting to a node at, so that scrapes can fall back through them
+// when the preferred address is unreachable (e.g. on nodes with separate management and data
+// plane networks, only one of which metrics-server can reach).
+type CandidateNodeAddressResolver interface {
+	NodeAddressResolver
+	// NodeAddresses lists the addresses of the given node of any of the prioritized types,
+	// without duplicates, in order of preference (starting with the one NodeAddress finds).
+	NodeAddresses(node *corev1.Node) ([]string, error)
+}
+
+// prioritizedAddresses returns the addresses of the given node of any of the given types, in
+// order of their type's priority, then their order within that type.
+func prioritizedAddresses(node *corev1.Node, typePriority []corev1.NodeAddressType) []corev1.NodeAddress {
+	var res []corev1.NodeAddress
+	for _, addrType := range typePriority {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type == addrType {
+				res = append(res, addr)
+			}
+		}
+	}
+	return res
+}
+
+// candidateList returns the given preferred address followed by the rest
+// of the given addresses, dropping duplicates.
+func candidateList(preferred string, addrs []corev1.NodeAddress) []string {
+	res := []string{preferred}
+	seen := map[string]struct{}{preferred: {}}
+	for _, addr := range addrs {
+		if _, ok := seen[addr.Address]; !ok {
+			seen[addr.Address] = struct{}{}
+			res = append(res, addr.Address)
+		}
+	}
+	return res
+}
+
 // prioNodeAddrResolver finds node addresses according to a list of
 // priorities of types of addresses.
 type prioNodeAddrResolver struct {
 	addrTypePriority []corev1.NodeAddressType
 }
 
+var _ CandidateNodeAddressResolver = &prioNodeAddrResolver{}
+
 func (r *prioNodeAddrResolver) NodeAddress(node *corev1.Node) (string, error) {
 	// adapted from k8s.io/kubernetes/pkg/util/node
 	for _, addrType := range r.addrTypePriority {
@@ -66,6 +123,14 @@ func (r *prioNodeAddrResolver) NodeAddress(node *corev1.Node) (string, error) {
 	return "", fmt.Errorf("node %s had no addresses that matched types %v", node.Name, r.addrTypePriority)
 }
 
+func (r *prioNodeAddrResolver) NodeAddresses(node *corev1.Node) ([]string, error) {
+	addrs := prioritizedAddresses(node, r.addrTypePriority)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("node %s had no addresses that matched types %v", node.Name, r.addrTypePriority)
+	}
+	return candidateList(addrs[0].Address, addrs), nil
+}
+
 // NewPriorityNodeAddressResolver creates a new NodeAddressResolver that resolves
 // addresses first based on a list of prioritized address types, then based on
 // address order (first to last) within a particular address type.
@@ -74,3 +139,152 @@ func NewPriorityNodeAddressResolver(typePriority []corev1.NodeAddressType) NodeA
 		addrTypePriority: typePriority,
 	}
 }
+
+// PruningNodeAddressResolver is implemented by NodeAddressResolvers which remember
+// something about each node, and so need to be told which nodes still exist.
+type PruningNodeAddressResolver interface {
+	NodeAddressResolver
+	// Prune forgets about any node not in the given set.
+	Prune(keep map[string]struct{})
+}
+
+// HostLookup looks up the addresses of a host, like net.Resolver's LookupHost.
+type HostLookup func(ctx context.Context, host string) ([]string, error)
+
+// fallbackNodeAddrResolver finds node addresses like prioNodeAddrResolver, except that it
+// passes over hostnames that don't resolve, for the next address in order of priority.
+// Some cloud providers name nodes after their instance IDs, and report those as their
+// hostnames, so preferring hostnames otherwise leaves every scrape failing with DNS errors.
+// The choice for each node is remembered until the node's addresses change, so nodes are
+// only looked up when they're first seen, and when their addresses change (or, if a lookup
+// failed temporarily, once the TemporaryLookupFailureTTL has passed).  A node's hostnames
+// are looked up concurrently, so a slow DNS server only holds up its scrape once.
+type fallbackNodeAddrResolver struct {
+	addrTypePriority []corev1.NodeAddressType
+	lookup           HostLookup
+	clock            clock.Clock
+
+	mu      sync.Mutex
+	choices map[string]addrChoice
+}
+
+// addrChoice is the address chosen for a node, and the addresses it was chosen from.
+type addrChoice struct {
+	addresses []corev1.NodeAddress
+	address   string
+	// expires, if set, is when the choice is next re-evaluated, even if the addresses are the same.
+	expires time.Time
+}
+
+var _ PruningNodeAddressResolver = &fallbackNodeAddrResolver{}
+var _ CandidateNodeAddressResolver = &fallbackNodeAddrResolver{}
+
+func (r *fallbackNodeAddrResolver) NodeAddress(node *corev1.Node) (string, error) {
+	now := r.clock.Now()
+	r.mu.Lock()
+	choice, ok := r.choices[node.Name]
+	r.mu.Unlock()
+	if ok && reflect.DeepEqual(choice.addresses, node.Status.Addresses) && (choice.expires.IsZero() || now.Before(choice.expires)) {
+		return choice.address, nil
+	}
+
+	candidates := prioritizedAddresses(node, r.addrTypePriority)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("node %s had no addresses that matched types %v", node.Name, r.addrTypePriority)
+	}
+
+	errs := r.resolve(candidates)
+	chosen := candidates[0]
+	var unresolved []corev1.NodeAddress
+	var lookupErr error
+	var expires time.Time
+	for i, candidate := range candidates {
+		chosen = candidate
+		err := errs[i]
+		if err == nil {
+			break
+		}
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			// it may resolve later, so use it (the scrape reporting why it fails,
+			// if it does), but look it up again once the failure's expired
+			expires = now.Add(TemporaryLookupFailureTTL)
+			break
+		}
+		if len(unresolved) == 0 {
+			lookupErr = err
+		}
+		unresolved = append(unresolved, candidate)
+	}
+	if len(unresolved) == len(candidates) {
+		// nothing better to fall back to, so leave it to the scrape to report the failure
+		chosen = candidates[0]
+	} else if len(unresolved) > 0 && expires.IsZero() {
+		glog.Warningf("node %q's %s address %q doesn't resolve (%v), so connecting to its %s address %q instead, until its addresses change", node.Name, unresolved[0].Type, unresolved[0].Address, lookupErr, chosen.Type, chosen.Address)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.choices[node.Name] = addrChoice{addresses: node.Status.Addresses, address: chosen.Address, expires: expires}
+	return chosen.Address, nil
+}
+
+// NodeAddresses lists the chosen address first, since the others may not resolve,
+// followed by the rest of the node's addresses of the prioritized types.
+func (r *fallbackNodeAddrResolver) NodeAddresses(node *corev1.Node) ([]string, error) {
+	chosen, err := r.NodeAddress(node)
+	if err != nil {
+		return nil, err
+	}
+	return candidateList(chosen, prioritizedAddresses(node, r.addrTypePriority)), nil
+}
+
+// resolve checks that each of the given addresses is an IP, or a hostname which resolves,
+// looking the hostnames up concurrently, within a single timeout, and returning the error
+// looking up each (or nil, if it's an IP or resolves).
+func (r *fallbackNodeAddrResolver) resolve(candidates []corev1.NodeAddress) []error {
+	ctx, cancel := context.WithTimeout(context.Background(), hostLookupTimeout)
+	defer cancel()
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		if net.ParseIP(candidate.Address) != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			_, errs[i] = r.lookup(ctx, host)
+		}(i, candidate.Address)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (r *fallbackNodeAddrResolver) Prune(keep map[string]struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for node := range r.choices {
+		if _, ok := keep[node]; !ok {
+			delete(r.choices, node)
+		}
+	}
+}
+
+// NewFallbackNodeAddressResolver creates a new NodeAddressResolver that resolves addresses
+// like NewPriorityNodeAddressResolver, except that it passes over hostnames which the given
+// lookup reports don't exist, in favor of the next address, if there is one.
+func NewFallbackNodeAddressResolver(typePriority []corev1.NodeAddressType, lookup HostLookup) NodeAddressResolver {
+	return NewFallbackNodeAddressResolverWithClock(typePriority, lookup, clock.RealClock{})
+}
+
+// NewFallbackNodeAddressResolverWithClock is like NewFallbackNodeAddressResolver, but uses
+// the given clock to expire the choices made after temporary lookup failures.
+func NewFallbackNodeAddressResolverWithClock(typePriority []corev1.NodeAddressType, lookup HostLookup, clk clock.Clock) NodeAddressResolver {
+	return &fallbackNodeAddrResolver{
+		addrTypePriority: typePriority,
+		lookup:           lookup,
+		clock:            clk,
+		choices:          make(map[string]addrChoice),
+	}
+}
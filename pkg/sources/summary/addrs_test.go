@@ -0,0 +1,168 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// stubLookup is a HostLookup which fails for the given names, recording the names looked up.
+type stubLookup struct {
+	missing   map[string]bool
+	temporary map[string]bool
+
+	mu     sync.Mutex
+	looked []string
+}
+
+func (l *stubLookup) LookupHost(_ context.Context, host string) ([]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.looked = append(l.looked, host)
+	switch {
+	case l.missing[host]:
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	case l.temporary[host]:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	return []string{"10.0.0.99"}, nil
+}
+
+func nodeWithAddresses(name string, addrs ...corev1.NodeAddress) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Addresses: addrs},
+	}
+}
+
+var _ = Describe("Fallback Node Address Resolver", func() {
+	var (
+		lookup    *stubLookup
+		fakeClock *clock.FakeClock
+		resolver  NodeAddressResolver
+	)
+
+	BeforeEach(func() {
+		lookup = &stubLookup{missing: map[string]bool{"i-0123456789": true}, temporary: map[string]bool{}}
+		fakeClock = clock.NewFakeClock(time.Now())
+		resolver = NewFallbackNodeAddressResolverWithClock(DefaultAddressTypePriority, lookup.LookupHost, fakeClock)
+	})
+
+	It("should prefer the hostname when it resolves", func() {
+		node := nodeWithAddresses("node1",
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "node1.example.com"})
+		Expect(resolver.NodeAddress(node)).To(Equal("node1.example.com"))
+	})
+
+	It("should fall back to the next address type when the hostname doesn't resolve, remembering the choice", func() {
+		node := nodeWithAddresses("i-0123456789",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "i-0123456789"},
+			corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "203.0.113.1"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"})
+		Expect(resolver.NodeAddress(node)).To(Equal("10.0.0.1"))
+		Expect(resolver.NodeAddress(node)).To(Equal("10.0.0.1"))
+		Expect(lookup.looked).To(Equal([]string{"i-0123456789"}))
+
+		By("re-evaluating the choice once the node's addresses change")
+		node = node.DeepCopy()
+		node.Status.Addresses[0].Address = "node1.example.com"
+		Expect(resolver.NodeAddress(node)).To(Equal("node1.example.com"))
+		Expect(lookup.looked).To(Equal([]string{"i-0123456789", "node1.example.com"}))
+	})
+
+	It("should keep the preferred address when nothing resolves, or resolving it may work later", func() {
+		lookup.missing["node1-internal"] = true
+		node := nodeWithAddresses("i-0123456789",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "i-0123456789"},
+			corev1.NodeAddress{Type: corev1.NodeInternalDNS, Address: "node1-internal"})
+		Expect(resolver.NodeAddress(node)).To(Equal("i-0123456789"))
+
+		lookup.temporary["node2"] = true
+		node = nodeWithAddresses("node2",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "node2"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.2"})
+		Expect(resolver.NodeAddress(node)).To(Equal("node2"))
+		By("remembering the failure for a while, rather than looking it up for every scrape")
+		lookup.looked = nil
+		fakeClock.Step(TemporaryLookupFailureTTL - time.Second)
+		Expect(resolver.NodeAddress(node)).To(Equal("node2"))
+		Expect(lookup.looked).To(BeEmpty())
+		By("looking it up again once the failure's expired, since it was temporary")
+		fakeClock.Step(time.Second)
+		delete(lookup.temporary, "node2")
+		Expect(resolver.NodeAddress(node)).To(Equal("node2"))
+		Expect(lookup.looked).To(Equal([]string{"node2"}))
+	})
+
+	It("should look up a node's hostnames concurrently", func() {
+		// each lookup waits for the other, so they only both succeed if they're concurrent
+		var arrived sync.WaitGroup
+		arrived.Add(2)
+		concurrent := func(ctx context.Context, host string) ([]string, error) {
+			arrived.Done()
+			waited := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(waited)
+			}()
+			select {
+			case <-waited:
+				return []string{"10.0.0.99"}, nil
+			case <-ctx.Done():
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}
+		resolver = NewFallbackNodeAddressResolver(DefaultAddressTypePriority, concurrent)
+		node := nodeWithAddresses("node1",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "node1"},
+			corev1.NodeAddress{Type: corev1.NodeInternalDNS, Address: "node1.internal"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"})
+		start := time.Now()
+		Expect(resolver.NodeAddress(node)).To(Equal("node1"))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("should list its choice first among the candidates, then the rest in order of preference", func() {
+		node := nodeWithAddresses("i-0123456789",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "i-0123456789"},
+			corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: "203.0.113.1"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "192.168.0.1"},
+			corev1.NodeAddress{Type: corev1.NodeInternalDNS, Address: "10.0.0.1"})
+		Expect(resolver.(CandidateNodeAddressResolver).NodeAddresses(node)).To(Equal([]string{"10.0.0.1", "i-0123456789", "192.168.0.1", "203.0.113.1"}))
+	})
+
+	It("should forget pruned nodes", func() {
+		node := nodeWithAddresses("i-0123456789",
+			corev1.NodeAddress{Type: corev1.NodeHostName, Address: "i-0123456789"},
+			corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"})
+		Expect(resolver.NodeAddress(node)).To(Equal("10.0.0.1"))
+		resolver.(PruningNodeAddressResolver).Prune(map[string]struct{}{})
+		Expect(resolver.NodeAddress(node)).To(Equal("10.0.0.1"))
+		Expect(lookup.looked).To(Equal([]string{"i-0123456789", "i-0123456789"}))
+	})
+})
@@ -0,0 +1,116 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// MetricsAgeInterval is how often the metrics age gauges are updated.
+const MetricsAgeInterval = 10 * time.Second
+
+var (
+	nodeMetricsAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_metrics_age_seconds",
+			Help:      "Seconds since the last successful scrape of each node, only published with per-node metrics ages enabled",
+		},
+		[]string{"node"},
+	)
+	nodePoolMetricsAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_pool_metrics_age_seconds",
+			Help:      "Seconds since the last successful scrape of the node scraped least recently in each node pool",
+		},
+		[]string{"node_pool"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(nodeMetricsAge)
+	prometheus.MustRegister(nodePoolMetricsAge)
+}
+
+// MetricsAgePublisher periodically publishes how long ago each node was last
+// successfully scraped, as recorded by a ScrapeStatusTracker.  Ages are always
+// published per node pool (taking the oldest node in each pool), and optionally
+// per node, since that adds a series per node.
+type MetricsAgePublisher struct {
+	statuses *ScrapeStatusTracker
+	perNode  bool
+	clock    clock.Clock
+}
+
+// NewMetricsAgePublisher returns a publisher of the ages recorded by the given tracker.
+func NewMetricsAgePublisher(statuses *ScrapeStatusTracker, perNode bool) *MetricsAgePublisher {
+	return NewMetricsAgePublisherWithClock(statuses, perNode, clock.RealClock{})
+}
+
+// NewMetricsAgePublisherWithClock is like NewMetricsAgePublisher, but uses the given clock to schedule and compute ages.
+func NewMetricsAgePublisherWithClock(statuses *ScrapeStatusTracker, perNode bool, clk clock.Clock) *MetricsAgePublisher {
+	return &MetricsAgePublisher{statuses: statuses, perNode: perNode, clock: clk}
+}
+
+// RunUntil publishes the ages every MetricsAgeInterval, until the given channel is closed.
+func (p *MetricsAgePublisher) RunUntil(stopCh <-chan struct{}) {
+	go func() {
+		ticker := p.clock.NewTicker(MetricsAgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				p.Publish()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Publish sets the age gauges from the current statuses.  Nodes which have
+// never been scraped successfully have no age, so are left out.
+func (p *MetricsAgePublisher) Publish() {
+	now := p.clock.Now()
+	poolAges := make(map[string]float64)
+	nodeMetricsAge.Reset()
+	for _, status := range p.statuses.List() {
+		if status.LastSuccess == nil {
+			continue
+		}
+		age := now.Sub(*status.LastSuccess).Seconds()
+		if p.perNode {
+			nodeMetricsAge.WithLabelValues(status.Node).Set(age)
+		}
+		pool := status.NodePool
+		if pool == "" {
+			pool = unknownNodePool
+		}
+		if oldest, ok := poolAges[pool]; !ok || age > oldest {
+			poolAges[pool] = age
+		}
+	}
+
+	nodePoolMetricsAge.Reset()
+	for pool, age := range poolAges {
+		nodePoolMetricsAge.WithLabelValues(pool).Set(age)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+const (
+	nodeAgeGauge = "metrics_server_kubelet_summary_node_metrics_age_seconds"
+	poolAgeGauge = "metrics_server_kubelet_summary_node_pool_metrics_age_seconds"
+)
+
+// poolGaugeValues fetches the values of the given per-pool gauge from the default registry, by pool.
+func poolGaugeValues(name string) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	res := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "node_pool" {
+					res[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return res
+}
+
+var _ = Describe("Metrics age publishing", func() {
+	var (
+		fakeClock *clock.FakeClock
+		statuses  *ScrapeStatusTracker
+		stopCh    chan struct{}
+	)
+
+	BeforeEach(func() {
+		fakeClock = clock.NewFakeClock(time.Now())
+		statuses = NewScrapeStatusTracker()
+		stopCh = make(chan struct{})
+
+		scraped := fakeClock.Now()
+		statuses.Update(NodeScrapeStatus{Node: "node1", NodePool: "pool-a", Success: true, LastScrape: scraped, LastSuccess: &scraped})
+		statuses.Update(NodeScrapeStatus{Node: "node3", Success: false, LastScrape: scraped})
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+	})
+
+	nodeAge := func(node string) float64 {
+		age, present := gaugeValue(nodeAgeGauge, node)
+		Expect(present).To(BeTrue(), "age of %s", node)
+		return age
+	}
+
+	scrapedAgo := func(node, pool string, ago time.Duration) {
+		scraped := fakeClock.Now().Add(-ago)
+		statuses.Update(NodeScrapeStatus{Node: node, NodePool: pool, Success: true, LastScrape: scraped, LastSuccess: &scraped})
+	}
+
+	It("should publish the age of the oldest node in each pool, as time passes", func() {
+		scrapedAgo("node2", "pool-a", 20*time.Second)
+		NewMetricsAgePublisherWithClock(statuses, false, fakeClock).RunUntil(stopCh)
+
+		By("waiting for the first update")
+		Eventually(fakeClock.HasWaiters).Should(BeTrue())
+		fakeClock.Step(MetricsAgeInterval)
+		Eventually(func() map[string]float64 { return poolGaugeValues(poolAgeGauge) }).Should(Equal(map[string]float64{
+			"pool-a": (20*time.Second + MetricsAgeInterval).Seconds(),
+		}))
+
+		By("verifying the age grows until the node is scraped again")
+		fakeClock.Step(MetricsAgeInterval)
+		Eventually(func() map[string]float64 { return poolGaugeValues(poolAgeGauge) }).Should(HaveKeyWithValue("pool-a", (20*time.Second + 2*MetricsAgeInterval).Seconds()))
+
+		By("verifying the age drops once every node in the pool is scraped again")
+		scrapedAgo("node1", "pool-a", 0)
+		scrapedAgo("node2", "pool-a", 0)
+		fakeClock.Step(MetricsAgeInterval)
+		Eventually(func() map[string]float64 { return poolGaugeValues(poolAgeGauge) }).Should(HaveKeyWithValue("pool-a", MetricsAgeInterval.Seconds()))
+	})
+
+	It("should keep aging nodes whose scrapes fail", func() {
+		nodeAges := NewMetricsAgePublisherWithClock(statuses, true, fakeClock)
+		fakeClock.Step(time.Minute)
+		statuses.Update(NodeScrapeStatus{Node: "node1", NodePool: "pool-a", Success: false, LastScrape: fakeClock.Now(), Error: "timed out"})
+		nodeAges.Publish()
+
+		Expect(nodeAge("node1")).To(Equal(time.Minute.Seconds()))
+		status, _ := statuses.Get("node1")
+		Expect(status.LastSuccess).NotTo(BeNil())
+	})
+
+	It("should only publish per-node ages when asked to", func() {
+		scrapedAgo("node2", "", 30*time.Second)
+
+		NewMetricsAgePublisherWithClock(statuses, false, fakeClock).Publish()
+		_, present := gaugeValue(nodeAgeGauge, "node2")
+		Expect(present).To(BeFalse())
+		Expect(poolGaugeValues(poolAgeGauge)).To(HaveKeyWithValue("unknown", float64(30)))
+
+		NewMetricsAgePublisherWithClock(statuses, true, fakeClock).Publish()
+		Expect(nodeAge("node2")).To(Equal(float64(30)))
+		Expect(nodeAge("node1")).To(BeZero())
+	})
+
+	It("should leave out nodes that were never scraped successfully", func() {
+		NewMetricsAgePublisherWithClock(statuses, true, fakeClock).Publish()
+		_, present := gaugeValue(nodeAgeGauge, "node3")
+		Expect(present).To(BeFalse())
+	})
+})
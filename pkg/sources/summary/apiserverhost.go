@@ -0,0 +1,254 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// When the API server's address changes (e.g. a VIP failing over to a new name or port, or
+// a rotated kubeconfig), requests through its proxy would keep going to the old address until
+// restarted.  So the address proxied through is re-resolved from the live client config, both
+// periodically, and after consecutive requests through it fail to get any response at all.
+// The transport the requests are made with is rebuilt too, whenever the TLS config or the
+// credentials in the client config change, so that the rotated kubeconfig's apply as well.
+
+// Defaults for re-resolving the API server's address.
+const (
+	DefaultAPIServerHostRefreshInterval = time.Minute
+	DefaultAPIServerHostRefreshFailures = 3
+)
+
+var apiServerHostChanges = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "apiserver_host_changes_total",
+		Help:      "The number of times the address of the API server proxied through changed, when re-resolved",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(apiServerHostChanges)
+}
+
+// APIServerHostConfig configures re-resolving the address of the API server proxied through.
+type APIServerHostConfig struct {
+	// Resolve returns the API server's current client config, e.g. reloaded from the kubeconfig:
+	// its host is the address proxied through, and its TLS config and credentials are those the
+	// requests through the proxy are made with.  It's called by whichever scrape finds the
+	// address due to be re-resolved, while the others carry on with the current address.
+	Resolve func() (*rest.Config, error)
+	// Interval is how often the address is re-resolved.  Zero only re-resolves it after failures.
+	Interval time.Duration
+	// Failures is the number of consecutive requests through the proxy which must fail to get
+	// any response (e.g. failing to connect) to re-resolve the address.  Zero only re-resolves
+	// it periodically.
+	Failures int
+	// Clock, if set, is used instead of the real clock.
+	Clock clock.Clock
+}
+
+// transportKey is what a transport to the API server is built from, besides its host, with
+// the TLS files loaded, so that rotating the files in place counts as a change too.
+type transportKey struct {
+	username, password, bearerToken string
+	impersonate                     rest.ImpersonationConfig
+	authProvider                    *clientcmdapi.AuthProviderConfig
+	execProvider                    *clientcmdapi.ExecConfig
+	tls                             rest.TLSClientConfig
+}
+
+// transportKeyOf returns the transport key of the given client config.
+func transportKeyOf(config *rest.Config) (transportKey, error) {
+	loaded := rest.CopyConfig(config)
+	if err := rest.LoadTLSFiles(loaded); err != nil {
+		return transportKey{}, err
+	}
+	return transportKey{
+		username:     loaded.Username,
+		password:     loaded.Password,
+		bearerToken:  loaded.BearerToken,
+		impersonate:  loaded.Impersonate,
+		authProvider: loaded.AuthProvider,
+		execProvider: loaded.ExecProvider,
+		tls:          loaded.TLSClientConfig,
+	}, nil
+}
+
+// apiServerHost holds the address (host and port) of the API server proxied through,
+// and the client the requests through it are made with.
+type apiServerHost struct {
+	config       APIServerHostConfig
+	clock        clock.Clock
+	newTransport func(*rest.Config) (http.RoundTripper, error)
+
+	mu     sync.Mutex
+	host   string
+	client *http.Client
+	// key is that of the current client's transport, if known
+	key          *transportKey
+	lastResolved time.Time
+	failures     int
+	resolving    bool
+}
+
+// newAPIServerHost returns the holder of the address of the API server with the given client
+// config, proxied through with the given client, re-resolving it as the given config (if any)
+// says, with transports built by the given func whenever the TLS config or credentials change.
+func newAPIServerHost(restConfig *rest.Config, client *http.Client, config *APIServerHostConfig, newTransport func(*rest.Config) (http.RoundTripper, error)) (*apiServerHost, error) {
+	host, err := hostOfURL(restConfig.Host)
+	if err != nil {
+		return nil, err
+	}
+	h := &apiServerHost{host: host, client: client, clock: clock.RealClock{}, newTransport: newTransport}
+	if key, err := transportKeyOf(restConfig); err == nil {
+		h.key = &key
+	}
+	if config != nil && config.Resolve != nil {
+		h.config = *config
+		if config.Clock != nil {
+			h.clock = config.Clock
+		}
+	}
+	h.lastResolved = h.clock.Now()
+	return h, nil
+}
+
+// hostOfURL returns the host and port of the given URL.
+func hostOfURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(parsed.Hostname(), parsed.Port()), nil
+}
+
+// get returns the current address, and the client to make requests to it with, first
+// re-resolving them if they're due to be.
+func (h *apiServerHost) get() (string, *http.Client) {
+	h.mu.Lock()
+	due := h.config.Interval > 0 && !h.resolving && h.clock.Since(h.lastResolved) >= h.config.Interval
+	var key *transportKey
+	if due {
+		key = h.startResolving()
+	}
+	h.mu.Unlock()
+	if due {
+		h.resolve("periodically", key)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.host, h.client
+}
+
+// observe counts the outcome of a request through the proxy, re-resolving the address once
+// enough consecutive requests have failed to get any response.
+func (h *apiServerHost) observe(ctx context.Context, err error) {
+	if h.config.Failures <= 0 {
+		return
+	}
+	var urlErr *url.Error
+	failed := err != nil && errors.As(err, &urlErr) && ctx.Err() != context.Canceled
+	h.mu.Lock()
+	if !failed {
+		h.failures = 0
+		h.mu.Unlock()
+		return
+	}
+	h.failures++
+	due := h.failures >= h.config.Failures && !h.resolving
+	var key *transportKey
+	if due {
+		key = h.startResolving()
+	}
+	h.mu.Unlock()
+	if due {
+		h.resolve("after consecutive failures", key)
+	}
+}
+
+// startResolving marks the address as being re-resolved, returning the key of the current
+// client's transport.  The caller must hold mu, and then resolve, without holding it.
+func (h *apiServerHost) startResolving() *transportKey {
+	h.resolving = true
+	h.lastResolved = h.clock.Now()
+	h.failures = 0
+	return h.key
+}
+
+// resolve re-resolves the address, rebuilding the client if the TLS config or credentials
+// differ from those of the given key, keeping the current ones if that fails.  The caller
+// mustn't hold mu, since reloading the client config may read files.
+func (h *apiServerHost) resolve(why string, key *transportKey) {
+	host, client, newKey, err := h.reload(key)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.resolving = false
+	if err != nil {
+		glog.Warningf("unable to re-resolve the API server's address (%s), still proxying through %s: %v", why, h.host, err)
+		return
+	}
+	if host != h.host {
+		glog.Infof("the API server's address changed from %s to %s (re-resolved %s), proxying through the new address", h.host, host, why)
+		apiServerHostChanges.Inc()
+		h.host = host
+	}
+	if client != nil {
+		glog.Infof("the TLS config or credentials of the API server's client config changed (re-resolved %s), proxying with them from now on", why)
+		h.client, h.key = client, &newKey
+	}
+}
+
+// reload reloads the client config, returning the API server's address, and a new client if
+// the TLS config or credentials differ from those of the given key (or nil if they don't).
+func (h *apiServerHost) reload(key *transportKey) (string, *http.Client, transportKey, error) {
+	restConfig, err := h.config.Resolve()
+	if err != nil {
+		return "", nil, transportKey{}, err
+	}
+	host, err := hostOfURL(restConfig.Host)
+	if err != nil {
+		return "", nil, transportKey{}, err
+	}
+	newKey, err := transportKeyOf(restConfig)
+	if err != nil {
+		return "", nil, transportKey{}, err
+	}
+	if key != nil && reflect.DeepEqual(*key, newKey) {
+		return host, nil, newKey, nil
+	}
+	transport, err := h.newTransport(restConfig)
+	if err != nil {
+		return "", nil, transportKey{}, fmt.Errorf("unable to construct transport: %v", err)
+	}
+	return host, &http.Client{Transport: transport, CheckRedirect: checkRedirect}, newKey, nil
+}
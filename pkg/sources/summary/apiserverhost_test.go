@@ -0,0 +1,201 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// apiServerHostChanges fetches the number of times the API server's address changed from the default registry.
+func apiServerHostChanges() float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == "metrics_server_kubelet_summary_apiserver_host_changes_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Kubelet Client re-resolving the API server's address", func() {
+	var (
+		oldAPIServer, newAPIServer *fakeProxyingAPIServer
+		oldServer, newServer       *httptest.Server
+		fakeClock                  *clock.FakeClock
+		config                     *KubeletClientConfig
+		client                     KubeletInterface
+
+		mu       sync.Mutex
+		current  string
+		token    string
+		resolves int
+		// resolve is what re-resolving calls, set per test before the client copies its config
+		resolve func() (*rest.Config, error)
+	)
+
+	BeforeEach(func() {
+		scrapeTime := time.Now()
+		healthy := summaryBody(&stats.Summary{Node: stats.NodeStats{
+			NodeName: "node1",
+			CPU:      cpuStats(100, scrapeTime),
+			Memory:   memStats(200, scrapeTime),
+		}})
+		oldAPIServer = &fakeProxyingAPIServer{status: http.StatusOK, body: healthy}
+		oldServer = httptest.NewServer(oldAPIServer)
+		newAPIServer = &fakeProxyingAPIServer{status: http.StatusOK, body: healthy}
+		newServer = httptest.NewServer(newAPIServer)
+		fakeClock = clock.NewFakeClock(scrapeTime)
+		current, token, resolves = oldServer.URL, "", 0
+		resolve = func() (*rest.Config, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			resolves++
+			return &rest.Config{Host: current, BearerToken: token}, nil
+		}
+		config = &KubeletClientConfig{
+			Port:                         10250,
+			RESTConfig:                   &rest.Config{Host: oldServer.URL},
+			DeprecatedCompletelyInsecure: true,
+			UseAPIServerProxy:            true,
+			APIServerHost: &APIServerHostConfig{
+				Resolve:  func() (*rest.Config, error) { return resolve() },
+				Interval: 5 * time.Minute,
+				Failures: 2,
+				Clock:    fakeClock,
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		client, err = NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		oldServer.Close()
+		newServer.Close()
+	})
+
+	// rotate moves the API server to its new address, as the client config would then say.
+	rotate := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		current = newServer.URL
+	}
+
+	scrape := func() error {
+		_, _, err := client.GetSummary(context.Background(), "node1")
+		return err
+	}
+
+	It("should proxy through the new address once enough consecutive requests fail to connect", func() {
+		Expect(scrape()).To(Succeed())
+		changes := apiServerHostChanges()
+
+		By("failing to connect to the old address, until the threshold")
+		oldServer.Close()
+		rotate()
+		Expect(scrape()).NotTo(Succeed())
+		Expect(resolves).To(Equal(0))
+		Expect(scrape()).NotTo(Succeed())
+		Expect(resolves).To(Equal(1))
+
+		By("proxying through the new address, without rebuilding the client")
+		Expect(scrape()).To(Succeed())
+		Expect(newAPIServer.requestCount()).To(Equal(1))
+		Expect(apiServerHostChanges()).To(Equal(changes + 1))
+	})
+
+	It("should not count error responses from the API server as failures", func() {
+		oldAPIServer.respond(http.StatusServiceUnavailable, overloadedBody)
+		rotate()
+		for i := 0; i < 3; i++ {
+			Expect(scrape()).NotTo(Succeed())
+		}
+		Expect(resolves).To(Equal(0))
+		Expect(newAPIServer.requestCount()).To(Equal(0))
+	})
+
+	It("should re-resolve the address periodically, even while requests succeed", func() {
+		Expect(scrape()).To(Succeed())
+		rotate()
+		fakeClock.Step(time.Minute)
+		Expect(scrape()).To(Succeed())
+		Expect(oldAPIServer.requestCount()).To(Equal(2))
+
+		fakeClock.Step(5 * time.Minute)
+		Expect(scrape()).To(Succeed())
+		Expect(resolves).To(Equal(1))
+		Expect(newAPIServer.requestCount()).To(Equal(1))
+	})
+
+	It("should proxy with rotated credentials once re-resolved, at the same address", func() {
+		Expect(scrape()).To(Succeed())
+		Expect(oldAPIServer.lastAuthorization()).To(BeEmpty())
+
+		mu.Lock()
+		token = "rotated"
+		mu.Unlock()
+		fakeClock.Step(5 * time.Minute)
+		Expect(scrape()).To(Succeed())
+		Expect(oldAPIServer.lastAuthorization()).To(Equal("Bearer rotated"))
+	})
+
+	It("should keep proxying through the current address while another scrape re-resolves it", func() {
+		started, release := make(chan struct{}), make(chan struct{})
+		resolve = func() (*rest.Config, error) {
+			close(started)
+			<-release
+			return &rest.Config{Host: newServer.URL}, nil
+		}
+		fakeClock.Step(5 * time.Minute)
+		resolving := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			resolving <- scrape()
+		}()
+		<-started
+
+		Expect(scrape()).To(Succeed())
+		Expect(oldAPIServer.requestCount()).To(Equal(1))
+		close(release)
+		Expect(<-resolving).To(Succeed())
+		Expect(newAPIServer.requestCount()).To(Equal(1))
+	})
+
+	It("should keep proxying through the current address when re-resolving fails", func() {
+		resolve = func() (*rest.Config, error) {
+			return nil, context.DeadlineExceeded
+		}
+		fakeClock.Step(5 * time.Minute)
+		Expect(scrape()).To(Succeed())
+		Expect(oldAPIServer.requestCount()).To(Equal(1))
+	})
+})
@@ -0,0 +1,303 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// When the API server is degraded, scrapes through its proxy pile up and time out, adding
+// to its load just when it can least afford it.  The circuit breaker tracks the outcome
+// of proxied requests over a sliding window, and once enough of them fail (timing out,
+// failing to connect, or being answered with 429 or a 5xx by the API server itself), it
+// opens, failing requests fast with ErrCircuitOpen for a cool-down period.  After that,
+// it's half-open, letting a few probe requests through: if they all succeed, it closes
+// again, and if any fails, it opens for another cool-down period.  Failures to reach the
+// Kubelet reported by the API server (ErrProxy) don't count, since the API server itself
+// is healthy.
+
+// Defaults for the proxy circuit breaker settings.
+const (
+	DefaultBreakerWindow      = time.Minute
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerCooldown    = 30 * time.Second
+	DefaultBreakerProbes      = 3
+)
+
+// breakerBuckets is the number of buckets the window is divided into.
+const breakerBuckets = 10
+
+// The states of the circuit breaker, as they appear in metrics and scrape statuses.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+var circuitStates = []string{CircuitClosed, CircuitOpen, CircuitHalfOpen}
+
+var proxyCircuitState = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "proxy_circuit_state",
+		Help:      "The state of the circuit breaker around the API server proxy: 1 for the current state, and 0 for the others",
+	},
+	[]string{"state"},
+)
+
+func init() {
+	prometheus.MustRegister(proxyCircuitState)
+}
+
+// CircuitBreakerConfig configures the circuit breaker around the API server proxy.
+type CircuitBreakerConfig struct {
+	// FailureRate is the fraction of requests within the window that must fail to open the circuit.
+	FailureRate float64
+	// MinRequests is the number of requests that must be made within the window before
+	// the circuit can open, so that a handful of failures doesn't open it.
+	MinRequests int
+	// Window is the period over which the failure rate is calculated.
+	Window time.Duration
+	// Cooldown is how long the circuit stays open before letting probe requests through.
+	Cooldown time.Duration
+	// Probes is the number of probe requests which must succeed to close the circuit.
+	Probes int
+	// Clock, if set, is used instead of the real clock.
+	Clock clock.Clock
+}
+
+// ErrCircuitOpen indicates that a request through the API server proxy wasn't made,
+// since the circuit breaker is open after too many recent requests failed.
+type ErrCircuitOpen struct {
+	endpoint string
+	// RetryAt is when the circuit next lets probe requests through.
+	RetryAt time.Time
+	trigger scrapeTrigger
+}
+
+func (err *ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("not requesting %q (%s), since the API server proxy circuit breaker is open after too many failures, until %s", err.endpoint, err.trigger, err.RetryAt.Format(time.RFC3339))
+}
+
+func (err *ErrCircuitOpen) ErrorClass() string { return ErrorClassCircuitOpen }
+func (err *ErrCircuitOpen) Remediation() string {
+	return remediations[ErrorClassCircuitOpen]
+}
+
+// IsCircuitOpenError checks if the given error (or any error it wraps) is an ErrCircuitOpen.
+func IsCircuitOpenError(err error) bool {
+	var circuitErr *ErrCircuitOpen
+	return errors.As(err, &circuitErr)
+}
+
+// breakerBucket counts the outcomes of the requests made in one slice of the window.
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// circuitBreaker decides whether requests through the API server proxy may be made.
+type circuitBreaker struct {
+	config CircuitBreakerConfig
+	clock  clock.Clock
+
+	mu      sync.Mutex
+	state   string
+	buckets [breakerBuckets]breakerBucket
+	// retryAt is when an open circuit becomes half-open.
+	retryAt time.Time
+	// probing and probed count the outstanding and successful probes while half-open.
+	probing int
+	probed  int
+	// inFlight holds the cancel functions of the requests in flight, by ID,
+	// so that they can be abandoned when the circuit opens.
+	inFlight    map[uint64]context.CancelCauseFunc
+	nextRequest uint64
+}
+
+// newCircuitBreaker returns the circuit breaker set in the given config,
+// or nil if there is none.
+func newCircuitBreaker(config *KubeletClientConfig) *circuitBreaker {
+	if config.ProxyBreaker == nil || config.ProxyBreaker.FailureRate <= 0 || !config.UseAPIServerProxy {
+		return nil
+	}
+	b := &circuitBreaker{config: *config.ProxyBreaker, clock: config.ProxyBreaker.Clock, inFlight: make(map[uint64]context.CancelCauseFunc)}
+	if b.clock == nil {
+		b.clock = clock.RealClock{}
+	}
+	if b.config.Window <= 0 {
+		b.config.Window = DefaultBreakerWindow
+	}
+	if b.config.Probes < 1 {
+		b.config.Probes = 1
+	}
+	b.setState(CircuitClosed)
+	return b
+}
+
+// allow checks if a request may be made, returning whether it's a probe, and the state of
+// the circuit it was made in.  It returns an ErrCircuitOpen if the request must not be made.
+func (b *circuitBreaker) allow(endpoint string, trigger scrapeTrigger) (bool, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.clock.Now().Before(b.retryAt) {
+			return false, b.state, &ErrCircuitOpen{endpoint: endpoint, RetryAt: b.retryAt, trigger: trigger}
+		}
+		glog.Infof("API server proxy circuit breaker is half-open, probing with up to %d requests", b.config.Probes)
+		b.setState(CircuitHalfOpen)
+		b.probing, b.probed = 0, 0
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probing+b.probed >= b.config.Probes {
+			// wait for the outstanding probes
+			return false, b.state, &ErrCircuitOpen{endpoint: endpoint, RetryAt: b.clock.Now(), trigger: trigger}
+		}
+		b.probing++
+		return true, b.state, nil
+	default:
+		return false, b.state, nil
+	}
+}
+
+// track returns the context to make a request allowed by allow with, which is canceled if the
+// circuit opens while the request is in flight, and a function to call once it's recorded.
+func (b *circuitBreaker) track(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	b.mu.Lock()
+	id := b.nextRequest
+	b.nextRequest++
+	b.inFlight[id] = cancel
+	b.mu.Unlock()
+	return ctx, func() {
+		b.mu.Lock()
+		delete(b.inFlight, id)
+		b.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// record counts the outcome of a request allowed by allow.
+func (b *circuitBreaker) record(probe bool, req *http.Request, err error) {
+	failed, counted := breakerFailure(req, err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing--
+		switch {
+		case b.state != CircuitHalfOpen || !counted:
+		case failed:
+			b.trip("a probe request failed")
+		default:
+			b.probed++
+			if b.probed >= b.config.Probes {
+				glog.Infof("API server proxy circuit breaker closed, after %d successful probe requests", b.probed)
+				b.setState(CircuitClosed)
+				b.buckets = [breakerBuckets]breakerBucket{}
+			}
+		}
+		return
+	}
+	// requests made before the circuit opened don't count
+	if b.state != CircuitClosed || !counted {
+		return
+	}
+
+	now := b.clock.Now()
+	width := b.config.Window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+
+	var requests, failures int
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.config.Window {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	if requests >= b.config.MinRequests && float64(failures) >= b.config.FailureRate*float64(requests) {
+		b.trip(fmt.Sprintf("%d of the last %d requests failed", failures, requests))
+	}
+}
+
+// trip opens the circuit for the cool-down period, abandoning the requests in flight,
+// which would otherwise most likely pile up and time out.
+func (b *circuitBreaker) trip(reason string) {
+	b.retryAt = b.clock.Now().Add(b.config.Cooldown)
+	glog.Warningf("API server proxy circuit breaker opened since %s, failing requests fast until %s", reason, b.retryAt.Format(time.RFC3339))
+	b.setState(CircuitOpen)
+	for id, cancel := range b.inFlight {
+		cancel(&sources.ErrCanceled{Reason: sources.CancelReasonCircuitOpen, Detail: fmt.Sprintf("the API server proxy circuit breaker opened since %s", reason)})
+		delete(b.inFlight, id)
+	}
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	for _, s := range circuitStates {
+		val := 0.0
+		if s == state {
+			val = 1
+		}
+		proxyCircuitState.WithLabelValues(s).Set(val)
+	}
+}
+
+// breakerFailure checks if the outcome of the given request suggests that the API server is
+// degraded, and whether it should be counted at all (it's not, if the request was canceled).
+func breakerFailure(req *http.Request, err error) (failed bool, counted bool) {
+	if err == nil {
+		return false, true
+	}
+	if req.Context().Err() == context.Canceled {
+		return false, false
+	}
+	var statusErr *errUnexpectedStatus
+	var urlErr *url.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= http.StatusInternalServerError, true
+	case errors.As(err, &urlErr):
+		return true, true
+	default:
+		// the API server answered (if only to pass on an error from the Kubelet)
+		return false, true
+	}
+}
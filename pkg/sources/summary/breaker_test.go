@@ -0,0 +1,279 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// fakeProxyingAPIServer serves summaries through its node proxy endpoints, unless it's failing.
+type fakeProxyingAPIServer struct {
+	mu       sync.Mutex
+	status   int
+	body     string
+	requests int
+	// authorization is the Authorization header of the last request
+	authorization string
+}
+
+func (s *fakeProxyingAPIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.Contains(req.URL.Path, "/nodes/hung/") {
+		// hang until canceled, like a Kubelet behind an overloaded API server
+		s.mu.Lock()
+		s.requests++
+		s.mu.Unlock()
+		<-req.Context().Done()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.authorization = req.Header.Get("Authorization")
+	if !strings.HasSuffix(req.URL.Path, "/proxy/stats/summary/") {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(s.status)
+	w.Write([]byte(s.body))
+}
+
+func (s *fakeProxyingAPIServer) respond(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.body = status, body
+}
+
+func (s *fakeProxyingAPIServer) lastAuthorization() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorization
+}
+
+func (s *fakeProxyingAPIServer) requestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// circuitState fetches the current state of the proxy circuit breaker from the default registry.
+func circuitState() string {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_proxy_circuit_state" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetGauge().GetValue() == 1 {
+				return metric.GetLabel()[0].GetValue()
+			}
+		}
+	}
+	return ""
+}
+
+const overloadedBody = `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "message": "the server is currently unable to handle the request", "code": 503}`
+
+var _ = Describe("Kubelet Client with a proxy circuit breaker", func() {
+	var (
+		apiServer *fakeProxyingAPIServer
+		server    *httptest.Server
+		fakeClock *clock.FakeClock
+		config    *KubeletClientConfig
+		client    KubeletInterface
+		healthy   string
+	)
+
+	BeforeEach(func() {
+		scrapeTime := time.Now()
+		healthy = summaryBody(&stats.Summary{Node: stats.NodeStats{
+			NodeName: "node1",
+			CPU:      cpuStats(100, scrapeTime),
+			Memory:   memStats(200, scrapeTime),
+		}})
+		apiServer = &fakeProxyingAPIServer{status: http.StatusOK, body: healthy}
+		server = httptest.NewServer(apiServer)
+		fakeClock = clock.NewFakeClock(scrapeTime)
+		config = &KubeletClientConfig{
+			Port:                         10250,
+			RESTConfig:                   &rest.Config{Host: server.URL},
+			DeprecatedCompletelyInsecure: true,
+			UseAPIServerProxy:            true,
+			ProxyBreaker: &CircuitBreakerConfig{
+				FailureRate: 0.5,
+				MinRequests: 4,
+				Window:      time.Minute,
+				Cooldown:    30 * time.Second,
+				Probes:      2,
+				Clock:       fakeClock,
+			},
+		}
+		var err error
+		client, err = NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	scrape := func() (*Provenance, error) {
+		_, prov, err := client.GetSummary(context.Background(), "node1")
+		return prov, err
+	}
+
+	It("should open once enough requests fail, then half-open after the cool-down, and close once the probes succeed", func() {
+		By("failing half the requests in the window, while closed")
+		for i := 0; i < 2; i++ {
+			prov, err := scrape()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(prov.Circuit).To(Equal(CircuitClosed))
+		}
+		apiServer.respond(http.StatusServiceUnavailable, overloadedBody)
+		_, err := scrape()
+		Expect(err).To(HaveOccurred())
+		Expect(circuitState()).To(Equal(CircuitClosed))
+		_, err = scrape()
+		Expect(err).To(HaveOccurred())
+		Expect(IsCircuitOpenError(err)).To(BeFalse())
+
+		By("failing fast, without making requests, while open")
+		Expect(circuitState()).To(Equal(CircuitOpen))
+		requests := apiServer.requestCount()
+		prov, err := scrape()
+		Expect(IsCircuitOpenError(err)).To(BeTrue(), "expected a circuit open error, got %v", err)
+		Expect(ErrorClass(err)).To(Equal(ErrorClassCircuitOpen))
+		Expect(prov.Circuit).To(Equal(CircuitOpen))
+		Expect(apiServer.requestCount()).To(Equal(requests))
+
+		By("probing once the cool-down has passed")
+		apiServer.respond(http.StatusOK, healthy)
+		fakeClock.Step(30 * time.Second)
+		prov, err = scrape()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Circuit).To(Equal(CircuitHalfOpen))
+		Expect(circuitState()).To(Equal(CircuitHalfOpen))
+
+		By("closing once enough probes have succeeded")
+		_, err = scrape()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(circuitState()).To(Equal(CircuitClosed))
+		prov, err = scrape()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Circuit).To(Equal(CircuitClosed))
+	})
+
+	It("should open again for another cool-down if a probe fails", func() {
+		config.ProxyBreaker.MinRequests = 1
+		client, _ = NewKubeletClient(http.DefaultTransport, config)
+		apiServer.respond(http.StatusTooManyRequests, overloadedBody)
+		scrape()
+		Expect(circuitState()).To(Equal(CircuitOpen))
+
+		fakeClock.Step(30 * time.Second)
+		prov, err := scrape()
+		Expect(IsCircuitOpenError(err)).To(BeFalse())
+		Expect(prov.Circuit).To(Equal(CircuitHalfOpen))
+		Expect(circuitState()).To(Equal(CircuitOpen))
+
+		fakeClock.Step(29 * time.Second)
+		_, err = scrape()
+		Expect(IsCircuitOpenError(err)).To(BeTrue())
+	})
+
+	It("should not count the API server failing to reach a Kubelet", func() {
+		config.ProxyBreaker.MinRequests = 1
+		client, _ = NewKubeletClient(http.DefaultTransport, config)
+		apiServer.respond(http.StatusServiceUnavailable, `{"kind": "Status", "apiVersion": "v1", "status": "Failure", "message": "error trying to reach service: dial tcp 10.0.0.1:10250: connect: connection refused", "code": 503}`)
+		for i := 0; i < 3; i++ {
+			_, err := scrape()
+			Expect(IsProxyError(err)).To(BeTrue())
+		}
+		Expect(circuitState()).To(Equal(CircuitClosed))
+	})
+
+	It("should abandon the requests in flight when the circuit opens, saying why", func() {
+		config.ProxyBreaker.MinRequests = 1
+		client, _ = NewKubeletClient(http.DefaultTransport, config)
+
+		By("starting a request which hangs")
+		hung := make(chan error, 1)
+		go func() {
+			_, _, err := client.GetSummary(context.Background(), "hung")
+			hung <- err
+		}()
+		Eventually(apiServer.requestCount).Should(Equal(1))
+
+		By("opening the circuit with a failed request")
+		apiServer.respond(http.StatusServiceUnavailable, overloadedBody)
+		scrape()
+		Expect(circuitState()).To(Equal(CircuitOpen))
+
+		By("checking that the hung request was canceled, with the circuit opening as the cause")
+		var err error
+		Eventually(hung).Should(Receive(&err))
+		canceled, ok := sources.CancelCause(err)
+		Expect(ok).To(BeTrue(), "expected a cancellation cause in %v", err)
+		Expect(canceled.Reason).To(Equal(sources.CancelReasonCircuitOpen))
+		Expect(ErrorClass(err)).To(Equal(ErrorClassCircuitOpen))
+	})
+
+	It("should keep serving the last-known data of nodes while the circuit is open", func() {
+		config.ProxyBreaker.MinRequests = 1
+		client, _ = NewKubeletClient(http.DefaultTransport, config)
+		statuses := NewScrapeStatusTracker()
+		node := makeNode("node1", "node1", "10.0.1.2", true)
+		node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeHostName, Address: "node1"}}
+		provider := NewSummaryProvider(&fakeNodeLister{nodes: []*corev1.Node{node}}, client, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{Statuses: statuses})
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs).To(HaveLen(1))
+
+		By("collecting a batch while the API server is healthy")
+		batch, err := srcs[0].Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Nodes).To(HaveLen(1))
+
+		By("opening the circuit")
+		apiServer.respond(http.StatusServiceUnavailable, overloadedBody)
+		failed, err := srcs[0].Collect(context.Background())
+		Expect(err).To(HaveOccurred())
+		Expect(failed).To(BeNil())
+
+		By("serving the last batch while it's open")
+		stale, err := srcs[0].Collect(context.Background())
+		Expect(IsCircuitOpenError(err)).To(BeTrue())
+		Expect(stale).To(Equal(batch))
+		status, _ := statuses.Get("node1")
+		Expect(status.Source.Circuit).To(Equal(CircuitOpen))
+	})
+})
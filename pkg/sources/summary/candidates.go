@@ -0,0 +1,148 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// DefaultAddressFallbackTTL is how long the candidate address found working for a
+// node is remembered by default, before its preferred address is tried again.
+const DefaultAddressFallbackTTL = 10 * time.Minute
+
+// FetchFromCandidates calls fetch with each of the given candidate addresses of the named node in turn,
+// until one doesn't fail to connect, returning the address last tried, and the error fetching
+// from it.  Each candidate but the last gets an even share of the time left to connect, so that
+// one that never answers can't use up the whole timeout before the others are tried.
+func FetchFromCandidates(ctx context.Context, node string, candidates []string, fetch func(ctx context.Context, addr string) error) (string, error) {
+	var addr string
+	var err error
+	for i := range candidates {
+		addr = candidates[i]
+		attemptCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok && i+1 < len(candidates) {
+			share := time.Until(deadline) / time.Duration(len(candidates)-i)
+			attemptCtx = withDialDeadline(ctx, time.Now().Add(share))
+		}
+		err = fetch(attemptCtx, addr)
+		if err == nil || !IsDialError(err) || ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(candidates) {
+			logging.FromContext(ctx, loglevel.Scraper).V(2).Info(fmt.Sprintf("unable to connect to node %q at %q (%v), trying its next candidate address %q", node, addr, err, candidates[i+1]), "address", addr, "err", err, "nextAddress", candidates[i+1])
+		}
+	}
+	return addr, err
+}
+
+// addressMemo is the candidate address last found working for a node,
+// the candidates it was chosen from, and when it was found.
+type addressMemo struct {
+	candidates []string
+	address    string
+	found      time.Time
+}
+
+// addressFallback remembers the candidate address found working for each node whose preferred
+// address was unreachable, so that later scrapes start from it, rather than waiting on the
+// unreachable addresses each time.  A memo is forgotten as soon as the node's candidates change,
+// or once it's older than the TTL, so that the preferred address is retried in case it's become
+// reachable again (e.g. when the pod lands on another network).
+type addressFallback struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	memos map[string]addressMemo
+}
+
+func newAddressFallback(ttl time.Duration) *addressFallback {
+	return &addressFallback{
+		ttl:   ttl,
+		now:   time.Now,
+		memos: make(map[string]addressMemo),
+	}
+}
+
+// order returns the given candidate addresses of the given node in the order to try them:
+// starting with the one found working, if it's remembered, and then in order of preference.
+func (f *addressFallback) order(node string, candidates []string) []string {
+	if f == nil || len(candidates) < 2 {
+		return candidates
+	}
+	f.mu.Lock()
+	memo, ok := f.memos[node]
+	if ok && (!reflect.DeepEqual(memo.candidates, candidates) || f.now().Sub(memo.found) >= f.ttl) {
+		delete(f.memos, node)
+		ok = false
+	}
+	f.mu.Unlock()
+	if !ok || memo.address == candidates[0] {
+		return candidates
+	}
+
+	res := make([]string, 0, len(candidates))
+	res = append(res, memo.address)
+	for _, candidate := range candidates {
+		if candidate != memo.address {
+			res = append(res, candidate)
+		}
+	}
+	return res
+}
+
+// found records that the given candidate address of the given node was reachable.
+func (f *addressFallback) found(node string, candidates []string, address string) {
+	if f == nil || len(candidates) < 2 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	memo, ok := f.memos[node]
+	if address == candidates[0] {
+		// the preferred address needs no remembering
+		delete(f.memos, node)
+		return
+	}
+	if ok && memo.address == address && reflect.DeepEqual(memo.candidates, candidates) {
+		// keep counting the TTL from when it was first found
+		return
+	}
+	glog.Warningf("node %q is unreachable at its preferred address %q, so connecting to its candidate address %q instead, for up to %s or until its addresses change", node, candidates[0], address, f.ttl)
+	f.memos[node] = addressMemo{candidates: candidates, address: address, found: f.now()}
+}
+
+// prune forgets the memos of any node not in the given set.
+func (f *addressFallback) prune(keep map[string]struct{}) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for node := range f.memos {
+		if _, ok := keep[node]; !ok {
+			delete(f.memos, node)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// blackhole is the route to an address whose connections are never answered.
+const blackhole = "blackhole"
+
+var _ = Describe("Summary Source Provider falling back through candidate addresses", func() {
+	var (
+		kubelet  *fakeKubelet
+		server   *httptest.Server
+		client   KubeletInterface
+		lister   *fakeNodeLister
+		statuses *ScrapeStatusTracker
+
+		mu sync.Mutex
+		// routes maps each address to the test server it reaches, if it's reachable
+		routes map[string]string
+		dialed map[string]int
+	)
+
+	// twoNICNode returns a ready node with the given internal IPs, in order.
+	twoNICNode := func(addrs ...string) *corev1.Node {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			},
+		}
+		for _, addr := range addrs {
+			node.Status.Addresses = append(node.Status.Addresses, corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: addr})
+		}
+		return node
+	}
+
+	timesDialed := func(host string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return dialed[host]
+	}
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: summaryBody(&stats.Summary{
+			Node: stats.NodeStats{NodeName: "node1", CPU: cpuStats(100, time.Now()), Memory: memStats(200, time.Now())},
+		})}
+		server = httptest.NewServer(kubelet)
+		routes = map[string]string{"10.0.0.3": server.Listener.Addr().String()}
+		dialed = make(map[string]int)
+
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port:                         10250,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+			DeprecatedCompletelyInsecure: true,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				mu.Lock()
+				dialed[host]++
+				target, ok := routes[host]
+				mu.Unlock()
+				if !ok {
+					return nil, errors.New("connect: no route to host")
+				}
+				if target == blackhole {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, target)
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		lister = &fakeNodeLister{nodes: []*corev1.Node{twoNICNode("10.0.0.2", "10.0.0.3")}}
+		statuses = NewScrapeStatusTracker()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// scrapeWith collects from the single node with a provider using the given fallback TTL.
+	scrapeWith := func(provider sources.MetricSourceProvider) error {
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs).To(HaveLen(1))
+		_, err = srcs[0].Collect(context.Background())
+		return err
+	}
+
+	newProvider := func(ttl time.Duration) sources.MetricSourceProvider {
+		return NewSummaryProvider(lister, client, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{
+			Statuses:           statuses,
+			AddressFallbackTTL: ttl,
+		})
+	}
+
+	It("should fall back to the next candidate when the first address is unreachable, remembering it", func() {
+		provider := newProvider(time.Hour)
+		Expect(scrapeWith(provider)).To(Succeed())
+		Expect(timesDialed("10.0.0.2")).To(Equal(1))
+
+		By("showing the candidate in use in the scrape status")
+		status, ok := statuses.Get("node1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeTrue())
+		Expect(status.Source.Host).To(Equal("10.0.0.3"))
+		Expect(status.Source.Candidates).To(Equal([]string{"10.0.0.2", "10.0.0.3"}))
+
+		By("connecting straight to the remembered candidate next time")
+		Expect(scrapeWith(provider)).To(Succeed())
+		Expect(timesDialed("10.0.0.2")).To(Equal(1))
+	})
+
+	It("should leave the next candidates time to connect when the first address never answers", func() {
+		routes["10.0.0.2"] = blackhole
+		srcs, err := newProvider(time.Hour).GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err = srcs[0].Collect(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(timesDialed("10.0.0.2")).To(Equal(1))
+		Expect(timesDialed("10.0.0.3")).To(Equal(1))
+	})
+
+	It("should retry the preferred address once the node's addresses change, or the memo expires", func() {
+		provider := newProvider(time.Hour)
+		Expect(scrapeWith(provider)).To(Succeed())
+
+		By("adding another address to the node")
+		lister.nodes = []*corev1.Node{twoNICNode("10.0.0.2", "10.0.0.3", "10.0.0.4")}
+		Expect(scrapeWith(provider)).To(Succeed())
+		Expect(timesDialed("10.0.0.2")).To(Equal(2))
+
+		By("remembering candidates only briefly")
+		provider = newProvider(time.Nanosecond)
+		Expect(scrapeWith(provider)).To(Succeed())
+		Expect(scrapeWith(provider)).To(Succeed())
+		Expect(timesDialed("10.0.0.2")).To(Equal(4))
+	})
+
+	It("should only fall back on connection errors", func() {
+		routes["10.0.0.2"] = server.Listener.Addr().String()
+		kubelet.status = http.StatusInternalServerError
+		Expect(scrapeWith(newProvider(time.Hour))).NotTo(Succeed())
+		Expect(timesDialed("10.0.0.3")).To(BeZero())
+	})
+
+	It("should only try the preferred address when falling back is disabled", func() {
+		err := scrapeWith(newProvider(0))
+		Expect(IsDialError(err)).To(BeTrue(), "expected a dial error, got %v", err)
+		Expect(timesDialed("10.0.0.3")).To(BeZero())
+	})
+})
@@ -0,0 +1,155 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// DefaultCaptureMaxBytes is the default maximum number of bytes saved per captured response.
+const DefaultCaptureMaxBytes = 10 * 1024 * 1024
+
+type nodeNameKey struct{}
+
+// WithNodeName records the name of the node being scraped in the context,
+// since the Kubelet client is only passed the address to connect to.
+func WithNodeName(ctx context.Context, nodeName string) context.Context {
+	return context.WithValue(ctx, nodeNameKey{}, nodeName)
+}
+
+// nodeNameFrom fetches the name of the node being scraped from the context, if present.
+func nodeNameFrom(ctx context.Context) string {
+	name, _ := ctx.Value(nodeNameKey{}).(string)
+	return name
+}
+
+// BodyCapture saves the raw summary responses for a single node to files,
+// so that decoding issues can be reproduced.  It disarms itself after a set
+// number of captures.  It also serves as an http.Handler for arming it at
+// runtime (POST with `node` and `count` query parameters) and viewing its state (GET).
+type BodyCapture struct {
+	dir      string
+	maxBytes int
+
+	mu        sync.Mutex
+	node      string
+	remaining int
+}
+
+// NewBodyCapture constructs a new, disarmed, BodyCapture that writes into the given
+// directory, truncating each response to at most maxBytes.
+func NewBodyCapture(dir string, maxBytes int) *BodyCapture {
+	if maxBytes <= 0 {
+		maxBytes = DefaultCaptureMaxBytes
+	}
+	return &BodyCapture{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+}
+
+// Arm enables capturing the next count responses from the given node.
+func (c *BodyCapture) Arm(node string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.node = node
+	c.remaining = count
+	glog.Infof("capturing the next %d raw summary responses from node %q to %s", count, node, c.dir)
+}
+
+// Active checks if captures are still pending for the given node.
+func (c *BodyCapture) Active(node string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remaining > 0 && c.node == node
+}
+
+// Capture saves the given response body if captures are pending for the given node.
+func (c *BodyCapture) Capture(node string, body []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.remaining <= 0 || c.node != node {
+		c.mu.Unlock()
+		return
+	}
+	c.remaining--
+	remaining := c.remaining
+	c.mu.Unlock()
+
+	if len(body) > c.maxBytes {
+		body = body[:c.maxBytes]
+	}
+	fileName := filepath.Join(c.dir, fmt.Sprintf("summary-%s-%d.json", node, time.Now().UnixNano()))
+	if err := ioutil.WriteFile(fileName, body, 0600); err != nil {
+		glog.Errorf("unable to save raw summary response from node %q: %v", node, err)
+		return
+	}
+	loglevel.V(loglevel.Client, 2).Infof("saved raw summary response from node %q to %s (%d captures remaining)", node, fileName, remaining)
+}
+
+type captureState struct {
+	Node      string `json:"node,omitempty"`
+	Remaining int    `json:"remaining"`
+	Dir       string `json:"dir"`
+}
+
+func (c *BodyCapture) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		node := req.URL.Query().Get("node")
+		if node == "" {
+			http.Error(w, "the node query parameter is required", http.StatusBadRequest)
+			return
+		}
+		count := 1
+		if rawCount := req.URL.Query().Get("count"); rawCount != "" {
+			var err error
+			count, err = strconv.Atoi(rawCount)
+			if err != nil || count < 0 {
+				http.Error(w, fmt.Sprintf("invalid count %q", rawCount), http.StatusBadRequest)
+				return
+			}
+		}
+		c.Arm(node, count)
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.mu.Lock()
+	state := captureState{Node: c.node, Remaining: c.remaining, Dir: c.dir}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Raw Summary Capture", func() {
+	var (
+		server  *httptest.Server
+		dir     string
+		capture *BodyCapture
+		src     sources.MetricSource
+		body    = `{"node": {"nodeName": "node1", "cpu": {"time": "2018-01-01T00:00:00Z", "usageNanoCores": 100}, "memory": {"time": "2018-01-01T00:00:00Z", "workingSetBytes": 200}}}`
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(&fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        body,
+		})
+		host, port := serverHostPort(server)
+
+		var err error
+		dir, err = ioutil.TempDir("", "summary-capture")
+		Expect(err).NotTo(HaveOccurred())
+		capture = NewBodyCapture(dir, 64)
+
+		client, err := NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+			DeprecatedCompletelyInsecure: true,
+			Capture:                      capture,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		src = NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{})
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	captured := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("should not capture anything by default", func() {
+		_, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(captured()).To(BeEmpty())
+	})
+
+	It("should ignore nodes other than the one it was armed for", func() {
+		capture.Arm("node2", 1)
+		_, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(captured()).To(BeEmpty())
+		Expect(capture.Active("node2")).To(BeTrue())
+	})
+
+	It("should capture up to the limit, then disable itself", func() {
+		By("arming the capture for two responses")
+		capture.Arm("node1", 2)
+
+		By("scraping the node three times")
+		for i := 0; i < 3; i++ {
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that decoding was unaffected")
+			Expect(batch.Nodes).To(HaveLen(1))
+		}
+
+		By("verifying that only two responses were captured, and capture was disabled")
+		files := captured()
+		Expect(files).To(HaveLen(2))
+		Expect(capture.Active("node1")).To(BeFalse())
+
+		By("verifying that the captures were truncated to the size cap")
+		contents, err := ioutil.ReadFile(files[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(body[:64]))
+	})
+})
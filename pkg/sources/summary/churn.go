@@ -0,0 +1,132 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Each cycle scrapes the nodes as they were when the cycle started: the name, UID, address,
+// and pool of each node are captured in its NodeInfo when the sources are listed, and changes
+// to the node objects during the cycle are ignored, with two exceptions:
+//
+// - deleting a node cancels its in-flight scrape, if the deletion is reported to InFlightScrapes
+// - a node re-created (with a new UID) during the cycle keeps its results only if
+//   it's still reached at the same address, since otherwise we scraped something else
+
+// InFlightScrapes tracks the scrapes in progress, so that deleting
+// a node can cancel its scrape, rather than waiting for it to time out.
+type InFlightScrapes struct {
+	mu      sync.Mutex
+	scrapes map[string]*inFlightScrape
+}
+
+type inFlightScrape struct {
+	uid     types.UID
+	cancel  context.CancelCauseFunc
+	deleted bool
+}
+
+// NewInFlightScrapes returns a new, empty, set of in-flight scrapes.
+func NewInFlightScrapes() *InFlightScrapes {
+	return &InFlightScrapes{scrapes: make(map[string]*inFlightScrape)}
+}
+
+// start registers a scrape of the given node, returning the context to scrape it with,
+// a function that checks if the node was deleted during the scrape, and a function to
+// call once the scrape is done.  A nil set of in-flight scrapes never cancels scrapes.
+func (s *InFlightScrapes) start(ctx context.Context, node NodeInfo) (context.Context, func() bool, func()) {
+	if s == nil {
+		return ctx, func() bool { return false }, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	scrape := &inFlightScrape{uid: node.UID, cancel: cancel}
+
+	s.mu.Lock()
+	s.scrapes[node.Name] = scrape
+	s.mu.Unlock()
+
+	deleted := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return scrape.deleted
+	}
+	done := func() {
+		s.mu.Lock()
+		if s.scrapes[node.Name] == scrape {
+			delete(s.scrapes, node.Name)
+		}
+		s.mu.Unlock()
+		cancel(nil)
+	}
+	return ctx, deleted, done
+}
+
+// NodeDeleted cancels any in-flight scrape of the given node, which may be a
+// *corev1.Node or a cache.DeletedFinalStateUnknown, so that it can be used
+// directly as the DeleteFunc of a node informer's event handler.
+func (s *InFlightScrapes) NodeDeleted(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	node, ok := obj.(*corev1.Node)
+	if !ok || node == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scrape, ok := s.scrapes[node.Name]
+	// a scrape of a node re-created since the deleted one isn't affected
+	if !ok || (node.UID != "" && scrape.uid != "" && node.UID != scrape.uid) {
+		return
+	}
+	scrape.deleted = true
+	scrape.cancel(&sources.ErrCanceled{Reason: sources.CancelReasonNodeDeleted, Detail: fmt.Sprintf("node %q was deleted", node.Name)})
+}
+
+// ErrNodeReplaced indicates that the node scraped was replaced, during the cycle, by a new
+// node with the same name, but a different address, so the results can't be attributed to it.
+type ErrNodeReplaced struct {
+	Name           string
+	ScrapedUID     types.UID
+	CurrentUID     types.UID
+	ScrapedAddress string
+	CurrentAddress string
+}
+
+func (err *ErrNodeReplaced) Error() string {
+	return fmt.Sprintf("node %q was replaced during the scrape (UID %s, now %s), and is now at %q rather than %q, discarding data", err.Name, err.ScrapedUID, err.CurrentUID, err.CurrentAddress, err.ScrapedAddress)
+}
+
+func (err *ErrNodeReplaced) ErrorClass() string { return ErrorClassNodeReplaced }
+func (err *ErrNodeReplaced) Remediation() string {
+	return remediations[ErrorClassNodeReplaced]
+}
+
+// IsNodeReplacedError checks if the given error (or any error it wraps) is an ErrNodeReplaced.
+func IsNodeReplacedError(err error) bool {
+	var replacedErr *ErrNodeReplaced
+	return errors.As(err, &replacedErr)
+}
@@ -16,38 +16,114 @@ package summary
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
-	"github.com/golang/glog"
+	"k8s.io/client-go/rest"
 	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+const (
+	// ReasonHeader is the request header containing the reason for a scrape.
+	ReasonHeader = "X-Metrics-Server-Reason"
+	// CycleHeader is the request header containing the ID of the collection cycle a scrape is part of.
+	CycleHeader = "X-Metrics-Server-Cycle"
 )
 
 // KubeletInterface knows how to fetch metrics from the Kubelet
 type KubeletInterface interface {
-	// GetSummary fetches summary metrics from the given Kubelet
-	GetSummary(ctx context.Context, host string) (*stats.Summary, error)
+	// GetSummary fetches summary metrics from the given Kubelet, returning
+	// information about where the summary was fetched from alongside it.
+	// The returned Provenance is non-nil even when an error is returned,
+	// so that failures can be attributed to the endpoint that was tried.
+	GetSummary(ctx context.Context, host string) (*stats.Summary, *Provenance, error)
+}
+
+// PruningKubeletInterface is implemented by KubeletInterfaces which remember
+// something about each node, and so need to be told which nodes still exist.
+type PruningKubeletInterface interface {
+	KubeletInterface
+	// Prune forgets about any node not in the given set.
+	Prune(keep map[string]struct{})
+}
+
+// Provenance describes the endpoint used to fetch a particular summary.
+type Provenance struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	Port   string `json:"port"`
+	Path   string `json:"path"`
+	// Proxied indicates that the request was made through the API server proxy.
+	Proxied bool `json:"proxied"`
+	// Profile is the profile the Kubelet was scraped with (see KubeletProfile).
+	Profile KubeletProfile `json:"profile,omitempty"`
+	// ContentType is the content type of the response, if any was received.
+	ContentType string `json:"contentType,omitempty"`
+	// Attempts is the number of requests made to fetch the summary.
+	Attempts int `json:"attempts"`
+	// Headers contains any Warning headers, and allowlisted custom headers,
+	// found on the response (bounded in size).
+	Headers map[string][]string `json:"headers,omitempty"`
+	// Circuit is the state of the API server proxy circuit breaker when the
+	// request was made (or not made), if there is one.
+	Circuit string `json:"circuit,omitempty"`
+	// Coalesced indicates that the summary was decoded from the response to an identical
+	// request already in flight, rather than requested again.
+	Coalesced bool `json:"coalesced,omitempty"`
+	// InsecureTLS indicates that the Kubelet's serving certificate wasn't verified,
+	// since its node is one of the InsecureTLSNodes.
+	InsecureTLS bool `json:"insecureTLS,omitempty"`
+	// Candidates lists the node's candidate addresses in order of preference, when it
+	// has several to fall back through, of which Host is the one connected to.
+	Candidates []string `json:"candidates,omitempty"`
+	// UnknownFields lists the paths of the fields of the summary unknown to metrics-server,
+	// when decoding strictly (see KubeletClientConfig.StrictDecoding).
+	UnknownFields []string `json:"unknownFields,omitempty"`
 }
 
 type kubeletClient struct {
 	port            int
 	deprecatedNoTLS bool
 	useAPIProxy     bool
-	apiServerHost   string
+	apiServerHost   *apiServerHost
 	client          *http.Client
+	// insecureClient skips verifying the serving certificates of the Kubelets on insecureNodes.
+	insecureClient *http.Client
+	insecureNodes  *InsecureTLSNodes
+	// readOnlyClient presents no credentials, for the Kubelets scraped with ProfileReadOnly.
+	readOnlyClient *http.Client
+	readOnlyPort   int
+	profiles       *KubeletProfiles
+	capture        *BodyCapture
+	headers        *headerCapture
+	tlsPolicy      *tlsPolicy
+	hedge          *hedgePolicy
+	gate           *requestGate
+	breaker        *circuitBreaker
+	decoder        SummaryDecoder
+	skips          *SubtreeSkips
+	drift          *schemaDrift
+	observer       RequestObserver
 }
 
 type ErrNotFound struct {
 	endpoint string
+	trigger  scrapeTrigger
 }
 
 func (err *ErrNotFound) Error() string {
-	return fmt.Sprintf("%q not found", err.endpoint)
+	return fmt.Sprintf("%q not found (%s)", err.endpoint, err.trigger)
 }
 
 func IsNotFoundError(err error) bool {
@@ -55,85 +131,475 @@ func IsNotFoundError(err error) bool {
 	return isNotFound
 }
 
-func (kc *kubeletClient) makeRequestAndGetValue(client *http.Client, req *http.Request, value interface{}) error {
+// errUnexpectedStatus indicates that the request failed with a status not otherwise handled.
+type errUnexpectedStatus struct {
+	code    int
+	status  string
+	body    string
+	trigger scrapeTrigger
+}
+
+func (err *errUnexpectedStatus) Error() string {
+	return fmt.Sprintf("request failed (%s) - %q, response: %q", err.trigger, err.status, err.body)
+}
+
+// decodableContentTypes are the media types of the responses that can be decoded.  The
+// Kubelet can also serve protobuf, which would be listed here once it's decoded.
+var decodableContentTypes = map[string]bool{
+	"application/json": true,
+}
+
+// decodableContentType checks if a response with the given Content-Type can be decoded.
+func decodableContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && decodableContentTypes[mediaType]
+}
+
+// ErrDial indicates that a custom dialer failed to establish a connection.
+type ErrDial struct {
+	addr    string
+	err     error
+	trigger scrapeTrigger
+}
+
+func (err *ErrDial) Error() string {
+	return fmt.Sprintf("unable to dial %q using custom dialer (%s): %v", err.addr, err.trigger, err.err)
+}
+
+func (err *ErrDial) Unwrap() error {
+	return err.err
+}
+
+// IsDialError checks if the given error (or any error it wraps) is an ErrDial.
+func IsDialError(err error) bool {
+	var dialErr *ErrDial
+	return errors.As(err, &dialErr)
+}
+
+// wrapDialErrors wraps the errors returned by the given dialer in ErrDial,
+// so that they can be distinguished from other connection errors, and gives
+// up dialing at the dial deadline of the context, if it has one.
+func wrapDialErrors(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialCtx := ctx
+		if deadline, ok := dialDeadlineFrom(ctx); ok {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		conn, err := dial(dialCtx, network, addr)
+		if err != nil {
+			return nil, &ErrDial{addr: addr, err: err, trigger: scrapeTriggerFrom(ctx)}
+		}
+		return conn, nil
+	}
+}
+
+type dialDeadlineKey struct{}
+
+// withDialDeadline sets the time by which connections made for requests with the
+// context must be established, while leaving the requests themselves the rest of
+// the context's time.
+func withDialDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, dialDeadlineKey{}, deadline)
+}
+
+// dialDeadlineFrom returns the dial deadline of the context, if it has one.
+func dialDeadlineFrom(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(dialDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// scrapeTrigger identifies the operation that triggered a request, so that
+// failures can be correlated with the scrape that caused them.
+type scrapeTrigger struct {
+	reason  sources.ScrapeReason
+	cycleID string
+}
+
+func scrapeTriggerFrom(ctx context.Context) scrapeTrigger {
+	return scrapeTrigger{
+		reason:  sources.ScrapeReasonFrom(ctx),
+		cycleID: sources.CycleIDFrom(ctx),
+	}
+}
+
+func (t scrapeTrigger) String() string {
+	return fmt.Sprintf("scrape reason %q, cycle %q", t.reason, t.cycleID)
+}
+
+func (kc *kubeletClient) makeRequestAndGetValue(client *http.Client, req *http.Request, decode func(body []byte) error, prov *Provenance) (err error) {
 	// TODO(directxman12): support validating certs by hostname
-	response, err := client.Do(req)
-	if err != nil {
-		return err
+	prov.Attempts++
+	start := time.Now()
+	var statusCode int
+	var body []byte
+	defer func() { kc.observe(req, EndpointSummary, start, statusCode, int64(len(body)), err) }()
+
+	trigger := scrapeTriggerFrom(req.Context())
+	if trigger.reason != "" {
+		req.Header.Set(ReasonHeader, string(trigger.reason))
 	}
-	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	if trigger.cycleID != "" {
+		req.Header.Set(CycleHeader, trigger.cycleID)
+	}
+	node := gateKeyFor(req)
+	response, coalesced, err := kc.gate.do(req.Context(), node, req.URL.String(), func() kubeletResponse {
+		return kc.roundTrip(client, req, trigger)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to read response body - %v", err)
+		return fmt.Errorf("gave up waiting to request %q (%s): %w", req.URL.String(), trigger, err)
+	}
+	prov.Coalesced = coalesced
+	statusCode = response.statusCode
+	body = response.body
+	if response.err != nil {
+		return response.err
+	}
+	if response.scheme != "" {
+		prov.Scheme = response.scheme
 	}
-	if response.StatusCode == http.StatusNotFound {
-		return &ErrNotFound{req.URL.String()}
-	} else if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed - %q, response: %q", response.Status, string(body))
+	prov.ContentType = response.header.Get("Content-Type")
+	prov.Headers = kc.headers.extract(response.header)
+	if !coalesced {
+		kc.headers.logChanges(node, prov.Headers)
+		kc.capture.Capture(nodeNameFrom(req.Context()), body)
+	}
+	switch response.statusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return &ErrNotFound{endpoint: req.URL.String(), trigger: trigger}
+	case http.StatusUnauthorized:
+		return &ErrUnauthorized{endpoint: req.URL.String(), body: errorBodySnippet(body), trigger: trigger}
+	case http.StatusForbidden:
+		return &ErrForbidden{endpoint: req.URL.String(), body: errorBodySnippet(body), trigger: trigger}
+	default:
+		if prov.Proxied {
+			if proxyErr := proxyErrorFor(req.URL.String(), response.statusCode, body, trigger); proxyErr != nil {
+				return proxyErr
+			}
+		}
+		return &errUnexpectedStatus{code: response.statusCode, status: response.status, body: string(body), trigger: trigger}
 	}
 
 	kubeletAddr := "[unknown]"
 	if req.URL != nil {
 		kubeletAddr = req.URL.Host
 	}
-	glog.V(10).Infof("Raw response from Kubelet at %s: %s", kubeletAddr, string(body))
+	if logger := logging.FromContext(req.Context(), loglevel.Client).V(10); logger.Enabled() {
+		logger.Info(fmt.Sprintf("Raw response from Kubelet at %s: %s", kubeletAddr, string(body)), "address", kubeletAddr, "endpoint", req.URL.Path, "duration", time.Since(start), "body", string(body))
+	}
 
-	err = json.Unmarshal(body, value)
+	if !decodableContentType(prov.ContentType) {
+		return &ErrUnexpectedContentType{endpoint: req.URL.String(), contentType: prov.ContentType, body: truncatedBody(body, maxContentTypeErrorBodyBytes), trigger: trigger}
+	}
+	err = decode(body)
 	if err != nil {
-		return fmt.Errorf("failed to parse output. Response: %q. Error: %v", string(body), err)
+		return fmt.Errorf("failed to parse output (%s). Response: %q. Error: %v", trigger, string(body), err)
 	}
 	return nil
 }
 
-func (kc *kubeletClient) GetSummary(ctx context.Context, host string) (*stats.Summary, error) {
-	scheme := "https"
+// roundTrip makes the given request, reading the whole response.
+func (kc *kubeletClient) roundTrip(client *http.Client, req *http.Request, trigger scrapeTrigger) kubeletResponse {
+	acceptGzip(req)
+	response, err := client.Do(req)
+	if err != nil {
+		if policyErr := kc.tlsPolicy.explain(req.Context(), req.URL.Host, err, trigger); policyErr != err {
+			return kubeletResponse{err: policyErr}
+		}
+		return kubeletResponse{err: withCancelCause(req.Context(), fmt.Errorf("%w (%s)", err, trigger))}
+	}
+	defer response.Body.Close()
+	res := kubeletResponse{statusCode: response.StatusCode, status: response.Status, header: response.Header, scheme: req.URL.Scheme}
+	if response.Request != nil {
+		res.scheme = response.Request.URL.Scheme
+	}
+	body, err := newMeasuredBody(response)
+	defer body.record(req.Context())
+	if err == nil {
+		res.body, err = ioutil.ReadAll(body)
+	}
+	if err != nil {
+		res.err = withCancelCause(req.Context(), fmt.Errorf("failed to read response body (%s) - %w", trigger, err))
+	}
+	return res
+}
+
+// withCancelCause adds why the given context was canceled to the given error from a request
+// made with it, if it was canceled with a cause, unless the error already includes it (as
+// errors from the transport do), since otherwise the error only says that it was canceled.
+func withCancelCause(ctx context.Context, err error) error {
+	cause, ok := context.Cause(ctx).(*sources.ErrCanceled)
+	if !ok {
+		return err
+	}
+	if _, included := sources.CancelCause(err); included {
+		return err
+	}
+	return fmt.Errorf("%w: %w", err, cause)
+}
+
+// kubeletEndpoint is a Kubelet endpoint, as requested under the profile of its node.
+type kubeletEndpoint struct {
+	url         *url.URL
+	client      *http.Client
+	profile     KubeletProfile
+	insecureTLS bool
+}
+
+// profileFor returns the profile the Kubelet of the given context's node is scraped with.
+func (kc *kubeletClient) profileFor(ctx context.Context) KubeletProfile {
+	if profile, ok := kc.profiles.For(nodeNameFrom(ctx)); ok {
+		return profile
+	}
+	if kc.useAPIProxy {
+		return ProfileProxy
+	}
+	return ProfileSecure
+}
+
+// endpointFor returns the given Kubelet endpoint on the given host, as requested under the
+// profile of the given context's node: through the API server proxy, or directly on the port,
+// and with the client, of its profile.
+func (kc *kubeletClient) endpointFor(ctx context.Context, host, kubeletPath string) (*kubeletEndpoint, error) {
+	profile := kc.profileFor(ctx)
+	spec := profileSpecs[profile]
+	endpoint := &kubeletEndpoint{profile: profile, client: kc.client}
+	if endpoint.client == nil {
+		endpoint.client = http.DefaultClient
+	}
+	scheme := spec.scheme
 	if kc.deprecatedNoTLS {
 		scheme = "http"
 	}
 
 	var path string
-	if kc.useAPIProxy {
-		path = fmt.Sprintf("api/v1/nodes/%s/proxy/stats/summary/", host)
-		host = kc.apiServerHost
-	} else {
-		path = "/stats/summary/"
+	switch {
+	case spec.proxied:
+		if kc.apiServerHost == nil {
+			return nil, fmt.Errorf("the Kubelet of node %s is scraped through the API server proxy, but no API server is configured", nodeNameFrom(ctx))
+		}
+		path = fmt.Sprintf("api/v1/nodes/%s/proxy%s", host, kubeletPath)
+		host, endpoint.client = kc.apiServerHost.get()
+	case !spec.credentials:
+		path = kubeletPath
+		host = net.JoinHostPort(host, strconv.Itoa(kc.readOnlyPort))
+		if kc.readOnlyClient != nil {
+			endpoint.client = kc.readOnlyClient
+		}
+	default:
+		path = kubeletPath
 		host = net.JoinHostPort(host, strconv.Itoa(kc.port))
+		if kc.insecureClient != nil && kc.insecureNodes.Matches(nodeNameFrom(ctx)) {
+			endpoint.client = kc.insecureClient
+			endpoint.insecureTLS = true
+		}
 	}
 
-	url := &url.URL{
+	endpoint.url = &url.URL{
 		Scheme: scheme,
 		Host:   host,
 		Path:   path,
 	}
+	return endpoint, nil
+}
+
+func (kc *kubeletClient) GetSummary(ctx context.Context, host string) (*stats.Summary, *Provenance, error) {
+	summary, _, prov, err := kc.fetchSummary(ctx, host, false)
+	return summary, prov, err
+}
+
+// GetSummaryWithSwap fetches summary metrics like GetSummary, also decoding the swap usage reported in them.
+func (kc *kubeletClient) GetSummaryWithSwap(ctx context.Context, host string) (*stats.Summary, *SwapSummary, *Provenance, error) {
+	return kc.fetchSummary(ctx, host, true)
+}
+
+// fetchSummary fetches summary metrics from the given Kubelet, also decoding
+// the swap usage reported in them if asked to.
+func (kc *kubeletClient) fetchSummary(ctx context.Context, host string, withSwap bool) (*stats.Summary, *SwapSummary, *Provenance, error) {
+	endpoint, err := kc.endpointFor(ctx, host, "/stats/summary/")
+	if err != nil {
+		return nil, nil, &Provenance{Host: host, Path: "/stats/summary/", Profile: kc.profileFor(ctx)}, err
+	}
+	url := endpoint.url
+	prov := &Provenance{
+		Scheme:      url.Scheme,
+		Host:        url.Hostname(),
+		Port:        url.Port(),
+		Path:        url.Path,
+		Proxied:     profileSpecs[endpoint.profile].proxied,
+		Profile:     endpoint.profile,
+		InsecureTLS: endpoint.insecureTLS,
+	}
 
 	req, err := http.NewRequest("GET", url.String(), nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, prov, err
+	}
+	client := endpoint.client
+	if kc.hedge != nil && !prov.Proxied {
+		summary, swap, err := kc.getSummaryHedged(ctx, client, req, prov, withSwap)
+		return summary, swap, prov, err
+	}
+	if kc.breaker != nil && prov.Proxied {
+		summary, swap, prov, err := kc.getSummaryWithBreaker(client, req.WithContext(ctx), prov, withSwap)
+		kc.observeProxied(ctx, prov, err)
+		return summary, swap, prov, err
+	}
+	summary, swap, err := kc.getSummary(client, req.WithContext(ctx), prov, withSwap)
+	kc.observeProxied(ctx, prov, err)
+	return summary, swap, prov, err
+}
+
+// observeProxied counts the outcome of a request through the API server proxy, if it was
+// made through it, towards re-resolving the API server's address.
+func (kc *kubeletClient) observeProxied(ctx context.Context, prov *Provenance, err error) {
+	if prov.Proxied {
+		kc.apiServerHost.observe(ctx, err)
+	}
+}
+
+// getSummaryWithBreaker makes the given summary request, if the circuit breaker allows it.
+func (kc *kubeletClient) getSummaryWithBreaker(client *http.Client, req *http.Request, prov *Provenance, withSwap bool) (*stats.Summary, *SwapSummary, *Provenance, error) {
+	probe, state, err := kc.breaker.allow(req.URL.String(), scrapeTriggerFrom(req.Context()))
+	prov.Circuit = state
+	if err != nil {
+		return nil, nil, prov, err
+	}
+	ctx, done := kc.breaker.track(req.Context())
+	defer done()
+	req = req.WithContext(ctx)
+	summary, swap, err := kc.getSummary(client, req, prov, withSwap)
+	kc.breaker.record(probe, req, err)
+	return summary, swap, prov, err
+}
+
+// getSummary makes the given summary request, decoding the response into a pooled summary,
+// and the swap usage it reports into a new swap summary if asked to.
+func (kc *kubeletClient) getSummary(client *http.Client, req *http.Request, prov *Provenance, withSwap bool) (*stats.Summary, *SwapSummary, error) {
+	summary := getPooledSummary()
+	var swap *SwapSummary
+	if withSwap {
+		swap = &SwapSummary{}
 	}
-	summary := &stats.Summary{}
-	client := kc.client
-	if client == nil {
-		client = http.DefaultClient
+	decode := func(body []byte) error { return kc.decoder.DecodeSkippingWithSwap(body, summary, kc.skips, swap) }
+	if kc.drift != nil {
+		decode = func(body []byte) error {
+			unknown, err := kc.decoder.DecodeReportingUnknown(body, summary, kc.skips, swap)
+			if err == nil {
+				prov.UnknownFields = unknown
+				kc.drift.report(req.Context(), unknown)
+			}
+			return err
+		}
+	}
+	if err := kc.makeRequestAndGetValue(client, req, decode, prov); err != nil {
+		releaseSummary(summary)
+		return nil, nil, err
+	}
+	pruneSummary(summary)
+	return summary, swap, nil
+}
+
+// ReleaseSummary returns a summary from GetSummary to be reused by later scrapes.
+// Neither it, nor anything it contains, may be used afterwards.
+func (kc *kubeletClient) ReleaseSummary(summary *stats.Summary) {
+	releaseSummary(summary)
+}
+
+var _ PruningKubeletInterface = &kubeletClient{}
+
+// Prune forgets the headers last logged for any node not in the given set.
+func (kc *kubeletClient) Prune(keep map[string]struct{}) {
+	kc.headers.prune(keep)
+}
+
+// CycleEnded warns about the unknown fields found over the given cycle, when decoding strictly.
+func (kc *kubeletClient) CycleEnded(cycleID string) {
+	if kc.drift != nil {
+		kc.drift.cycleEnded(cycleID)
 	}
-	err = kc.makeRequestAndGetValue(client, req.WithContext(ctx), summary)
-	return summary, err
 }
 
+// NewKubeletClient constructs a new KubeletInterface using the given transport.
+// The transport is expected to already make use of any custom dialer in the
+// config (see KubeletClientFor).
+// It's used for the Kubelets of every profile, including ProfileReadOnly.
 func NewKubeletClient(transport http.RoundTripper, config *KubeletClientConfig) (KubeletInterface, error) {
+	return newKubeletClient(transport, nil, nil, config)
+}
+
+// newKubeletClient constructs a new KubeletInterface using the given transport, the given
+// insecure transport (if any) for the Kubelets on the config's InsecureTLSNodes, and the
+// given transport without credentials (if any) for the Kubelets scraped with ProfileReadOnly.
+func newKubeletClient(transport, insecureTransport, readOnlyTransport http.RoundTripper, config *KubeletClientConfig) (KubeletInterface, error) {
 	c := &http.Client{
-		Transport: transport,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+	var insecureClient *http.Client
+	if insecureTransport != nil {
+		insecureClient = &http.Client{Transport: insecureTransport, CheckRedirect: checkRedirect}
 	}
 
-	apiserverURL, err := url.Parse(config.RESTConfig.Host)
-	if err != nil {
-		return nil, err
+	var readOnlyClient *http.Client
+	if readOnlyTransport != nil {
+		readOnlyClient = &http.Client{Transport: readOnlyTransport, CheckRedirect: checkRedirect}
+	}
+	readOnlyPort := config.ReadOnlyPort
+	if readOnlyPort == 0 {
+		readOnlyPort = DefaultReadOnlyPort
+	}
+
+	var apiServer *apiServerHost
+	// any node might be selected to be scraped through the proxy
+	if config.UseAPIServerProxy || config.Profiles != nil {
+		newTransport := func(restConfig *rest.Config) (http.RoundTripper, error) {
+			return transportFor(apiServerTransportConfig(config, restConfig))
+		}
+		restConfig, apiServerClient := config.RESTConfig, c
+		if !config.UseAPIServerProxy {
+			// the Kubelets' transport (with their TLS settings) mustn't be used for the API server
+			if config.APIServerRESTConfig != nil {
+				restConfig = config.APIServerRESTConfig
+			}
+			apiServerTransport, err := newTransport(restConfig)
+			if err != nil {
+				return nil, fmt.Errorf("unable to construct transport for the API server proxy: %v", err)
+			}
+			apiServerClient = &http.Client{Transport: apiServerTransport, CheckRedirect: checkRedirect}
+		}
+		var err error
+		if apiServer, err = newAPIServerHost(restConfig, apiServerClient, config.APIServerHost, newTransport); err != nil {
+			return nil, err
+		}
+	}
+	skips := config.SkippedSubtrees
+	if skips == nil {
+		skips = defaultSubtreeSkips
 	}
 
 	return &kubeletClient{
 		port:            config.Port,
 		client:          c,
+		insecureClient:  insecureClient,
+		insecureNodes:   config.InsecureTLSNodes,
+		readOnlyClient:  readOnlyClient,
+		readOnlyPort:    readOnlyPort,
+		profiles:        config.Profiles,
 		deprecatedNoTLS: config.DeprecatedCompletelyInsecure,
 		useAPIProxy:     config.UseAPIServerProxy,
-		apiServerHost:   net.JoinHostPort(apiserverURL.Hostname(), apiserverURL.Port()),
+		apiServerHost:   apiServer,
+		capture:         config.Capture,
+		headers:         newHeaderCapture(config.CaptureHeaders),
+		tlsPolicy:       newTLSPolicy(config),
+		hedge:           newHedgePolicy(config),
+		gate:            newRequestGate(config),
+		breaker:         newCircuitBreaker(config),
+		decoder:         config.SummaryDecoder,
+		skips:           skips,
+		drift:           newSchemaDrift(config),
+		observer:        config.RequestObserver,
 	}, nil
 }
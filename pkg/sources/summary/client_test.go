@@ -0,0 +1,1492 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// fakeKubelet serves a minimal summary on the given path, recording the paths requested.
+type fakeKubelet struct {
+	summaryPath string
+	status      int
+	body        string
+	headers     http.Header
+
+	requestedPaths   []string
+	requestedHeaders []http.Header
+}
+
+func (k *fakeKubelet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	k.requestedPaths = append(k.requestedPaths, req.URL.Path)
+	k.requestedHeaders = append(k.requestedHeaders, req.Header)
+	if req.URL.Path != k.summaryPath {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for name, vals := range k.headers {
+		w.Header()[name] = vals
+	}
+	w.WriteHeader(k.status)
+	w.Write([]byte(k.body))
+}
+
+// serverHostPort splits the host and port out of a test server's URL.
+func serverHostPort(server *httptest.Server) (string, int) {
+	serverURL, err := url.Parse(server.URL)
+	Expect(err).NotTo(HaveOccurred())
+	host, portStr, err := net.SplitHostPort(serverURL.Host)
+	Expect(err).NotTo(HaveOccurred())
+	port, err := strconv.Atoi(portStr)
+	Expect(err).NotTo(HaveOccurred())
+	return host, port
+}
+
+var _ = Describe("Kubelet Client", func() {
+	var (
+		kubelet *fakeKubelet
+		server  *httptest.Server
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        `{"node": {"nodeName": "node1"}}`,
+			headers:     http.Header{},
+		}
+		server = httptest.NewServer(kubelet)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("when connecting directly to the kubelet", func() {
+		var (
+			client KubeletInterface
+			host   string
+			port   int
+		)
+
+		BeforeEach(func() {
+			host, port = serverHostPort(server)
+			var err error
+			client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+				Port:                         port,
+				RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+				DeprecatedCompletelyInsecure: true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should report the direct endpoint used as the provenance", func() {
+			By("fetching the summary")
+			summary, prov, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.Node.NodeName).To(Equal("node1"))
+
+			By("verifying the provenance")
+			Expect(prov).To(Equal(&Provenance{
+				Scheme:      "http",
+				Host:        host,
+				Port:        strconv.Itoa(port),
+				Path:        "/stats/summary/",
+				Proxied:     false,
+				Profile:     ProfileSecure,
+				ContentType: "application/json",
+				Attempts:    1,
+			}))
+		})
+
+		It("should report the provenance even when the request fails", func() {
+			By("making the kubelet return an error")
+			kubelet.status = http.StatusInternalServerError
+
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), host)
+			Expect(err).To(HaveOccurred())
+
+			By("verifying the provenance points at the endpoint tried")
+			Expect(prov).NotTo(BeNil())
+			Expect(prov.Host).To(Equal(host))
+			Expect(prov.Port).To(Equal(strconv.Itoa(port)))
+			Expect(prov.Attempts).To(Equal(1))
+		})
+
+		It("should return a typed error with the response body and a remediation when unauthorized", func() {
+			By("making the kubelet return unauthorized")
+			kubelet.status = http.StatusUnauthorized
+			kubelet.body = "Unauthorized"
+
+			By("fetching the summary")
+			_, _, err := client.GetSummary(context.Background(), host)
+
+			By("verifying the error")
+			Expect(IsUnauthorizedError(err)).To(BeTrue())
+			Expect(IsForbiddenError(err)).To(BeFalse())
+			Expect(err.Error()).To(ContainSubstring("Unauthorized"))
+			Expect(ErrorClass(fmt.Errorf("wrapped: %w", err))).To(Equal(ErrorClassUnauthorized))
+			classified, ok := err.(sources.ClassifiedError)
+			Expect(ok).To(BeTrue())
+			Expect(classified.Remediation()).To(ContainSubstring("authentication-token-webhook"))
+		})
+
+		It("should return a typed error with a truncated response body and a remediation when forbidden", func() {
+			By("making the kubelet return forbidden, with a long body")
+			kubelet.status = http.StatusForbidden
+			kubelet.body = "Forbidden (user=system:serviceaccount:kube-system:metrics-server, verb=get, resource=nodes, subresource=stats)" + strings.Repeat("x", 1024)
+
+			By("fetching the summary")
+			_, _, err := client.GetSummary(context.Background(), host)
+
+			By("verifying the error")
+			Expect(IsForbiddenError(err)).To(BeTrue())
+			Expect(IsUnauthorizedError(err)).To(BeFalse())
+			Expect(err.Error()).To(ContainSubstring("subresource=stats"))
+			Expect(len(err.Error())).To(BeNumerically("<", 512))
+			Expect(ErrorClass(err)).To(Equal(ErrorClassForbidden))
+			classified, ok := err.(sources.ClassifiedError)
+			Expect(ok).To(BeTrue())
+			Expect(classified.Remediation()).To(ContainSubstring("system:kubelet-api-admin"))
+		})
+
+		It("should return a typed error with a truncated response body when served something other than JSON", func() {
+			By("making something in front of the kubelet serve an HTML error page")
+			kubelet.headers = http.Header{"Content-Type": {"text/html; charset=utf-8"}}
+			kubelet.body = "<html><head><title>502 Bad Gateway</title></head><body>" + strings.Repeat("<p>nginx</p>", 100) + "</body></html>"
+
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), host)
+
+			By("verifying the error")
+			Expect(IsUnexpectedContentTypeError(err)).To(BeTrue())
+			Expect(ErrorClass(fmt.Errorf("wrapped: %w", err))).To(Equal(ErrorClassContentType))
+			Expect(err.Error()).To(ContainSubstring(`unexpected content type "text/html; charset=utf-8"`))
+			Expect(err.Error()).To(ContainSubstring("502 Bad Gateway"))
+			Expect(err.Error()).NotTo(ContainSubstring("</html>"))
+			Expect(err.Error()).NotTo(ContainSubstring("failed to parse output"))
+			Expect(prov.ContentType).To(Equal("text/html; charset=utf-8"))
+			classified, ok := err.(sources.ClassifiedError)
+			Expect(ok).To(BeTrue())
+			Expect(classified.Remediation()).To(ContainSubstring("load balancer"))
+		})
+
+		It("should return a typed error for empty responses without a content type", func() {
+			kubelet.headers = http.Header{"Content-Type": {""}}
+			kubelet.body = ""
+
+			_, _, err := client.GetSummary(context.Background(), host)
+			Expect(IsUnexpectedContentTypeError(err)).To(BeTrue())
+			Expect(err.(*ErrUnexpectedContentType).ContentType()).To(BeEmpty())
+			Expect(ErrorClass(err)).To(Equal(ErrorClassContentType))
+		})
+
+		It("should accept JSON with parameters, but still fail to decode empty JSON responses", func() {
+			kubelet.headers = http.Header{"Content-Type": {"Application/JSON; charset=utf-8"}}
+			summary, _, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.Node.NodeName).To(Equal("node1"))
+
+			kubelet.body = ""
+			_, _, err = client.GetSummary(context.Background(), host)
+			Expect(err).To(HaveOccurred())
+			Expect(IsUnexpectedContentTypeError(err)).To(BeFalse())
+			Expect(err.Error()).To(ContainSubstring("failed to parse output"))
+		})
+
+		It("should never blame the API server proxy when connecting directly", func() {
+			kubelet.status = http.StatusServiceUnavailable
+			kubelet.body = `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"error trying to reach service: dial tcp 10.0.1.17:10250: connect: connection refused","code":503}`
+
+			_, _, err := client.GetSummary(context.Background(), host)
+			Expect(err).To(HaveOccurred())
+			Expect(IsProxyError(err)).To(BeFalse())
+		})
+
+		for _, reason := range []sources.ScrapeReason{sources.ScrapeReasonCycle, sources.ScrapeReasonDebug} {
+			reason := reason
+			It(fmt.Sprintf("should send the scrape reason and cycle ID as headers for %q scrapes", reason), func() {
+				By("fetching the summary with a context carrying the reason and cycle ID")
+				ctx := sources.WithCycleID(sources.WithScrapeReason(context.Background(), reason), "cycle-1")
+				_, _, err := client.GetSummary(ctx, host)
+				Expect(err).NotTo(HaveOccurred())
+
+				By("verifying that the kubelet received the headers")
+				Expect(kubelet.requestedHeaders).To(HaveLen(1))
+				Expect(kubelet.requestedHeaders[0].Get(ReasonHeader)).To(Equal(string(reason)))
+				Expect(kubelet.requestedHeaders[0].Get(CycleHeader)).To(Equal("cycle-1"))
+			})
+		}
+
+		It("should include the scrape reason and cycle ID in errors", func() {
+			By("making the kubelet return not found")
+			kubelet.summaryPath = "/other/"
+
+			By("fetching the summary")
+			ctx := sources.WithCycleID(sources.WithScrapeReason(context.Background(), sources.ScrapeReasonCycle), "cycle-2")
+			_, _, err := client.GetSummary(ctx, host)
+			Expect(err).To(HaveOccurred())
+			Expect(IsNotFoundError(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(`scrape reason "cycle", cycle "cycle-2"`))
+		})
+
+		It("should not record any headers when none of interest are present", func() {
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(prov.Headers).To(BeNil())
+		})
+
+		It("should record Warning headers and allowlisted custom headers", func() {
+			By("constructing a client that captures a custom header")
+			var err error
+			client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+				Port:                         port,
+				RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+				DeprecatedCompletelyInsecure: true,
+				CaptureHeaders:               []string{"x-stats-degraded"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("making the kubelet return warning and custom headers")
+			kubelet.headers = http.Header{
+				"Warning":          {`199 kubelet "cadvisor is restarting"`, `299 - "stats may be stale"`},
+				"X-Stats-Degraded": {"cadvisor"},
+				"X-Other":          {"ignored"},
+			}
+
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that only the headers of interest were recorded")
+			Expect(prov.Headers).To(Equal(map[string][]string{
+				"Warning":          {`199 kubelet "cadvisor is restarting"`, `299 - "stats may be stale"`},
+				"X-Stats-Degraded": {"cadvisor"},
+			}))
+		})
+
+		It("should bound the size of the recorded headers", func() {
+			By("making the kubelet return many long warning headers")
+			longVal := strings.Repeat("a", 1000)
+			for i := 0; i < 100; i++ {
+				kubelet.headers.Add("Warning", longVal)
+			}
+
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that values were truncated and the total size was limited")
+			Expect(prov.Headers["Warning"]).NotTo(BeEmpty())
+			total := 0
+			for _, val := range prov.Headers["Warning"] {
+				Expect(len(val)).To(BeNumerically("<=", 256))
+				total += len(val)
+			}
+			Expect(total).To(BeNumerically("<=", 2048))
+		})
+	})
+
+	Context("when connecting through the API server proxy", func() {
+		var client KubeletInterface
+
+		BeforeEach(func() {
+			kubelet.summaryPath = "/api/v1/nodes/node1/proxy/stats/summary/"
+			var err error
+			client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+				Port:                         10250,
+				RESTConfig:                   &rest.Config{Host: server.URL},
+				DeprecatedCompletelyInsecure: true,
+				UseAPIServerProxy:            true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should report the proxy endpoint used as the provenance", func() {
+			By("fetching the summary")
+			_, prov, err := client.GetSummary(context.Background(), "node1")
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying the provenance")
+			host, port := serverHostPort(server)
+			Expect(prov).To(Equal(&Provenance{
+				Scheme:      "http",
+				Host:        host,
+				Port:        strconv.Itoa(port),
+				Path:        "api/v1/nodes/node1/proxy/stats/summary/",
+				Proxied:     true,
+				Profile:     ProfileProxy,
+				ContentType: "application/json",
+				Attempts:    1,
+			}))
+		})
+
+		// responses captured from API server proxy failures, alongside Kubelet failures that look similar
+		proxyResponses := []struct {
+			desc   string
+			status int
+			body   string
+			// reason is the expected proxy error reason, or empty if the Kubelet sent the response
+			reason string
+		}{
+			{
+				desc:   "a Status for a refused connection",
+				status: http.StatusServiceUnavailable,
+				body:   `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"error trying to reach service: dial tcp 10.0.1.17:10250: connect: connection refused","reason":"ServiceUnavailable","code":503}`,
+				reason: ProxyReasonConnectionRefused,
+			},
+			{
+				desc:   "a Status for an unreachable host",
+				status: http.StatusServiceUnavailable,
+				body:   `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"error trying to reach service: dial tcp 10.0.1.17:10250: connect: no route to host","reason":"ServiceUnavailable","code":503}`,
+				reason: ProxyReasonNoRouteToHost,
+			},
+			{
+				desc:   "a Status for a TLS failure at the Kubelet",
+				status: http.StatusServiceUnavailable,
+				body:   `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"error trying to reach service: x509: certificate signed by unknown authority","reason":"ServiceUnavailable","code":503}`,
+				reason: ProxyReasonBackendTLS,
+			},
+			{
+				desc:   "a Status for a timed out connection while dialing the backend",
+				status: http.StatusInternalServerError,
+				body:   `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"error dialing backend: dial tcp 10.0.1.17:10250: i/o timeout","code":500}`,
+				reason: ProxyReasonTimeout,
+			},
+			{
+				desc:   "legacy plain text for a refused connection",
+				status: http.StatusServiceUnavailable,
+				body:   "Error: 'dial tcp 10.0.1.17:10250: getsockopt: connection refused'\nTrying to reach: 'https://10.0.1.17:10250/stats/summary/'",
+				reason: ProxyReasonConnectionRefused,
+			},
+			{
+				desc:   "legacy plain text for a TLS failure at the Kubelet",
+				status: http.StatusServiceUnavailable,
+				body:   "Error: 'remote error: tls: bad certificate'\nTrying to reach: 'https://10.0.1.17:10250/stats/summary/'",
+				reason: ProxyReasonBackendTLS,
+			},
+			{
+				desc:   "an empty response from the reverse proxy",
+				status: http.StatusBadGateway,
+				body:   "",
+				reason: ProxyReasonUnknown,
+			},
+			{
+				desc:   "a Kubelet failure passed through the proxy",
+				status: http.StatusServiceUnavailable,
+				body:   "Internal Error: failed to get node info: node \"node1\" not found",
+			},
+			{
+				desc:   "an unrelated API server Status",
+				status: http.StatusServiceUnavailable,
+				body:   `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"the server is currently unable to handle the request","reason":"ServiceUnavailable","code":503}`,
+			},
+		}
+		for _, resp := range proxyResponses {
+			resp := resp
+			It(fmt.Sprintf("should classify %s", resp.desc), func() {
+				kubelet.status = resp.status
+				kubelet.body = resp.body
+
+				_, _, err := client.GetSummary(context.Background(), "node1")
+				Expect(err).To(HaveOccurred())
+				if resp.reason == "" {
+					Expect(IsProxyError(err)).To(BeFalse(), "expected a Kubelet error, got %v", err)
+					return
+				}
+				Expect(IsProxyError(err)).To(BeTrue(), "expected a proxy error, got %v", err)
+				Expect(err.(*ErrProxy).Reason).To(Equal(resp.reason))
+				Expect(ErrorClass(err)).To(Equal(ErrorClassProxy))
+			})
+		}
+	})
+})
+
+// pipeListener is a net.Listener that accepts connections handed to it by pipeDialer.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10250}
+}
+
+// dial hands one end of an in-memory pipe to the listener, recording the address dialed.
+func (l *pipeListener) dial(dialed *[]string) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		*dialed = append(*dialed, addr)
+		client, server := net.Pipe()
+		select {
+		case l.conns <- server:
+			return client, nil
+		case <-l.closed:
+			return nil, fmt.Errorf("listener closed")
+		}
+	}
+}
+
+var _ = Describe("Kubelet Client with a custom dialer", func() {
+	var (
+		server   *httptest.Server
+		listener *pipeListener
+		dialed   []string
+		caData   []byte
+	)
+
+	BeforeEach(func() {
+		dialed = nil
+		listener = newPipeListener()
+		server = httptest.NewUnstartedServer(&fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        `{"node": {"nodeName": "node1"}}`,
+		})
+		server.Listener = listener
+		server.StartTLS()
+		caData = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should connect using the custom dialer, verifying TLS over the dialed connection", func() {
+		By("constructing a client that trusts the test server's CA")
+		client, err := KubeletClientFor(&KubeletClientConfig{
+			Port: 10250,
+			RESTConfig: &rest.Config{
+				Host:            "https://apiserver.invalid:6443",
+				TLSClientConfig: rest.TLSClientConfig{CAData: caData},
+			},
+			Dial: listener.dial(&dialed),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("fetching the summary")
+		summary, _, err := client.GetSummary(context.Background(), "127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Node.NodeName).To(Equal("node1"))
+
+		By("verifying that the custom dialer was used")
+		Expect(dialed).To(ConsistOf("127.0.0.1:10250"))
+	})
+
+	It("should still reject kubelets whose certificates can't be verified", func() {
+		By("constructing a client that doesn't trust the test server's CA")
+		client, err := KubeletClientFor(&KubeletClientConfig{
+			Port:       10250,
+			RESTConfig: &rest.Config{Host: "https://apiserver.invalid:6443"},
+			Dial:       listener.dial(&dialed),
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("fetching the summary")
+		_, _, err = client.GetSummary(context.Background(), "127.0.0.1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+		Expect(IsDialError(err)).To(BeFalse())
+	})
+
+	It("should wrap errors from the custom dialer in a distinct error type", func() {
+		By("constructing a client with a failing dialer")
+		client, err := KubeletClientFor(&KubeletClientConfig{
+			Port:       10250,
+			RESTConfig: &rest.Config{Host: "https://apiserver.invalid:6443"},
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return nil, fmt.Errorf("tunnel is down")
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("fetching the summary")
+		_, _, err = client.GetSummary(context.Background(), "127.0.0.1")
+		Expect(err).To(HaveOccurred())
+		Expect(IsDialError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("tunnel is down"))
+	})
+})
+
+var _ = Describe("Kubelet Client with a TLS policy", func() {
+	var (
+		server    *httptest.Server
+		serverTLS *tls.Config
+	)
+
+	BeforeEach(func() {
+		serverTLS = &tls.Config{}
+	})
+
+	JustBeforeEach(func() {
+		server = httptest.NewUnstartedServer(&fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        `{"node": {"nodeName": "node1"}}`,
+		})
+		server.TLS = serverTLS
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	getSummary := func(minVersion string, cipherSuites ...string) error {
+		serverURL, err := url.Parse(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		port, err := strconv.Atoi(serverURL.Port())
+		Expect(err).NotTo(HaveOccurred())
+
+		config := &KubeletClientConfig{
+			Port: port,
+			RESTConfig: &rest.Config{
+				Host:            "https://apiserver.invalid:6443",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			},
+		}
+		config.TLSMinVersion, err = ParseTLSMinVersion(minVersion)
+		Expect(err).NotTo(HaveOccurred())
+		config.TLSCipherSuites, err = ParseTLSCipherSuites(cipherSuites)
+		Expect(err).NotTo(HaveOccurred())
+		client, err := KubeletClientFor(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = client.GetSummary(context.Background(), serverURL.Hostname())
+		return err
+	}
+
+	Context("when the Kubelet only supports old TLS versions", func() {
+		BeforeEach(func() {
+			serverTLS.MinVersion = tls.VersionTLS10
+			serverTLS.MaxVersion = tls.VersionTLS11
+		})
+
+		It("should refuse to connect, naming the negotiated and required versions", func() {
+			err := getSummary("VersionTLS12")
+			Expect(err).To(HaveOccurred())
+			Expect(IsTLSPolicyError(err)).To(BeTrue(), "expected a TLS policy error, got %v", err)
+			Expect(err.Error()).To(ContainSubstring("negotiated TLS 1.1"))
+			Expect(err.Error()).To(ContainSubstring("requires TLS 1.2 or later"))
+			Expect(ErrorClass(err)).To(Equal(ErrorClassTLSPolicy))
+		})
+
+		It("should connect if the policy allows the old version", func() {
+			Expect(getSummary("VersionTLS11")).To(Succeed())
+		})
+	})
+
+	Context("when the Kubelet only supports weak cipher suites", func() {
+		BeforeEach(func() {
+			serverTLS.MaxVersion = tls.VersionTLS12
+			serverTLS.CipherSuites = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}
+		})
+
+		It("should refuse to connect, naming the negotiated and allowed cipher suites", func() {
+			err := getSummary("", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+			Expect(err).To(HaveOccurred())
+			Expect(IsTLSPolicyError(err)).To(BeTrue(), "expected a TLS policy error, got %v", err)
+			Expect(err.Error()).To(ContainSubstring("negotiated TLS 1.2 with TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"))
+			Expect(err.Error()).To(ContainSubstring("one of the cipher suites TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"))
+		})
+	})
+
+	It("should connect to Kubelets meeting the policy", func() {
+		Expect(getSummary("VersionTLS12", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")).To(Succeed())
+	})
+
+	It("should not report other connection failures as TLS policy errors", func() {
+		err := getSummary("VersionTLS12")
+		Expect(err).NotTo(HaveOccurred())
+		server.Close()
+		err = getSummary("VersionTLS12")
+		Expect(err).To(HaveOccurred())
+		Expect(IsTLSPolicyError(err)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Kubelet TLS policy parsing", func() {
+	It("should accept the Kubernetes TLS version names, including TLS 1.3", func() {
+		Expect(ParseTLSMinVersion("VersionTLS11")).To(Equal(uint16(tls.VersionTLS11)))
+		Expect(ParseTLSMinVersion("VersionTLS13")).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(ParseTLSMinVersion("")).To(BeZero())
+	})
+
+	It("should reject unknown TLS versions, listing the known ones", func() {
+		_, err := ParseTLSMinVersion("TLS1.2")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`"TLS1.2"`))
+		Expect(err.Error()).To(ContainSubstring("VersionTLS12"))
+	})
+
+	It("should reject unknown cipher suites, naming them", func() {
+		_, err := ParseTLSCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_MADE_UP"})
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("TLS_MADE_UP"))
+	})
+})
+
+// stallingKubelet stalls the first summary request made in each cycle
+// until it's canceled, answering every other request immediately.
+type stallingKubelet struct {
+	mu       sync.Mutex
+	requests map[string]int
+	stallFor time.Duration
+	canceled chan struct{}
+}
+
+func (k *stallingKubelet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	k.mu.Lock()
+	cycle := req.Header.Get(CycleHeader)
+	k.requests[cycle]++
+	first := k.requests[cycle] == 1
+	k.mu.Unlock()
+
+	if first {
+		select {
+		case <-req.Context().Done():
+			k.canceled <- struct{}{}
+			return
+		case <-time.After(k.stallFor):
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"node": {"nodeName": "node1"}}`))
+}
+
+func (k *stallingKubelet) requestsIn(cycle string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.requests[cycle]
+}
+
+// counterValue fetches the value of the given unlabelled counter from the default registry.
+func counterValue(name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Kubelet Client canceled mid-request", func() {
+	var (
+		server *httptest.Server
+		client KubeletInterface
+		host   string
+	)
+
+	BeforeEach(func() {
+		server = httptest.NewServer(&stallingKubelet{requests: make(map[string]int), stallFor: 5 * time.Second, canceled: make(chan struct{}, 10)})
+		var port int
+		host, port = serverHostPort(server)
+		var err error
+		client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: server.URL},
+			DeprecatedCompletelyInsecure: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should preserve the cause of the cancellation in the error, classifying it by the cause", func() {
+		ctx, cancel := context.WithTimeoutCause(context.Background(), 50*time.Millisecond, &sources.ErrCanceled{Reason: sources.CancelReasonTimeout, Detail: "the scrape timeout of 50ms was reached"})
+		defer cancel()
+		_, _, err := client.GetSummary(ctx, host)
+		canceled, ok := sources.CancelCause(err)
+		Expect(ok).To(BeTrue(), "expected a cancellation cause in %v", err)
+		Expect(canceled.Reason).To(Equal(sources.CancelReasonTimeout))
+		Expect(strings.Count(err.Error(), "the scrape timeout of 50ms was reached")).To(Equal(1), "expected the cause once in %v", err)
+		Expect(ErrorClass(err)).To(Equal("timeout"))
+	})
+
+	It("should leave errors from contexts canceled without a cause alone", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, _, err := client.GetSummary(ctx, host)
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		_, ok := sources.CancelCause(err)
+		Expect(ok).To(BeFalse())
+		Expect(ErrorClass(err)).To(Equal(ErrorClassOther))
+	})
+})
+
+// unknownZoneBytes fetches the number of bytes read from nodes with no known zone, at the
+// given stage, from the default registry.
+func unknownZoneBytes(stage string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_response_bytes_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			values := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				values[label.GetName()] = label.GetValue()
+			}
+			if values["zone"] == "unknown" && values["stage"] == stage {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Kubelet Client counting bytes transferred", func() {
+	const body = `{"node": {"nodeName": "node1"}, "pods": []}`
+	var (
+		handler http.HandlerFunc
+		server  *httptest.Server
+		client  KubeletInterface
+		host    string
+	)
+
+	JustBeforeEach(func() {
+		server = httptest.NewServer(handler)
+		var port int
+		host, port = serverHostPort(server)
+		var err error
+		client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: server.URL},
+			DeprecatedCompletelyInsecure: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("with a compressed response", func() {
+		var compressed []byte
+
+		BeforeEach(func() {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			_, err := gz.Write([]byte(strings.Repeat(" ", 1000) + body))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(gz.Close()).To(Succeed())
+			compressed = buf.Bytes()
+			handler = func(w http.ResponseWriter, req *http.Request) {
+				defer GinkgoRecover()
+				Expect(req.Header.Get("Accept-Encoding")).To(Equal("gzip"))
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(compressed)
+			}
+		})
+
+		It("should count the bytes both as transferred and decompressed", func() {
+			wire, decompressed := unknownZoneBytes(TransferStageWire), unknownZoneBytes(TransferStageDecompressed)
+			summary, _, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summary.Node.NodeName).To(Equal("node1"))
+			Expect(unknownZoneBytes(TransferStageWire) - wire).To(BeEquivalentTo(len(compressed)))
+			Expect(unknownZoneBytes(TransferStageDecompressed) - decompressed).To(BeEquivalentTo(1000 + len(body)))
+		})
+	})
+
+	Context("with a response cut short", func() {
+		BeforeEach(func() {
+			handler = func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", "2000")
+				w.Write([]byte(body[:20]))
+				w.(http.Flusher).Flush()
+				<-req.Context().Done()
+			}
+		})
+
+		It("should count the bytes read before the request failed", func() {
+			wire := unknownZoneBytes(TransferStageWire)
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, _, err := client.GetSummary(ctx, host)
+			Expect(err).To(HaveOccurred())
+			Expect(unknownZoneBytes(TransferStageWire) - wire).To(BeEquivalentTo(20))
+		})
+	})
+})
+
+var _ = Describe("Kubelet Client with hedging", func() {
+	var (
+		kubelet *stallingKubelet
+		server  *httptest.Server
+		config  *KubeletClientConfig
+	)
+
+	BeforeEach(func() {
+		kubelet = &stallingKubelet{requests: make(map[string]int), stallFor: 5 * time.Second, canceled: make(chan struct{}, 10)}
+		server = httptest.NewServer(kubelet)
+		_, port := serverHostPort(server)
+		config = &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: server.URL},
+			DeprecatedCompletelyInsecure: true,
+			HedgeDelay:                   50 * time.Millisecond,
+			MaxHedgesPerCycle:            1,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	getSummary := func(cycle string) (*Provenance, time.Duration, error) {
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		host, _ := serverHostPort(server)
+		start := time.Now()
+		_, prov, err := client.GetSummary(sources.WithCycleID(context.Background(), cycle), host)
+		return prov, time.Since(start), err
+	}
+
+	It("should race a second request against a slow one, using the first to succeed, and canceling the other", func() {
+		issued, won := counterValue("metrics_server_kubelet_summary_hedged_requests_total"), counterValue("metrics_server_kubelet_summary_hedged_requests_won_total")
+
+		prov, took, err := getSummary("cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(took).To(BeNumerically("<", time.Second))
+		Expect(prov.Attempts).To(Equal(2))
+		Expect(kubelet.requestsIn("cycle-1")).To(Equal(2))
+		Eventually(kubelet.canceled).Should(Receive())
+
+		Expect(counterValue("metrics_server_kubelet_summary_hedged_requests_total")).To(Equal(issued + 1))
+		Expect(counterValue("metrics_server_kubelet_summary_hedged_requests_won_total")).To(Equal(won + 1))
+	})
+
+	It("should not hedge requests which complete within the hedge delay", func() {
+		kubelet.stallFor = 0
+		prov, _, err := getSummary("cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(1))
+		Expect(kubelet.requestsIn("cycle-1")).To(Equal(1))
+	})
+
+	It("should cap the number of hedged requests per cycle", func() {
+		kubelet.stallFor = 300 * time.Millisecond
+		config.MaxHedgesPerCycle = 1
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		host, _ := serverHostPort(server)
+		ctx := sources.WithCycleID(context.Background(), "cycle-1")
+
+		By("hedging the first slow request in the cycle")
+		_, prov, err := client.GetSummary(ctx, host)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(2))
+
+		By("not hedging further slow requests in the same cycle")
+		kubelet.mu.Lock()
+		kubelet.requests["cycle-1"] = 0
+		kubelet.mu.Unlock()
+		start := time.Now()
+		_, prov, err = client.GetSummary(ctx, host)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+
+		By("hedging again in the next cycle")
+		_, prov, err = client.GetSummary(sources.WithCycleID(context.Background(), "cycle-2"), host)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(2))
+	})
+
+	It("should never hedge requests through the API server proxy", func() {
+		kubelet.stallFor = 300 * time.Millisecond
+		config.UseAPIServerProxy = true
+		prov, _, err := getSummary("cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(1))
+		Expect(kubelet.requestsIn("cycle-1")).To(Equal(1))
+	})
+})
+
+// slowKubelet answers every request slowly, tracking how many are in flight at once.
+type slowKubelet struct {
+	delay time.Duration
+
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+	requests    int
+}
+
+func (k *slowKubelet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	k.mu.Lock()
+	k.inflight++
+	k.requests++
+	if k.inflight > k.maxInflight {
+		k.maxInflight = k.inflight
+	}
+	k.mu.Unlock()
+	defer func() {
+		k.mu.Lock()
+		k.inflight--
+		k.mu.Unlock()
+	}()
+
+	select {
+	case <-req.Context().Done():
+		return
+	case <-time.After(k.delay):
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"node": {"nodeName": "node1"}}`))
+}
+
+// stats returns the most requests the kubelet had in flight at once, and the number it received.
+func (k *slowKubelet) stats() (int, int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.maxInflight, k.requests
+}
+
+var _ = Describe("Kubelet Client with a per-node request gate", func() {
+	var (
+		kubelet *slowKubelet
+		server  *httptest.Server
+		config  *KubeletClientConfig
+		host    string
+	)
+
+	BeforeEach(func() {
+		kubelet = &slowKubelet{delay: 100 * time.Millisecond}
+		server = httptest.NewServer(kubelet)
+		var port int
+		host, port = serverHostPort(server)
+		config = &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: server.URL},
+			DeprecatedCompletelyInsecure: true,
+			HedgeDelay:                   20 * time.Millisecond,
+			MaxHedgesPerCycle:            10,
+			MaxConcurrentRequestsPerNode: 1,
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// scrapeAll scrapes the kubelet three times at once, as an overrunning cycle, the next one,
+	// and an on-demand scrape, returning their provenances and errors.
+	scrapeAll := func(client KubeletInterface, timeout time.Duration) ([]*Provenance, []error) {
+		reasons := []sources.ScrapeReason{sources.ScrapeReasonCycle, sources.ScrapeReasonCycle, sources.ScrapeReasonDebug}
+		provs := make([]*Provenance, len(reasons))
+		errs := make([]error, len(reasons))
+		var wg sync.WaitGroup
+		for i, reason := range reasons {
+			wg.Add(1)
+			go func(i int, reason sources.ScrapeReason) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				ctx, cancel := context.WithTimeout(sources.WithCycleID(sources.WithScrapeReason(context.Background(), reason), "cycle-1"), timeout)
+				defer cancel()
+				_, provs[i], errs[i] = client.GetSummary(ctx, host)
+			}(i, reason)
+		}
+		wg.Wait()
+		return provs, errs
+	}
+
+	It("should only let one request onto the wire at a time, queuing the rest", func() {
+		config.HedgeDelay = 0
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		_, errs := scrapeAll(client, 5*time.Second)
+		for _, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		maxInflight, requests := kubelet.stats()
+		Expect(maxInflight).To(Equal(1))
+		Expect(requests).To(BeNumerically(">=", 3))
+	})
+
+	It("should let hedges past the gate, racing the requests they hedge, even when coalescing", func() {
+		config.CoalesceRequests = true
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		ctx := sources.WithCycleID(sources.WithScrapeReason(context.Background(), sources.ScrapeReasonCycle), "cycle-1")
+		_, prov, err := client.GetSummary(ctx, host)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prov.Attempts).To(Equal(2))
+		Expect(prov.Coalesced).To(BeFalse())
+		maxInflight, requests := kubelet.stats()
+		Expect(maxInflight).To(Equal(2))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should coalesce requests over the limit onto an identical request in flight", func() {
+		config.HedgeDelay = 0
+		config.CoalesceRequests = true
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		provs, errs := scrapeAll(client, 5*time.Second)
+		coalesced := 0
+		for i, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+			if provs[i].Coalesced {
+				coalesced++
+			}
+		}
+		maxInflight, requests := kubelet.stats()
+		Expect(maxInflight).To(Equal(1))
+		Expect(coalesced).To(BeNumerically(">=", 1))
+		Expect(requests).To(BeNumerically("<", 3))
+	})
+
+	It("should give up on queued requests once their context is done", func() {
+		config.HedgeDelay = 0
+		kubelet.delay = time.Second
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		_, errs := scrapeAll(client, 300*time.Millisecond)
+		// the request in flight fails in the transport, while those queued behind it give up
+		gaveUp := 0
+		for _, err := range errs {
+			if err != nil && strings.Contains(err.Error(), "gave up waiting to request") {
+				Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+				gaveUp++
+			}
+		}
+		Expect(gaveUp).To(BeNumerically(">=", 1))
+		maxInflight, _ := kubelet.stats()
+		Expect(maxInflight).To(Equal(1))
+	})
+
+	It("should leave requests unlimited by default", func() {
+		config.MaxConcurrentRequestsPerNode = 0
+		config.HedgeDelay = 0
+		client, err := NewKubeletClient(http.DefaultTransport, config)
+		Expect(err).NotTo(HaveOccurred())
+		_, errs := scrapeAll(client, 5*time.Second)
+		for _, err := range errs {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		maxInflight, _ := kubelet.stats()
+		Expect(maxInflight).To(Equal(3))
+	})
+})
+
+var _ = Describe("Kubelet Client with insecure TLS nodes", func() {
+	var (
+		server   *httptest.Server
+		statuses *ScrapeStatusTracker
+		client   KubeletInterface
+		body     = `{"node": {"cpu": {"time": "2018-01-01T00:00:00Z", "usageNanoCores": 100}, "memory": {"time": "2018-01-01T00:00:00Z", "workingSetBytes": 200}}}`
+	)
+
+	BeforeEach(func() {
+		// the test server's certificate is signed by a CA the client doesn't trust
+		server = httptest.NewTLSServer(&fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        body,
+		})
+		_, port := serverHostPort(server)
+		statuses = NewScrapeStatusTracker()
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		Expect(indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "appliance2", Labels: map[string]string{"hardware": "appliance"}}})).To(Succeed())
+		Expect(indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})).To(Succeed())
+		insecureNodes := NewInsecureTLSNodes([]string{"appliance1"}, labels.SelectorFromSet(labels.Set{"hardware": "appliance"}), v1listers.NewNodeLister(indexer))
+		Expect(insecureNodes.List()).To(Equal([]string{"appliance1", "appliance2"}))
+
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port:             port,
+			RESTConfig:       &rest.Config{Host: "https://apiserver.invalid:6443"},
+			InsecureTLSNodes: insecureNodes,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	collect := func(node string) error {
+		src := NewSummaryMetricsSource(NodeInfo{Name: node, ConnectAddress: "127.0.0.1"}, client, SourceOptions{Statuses: statuses})
+		_, err := src.Collect(context.Background())
+		return err
+	}
+
+	It("should skip verification only for the listed and selected nodes, marking them in the scrape status", func() {
+		for _, node := range []string{"appliance1", "appliance2"} {
+			Expect(collect(node)).To(Succeed(), "node %s should be scraped without verification", node)
+			status, ok := statuses.Get(node)
+			Expect(ok).To(BeTrue())
+			Expect(status.Source.InsecureTLS).To(BeTrue())
+		}
+
+		By("still verifying every other node's certificate")
+		err := collect("node1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+		status, ok := statuses.Get("node1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Source.InsecureTLS).To(BeFalse())
+	})
+})
+
+// sniffingListener serves both plain HTTP and HTTPS on the same port, like a Kubelet part-way
+// through migrating, by peeking at the first byte of each connection for a TLS handshake.
+type sniffingListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *sniffingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	peeked := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+	if first, err := peeked.r.Peek(1); err == nil && first[0] == 0x16 {
+		return tls.Server(peeked, l.config), nil
+	}
+	return peeked, nil
+}
+
+// peekedConn reads a connection through the reader peeking at it.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// unlabelledGaugeValue fetches the value of the given unlabelled gauge from the default registry.
+func unlabelledGaugeValue(name string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Kubelet Client migrating off plain HTTP", func() {
+	var (
+		httpKubelet, httpsKubelet, bothKubelet *fakeKubelet
+		servers                                []*httptest.Server
+		addrs                                  map[string]string
+		client                                 KubeletInterface
+	)
+
+	newKubelet := func() *fakeKubelet {
+		return &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: `{"node": {"nodeName": "node1"}}`}
+	}
+
+	BeforeEach(func() {
+		httpKubelet, httpsKubelet, bothKubelet = newKubelet(), newKubelet(), newKubelet()
+		httpServer := httptest.NewServer(httpKubelet)
+		httpsServer := httptest.NewTLSServer(httpsKubelet)
+		bothServer := httptest.NewUnstartedServer(bothKubelet)
+		bothServer.Listener = &sniffingListener{Listener: bothServer.Listener, config: httpsServer.TLS.Clone()}
+		bothServer.Start()
+		servers = []*httptest.Server{httpServer, httpsServer, bothServer}
+		addrs = map[string]string{
+			"http-only":  httpServer.Listener.Addr().String(),
+			"https-only": httpsServer.Listener.Addr().String(),
+			"both":       bothServer.Listener.Addr().String(),
+		}
+
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port: 10250,
+			RESTConfig: &rest.Config{
+				Host:            "https://apiserver.invalid:6443",
+				BearerToken:     "secret",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			},
+			MigrateFromCompletelyInsecure: true,
+			// route each node to its test server, whatever port they're on
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				target, ok := addrs[host]
+				if !ok {
+					return nil, fmt.Errorf("no route to %s", host)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, target)
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	// scrape scrapes each of the given nodes in the given cycle, returning the scheme each worked over.
+	scrape := func(cycle string, nodes ...string) map[string]string {
+		schemes := make(map[string]string)
+		for _, node := range nodes {
+			_, prov, err := client.GetSummary(sources.WithCycleID(context.Background(), cycle), node)
+			Expect(err).NotTo(HaveOccurred(), "node %s", node)
+			schemes[node] = prov.Scheme
+		}
+		return schemes
+	}
+
+	It("should try HTTPS first, only falling back to plain HTTP without credentials for nodes requiring it", func() {
+		Expect(scrape("cycle-1", "http-only", "https-only", "both")).To(Equal(map[string]string{
+			"http-only":  "http",
+			"https-only": "https",
+			"both":       "https",
+		}))
+		Expect(unlabelledGaugeValue("metrics_server_kubelet_nodes_requiring_http")).To(Equal(1.0))
+
+		By("never sending credentials over plain HTTP")
+		Expect(httpKubelet.requestedHeaders).To(HaveLen(1))
+		Expect(httpKubelet.requestedHeaders[0].Get("Authorization")).To(BeEmpty())
+		Expect(httpsKubelet.requestedHeaders[0].Get("Authorization")).To(Equal("Bearer secret"))
+		Expect(bothKubelet.requestedHeaders).To(HaveLen(1))
+	})
+
+	It("should notice nodes once they're migrated", func() {
+		scrape("cycle-1", "http-only", "https-only")
+		Expect(unlabelledGaugeValue("metrics_server_kubelet_nodes_requiring_http")).To(Equal(1.0))
+
+		By("migrating the node to HTTPS")
+		addrs["http-only"] = addrs["both"]
+		Expect(scrape("cycle-2", "http-only", "https-only")).To(Equal(map[string]string{
+			"http-only":  "https",
+			"https-only": "https",
+		}))
+		Expect(unlabelledGaugeValue("metrics_server_kubelet_nodes_requiring_http")).To(Equal(0.0))
+	})
+
+	It("should not fall back to plain HTTP for failures other than TLS", func() {
+		_, _, err := client.GetSummary(context.Background(), "unrouted")
+		Expect(err).To(HaveOccurred())
+		Expect(IsDialError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("https://"))
+		Expect(err.Error()).NotTo(ContainSubstring("http://"))
+	})
+})
+
+// recordingObserver records the requests it observes.
+type recordingObserver struct {
+	mu       sync.Mutex
+	requests []RequestInfo
+}
+
+func (o *recordingObserver) ObserveRequest(info RequestInfo) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, info)
+}
+
+var _ = Describe("Kubelet Client with a request observer", func() {
+	var (
+		kubelet  *fakeKubelet
+		server   *httptest.Server
+		observer *recordingObserver
+		client   KubeletInterface
+		host     string
+		port     int
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: `{"node": {"nodeName": "node1"}}`}
+		server = httptest.NewServer(kubelet)
+		observer = &recordingObserver{}
+		host, port = serverHostPort(server)
+		var err error
+		client, err = NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+			DeprecatedCompletelyInsecure: true,
+			RequestObserver:              observer,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should observe successful requests, with their status, size, and trigger", func() {
+		ctx := sources.WithCycleID(sources.WithScrapeReason(context.Background(), sources.ScrapeReasonCycle), "cycle-1")
+		before := time.Now()
+		_, _, err := client.GetSummary(ctx, host)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(observer.requests).To(HaveLen(1))
+		info := observer.requests[0]
+		Expect(info.Start).To(BeTemporally(">=", before))
+		Expect(info.Duration).To(BeNumerically(">", 0))
+		info.Start, info.Duration = time.Time{}, 0
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		Expect(info).To(Equal(RequestInfo{
+			Node:       addr,
+			URL:        "http://" + addr + "/stats/summary/",
+			Endpoint:   EndpointSummary,
+			Reason:     sources.ScrapeReasonCycle,
+			CycleID:    "cycle-1",
+			StatusCode: http.StatusOK,
+			Bytes:      int64(len(kubelet.body)),
+		}))
+	})
+
+	It("should observe failed requests, with their error", func() {
+		kubelet.status = http.StatusUnauthorized
+		kubelet.body = "Unauthorized"
+		_, _, err := client.GetSummary(context.Background(), host)
+		Expect(err).To(HaveOccurred())
+
+		By("failing to connect at all")
+		server.Close()
+		_, _, err = client.GetSummary(context.Background(), host)
+		Expect(err).To(HaveOccurred())
+
+		Expect(observer.requests).To(HaveLen(2))
+		Expect(observer.requests[0].StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(observer.requests[0].Bytes).To(BeEquivalentTo(len("Unauthorized")))
+		Expect(ErrorClass(observer.requests[0].Err)).To(Equal(ErrorClassUnauthorized))
+		Expect(observer.requests[1].StatusCode).To(BeZero())
+		Expect(observer.requests[1].Err).To(HaveOccurred())
+	})
+})
+
+// nodeSummary is a minimal summary of the named node, with stats.
+func nodeSummary(name string) string {
+	return fmt.Sprintf(`{"node": {"nodeName": %q, "cpu": {"time": "2018-08-21T13:49:48Z", "usageNanoCores": 1000}, "memory": {"time": "2018-08-21T13:49:48Z", "workingSetBytes": 1024}}}`, name)
+}
+
+var _ = Describe("Scrape Logging", func() {
+	var (
+		kubelet  *fakeKubelet
+		server   *httptest.Server
+		recorder *logging.Recorder
+		ctx      context.Context
+		src      sources.MetricSource
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: nodeSummary("node1"), headers: http.Header{}}
+		server = httptest.NewServer(kubelet)
+		client, host := directClientWith(server, KubeletClientConfig{})
+		src = NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{NodeNameVerification: NodeNameVerificationWarn})
+		recorder = &logging.Recorder{MaxLevel: 10}
+		ctx = sources.WithCycleID(logging.NewContext(context.Background(), logging.NewLogger(recorder, loglevel.Scraper)), "cycle-1")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should log raw responses with the node, cycle, endpoint and duration of the request", func() {
+		_, err := src.Collect(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries := recorder.FindPrefix("Raw response from Kubelet at ")
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Component).To(Equal(loglevel.Client))
+		Expect(entries[0].Level).To(BeNumerically("==", 10))
+		Expect(entries[0].Fields).To(HaveKeyWithValue("node", "node1"))
+		Expect(entries[0].Fields).To(HaveKeyWithValue("cycle", "cycle-1"))
+		Expect(entries[0].Fields).To(HaveKeyWithValue("endpoint", "/stats/summary/"))
+		Expect(entries[0].Fields).To(HaveKey("duration"))
+	})
+
+	It("should log warnings about a node's summary with the node and cycle", func() {
+		kubelet.body = nodeSummary("node2")
+		_, err := src.Collect(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries := recorder.Find(`summary for node "node1" reported node name "node2", accepting it anyway`)
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Severity).To(Equal("warning"))
+		Expect(entries[0].Fields).To(Equal(map[string]interface{}{"cycle": "cycle-1", "node": "node1", "reportedNode": "node2"}))
+	})
+})
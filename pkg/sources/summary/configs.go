@@ -15,9 +15,17 @@
 package summary
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"time"
 
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe"
 )
 
 // GetKubeletConfig fetches connection config for connecting to the Kubelet.
@@ -48,14 +56,201 @@ type KubeletClientConfig struct {
 	RESTConfig                   *rest.Config
 	DeprecatedCompletelyInsecure bool
 	UseAPIServerProxy            bool
+
+	// MigrateFromCompletelyInsecure, if set, retries requests to the Kubelets over plain
+	// HTTP, without any credentials, when they fail over HTTPS in a TLS-specific way, to
+	// migrate off DeprecatedCompletelyInsecure (see migration.go).  It isn't used with
+	// UseAPIServerProxy.
+	MigrateFromCompletelyInsecure bool
+
+	// Dial, if set, is used to establish the underlying connections to
+	// the Kubelets (or the API server, when proxying), e.g. to tunnel
+	// them over SSH.  TLS is still negotiated over the dialed connection.
+	Dial DialFunc
+
+	// TLSMinVersion and TLSCipherSuites, if set, restrict the TLS connections to
+	// the Kubelets (or the API server, when proxying) to at least the given version,
+	// and to the given cipher suites, respectively.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// SANPolicy, if set, selects the SANs required of the Kubelets' serving certificates,
+	// checked in place of Go's verification of the host connected to (see san.go).  It
+	// isn't used with UseAPIServerProxy, or when serving certificates aren't verified.
+	SANPolicy SANPolicy
+
+	// SPIFFE, if set, supplies the client certificate presented to the Kubelets:
+	// metrics-server's X.509 SVID, in place of any client certificate in the REST
+	// config.  If SPIFFETrustDomain is also set, the Kubelets' serving certificates
+	// are verified as SVIDs in that trust domain, rather than against a CA.
+	SPIFFE            *spiffe.X509Source
+	SPIFFETrustDomain string
+
+	// InsecureTLSNodes, if set, selects the nodes whose Kubelets' serving certificates
+	// aren't verified, while every other node's still are.  It isn't used with
+	// UseAPIServerProxy, since then the API server connects to the Kubelets.
+	InsecureTLSNodes *InsecureTLSNodes
+
+	// Profiles, if set, selects the profiles of the nodes whose Kubelets aren't scraped
+	// with the client's own: ProfileProxy with UseAPIServerProxy, or ProfileSecure.  Those
+	// scraped with ProfileReadOnly are requested on ReadOnlyPort (DefaultReadOnlyPort if
+	// unset), without any credentials.
+	Profiles     *KubeletProfiles
+	ReadOnlyPort int
+	// APIServerRESTConfig, if set, is the client config of the API server which the nodes
+	// scraped with ProfileProxy are proxied through, without UseAPIServerProxy (RESTConfig
+	// otherwise).  Their requests go through a transport of its own, which none of the
+	// settings applying only to the Kubelets (e.g. SANPolicy or SPIFFE) apply to.
+	APIServerRESTConfig *rest.Config
+
+	// HedgeDelay, if set, is how long to wait for a summary before racing a second, identical,
+	// request against it, up to MaxHedgesPerCycle times per collection cycle.  Requests
+	// through the API server proxy are never hedged.
+	HedgeDelay        time.Duration
+	MaxHedgesPerCycle int
+
+	// MaxConcurrentRequestsPerNode, if positive, limits the requests to each Kubelet in flight
+	// at once, from every entry point, except hedged requests (see gate.go).  With
+	// CoalesceRequests, summary requests over the limit share the response of an identical
+	// request already in flight, rather than queuing for their own.
+	MaxConcurrentRequestsPerNode int
+	CoalesceRequests             bool
+
+	// ProxyBreaker, if set, fails requests through the API server proxy fast
+	// while too many of them are failing (see breaker.go).  It's only used
+	// with UseAPIServerProxy.
+	ProxyBreaker *CircuitBreakerConfig
+
+	// APIServerHost, if set, re-resolves the address of the API server proxied through
+	// (see apiserverhost.go), with UseAPIServerProxy or for the nodes scraped with ProfileProxy.
+	APIServerHost *APIServerHostConfig
+
+	// Capture, if set, is used to save raw summary responses for debugging.
+	Capture *BodyCapture
+
+	// CaptureHeaders lists custom response headers to record in the scrape
+	// status, in addition to the standard Warning header.
+	CaptureHeaders []string
+
+	// SummaryDecoder selects how summaries are decoded, defaulting to SummaryDecoderFast.
+	SummaryDecoder SummaryDecoder
+	// SkippedSubtrees, if set, are the subtrees skipped by the fast decoder,
+	// in place of the DefaultSkippedSubtrees.
+	SkippedSubtrees *SubtreeSkips
+	// StrictDecoding, if set, reports the fields of summaries unknown to metrics-server in
+	// their provenance, warning about them once per collection cycle, e.g. to catch schema
+	// drift when testing against new Kubelet versions.
+	StrictDecoding bool
+
+	// RequestObserver, if set, is notified of every request made to the Kubelets.
+	RequestObserver RequestObserver
 }
 
+// idleConnsPerHost is the number of idle connections kept to each host, matching
+// client-go's transports, so that concurrent scrapes through the API server proxy,
+// which all go to the same host, reuse their connections in the next cycle rather
+// than paying for new TLS handshakes, which would dominate at short resolutions.
+const idleConnsPerHost = 25
+
+// DialFunc knows how to establish a connection to the given address.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
 // KubeletClientFor constructs a new KubeletInterface for the given configuration.
 func KubeletClientFor(config *KubeletClientConfig) (KubeletInterface, error) {
-	transport, err := rest.TransportFor(config.RESTConfig)
+	transport, err := transportFor(config)
 	if err != nil {
 		return nil, fmt.Errorf("unable to construct transport: %v", err)
 	}
+	var insecureTransport http.RoundTripper
+	if config.InsecureTLSNodes != nil && !config.UseAPIServerProxy && !config.DeprecatedCompletelyInsecure {
+		insecureTransport, err = transportFor(insecureKubeletConfig(config))
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct transport for Kubelets with unverified certificates: %v", err)
+		}
+	}
+	if config.MigrateFromCompletelyInsecure && !config.UseAPIServerProxy && !config.DeprecatedCompletelyInsecure {
+		plaintext, err := transportFor(plaintextKubeletConfig(config))
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct plain HTTP transport for migrating Kubelets: %v", err)
+		}
+		migration := newSchemeMigration()
+		transport = &migratingTransport{secure: transport, plaintext: plaintext, migration: migration}
+		if insecureTransport != nil {
+			insecureTransport = &migratingTransport{secure: insecureTransport, plaintext: plaintext, migration: migration}
+		}
+	}
+
+	var readOnlyTransport http.RoundTripper
+	if config.Profiles != nil {
+		readOnlyTransport, err = transportFor(plaintextKubeletConfig(config))
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct transport for read-only Kubelets: %v", err)
+		}
+	}
+
+	return newKubeletClient(transport, insecureTransport, readOnlyTransport, config)
+}
+
+// apiServerTransportConfig returns the config of the transport to the API server proxied
+// through, with the given REST config, and the connection settings of the given config
+// applying to the API server, but nothing applying only to the Kubelets.
+func apiServerTransportConfig(config *KubeletClientConfig, restConfig *rest.Config) *KubeletClientConfig {
+	return &KubeletClientConfig{
+		RESTConfig:        restConfig,
+		UseAPIServerProxy: true,
+		Dial:              config.Dial,
+		TLSMinVersion:     config.TLSMinVersion,
+		TLSCipherSuites:   config.TLSCipherSuites,
+	}
+}
 
-	return NewKubeletClient(transport, config)
+// transportFor constructs the round tripper used to connect to the Kubelets.
+func transportFor(config *KubeletClientConfig) (http.RoundTripper, error) {
+	policy := newTLSPolicy(config)
+	sans := newSANVerifier(config)
+	if config.Dial == nil && policy == nil && config.SPIFFE == nil && sans == nil {
+		return rest.TransportFor(config.RESTConfig)
+	}
+
+	// NB: we construct the transport ourselves instead of setting Dial on the
+	// REST config, since client-go caches transports by the dial function's
+	// code pointer, which is the same for every wrapped dialer, and has no way
+	// to set the TLS version or cipher suites, or to rotate client certificates.
+	tlsConfig, err := rest.TLSConfigFor(config.RESTConfig)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil && !config.DeprecatedCompletelyInsecure {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		policy.apply(tlsConfig)
+	}
+	if config.SPIFFE != nil && !config.DeprecatedCompletelyInsecure {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		config.SPIFFE.ConfigureClientTLS(tlsConfig, config.SPIFFETrustDomain)
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: idleConnsPerHost,
+	}
+	if config.Dial != nil {
+		transport.DialContext = wrapDialErrors(config.Dial)
+	}
+	transport = utilnet.SetTransportDefaults(transport)
+	if sans != nil {
+		dial := DialFunc((&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext)
+		if config.Dial != nil {
+			dial = wrapDialErrors(config.Dial)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.DialTLSContext = sans.dialTLS(dial, transport.TLSClientConfig)
+	}
+	return rest.HTTPWrappersForConfig(config.RESTConfig, transport)
 }
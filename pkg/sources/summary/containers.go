@@ -0,0 +1,87 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"path"
+
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// ContainerExclusionMode controls what happens to containers matched by a ContainerFilter.
+type ContainerExclusionMode string
+
+const (
+	// ContainerExclusionList keeps excluded containers listed in their pod's metrics, so that
+	// they can still be targeted individually, but leaves them out of pod-level aggregates.
+	ContainerExclusionList ContainerExclusionMode = "list"
+	// ContainerExclusionDrop drops excluded containers from their pod's metrics entirely.
+	ContainerExclusionDrop ContainerExclusionMode = "drop"
+)
+
+// ContainerFilter matches containers (such as injected service mesh sidecars)
+// to exclude from pod metrics, by exact name or simple glob.
+type ContainerFilter struct {
+	patterns []string
+	mode     ContainerExclusionMode
+}
+
+// NewContainerFilter returns a filter matching containers by the given patterns, which are
+// either exact names, or globs as supported by path.Match (e.g. "*-proxy").  It returns an
+// error if any pattern or the mode is invalid.
+func NewContainerFilter(patterns []string, mode ContainerExclusionMode) (*ContainerFilter, error) {
+	if mode != ContainerExclusionList && mode != ContainerExclusionDrop {
+		return nil, fmt.Errorf("invalid container exclusion mode %q, must be %q or %q", mode, ContainerExclusionList, ContainerExclusionDrop)
+	}
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, fmt.Errorf("invalid excluded container pattern: must not be empty")
+		}
+		// path.Match only reports bad patterns once it reaches the bad part,
+		// so match against a name that can't stop it early
+		if _, err := path.Match(pattern, pattern); err != nil {
+			return nil, fmt.Errorf("invalid excluded container pattern %q: %v", pattern, err)
+		}
+	}
+	return &ContainerFilter{patterns: patterns, mode: mode}, nil
+}
+
+// Matches checks if the given container name is excluded.  A nil filter matches nothing.
+func (f *ContainerFilter) Matches(name string) bool {
+	if f == nil {
+		return false
+	}
+	for _, pattern := range f.patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// keep returns the containers which should be decoded, dropping excluded ones in drop mode.
+func (f *ContainerFilter) keep(containers []stats.ContainerStats) []stats.ContainerStats {
+	if f == nil || f.mode != ContainerExclusionDrop {
+		return containers
+	}
+	var kept []stats.ContainerStats
+	for _, container := range containers {
+		if !f.Matches(container.Name) {
+			kept = append(kept, container)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// The Kubelet reports CPU usage both as a rate (usageNanoCores), which cAdvisor calculates
+// over its own housekeeping interval, and as a cumulative counter (usageCoreNanoSeconds).
+// cAdvisor bugs have been seen to leave the two an order of magnitude apart, and whichever
+// is served decides whether HPAs misfire.  When the consistency check is enabled, a rate is
+// also derived from the counters in successive summaries (just like page fault rates), and
+// served in preference to the reported rate whenever there is one.  The reported rate is
+// only served until there's a previous sample (which may be restored from before a restart,
+// see warmstart.go), or after the counter's reset.  Rates that diverge by more than the
+// configured ratio are counted in a per-node gauge, logged (at most once per node per
+// cpuRateWarningInterval), and listed in the node's scrape status.
+
+// cpuRateWarningInterval is the minimum time between warnings about inconsistent CPU
+// usage rates on the same node.  Inconsistencies in between are only logged at V(2).
+const cpuRateWarningInterval = 10 * time.Minute
+
+// minCPURateCompared is the rate (in nanocores) below which rates aren't compared, since
+// the rates of idle containers are dominated by rounding, and divergence doesn't matter.
+const minCPURateCompared = 1000000
+
+// maxCPURateInconsistenciesRecorded caps the inconsistencies listed in each node's scrape status.
+const maxCPURateInconsistenciesRecorded = 10
+
+var cpuRateInconsistencies = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "cpu_rate_inconsistencies",
+		Help:      "The number of containers (and the node itself) in the node's last summary whose reported CPU usage rate diverged from the rate derived from their cumulative CPU usage by more than the configured ratio",
+	},
+	[]string{"node"},
+)
+
+func init() {
+	prometheus.MustRegister(cpuRateInconsistencies)
+}
+
+// CPURateInconsistency records a container (or node) whose reported CPU usage rate
+// diverged from the rate derived from its cumulative CPU usage.
+type CPURateInconsistency struct {
+	// Pod is the namespace/name of the container's pod.  It, and Container,
+	// are empty for the node itself.
+	Pod       string `json:"pod,omitempty"`
+	Container string `json:"container,omitempty"`
+	// ReportedNanoCores is the rate reported by the Kubelet, and
+	// DerivedNanoCores the rate derived from the cumulative usage (which is served).
+	ReportedNanoCores uint64 `json:"reportedNanoCores"`
+	DerivedNanoCores  uint64 `json:"derivedNanoCores"`
+	// WindowSeconds is the time between the samples the derived rate was calculated from.
+	WindowSeconds float64 `json:"windowSeconds"`
+}
+
+type cpuSample struct {
+	timestamp time.Time
+	usage     uint64
+	// startTime is when the container (or node) started, as reported with the sample.
+	startTime time.Time
+	// warm marks samples restored from a warm start (see warmstart.go), which were taken
+	// by a previous process, and so are only used if they're of the same container.
+	warm bool
+	// rate and window are the rate derived from the sample, if derived is set,
+	// which is carried forward if the next sample is the same (see stalesummary.go).
+	rate    uint64
+	window  time.Duration
+	derived bool
+}
+
+// cpuSamples holds the cumulative CPU usage sampled from a single summary, by container.
+// The node's own sample is keyed by the zero containerKey.
+type cpuSamples map[containerKey]cpuSample
+
+// cpuRateTracker holds the last cumulative CPU usage sampled from each
+// node, along with when inconsistencies on it were last warned about.
+type cpuRateTracker struct {
+	mu         sync.Mutex
+	samples    map[string]cpuSamples
+	lastWarned map[string]time.Time
+	// warmMaxAge is the longest before a sample that a sample restored from a warm start may
+	// have been taken, for a rate to be derived between them.
+	warmMaxAge time.Duration
+}
+
+func newCPURateTracker() *cpuRateTracker {
+	return &cpuRateTracker{
+		samples:    make(map[string]cpuSamples),
+		lastWarned: make(map[string]time.Time),
+	}
+}
+
+// check starts checking the CPU usage rates of a summary from the given node against those
+// derived from the last samples of it, or returns nil (checking nothing) if the tracker is nil.
+func (t *cpuRateTracker) check(node string, ratio float64, maxGap time.Duration) *cpuRateCheck {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.samples[node]
+	return &cpuRateCheck{
+		prev:       prev,
+		next:       make(cpuSamples, len(prev)),
+		ratio:      ratio,
+		maxGap:     maxGap,
+		warmMaxAge: t.warmMaxAge,
+	}
+}
+
+// finish records the samples and inconsistencies found by the given check of a summary from
+// the given node, warning about any inconsistencies unless it's done so recently.  It returns
+// a note for the scrape status if there were any.
+func (t *cpuRateTracker) finish(node string, check *cpuRateCheck) string {
+	if t == nil || check == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[node] = check.next
+	cpuRateInconsistencies.WithLabelValues(node).Set(float64(check.numInconsistent))
+	if check.numInconsistent == 0 {
+		return ""
+	}
+
+	first := check.inconsistencies[0]
+	msg := fmt.Sprintf("node %q: %d reported CPU usage rates diverged from the rates derived from cumulative CPU usage by more than %gx (e.g. %s reported %d nanocores, but used %d over %.1fs), serving the derived rates",
+		node, check.numInconsistent, check.ratio, first.subject(), first.ReportedNanoCores, first.DerivedNanoCores, first.WindowSeconds)
+	if now := time.Now(); now.Sub(t.lastWarned[node]) >= cpuRateWarningInterval {
+		t.lastWarned[node] = now
+		glog.Warning(msg)
+	} else {
+		loglevel.V(loglevel.Scraper, 2).Info(msg)
+	}
+	return fmt.Sprintf("%d reported CPU usage rates diverged from the rates derived from cumulative CPU usage by more than %gx, serving the derived rates", check.numInconsistent, check.ratio)
+}
+
+// prune removes the samples and gauges of any node not in the given set.
+func (t *cpuRateTracker) prune(keep map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node := range t.samples {
+		if _, ok := keep[node]; !ok {
+			delete(t.samples, node)
+			delete(t.lastWarned, node)
+			cpuRateInconsistencies.DeleteLabelValues(node)
+		}
+	}
+}
+
+// cpuRateCheck checks the CPU usage rates in a single summary against
+// the rates derived from the cumulative usage in the last one.
+type cpuRateCheck struct {
+	prev, next cpuSamples
+	ratio      float64
+	maxGap     time.Duration
+	warmMaxAge time.Duration
+
+	numInconsistent int
+	inconsistencies []CPURateInconsistency
+}
+
+// decodeCPU decodes the CPU usage of the given container (or node, for the zero key), which
+// started at the given time, into the target's CpuUsage, preferring the rate derived from its
+// cumulative usage over the reported rate (setting the target's Window to the one it was derived
+// over), and recording any divergence between the two.  A nil check just decodes the reported rate.
+func (c *cpuRateCheck) decodeCPU(target *sources.MetricsPoint, key containerKey, cpuStats *stats.CPUStats, startTime time.Time) error {
+	if c == nil {
+		return decodeCPU(&target.CpuUsage, cpuStats)
+	}
+	derived, window, ok := c.derive(key, cpuStats, startTime)
+	if !ok {
+		return decodeCPU(&target.CpuUsage, cpuStats)
+	}
+	if reported := cpuStats.UsageNanoCores; reported != nil && cpuRatesDiverge(*reported, derived, c.ratio) {
+		c.numInconsistent++
+		if len(c.inconsistencies) < maxCPURateInconsistenciesRecorded {
+			inconsistency := CPURateInconsistency{
+				Container:         key.container,
+				ReportedNanoCores: *reported,
+				DerivedNanoCores:  derived,
+				WindowSeconds:     window.Seconds(),
+			}
+			if key.pod != "" {
+				inconsistency.Pod = key.namespace + "/" + key.pod
+			}
+			c.inconsistencies = append(c.inconsistencies, inconsistency)
+		}
+	}
+	target.CpuUsage = *translate.Uint64Quantity(derived, -9)
+	target.Window = window
+	return nil
+}
+
+// derive records the cumulative CPU usage of the given container, returning the rate (in
+// nanocores) since the last sample of it, and the window between them, if there was one
+// (and the counter wasn't reset), unless the samples are further apart than the maximum gap
+// (or, for a sample restored from a warm start, its max age).  The same sample again (from a stale summary) carries forward the rate derived from the last.
+func (c *cpuRateCheck) derive(key containerKey, cpuStats *stats.CPUStats, startTime time.Time) (uint64, time.Duration, bool) {
+	if cpuStats == nil || cpuStats.UsageCoreNanoSeconds == nil || cpuStats.Time.IsZero() {
+		return 0, 0, false
+	}
+	cur := cpuSample{timestamp: cpuStats.Time.Time, usage: *cpuStats.UsageCoreNanoSeconds, startTime: startTime}
+	c.next[key] = cur
+
+	last, ok := c.prev[key]
+	if !ok {
+		return 0, 0, false
+	}
+	maxGap := c.maxGap
+	if last.warm {
+		if !c.usableWarmSample(last, cur) {
+			return 0, 0, false
+		}
+		// the window spans the restart, so it's bounded by the warm start's max age instead
+		maxGap = 0
+	}
+	if last.derived && cur.timestamp.Equal(last.timestamp) && cur.usage == last.usage {
+		c.next[key] = last
+		return last.rate, last.window, true
+	}
+	window, ok := translate.RateWindow(last.timestamp, cur.timestamp, cur.usage < last.usage, maxGap)
+	if !ok {
+		return 0, 0, false
+	}
+	cur.rate, cur.window, cur.derived = uint64(translate.PerSecond(float64(cur.usage-last.usage), window)), window, true
+	c.next[key] = cur
+	return cur.rate, cur.window, true
+}
+
+// cpuRatesDiverge checks if the given rates differ by more than the given ratio,
+// ignoring rates too low to matter.
+func cpuRatesDiverge(reported, derived uint64, ratio float64) bool {
+	high, low := float64(reported), float64(derived)
+	if low > high {
+		high, low = low, high
+	}
+	return high >= minCPURateCompared && high > low*ratio
+}
+
+// subject describes what the inconsistency is of, for logging.
+func (i CPURateInconsistency) subject() string {
+	if i.Pod == "" {
+		return "the node"
+	}
+	return fmt.Sprintf("container %q in pod %s", i.Container, i.Pod)
+}
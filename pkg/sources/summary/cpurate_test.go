@@ -0,0 +1,178 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+const (
+	cpuRateInconsistenciesGauge = "metrics_server_kubelet_summary_cpu_rate_inconsistencies"
+	staleResponsesGauge         = "metrics_server_kubelet_summary_consecutive_stale_responses"
+)
+
+var _ = Describe("CPU Rate Consistency", func() {
+	var (
+		kubelet  *fakeKubelet
+		server   *httptest.Server
+		statuses *ScrapeStatusTracker
+		client   KubeletInterface
+		host     string
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK}
+		server = httptest.NewServer(kubelet)
+		statuses = NewScrapeStatusTracker()
+		client, host = directClient(server)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newSource := func(ratio float64) sources.MetricSource {
+		return NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{Statuses: statuses, CPURateConsistencyRatio: ratio})
+	}
+
+	// collect serves the given fixture, and collects it with the given source, returning
+	// the CPU usage of the node, and of each container, in millicores.
+	collect := func(src sources.MetricSource, fixture string) map[string]int64 {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "cpu-rates", fixture))
+		Expect(err).NotTo(HaveOccurred())
+		kubelet.body = string(body)
+
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Nodes).To(HaveLen(1))
+		Expect(batch.Pods).To(HaveLen(1))
+		usage := map[string]int64{"node": batch.Nodes[0].CpuUsage.MilliValue()}
+		for _, container := range batch.Pods[0].Containers {
+			usage[container.Name] = container.CpuUsage.MilliValue()
+		}
+		return usage
+	}
+
+	inconsistencies := func() float64 {
+		value, ok := gaugeValue(cpuRateInconsistenciesGauge, "node1")
+		Expect(ok).To(BeTrue())
+		return value
+	}
+
+	It("should serve the rates derived from cumulative usage, once there are any, when they agree", func() {
+		src := newSource(2)
+		Expect(collect(src, "agreeing-1.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		Expect(collect(src, "agreeing-2.json")).To(Equal(map[string]int64{"node": 2000, "app": 520, "sidecar": 20}))
+
+		status, ok := statuses.Get("node1")
+		Expect(ok).To(BeTrue())
+		Expect(status.CPURates).To(BeEmpty())
+		Expect(status.Notes).To(BeEmpty())
+		Expect(inconsistencies()).To(BeZero())
+	})
+
+	It("should serve the derived rates, and record the inconsistencies, when they disagree", func() {
+		src := newSource(2)
+		Expect(collect(src, "disagreeing-1.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		Expect(collect(src, "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+
+		status, ok := statuses.Get("node1")
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeTrue())
+		Expect(status.CPURates).To(Equal([]CPURateInconsistency{
+			{Pod: "ns1/pod1", Container: "app", ReportedNanoCores: 5000000000, DerivedNanoCores: 500000000, WindowSeconds: 10},
+			{Pod: "ns1/pod1", Container: "sidecar", ReportedNanoCores: 2000000, DerivedNanoCores: 20000000, WindowSeconds: 10},
+		}))
+		Expect(status.Notes).To(ConsistOf(ContainSubstring("2 reported CPU usage rates diverged")))
+		Expect(inconsistencies()).To(BeEquivalentTo(2))
+
+		By("clearing them once the rates agree again")
+		Expect(collect(src, "agreeing-1.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		Expect(collect(src, "agreeing-2.json")).To(Equal(map[string]int64{"node": 2000, "app": 520, "sidecar": 20}))
+		status, _ = statuses.Get("node1")
+		Expect(status.CPURates).To(BeEmpty())
+		Expect(inconsistencies()).To(BeZero())
+	})
+
+	It("should record the window the rates were derived over, and none for the reported rates", func() {
+		src := newSource(2)
+		windows := func(fixture string) map[string]time.Duration {
+			body, err := ioutil.ReadFile(filepath.Join("testdata", "cpu-rates", fixture))
+			Expect(err).NotTo(HaveOccurred())
+			kubelet.body = string(body)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			res := map[string]time.Duration{"node": batch.Nodes[0].Window}
+			for _, container := range batch.Pods[0].Containers {
+				res[container.Name] = container.Window
+			}
+			return res
+		}
+		Expect(windows("agreeing-1.json")).To(Equal(map[string]time.Duration{"node": 0, "app": 0, "sidecar": 0}))
+		Expect(windows("agreeing-2.json")).To(Equal(map[string]time.Duration{"node": 10 * time.Second, "app": 10 * time.Second, "sidecar": 10 * time.Second}))
+	})
+
+	It("should carry the derived rates forward through summaries served again from the Kubelet's cache, counting them", func() {
+		src := newSource(2)
+		collect(src, "disagreeing-1.json")
+		Expect(collect(src, "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		stale, ok := gaugeValue(staleResponsesGauge, "node1")
+		Expect(ok).To(BeTrue())
+		Expect(stale).To(BeZero())
+
+		for i := 1; i <= 3; i++ {
+			// rather than the reported rates, or zero
+			Expect(collect(src, "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+			stale, _ = gaugeValue(staleResponsesGauge, "node1")
+			Expect(stale).To(BeEquivalentTo(i))
+			status, _ := statuses.Get("node1")
+			Expect(status.Success).To(BeTrue())
+			Expect(status.Notes).To(ContainElement(ContainSubstring("served from the Kubelet's cache")))
+		}
+
+		By("resetting the count once a fresh summary arrives")
+		collect(src, "disagreeing-1.json")
+		stale, _ = gaugeValue(staleResponsesGauge, "node1")
+		Expect(stale).To(BeZero())
+	})
+
+	It("should fall back to the reported rates when there's no usable previous sample", func() {
+		src := newSource(2)
+		Expect(collect(src, "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2200, "app": 5000, "sidecar": 2}))
+		// going back in time looks just like a stale sample, or a reset counter
+		Expect(collect(src, "agreeing-1.json")).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		status, _ := statuses.Get("node1")
+		Expect(status.CPURates).To(BeEmpty())
+	})
+
+	It("should only serve the reported rates when disabled", func() {
+		src := newSource(0)
+		collect(src, "disagreeing-1.json")
+		Expect(collect(src, "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2200, "app": 5000, "sidecar": 2}))
+		status, _ := statuses.Get("node1")
+		Expect(status.CPURates).To(BeEmpty())
+	})
+})
@@ -0,0 +1,852 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// Decoding a summary with encoding/json, by reflection, is slow, and much of a summary is
+// stats metrics-server never reads.  The fast decoder instead scans the response directly,
+// decoding the fields read from it:
+//
+//   - the node's name, CPU, memory, rlimit, and runtime image filesystem stats;
+//   - each pod's reference and containers;
+//   - each container's name, CPU, and memory stats;
+//
+// along with the CPU, memory, filesystem, and start time stats of the rest, but skipping the
+// configured subtrees (see subtrees.go), and unknown keys, without allocating them (or, decoding
+// strictly, reporting the unknown keys, see strict.go).  The few
+// remaining stats (network, volume, accelerator, and user-defined metric stats, if they're not
+// skipped) are decoded with encoding/json.  Everything is decoded exactly as encoding/json
+// would, into the same reused targets of a pooled summary (see pool.go), except that keys are
+// only matched exactly, as the Kubelet writes them, rather than falling back to case-insensitive
+// matches.  Skipped values are only checked for well-formed strings and balanced brackets.
+
+// SummaryDecoder selects how summary responses are decoded.
+type SummaryDecoder string
+
+const (
+	// SummaryDecoderFast decodes only the fields of summaries that metrics-server reads.
+	SummaryDecoderFast SummaryDecoder = "fast"
+	// SummaryDecoderFull decodes summaries in full, with encoding/json.
+	SummaryDecoderFull SummaryDecoder = "full"
+)
+
+// Decode decodes the given summary response into the given summary, which must be either
+// new or reset for reuse, skipping the DefaultSkippedSubtrees.  Anything but
+// SummaryDecoderFull decodes fast.
+func (d SummaryDecoder) Decode(body []byte, summary *stats.Summary) error {
+	return d.DecodeSkipping(body, summary, defaultSubtreeSkips)
+}
+
+// DecodeSkipping decodes the given summary response like Decode, but skipping the
+// given subtrees instead.  SummaryDecoderFull never skips anything.
+func (d SummaryDecoder) DecodeSkipping(body []byte, summary *stats.Summary, skips *SubtreeSkips) error {
+	return d.DecodeSkippingWithSwap(body, summary, skips, nil)
+}
+
+// DecodeSkippingWithSwap decodes the given summary response like DecodeSkipping, also decoding
+// the swap usage it reports into the given swap summary (see swap.go), which must be new,
+// unless it's nil.
+func (d SummaryDecoder) DecodeSkippingWithSwap(body []byte, summary *stats.Summary, skips *SubtreeSkips, swap *SwapSummary) error {
+	_, err := d.decode(body, summary, skips, swap, false)
+	return err
+}
+
+// DecodeReportingUnknown decodes the given summary response like DecodeSkippingWithSwap,
+// also returning the paths of the fields it contains unknown to metrics-server, sorted (see
+// strict.go).  Unknown fields are never an error.
+func (d SummaryDecoder) DecodeReportingUnknown(body []byte, summary *stats.Summary, skips *SubtreeSkips, swap *SwapSummary) ([]string, error) {
+	return d.decode(body, summary, skips, swap, true)
+}
+
+func (d SummaryDecoder) decode(body []byte, summary *stats.Summary, skips *SubtreeSkips, swap *SwapSummary, strict bool) ([]string, error) {
+	if d == SummaryDecoderFull {
+		if err := json.Unmarshal(body, summary); err != nil {
+			return nil, err
+		}
+		var unknown []string
+		if strict {
+			unknown = fullUnknownFields(body)
+		}
+		if swap != nil {
+			return unknown, decodeSwap(body, swap)
+		}
+		return unknown, nil
+	}
+	s := &summaryScanner{data: body, skips: skips, swap: swap}
+	if strict {
+		s.unknown = make(map[string]bool)
+	}
+	defer s.countSkipped()
+	if err := s.summary(summary); err != nil {
+		return nil, err
+	}
+	s.space()
+	if s.pos != len(s.data) {
+		return nil, s.errorf("unexpected data after the summary")
+	}
+	return sortedPaths(s.unknown), nil
+}
+
+var nullLiteral = []byte("null")
+
+// the stats types of the objects scanned, whose fields' keys are known when decoding strictly
+var (
+	summaryType        = reflect.TypeOf(stats.Summary{})
+	nodeStatsType      = reflect.TypeOf(stats.NodeStats{})
+	podStatsType       = reflect.TypeOf(stats.PodStats{})
+	podReferenceType   = reflect.TypeOf(stats.PodReference{})
+	containerStatsType = reflect.TypeOf(stats.ContainerStats{})
+	cpuStatsType       = reflect.TypeOf(stats.CPUStats{})
+	memoryStatsType    = reflect.TypeOf(stats.MemoryStats{})
+	rlimitStatsType    = reflect.TypeOf(stats.RlimitStats{})
+	runtimeStatsType   = reflect.TypeOf(stats.RuntimeStats{})
+	fsStatsType        = reflect.TypeOf(stats.FsStats{})
+)
+
+// summaryScanner decodes the fields read from a summary, skipping the rest.
+type summaryScanner struct {
+	data []byte
+	pos  int
+
+	skips *SubtreeSkips
+	// skipped is the number of bytes skipped in each skipped subtree
+	skipped map[string]int
+
+	// swap, if non-nil, receives the swap usage reported, and podSwap
+	// that of the pod being decoded
+	swap    *SwapSummary
+	podSwap *PodSwapStats
+
+	// unknown, if non-nil, receives the paths of the unknown keys skipped, and path
+	// holds the keys leading to the value being scanned
+	unknown map[string]bool
+	path    []string
+
+	// the last time decoded, and its raw value, since a summary repeats the same few times
+	haveTime    bool
+	lastTimeRaw []byte
+	lastTime    time.Time
+}
+
+func (s *summaryScanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid summary at offset %d: %s", s.pos, fmt.Sprintf(format, args...))
+}
+
+func (s *summaryScanner) space() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\n', '\r':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+// consume consumes the given delimiter, after any whitespace.
+func (s *summaryScanner) consume(c byte) error {
+	s.space()
+	if s.pos >= len(s.data) {
+		return s.errorf("unexpected end of input, expecting %q", c)
+	}
+	if s.data[s.pos] != c {
+		return s.errorf("unexpected %q, expecting %q", s.data[s.pos], c)
+	}
+	s.pos++
+	return nil
+}
+
+// null consumes a null, if that's the next value.
+func (s *summaryScanner) null() bool {
+	s.space()
+	if bytes.HasPrefix(s.data[s.pos:], nullLiteral) {
+		s.pos += len(nullLiteral)
+		return true
+	}
+	return false
+}
+
+// object scans an object, calling the given function to consume the value of each key.
+// A null is treated as an empty object, as encoding/json does for struct values.
+func (s *summaryScanner) object(field func(key []byte) error) error {
+	if s.null() {
+		return nil
+	}
+	if err := s.consume('{'); err != nil {
+		return err
+	}
+	s.space()
+	if s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		s.space()
+		start := s.pos
+		key, plain, err := s.rawString()
+		if err != nil {
+			return err
+		}
+		if !plain {
+			var unescaped string
+			if err := json.Unmarshal(s.data[start:s.pos], &unescaped); err != nil {
+				return err
+			}
+			key = []byte(unescaped)
+		}
+		if err := s.consume(':'); err != nil {
+			return err
+		}
+		if s.unknown != nil {
+			s.path = append(s.path, string(key))
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+		if s.unknown != nil {
+			s.path = s.path[:len(s.path)-1]
+		}
+		s.space()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input in an object")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("unexpected %q in an object", s.data[s.pos])
+		}
+	}
+}
+
+// array scans an array, calling the given function to consume each element.
+func (s *summaryScanner) array(elem func() error) error {
+	if err := s.consume('['); err != nil {
+		return err
+	}
+	s.space()
+	if s.pos < len(s.data) && s.data[s.pos] == ']' {
+		s.pos++
+		return nil
+	}
+	for {
+		if err := elem(); err != nil {
+			return err
+		}
+		s.space()
+		if s.pos >= len(s.data) {
+			return s.errorf("unexpected end of input in an array")
+		}
+		switch s.data[s.pos] {
+		case ',':
+			s.pos++
+		case ']':
+			s.pos++
+			return nil
+		default:
+			return s.errorf("unexpected %q in an array", s.data[s.pos])
+		}
+	}
+}
+
+// rawString consumes a string, returning its contents as they appear in the input,
+// and whether they're plain ASCII with no escapes, and so are also its value.
+func (s *summaryScanner) rawString() ([]byte, bool, error) {
+	if err := s.consume('"'); err != nil {
+		return nil, false, err
+	}
+	start := s.pos
+	plain := true
+	for s.pos < len(s.data) {
+		switch c := s.data[s.pos]; {
+		case c == '"':
+			s.pos++
+			return s.data[start : s.pos-1], plain, nil
+		case c == '\\':
+			plain = false
+			s.pos += 2
+			continue
+		case c < 0x20:
+			return nil, false, s.errorf("invalid character %q in a string", c)
+		case c >= 0x80:
+			plain = false
+		}
+		s.pos++
+	}
+	return nil, false, s.errorf("unexpected end of input in a string")
+}
+
+// skip consumes a value without decoding it.
+func (s *summaryScanner) skip() error {
+	s.space()
+	if s.pos >= len(s.data) {
+		return s.errorf("unexpected end of input, expecting a value")
+	}
+	switch s.data[s.pos] {
+	case '"':
+		_, _, err := s.rawString()
+		return err
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case '"':
+				if _, _, err := s.rawString(); err != nil {
+					return err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					s.pos++
+					return nil
+				}
+			}
+			s.pos++
+		}
+		return s.errorf("unexpected end of input in a skipped value")
+	default:
+		// a number or literal, which runs until the next delimiter
+		start := s.pos
+		for s.pos < len(s.data) {
+			switch s.data[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\n', '\r':
+			default:
+				s.pos++
+				continue
+			}
+			break
+		}
+		if s.pos == start {
+			return s.errorf("unexpected %q, expecting a value", s.data[s.pos])
+		}
+		return nil
+	}
+}
+
+// skipUnknown skips the value of the given key, which isn't decoded, recording its path
+// if it's not even that of a field of the given stats type.
+func (s *summaryScanner) skipUnknown(key []byte, t reflect.Type) error {
+	if s.unknown != nil {
+		path := strings.Join(s.path, ".")
+		if _, known := knownKey(t, string(key), path); !known {
+			s.unknown[path] = true
+		}
+	}
+	return s.skip()
+}
+
+// skipSubtree skips the value of the subtree at the given path, if it's configured
+// to be skipped, returning whether it was.
+func (s *summaryScanner) skipSubtree(path string) (bool, error) {
+	if !s.skips.Skips(path) {
+		return false, nil
+	}
+	s.space()
+	start := s.pos
+	err := s.skip()
+	if s.skipped == nil {
+		s.skipped = make(map[string]int)
+	}
+	s.skipped[path] += s.pos - start
+	return true, err
+}
+
+// countSkipped adds the bytes skipped to the skipped bytes metric.
+func (s *summaryScanner) countSkipped() {
+	for path, n := range s.skipped {
+		skippedBytes.WithLabelValues(path).Add(float64(n))
+	}
+}
+
+// jsonValue decodes a value with encoding/json.
+func (s *summaryScanner) jsonValue(target interface{}) error {
+	s.space()
+	start := s.pos
+	if err := s.skip(); err != nil {
+		return err
+	}
+	return json.Unmarshal(s.data[start:s.pos], target)
+}
+
+// string decodes a string.
+func (s *summaryScanner) string(target *string) error {
+	if s.null() {
+		return nil
+	}
+	start := s.pos
+	raw, plain, err := s.rawString()
+	if err != nil {
+		return err
+	}
+	if !plain {
+		return json.Unmarshal(s.data[start:s.pos], target)
+	}
+	*target = string(raw)
+	return nil
+}
+
+// digits consumes an unsigned integer, which mustn't exceed the given maximum.
+func (s *summaryScanner) digits(max uint64) (uint64, error) {
+	start := s.pos
+	var value uint64
+	for s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '9' {
+		digit := uint64(s.data[s.pos] - '0')
+		if value > (max-digit)/10 {
+			return 0, s.errorf("number out of range")
+		}
+		value = value*10 + digit
+		s.pos++
+	}
+	switch {
+	case s.pos == start:
+		return 0, s.errorf("expecting an integer")
+	case s.data[start] == '0' && s.pos-start > 1:
+		return 0, s.errorf("invalid integer with a leading zero")
+	case s.pos < len(s.data) && (s.data[s.pos] == '.' || s.data[s.pos] == 'e' || s.data[s.pos] == 'E'):
+		return 0, s.errorf("expecting an integer, not a fraction")
+	}
+	return value, nil
+}
+
+// uint64 decodes an unsigned integer into the given pointer, reusing its target if it has one.
+func (s *summaryScanner) uint64(target **uint64) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	value, err := s.digits(math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	if *target == nil {
+		*target = new(uint64)
+	}
+	**target = value
+	return nil
+}
+
+// int64 decodes an integer into the given pointer, reusing its target if it has one.
+func (s *summaryScanner) int64(target **int64) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	negative := s.pos < len(s.data) && s.data[s.pos] == '-'
+	if negative {
+		s.pos++
+	}
+	var max uint64 = math.MaxInt64
+	if negative {
+		max++
+	}
+	magnitude, err := s.digits(max)
+	if err != nil {
+		return err
+	}
+	value := int64(magnitude)
+	if negative {
+		value = -value
+	}
+	if *target == nil {
+		*target = new(int64)
+	}
+	**target = value
+	return nil
+}
+
+// time decodes a time, as metav1.Time does.
+func (s *summaryScanner) time(target *metav1.Time) error {
+	if s.null() {
+		target.Time = time.Time{}
+		return nil
+	}
+	start := s.pos
+	raw, plain, err := s.rawString()
+	if err != nil {
+		return err
+	}
+	if !plain {
+		return target.UnmarshalJSON(s.data[start:s.pos])
+	}
+	if !s.haveTime || !bytes.Equal(raw, s.lastTimeRaw) {
+		parsed, err := time.Parse(time.RFC3339, string(raw))
+		if err != nil {
+			return err
+		}
+		s.haveTime, s.lastTimeRaw, s.lastTime = true, raw, parsed.Local()
+	}
+	target.Time = s.lastTime
+	return nil
+}
+
+func (s *summaryScanner) summary(summary *stats.Summary) error {
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "node":
+			return s.nodeStats(&summary.Node)
+		case "pods":
+			return s.pods(&summary.Pods)
+		}
+		return s.skipUnknown(key, summaryType)
+	})
+}
+
+func (s *summaryScanner) nodeStats(node *stats.NodeStats) error {
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "nodeName":
+			return s.string(&node.NodeName)
+		case "cpu":
+			return s.cpuStats(&node.CPU)
+		case "memory":
+			return s.memoryStats(&node.Memory)
+		case "rlimit":
+			return s.rlimitStats(&node.Rlimit)
+		case "runtime":
+			return s.runtimeStats(&node.Runtime)
+		case "systemContainers":
+			if skipped, err := s.skipSubtree("node.systemContainers"); skipped {
+				return err
+			}
+			return s.containers(&node.SystemContainers, &systemContainerSubtrees)
+		case "startTime":
+			if skipped, err := s.skipSubtree("node.startTime"); skipped {
+				return err
+			}
+			return s.time(&node.StartTime)
+		case "network":
+			if skipped, err := s.skipSubtree("node.network"); skipped {
+				return err
+			}
+			return s.jsonValue(&node.Network)
+		case "fs":
+			if skipped, err := s.skipSubtree("node.fs"); skipped {
+				return err
+			}
+			return s.fsStats(&node.Fs)
+		case "swap":
+			if s.swap != nil {
+				return s.jsonValue(&s.swap.Node)
+			}
+		}
+		return s.skipUnknown(key, nodeStatsType)
+	})
+}
+
+func (s *summaryScanner) pods(target *[]stats.PodStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	// reuse the elements of a pooled summary, as encoding/json does
+	pods := (*target)[:0]
+	err := s.array(func() error {
+		if len(pods) < cap(pods) {
+			pods = pods[:len(pods)+1]
+		} else {
+			pods = append(pods, stats.PodStats{})
+		}
+		return s.podStats(&pods[len(pods)-1])
+	})
+	if pods == nil {
+		pods = []stats.PodStats{}
+	}
+	*target = pods
+	return err
+}
+
+func (s *summaryScanner) podStats(pod *stats.PodStats) error {
+	if s.swap != nil {
+		// the pod reference may come after the swap usage, so only record it afterwards
+		s.podSwap = &PodSwapStats{}
+		defer func() {
+			s.swap.addPod(pod.PodRef, s.podSwap)
+			s.podSwap = nil
+		}()
+	}
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "podRef":
+			return s.podReference(&pod.PodRef)
+		case "containers":
+			return s.containers(&pod.Containers, &podContainerSubtrees)
+		case "startTime":
+			if skipped, err := s.skipSubtree("pods.startTime"); skipped {
+				return err
+			}
+			return s.time(&pod.StartTime)
+		case "cpu":
+			if skipped, err := s.skipSubtree("pods.cpu"); skipped {
+				return err
+			}
+			return s.cpuStats(&pod.CPU)
+		case "memory":
+			if skipped, err := s.skipSubtree("pods.memory"); skipped {
+				return err
+			}
+			return s.memoryStats(&pod.Memory)
+		case "network":
+			if skipped, err := s.skipSubtree("pods.network"); skipped {
+				return err
+			}
+			return s.jsonValue(&pod.Network)
+		case "volume":
+			if skipped, err := s.skipSubtree("pods.volume"); skipped {
+				return err
+			}
+			return s.jsonValue(&pod.VolumeStats)
+		case "ephemeral-storage":
+			if skipped, err := s.skipSubtree("pods.ephemeral-storage"); skipped {
+				return err
+			}
+			return s.fsStats(&pod.EphemeralStorage)
+		case "swap":
+			if s.podSwap != nil {
+				return s.jsonValue(&s.podSwap.Pod)
+			}
+		}
+		return s.skipUnknown(key, podStatsType)
+	})
+}
+
+func (s *summaryScanner) podReference(ref *stats.PodReference) error {
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "name":
+			return s.string(&ref.Name)
+		case "namespace":
+			return s.string(&ref.Namespace)
+		case "uid":
+			return s.string(&ref.UID)
+		}
+		return s.skipUnknown(key, podReferenceType)
+	})
+}
+
+func (s *summaryScanner) containers(target *[]stats.ContainerStats, subtrees *containerSubtrees) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	containers := (*target)[:0]
+	err := s.array(func() error {
+		if len(containers) < cap(containers) {
+			containers = containers[:len(containers)+1]
+		} else {
+			containers = append(containers, stats.ContainerStats{})
+		}
+		return s.containerStats(&containers[len(containers)-1], subtrees)
+	})
+	if containers == nil {
+		containers = []stats.ContainerStats{}
+	}
+	*target = containers
+	return err
+}
+
+func (s *summaryScanner) containerStats(container *stats.ContainerStats, subtrees *containerSubtrees) error {
+	// likewise, the container name may come after its swap usage
+	var swap *SwapStats
+	err := s.object(func(key []byte) error {
+		switch string(key) {
+		case "name":
+			return s.string(&container.Name)
+		case "cpu":
+			if skipped, err := s.skipSubtree(subtrees.cpu); skipped {
+				return err
+			}
+			return s.cpuStats(&container.CPU)
+		case "memory":
+			if skipped, err := s.skipSubtree(subtrees.memory); skipped {
+				return err
+			}
+			return s.memoryStats(&container.Memory)
+		case "startTime":
+			if skipped, err := s.skipSubtree(subtrees.startTime); skipped {
+				return err
+			}
+			return s.time(&container.StartTime)
+		case "rootfs":
+			if skipped, err := s.skipSubtree(subtrees.rootfs); skipped {
+				return err
+			}
+			return s.fsStats(&container.Rootfs)
+		case "logs":
+			if skipped, err := s.skipSubtree(subtrees.logs); skipped {
+				return err
+			}
+			return s.fsStats(&container.Logs)
+		case "accelerators":
+			if skipped, err := s.skipSubtree(subtrees.accelerators); skipped {
+				return err
+			}
+			return s.jsonValue(&container.Accelerators)
+		case "userDefinedMetrics":
+			if skipped, err := s.skipSubtree(subtrees.userDefinedMetrics); skipped {
+				return err
+			}
+			return s.jsonValue(&container.UserDefinedMetrics)
+		case "swap":
+			// system containers are never decoded within a pod, so their swap usage is skipped
+			if s.podSwap != nil {
+				return s.jsonValue(&swap)
+			}
+		}
+		return s.skipUnknown(key, containerStatsType)
+	})
+	if err == nil && swap != nil {
+		s.podSwap.addContainer(container.Name, swap)
+	}
+	return err
+}
+
+func (s *summaryScanner) cpuStats(target **stats.CPUStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	if *target == nil {
+		*target = &stats.CPUStats{}
+	}
+	cpu := *target
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "time":
+			return s.time(&cpu.Time)
+		case "usageNanoCores":
+			return s.uint64(&cpu.UsageNanoCores)
+		case "usageCoreNanoSeconds":
+			return s.uint64(&cpu.UsageCoreNanoSeconds)
+		}
+		return s.skipUnknown(key, cpuStatsType)
+	})
+}
+
+func (s *summaryScanner) memoryStats(target **stats.MemoryStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	if *target == nil {
+		*target = &stats.MemoryStats{}
+	}
+	memory := *target
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "time":
+			return s.time(&memory.Time)
+		case "availableBytes":
+			return s.uint64(&memory.AvailableBytes)
+		case "usageBytes":
+			return s.uint64(&memory.UsageBytes)
+		case "workingSetBytes":
+			return s.uint64(&memory.WorkingSetBytes)
+		case "rssBytes":
+			return s.uint64(&memory.RSSBytes)
+		case "pageFaults":
+			return s.uint64(&memory.PageFaults)
+		case "majorPageFaults":
+			return s.uint64(&memory.MajorPageFaults)
+		}
+		return s.skipUnknown(key, memoryStatsType)
+	})
+}
+
+func (s *summaryScanner) rlimitStats(target **stats.RlimitStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	if *target == nil {
+		*target = &stats.RlimitStats{}
+	}
+	rlimit := *target
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "time":
+			return s.time(&rlimit.Time)
+		case "maxpid":
+			return s.int64(&rlimit.MaxPID)
+		case "curproc":
+			return s.int64(&rlimit.NumOfRunningProcesses)
+		}
+		return s.skipUnknown(key, rlimitStatsType)
+	})
+}
+
+func (s *summaryScanner) runtimeStats(target **stats.RuntimeStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	if *target == nil {
+		*target = &stats.RuntimeStats{}
+	}
+	runtime := *target
+	return s.object(func(key []byte) error {
+		if string(key) == "imageFs" {
+			return s.fsStats(&runtime.ImageFs)
+		}
+		return s.skipUnknown(key, runtimeStatsType)
+	})
+}
+
+func (s *summaryScanner) fsStats(target **stats.FsStats) error {
+	if s.null() {
+		*target = nil
+		return nil
+	}
+	if *target == nil {
+		*target = &stats.FsStats{}
+	}
+	fs := *target
+	return s.object(func(key []byte) error {
+		switch string(key) {
+		case "time":
+			return s.time(&fs.Time)
+		case "availableBytes":
+			return s.uint64(&fs.AvailableBytes)
+		case "capacityBytes":
+			return s.uint64(&fs.CapacityBytes)
+		case "usedBytes":
+			return s.uint64(&fs.UsedBytes)
+		case "inodesFree":
+			return s.uint64(&fs.InodesFree)
+		case "inodes":
+			return s.uint64(&fs.Inodes)
+		case "inodesUsed":
+			return s.uint64(&fs.InodesUsed)
+		}
+		return s.skipUnknown(key, fsStatsType)
+	})
+}
@@ -0,0 +1,296 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// hotFields returns just the fields of the given summary that the fast decoder decodes.
+func hotFields(full *stats.Summary) *stats.Summary {
+	res := &stats.Summary{Node: stats.NodeStats{
+		NodeName: full.Node.NodeName,
+		CPU:      full.Node.CPU,
+		Memory:   full.Node.Memory,
+		Rlimit:   full.Node.Rlimit,
+	}}
+	if full.Node.Runtime != nil {
+		res.Node.Runtime = &stats.RuntimeStats{ImageFs: full.Node.Runtime.ImageFs}
+	}
+	if full.Pods == nil {
+		return res
+	}
+	res.Pods = make([]stats.PodStats, len(full.Pods))
+	for i, pod := range full.Pods {
+		res.Pods[i].PodRef = pod.PodRef
+		if pod.Containers == nil {
+			continue
+		}
+		res.Pods[i].Containers = make([]stats.ContainerStats, len(pod.Containers))
+		for j, container := range pod.Containers {
+			res.Pods[i].Containers[j] = stats.ContainerStats{Name: container.Name, CPU: container.CPU, Memory: container.Memory}
+		}
+	}
+	return res
+}
+
+// withoutEmptySlices sets any empty slices of stats in the given summary to nil.
+// The elements of reused summaries decoded from nulls keep empty slices from earlier
+// summaries, so whether they're nil or empty depends on which summaries were reused.
+func withoutEmptySlices(summary *stats.Summary) *stats.Summary {
+	if len(summary.Pods) == 0 {
+		summary.Pods = nil
+	}
+	if len(summary.Node.SystemContainers) == 0 {
+		summary.Node.SystemContainers = nil
+	}
+	containersWithoutEmptySlices(summary.Node.SystemContainers)
+	for i := range summary.Pods {
+		if len(summary.Pods[i].Containers) == 0 {
+			summary.Pods[i].Containers = nil
+		}
+		if len(summary.Pods[i].VolumeStats) == 0 {
+			summary.Pods[i].VolumeStats = nil
+		}
+		containersWithoutEmptySlices(summary.Pods[i].Containers)
+	}
+	return summary
+}
+
+func containersWithoutEmptySlices(containers []stats.ContainerStats) {
+	for i := range containers {
+		if len(containers[i].Accelerators) == 0 {
+			containers[i].Accelerators = nil
+		}
+		if len(containers[i].UserDefinedMetrics) == 0 {
+			containers[i].UserDefinedMetrics = nil
+		}
+	}
+}
+
+// summaryCorpus returns the summary fixtures, along with a large generated summary, by name.
+func summaryCorpus() map[string][]byte {
+	paths, err := filepath.Glob("testdata/summaries/*.json")
+	Expect(err).NotTo(HaveOccurred())
+	Expect(paths).NotTo(BeEmpty())
+	corpus := map[string][]byte{"generated": []byte(largeSummaryBody(50))}
+	for _, path := range paths {
+		body, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		corpus[filepath.Base(path)] = body
+	}
+	return corpus
+}
+
+var _ = Describe("Summary Decoders", func() {
+	It("should decode the same as the full decoder, except for the skipped subtrees, for every summary in the corpus", func() {
+		skipAll, err := NewSubtreeSkips(SkippableSubtrees(), false)
+		Expect(err).NotTo(HaveOccurred())
+		for name, body := range summaryCorpus() {
+			full := &stats.Summary{}
+			Expect(SummaryDecoderFull.Decode(body, full)).To(Succeed(), name)
+
+			unskipped := &stats.Summary{}
+			Expect(SummaryDecoderFast.DecodeSkipping(body, unskipped, nil)).To(Succeed(), name)
+			Expect(unskipped).To(Equal(full), name)
+
+			onlyHot := &stats.Summary{}
+			Expect(SummaryDecoderFast.DecodeSkipping(body, onlyHot, skipAll)).To(Succeed(), name)
+			Expect(onlyHot).To(Equal(hotFields(full)), name)
+
+			fast := &stats.Summary{}
+			Expect(SummaryDecoderFast.Decode(body, fast)).To(Succeed(), name)
+			Expect(fast).To(Equal(hotFields(full)), name)
+		}
+	})
+
+	It("should decode the same as the full decoder into reused summaries", func() {
+		corpus := summaryCorpus()
+		kubelet := &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK}
+		server := httptest.NewServer(kubelet)
+		defer server.Close()
+		fullClient, host := directClientDecoding(server, SummaryDecoderFull)
+		fastClient, _ := directClientDecoding(server, SummaryDecoderFast)
+
+		// go through the corpus twice, so that every summary is decoded into one used for others
+		for i := 0; i < 2; i++ {
+			for name, body := range corpus {
+				kubelet.body = string(body)
+				full, _, err := fullClient.GetSummary(context.Background(), host)
+				Expect(err).NotTo(HaveOccurred(), name)
+				fast, _, err := fastClient.GetSummary(context.Background(), host)
+				Expect(err).NotTo(HaveOccurred(), name)
+				Expect(withoutEmptySlices(fast)).To(Equal(withoutEmptySlices(hotFields(full))), name)
+				fullClient.(interface{ ReleaseSummary(*stats.Summary) }).ReleaseSummary(full)
+				fastClient.(interface{ ReleaseSummary(*stats.Summary) }).ReleaseSummary(fast)
+			}
+		}
+	})
+
+	It("should reject malformed summaries that the full decoder rejects", func() {
+		for _, body := range []string{
+			``,
+			`{"node": {"nodeName": "node1"}`,
+			`{"node": {"nodeName": "node1"}} {}`,
+			`{"node": {"nodeName": "node1", "cpu": {"usageNanoCores": "100"}}}`,
+			`{"node": {"nodeName": "node1", "cpu": {"usageNanoCores": 1.5}}}`,
+			`{"node": {"nodeName": "node1", "cpu": {"usageNanoCores": -1}}}`,
+			`{"node": {"nodeName": "node1", "cpu": {"usageNanoCores": 18446744073709551616}}}`,
+			`{"node": {"nodeName": "node1", "cpu": {"usageNanoCores": 01}}}`,
+			`{"node": {"nodeName": "node1", "rlimit": {"maxpid": 9223372036854775808}}}`,
+			`{"node": {"nodeName": "node1", "cpu": {"time": "yesterday"}}}`,
+			`{"node": {"nodeName": 1}}`,
+			`{"node": {"nodeName": "node1", "fs": {"time": "unterminated}}}`,
+			`{"pods": {"podRef": {"name": "pod1"}}}`,
+			`{"pods": [{"podRef": {"name": "pod1"}},]}`,
+			"{\"node\": {\"nodeName\": \"node\n1\"}}",
+		} {
+			Expect(json.Unmarshal([]byte(body), &stats.Summary{})).NotTo(Succeed(), body)
+			Expect(SummaryDecoderFast.Decode([]byte(body), &stats.Summary{})).NotTo(Succeed(), body)
+		}
+	})
+})
+
+// skippedBytesFor fetches the number of bytes skipped in the given subtree from the default registry.
+func skippedBytesFor(subtree string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_skipped_bytes_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "subtree" && label.GetValue() == subtree {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Summary Subtree Skipping", func() {
+	var body []byte
+
+	BeforeEach(func() {
+		var err error
+		body, err = ioutil.ReadFile(filepath.Join("testdata", "summaries", "kubelet.json"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should extract the same metrics however many subtrees are skipped", func() {
+		kubelet := &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: string(body)}
+		server := httptest.NewServer(kubelet)
+		defer server.Close()
+
+		// start times are only read when retained, so everything else is skipped
+		defaults, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		skipAll, err := NewSubtreeSkips(SkippableSubtrees(), false)
+		Expect(err).NotTo(HaveOccurred())
+		skipNone, err := NewSubtreeSkips(nil, false)
+		Expect(err).NotTo(HaveOccurred())
+		var batches []*sources.MetricsBatch
+		for _, skips := range []*SubtreeSkips{defaults.Retaining(StartTimeSubtrees), skipAll.Retaining(StartTimeSubtrees), skipNone} {
+			client, host := directClientWith(server, KubeletClientConfig{SkippedSubtrees: skips})
+			src := NewSummaryMetricsSource(NodeInfo{Name: "gke-cluster-default-pool-0a1b2c3d-xk2p", ConnectAddress: host}, client, SourceOptions{})
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Pods).NotTo(BeEmpty())
+			batches = append(batches, batch)
+		}
+		Expect(batches[1]).To(Equal(batches[0]))
+		Expect(batches[2]).To(Equal(batches[0]))
+	})
+
+	It("should count the bytes skipped in each subtree", func() {
+		volumeBefore, networkBefore := skippedBytesFor("pods.volume"), skippedBytesFor("node.network")
+		Expect(SummaryDecoderFast.Decode(body, &stats.Summary{})).To(Succeed())
+		Expect(skippedBytesFor("pods.volume")).To(BeNumerically(">", volumeBefore+100))
+		Expect(skippedBytesFor("node.network")).To(BeNumerically(">", networkBefore+100))
+	})
+
+	It("should retain the ephemeral storage subtrees when asked to, even if they're listed", func() {
+		paths := append([]string{"pods.ephemeral-storage", "pods.containers.rootfs", "pods.containers.logs"}, DefaultSkippedSubtrees...)
+		skipping, err := NewSubtreeSkips(paths, false)
+		Expect(err).NotTo(HaveOccurred())
+		retaining, err := NewSubtreeSkips(paths, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(retaining.Skips("pods.network")).To(BeTrue())
+
+		full, skipped, retained := &stats.Summary{}, &stats.Summary{}, &stats.Summary{}
+		Expect(SummaryDecoderFull.Decode(body, full)).To(Succeed())
+		Expect(SummaryDecoderFast.DecodeSkipping(body, skipped, skipping)).To(Succeed())
+		Expect(SummaryDecoderFast.DecodeSkipping(body, retained, retaining)).To(Succeed())
+
+		pod := full.Pods[0]
+		Expect(pod.EphemeralStorage).NotTo(BeNil())
+		Expect(pod.VolumeStats).NotTo(BeEmpty())
+		Expect(skipped.Pods[0].EphemeralStorage).To(BeNil())
+		Expect(skipped.Pods[0].VolumeStats).To(BeNil())
+		Expect(skipped.Pods[0].Containers[0].Rootfs).To(BeNil())
+		Expect(retained.Pods[0].EphemeralStorage).To(Equal(pod.EphemeralStorage))
+		Expect(retained.Pods[0].VolumeStats).To(Equal(pod.VolumeStats))
+		Expect(retained.Pods[0].Containers[0].Rootfs).To(Equal(pod.Containers[0].Rootfs))
+		Expect(retained.Pods[0].Containers[0].Logs).To(Equal(pod.Containers[0].Logs))
+		Expect(retained.Pods[0].Network).To(BeNil())
+	})
+
+	It("should refuse to skip unknown subtrees, or those holding the fields read", func() {
+		for _, path := range []string{"pods.containers.cpu", "node.memory", "pods", "pods.volumes"} {
+			_, err := NewSubtreeSkips([]string{path}, false)
+			Expect(err).To(HaveOccurred(), path)
+		}
+	})
+})
+
+func benchmarkDecode(b *testing.B, decoder SummaryDecoder) {
+	body := []byte(largeSummaryBody(500))
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		summary := &stats.Summary{}
+		if err := decoder.Decode(body, summary); err != nil {
+			b.Fatal(err)
+		}
+		if len(summary.Pods) != 500 {
+			b.Fatalf("expected 500 pods, got %d", len(summary.Pods))
+		}
+	}
+}
+
+func BenchmarkDecodeSummary500PodsFull(b *testing.B) {
+	benchmarkDecode(b, SummaryDecoderFull)
+}
+
+func BenchmarkDecodeSummary500PodsFast(b *testing.B) {
+	benchmarkDecode(b, SummaryDecoderFast)
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// maxErrorBodyBytes is the maximum length of the response body snippet included in errors.
+const maxErrorBodyBytes = 256
+
+// maxContentTypeErrorBodyBytes is the maximum length of the response body snippet included in
+// ErrUnexpectedContentType, which is shorter, since the body is normally a whole HTML page.
+const maxContentTypeErrorBodyBytes = 200
+
+// The classes of scrape errors, as used in logs and metrics.
+const (
+	ErrorClassUnauthorized = "unauthorized"
+	ErrorClassForbidden    = "forbidden"
+	ErrorClassNotFound     = "not_found"
+	ErrorClassDial         = "dial"
+	ErrorClassNodeMismatch = "node_mismatch"
+	ErrorClassNodeReplaced = "node_replaced"
+	ErrorClassTLSPolicy    = "tls_policy"
+	ErrorClassSANPolicy    = "tls_san_policy"
+	ErrorClassProxy        = "proxy"
+	ErrorClassCircuitOpen  = "circuit_open"
+	ErrorClassContentType  = "unexpected_content_type"
+	ErrorClassRedirect     = "redirect"
+	ErrorClassOther        = "other"
+)
+
+// remediations contains the one-line remediation hint for each class of error with a known fix.
+// Hints live here, rather than at the call sites, so that they stay consistent.
+var remediations = map[string]string{
+	ErrorClassUnauthorized: "the Kubelet did not accept metrics-server's credentials; check that the Kubelet trusts the CA of metrics-server's client certificate, or has webhook token authentication enabled (--authentication-token-webhook)",
+	ErrorClassForbidden:    "metrics-server authenticated, but is not allowed to read Kubelet stats; bind its service account to the system:kubelet-api-admin ClusterRole (or another role granting get on nodes/stats)",
+	ErrorClassTLSPolicy:    "the Kubelet's serving TLS configuration is weaker than --kubelet-tls-min-version and --kubelet-tls-cipher-suites allow; raise the Kubelet's --tls-min-version or --tls-cipher-suites, or relax metrics-server's policy",
+	ErrorClassSANPolicy:    "the Kubelet's serving certificate was issued by a trusted CA, but lacks the SANs --kubelet-tls-san-policy requires; reissue it with an IP SAN for the node's address or a DNS SAN for the node's name (e.g. with the Kubelet's serverTLSBootstrap, or your provisioning tool's certificate settings), or relax the policy",
+	ErrorClassProxy:        "the API server could not reach the Kubelet to proxy the request, so the Kubelet itself may be healthy; check connectivity from the API server to the node's Kubelet port, and that the API server trusts the Kubelet's serving certificate",
+	ErrorClassCircuitOpen:  "too many recent requests through the API server proxy failed, so requests are failing fast (serving the last-known metrics) to let the API server recover; check the API server's health and load",
+	ErrorClassContentType:  "the response did not come from a Kubelet, but from something in front of it, such as a load balancer or proxy serving an error page; check what's listening at the Kubelet's address and port, and how requests to it are routed",
+	ErrorClassRedirect:     "the request was redirected to another host or scheme, or too many times, which a Kubelet never does, so something in front of it (such as a proxy or load balancer) is answering; check what's listening at the Kubelet's address and port, since it shouldn't be trusted with metrics-server's credentials",
+	ErrorClassNodeReplaced: "the nodes were deleted and re-created at different addresses during the cycle, and will be scraped normally next cycle; if this persists, check for rapid node churn or reuse of node names",
+}
+
+// ErrUnauthorized indicates that the Kubelet rejected the request's credentials (HTTP 401).
+type ErrUnauthorized struct {
+	endpoint string
+	body     string
+	trigger  scrapeTrigger
+}
+
+func (err *ErrUnauthorized) Error() string {
+	return fmt.Sprintf("request to %q was unauthorized (%s), response: %q", err.endpoint, err.trigger, err.body)
+}
+
+func (err *ErrUnauthorized) ErrorClass() string { return ErrorClassUnauthorized }
+func (err *ErrUnauthorized) Remediation() string {
+	return remediations[ErrorClassUnauthorized]
+}
+
+// IsUnauthorizedError checks if the given error (or any error it wraps) is an ErrUnauthorized.
+func IsUnauthorizedError(err error) bool {
+	var unauthorizedErr *ErrUnauthorized
+	return errors.As(err, &unauthorizedErr)
+}
+
+// ErrForbidden indicates that the Kubelet authenticated the request, but did not authorize it (HTTP 403).
+type ErrForbidden struct {
+	endpoint string
+	body     string
+	trigger  scrapeTrigger
+}
+
+func (err *ErrForbidden) Error() string {
+	return fmt.Sprintf("request to %q was forbidden (%s), response: %q", err.endpoint, err.trigger, err.body)
+}
+
+func (err *ErrForbidden) ErrorClass() string { return ErrorClassForbidden }
+func (err *ErrForbidden) Remediation() string {
+	return remediations[ErrorClassForbidden]
+}
+
+// IsForbiddenError checks if the given error (or any error it wraps) is an ErrForbidden.
+func IsForbiddenError(err error) bool {
+	var forbiddenErr *ErrForbidden
+	return errors.As(err, &forbiddenErr)
+}
+
+// ErrUnexpectedContentType indicates that a successful response was of a content type that
+// can't be decoded (e.g. an HTML error page from a load balancer in front of the Kubelet).
+type ErrUnexpectedContentType struct {
+	endpoint    string
+	contentType string
+	body        string
+	trigger     scrapeTrigger
+}
+
+func (err *ErrUnexpectedContentType) Error() string {
+	return fmt.Sprintf("request to %q returned unexpected content type %q (%s), response: %q", err.endpoint, err.contentType, err.trigger, err.body)
+}
+
+// ContentType returns the content type of the response, which is empty if it had none.
+func (err *ErrUnexpectedContentType) ContentType() string { return err.contentType }
+
+func (err *ErrUnexpectedContentType) ErrorClass() string { return ErrorClassContentType }
+func (err *ErrUnexpectedContentType) Remediation() string {
+	return remediations[ErrorClassContentType]
+}
+
+// IsUnexpectedContentTypeError checks if the given error (or any error it wraps) is an ErrUnexpectedContentType.
+func IsUnexpectedContentTypeError(err error) bool {
+	var contentTypeErr *ErrUnexpectedContentType
+	return errors.As(err, &contentTypeErr)
+}
+
+// errorBodySnippet truncates a response body for inclusion in an error.
+func errorBodySnippet(body []byte) string {
+	return truncatedBody(body, maxErrorBodyBytes)
+}
+
+// truncatedBody truncates a response body to the given length.
+func truncatedBody(body []byte, max int) string {
+	if len(body) > max {
+		return string(body[:max]) + "..."
+	}
+	return string(body)
+}
+
+// ErrorClass classifies the given scrape error, for use in logs and metrics.
+func ErrorClass(err error) string {
+	var classified sources.ClassifiedError
+	switch {
+	case errors.As(err, &classified):
+		return classified.ErrorClass()
+	case IsNotFoundError(err):
+		return ErrorClassNotFound
+	case IsDialError(err):
+		return ErrorClassDial
+	case IsNodeMismatchError(err):
+		return ErrorClassNodeMismatch
+	default:
+		return ErrorClassOther
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/events"
+)
+
+const (
+	// EventReasonScrapeFailing is the reason of the warning event recorded on a node
+	// once its scrapes have failed for the threshold number of consecutive cycles.
+	EventReasonScrapeFailing = "MetricsScrapeFailing"
+	// EventReasonScrapeRecovered is the reason of the event recorded on a node
+	// once it's scraped successfully again after EventReasonScrapeFailing.
+	EventReasonScrapeRecovered = "MetricsScrapeRecovered"
+)
+
+// DefaultScrapeFailureEventThreshold is the default number of consecutive failed
+// scrapes after which a node's scrapes are reported as failing.
+const DefaultScrapeFailureEventThreshold = 3
+
+// ScrapeFailureEvents records events on nodes whose scrapes have failed for a number of
+// consecutive cycles, and again once they recover.  Only those transitions are recorded,
+// and the recorder aggregates repeats, so flapping nodes don't spam their events.
+type ScrapeFailureEvents struct {
+	recorder  events.Recorder
+	threshold int
+
+	mu sync.Mutex
+	// failures is the number of consecutive failed scrapes of each node failing at the moment.
+	failures map[string]int
+}
+
+// NewScrapeFailureEvents returns a tracker recording events with the given recorder,
+// once a node's scrapes have failed for the given number of consecutive cycles.
+func NewScrapeFailureEvents(recorder events.Recorder, threshold int) *ScrapeFailureEvents {
+	return &ScrapeFailureEvents{recorder: recorder, threshold: threshold, failures: make(map[string]int)}
+}
+
+// observe records the outcome of a scrape of the given node.
+func (e *ScrapeFailureEvents) observe(node NodeInfo, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ref := &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: node.Name, UID: node.UID}
+	failures := e.failures[node.Name]
+	if err == nil {
+		delete(e.failures, node.Name)
+		if failures >= e.threshold {
+			glog.Infof("node %q is being scraped successfully again, after %d consecutive failures", node.Name, failures)
+			e.recorder.Eventf(ref, corev1.EventTypeNormal, EventReasonScrapeRecovered, "metrics-server is scraping the node's Kubelet successfully again, after %d consecutive failed scrapes", failures)
+		}
+		return
+	}
+
+	failures++
+	e.failures[node.Name] = failures
+	if failures == e.threshold {
+		class := ErrorClass(err)
+		glog.Warningf("node %q has failed to be scraped for %d consecutive cycles (%s): %v", node.Name, failures, class, err)
+		e.recorder.Eventf(ref, corev1.EventTypeWarning, EventReasonScrapeFailing, "metrics-server has failed to scrape the node's Kubelet for %d consecutive cycles (%s): %v", failures, class, err)
+	}
+}
+
+// prune forgets the failures of any node not in the given set.
+func (e *ScrapeFailureEvents) prune(keep map[string]struct{}) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for node := range e.failures {
+		if _, ok := keep[node]; !ok {
+			delete(e.failures, node)
+		}
+	}
+}
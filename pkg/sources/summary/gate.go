@@ -0,0 +1,265 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Requests to each Kubelet pass through a per-node gate, which lets at most the configured number
+// of them onto the wire at once, whichever entry point they came from (collection cycles, or
+// on-demand debug scrapes), since some Kubelets handle concurrent requests poorly.
+// Requests over the limit queue for a free slot until their context is done, or, when coalescing,
+// summary requests wait for an identical request already in flight and decode its response
+// instead, which is just as fresh.  Hedged requests (see hedge.go) bypass the gate, since they
+// only help by racing the request they hedge, which holds the node's slot (and has the same URL)
+// until one of them wins; they're capped per cycle instead.
+
+// DefaultMaxConcurrentRequestsPerNode is the default limit on requests to each Kubelet at once.
+const DefaultMaxConcurrentRequestsPerNode = 1
+
+// Outcomes of waiting at the gate.
+const (
+	gateAcquired  = "acquired"
+	gateCoalesced = "coalesced"
+	gateCanceled  = "canceled"
+)
+
+var gateWaitDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "gate_wait_duration_seconds",
+		Help:      "How long requests to Kubelets waited at their node's concurrency gate, by whether they acquired a slot, were coalesced onto a request in flight, or were canceled first",
+		Buckets:   []float64{0, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(gateWaitDuration)
+}
+
+// kubeletResponse is what a request read from a Kubelet, shared with any requests coalesced onto it.
+type kubeletResponse struct {
+	statusCode int
+	status     string
+	header     http.Header
+	body       []byte
+	// scheme is the scheme the response came over, which may differ from the
+	// request's while migrating off plain HTTP (see migration.go).
+	scheme string
+	// err is the error making the request or reading its body, if any.
+	err error
+}
+
+// flight is a request in flight, whose response is shared when it's done.
+type flight struct {
+	done chan struct{}
+	res  kubeletResponse
+	// canceled is set if the request's own context was done before it completed.
+	canceled bool
+}
+
+// nodeGate holds the slots and requests in flight for a single node.
+type nodeGate struct {
+	slots   chan struct{}
+	flights map[string]*flight
+	// users counts the requests holding or waiting on the gate, so that idle gates can be dropped.
+	users int
+}
+
+// requestGate limits the requests in flight to each node.  A nil gate doesn't limit anything.
+type requestGate struct {
+	limit    int
+	coalesce bool
+
+	mu    sync.Mutex
+	nodes map[string]*nodeGate
+}
+
+// newRequestGate returns the gate set in the given config, or nil if requests are unlimited.
+func newRequestGate(config *KubeletClientConfig) *requestGate {
+	if config.MaxConcurrentRequestsPerNode <= 0 {
+		return nil
+	}
+	return &requestGate{
+		limit:    config.MaxConcurrentRequestsPerNode,
+		coalesce: config.CoalesceRequests,
+		nodes:    make(map[string]*nodeGate),
+	}
+}
+
+// join returns the given node's gate, counting the caller as a user until it calls leave.
+func (g *requestGate) join(node string) *nodeGate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gate, ok := g.nodes[node]
+	if !ok {
+		gate = &nodeGate{slots: make(chan struct{}, g.limit), flights: make(map[string]*flight)}
+		g.nodes[node] = gate
+	}
+	gate.users++
+	return gate
+}
+
+// leave stops counting the caller as a user of the given node's gate, dropping it once it's idle.
+func (g *requestGate) leave(node string, gate *nodeGate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gate.users--
+	if gate.users == 0 {
+		delete(g.nodes, node)
+	}
+}
+
+// wait waits for a free slot in the given node gate until the context is done.
+func (g *requestGate) wait(ctx context.Context, gate *nodeGate) error {
+	select {
+	case gate.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case gate.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return gateCanceledError(ctx)
+	}
+}
+
+type hedgeKey struct{}
+
+// withHedge marks the context as that of a hedged request, which bypasses the gate.
+func withHedge(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hedgeKey{}, true)
+}
+
+// isHedge checks if the context is that of a hedged request.
+func isHedge(ctx context.Context) bool {
+	hedge, _ := ctx.Value(hedgeKey{}).(bool)
+	return hedge
+}
+
+// gateCanceledError explains that a request was canceled while waiting at the gate.
+func gateCanceledError(ctx context.Context) error {
+	if cause, ok := context.Cause(ctx).(*sources.ErrCanceled); ok {
+		return cause
+	}
+	return ctx.Err()
+}
+
+// gateKeyFor returns the key of the gate for the given request: the name of the node
+// being scraped, or the host requested, if that's unknown.
+func gateKeyFor(req *http.Request) string {
+	if node := nodeNameFrom(req.Context()); node != "" {
+		return node
+	}
+	return req.URL.Host
+}
+
+// acquire waits for a free slot for a request to the given node until the context is done,
+// returning a func releasing it.
+func (g *requestGate) acquire(ctx context.Context, node string) (func(), error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	gate := g.join(node)
+	if err := g.wait(ctx, gate); err != nil {
+		g.leave(node, gate)
+		gateWaitDuration.WithLabelValues(gateCanceled).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+	gateWaitDuration.WithLabelValues(gateAcquired).Observe(time.Since(start).Seconds())
+	return func() {
+		<-gate.slots
+		g.leave(node, gate)
+	}, nil
+}
+
+// do makes a request to the given URL on the given node with the given func once the node has a
+// free slot, or, when coalescing, shares the response of an identical request already in flight,
+// reporting whether it did.  It fails if the context is done first.
+func (g *requestGate) do(ctx context.Context, node, url string, fetch func() kubeletResponse) (kubeletResponse, bool, error) {
+	if g == nil || isHedge(ctx) {
+		return fetch(), false, nil
+	}
+	if !g.coalesce {
+		release, err := g.acquire(ctx, node)
+		if err != nil {
+			return kubeletResponse{}, false, err
+		}
+		defer release()
+		return fetch(), false, nil
+	}
+
+	start := time.Now()
+	gate := g.join(node)
+	defer g.leave(node, gate)
+	for {
+		g.mu.Lock()
+		inflight, ok := gate.flights[url]
+		if !ok {
+			inflight = &flight{done: make(chan struct{})}
+			gate.flights[url] = inflight
+		}
+		g.mu.Unlock()
+		if !ok {
+			return g.lead(ctx, gate, url, inflight, start, fetch)
+		}
+
+		select {
+		case <-inflight.done:
+		case <-ctx.Done():
+			gateWaitDuration.WithLabelValues(gateCanceled).Observe(time.Since(start).Seconds())
+			return kubeletResponse{}, false, gateCanceledError(ctx)
+		}
+		// a request canceled by its own context says nothing about the Kubelet,
+		// so another takes its place, unless this one is done too
+		if inflight.canceled && ctx.Err() == nil {
+			continue
+		}
+		gateWaitDuration.WithLabelValues(gateCoalesced).Observe(time.Since(start).Seconds())
+		return inflight.res, true, nil
+	}
+}
+
+// lead makes the request in the given flight, once there's a free slot, sharing its
+// response with any requests coalesced onto it.
+func (g *requestGate) lead(ctx context.Context, gate *nodeGate, url string, inflight *flight, start time.Time, fetch func() kubeletResponse) (kubeletResponse, bool, error) {
+	err := g.wait(ctx, gate)
+	if err != nil {
+		gateWaitDuration.WithLabelValues(gateCanceled).Observe(time.Since(start).Seconds())
+		inflight.res = kubeletResponse{err: err}
+	} else {
+		gateWaitDuration.WithLabelValues(gateAcquired).Observe(time.Since(start).Seconds())
+		inflight.res = fetch()
+		<-gate.slots
+	}
+	inflight.canceled = ctx.Err() != nil
+	g.mu.Lock()
+	delete(gate.flights, url)
+	g.mu.Unlock()
+	close(inflight.done)
+	return inflight.res, false, err
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// maxHeaderValueBytes is the maximum length of a single captured header value.
+	maxHeaderValueBytes = 256
+	// maxCapturedHeaderBytes is the maximum total length of the captured headers from a single response.
+	maxCapturedHeaderBytes = 2048
+	// headerLogInterval is the minimum interval between logging changed headers for a single node.
+	headerLogInterval = 1 * time.Minute
+)
+
+// headerCapture extracts the Warning header, plus an allowlist of custom
+// headers, from Kubelet responses, logging them when they change.
+type headerCapture struct {
+	names []string
+
+	mu     sync.Mutex
+	logged map[string]loggedHeaders
+}
+
+type loggedHeaders struct {
+	headers map[string][]string
+	at      time.Time
+}
+
+func newHeaderCapture(extraNames []string) *headerCapture {
+	names := []string{"Warning"}
+	for _, name := range extraNames {
+		name = http.CanonicalHeaderKey(name)
+		if name != "Warning" {
+			names = append(names, name)
+		}
+	}
+	return &headerCapture{
+		names:  names,
+		logged: make(map[string]loggedHeaders),
+	}
+}
+
+// extract returns the captured headers from the given response headers, or nil if none are present.
+// Values are truncated, and values beyond the overall size limit are dropped.
+func (c *headerCapture) extract(header http.Header) map[string][]string {
+	var res map[string][]string
+	size := 0
+	for _, name := range c.names {
+		for _, val := range header[name] {
+			if len(val) > maxHeaderValueBytes {
+				val = val[:maxHeaderValueBytes]
+			}
+			if size+len(name)+len(val) > maxCapturedHeaderBytes {
+				return res
+			}
+			size += len(name) + len(val)
+			if res == nil {
+				res = make(map[string][]string)
+			}
+			res[name] = append(res[name], val)
+		}
+	}
+	return res
+}
+
+// logChanges logs the captured headers for the given node if they differ from the
+// last ones logged, at most once per headerLogInterval.
+func (c *headerCapture) logChanges(node string, headers map[string][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, seen := c.logged[node]
+	if reflect.DeepEqual(last.headers, headers) || (seen && time.Since(last.at) < headerLogInterval) {
+		return
+	}
+	c.logged[node] = loggedHeaders{headers: headers, at: time.Now()}
+	if len(headers) == 0 {
+		glog.Infof("Kubelet on node %q no longer reports any headers of interest", node)
+		return
+	}
+	glog.Warningf("Kubelet on node %q reported headers of interest: %v", node, headers)
+}
+
+// prune forgets the headers last logged for any node not in the given set.
+func (c *headerCapture) prune(keep map[string]struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for node := range c.logged {
+		if _, ok := keep[node]; !ok {
+			delete(c.logged, node)
+		}
+	}
+}
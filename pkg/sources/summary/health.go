@@ -0,0 +1,144 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// The summary's node stats include more than metrics-server serves, some of which can explain
+// why a node's metrics look wrong (e.g. a node out of PIDs or image filesystem space).  When
+// enabled, a few of these are published as per-node gauges, from each node's last summary.
+// They're off by default, since they add several series per node.
+
+var (
+	nodeMaxPIDs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_rlimit_max_pids",
+			Help:      "The maximum PID on the node, as of its last summary",
+		},
+		[]string{"node"},
+	)
+	nodeRunningProcesses = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_rlimit_running_processes",
+			Help:      "The number of processes running on the node, as of its last summary",
+		},
+		[]string{"node"},
+	)
+	nodeImageFsAvailableBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_runtime_imagefs_available_bytes",
+			Help:      "The space available on the filesystem holding the node's container images, as of its last summary",
+		},
+		[]string{"node"},
+	)
+	nodeImageFsCapacityBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_runtime_imagefs_capacity_bytes",
+			Help:      "The capacity of the filesystem holding the node's container images, as of its last summary",
+		},
+		[]string{"node"},
+	)
+
+	nodeHealthGauges = []*prometheus.GaugeVec{nodeMaxPIDs, nodeRunningProcesses, nodeImageFsAvailableBytes, nodeImageFsCapacityBytes}
+)
+
+func init() {
+	for _, gauge := range nodeHealthGauges {
+		prometheus.MustRegister(gauge)
+	}
+}
+
+// healthTracker publishes the health signals of each node, remembering
+// which nodes it has published them for, so that they can be pruned.
+type healthTracker struct {
+	mu    sync.Mutex
+	nodes map[string]struct{}
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{nodes: make(map[string]struct{})}
+}
+
+// record publishes the health signals present in the given node stats, removing any
+// previously published signals now missing, so that they don't go stale.
+func (t *healthTracker) record(node string, nodeStats *stats.NodeStats) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[node] = struct{}{}
+
+	var maxPIDs, runningProcs *int64
+	if nodeStats.Rlimit != nil {
+		maxPIDs, runningProcs = nodeStats.Rlimit.MaxPID, nodeStats.Rlimit.NumOfRunningProcesses
+	}
+	var imageFsAvailable, imageFsCapacity *uint64
+	if nodeStats.Runtime != nil && nodeStats.Runtime.ImageFs != nil {
+		imageFsAvailable, imageFsCapacity = nodeStats.Runtime.ImageFs.AvailableBytes, nodeStats.Runtime.ImageFs.CapacityBytes
+	}
+
+	setOrDeleteInt(nodeMaxPIDs, node, maxPIDs)
+	setOrDeleteInt(nodeRunningProcesses, node, runningProcs)
+	setOrDeleteUint(nodeImageFsAvailableBytes, node, imageFsAvailable)
+	setOrDeleteUint(nodeImageFsCapacityBytes, node, imageFsCapacity)
+}
+
+// prune removes the health signals of any node not in the given set.
+func (t *healthTracker) prune(keep map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node := range t.nodes {
+		if _, ok := keep[node]; ok {
+			continue
+		}
+		for _, gauge := range nodeHealthGauges {
+			gauge.DeleteLabelValues(node)
+		}
+		delete(t.nodes, node)
+	}
+}
+
+func setOrDeleteInt(gauge *prometheus.GaugeVec, node string, val *int64) {
+	if val == nil {
+		gauge.DeleteLabelValues(node)
+		return
+	}
+	gauge.WithLabelValues(node).Set(float64(*val))
+}
+
+func setOrDeleteUint(gauge *prometheus.GaugeVec, node string, val *uint64) {
+	if val == nil {
+		gauge.DeleteLabelValues(node)
+		return
+	}
+	gauge.WithLabelValues(node).Set(float64(*val))
+}
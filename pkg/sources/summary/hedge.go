@@ -0,0 +1,165 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Some Kubelets occasionally take several seconds to answer (e.g. during GC pauses) where
+// an identical request made at the same time is answered immediately.  When hedging is
+// enabled, a summary request that hasn't completed within the hedge delay is raced by a
+// second, identical, request, and whichever succeeds first is used, canceling the other.
+// The number of hedged requests is capped per collection cycle, so that a cluster-wide
+// slowdown doesn't double the load on the Kubelets, so hedged requests bypass the per-node
+// request gate, and hedging is only ever used when connecting directly, since every proxied
+// request also loads the API server.
+
+// DefaultMaxHedgesPerCycle is the default cap on hedged requests per collection cycle.
+const DefaultMaxHedgesPerCycle = 10
+
+var (
+	hedgesIssued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "hedged_requests_total",
+			Help:      "Total number of hedged Summary API requests issued for Kubelets slower than the hedge delay",
+		},
+	)
+	hedgesWon = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "hedged_requests_won_total",
+			Help:      "Total number of hedged Summary API requests which succeeded before the original request",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(hedgesIssued)
+	prometheus.MustRegister(hedgesWon)
+}
+
+// hedgePolicy decides when to hedge summary requests, tracking
+// the number of hedged requests issued in the current cycle.
+type hedgePolicy struct {
+	delay     time.Duration
+	maxHedges int
+
+	mu      sync.Mutex
+	cycleID string
+	issued  int
+}
+
+// newHedgePolicy returns the hedging policy set in the given config,
+// or nil if hedging is disabled.
+func newHedgePolicy(config *KubeletClientConfig) *hedgePolicy {
+	if config.HedgeDelay <= 0 || config.MaxHedgesPerCycle <= 0 || config.UseAPIServerProxy {
+		return nil
+	}
+	return &hedgePolicy{delay: config.HedgeDelay, maxHedges: config.MaxHedgesPerCycle}
+}
+
+// acquire checks if another request may be hedged in the given cycle, counting it if so.
+// Requests outside of collection cycles have no budget to count against, so aren't hedged.
+func (p *hedgePolicy) acquire(cycleID string) bool {
+	if cycleID == "" {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cycleID != p.cycleID {
+		p.cycleID, p.issued = cycleID, 0
+	}
+	if p.issued >= p.maxHedges {
+		return false
+	}
+	p.issued++
+	return true
+}
+
+// attemptResult is the outcome of a single summary request.
+type attemptResult struct {
+	summary *stats.Summary
+	swap    *SwapSummary
+	prov    Provenance
+	err     error
+	hedge   bool
+}
+
+// getSummaryHedged makes the given summary request, hedging it as the policy allows.
+// The returned provenance is that of the request whose result was used, counting
+// the attempts made by both.
+func (kc *kubeletClient) getSummaryHedged(ctx context.Context, client *http.Client, req *http.Request, prov *Provenance, withSwap bool) (*stats.Summary, *SwapSummary, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	// cancels the loser, once the winner is chosen
+	defer cancel(&sources.ErrCanceled{Reason: sources.CancelReasonHedgeLost, Detail: "another request for the same summary answered first"})
+
+	base := *prov
+	results := make(chan attemptResult, 2)
+	attempt := func(hedge bool) {
+		res := attemptResult{prov: base, hedge: hedge}
+		attemptCtx := ctx
+		if hedge {
+			attemptCtx = withHedge(ctx)
+		}
+		res.summary, res.swap, res.err = kc.getSummary(client, req.Clone(attemptCtx), &res.prov, withSwap)
+		results <- res
+	}
+	go attempt(false)
+
+	timer := time.NewTimer(kc.hedge.delay)
+	defer timer.Stop()
+
+	outstanding, started := 1, 1
+	var res attemptResult
+	for {
+		select {
+		case <-timer.C:
+			if !kc.hedge.acquire(sources.CycleIDFrom(ctx)) {
+				continue
+			}
+			hedgesIssued.Inc()
+			outstanding++
+			started++
+			go attempt(true)
+			continue
+		case res = <-results:
+		}
+
+		outstanding--
+		// use the first success, or the last failure
+		if res.err == nil || outstanding == 0 {
+			break
+		}
+	}
+
+	if res.hedge && res.err == nil {
+		hedgesWon.Inc()
+	}
+	*prov = res.prov
+	prov.Attempts = base.Attempts + started
+	return res.summary, res.swap, res.err
+}
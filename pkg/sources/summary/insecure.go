@@ -0,0 +1,97 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// InsecureTLSNodes selects the nodes whose Kubelets' serving certificates aren't verified,
+// by name or by label, for Kubelets whose certificates can't be fixed (e.g. on appliances),
+// without giving up verification for every other node.
+type InsecureTLSNodes struct {
+	names    sets.String
+	selector labels.Selector
+	nodes    v1listers.NodeLister
+}
+
+// NewInsecureTLSNodes selects the nodes with the given names, and those with labels matching
+// the given selector (if any), looked up with the given lister.
+func NewInsecureTLSNodes(names []string, selector labels.Selector, nodes v1listers.NodeLister) *InsecureTLSNodes {
+	return &InsecureTLSNodes{names: sets.NewString(names...), selector: selector, nodes: nodes}
+}
+
+// Matches checks if the given node's Kubelet certificate goes unverified.
+func (n *InsecureTLSNodes) Matches(nodeName string) bool {
+	if n == nil || nodeName == "" {
+		return false
+	}
+	if n.names.Has(nodeName) {
+		return true
+	}
+	if n.selector == nil || n.nodes == nil {
+		return false
+	}
+	node, err := n.nodes.Get(nodeName)
+	if err != nil {
+		return false
+	}
+	return n.selector.Matches(labels.Set(node.Labels))
+}
+
+// List returns the names of the nodes currently selected, sorted, including named
+// nodes which don't (yet) exist.
+func (n *InsecureTLSNodes) List() []string {
+	selected := sets.NewString(n.names.UnsortedList()...)
+	if n.selector != nil && n.nodes != nil {
+		nodes, err := n.nodes.List(n.selector)
+		if err != nil {
+			glog.Errorf("unable to list the nodes whose Kubelet certificates aren't verified: %v", err)
+		}
+		for _, node := range nodes {
+			selected.Insert(node.Name)
+		}
+	}
+	return selected.List()
+}
+
+// Warn logs a prominent warning listing the nodes currently selected.
+func (n *InsecureTLSNodes) Warn() {
+	selector := ""
+	if n.selector != nil {
+		selector = ", and any nodes labeled " + n.selector.String()
+	}
+	glog.Warningf("INSECURE: the serving certificates of the Kubelets on these nodes will NOT be verified, leaving their connections open to interception: %s%s", strings.Join(n.List(), ", "), selector)
+}
+
+// insecureKubeletConfig returns a copy of the given config which skips verifying Kubelet
+// serving certificates, while still presenting the same client credentials.
+func insecureKubeletConfig(config *KubeletClientConfig) *KubeletClientConfig {
+	insecure := *config
+	insecure.RESTConfig = rest.CopyConfig(config.RESTConfig)
+	insecure.RESTConfig.TLSClientConfig.Insecure = true
+	insecure.RESTConfig.TLSClientConfig.CAData = nil
+	insecure.RESTConfig.TLSClientConfig.CAFile = ""
+	// SVIDs are still presented, just not required of the Kubelet
+	insecure.SPIFFETrustDomain = ""
+	insecure.SANPolicy = SANPolicyNone
+	return &insecure
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// On nodes with heavy cgroup churn, the Kubelet's stats for some pods can be tens of
+// seconds older than its stats for the node.  Each pod's window is measured to its own
+// sample time (see sources.PodMetricsPoint.SampleTime), never the node's, but a lagging
+// sample still means the pod's usage is older than it looks, so we track the lag.
+
+// DefaultPodTimestampLagThreshold is the default lag behind the node's timestamp
+// beyond which pods are called out in the logs.
+const DefaultPodTimestampLagThreshold = 20 * time.Second
+
+// maxLaggingPodsLogged caps the number of pods listed in each log line.
+const maxLaggingPodsLogged = 10
+
+var podTimestampLag = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "pod_timestamp_lag_seconds",
+		Help:      "How far the sample time of each pod in a summary lags the node's timestamp (negative if it's ahead)",
+		Buckets:   []float64{0, 1, 2, 5, 10, 15, 20, 30, 45, 60, 120},
+	},
+)
+
+func init() {
+	prometheus.MustRegister(podTimestampLag)
+}
+
+// recordPodLags observes how far each pod's sample time lags the given node timestamp,
+// logging the pods lagging more than the threshold (if any).  It returns a note for
+// the scrape status if any pods did.
+func (src *summaryMetricsSource) recordPodLags(nodeTime time.Time, pods []sources.PodMetricsPoint) string {
+	if nodeTime.IsZero() {
+		return ""
+	}
+	threshold := src.opts.PodTimestampLagThreshold
+	var lagging []string
+	var numLagging int
+	for i := range pods {
+		sampleTime := pods[i].SampleTime()
+		if sampleTime.IsZero() {
+			continue
+		}
+		lag := nodeTime.Sub(sampleTime)
+		podTimestampLag.Observe(lag.Seconds())
+		if threshold <= 0 || lag <= threshold {
+			continue
+		}
+		numLagging++
+		if len(lagging) < maxLaggingPodsLogged {
+			lagging = append(lagging, fmt.Sprintf("%s/%s (%s)", pods[i].Namespace, pods[i].Name, lag.Round(time.Millisecond)))
+		}
+	}
+	if numLagging == 0 {
+		return ""
+	}
+	if more := numLagging - len(lagging); more > 0 {
+		lagging = append(lagging, fmt.Sprintf("and %d more", more))
+	}
+	glog.Warningf("node %q: %d pods' samples lag the node's timestamp by more than %s: %s", src.node.Name, numLagging, threshold, strings.Join(lagging, ", "))
+	return fmt.Sprintf("%d pods' samples lag the node's timestamp by more than %s", numLagging, threshold)
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Migrating off --deprecated-kubelet-completely-insecure, each request to a Kubelet is made
+// over HTTPS first, and only retried over plain HTTP (without any credentials) when the HTTPS
+// attempt fails in a TLS-specific way (e.g. the Kubelet answered in plain HTTP, or its certificate
+// couldn't be verified), rather than, say, being refused, since then plain HTTP would fail too.
+// HTTPS is tried again on every request, so that nodes are noticed as soon as they're migrated.
+//
+// The scheme which worked for each node is recorded, and the nodes still requiring plain HTTP
+// are counted in metrics_server_kubelet_nodes_requiring_http.  Once a whole collection cycle
+// passes without falling back to plain HTTP for any node, the flag is no longer needed.
+
+var nodesRequiringHTTP = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet",
+		Name:      "nodes_requiring_http",
+		Help:      "The number of nodes whose Kubelets were last reached over plain HTTP, after failing over HTTPS, while migrating off --deprecated-kubelet-completely-insecure",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(nodesRequiringHTTP)
+}
+
+// schemeMigration records which scheme worked for each node while migrating off plain HTTP.
+type schemeMigration struct {
+	mu      sync.Mutex
+	schemes map[string]string
+
+	// cycleID is the collection cycle being tracked, with the nodes requested in it,
+	// and the number of requests falling back to plain HTTP.
+	cycleID   string
+	seen      sets.String
+	fallbacks int
+	// announced is set once a cycle has passed without falling back,
+	// until a later request falls back again.
+	announced bool
+}
+
+func newSchemeMigration() *schemeMigration {
+	return &schemeMigration{schemes: make(map[string]string), seen: sets.NewString()}
+}
+
+// record records that a request to the given node in the given cycle (if any) fell back to
+// plain HTTP or not, and which scheme worked, if any did.
+func (m *schemeMigration) record(node, cycleID string, fellBack bool, scheme string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cycleID != "" && cycleID != m.cycleID {
+		m.endCycle()
+		m.cycleID, m.seen, m.fallbacks = cycleID, sets.NewString(), 0
+	}
+	if cycleID != "" {
+		m.seen.Insert(node)
+		if fellBack {
+			m.fallbacks++
+		}
+	}
+	if fellBack {
+		m.announced = false
+	}
+	if scheme != "" {
+		m.schemes[node] = scheme
+	}
+	m.updateGauge()
+}
+
+// endCycle forgets the nodes not requested in the cycle just finished (e.g. those deleted),
+// announcing if no requests in it fell back to plain HTTP.
+func (m *schemeMigration) endCycle() {
+	if m.cycleID == "" {
+		return
+	}
+	for node := range m.schemes {
+		if !m.seen.Has(node) {
+			delete(m.schemes, node)
+		}
+	}
+	if m.fallbacks == 0 && m.seen.Len() > 0 && !m.announced {
+		glog.Warningf("MIGRATION COMPLETE: every Kubelet was reached over HTTPS in collection cycle %s, without falling back to plain HTTP, so --deprecated-kubelet-completely-insecure (and --kubelet-insecure-migration) can now be removed", m.cycleID)
+		m.announced = true
+	}
+}
+
+// updateGauge publishes the number of nodes last reached over plain HTTP.
+func (m *schemeMigration) updateGauge() {
+	requiringHTTP := 0
+	for _, scheme := range m.schemes {
+		if scheme == "http" {
+			requiringHTTP++
+		}
+	}
+	nodesRequiringHTTP.Set(float64(requiringHTTP))
+}
+
+// migratingTransport makes requests over HTTPS with one transport, retrying them over plain
+// HTTP with another if they fail in a TLS-specific way.
+type migratingTransport struct {
+	secure    http.RoundTripper
+	plaintext http.RoundTripper
+	migration *schemeMigration
+}
+
+func (t *migratingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	node := nodeNameFrom(req.Context())
+	if node == "" {
+		node = req.URL.Host
+	}
+	cycleID := sources.CycleIDFrom(req.Context())
+	if req.URL.Scheme != "https" {
+		return t.plaintext.RoundTrip(req)
+	}
+
+	response, err := t.secure.RoundTrip(req)
+	if err == nil {
+		t.migration.record(node, cycleID, false, "https")
+		return response, nil
+	}
+	if !isTLSFailure(err) || req.Context().Err() != nil {
+		t.migration.record(node, cycleID, false, "")
+		return nil, err
+	}
+
+	loglevel.V(loglevel.Client, 2).Infof("falling back to plain HTTP for %s after failing over HTTPS: %v", node, err)
+	plainReq := req.Clone(req.Context())
+	plainReq.URL.Scheme = "http"
+	response, err = t.plaintext.RoundTrip(plainReq)
+	scheme := ""
+	if err == nil {
+		scheme = "http"
+	}
+	t.migration.record(node, cycleID, true, scheme)
+	return response, err
+}
+
+// isTLSFailure checks if the given error from an HTTPS request means that the Kubelet couldn't
+// be reached over TLS, rather than at all: a failed handshake, an unverified certificate, or a
+// Kubelet answering in plain HTTP.
+func isTLSFailure(err error) bool {
+	if IsSANPolicyError(err) {
+		// the Kubelet serves TLS, just not with the SANs required, so falling back would be a downgrade
+		return false
+	}
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "server gave HTTP response to HTTPS client") || strings.Contains(msg, "tls:")
+}
+
+// plaintextKubeletConfig returns a copy of the given config for plain HTTP requests to the
+// Kubelets, using no encryption or credentials, just as --deprecated-kubelet-completely-insecure does.
+func plaintextKubeletConfig(config *KubeletClientConfig) *KubeletClientConfig {
+	plaintext := *config
+	plaintext.RESTConfig = rest.AnonymousClientConfig(config.RESTConfig)
+	plaintext.RESTConfig.TLSClientConfig = rest.TLSClientConfig{}
+	plaintext.DeprecatedCompletelyInsecure = true
+	plaintext.SPIFFE = nil
+	plaintext.SPIFFETrustDomain = ""
+	plaintext.TLSMinVersion = 0
+	plaintext.TLSCipherSuites = nil
+	plaintext.SANPolicy = SANPolicyNone
+	return &plaintext
+}
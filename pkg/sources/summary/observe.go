@@ -0,0 +1,83 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+const (
+	// EndpointSummary identifies requests for a Kubelet's summary.
+	EndpointSummary = "summary"
+	// EndpointCadvisor identifies requests for a Kubelet's cAdvisor metrics.
+	EndpointCadvisor = "cadvisor"
+)
+
+// RequestObserver is notified of every request made by the Kubelet client (including
+// hedged requests, and those through the API server proxy), e.g. to audit them.
+type RequestObserver interface {
+	// ObserveRequest records a completed (or failed) request.  It's called
+	// synchronously by the scrape making the request, so it must not block.
+	ObserveRequest(info RequestInfo)
+}
+
+// RequestInfo describes a single request made by the Kubelet client.
+type RequestInfo struct {
+	// Start is when the request was made, and Duration how long it took,
+	// including reading and decoding the response.
+	Start    time.Time
+	Duration time.Duration
+	// Node is the node the request was for, or the host requested if that's unknown.
+	Node string
+	URL  string
+	// Endpoint is the Kubelet endpoint requested (EndpointSummary or EndpointCadvisor).
+	Endpoint string
+	// Reason and CycleID identify the operation that triggered the request.
+	Reason  sources.ScrapeReason
+	CycleID string
+	// StatusCode is the status of the response, or zero if none was received.
+	StatusCode int
+	// Bytes is the size of the response body read.
+	Bytes int64
+	// Err is the error the request failed with, if it did.
+	Err error
+}
+
+// observe notifies the client's observer, if any, of the given request.
+func (kc *kubeletClient) observe(req *http.Request, endpoint string, start time.Time, statusCode int, bytes int64, err error) {
+	if kc.observer == nil {
+		return
+	}
+	node := nodeNameFrom(req.Context())
+	if node == "" {
+		node = req.URL.Host
+	}
+	trigger := scrapeTriggerFrom(req.Context())
+	kc.observer.ObserveRequest(RequestInfo{
+		Start:      start,
+		Duration:   time.Since(start),
+		Node:       node,
+		URL:        req.URL.String(),
+		Endpoint:   endpoint,
+		Reason:     trigger.reason,
+		CycleID:    trigger.cycleID,
+		StatusCode: statusCode,
+		Bytes:      bytes,
+		Err:        err,
+	})
+}
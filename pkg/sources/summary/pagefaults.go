@@ -0,0 +1,126 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"sync"
+	"time"
+
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// The Kubelet only reports cumulative page fault counts, so rates are calculated
+// from the counts in successive summaries, as described in translate/rates.go.
+
+type containerKey struct {
+	namespace, pod, container string
+}
+
+type faultSample struct {
+	timestamp   time.Time
+	pageFaults  uint64
+	majorFaults uint64
+	// rates are the rates calculated from the sample, if any, which are carried
+	// forward if the next sample is the same (see stalesummary.go).
+	rates *sources.PageFaultRates
+}
+
+// faultSamples holds the page fault counts sampled from a single summary, by container.
+type faultSamples map[containerKey]faultSample
+
+// faultTracker holds the last page fault counts sampled from each node.
+type faultTracker struct {
+	mu      sync.Mutex
+	samples map[string]faultSamples
+}
+
+func newFaultTracker() *faultTracker {
+	return &faultTracker{samples: make(map[string]faultSamples)}
+}
+
+// get fetches the last samples for the given node, or nil if none are known.
+func (t *faultTracker) get(node string) faultSamples {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.samples[node]
+}
+
+// set replaces the samples for the given node, dropping those of any containers that went away.
+func (t *faultTracker) set(node string, samples faultSamples) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[node] = samples
+}
+
+// prune removes the samples of any node not in the given set.
+func (t *faultTracker) prune(keep map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node := range t.samples {
+		if _, ok := keep[node]; !ok {
+			delete(t.samples, node)
+		}
+	}
+}
+
+// decodePageFaults records the page fault counts of the given container in next, returning
+// the rates since the sample for it in prev, if there was one (and the counters weren't reset),
+// unless the samples are further apart than the given maximum gap (if non-zero).  The same
+// sample again (from a stale summary) carries forward the rates calculated from the last.
+func decodePageFaults(key containerKey, memStats *stats.MemoryStats, prev, next faultSamples, maxGap time.Duration) *sources.PageFaultRates {
+	if memStats == nil || memStats.PageFaults == nil || memStats.MajorPageFaults == nil || memStats.Time.IsZero() {
+		return nil
+	}
+	cur := faultSample{
+		timestamp:   memStats.Time.Time,
+		pageFaults:  *memStats.PageFaults,
+		majorFaults: *memStats.MajorPageFaults,
+	}
+	next[key] = cur
+
+	last, ok := prev[key]
+	if !ok {
+		return nil
+	}
+	if last.rates != nil && cur.timestamp.Equal(last.timestamp) && cur.pageFaults == last.pageFaults && cur.majorFaults == last.majorFaults {
+		next[key] = last
+		rates := *last.rates
+		return &rates
+	}
+	reset := cur.pageFaults < last.pageFaults || cur.majorFaults < last.majorFaults
+	window, ok := translate.RateWindow(last.timestamp, cur.timestamp, reset, maxGap)
+	if !ok {
+		return nil
+	}
+	cur.rates = &sources.PageFaultRates{
+		PageFaults:      translate.MilliRate(float64(cur.pageFaults-last.pageFaults), window),
+		MajorPageFaults: translate.MilliRate(float64(cur.majorFaults-last.majorFaults), window),
+		Window:          window,
+	}
+	next[key] = cur
+	return cur.rates
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// On some container runtimes, the containers of hostNetwork pods (such as kube-proxy) share
+// cgroups with other processes on the node, so the usage reported for those containers includes
+// the other processes too.  The pod-level usage, from the pod's own cgroup, doesn't.  When the
+// pod usage check is enabled, a pod whose containers' CPU or memory usage adds up to more than
+// its pod-level usage, beyond the configured tolerance, has its containers' usage of that
+// resource scaled down to add up to the pod-level usage.  Pod aggregates then match the
+// pod-level usage.  Each correction is counted, and the pod is marked with the resources
+// corrected (see PodMetricsPoint.CorrectedResources).
+
+// The pod-level memory usage also covers what isn't charged to any container: the pod sandbox
+// (e.g. the pause container), and tmpfs volumes (such as memory-backed emptyDirs).  When enabled,
+// that residual is calculated for each pod as its pod-level working set less the sum of all of its
+// containers' (served or not), and passed on as the pod's memory overhead.  It's calculated from
+// the usage as reported, before any correction.  Pods whose containers add up to more than the pod
+// (an inconsistency in the Kubelet's reporting) have no overhead, and are counted.
+
+// PodUsageSubtrees are the subtrees holding the pod-level usage of pods,
+// which must be retained to check their containers' usage against,
+// or to calculate their memory overhead from.
+var PodUsageSubtrees = []string{
+	"pods.cpu",
+	"pods.memory",
+}
+
+var podUsageCorrections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "pod_usage_corrections_total",
+		Help:      "Total number of pods whose containers' usage of a resource added up to more than the pod-level usage reported, beyond the configured tolerance, and so was scaled down to it",
+	},
+	[]string{"node", "resource"},
+)
+
+var negativeMemoryOverheads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "pod_memory_overhead_negative_total",
+		Help:      "Total number of pods whose containers' working sets added up to more than the pod-level working set reported, so were served with no memory overhead",
+	},
+	[]string{"node"},
+)
+
+func init() {
+	prometheus.MustRegister(podUsageCorrections)
+	prometheus.MustRegister(negativeMemoryOverheads)
+}
+
+// correctPodUsage checks the CPU and memory usage of the containers of the given pod against
+// its pod-level usage in the given stats, correcting the resources whose container usage adds
+// up to more than the pod-level usage by more than the given fraction.
+func correctPodUsage(node string, podStats *stats.PodStats, target *sources.PodMetricsPoint, tolerance float64) {
+	if podStats.CPU != nil && podStats.CPU.UsageNanoCores != nil {
+		cpuOf := func(c *sources.ContainerMetricsPoint) *resource.Quantity { return &c.CpuUsage }
+		if scaleUsage(target.Containers, *podStats.CPU.UsageNanoCores, resource.Nano, tolerance, cpuOf) {
+			recordPodUsageCorrection(node, target, corev1.ResourceCPU)
+		}
+	}
+	if podStats.Memory != nil && podStats.Memory.WorkingSetBytes != nil {
+		memoryOf := func(c *sources.ContainerMetricsPoint) *resource.Quantity { return &c.MemoryUsage }
+		if scaleUsage(target.Containers, *podStats.Memory.WorkingSetBytes, 0, tolerance, memoryOf) {
+			recordPodUsageCorrection(node, target, corev1.ResourceMemory)
+		}
+	}
+}
+
+func recordPodUsageCorrection(node string, target *sources.PodMetricsPoint, name corev1.ResourceName) {
+	podUsageCorrections.WithLabelValues(node, string(name)).Inc()
+	loglevel.V(loglevel.Scraper, 2).Infof("the containers of pod %s/%s on node %q reported more %s usage than the pod, so were scaled down to the pod's usage", target.Namespace, target.Name, node, name)
+	target.CorrectedResources = append(target.CorrectedResources, string(name))
+}
+
+// scaleUsage scales the given containers' usage (in units of the given scale) down to add
+// up to the given pod usage, if it adds up to more than that by more than the given fraction,
+// returning whether it did.  Pods reporting no usage at all are left alone, since it's their
+// usage that's suspect then.
+func scaleUsage(containers []sources.ContainerMetricsPoint, podUsage uint64, scale resource.Scale, tolerance float64, usageOf func(*sources.ContainerMetricsPoint) *resource.Quantity) bool {
+	if podUsage == 0 {
+		return false
+	}
+	var sum float64
+	for i := range containers {
+		sum += float64(usageOf(&containers[i]).ScaledValue(scale))
+	}
+	if sum <= float64(podUsage)*(1+tolerance) {
+		return false
+	}
+	for i := range containers {
+		usage := usageOf(&containers[i])
+		format := usage.Format
+		*usage = *resource.NewScaledQuantity(int64(math.Round(float64(usage.ScaledValue(scale))*float64(podUsage)/sum)), scale)
+		usage.Format = format
+	}
+	return true
+}
+
+// podMemoryOverhead returns how far the pod-level working set in the given stats exceeds
+// the sum of the working sets of all of its containers, or nil if it wasn't reported.
+func podMemoryOverhead(node string, podStats *stats.PodStats) *resource.Quantity {
+	if podStats.Memory == nil || podStats.Memory.WorkingSetBytes == nil {
+		return nil
+	}
+	var sum uint64
+	for _, container := range podStats.Containers {
+		if container.Memory != nil && container.Memory.WorkingSetBytes != nil {
+			sum += *container.Memory.WorkingSetBytes
+		}
+	}
+	podUsage := *podStats.Memory.WorkingSetBytes
+	if sum > podUsage {
+		negativeMemoryOverheads.WithLabelValues(node).Inc()
+		loglevel.V(loglevel.Scraper, 2).Infof("the containers of pod %s/%s on node %q reported %d bytes more memory usage than the pod, so it has no memory overhead", podStats.PodRef.Namespace, podStats.PodRef.Name, node, sum-podUsage)
+		return resource.NewQuantity(0, resource.BinarySI)
+	}
+	return translate.Uint64Bytes("pod memory overhead", podUsage-sum)
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Pod Usage Check", func() {
+	var (
+		server *httptest.Server
+		client KubeletInterface
+		host   string
+	)
+
+	BeforeEach(func() {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "summaries", "hostnetwork-node.json"))
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewServer(&fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: string(body)})
+
+		skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		client, host = directClientWith(server, KubeletClientConfig{SkippedSubtrees: skips.Retaining(PodUsageSubtrees)})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// usage is the usage collected for a container, in millicores and bytes
+	type usage struct {
+		cpu, memory int64
+	}
+
+	// collect collects the fixture with the given tolerance, returning the usage of each container,
+	// by pod/container, and the resources corrected for each pod, by name.
+	collect := func(tolerance float64) (map[string]usage, map[string][]string) {
+		src := NewSummaryMetricsSource(NodeInfo{Name: "hostnet-node1", ConnectAddress: host}, client, SourceOptions{PodUsageTolerance: tolerance})
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		usages := make(map[string]usage)
+		corrected := make(map[string][]string)
+		for _, pod := range batch.Pods {
+			corrected[pod.Name] = pod.CorrectedResources
+			for _, container := range pod.Containers {
+				usages[pod.Name+"/"+container.Name] = usage{container.CpuUsage.MilliValue(), container.MemoryUsage.Value()}
+			}
+		}
+		return usages, corrected
+	}
+
+	It("should scale down the usage of containers adding up to more than their pod's", func() {
+		usages, corrected := collect(0.1)
+		Expect(usages).To(Equal(map[string]usage{
+			"kube-proxy-x7k2p/kube-proxy":         {50, 41943040},
+			"web-6f5d8c7b9-2xq7k/nginx":           {100, 52428800},
+			"web-6f5d8c7b9-2xq7k/sidecar":         {50, 20971520},
+			"node-exporter-9wz4d/node-exporter":   {20, 16777216},
+			"node-exporter-9wz4d/kube-rbac-proxy": {5, 16777216},
+		}))
+		Expect(corrected).To(Equal(map[string][]string{
+			"kube-proxy-x7k2p":    {"cpu", "memory"},
+			"web-6f5d8c7b9-2xq7k": nil,
+			"node-exporter-9wz4d": {"memory"},
+		}))
+	})
+
+	It("should leave consistent pods alone within the tolerance, and everything alone when disabled", func() {
+		strict, corrected := collect(0.001)
+		Expect(corrected["web-6f5d8c7b9-2xq7k"]).To(Equal([]string{"cpu"}))
+		Expect(strict["web-6f5d8c7b9-2xq7k/nginx"].cpu + strict["web-6f5d8c7b9-2xq7k/sidecar"].cpu).To(BeNumerically("~", 148, 1))
+
+		usages, corrected := collect(0)
+		Expect(corrected).To(Equal(map[string][]string{
+			"kube-proxy-x7k2p":    nil,
+			"web-6f5d8c7b9-2xq7k": nil,
+			"node-exporter-9wz4d": nil,
+		}))
+		Expect(usages["kube-proxy-x7k2p/kube-proxy"]).To(Equal(usage{2000, 3221225472}))
+	})
+
+	It("should keep the format of the usage it corrects", func() {
+		src := NewSummaryMetricsSource(NodeInfo{Name: "hostnet-node1", ConnectAddress: host}, client, SourceOptions{PodUsageTolerance: 0.1})
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		var kubeProxy *sources.ContainerMetricsPoint
+		for _, pod := range batch.Pods {
+			if pod.Name == "kube-proxy-x7k2p" {
+				kubeProxy = &pod.Containers[0]
+			}
+		}
+		Expect(kubeProxy).NotTo(BeNil())
+		Expect(kubeProxy.MemoryUsage.String()).To(Equal("40Mi"))
+	})
+})
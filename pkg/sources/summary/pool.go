@@ -0,0 +1,205 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// A summary has thousands of nested slices and pointers, which all become garbage once
+// it's translated.  Summaries are therefore decoded into pooled targets, which retain
+// them: encoding/json decodes into the existing elements of slices (up to their capacity)
+// and the existing targets of pointers, rather than allocating new ones.
+//
+// Decoding into a used summary would leave anything missing from the new response as it
+// was in the old one, so before reuse, a summary is reset: every value is zeroed, except
+// that slices keep their capacity, and pointers keep their targets, which are reset in
+// turn, with integers set to a marker value.  After decoding, any pointer whose target
+// still only holds reset values (i.e. which wasn't in the response) is set back to nil.
+// An object present in the response, but with no fields set, therefore decodes as if it
+// were missing, as does an integer with the marker value, neither of which is meaningful
+// to metrics-server.
+//
+// Nothing may point into a summary once it's released.  Build with the summarypoison
+// tag to overwrite released summaries with poison values instead of reusing them, so
+// that tests catch anything which does.
+
+const (
+	unsetUint64 = math.MaxUint64
+	unsetInt64  = math.MinInt64
+
+	poisonString = "<released summary>"
+	poisonUint64 = 0xbadbadbadbad
+	poisonInt64  = -0xbadbadbadbad
+)
+
+var (
+	statsPkgPath = reflect.TypeOf(stats.Summary{}).PkgPath()
+	timeType     = reflect.TypeOf(metav1.Time{})
+	poisonTime   = reflect.ValueOf(metav1.NewTime(time.Unix(0xbadbad, 0)))
+)
+
+var summaryPool = sync.Pool{
+	New: func() interface{} { return &stats.Summary{} },
+}
+
+// summaryReleaser is implemented by KubeletInterfaces whose summaries can be
+// released for reuse, once the caller is done with them.
+type summaryReleaser interface {
+	ReleaseSummary(summary *stats.Summary)
+}
+
+// getPooledSummary returns a summary to decode into, reusing a released one if possible.
+func getPooledSummary() *stats.Summary {
+	return summaryPool.Get().(*stats.Summary)
+}
+
+// releaseSummary returns the given summary to the pool.  Neither it, nor
+// anything it contains, may be used afterwards.
+func releaseSummary(summary *stats.Summary) {
+	if poisonReleasedSummaries {
+		poisonValue(reflect.ValueOf(summary).Elem())
+		return
+	}
+	resetValue(reflect.ValueOf(summary).Elem())
+	summaryPool.Put(summary)
+}
+
+// pruneSummary clears out everything in a summary decoded into a pooled target that
+// wasn't in the response.
+func pruneSummary(summary *stats.Summary) {
+	pruneValue(reflect.ValueOf(summary).Elem())
+}
+
+func isStatsStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.PkgPath() == statsPkgPath
+}
+
+// resetValue resets the given value for reuse as a decode target, keeping the capacity
+// of slices and the targets of pointers to integers and to stats types.
+func resetValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		switch elem := v.Elem(); {
+		case elem.Kind() == reflect.Uint64:
+			elem.SetUint(unsetUint64)
+		case elem.Kind() == reflect.Int64:
+			elem.SetInt(unsetInt64)
+		case isStatsStruct(elem.Type()):
+			resetValue(elem)
+		default:
+			v.Set(reflect.Zero(v.Type()))
+		}
+	case reflect.Slice:
+		// extending the slice in place, since slicing it allocates a new header
+		v.SetLen(v.Cap())
+		for i := 0; i < v.Len(); i++ {
+			resetValue(v.Index(i))
+		}
+		v.SetLen(0)
+	case reflect.Struct:
+		if !isStatsStruct(v.Type()) {
+			v.Set(reflect.Zero(v.Type()))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			resetValue(v.Field(i))
+		}
+	default:
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
+
+// pruneValue sets any pointers within the given value whose targets weren't decoded into
+// back to nil, returning whether the value itself still only holds reset values.
+func pruneValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return true
+		}
+		var unset bool
+		switch elem := v.Elem(); {
+		case elem.Kind() == reflect.Uint64:
+			unset = elem.Uint() == unsetUint64
+		case elem.Kind() == reflect.Int64:
+			unset = elem.Int() == unsetInt64
+		case isStatsStruct(elem.Type()):
+			unset = pruneValue(elem)
+		}
+		if unset {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return unset
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			pruneValue(v.Index(i))
+		}
+		return v.Len() == 0
+	case reflect.Struct:
+		if !isStatsStruct(v.Type()) {
+			return v.IsZero()
+		}
+		unset := true
+		for i := 0; i < v.NumField(); i++ {
+			// prune every field, even once we know the struct was decoded into
+			if !pruneValue(v.Field(i)) {
+				unset = false
+			}
+		}
+		return unset
+	default:
+		return v.IsZero()
+	}
+}
+
+// poisonValue overwrites everything reachable from the given value with poison values,
+// so that anything still pointing into a released summary reads obviously wrong data.
+func poisonValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			poisonValue(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			poisonValue(v.Index(i))
+		}
+	case reflect.Struct:
+		switch {
+		case v.Type() == timeType:
+			v.Set(poisonTime)
+		case isStatsStruct(v.Type()):
+			for i := 0; i < v.NumField(); i++ {
+				poisonValue(v.Field(i))
+			}
+		}
+	case reflect.String:
+		v.SetString(poisonString)
+	case reflect.Uint64:
+		v.SetUint(poisonUint64)
+	case reflect.Int64:
+		v.SetInt(poisonInt64)
+	}
+}
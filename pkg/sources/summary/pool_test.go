@@ -0,0 +1,258 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// summaryBody encodes the given summary as a Kubelet would serve it.
+func summaryBody(summary *stats.Summary) string {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		panic(err)
+	}
+	return string(body)
+}
+
+// directClient returns a Kubelet client connecting directly to the given test server,
+// returning the host to scrape.
+func directClient(server *httptest.Server) (KubeletInterface, string) {
+	return directClientDecoding(server, "")
+}
+
+// directClientDecoding is like directClient, but decodes summaries with the given decoder.
+func directClientDecoding(server *httptest.Server, decoder SummaryDecoder) (KubeletInterface, string) {
+	return directClientWith(server, KubeletClientConfig{SummaryDecoder: decoder})
+}
+
+// directClientWith is like directClient, but with the decoding options of the given config.
+func directClientWith(server *httptest.Server, config KubeletClientConfig) (KubeletInterface, string) {
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	port, err := strconv.Atoi(serverURL.Port())
+	if err != nil {
+		panic(err)
+	}
+	client, err := NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+		Port:                         port,
+		RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+		DeprecatedCompletelyInsecure: true,
+		SummaryDecoder:               config.SummaryDecoder,
+		SkippedSubtrees:              config.SkippedSubtrees,
+		StrictDecoding:               config.StrictDecoding,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return client, serverURL.Hostname()
+}
+
+// decoded returns the given summary as decoded from a response by the given decoder.
+func decoded(decoder SummaryDecoder, summary *stats.Summary) *stats.Summary {
+	res := &stats.Summary{}
+	if err := decoder.Decode([]byte(summaryBody(summary)), res); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+var _ = Describe("Pooled summaries", func() {
+	var (
+		kubelet    *fakeKubelet
+		server     *httptest.Server
+		client     KubeletInterface
+		host       string
+		scrapeTime time.Time
+		first      *stats.Summary
+		second     *stats.Summary
+	)
+
+	BeforeEach(func() {
+		scrapeTime = time.Now().Truncate(time.Second)
+		first = &stats.Summary{
+			Node: stats.NodeStats{
+				NodeName: "node1",
+				CPU:      cpuStats(100, scrapeTime),
+				Memory:   memStats(200, scrapeTime),
+			},
+			Pods: []stats.PodStats{
+				podStats("ns1", "pod1",
+					containerStats("container1", 300, 400, scrapeTime),
+					containerStats("container2", 500, 600, scrapeTime)),
+				podStats("ns1", "pod2",
+					containerStats("container1", 700, 800, scrapeTime)),
+			},
+		}
+		first.Pods[0].Network = &stats.NetworkStats{Time: metav1.Time{scrapeTime}}
+		second = &stats.Summary{
+			Node: stats.NodeStats{
+				NodeName: "node1",
+				CPU:      cpuStats(900, scrapeTime.Add(time.Minute)),
+				Memory:   memStats(1000, scrapeTime.Add(time.Minute)),
+			},
+			Pods: []stats.PodStats{
+				podStats("ns2", "pod3",
+					containerStats("container3", 1000, 1100, scrapeTime.Add(time.Minute))),
+			},
+		}
+
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: summaryBody(first)}
+		server = httptest.NewServer(kubelet)
+		client, host = directClient(server)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	for _, decoder := range []SummaryDecoder{SummaryDecoderFull, SummaryDecoderFast} {
+		decoder := decoder
+		It(fmt.Sprintf("should not carry anything over from a released summary, with the %s decoder", decoder), func() {
+			client, host = directClientDecoding(server, decoder)
+			second.Node.Memory = nil
+			second.Pods[0].Containers[0].Memory = nil
+
+			summary, _, err := client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summaryBody(summary)).To(MatchJSON(summaryBody(decoded(decoder, first))))
+			client.(interface{ ReleaseSummary(*stats.Summary) }).ReleaseSummary(summary)
+
+			kubelet.body = summaryBody(second)
+			summary, _, err = client.GetSummary(context.Background(), host)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(summaryBody(summary)).To(MatchJSON(summaryBody(decoded(decoder, second))))
+			Expect(summary.Node.Memory).To(BeNil())
+			Expect(summary.Pods[0].Network).To(BeNil())
+			Expect(summary.Pods[0].Containers[0].Memory).To(BeNil())
+		})
+	}
+
+	It("should not let reuse of the summary change the batches translated from it", func() {
+		src := NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{})
+
+		By("collecting a batch")
+		firstBatch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("collecting the next batch, reusing the same summary")
+		kubelet.body = summaryBody(second)
+		_, err = src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying the first batch is unchanged")
+		// timestamps are only served to the second
+		served := &stats.Summary{}
+		Expect(json.Unmarshal([]byte(summaryBody(first)), served)).To(Succeed())
+		verifyNode("node1", served, firstBatch)
+		verifyPods(served, firstBatch)
+	})
+})
+
+// largeSummaryBody returns a summary with the given number of pods,
+// each with two containers and the stats a Kubelet usually reports.
+func largeSummaryBody(pods int) string {
+	val := func(v uint64) *uint64 { return &v }
+	ts := metav1.NewTime(time.Now())
+	fsStats := func() stats.FsStats {
+		return stats.FsStats{Time: ts, AvailableBytes: val(1), CapacityBytes: val(2), UsedBytes: val(3), InodesFree: val(4), Inodes: val(5), InodesUsed: val(6)}
+	}
+	memory := func() *stats.MemoryStats {
+		return &stats.MemoryStats{Time: ts, AvailableBytes: val(1), UsageBytes: val(2), WorkingSetBytes: val(3), RSSBytes: val(4), PageFaults: val(5), MajorPageFaults: val(6)}
+	}
+	container := func(name string) stats.ContainerStats {
+		rootfs, logs := fsStats(), fsStats()
+		return stats.ContainerStats{
+			Name:      name,
+			StartTime: ts,
+			CPU:       &stats.CPUStats{Time: ts, UsageNanoCores: val(1000), UsageCoreNanoSeconds: val(2000)},
+			Memory:    memory(),
+			Rootfs:    &rootfs,
+			Logs:      &logs,
+		}
+	}
+
+	summary := &stats.Summary{Node: stats.NodeStats{NodeName: "node1", CPU: cpuStats(100, ts.Time), Memory: memStats(200, ts.Time)}}
+	for i := 0; i < pods; i++ {
+		iface := stats.InterfaceStats{Name: "eth0", RxBytes: val(1), RxErrors: val(2), TxBytes: val(3), TxErrors: val(4)}
+		ephemeral := fsStats()
+		summary.Pods = append(summary.Pods, stats.PodStats{
+			PodRef:           stats.PodReference{Name: fmt.Sprintf("pod%d", i), Namespace: "ns1", UID: fmt.Sprintf("uid%d", i)},
+			StartTime:        ts,
+			Containers:       []stats.ContainerStats{container("app"), container("sidecar")},
+			CPU:              &stats.CPUStats{Time: ts, UsageNanoCores: val(1000), UsageCoreNanoSeconds: val(2000)},
+			Memory:           memory(),
+			Network:          &stats.NetworkStats{Time: ts, InterfaceStats: iface, Interfaces: []stats.InterfaceStats{iface}},
+			VolumeStats:      []stats.VolumeStats{{Name: "token", FsStats: fsStats()}},
+			EphemeralStorage: &ephemeral,
+		})
+	}
+	return summaryBody(summary)
+}
+
+// unpooledClient hides the client's ReleaseSummary, so that every scrape decodes into a new summary.
+type unpooledClient struct {
+	KubeletInterface
+}
+
+func benchmarkScrape(b *testing.B, pooled bool) {
+	server := httptest.NewServer(&fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: largeSummaryBody(500)})
+	defer server.Close()
+	client, host := directClient(server)
+	if !pooled {
+		client = unpooledClient{client}
+	}
+	src := NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{})
+
+	var batch *sources.MetricsBatch
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if batch, err = src.Collect(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if len(batch.Pods) != 500 {
+		b.Fatalf("expected 500 pods, got %d", len(batch.Pods))
+	}
+}
+
+func BenchmarkScrape500Pods(b *testing.B) {
+	benchmarkScrape(b, true)
+}
+
+func BenchmarkScrape500PodsUnpooled(b *testing.B) {
+	benchmarkScrape(b, false)
+}
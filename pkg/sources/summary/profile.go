@@ -0,0 +1,227 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// KubeletProfile names how a node's Kubelet is scraped: where it's requested, whether
+// credentials are presented, and which summary fields it can be expected to omit.
+type KubeletProfile string
+
+const (
+	// ProfileSecure requests the Kubelet's authenticated HTTPS API directly (on the Kubelet port).
+	ProfileSecure KubeletProfile = "secure"
+	// ProfileReadOnly requests the Kubelet's read-only port directly, over plain HTTP,
+	// never presenting any credentials.  Older and specially configured Kubelets serve
+	// summaries there without the fields gated behind authentication.
+	ProfileReadOnly KubeletProfile = "read-only"
+	// ProfileProxy requests the Kubelet through the API server's node proxy.
+	ProfileProxy KubeletProfile = "proxy"
+)
+
+// KubeletProfileAnnotation, set on a node, selects the profile its Kubelet is scraped with,
+// overriding any configured for it, when annotations are honored (see KubeletProfiles).
+const KubeletProfileAnnotation = "metrics-server.kubernetes.io/kubelet-profile"
+
+// DefaultReadOnlyPort is the port Kubelets serve their read-only API on by default.
+const DefaultReadOnlyPort = 10255
+
+// SummaryField names an optional field of a summary whose absence is validated.
+type SummaryField string
+
+const (
+	// FieldNodeName is the node name reported in the summary, used to verify the node scraped.
+	FieldNodeName SummaryField = "nodeName"
+	// FieldUsageCoreNanoSeconds is the cumulative CPU usage, which CPU rate consistency checks need.
+	FieldUsageCoreNanoSeconds SummaryField = "usageCoreNanoSeconds"
+	// FieldPageFaults are the cumulative page fault counts, which page fault rates need.
+	FieldPageFaults SummaryField = "pageFaults"
+)
+
+// profileSpec describes how the Kubelets of a profile are requested, and what they serve.
+type profileSpec struct {
+	// scheme is the scheme requested, unless DeprecatedCompletelyInsecure says otherwise.
+	scheme string
+	// credentials is whether metrics-server's credentials are presented.
+	credentials bool
+	// proxied is whether the Kubelet is requested through the API server.
+	proxied bool
+	// expectedMissing are the fields the Kubelets may omit without being flagged.
+	expectedMissing []SummaryField
+}
+
+var profileSpecs = map[KubeletProfile]profileSpec{
+	ProfileSecure: {scheme: "https", credentials: true},
+	ProfileReadOnly: {
+		scheme:          "http",
+		expectedMissing: []SummaryField{FieldNodeName, FieldUsageCoreNanoSeconds, FieldPageFaults},
+	},
+	ProfileProxy: {scheme: "https", credentials: true, proxied: true},
+}
+
+var missingFieldsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "missing_fields_total",
+		Help:      "Total number of Summary API responses missing fields their Kubelet's profile should report, by profile and field",
+	},
+	[]string{"profile", "field"},
+)
+
+func init() {
+	prometheus.MustRegister(missingFieldsTotal)
+}
+
+// ParseKubeletProfile parses the name of a Kubelet profile.
+func ParseKubeletProfile(name string) (KubeletProfile, error) {
+	profile := KubeletProfile(name)
+	if _, ok := profileSpecs[profile]; !ok {
+		return "", fmt.Errorf("unknown Kubelet profile %q, must be one of %s", name, strings.Join(kubeletProfileNames(), ", "))
+	}
+	return profile, nil
+}
+
+func kubeletProfileNames() []string {
+	var names []string
+	for profile := range profileSpecs {
+		names = append(names, string(profile))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseNodeProfiles parses a list of node=profile entries, selecting each node's profile.
+func ParseNodeProfiles(entries []string) (map[string]KubeletProfile, error) {
+	profiles := make(map[string]KubeletProfile, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Kubelet profile entry %q must be of the form node=profile", entry)
+		}
+		node := strings.TrimSpace(parts[0])
+		profile, err := ParseKubeletProfile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := profiles[node]; dup {
+			return nil, fmt.Errorf("node %q is given more than one Kubelet profile", node)
+		}
+		profiles[node] = profile
+	}
+	return profiles, nil
+}
+
+// KubeletProfiles selects the profiles of the nodes whose Kubelets aren't scraped with the
+// client's own (secure, or proxy with UseAPIServerProxy), by name or by annotation.
+type KubeletProfiles struct {
+	names map[string]KubeletProfile
+	nodes v1listers.NodeLister
+}
+
+// NewKubeletProfiles selects the given profiles for the named nodes, and, if given a lister,
+// the profiles nodes are annotated with (see KubeletProfileAnnotation), which take precedence.
+func NewKubeletProfiles(names map[string]KubeletProfile, nodes v1listers.NodeLister) *KubeletProfiles {
+	return &KubeletProfiles{names: names, nodes: nodes}
+}
+
+// For returns the profile selected for the given node, if any.
+func (p *KubeletProfiles) For(nodeName string) (KubeletProfile, bool) {
+	if p == nil || nodeName == "" {
+		return "", false
+	}
+	if p.nodes != nil {
+		if node, err := p.nodes.Get(nodeName); err == nil {
+			if annotated, ok := node.Annotations[KubeletProfileAnnotation]; ok {
+				profile, err := ParseKubeletProfile(annotated)
+				if err == nil {
+					return profile, true
+				}
+				glog.Warningf("ignoring the Kubelet profile annotation on node %s: %v", nodeName, err)
+			}
+		}
+	}
+	profile, ok := p.names[nodeName]
+	return profile, ok
+}
+
+// expectsMissing checks if the Kubelets of the given profile may omit the given field.
+func (p KubeletProfile) expectsMissing(field SummaryField) bool {
+	for _, expected := range profileSpecs[p].expectedMissing {
+		if expected == field {
+			return true
+		}
+	}
+	return false
+}
+
+// unexpectedlyMissing returns the fields validated by the given options which are missing from
+// the given summary (of the given pods), yet should be reported by a Kubelet of the given profile.
+// Summaries from unknown profiles (e.g. from other clients) aren't validated.
+func (p KubeletProfile) unexpectedlyMissing(summary *stats.Summary, pods []stats.PodStats, opts *SourceOptions) []SummaryField {
+	if _, known := profileSpecs[p]; !known {
+		return nil
+	}
+	var missing []SummaryField
+	check := func(field SummaryField, validated bool, isMissing func(cpu *stats.CPUStats, memory *stats.MemoryStats) bool) {
+		if !validated || p.expectsMissing(field) {
+			return
+		}
+		if anyContainer(summary, pods, isMissing) {
+			missing = append(missing, field)
+			missingFieldsTotal.WithLabelValues(string(p), string(field)).Inc()
+		}
+	}
+	check(FieldUsageCoreNanoSeconds, opts.CPURateConsistencyRatio > 0, func(cpu *stats.CPUStats, _ *stats.MemoryStats) bool {
+		return cpu != nil && cpu.UsageCoreNanoSeconds == nil
+	})
+	check(FieldPageFaults, opts.PageFaultRates, func(_ *stats.CPUStats, memory *stats.MemoryStats) bool {
+		return memory != nil && (memory.PageFaults == nil || memory.MajorPageFaults == nil)
+	})
+	return missing
+}
+
+// anyContainer checks if the given condition holds of the node's stats, or any of the given pods' containers' stats.
+func anyContainer(summary *stats.Summary, pods []stats.PodStats, cond func(cpu *stats.CPUStats, memory *stats.MemoryStats) bool) bool {
+	if cond(summary.Node.CPU, summary.Node.Memory) {
+		return true
+	}
+	for i := range pods {
+		for j := range pods[i].Containers {
+			if cond(pods[i].Containers[j].CPU, pods[i].Containers[j].Memory) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingFieldsNote describes the fields missing from a summary, for the scrape status.
+func missingFieldsNote(profile KubeletProfile, missing []SummaryField) string {
+	names := make([]string, len(missing))
+	for i, field := range missing {
+		names[i] = string(field)
+	}
+	return fmt.Sprintf("summary is missing %s, which a %s Kubelet should report", strings.Join(names, ", "), profile)
+}
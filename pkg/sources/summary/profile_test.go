@@ -0,0 +1,154 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Kubelet Profiles", func() {
+	var (
+		secure, readOnly, apiServer *fakeKubelet
+		servers                     []*httptest.Server
+		statuses                    *ScrapeStatusTracker
+		client                      KubeletInterface
+		// no node name, cumulative CPU usage, or page faults, as from an older read-only port
+		body = `{"node": {"cpu": {"time": "2018-01-01T00:00:00Z", "usageNanoCores": 100}, "memory": {"time": "2018-01-01T00:00:00Z", "workingSetBytes": 200}}}`
+	)
+
+	BeforeEach(func() {
+		secure = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: body}
+		readOnly = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: body}
+		apiServer = &fakeKubelet{summaryPath: "/api/v1/nodes/proxied/proxy/stats/summary/", status: http.StatusOK, body: body}
+		secureServer := httptest.NewTLSServer(secure)
+		readOnlyServer := httptest.NewServer(readOnly)
+		apiServerServer := httptest.NewTLSServer(apiServer)
+		servers = []*httptest.Server{secureServer, readOnlyServer, apiServerServer}
+		_, securePort := serverHostPort(secureServer)
+		_, readOnlyPort := serverHostPort(readOnlyServer)
+		statuses = NewScrapeStatusTracker()
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		Expect(indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "annotated", Annotations: map[string]string{KubeletProfileAnnotation: "read-only"}}})).To(Succeed())
+		Expect(indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "misannotated", Annotations: map[string]string{KubeletProfileAnnotation: "bogus"}}})).To(Succeed())
+		profiles := NewKubeletProfiles(map[string]KubeletProfile{"named": ProfileReadOnly, "proxied": ProfileProxy}, v1listers.NewNodeLister(indexer))
+
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port:         securePort,
+			ReadOnlyPort: readOnlyPort,
+			RESTConfig: &rest.Config{
+				Host:            apiServerServer.URL,
+				BearerToken:     "token",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			},
+			APIServerRESTConfig: &rest.Config{
+				Host:            apiServerServer.URL,
+				BearerToken:     "apiserver-token",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			},
+			Profiles: profiles,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	collect := func(node, addr string) NodeScrapeStatus {
+		src := NewSummaryMetricsSource(NodeInfo{Name: node, ConnectAddress: addr}, client, SourceOptions{
+			Statuses:                statuses,
+			CPURateConsistencyRatio: 1.5,
+			PageFaultRates:          true,
+		})
+		_, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred(), "node %s", node)
+		status, ok := statuses.Get(node)
+		Expect(ok).To(BeTrue())
+		return status
+	}
+
+	It("should scrape the read-only port without credentials, not flagging the fields it omits", func() {
+		for _, node := range []string{"named", "annotated"} {
+			status := collect(node, "127.0.0.1")
+			Expect(status.Source.Profile).To(Equal(ProfileReadOnly), "node %s", node)
+			Expect(status.Source.Scheme).To(Equal("http"))
+			Expect(status.Source.Proxied).To(BeFalse())
+			Expect(status.Notes).To(BeEmpty(), "node %s", node)
+		}
+		Expect(readOnly.requestedHeaders).To(HaveLen(2))
+		for _, headers := range readOnly.requestedHeaders {
+			Expect(headers.Get("Authorization")).To(BeEmpty())
+		}
+		Expect(secure.requestedPaths).To(BeEmpty())
+	})
+
+	It("should scrape other nodes securely, with credentials, flagging the fields they should report", func() {
+		By("scraping a node with no profile selected, or an unknown one annotated, with the client's own")
+		for _, node := range []string{"node1", "misannotated"} {
+			status := collect(node, "127.0.0.1")
+			Expect(status.Source.Profile).To(Equal(ProfileSecure), "node %s", node)
+			Expect(status.Source.Scheme).To(Equal("https"))
+			Expect(status.Notes).To(ConsistOf(
+				"summary did not report a node name, so it could not be verified",
+				"summary is missing usageCoreNanoSeconds, pageFaults, which a secure Kubelet should report",
+			))
+		}
+		Expect(secure.requestedHeaders).To(HaveLen(2))
+		Expect(secure.requestedHeaders[0].Get("Authorization")).To(Equal("Bearer token"))
+		Expect(readOnly.requestedPaths).To(BeEmpty())
+	})
+
+	It("should scrape nodes selected for the proxy through the API server, with its own client config, flagging the fields they should report", func() {
+		status := collect("proxied", "proxied")
+		Expect(status.Source.Profile).To(Equal(ProfileProxy))
+		Expect(status.Source.Proxied).To(BeTrue())
+		Expect(status.Source.Path).To(Equal("api/v1/nodes/proxied/proxy/stats/summary/"))
+		Expect(status.Notes).To(ContainElement("summary is missing usageCoreNanoSeconds, pageFaults, which a proxy Kubelet should report"))
+		Expect(apiServer.requestedHeaders[0].Get("Authorization")).To(Equal("Bearer apiserver-token"))
+		Expect(secure.requestedPaths).To(BeEmpty())
+		Expect(readOnly.requestedPaths).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Kubelet profile parsing", func() {
+	It("should parse node=profile entries", func() {
+		profiles, err := ParseNodeProfiles([]string{"node1=read-only", " node2 = proxy"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(profiles).To(Equal(map[string]KubeletProfile{"node1": ProfileReadOnly, "node2": ProfileProxy}))
+	})
+
+	It("should reject malformed entries, unknown profiles, and nodes given twice", func() {
+		for _, entries := range [][]string{{"node1"}, {"=secure"}, {"node1=plaintext"}, {"node1=secure", "node1=proxy"}} {
+			_, err := ParseNodeProfiles(entries)
+			Expect(err).To(HaveOccurred(), "%v", entries)
+		}
+	})
+})
@@ -0,0 +1,92 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// ProvenanceSource is the source type recorded in the provenance of metrics
+// scraped from Kubelet summaries.
+const ProvenanceSource = "kubelet_summary"
+
+// attachProvenance records where the given batch, scraped from the given address starting at
+// the given time, came from, on its node and every pod, which all share the same provenance,
+// if enabled.
+func (src *summaryMetricsSource) attachProvenance(ctx context.Context, batch *sources.MetricsBatch, scrapeTime time.Time, prov *Provenance, addr string) {
+	if !src.opts.Provenance {
+		return
+	}
+	kind := sources.ProvenanceDirect
+	if addr != src.node.ConnectAddress {
+		kind = sources.ProvenanceFallback
+	}
+	provenance := sources.NewProvenance(sources.CycleIDFrom(ctx), ProvenanceSource, provenanceEndpoint(prov, addr), scrapeTime, kind)
+	for i := range batch.Nodes {
+		batch.Nodes[i].Provenance = provenance
+	}
+	for i := range batch.Pods {
+		batch.Pods[i].Provenance = provenance
+	}
+}
+
+// provenanceEndpoint describes the endpoint a summary was requested from, or just the
+// address connected to, if the request wasn't described.
+func provenanceEndpoint(prov *Provenance, addr string) string {
+	if prov == nil {
+		return addr
+	}
+	host := prov.Host
+	if prov.Port != "" {
+		host = net.JoinHostPort(prov.Host, prov.Port)
+	}
+	return (&url.URL{Scheme: prov.Scheme, Host: host, Path: prov.Path}).String()
+}
+
+// staleBatch returns the given last good batch of a node, for serving again when its scrape
+// fails, as a copy whose provenance is marked stale, if enabled.
+func (src *summaryMetricsSource) staleBatch(batch *sources.MetricsBatch) *sources.MetricsBatch {
+	if batch == nil || !src.opts.Provenance {
+		return batch
+	}
+	res := &sources.MetricsBatch{
+		Nodes: make([]sources.NodeMetricsPoint, len(batch.Nodes)),
+		Pods:  make([]sources.PodMetricsPoint, len(batch.Pods)),
+	}
+	copy(res.Nodes, batch.Nodes)
+	copy(res.Pods, batch.Pods)
+	stale := make(map[*sources.Provenance]*sources.Provenance, 1)
+	markStale := func(prov *sources.Provenance) *sources.Provenance {
+		if prov == nil {
+			return nil
+		}
+		if _, ok := stale[prov]; !ok {
+			stale[prov] = prov.WithKind(sources.ProvenanceStale)
+		}
+		return stale[prov]
+	}
+	for i := range res.Nodes {
+		res.Nodes[i].Provenance = markStale(res.Nodes[i].Provenance)
+	}
+	for i := range res.Pods {
+		res.Pods[i].Provenance = markStale(res.Pods[i].Provenance)
+	}
+	return res
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Summary Source Provider recording provenance", func() {
+	var (
+		kubelet *fakeKubelet
+		server  *httptest.Server
+		client  KubeletInterface
+		lister  *fakeNodeLister
+		summary *stats.Summary
+
+		mu sync.Mutex
+		// routes maps each address to the test server it reaches, if it's reachable
+		routes map[string]string
+	)
+
+	BeforeEach(func() {
+		summary = &stats.Summary{
+			Node: stats.NodeStats{NodeName: "node1", CPU: cpuStats(100, time.Now()), Memory: memStats(200, time.Now())},
+			Pods: []stats.PodStats{
+				podStats("ns1", "pod1", containerStats("container1", 300, 400, time.Now())),
+				podStats("ns1", "pod2", containerStats("container1", 500, 600, time.Now())),
+			},
+		}
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: summaryBody(summary)}
+		server = httptest.NewServer(kubelet)
+		routes = map[string]string{"10.0.0.2": server.Listener.Addr().String(), "10.0.0.3": server.Listener.Addr().String()}
+
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port:                         10250,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+			DeprecatedCompletelyInsecure: true,
+			Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				mu.Lock()
+				target, ok := routes[host]
+				mu.Unlock()
+				if !ok {
+					return nil, errors.New("connect: no route to host")
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, target)
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+				Addresses: []corev1.NodeAddress{
+					{Type: corev1.NodeInternalIP, Address: "10.0.0.2"},
+					{Type: corev1.NodeInternalIP, Address: "10.0.0.3"},
+				},
+			},
+		}
+		lister = &fakeNodeLister{nodes: []*corev1.Node{node}}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newProvider := func(provenance bool) sources.MetricSourceProvider {
+		return NewSummaryProvider(lister, client, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{
+			AddressFallbackTTL: time.Hour,
+			Provenance:         provenance,
+		})
+	}
+
+	// collectIn collects from the single node as part of the given collection cycle.
+	collectIn := func(provider sources.MetricSourceProvider, cycleID string) (*sources.MetricsBatch, error) {
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs).To(HaveLen(1))
+		return srcs[0].Collect(sources.WithCycleID(context.Background(), cycleID))
+	}
+
+	// provenanceOf returns the provenance shared by the node and pods of the given batch.
+	provenanceOf := func(batch *sources.MetricsBatch) *sources.Provenance {
+		Expect(batch).NotTo(BeNil())
+		Expect(batch.Nodes).To(HaveLen(1))
+		Expect(batch.Pods).To(HaveLen(2))
+		prov := batch.Nodes[0].Provenance
+		Expect(prov).NotTo(BeNil())
+		for _, pod := range batch.Pods {
+			Expect(pod.Provenance).To(BeIdenticalTo(prov))
+		}
+		return prov
+	}
+
+	It("should record the cycle, source and endpoint of metrics scraped directly", func() {
+		before := time.Now()
+		batch, err := collectIn(newProvider(true), "cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		prov := provenanceOf(batch)
+		Expect(prov.CycleID).To(Equal("cycle-1"))
+		Expect(prov.Source).To(Equal(ProvenanceSource))
+		Expect(prov.Endpoint).To(Equal("http://10.0.0.2:10250/stats/summary/"))
+		Expect(prov.Kind).To(Equal(sources.ProvenanceDirect))
+		Expect(prov.Collected).To(BeTemporally(">=", before))
+		Expect(prov.Collected).To(BeTemporally("<=", time.Now()))
+	})
+
+	It("should mark metrics scraped from a fallback address", func() {
+		delete(routes, "10.0.0.2")
+		batch, err := collectIn(newProvider(true), "cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+
+		prov := provenanceOf(batch)
+		Expect(prov.Endpoint).To(Equal("http://10.0.0.3:10250/stats/summary/"))
+		Expect(prov.Kind).To(Equal(sources.ProvenanceFallback))
+	})
+
+	It("should mark the last-known metrics served again as stale, keeping the cycle that produced them", func() {
+		provider := newProvider(true)
+		good, err := collectIn(provider, "cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(provenanceOf(good).Kind).To(Equal(sources.ProvenanceDirect))
+
+		By("serving the previous data again when the summary reports another node")
+		summary.Node.NodeName = "node2"
+		kubelet.body = summaryBody(summary)
+		stale, err := collectIn(provider, "cycle-2")
+		Expect(IsNodeMismatchError(err)).To(BeTrue())
+		prov := provenanceOf(stale)
+		Expect(prov.Kind).To(Equal(sources.ProvenanceStale))
+		Expect(prov.CycleID).To(Equal("cycle-1"))
+		Expect(prov.Collected).To(Equal(provenanceOf(good).Collected))
+		Expect(stale.Nodes[0].MetricsPoint).To(Equal(good.Nodes[0].MetricsPoint))
+
+		By("leaving the last good batch itself unmarked")
+		Expect(provenanceOf(good).Kind).To(Equal(sources.ProvenanceDirect))
+
+		By("recording fresh provenance once the node is scraped again")
+		summary.Node.NodeName = "node1"
+		kubelet.body = summaryBody(summary)
+		fresh, err := collectIn(provider, "cycle-3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(provenanceOf(fresh).CycleID).To(Equal("cycle-3"))
+		Expect(provenanceOf(fresh).Kind).To(Equal(sources.ProvenanceDirect))
+	})
+
+	It("should record nothing unless enabled", func() {
+		batch, err := collectIn(newProvider(false), "cycle-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Nodes[0].Provenance).To(BeNil())
+		Expect(batch.Pods[0].Provenance).To(BeNil())
+	})
+})
@@ -0,0 +1,136 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The reasons the API server proxy can fail to reach a Kubelet, as used in ErrProxy and metrics.
+const (
+	ProxyReasonConnectionRefused = "connection_refused"
+	ProxyReasonNoRouteToHost     = "no_route_to_host"
+	ProxyReasonTimeout           = "timeout"
+	ProxyReasonBackendTLS        = "backend_tls"
+	ProxyReasonUnknown           = "unknown"
+)
+
+// When proxying, an API server that can't reach the Kubelet responds with an error of
+// its own, which otherwise looks just like the Kubelet failing.  Depending on its version,
+// it responds with either:
+//
+// - a Status object, whose message starts with one of proxyStatusPrefixes
+// - plain text of the form "Error: '<error>'\nTrying to reach: '<url>'"
+// - an empty 502, written by the reverse proxy itself, without the error
+var proxyStatusPrefixes = []string{"error trying to reach service: ", "error dialing backend: "}
+
+const (
+	legacyProxyErrorPrefix  = "Error: '"
+	legacyProxyTargetMarker = "'\nTrying to reach: "
+)
+
+// ErrProxy indicates that the API server proxy failed to reach the Kubelet,
+// so the request never got as far as the Kubelet itself.
+type ErrProxy struct {
+	endpoint string
+	code     int
+	// Reason is the reason the proxy couldn't reach the Kubelet (one of the ProxyReason constants).
+	Reason string
+	// Message is the underlying error reported by the API server, if any.
+	Message string
+	trigger scrapeTrigger
+}
+
+func (err *ErrProxy) Error() string {
+	return fmt.Sprintf("API server proxy failed to reach the Kubelet for %q (%s), %s (HTTP %d): %q", err.endpoint, err.trigger, err.Reason, err.code, err.Message)
+}
+
+func (err *ErrProxy) ErrorClass() string { return ErrorClassProxy }
+func (err *ErrProxy) Remediation() string {
+	return remediations[ErrorClassProxy]
+}
+
+// IsProxyError checks if the given error (or any error it wraps) is an ErrProxy.
+func IsProxyError(err error) bool {
+	var proxyErr *ErrProxy
+	return errors.As(err, &proxyErr)
+}
+
+// proxyErrorFor checks if the given failed response, received through the API server
+// proxy, came from the API server itself, returning an ErrProxy if so, or nil if it
+// came from the Kubelet.
+func proxyErrorFor(endpoint string, code int, body []byte, trigger scrapeTrigger) *ErrProxy {
+	if code < http.StatusInternalServerError {
+		return nil
+	}
+	message, ok := proxyErrorMessage(code, body)
+	if !ok {
+		return nil
+	}
+	return &ErrProxy{
+		endpoint: endpoint,
+		code:     code,
+		Reason:   proxyErrorReason(message),
+		Message:  message,
+		trigger:  trigger,
+	}
+}
+
+// proxyErrorMessage extracts the underlying error from a response written by the API server proxy.
+func proxyErrorMessage(code int, body []byte) (string, bool) {
+	var status metav1.Status
+	if err := json.Unmarshal(body, &status); err == nil && status.Kind == "Status" {
+		for _, prefix := range proxyStatusPrefixes {
+			if strings.HasPrefix(status.Message, prefix) {
+				return strings.TrimPrefix(status.Message, prefix), true
+			}
+		}
+		return "", false
+	}
+
+	text := string(body)
+	if strings.HasPrefix(text, legacyProxyErrorPrefix) {
+		if end := strings.Index(text, legacyProxyTargetMarker); end >= 0 {
+			return text[len(legacyProxyErrorPrefix):end], true
+		}
+	}
+
+	if code == http.StatusBadGateway && len(strings.TrimSpace(text)) == 0 {
+		return "", true
+	}
+	return "", false
+}
+
+// proxyErrorReason classifies the underlying error reported by the API server proxy.
+func proxyErrorReason(message string) string {
+	switch {
+	case strings.Contains(message, "connection refused"):
+		return ProxyReasonConnectionRefused
+	case strings.Contains(message, "no route to host"):
+		return ProxyReasonNoRouteToHost
+	case strings.Contains(message, "i/o timeout"), strings.Contains(message, "deadline exceeded"):
+		return ProxyReasonTimeout
+	case strings.Contains(message, "x509:"), strings.Contains(message, "tls:"):
+		return ProxyReasonBackendTLS
+	default:
+		return ProxyReasonUnknown
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxRedirects is the number of same-host redirects followed for a single request.
+const maxRedirects = 3
+
+// The reasons a redirect is refused, as used in ErrRedirect and metrics.
+const (
+	RedirectReasonCrossHost    = "cross_host"
+	RedirectReasonSchemeChange = "scheme_change"
+	RedirectReasonTooMany      = "too_many"
+)
+
+var redirectsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "redirects_total",
+		Help:      "Total number of redirects in response to Kubelet requests, by outcome: followed, or the reason it was refused",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(redirectsTotal)
+}
+
+// ErrRedirect indicates that a request to a Kubelet was redirected somewhere metrics-server
+// won't follow: to another host, where its credentials could be harvested, to another
+// scheme, or past maxRedirects redirects.
+type ErrRedirect struct {
+	// From and To are the URLs of the redirected request and of where it was redirected.
+	From string
+	To   string
+	// Reason is why the redirect was refused (one of the RedirectReason constants).
+	Reason string
+}
+
+func (err *ErrRedirect) Error() string {
+	return fmt.Sprintf("refused to follow the redirect of %q to %q (%s)", err.From, err.To, err.Reason)
+}
+
+func (err *ErrRedirect) ErrorClass() string { return ErrorClassRedirect }
+func (err *ErrRedirect) Remediation() string {
+	return remediations[ErrorClassRedirect]
+}
+
+// IsRedirectError checks if the given error (or any error it wraps) is an ErrRedirect.
+func IsRedirectError(err error) bool {
+	var redirectErr *ErrRedirect
+	return errors.As(err, &redirectErr)
+}
+
+// checkRedirect is the redirect policy of the clients requesting from Kubelets: neither a Kubelet
+// nor the API server proxy redirects, so a redirect means something else is answering, which
+// mustn't be trusted with the credentials sent along.  Redirects to another path on the same
+// host are followed, up to maxRedirects of them, while the rest are refused with an ErrRedirect.
+// Refusing is the only way to keep the credentials from another host: net/http drops the
+// Authorization header when following a redirect elsewhere, but the transport built from the
+// REST config adds it back to every request it makes, whatever its host.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	original, previous := via[0].URL, via[len(via)-1].URL
+	reason := ""
+	switch {
+	case req.URL.Host != original.Host:
+		reason = RedirectReasonCrossHost
+	case req.URL.Scheme != original.Scheme:
+		reason = RedirectReasonSchemeChange
+	case len(via) > maxRedirects:
+		reason = RedirectReasonTooMany
+	}
+	if reason == "" {
+		redirectsTotal.WithLabelValues("followed").Inc()
+		return nil
+	}
+	redirectsTotal.WithLabelValues(reason).Inc()
+	return &ErrRedirect{From: previous.String(), To: req.URL.String(), Reason: reason}
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// redirectCount fetches the number of redirects with the given outcome from the default registry.
+func redirectCount(outcome string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_redirects_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == outcome {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Kubelet Client redirected", func() {
+	var (
+		target     *fakeKubelet
+		mux        *http.ServeMux
+		redirector *httptest.Server
+		elsewhere  *httptest.Server
+		client     KubeletInterface
+		host       string
+	)
+
+	BeforeEach(func() {
+		target = &fakeKubelet{
+			summaryPath: "/moved/summary",
+			status:      http.StatusOK,
+			body:        `{"node": {"nodeName": "node1", "cpu": {"time": "2018-01-01T00:00:00Z", "usageNanoCores": 100}, "memory": {"time": "2018-01-01T00:00:00Z", "workingSetBytes": 200}}}`,
+		}
+		mux = http.NewServeMux()
+		mux.Handle("/moved/", target)
+		redirector = httptest.NewServer(mux)
+		elsewhere = httptest.NewServer(target)
+
+		var port int
+		host, port = serverHostPort(redirector)
+		var err error
+		client, err = KubeletClientFor(&KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443", BearerToken: "secret-token"},
+			DeprecatedCompletelyInsecure: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		redirector.Close()
+		elsewhere.Close()
+	})
+
+	redirectTo := func(location func(*http.Request) string) {
+		mux.HandleFunc("/stats/summary/", func(w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, location(req), http.StatusFound)
+		})
+	}
+
+	It("should follow redirects to another path on the same host", func() {
+		redirectTo(func(*http.Request) string { return "/moved/summary" })
+		followedBefore := redirectCount("followed")
+
+		summary, _, err := client.GetSummary(context.Background(), host)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Node.NodeName).To(Equal("node1"))
+		Expect(target.requestedPaths).To(Equal([]string{"/moved/summary"}))
+		Expect(target.requestedHeaders[0].Get("Authorization")).To(Equal("Bearer secret-token"))
+		Expect(redirectCount("followed") - followedBefore).To(BeEquivalentTo(1))
+	})
+
+	It("should refuse redirects to another host, never sending it the credentials", func() {
+		redirectTo(func(*http.Request) string { return elsewhere.URL + "/moved/summary" })
+		refusedBefore := redirectCount(RedirectReasonCrossHost)
+
+		_, _, err := client.GetSummary(context.Background(), host)
+		Expect(IsRedirectError(err)).To(BeTrue())
+		Expect(ErrorClass(err)).To(Equal(ErrorClassRedirect))
+		Expect(err.Error()).To(ContainSubstring("refused to follow the redirect of %q to %q (cross_host)", "http://"+redirector.Listener.Addr().String()+"/stats/summary/", elsewhere.URL+"/moved/summary"))
+		Expect(target.requestedPaths).To(BeEmpty())
+		Expect(redirectCount(RedirectReasonCrossHost) - refusedBefore).To(BeEquivalentTo(1))
+	})
+
+	It("should refuse to follow more than a few redirects on the same host", func() {
+		redirectTo(func(req *http.Request) string {
+			hops, _ := strconv.Atoi(req.URL.Query().Get("hops"))
+			return "/stats/summary/?hops=" + strconv.Itoa(hops+1)
+		})
+		followedBefore, refusedBefore := redirectCount("followed"), redirectCount(RedirectReasonTooMany)
+
+		_, _, err := client.GetSummary(context.Background(), host)
+		Expect(IsRedirectError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("(too_many)"))
+		Expect(redirectCount("followed") - followedBefore).To(BeEquivalentTo(3))
+		Expect(redirectCount(RedirectReasonTooMany) - refusedBefore).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,186 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Kubelet serving certificates carry IP SANs, DNS SANs (the node name), or both, depending
+// on how the cluster was provisioned.  Go verifies them against whatever host was connected
+// to, so which SANs are checked depends on the address type chosen for each node.  A SAN
+// policy instead makes the requirement explicit: the certificate's chain is verified as usual,
+// and then its SANs are checked against the policy, given the address connected to and the
+// name of the node, during the handshake (see VerifyConnection).
+
+// SANPolicy selects which subject alternative names are required of Kubelet serving certificates.
+type SANPolicy string
+
+const (
+	// SANPolicyNone leaves verification to Go, against the host connected to.
+	SANPolicyNone SANPolicy = ""
+	// SANPolicyRequireIP requires an IP SAN matching the address connected to,
+	// which must be an IP address.
+	SANPolicyRequireIP SANPolicy = "require-ip"
+	// SANPolicyRequireName requires a DNS SAN matching the name of the node.
+	SANPolicyRequireName SANPolicy = "require-name"
+	// SANPolicyEither requires either of the above.
+	SANPolicyEither SANPolicy = "either"
+)
+
+// SANPolicies lists the SAN policies which can be set.
+var SANPolicies = []SANPolicy{SANPolicyRequireIP, SANPolicyRequireName, SANPolicyEither}
+
+// ParseSANPolicy parses the name of a SAN policy, which is SANPolicyNone if it's empty.
+func ParseSANPolicy(name string) (SANPolicy, error) {
+	if name == "" {
+		return SANPolicyNone, nil
+	}
+	for _, policy := range SANPolicies {
+		if SANPolicy(name) == policy {
+			return policy, nil
+		}
+	}
+	names := make([]string, len(SANPolicies))
+	for i, policy := range SANPolicies {
+		names[i] = string(policy)
+	}
+	return SANPolicyNone, fmt.Errorf("unknown Kubelet SAN policy %q, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// sanVerifier verifies Kubelet serving certificates against a SAN policy.
+type sanVerifier struct {
+	policy SANPolicy
+}
+
+// newSANVerifier returns a verifier for the SAN policy set in the given config, or nil if none
+// is set, or it doesn't apply, since the Kubelets' serving certificates aren't verified against
+// a CA, or aren't connected to directly.
+func newSANVerifier(config *KubeletClientConfig) *sanVerifier {
+	if config.SANPolicy == SANPolicyNone || config.UseAPIServerProxy || config.DeprecatedCompletelyInsecure ||
+		config.RESTConfig.TLSClientConfig.Insecure || config.SPIFFETrustDomain != "" {
+		return nil
+	}
+	return &sanVerifier{policy: config.SANPolicy}
+}
+
+// dialTLS returns a function establishing TLS connections over connections from the given
+// dialer, with the given config, verifying the Kubelet serving certificates against its root
+// CAs and the policy, in place of Go's verification of the host connected to.  The name of
+// the node is taken from the context of the request (see WithNodeName).
+func (v *sanVerifier) dialTLS(dial DialFunc, tlsConfig *tls.Config) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		node := nodeNameFrom(ctx)
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		// the chain is still verified, just not against the host
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return v.verify(state.PeerCertificates, tlsConfig.RootCAs, addr, host, node)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// verify verifies the chain of the given certificates against the given roots (or the
+// system's, if nil), and then checks that the leaf's SANs satisfy the policy, given the
+// host connected to and the node's name.
+func (v *sanVerifier) verify(certs []*x509.Certificate, roots *x509.CertPool, addr, host, node string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("Kubelet at %q presented no serving certificate", addr)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	leaf := certs[0]
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return &tls.CertificateVerificationError{UnverifiedCertificates: certs, Err: err}
+	}
+
+	ipOK := net.ParseIP(host) != nil && leaf.VerifyHostname(host) == nil
+	nameOK := node != "" && net.ParseIP(node) == nil && len(leaf.DNSNames) > 0 && leaf.VerifyHostname(node) == nil
+	switch {
+	case v.policy == SANPolicyRequireIP && ipOK,
+		v.policy == SANPolicyRequireName && nameOK,
+		v.policy == SANPolicyEither && (ipOK || nameOK):
+		return nil
+	}
+	sanErr := &ErrSANPolicy{addr: addr, node: node, policy: v.policy, dnsSANs: leaf.DNSNames}
+	for _, ip := range leaf.IPAddresses {
+		sanErr.ipSANs = append(sanErr.ipSANs, ip.String())
+	}
+	return sanErr
+}
+
+// ErrSANPolicy indicates that a Kubelet's serving certificate was issued by a trusted CA,
+// but its SANs didn't satisfy the configured SAN policy.
+type ErrSANPolicy struct {
+	addr    string
+	node    string
+	policy  SANPolicy
+	ipSANs  []string
+	dnsSANs []string
+}
+
+func (err *ErrSANPolicy) Error() string {
+	var required string
+	switch err.policy {
+	case SANPolicyRequireIP:
+		required = fmt.Sprintf("an IP SAN for the address connected to (%s)", err.addr)
+	case SANPolicyRequireName:
+		required = fmt.Sprintf("a DNS SAN for the node name (%q)", err.node)
+	default:
+		required = fmt.Sprintf("an IP SAN for the address connected to (%s) or a DNS SAN for the node name (%q)", err.addr, err.node)
+	}
+	return fmt.Sprintf("serving certificate of the Kubelet at %q does not satisfy the %s SAN policy, which requires %s; its IP SANs are [%s], and its DNS SANs are [%s]",
+		err.addr, err.policy, required, strings.Join(err.ipSANs, ", "), strings.Join(err.dnsSANs, ", "))
+}
+
+// IPSANs and DNSSANs return the SANs present in the certificate.
+func (err *ErrSANPolicy) IPSANs() []string  { return err.ipSANs }
+func (err *ErrSANPolicy) DNSSANs() []string { return err.dnsSANs }
+
+func (err *ErrSANPolicy) ErrorClass() string { return ErrorClassSANPolicy }
+func (err *ErrSANPolicy) Remediation() string {
+	return remediations[ErrorClassSANPolicy]
+}
+
+// IsSANPolicyError checks if the given error (or any error it wraps) is an ErrSANPolicy.
+func IsSANPolicyError(err error) bool {
+	var sanErr *ErrSANPolicy
+	return errors.As(err, &sanErr)
+}
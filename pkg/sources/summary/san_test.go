@@ -0,0 +1,183 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// sanCA issues serving certificates with the given SANs, for testing SAN policies.
+type sanCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newSANCA() *sanCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubelet-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(raw)
+	Expect(err).NotTo(HaveOccurred())
+	return &sanCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})}
+}
+
+func (ca *sanCA) issue(ips []net.IP, dnsNames []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kubelet"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+		DNSNames:     dnsNames,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).NotTo(HaveOccurred())
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}
+}
+
+var _ = Describe("Kubelet Client with a SAN policy", func() {
+	var (
+		ca      *sanCA
+		servers map[string]*httptest.Server
+	)
+
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	sans := map[string]struct {
+		ips      []net.IP
+		dnsNames []string
+	}{
+		"ip":      {ips: loopback},
+		"name":    {dnsNames: []string{"node1"}},
+		"both":    {ips: loopback, dnsNames: []string{"node1"}},
+		"neither": {},
+	}
+
+	BeforeEach(func() {
+		ca = newSANCA()
+		servers = map[string]*httptest.Server{}
+		for name, san := range sans {
+			server := httptest.NewUnstartedServer(&fakeKubelet{
+				summaryPath: "/stats/summary/",
+				status:      http.StatusOK,
+				body:        `{"node": {"nodeName": "node1"}}`,
+			})
+			server.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(san.ips, san.dnsNames)}}
+			server.StartTLS()
+			servers[name] = server
+		}
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	// getSummary scrapes the server with the given SANs, as the given node, with the given policy.
+	getSummary := func(sans, node string, policy SANPolicy, caData []byte) error {
+		host, port := serverHostPort(servers[sans])
+		client, err := KubeletClientFor(&KubeletClientConfig{
+			Port: port,
+			RESTConfig: &rest.Config{
+				Host:            "https://apiserver.invalid:6443",
+				TLSClientConfig: rest.TLSClientConfig{CAData: caData},
+			},
+			SANPolicy: policy,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = client.GetSummary(WithNodeName(context.Background(), node), host)
+		return err
+	}
+
+	It("should accept only the certificates meeting each policy", func() {
+		accepted := map[SANPolicy][]string{
+			SANPolicyNone:        {"ip", "both"},
+			SANPolicyRequireIP:   {"ip", "both"},
+			SANPolicyRequireName: {"name", "both"},
+			SANPolicyEither:      {"ip", "name", "both"},
+		}
+		for policy, names := range accepted {
+			for name := range sans {
+				err := getSummary(name, "node1", policy, ca.pem)
+				shouldAccept := false
+				for _, acceptedName := range names {
+					shouldAccept = shouldAccept || acceptedName == name
+				}
+				if shouldAccept {
+					Expect(err).NotTo(HaveOccurred(), "policy %q, SANs %q", policy, name)
+				} else {
+					Expect(err).To(HaveOccurred(), "policy %q, SANs %q", policy, name)
+				}
+			}
+		}
+	})
+
+	It("should report the SANs present on certificates failing the policy", func() {
+		err := getSummary("ip", "node1", SANPolicyRequireName, ca.pem)
+		Expect(IsSANPolicyError(err)).To(BeTrue())
+		Expect(ErrorClass(err)).To(Equal(ErrorClassSANPolicy))
+		Expect(err.Error()).To(ContainSubstring("127.0.0.1"))
+
+		err = getSummary("name", "node1", SANPolicyRequireIP, ca.pem)
+		Expect(IsSANPolicyError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("node1"))
+	})
+
+	It("should require the name SAN to match the node's name", func() {
+		err := getSummary("name", "node2", SANPolicyRequireName, ca.pem)
+		Expect(IsSANPolicyError(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("node2"))
+	})
+
+	It("should still verify the certificate's chain against the CA", func() {
+		err := getSummary("both", "node1", SANPolicyEither, newSANCA().pem)
+		Expect(err).To(HaveOccurred())
+		Expect(IsSANPolicyError(err)).To(BeFalse())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+	})
+})
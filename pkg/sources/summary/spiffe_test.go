@@ -0,0 +1,109 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/client-go/rest"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe"
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe/fake"
+)
+
+var _ = Describe("Kubelet Client with a SPIFFE X.509 SVID", func() {
+	var (
+		ca     *fake.CA
+		api    *fake.WorkloadAPI
+		svids  *spiffe.X509Source
+		stopCh chan struct{}
+		server *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		ca, err = fake.NewCA("example.org")
+		Expect(err).NotTo(HaveOccurred())
+		clientSVID, err := ca.Issue("/metrics-server")
+		Expect(err).NotTo(HaveOccurred())
+		api, err = fake.NewWorkloadAPI(clientSVID)
+		Expect(err).NotTo(HaveOccurred())
+
+		stopCh = make(chan struct{})
+		svids = spiffe.NewX509Source(api.SocketPath())
+		Expect(svids.RunUntil(stopCh)).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(svids.WaitUntilReady(ctx)).To(Succeed())
+
+		kubeletSVID, err := ca.Issue("/kubelet/node1")
+		Expect(err).NotTo(HaveOccurred())
+		kubeletCert, err := fake.TLSCertificate(kubeletSVID)
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewUnstartedServer(&fakeKubelet{
+			summaryPath: "/stats/summary/",
+			status:      http.StatusOK,
+			body:        `{"node": {"nodeName": "node1"}}`,
+		})
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{kubeletCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.Pool(),
+		}
+		server.StartTLS()
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		api.Close()
+		server.Close()
+	})
+
+	getSummary := func(trustDomain string) error {
+		host, port := serverHostPort(server)
+		client, err := KubeletClientFor(&KubeletClientConfig{
+			Port:              port,
+			RESTConfig:        &rest.Config{Host: "https://apiserver.invalid:6443"},
+			SPIFFE:            svids,
+			SPIFFETrustDomain: trustDomain,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = client.GetSummary(context.Background(), host)
+		return err
+	}
+
+	It("should authenticate with the SVID, verifying the Kubelet's SVID in the trust domain", func() {
+		Expect(getSummary("example.org")).To(Succeed())
+	})
+
+	It("should reject Kubelets outside the trust domain", func() {
+		err := getSummary("example.com")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("trust domain"))
+	})
+
+	It("should still verify the Kubelet against a CA without a trust domain", func() {
+		err := getSummary("")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("certificate"))
+	})
+})
@@ -0,0 +1,119 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+)
+
+// Some Kubelets serve a summary cached for up to their housekeeping interval, so scraping
+// them at a similar resolution sometimes yields the same summary twice.  Rates derived from
+// two identical samples would be zero (or are declined, for lack of a window), so a summary
+// whose node stats have the same timestamp as the last one's is counted as stale, and the rates
+// derived from it (CPU usage, when checked, and page faults) are carried forward from the
+// last summary instead, flagged in the node's scrape status.  The number of consecutive
+// stale summaries is published per node, and warned about once it reaches a threshold.
+
+// DefaultStaleSummaryWarningThreshold is the default number of consecutive
+// stale summaries from a node after which a warning is logged.
+const DefaultStaleSummaryWarningThreshold = 3
+
+var staleSummaries = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "consecutive_stale_responses",
+		Help:      "The number of consecutive summaries from the node whose node stats had the same timestamp as the previous summary's, as served from the Kubelet's cache",
+	},
+	[]string{"node"},
+)
+
+func init() {
+	prometheus.MustRegister(staleSummaries)
+}
+
+// staleSummaryState is the node stats timestamp of a node's last summary,
+// and the number of consecutive summaries which had the same one.
+type staleSummaryState struct {
+	timestamp   time.Time
+	consecutive int
+}
+
+// staleSummaryTracker detects nodes serving the same cached summary in consecutive scrapes.
+type staleSummaryTracker struct {
+	mu    sync.Mutex
+	nodes map[string]staleSummaryState
+}
+
+func newStaleSummaryTracker() *staleSummaryTracker {
+	return &staleSummaryTracker{nodes: make(map[string]staleSummaryState)}
+}
+
+// observe records the timestamp of the given node stats, returning the number of consecutive
+// summaries (up to and including this one) whose node stats had the same timestamp as the
+// summary before them, which is zero if this one is fresh.  Once that reaches the given threshold
+// (if non-zero), it's warned about.
+func (t *staleSummaryTracker) observe(node string, nodeStats *stats.NodeStats, threshold int) int {
+	if t == nil {
+		return 0
+	}
+	timestamp, err := getScrapeTime(nodeStats.CPU, nodeStats.Memory)
+	if err != nil {
+		// nothing to compare, so it can't be called stale
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, seen := t.nodes[node]
+	if seen && timestamp.Equal(state.timestamp) {
+		state.consecutive++
+	} else {
+		state = staleSummaryState{timestamp: timestamp}
+	}
+	t.nodes[node] = state
+	staleSummaries.WithLabelValues(node).Set(float64(state.consecutive))
+
+	if threshold > 0 && state.consecutive == threshold {
+		glog.Warningf("node %q served %d consecutive stale summaries, unchanged since its node stats from %s; its Kubelet's stats housekeeping interval is likely as long as the metric resolution, so lengthen --metric-resolution, or shorten the Kubelet's housekeeping interval", node, threshold, timestamp.Format(time.RFC3339))
+	}
+	return state.consecutive
+}
+
+// prune removes the state and gauge of any node not in the given set.
+func (t *staleSummaryTracker) prune(keep map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node := range t.nodes {
+		if _, ok := keep[node]; !ok {
+			delete(t.nodes, node)
+			staleSummaries.DeleteLabelValues(node)
+		}
+	}
+}
+
+// staleSummaryNote describes a stale summary for the node's scrape status.
+func staleSummaryNote(consecutive int) string {
+	return fmt.Sprintf("summary was served from the Kubelet's cache, unchanged since the last scrape (%d consecutive stale summaries), so rates were carried forward from the last fresh one", consecutive)
+}
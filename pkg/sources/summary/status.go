@@ -0,0 +1,188 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// NodeScrapeStatus records the outcome of the most recent scrape of a node.
+type NodeScrapeStatus struct {
+	Node       string    `json:"node"`
+	NodePool   string    `json:"nodePool,omitempty"`
+	LastScrape time.Time `json:"lastScrape"`
+	// LastSuccess is the time of the last fully successful scrape, if any.
+	// It's carried over from the previous status by failed scrapes.
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// Reason and CycleID identify the operation that triggered the last scrape.
+	Reason  string `json:"reason,omitempty"`
+	CycleID string `json:"cycleID,omitempty"`
+	Success bool   `json:"success"`
+	// WarmingUp indicates that the node was created recently, and its Kubelet
+	// had no node stats to report yet.  It's not considered an error.
+	WarmingUp bool   `json:"warmingUp,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// ErrorClass classifies the error (see ErrorClass), if there was one.
+	ErrorClass string `json:"errorClass,omitempty"`
+	// DurationSeconds is how long the scrape took, including decoding the summary.
+	DurationSeconds float64 `json:"durationSeconds"`
+	// CancelCause is why the last scrape was canceled, if it was (e.g. "timeout").
+	CancelCause sources.CancelReason `json:"cancelCause,omitempty"`
+	// Source is the endpoint that was last tried for this node.
+	Source *Provenance `json:"source,omitempty"`
+	// Notes contains any non-fatal issues encountered while processing the scrape.
+	Notes []string `json:"notes,omitempty"`
+	// CPURates lists containers (up to a cap) whose reported CPU usage rates diverged
+	// from the rates derived from their cumulative usage, if that's checked.
+	CPURates []CPURateInconsistency `json:"cpuRateInconsistencies,omitempty"`
+}
+
+// StatusObserver is notified of every status recorded by a ScrapeStatusTracker.
+type StatusObserver interface {
+	// ObserveStatus is called synchronously by the scrape recording the
+	// status, once it's recorded, so it must not block.
+	ObserveStatus(status NodeScrapeStatus)
+}
+
+// statusShards is the number of shards the statuses are split across, so that scrapes
+// of thousands of nodes recording their statuses at once rarely contend for a lock.
+const statusShards = 64
+
+// statusShard holds the statuses of the nodes whose names hash to it.
+type statusShard struct {
+	mu    sync.RWMutex
+	nodes map[string]NodeScrapeStatus
+}
+
+// ScrapeStatusTracker keeps track of the latest scrape status of each node.
+// It also serves as an http.Handler for the scrape-status debug endpoint.
+type ScrapeStatusTracker struct {
+	shards [statusShards]statusShard
+
+	// observers holds the []StatusObserver to notify, replaced (under observersMu)
+	// rather than modified, so that updates can load it without locking.
+	observersMu sync.Mutex
+	observers   atomic.Value
+}
+
+// NewScrapeStatusTracker returns a new, empty ScrapeStatusTracker.
+func NewScrapeStatusTracker() *ScrapeStatusTracker {
+	t := &ScrapeStatusTracker{}
+	for i := range t.shards {
+		t.shards[i].nodes = make(map[string]NodeScrapeStatus)
+	}
+	t.observers.Store([]StatusObserver(nil))
+	return t
+}
+
+// shard returns the shard holding the status of the given node, by the FNV-1a hash of its name.
+func (t *ScrapeStatusTracker) shard(node string) *statusShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(node); i++ {
+		hash ^= uint32(node[i])
+		hash *= 16777619
+	}
+	return &t.shards[hash%statusShards]
+}
+
+// AddObserver registers an observer to be notified of every status recorded from now on.
+func (t *ScrapeStatusTracker) AddObserver(observer StatusObserver) {
+	t.observersMu.Lock()
+	defer t.observersMu.Unlock()
+	current := t.observers.Load().([]StatusObserver)
+	observers := make([]StatusObserver, len(current), len(current)+1)
+	copy(observers, current)
+	t.observers.Store(append(observers, observer))
+}
+
+// Update records the given status, replacing any previous status for the same node
+// (but keeping its last success time, if the new status has none), and passes it on
+// to the observers.  It only locks the node's shard.
+func (t *ScrapeStatusTracker) Update(status NodeScrapeStatus) {
+	shard := t.shard(status.Node)
+	shard.mu.Lock()
+	if status.LastSuccess == nil {
+		status.LastSuccess = shard.nodes[status.Node].LastSuccess
+	}
+	shard.nodes[status.Node] = status
+	shard.mu.Unlock()
+
+	for _, observer := range t.observers.Load().([]StatusObserver) {
+		observer.ObserveStatus(status)
+	}
+}
+
+// Get fetches the status for the given node, if any is known.
+func (t *ScrapeStatusTracker) Get(node string) (NodeScrapeStatus, bool) {
+	shard := t.shard(node)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	status, ok := shard.nodes[node]
+	return status, ok
+}
+
+// List returns the status of all known nodes, sorted by node name.  Each shard is copied
+// in turn, so updates are only ever blocked by the copy of their own shard; statuses
+// recorded while listing may or may not be included.
+func (t *ScrapeStatusTracker) List() []NodeScrapeStatus {
+	var res []NodeScrapeStatus
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.RLock()
+		if res == nil {
+			// size for the whole tracker, assuming the shards are roughly balanced
+			res = make([]NodeScrapeStatus, 0, len(shard.nodes)*statusShards*5/4)
+		}
+		for _, status := range shard.nodes {
+			res = append(res, status)
+		}
+		shard.mu.RUnlock()
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Node < res[j].Node })
+	return res
+}
+
+// Prune removes the status of any node not in the given set,
+// so that nodes removed from the cluster don't linger.
+func (t *ScrapeStatusTracker) Prune(keep map[string]struct{}) {
+	for i := range t.shards {
+		shard := &t.shards[i]
+		shard.mu.Lock()
+		for node := range shard.nodes {
+			if _, ok := keep[node]; !ok {
+				delete(shard.nodes, node)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// ServeHTTP serves the status of all known nodes as JSON.
+func (t *ScrapeStatusTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(t.List()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Scrape Status Tracker", func() {
+	var tracker *ScrapeStatusTracker
+
+	BeforeEach(func() {
+		tracker = NewScrapeStatusTracker()
+	})
+
+	It("should list the latest status of every node, sorted by node name", func() {
+		for i := 99; i >= 0; i-- {
+			tracker.Update(NodeScrapeStatus{Node: fmt.Sprintf("node-%02d", i), CycleID: "1"})
+		}
+		tracker.Update(NodeScrapeStatus{Node: "node-42", CycleID: "2"})
+
+		statuses := tracker.List()
+		Expect(statuses).To(HaveLen(100))
+		for i, status := range statuses {
+			Expect(status.Node).To(Equal(fmt.Sprintf("node-%02d", i)))
+		}
+		Expect(statuses[42].CycleID).To(Equal("2"))
+		status, ok := tracker.Get("node-42")
+		Expect(ok).To(BeTrue())
+		Expect(status.CycleID).To(Equal("2"))
+	})
+
+	It("should carry over the last success time to failed scrapes", func() {
+		success := time.Now()
+		tracker.Update(NodeScrapeStatus{Node: "node", Success: true, LastSuccess: &success})
+		tracker.Update(NodeScrapeStatus{Node: "node", Error: "failed"})
+		status, ok := tracker.Get("node")
+		Expect(ok).To(BeTrue())
+		Expect(status.LastSuccess).To(Equal(&success))
+	})
+
+	It("should prune the nodes not kept, wherever they're stored", func() {
+		keep := make(map[string]struct{})
+		for i := 0; i < 100; i++ {
+			node := fmt.Sprintf("node-%d", i)
+			tracker.Update(NodeScrapeStatus{Node: node})
+			if i%2 == 0 {
+				keep[node] = struct{}{}
+			}
+		}
+		tracker.Prune(keep)
+		statuses := tracker.List()
+		Expect(statuses).To(HaveLen(50))
+		for _, status := range statuses {
+			Expect(keep).To(HaveKey(status.Node))
+		}
+	})
+
+	It("should serve the statuses while they're updated concurrently", func() {
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					tracker.Update(NodeScrapeStatus{Node: fmt.Sprintf("node-%d-%d", w, i)})
+				}
+			}(w)
+		}
+		for i := 0; i < 10; i++ {
+			rec := httptest.NewRecorder()
+			tracker.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/scrape-status", nil))
+			var statuses []NodeScrapeStatus
+			Expect(json.Unmarshal(rec.Body.Bytes(), &statuses)).To(Succeed())
+		}
+		wg.Wait()
+		Expect(tracker.List()).To(HaveLen(2000))
+	})
+})
+
+// BenchmarkScrapeStatusUpdates5kNodes measures the cost of recording statuses for 5000 nodes
+// from many scrape goroutines at once, while the debug endpoint is polled continuously, as it
+// is when many large clusters' statuses are watched.
+func BenchmarkScrapeStatusUpdates5kNodes(b *testing.B) {
+	const nodes = 5000
+	tracker := NewScrapeStatusTracker()
+	names := make([]string, nodes)
+	for i := range names {
+		names[i] = fmt.Sprintf("node-%d", i)
+		tracker.Update(NodeScrapeStatus{Node: names[i]})
+	}
+
+	stop := make(chan struct{})
+	var polls int64
+	var polling sync.WaitGroup
+	polling.Add(1)
+	go func() {
+		defer polling.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tracker.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/debug/scrape-status", nil))
+			atomic.AddInt64(&polls, 1)
+		}
+	}()
+
+	var next int64
+	start := time.Now()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&next, 1)
+			tracker.Update(NodeScrapeStatus{Node: names[i%nodes], Success: true})
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	polling.Wait()
+	b.ReportMetric(float64(polls)/time.Since(start).Seconds(), "polls/s")
+}
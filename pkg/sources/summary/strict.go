@@ -0,0 +1,319 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Fields of summaries unknown to metrics-server are ignored, which is right in production, but
+// hides schema drift as the Kubelet adds fields.  Decoding strictly reports the paths of the
+// unknown fields (named like subtrees, e.g. "pods.containers.cpu.psi") without failing: the
+// full decoder checks the whole summary, while the fast decoder checks the keys of the objects
+// it scans, but not those within the subtrees it skips or decodes with encoding/json.
+
+var unknownFieldsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "unknown_fields_total",
+		Help:      "Total number of Summary API responses containing fields unknown to metrics-server, by path (up to 100 of them, the rest counted as \"other\"), when decoding strictly",
+	},
+	[]string{"path"},
+)
+
+func init() {
+	prometheus.MustRegister(unknownFieldsTotal)
+}
+
+// extensionPaths are the paths of fields decoded despite being absent from the stats API
+// types (see swap.go).
+var extensionPaths = map[string]bool{
+	"node.swap":                  true,
+	"node.systemContainers.swap": true,
+	"pods.swap":                  true,
+	"pods.containers.swap":       true,
+}
+
+// jsonKeys caches the JSON keys of the fields of each struct type.
+var jsonKeys sync.Map
+
+// keysOf returns the JSON keys of the fields of the given struct type, including those of
+// its embedded structs, mapped to the types of their values.
+func keysOf(t reflect.Type) map[string]reflect.Type {
+	if keys, ok := jsonKeys.Load(t); ok {
+		return keys.(map[string]reflect.Type)
+	}
+	keys := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			for key, valueType := range keysOf(derefType(field.Type)) {
+				keys[key] = valueType
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		keys[name] = field.Type
+	}
+	jsonKeys.Store(t, keys)
+	return keys
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// knownKey checks if the given key is that of a field of the given struct type, or an
+// extension at the given path, matching keys case-insensitively as encoding/json does.
+func knownKey(t reflect.Type, key, path string) (reflect.Type, bool) {
+	if extensionPaths[path] {
+		return nil, true
+	}
+	keys := keysOf(t)
+	if valueType, ok := keys[key]; ok {
+		return valueType, true
+	}
+	for name, valueType := range keys {
+		if strings.EqualFold(name, key) {
+			return valueType, true
+		}
+	}
+	return nil, false
+}
+
+// unknownFields records the paths of the fields of the given decoded JSON value which are
+// unknown to the given type, below the given path.
+func unknownFields(value interface{}, t reflect.Type, path string, found map[string]bool) {
+	t = derefType(t)
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, fieldValue := range object {
+			fieldPath := joinPath(path, key)
+			valueType, known := knownKey(t, key, fieldPath)
+			if !known {
+				found[fieldPath] = true
+				continue
+			}
+			if valueType != nil {
+				unknownFields(fieldValue, valueType, fieldPath, found)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		elems, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for _, elem := range elems {
+			unknownFields(elem, t.Elem(), path, found)
+		}
+	case reflect.Map:
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for _, entry := range entries {
+			unknownFields(entry, t.Elem(), path, found)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// fullUnknownFields returns the paths of the fields of the given summary response unknown to
+// metrics-server, sorted, checking with encoding/json's DisallowUnknownFields first, so that
+// summaries without any are only decoded once more.
+func fullUnknownFields(body []byte) []string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&stats.Summary{}); err == nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil
+	}
+	found := make(map[string]bool)
+	unknownFields(decoded, reflect.TypeOf(stats.Summary{}), "", found)
+	return sortedPaths(found)
+}
+
+func sortedPaths(found map[string]bool) []string {
+	if len(found) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// maxUnknownFieldPaths bounds the number of distinct paths unknown_fields_total is labelled
+// with, since they're chosen by the Kubelets: any further paths are counted under
+// otherUnknownFieldPath instead.
+const maxUnknownFieldPaths = 100
+
+const otherUnknownFieldPath = "other"
+
+// endedCyclesKept is the number of recently ended cycles remembered, so that the unknown
+// fields found by their late scrapes (e.g. hedged ones) are warned about straight away,
+// rather than kept for a cycle which won't end again.
+const endedCyclesKept = 8
+
+// schemaDrift aggregates the unknown fields reported by each node's summary over each
+// collection cycle, warning about each path once the cycle ends, listing the nodes reporting it.
+type schemaDrift struct {
+	mu sync.Mutex
+	// cycles holds the nodes reporting each unknown path, by the cycle they were found in.
+	cycles   map[string]map[string][]string
+	ended    []string
+	labelled map[string]bool
+}
+
+func newSchemaDrift(config *KubeletClientConfig) *schemaDrift {
+	if !config.StrictDecoding {
+		return nil
+	}
+	return &schemaDrift{cycles: make(map[string]map[string][]string), labelled: make(map[string]bool)}
+}
+
+// report records the unknown fields found in the summary of the given context's node.  The
+// fields found over a cycle are warned about once it ends, while those found by scrapes
+// outside of cycles, or after theirs ended, are warned about straight away.
+func (d *schemaDrift) report(ctx context.Context, unknown []string) {
+	cycle := sources.CycleIDFrom(ctx)
+	node := nodeNameFrom(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, path := range unknown {
+		unknownFieldsTotal.WithLabelValues(d.label(path)).Inc()
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	if cycle == "" || d.hasEnded(cycle) {
+		paths := make(map[string][]string, len(unknown))
+		for _, path := range unknown {
+			paths[path] = []string{node}
+		}
+		warnUnknownFields(cycle, paths)
+		return
+	}
+	paths, ok := d.cycles[cycle]
+	if !ok {
+		paths = make(map[string][]string)
+		d.cycles[cycle] = paths
+	}
+	for _, path := range unknown {
+		paths[path] = append(paths[path], node)
+	}
+}
+
+// cycleEnded warns about each unknown field found over the given cycle, forgetting them.
+func (d *schemaDrift) cycleEnded(cycle string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	warnUnknownFields(cycle, d.cycles[cycle])
+	delete(d.cycles, cycle)
+	if len(d.ended) == endedCyclesKept {
+		copy(d.ended, d.ended[1:])
+		d.ended = d.ended[:len(d.ended)-1]
+	}
+	d.ended = append(d.ended, cycle)
+}
+
+func (d *schemaDrift) hasEnded(cycle string) bool {
+	for _, ended := range d.ended {
+		if ended == cycle {
+			return true
+		}
+	}
+	return false
+}
+
+// label returns the path to label unknown_fields_total with for the given path.
+func (d *schemaDrift) label(path string) string {
+	if d.labelled[path] {
+		return path
+	}
+	if len(d.labelled) >= maxUnknownFieldPaths {
+		return otherUnknownFieldPath
+	}
+	d.labelled[path] = true
+	return path
+}
+
+// warnUnknownFields warns about each of the given unknown fields, found in the given cycle.
+func warnUnknownFields(cycle string, paths map[string][]string) {
+	if len(paths) == 0 {
+		return
+	}
+	logger := logging.Background(loglevel.Client)
+	if cycle != "" {
+		logger = logger.WithValues("cycle", cycle)
+	}
+	for _, path := range sortedPaths(pathSet(paths)) {
+		nodes := paths[path]
+		sort.Strings(nodes)
+		logger.Warning("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift", "path", path, "nodes", len(nodes), "exampleNode", nodes[0])
+	}
+}
+
+func pathSet(paths map[string][]string) map[string]bool {
+	set := make(map[string]bool, len(paths))
+	for path := range paths {
+		set[path] = true
+	}
+	return set
+}
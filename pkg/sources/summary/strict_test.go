@@ -0,0 +1,202 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// driftedFields are the paths of the fields injected into the drift fixture, besides those
+// within skipped subtrees.
+var driftedFields = []string{"node.cpu.psi", "node.hugepages", "pods.containers.memory.swapBytes", "pods.podRef.generation", "pods.process_stats"}
+
+const otherUnknownFieldLabel = "other"
+
+// unknownFieldsCount fetches the number of unknown fields counted under the given path label.
+func unknownFieldsCount(path string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_unknown_fields_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "path" && label.GetValue() == path {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Strict Summary Decoding", func() {
+	var body []byte
+
+	BeforeEach(func() {
+		var err error
+		body, err = ioutil.ReadFile(filepath.Join("testdata", "drift", "unknown-fields.json"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should report the paths of unknown fields outside skipped subtrees with the fast decoder", func() {
+		skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		summary := &stats.Summary{}
+		unknown, err := SummaryDecoderFast.DecodeReportingUnknown(body, summary, skips, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unknown).To(Equal(driftedFields))
+		Expect(summary.Node.NodeName).To(Equal("node1"))
+	})
+
+	It("should report the paths of every unknown field with the full decoder", func() {
+		summary := &stats.Summary{}
+		unknown, err := SummaryDecoderFull.DecodeReportingUnknown(body, summary, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unknown).To(ConsistOf(append([]string{"pods.volume.health"}, driftedFields...)))
+		Expect(summary.Node.NodeName).To(Equal("node1"))
+	})
+
+	It("should not report the extensions decoded alongside a summary", func() {
+		unknown, err := SummaryDecoderFast.DecodeReportingUnknown(body, &stats.Summary{}, nil, &SwapSummary{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unknown).NotTo(ContainElement(HavePrefix("node.swap")))
+		Expect(unknown).NotTo(ContainElement(HavePrefix("pods.containers.swap")))
+	})
+
+	It("should decode summaries with unknown fields just the same when not decoding strictly", func() {
+		strict, lenient := &stats.Summary{}, &stats.Summary{}
+		_, err := SummaryDecoderFast.DecodeReportingUnknown(body, strict, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(SummaryDecoderFast.DecodeSkippingWithSwap(body, lenient, nil, nil)).To(Succeed())
+		Expect(lenient).To(Equal(strict))
+	})
+
+	Context("when scraping Kubelets", func() {
+		var (
+			kubelet  *fakeKubelet
+			server   *httptest.Server
+			recorder *logging.Recorder
+		)
+
+		BeforeEach(func() {
+			kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: string(body)}
+			server = httptest.NewServer(kubelet)
+			recorder = &logging.Recorder{}
+			logging.SetDefaultSink(recorder)
+		})
+
+		AfterEach(func() {
+			logging.SetDefaultSink(logging.GlogSink{})
+			server.Close()
+		})
+
+		scrape := func(client KubeletInterface, host, cycle, node string) *Provenance {
+			ctx := WithNodeName(sources.WithCycleID(context.Background(), cycle), node)
+			_, prov, err := client.GetSummary(ctx, host)
+			Expect(err).NotTo(HaveOccurred())
+			return prov
+		}
+
+		endCycle := func(client KubeletInterface, cycle string) {
+			client.(sources.CycleEndObserver).CycleEnded(cycle)
+		}
+
+		It("should record unknown fields in the provenance, warning about each once per cycle, once it ends", func() {
+			client, host := directClientWith(server, KubeletClientConfig{StrictDecoding: true})
+
+			By("scraping two nodes in the first cycle, and one in the next before the first ends")
+			Expect(scrape(client, host, "cycle-1", "node2").UnknownFields).To(Equal(driftedFields))
+			Expect(scrape(client, host, "cycle-1", "node1").UnknownFields).To(Equal(driftedFields))
+			scrape(client, host, "cycle-2", "node1")
+			Expect(recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")).To(BeEmpty())
+
+			By("ending the first cycle")
+			endCycle(client, "cycle-1")
+			entries := recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")
+			Expect(entries).To(HaveLen(len(driftedFields)))
+			for i, entry := range entries {
+				Expect(entry.Severity).To(Equal("warning"))
+				Expect(entry.Fields).To(Equal(map[string]interface{}{"cycle": "cycle-1", "path": driftedFields[i], "nodes": 2, "exampleNode": "node1"}))
+			}
+
+			By("ending the last cycle, with nothing scraped after it")
+			endCycle(client, "cycle-2")
+			entries = recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")
+			Expect(entries).To(HaveLen(2 * len(driftedFields)))
+			Expect(entries[len(driftedFields)].Fields).To(Equal(map[string]interface{}{"cycle": "cycle-2", "path": driftedFields[0], "nodes": 1, "exampleNode": "node1"}))
+		})
+
+		It("should warn straight away about unknown fields found by scrapes finishing after their cycle ended", func() {
+			client, host := directClientWith(server, KubeletClientConfig{StrictDecoding: true})
+			scrape(client, host, "cycle-1", "node1")
+			endCycle(client, "cycle-1")
+			warned := len(recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift"))
+
+			scrape(client, host, "cycle-1", "node2")
+			entries := recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")[warned:]
+			Expect(entries).To(HaveLen(len(driftedFields)))
+			Expect(entries[0].Fields).To(Equal(map[string]interface{}{"cycle": "cycle-1", "path": driftedFields[0], "nodes": 1, "exampleNode": "node2"}))
+		})
+
+		It("should count the unknown fields of paths beyond the first hundred under a single label", func() {
+			var decoded map[string]interface{}
+			Expect(json.Unmarshal(body, &decoded)).To(Succeed())
+			node := decoded["node"].(map[string]interface{})
+			for i := 0; i < 120; i++ {
+				node[fmt.Sprintf("drift%03d", i)] = i
+			}
+			drifted, err := json.Marshal(decoded)
+			Expect(err).NotTo(HaveOccurred())
+			kubelet.body = string(drifted)
+
+			client, host := directClientWith(server, KubeletClientConfig{StrictDecoding: true})
+			before := unknownFieldsCount(otherUnknownFieldLabel)
+			Expect(scrape(client, host, "", "node1").UnknownFields).To(HaveLen(120 + len(driftedFields)))
+			Expect(unknownFieldsCount(otherUnknownFieldLabel) - before).To(BeEquivalentTo(120 + len(driftedFields) - 100))
+		})
+
+		It("should warn straight away about unknown fields found outside collection cycles", func() {
+			client, host := directClientWith(server, KubeletClientConfig{StrictDecoding: true})
+			scrape(client, host, "", "node1")
+			entries := recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")
+			Expect(entries).To(HaveLen(len(driftedFields)))
+			Expect(entries[0].Fields).To(Equal(map[string]interface{}{"path": driftedFields[0], "nodes": 1, "exampleNode": "node1"}))
+		})
+
+		It("should neither record nor warn about unknown fields when not decoding strictly", func() {
+			client, host := directClientWith(server, KubeletClientConfig{})
+			Expect(scrape(client, host, "cycle-1", "node1").UnknownFields).To(BeNil())
+			scrape(client, host, "cycle-2", "node1")
+			Expect(recorder.Find("Kubelet summaries contain a field unknown to metrics-server, which may be schema drift")).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,202 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Besides the fields metrics-server reads, the fast decoder can decode the rest of a summary too,
+// except for the subtrees it's configured to skip, which are skipped without being decoded (or
+// allocated).  By default, it skips every subtree nothing reads, so that it only decodes the fields
+// read, and features reading more (e.g. accelerator stats) retain the subtrees they need.
+// Subtrees are named by the path of JSON keys leading to them, e.g. "pods.volume", or
+// "pods.containers.rootfs" for the root filesystem stats of every pod's containers.  Subtrees
+// holding the fields metrics-server reads can't be skipped.  The full decoder never skips anything.
+
+var (
+	// DefaultSkippedSubtrees are the subtrees the fast decoder skips by default, which
+	// are all those that are skippable (the system containers' subtrees within theirs).
+	DefaultSkippedSubtrees = []string{
+		"node.systemContainers",
+		"node.startTime",
+		"node.network",
+		"node.fs",
+		"pods.startTime",
+		"pods.cpu",
+		"pods.memory",
+		"pods.network",
+		"pods.volume",
+		"pods.ephemeral-storage",
+		"pods.containers.startTime",
+		"pods.containers.rootfs",
+		"pods.containers.logs",
+		"pods.containers.accelerators",
+		"pods.containers.userDefinedMetrics",
+	}
+
+	// EphemeralStorageSubtrees are the subtrees that go into the ephemeral storage usage of pods
+	// (their own, their containers' root filesystems and logs, and their volumes, some of which
+	// are ephemeral), which are never skipped when retaining ephemeral storage.
+	EphemeralStorageSubtrees = []string{
+		"pods.ephemeral-storage",
+		"pods.volume",
+		"pods.containers.rootfs",
+		"pods.containers.logs",
+	}
+
+	// AcceleratorSubtrees are the subtrees holding the accelerator stats of pods'
+	// containers, which must be retained to pass through their accelerator usage.
+	AcceleratorSubtrees = []string{
+		"pods.containers.accelerators",
+	}
+
+	// StartTimeSubtrees are the subtrees holding the start times of nodes and pods'
+	// containers, which must be retained to tell when their usage history restarts.
+	StartTimeSubtrees = []string{
+		"node.startTime",
+		"pods.containers.startTime",
+	}
+)
+
+// containerSubtrees are the paths of the skippable subtrees of the containers at some path.  The
+// paths of subtrees holding fields which are read are empty, since those aren't skippable.
+type containerSubtrees struct {
+	startTime, cpu, memory, rootfs, logs, accelerators, userDefinedMetrics string
+}
+
+var (
+	podContainerSubtrees = containerSubtrees{
+		startTime:          "pods.containers.startTime",
+		rootfs:             "pods.containers.rootfs",
+		logs:               "pods.containers.logs",
+		accelerators:       "pods.containers.accelerators",
+		userDefinedMetrics: "pods.containers.userDefinedMetrics",
+	}
+	systemContainerSubtrees = containerSubtrees{
+		startTime:          "node.systemContainers.startTime",
+		cpu:                "node.systemContainers.cpu",
+		memory:             "node.systemContainers.memory",
+		rootfs:             "node.systemContainers.rootfs",
+		logs:               "node.systemContainers.logs",
+		accelerators:       "node.systemContainers.accelerators",
+		userDefinedMetrics: "node.systemContainers.userDefinedMetrics",
+	}
+)
+
+// skippableSubtrees are the paths of all the subtrees which may be skipped.
+var skippableSubtrees = func() map[string]bool {
+	res := map[string]bool{
+		"node.systemContainers":  true,
+		"node.startTime":         true,
+		"node.network":           true,
+		"node.fs":                true,
+		"pods.startTime":         true,
+		"pods.cpu":               true,
+		"pods.memory":            true,
+		"pods.network":           true,
+		"pods.volume":            true,
+		"pods.ephemeral-storage": true,
+	}
+	for _, subtrees := range []containerSubtrees{podContainerSubtrees, systemContainerSubtrees} {
+		for _, path := range []string{subtrees.startTime, subtrees.cpu, subtrees.memory, subtrees.rootfs, subtrees.logs, subtrees.accelerators, subtrees.userDefinedMetrics} {
+			if path != "" {
+				res[path] = true
+			}
+		}
+	}
+	return res
+}()
+
+var skippedBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "skipped_bytes_total",
+		Help:      "The number of bytes of summaries skipped without being decoded, by the subtree they held",
+	},
+	[]string{"subtree"},
+)
+
+func init() {
+	prometheus.MustRegister(skippedBytes)
+}
+
+// SubtreeSkips is a set of subtrees for the fast decoder to skip.  A nil set skips nothing.
+type SubtreeSkips struct {
+	paths map[string]bool
+}
+
+// defaultSubtreeSkips skips the DefaultSkippedSubtrees.
+var defaultSubtreeSkips = func() *SubtreeSkips {
+	skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+	if err != nil {
+		panic(err)
+	}
+	return skips
+}()
+
+// NewSubtreeSkips returns the set of the given subtrees, which must all be skippable.  If
+// retainEphemeralStorage is set, the EphemeralStorageSubtrees are left out of it, so that they're
+// decoded even if they're listed, for anything that reads the ephemeral storage usage of pods.
+func NewSubtreeSkips(paths []string, retainEphemeralStorage bool) (*SubtreeSkips, error) {
+	skips := &SubtreeSkips{paths: make(map[string]bool, len(paths))}
+	for _, path := range paths {
+		if !skippableSubtrees[path] {
+			return nil, fmt.Errorf("unknown summary subtree %q, must be one of %v", path, SkippableSubtrees())
+		}
+		skips.paths[path] = true
+	}
+	if retainEphemeralStorage {
+		for _, path := range EphemeralStorageSubtrees {
+			delete(skips.paths, path)
+		}
+	}
+	return skips, nil
+}
+
+// SkippableSubtrees returns the paths of all the subtrees which may be skipped, in order.
+func SkippableSubtrees() []string {
+	res := make([]string, 0, len(skippableSubtrees))
+	for path := range skippableSubtrees {
+		res = append(res, path)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Skips checks if the subtree at the given path is skipped.
+func (s *SubtreeSkips) Skips(path string) bool {
+	return s != nil && s.paths[path]
+}
+
+// Retaining returns a copy of the set without the given subtrees, so that they're
+// decoded even if they were skipped (e.g. for features which read them).
+func (s *SubtreeSkips) Retaining(paths []string) *SubtreeSkips {
+	if s == nil {
+		return nil
+	}
+	res := &SubtreeSkips{paths: make(map[string]bool, len(s.paths))}
+	for path := range s.paths {
+		res.paths[path] = true
+	}
+	for _, path := range paths {
+		delete(res.paths, path)
+	}
+	return res
+}
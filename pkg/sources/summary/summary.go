@@ -16,16 +16,23 @@ package summary
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
 	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	v1listers "k8s.io/client-go/listers/core/v1"
 	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
@@ -53,31 +60,277 @@ var (
 		},
 		[]string{"success"},
 	)
+	podsDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "pods_dropped_total",
+			Help:      "Total number of pod entries dropped from Summary API responses for exceeding the pods-per-node cap",
+		},
+		[]string{"node"},
+	)
+	warmingUpTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "warming_up_scrapes_total",
+			Help:      "Total number of Summary API scrapes of recently created nodes that had no node stats yet",
+		},
+		[]string{"node"},
+	)
+	nodeMismatchTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "node_name_mismatches_total",
+			Help:      "Total number of Summary API responses that reported a different node name than the node scraped",
+		},
+		[]string{"node"},
+	)
+	scrapeErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "scrape_errors_total",
+			Help:      "Total number of failed Summary API scrapes, by class of error and node pool",
+		},
+		[]string{"class", "node_pool"},
+	)
+	proxyErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet_summary",
+			Name:      "proxy_errors_total",
+			Help:      "Total number of failed Summary API scrapes where the API server proxy couldn't reach the Kubelet, by reason and node pool",
+		},
+		[]string{"reason", "node_pool"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(summaryRequestLatency)
 	prometheus.MustRegister(scrapeTotal)
+	prometheus.MustRegister(podsDroppedTotal)
+	prometheus.MustRegister(warmingUpTotal)
+	prometheus.MustRegister(nodeMismatchTotal)
+	prometheus.MustRegister(scrapeErrorsTotal)
+	prometheus.MustRegister(proxyErrorsTotal)
+}
+
+// DefaultMaxPodsPerNode is the default cap on pods processed in a single
+// node's summary, comfortably above the Kubelet's default max-pods.
+const DefaultMaxPodsPerNode = 1000
+
+// DefaultWarmupGracePeriod is the default period after a node's creation during
+// which a summary without node stats is treated as the Kubelet warming up.
+const DefaultWarmupGracePeriod = 5 * time.Minute
+
+// DefaultNodePoolLabels are the node labels checked, in order, for the name
+// of a node's pool, covering the common managed Kubernetes offerings.
+var DefaultNodePoolLabels = []string{
+	"cloud.google.com/gke-nodepool",
+	"eks.amazonaws.com/nodegroup",
+	"kubernetes.azure.com/agentpool",
+	"agentpool",
+}
+
+// unknownNodePool is the node pool reported in metrics for nodes without any node pool label.
+const unknownNodePool = "unknown"
+
+// SourceOptions holds the optional settings for summary metrics sources.
+type SourceOptions struct {
+	// Statuses, if non-nil, records the outcome of each scrape.
+	Statuses *ScrapeStatusTracker
+	// MaxPodsPerNode caps the number of pods processed from a single summary.
+	// Pods beyond the cap are dropped in namespace/name order, so the same pods
+	// are dropped each cycle.  Zero means no cap.
+	MaxPodsPerNode int
+	// Priority, if non-nil, determines which pods are never dropped by the
+	// pods-per-node cap (and are ordered first in the batch when it applies).
+	Priority priority.Namespaces
+	// Namespaces, if non-nil, restricts the pods collected to those in the namespaces it
+	// allows.  The metrics API enforces it again, so this just avoids storing the rest.
+	Namespaces *provider.NamespaceAllowlist
+	// WarmupGracePeriod is the period after a node's creation during which a summary
+	// without any node stats is recorded as warming up, rather than as an error.
+	// Zero disables this.
+	WarmupGracePeriod time.Duration
+	// NodeNameVerification controls what happens when a summary reports
+	// a different node name than the node scraped.  It defaults to enforcing.
+	NodeNameVerification NodeNameVerification
+	// NodePoolLabels are the node labels checked, in order, for the name
+	// of a node's pool, which is used to break down error metrics.
+	NodePoolLabels []string
+	// NodeFilter, if non-nil, restricts the nodes scraped to those it selects
+	// (e.g. leaving nodes that don't serve the summary API to other sources).
+	NodeFilter sources.NodeFilter
+	// PageFaultRates enables calculating the memory page fault rates of containers.
+	PageFaultRates bool
+	// MaxRateGap, if non-zero, is the longest time between two samples that page fault
+	// rates are calculated over.  Rates over longer gaps (e.g. after failed scrapes)
+	// aren't reported, since averaging over them hides spikes.
+	MaxRateGap time.Duration
+	// CPUThrottlingRates enables calculating the CPU throttling rates of containers,
+	// from an auxiliary scrape of each Kubelet's cAdvisor metrics (see throttling.go).
+	// MaxRateGap applies to them too.
+	CPUThrottlingRates bool
+	// ExcludedContainers, if non-nil, selects containers to leave out of pod-level
+	// aggregates, or drop entirely, depending on its mode.
+	ExcludedContainers *ContainerFilter
+	// NodeHealthSignals enables publishing health signals from each node's summary
+	// (such as its PID limits) as per-node Prometheus gauges.
+	NodeHealthSignals bool
+	// FailureEvents, if non-nil, records events on nodes whose scrapes keep failing.
+	FailureEvents *ScrapeFailureEvents
+	// InFlight, if non-nil, tracks scrapes in progress, so that they're
+	// cancelled when their node is deleted mid-cycle.
+	InFlight *InFlightScrapes
+	// PodTimestampLagThreshold is how far a pod's sample time may lag its node's
+	// timestamp before the pod is called out in the logs.  Zero disables this.
+	PodTimestampLagThreshold time.Duration
+	// CPURateConsistencyRatio, if non-zero, enables checking the CPU usage rates reported
+	// by the Kubelet against the rates derived from its cumulative CPU usage, serving the
+	// latter, and flagging rates that diverge by more than this ratio (see cpurate.go).
+	// MaxRateGap applies to the derived rates too.
+	CPURateConsistencyRatio float64
+	// WarmStart, if non-nil, restores the cumulative CPU usage sampled before a restart as the
+	// baselines of the first scrapes, and saves it for the next (see warmstart.go).  It's only
+	// used when checking CPU rate consistency.
+	WarmStart *WarmStart
+	// StaleSummaryWarningThreshold is the number of consecutive stale summaries (served
+	// unchanged from the Kubelet's cache, see stalesummary.go) from a node after which a
+	// warning is logged.  Zero disables the warning.
+	StaleSummaryWarningThreshold int
+	// AcceleratorStats enables passing through the usage of the accelerators attached to
+	// containers.  The fast decoder skips accelerator stats by default, so the Kubelet
+	// client must be configured to retain the AcceleratorSubtrees too.
+	AcceleratorStats bool
+	// SwapStats enables collecting the swap usage of nodes, pods and containers, from
+	// Kubelets that report it (see swap.go), if the Kubelet client can decode it.
+	SwapStats bool
+	// PodUsageTolerance, if non-zero, enables checking the CPU and memory usage of each
+	// pod's containers against the pod-level usage, scaling down the usage of containers
+	// that add up to more than this fraction above it (see podusage.go).  The Kubelet
+	// client must not skip the PodUsageSubtrees.
+	PodUsageTolerance float64
+	// PodMemoryOverhead enables calculating how far each pod's pod-level memory usage exceeds
+	// its containers' (see podusage.go).  The Kubelet client must not skip the PodUsageSubtrees.
+	PodMemoryOverhead bool
+	// LastBatchMaxAge, if non-zero, is how long after it was collected the last good batch of
+	// a node may still be served in place of a failed scrape (while the circuit to the API
+	// server is open, or when the summary reports another node).  Older batches are dropped,
+	// so that a node whose scrapes keep failing doesn't report frozen usage forever.
+	LastBatchMaxAge time.Duration
+	// AddressFallbackTTL, if non-zero, enables falling back through each node's candidate
+	// addresses (see CandidateNodeAddressResolver) in turn when connecting to one fails,
+	// remembering the candidate found working for this long (see candidates.go).
+	AddressFallbackTTL time.Duration
+	// Provenance enables recording where the metrics of each node and pod came from
+	// (see sources.Provenance), marking the last-known data served again when a scrape
+	// fails as stale (see provenance.go).
+	Provenance bool
+}
+
+// NodeNameVerification controls how summaries reporting a different node name
+// than the node scraped (e.g. due to a recycled IP) are handled.
+type NodeNameVerification string
+
+const (
+	// NodeNameVerificationEnforce rejects mismatched summaries, keeping the previous data for the node.
+	NodeNameVerificationEnforce NodeNameVerification = "enforce"
+	// NodeNameVerificationWarn logs mismatched summaries, but otherwise accepts them.
+	NodeNameVerificationWarn NodeNameVerification = "warn"
+)
+
+// ErrNodeMismatch indicates that a summary reported a different node name than the node scraped.
+type ErrNodeMismatch struct {
+	Requested string
+	Reported  string
+}
+
+func (err *ErrNodeMismatch) Error() string {
+	return fmt.Sprintf("summary for node %q reported node name %q, discarding data", err.Requested, err.Reported)
+}
+
+// IsNodeMismatchError checks if the given error (or any error it wraps) is an ErrNodeMismatch.
+func IsNodeMismatchError(err error) bool {
+	var mismatchErr *ErrNodeMismatch
+	return errors.As(err, &mismatchErr)
 }
 
 // NodeInfo contains the information needed to identify and connect to a particular node
 // (node name and preferred address).
 type NodeInfo struct {
-	Name           string
+	Name string
+	// UID is the UID of the node object, if known.
+	UID            types.UID
 	ConnectAddress string
+	// CandidateAddresses, if there are several, lists the addresses to fall back through in
+	// turn when connecting to the node fails, in order of preference, from ConnectAddress on.
+	CandidateAddresses []string
+	// CreationTimestamp is the creation time of the node object, if known.
+	CreationTimestamp time.Time
+	// Pool is the name of the node pool that the node belongs to, if known.
+	Pool string
+	// Zone is the name of the availability zone that the node is in, if known.
+	Zone string
 }
 
 // Kubelet-provided metrics for pod and system container.
 type summaryMetricsSource struct {
 	node          NodeInfo
 	kubeletClient KubeletInterface
+	opts          SourceOptions
+	// lastBatches, if non-nil, holds the last good batch for each node,
+	// to fall back to when a summary is rejected.
+	lastBatches *batchCache
+	// faults, if non-nil, holds the last page fault counts for each node,
+	// to calculate page fault rates from.
+	faults *faultTracker
+	// throttling, if non-nil, holds the last throttled times for each node,
+	// to calculate CPU throttling rates from.
+	throttling *throttleTracker
+	// addrFallback, if non-nil, remembers the candidate address found working for
+	// each node, when its preferred address is unreachable.
+	addrFallback *addressFallback
+	// cpuRates, if non-nil, holds the last cumulative CPU usage of each node,
+	// to check the CPU usage rates reported against.
+	cpuRates *cpuRateTracker
+	// health, if non-nil, publishes the health signals of each node.
+	health *healthTracker
+	// stale, if non-nil, detects nodes serving the same cached summary in consecutive scrapes.
+	stale *staleSummaryTracker
+	// translator translates each summary collected into a batch.
+	translator translate.BatchTranslator
+	// nodeLister and addrResolver, if non-nil, are used to check that the node
+	// scraped is still the node by that name once its scrape completes.
+	nodeLister   v1listers.NodeLister
+	addrResolver NodeAddressResolver
 }
 
-func NewSummaryMetricsSource(node NodeInfo, client KubeletInterface) sources.MetricSource {
-	return &summaryMetricsSource{
+// NewSummaryMetricsSource creates a new MetricSource for the given node.
+func NewSummaryMetricsSource(node NodeInfo, client KubeletInterface, opts SourceOptions) sources.MetricSource {
+	src := &summaryMetricsSource{
 		node:          node,
 		kubeletClient: client,
+		opts:          opts,
+		translator:    newSummaryTranslator(opts),
+		stale:         newStaleSummaryTracker(),
+	}
+	if opts.PageFaultRates {
+		src.faults = newFaultTracker()
+	}
+	if opts.CPUThrottlingRates {
+		src.throttling = newThrottleTracker()
+	}
+	if opts.CPURateConsistencyRatio > 0 {
+		src.cpuRates = newCPURateTracker()
+		opts.WarmStart.attach(src.cpuRates)
 	}
+	if opts.NodeHealthSignals {
+		src.health = newHealthTracker()
+	}
+	return src
 }
 
 func (src *summaryMetricsSource) Name() string {
@@ -89,169 +342,436 @@ func (src *summaryMetricsSource) String() string {
 }
 
 func (src *summaryMetricsSource) Collect(ctx context.Context) (*sources.MetricsBatch, error) {
-	summary, err := func() (*stats.Summary, error) {
-		startTime := time.Now()
-		defer summaryRequestLatency.WithLabelValues(src.node.Name).Observe(float64(time.Since(startTime)) / float64(time.Second))
-		return src.kubeletClient.GetSummary(ctx, src.node.ConnectAddress)
+	logger := logging.FromContext(ctx, loglevel.Scraper).WithValues("node", src.node.Name)
+	ctx = logging.NewContext(ctx, logger)
+	scrapeCtx, nodeDeleted, scrapeDone := src.opts.InFlight.start(ctx, src.node)
+	defer scrapeDone()
+
+	scrapeTime := time.Now()
+	summary, swap, prov, addr, err := func() (*stats.Summary, *SwapSummary, *Provenance, string, error) {
+		defer summaryRequestLatency.WithLabelValues(src.node.Name).Observe(float64(time.Since(scrapeTime)) / float64(time.Second))
+		return src.fetch(withNodeZone(WithNodeName(scrapeCtx, src.node.Name), src.node.Zone))
 	}()
+	if releaser, ok := src.kubeletClient.(summaryReleaser); ok && summary != nil {
+		// nothing kept from the summary may point into it, since it's reused once released
+		defer releaser.ReleaseSummary(summary)
+	}
 
+	if nodeDeleted() {
+		logger.V(2).Info(fmt.Sprintf("node %q was deleted during its scrape, discarding its data", src.node.Name))
+		// not a failure, but record why the scrape was cut short
+		src.recordStatus(ctx, scrapeTime, prov, context.Cause(scrapeCtx), nil, nil)
+		return &sources.MetricsBatch{}, nil
+	}
 	if err != nil {
 		scrapeTotal.WithLabelValues("false").Inc()
-		return nil, fmt.Errorf("unable to fetch metrics from Kubelet %s (%s): %v", src.node.Name, src.node.ConnectAddress, err)
+		src.recordError(err)
+		src.recordStatus(ctx, scrapeTime, prov, err, nil, nil)
+		var stale *sources.MetricsBatch
+		if canceled, ok := sources.CancelCause(err); IsCircuitOpenError(err) || (ok && canceled.Reason == sources.CancelReasonCircuitOpen) {
+			// keep serving the last-known data, rather than dropping the node while the API server recovers
+			stale = src.staleBatch(src.lastBatches.get(src.node.Name, src.opts.LastBatchMaxAge))
+		}
+		return stale, fmt.Errorf("unable to fetch metrics from Kubelet %s (%s): %w", src.node.Name, addr, err)
 	}
 
 	scrapeTotal.WithLabelValues("true").Inc()
 
-	res := &sources.MetricsBatch{
-		Nodes: make([]sources.NodeMetricsPoint, 1),
-		Pods:  make([]sources.PodMetricsPoint, len(summary.Pods)),
+	if exists, replacedErr := src.checkIdentity(logger, addr); !exists {
+		logger.V(2).Info(fmt.Sprintf("node %q was deleted during its scrape, discarding its data", src.node.Name))
+		return &sources.MetricsBatch{}, nil
+	} else if replacedErr != nil {
+		src.recordError(replacedErr)
+		src.recordStatus(ctx, scrapeTime, prov, replacedErr, nil, nil)
+		return nil, replacedErr
 	}
 
-	var errs []error
-	errs = append(errs, src.decodeNodeStats(&summary.Node, &res.Nodes[0])...)
-	if len(errs) != 0 {
-		// if we had errors providing node metrics, discard the data point
-		// so that we don't incorrectly report metric values as zero.
-		res.Nodes = res.Nodes[:1]
-	}
-
-	num := 0
-	for _, pod := range summary.Pods {
-		podErrs := src.decodePodStats(&pod, &res.Pods[num])
-		errs = append(errs, podErrs...)
-		if len(podErrs) != 0 {
-			// NB: we explicitly want to discard pods with partial results, since
-			// the horizontal pod autoscaler takes special action when a pod is missing
-			// metrics (and zero CPU or memory does not count as "missing metrics")
-
-			// we don't care if we reuse slots in the result array,
-			// because they get completely overwritten in decodePodStats
-			continue
+	var profile KubeletProfile
+	if prov != nil {
+		profile = prov.Profile
+	}
+	var notes []string
+	if reported := summary.Node.NodeName; reported != src.node.Name {
+		switch {
+		case reported == "" && profile.expectsMissing(FieldNodeName):
+			// we can't tell, but the Kubelet's profile says not to expect it to
+		case reported == "":
+			// we can't tell, so just assume it's the right node
+			notes = append(notes, "summary did not report a node name, so it could not be verified")
+		case src.opts.NodeNameVerification == NodeNameVerificationWarn:
+			nodeMismatchTotal.WithLabelValues(src.node.Name).Inc()
+			logger.Warning(fmt.Sprintf("summary for node %q reported node name %q, accepting it anyway", src.node.Name, reported), "reportedNode", reported)
+			notes = append(notes, fmt.Sprintf("summary reported node name %q", reported))
+		default:
+			nodeMismatchTotal.WithLabelValues(src.node.Name).Inc()
+			mismatchErr := &ErrNodeMismatch{Requested: src.node.Name, Reported: reported}
+			src.recordError(mismatchErr)
+			src.recordStatus(ctx, scrapeTime, prov, mismatchErr, nil, nil)
+			// keep the previous data, rather than storing another node's metrics under this name
+			return src.staleBatch(src.lastBatches.get(src.node.Name, src.opts.LastBatchMaxAge)), mismatchErr
 		}
-		num++
 	}
-	res.Pods = res.Pods[:num]
 
-	return res, utilerrors.NewAggregate(errs)
+	src.health.record(src.node.Name, &summary.Node)
+
+	if src.warmingUp(&summary.Node) {
+		// the Kubelet on a freshly joined node serves a summary before it has
+		// any stats, which isn't a failure, so just try again next cycle.
+		warmingUpTotal.WithLabelValues(src.node.Name).Inc()
+		logger.V(2).Info(fmt.Sprintf("node %q has no stats yet, assuming its Kubelet is still warming up", src.node.Name))
+		src.recordWarmingUp(ctx, scrapeTime, prov)
+		return &sources.MetricsBatch{}, nil
+	}
+
+	if stale := src.stale.observe(src.node.Name, &summary.Node, src.opts.StaleSummaryWarningThreshold); stale > 0 {
+		notes = append(notes, staleSummaryNote(stale))
+	}
+
+	pods := summary.Pods
+	if src.opts.Namespaces != nil {
+		pods = allowedPods(pods, src.opts.Namespaces)
+	}
+	if max := src.opts.MaxPodsPerNode; max > 0 && len(pods) > max {
+		pods = capPods(pods, max, src.opts.Priority)
+		dropped := len(summary.Pods) - len(pods)
+		podsDroppedTotal.WithLabelValues(src.node.Name).Add(float64(dropped))
+		logger.Warning(fmt.Sprintf("node %q reported %d pods, more than the cap of %d; dropping %d pods", src.node.Name, len(summary.Pods), max, dropped), "pods", len(summary.Pods), "cap", max, "dropped", dropped)
+		notes = append(notes, fmt.Sprintf("dropped %d pods exceeding the cap of %d pods per node", dropped, max))
+	}
+
+	if missing := profile.unexpectedlyMissing(summary, pods, &src.opts); len(missing) > 0 {
+		notes = append(notes, missingFieldsNote(profile, missing))
+	}
+
+	payload := &summaryPayload{
+		summary:  summary,
+		pods:     pods,
+		swap:     swap,
+		cpuCheck: src.cpuRates.check(src.node.Name, src.opts.CPURateConsistencyRatio, src.opts.MaxRateGap),
+	}
+	if src.faults != nil {
+		payload.prevFaults = src.faults.get(src.node.Name)
+		payload.nextFaults = make(faultSamples, len(payload.prevFaults))
+	}
+	res, translateErr := src.translator.Translate(translate.Node{Name: src.node.Name, Address: addr}, payload)
+	if note := src.recordPodLags(res.Nodes[0].Timestamp, res.Pods); note != "" {
+		notes = append(notes, note)
+	}
+	if src.faults != nil {
+		src.faults.set(src.node.Name, payload.nextFaults)
+	}
+	var inconsistentCPURates []CPURateInconsistency
+	if note := src.cpuRates.finish(src.node.Name, payload.cpuCheck); note != "" {
+		notes = append(notes, note)
+		inconsistentCPURates = payload.cpuCheck.inconsistencies
+	}
+	src.addThrottling(scrapeCtx, res, addr)
+	src.attachProvenance(ctx, res, scrapeTime, prov, addr)
+
+	if translateErr == nil {
+		src.lastBatches.set(src.node.Name, res)
+	}
+	src.recordStatus(ctx, scrapeTime, prov, translateErr, notes, inconsistentCPURates)
+	return res, translateErr
 }
 
-func (src *summaryMetricsSource) decodeNodeStats(nodeStats *stats.NodeStats, target *sources.NodeMetricsPoint) []error {
-	timestamp, err := getScrapeTime(nodeStats.CPU, nodeStats.Memory)
-	if err != nil {
-		// if we can't get a timestamp, assume bad data in general
-		return []error{fmt.Errorf("unable to get valid timestamp for metric point for node %q, discarding data: %v", src.node.ConnectAddress, err)}
+// fetch fetches the summary (and swap summary, if enabled) of the node, returning the address
+// it was fetched from.  When the node has several candidate addresses, and connecting to one
+// fails, the next is tried in turn (see FetchFromCandidates), starting from the one last found
+// working, if any.
+func (src *summaryMetricsSource) fetch(ctx context.Context) (*stats.Summary, *SwapSummary, *Provenance, string, error) {
+	addrs := src.addrFallback.order(src.node.Name, src.node.CandidateAddresses)
+	if len(addrs) < 2 {
+		summary, swap, prov, err := src.fetchFrom(ctx, src.node.ConnectAddress)
+		return summary, swap, prov, src.node.ConnectAddress, err
 	}
-	*target = sources.NodeMetricsPoint{
-		Name: src.node.Name,
-		MetricsPoint: sources.MetricsPoint{
-			Timestamp: timestamp,
-		},
+
+	var summary *stats.Summary
+	var swap *SwapSummary
+	var prov *Provenance
+	addr, err := FetchFromCandidates(ctx, src.node.Name, addrs, func(ctx context.Context, addr string) error {
+		var err error
+		summary, swap, prov, err = src.fetchFrom(ctx, addr)
+		return err
+	})
+	if err == nil {
+		src.addrFallback.found(src.node.Name, src.node.CandidateAddresses, addr)
 	}
-	var errs []error
-	if err := decodeCPU(&target.CpuUsage, nodeStats.CPU); err != nil {
-		errs = append(errs, fmt.Errorf("unable to get CPU for node %q, discarding data: %v", src.node.ConnectAddress, err))
+	if prov != nil {
+		// the same provenance may be shared by coalesced requests, so annotate a copy
+		annotated := *prov
+		annotated.Candidates = src.node.CandidateAddresses
+		prov = &annotated
 	}
-	if err := decodeMemory(&target.MemoryUsage, nodeStats.Memory); err != nil {
-		errs = append(errs, fmt.Errorf("unable to get memory for node %q, discarding data: %v", src.node.ConnectAddress, err))
+	return summary, swap, prov, addr, err
+}
+
+// fetchFrom fetches the summary (and swap summary, if enabled) of the node from the given address.
+func (src *summaryMetricsSource) fetchFrom(ctx context.Context, addr string) (*stats.Summary, *SwapSummary, *Provenance, error) {
+	if getter, ok := src.kubeletClient.(swapSummaryGetter); ok && src.opts.SwapStats {
+		return getter.GetSummaryWithSwap(ctx, addr)
 	}
-	return errs
+	summary, prov, err := src.kubeletClient.GetSummary(ctx, addr)
+	return summary, nil, prov, err
 }
 
-func (src *summaryMetricsSource) decodePodStats(podStats *stats.PodStats, target *sources.PodMetricsPoint) []error {
-	// completely overwrite data in the target
-	*target = sources.PodMetricsPoint{
-		Name:       podStats.PodRef.Name,
-		Namespace:  podStats.PodRef.Namespace,
-		Containers: make([]sources.ContainerMetricsPoint, len(podStats.Containers)),
+// checkIdentity checks that the node scraped (at the given address) is still the node by that
+// name, returning false if it's gone, or an error if it was re-created (with a new UID) at a
+// different address, since the summary then came from whatever was at the old address.  A node
+// re-created at the same address (or with it still among its candidates) keeps its results,
+// which are committed under its name, and so its new identity.
+func (src *summaryMetricsSource) checkIdentity(logger logging.Logger, scrapedAddr string) (bool, error) {
+	if src.nodeLister == nil || src.node.UID == "" {
+		return true, nil
+	}
+	node, err := src.nodeLister.Get(src.node.Name)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil || node == nil {
+		// we can't tell, so assume it's unchanged
+		return true, nil
+	}
+	if node.UID == src.node.UID {
+		return true, nil
 	}
 
-	var errs []error
-	for i, container := range podStats.Containers {
-		timestamp, err := getScrapeTime(container.CPU, container.Memory)
-		if err != nil {
-			// if we can't get a timestamp, assume bad data in general
-			errs = append(errs, fmt.Errorf("unable to get a valid timestamp for metric point for container %q in pod %s/%s on node %q, discarding data: %v", container.Name, target.Namespace, target.Name, src.node.ConnectAddress, err))
-			continue
-		}
-		point := sources.ContainerMetricsPoint{
-			Name: container.Name,
-			MetricsPoint: sources.MetricsPoint{
-				Timestamp: timestamp,
-			},
-		}
-		if err := decodeCPU(&point.CpuUsage, container.CPU); err != nil {
-			errs = append(errs, fmt.Errorf("unable to get CPU for container %q in pod %s/%s on node %q, discarding data: %v", container.Name, target.Namespace, target.Name, src.node.ConnectAddress, err))
+	addrs, err := src.currentAddresses(node)
+	if err != nil || !containsString(addrs, scrapedAddr) {
+		replacedErr := &ErrNodeReplaced{
+			Name:           src.node.Name,
+			ScrapedUID:     src.node.UID,
+			CurrentUID:     node.UID,
+			ScrapedAddress: scrapedAddr,
 		}
-		if err := decodeMemory(&point.MemoryUsage, container.Memory); err != nil {
-			errs = append(errs, fmt.Errorf("unable to get memory for container %q in pod %s/%s on node %q: %v, discarding data", container.Name, target.Namespace, target.Name, src.node.ConnectAddress, err))
+		if len(addrs) > 0 {
+			replacedErr.CurrentAddress = addrs[0]
 		}
-
-		target.Containers[i] = point
+		return true, replacedErr
 	}
-
-	return errs
+	logger.V(2).Info(fmt.Sprintf("node %q was re-created during its scrape (UID %s, now %s) at the same address, keeping its data", src.node.Name, src.node.UID, node.UID), "scrapedUID", src.node.UID, "currentUID", node.UID)
+	return true, nil
 }
 
-func decodeCPU(target *resource.Quantity, cpuStats *stats.CPUStats) error {
-	if cpuStats == nil || cpuStats.UsageNanoCores == nil {
-		return fmt.Errorf("missing cpu usage metric")
+// currentAddresses returns the addresses the given node object could be scraped at now:
+// all of its candidates, if the node's scraped from several, or else its preferred address.
+func (src *summaryMetricsSource) currentAddresses(node *corev1.Node) ([]string, error) {
+	if resolver, ok := src.addrResolver.(CandidateNodeAddressResolver); ok && len(src.node.CandidateAddresses) > 0 {
+		return resolver.NodeAddresses(node)
 	}
+	addr, err := src.addrResolver.NodeAddress(node)
+	if err != nil {
+		return nil, err
+	}
+	return []string{addr}, nil
+}
 
-	*target = *uint64Quantity(*cpuStats.UsageNanoCores, -9)
-	return nil
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
-func decodeMemory(target *resource.Quantity, memStats *stats.MemoryStats) error {
-	if memStats == nil || memStats.WorkingSetBytes == nil {
-		return fmt.Errorf("missing memory usage metric")
+// recordError counts a failed scrape by its class and the node's pool.
+func (src *summaryMetricsSource) recordError(err error) {
+	pool := src.node.Pool
+	if pool == "" {
+		pool = unknownNodePool
+	}
+	scrapeErrorsTotal.WithLabelValues(ErrorClass(err), pool).Inc()
+	var proxyErr *ErrProxy
+	if errors.As(err, &proxyErr) {
+		proxyErrorsTotal.WithLabelValues(proxyErr.Reason, pool).Inc()
 	}
+}
 
-	*target = *uint64Quantity(*memStats.WorkingSetBytes, 0)
-	target.Format = resource.BinarySI
+// recordStatus saves the outcome of a scrape in the status tracker, if any.
+func (src *summaryMetricsSource) recordStatus(ctx context.Context, scrapeTime time.Time, prov *Provenance, err error, notes []string, cpuRates []CPURateInconsistency) {
+	if canceled, ok := sources.CancelCause(err); !ok || canceled.Reason != sources.CancelReasonNodeDeleted {
+		// scrapes cut short by the node's deletion aren't failures
+		src.opts.FailureEvents.observe(src.node, err)
+	}
+	if src.opts.Statuses == nil {
+		return
+	}
+	status := NodeScrapeStatus{
+		Node:       src.node.Name,
+		NodePool:   src.node.Pool,
+		LastScrape: scrapeTime,
+		Reason:     string(sources.ScrapeReasonFrom(ctx)),
+		CycleID:    sources.CycleIDFrom(ctx),
+		Success:    err == nil,
+		Source:     prov,
+		Notes:      notes,
+		CPURates:   cpuRates,
+
+		DurationSeconds: time.Since(scrapeTime).Seconds(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+		status.ErrorClass = ErrorClass(err)
+		if canceled, ok := sources.CancelCause(err); ok {
+			status.CancelCause = canceled.Reason
+		}
+	} else {
+		status.LastSuccess = &scrapeTime
+	}
+	src.opts.Statuses.Update(status)
+}
 
-	return nil
+// recordWarmingUp saves a warming-up outcome in the status tracker, if any.
+func (src *summaryMetricsSource) recordWarmingUp(ctx context.Context, scrapeTime time.Time, prov *Provenance) {
+	if src.opts.Statuses == nil {
+		return
+	}
+	src.opts.Statuses.Update(NodeScrapeStatus{
+		Node:       src.node.Name,
+		NodePool:   src.node.Pool,
+		LastScrape: scrapeTime,
+		Reason:     string(sources.ScrapeReasonFrom(ctx)),
+		CycleID:    sources.CycleIDFrom(ctx),
+		WarmingUp:  true,
+		Source:     prov,
+
+		DurationSeconds: time.Since(scrapeTime).Seconds(),
+	})
 }
 
-func getScrapeTime(cpu *stats.CPUStats, memory *stats.MemoryStats) (time.Time, error) {
-	// Ensure we get the earlier timestamp so that we can tell if a given data
-	// point was tainted by pod initialization.
+// warmingUp checks if the given node stats are missing entirely for a node
+// that's still within the warmup grace period.
+func (src *summaryMetricsSource) warmingUp(nodeStats *stats.NodeStats) bool {
+	if src.opts.WarmupGracePeriod <= 0 || src.node.CreationTimestamp.IsZero() {
+		return false
+	}
+	if time.Since(src.node.CreationTimestamp) >= src.opts.WarmupGracePeriod {
+		return false
+	}
+	hasCPU := nodeStats.CPU != nil && nodeStats.CPU.UsageNanoCores != nil
+	hasMemory := nodeStats.Memory != nil && nodeStats.Memory.WorkingSetBytes != nil
+	return !hasCPU && !hasMemory
+}
 
-	var earliest *time.Time
-	if cpu != nil && !cpu.Time.IsZero() && (earliest == nil || earliest.After(cpu.Time.Time)) {
-		earliest = &cpu.Time.Time
+// allowedPods returns the given pods in the namespaces the given allowlist allows, in the same order.
+func allowedPods(pods []stats.PodStats, allowlist *provider.NamespaceAllowlist) []stats.PodStats {
+	allowed := make([]stats.PodStats, 0, len(pods))
+	for _, pod := range pods {
+		if allowlist.Allows(pod.PodRef.Namespace) {
+			allowed = append(allowed, pod)
+		}
 	}
+	return allowed
+}
 
-	if memory != nil && !memory.Time.IsZero() && (earliest == nil || earliest.After(memory.Time.Time)) {
-		earliest = &memory.Time.Time
+// capPods returns at most max pods, keeping all pods in priority namespaces,
+// followed by the first of the remaining pods in namespace/name order.
+// It does not modify the passed slice.
+func capPods(pods []stats.PodStats, max int, prio priority.Namespaces) []stats.PodStats {
+	if prio == nil {
+		prio = priority.None
+	}
+	sorted := make([]stats.PodStats, len(pods))
+	copy(sorted, pods)
+	isPriority := make(map[string]bool)
+	for _, pod := range sorted {
+		if _, known := isPriority[pod.PodRef.Namespace]; !known {
+			isPriority[pod.PodRef.Namespace] = prio.IsPriority(pod.PodRef.Namespace)
+		}
 	}
+	sort.Slice(sorted, func(i, j int) bool {
+		iPrio, jPrio := isPriority[sorted[i].PodRef.Namespace], isPriority[sorted[j].PodRef.Namespace]
+		if iPrio != jPrio {
+			return iPrio
+		}
+		if sorted[i].PodRef.Namespace != sorted[j].PodRef.Namespace {
+			return sorted[i].PodRef.Namespace < sorted[j].PodRef.Namespace
+		}
+		return sorted[i].PodRef.Name < sorted[j].PodRef.Name
+	})
 
-	if earliest == nil {
-		return time.Time{}, fmt.Errorf("no non-zero timestamp on either CPU or memory")
+	numPriority := 0
+	for _, pod := range sorted {
+		if !isPriority[pod.PodRef.Namespace] {
+			break
+		}
+		numPriority++
+	}
+	if numPriority > max {
+		max = numPriority
 	}
+	return sorted[:max]
+}
+
+// batchCache holds the last good batch from each node, and when it was collected.
+type batchCache struct {
+	mu      sync.Mutex
+	batches map[string]cachedBatch
+}
+
+type cachedBatch struct {
+	batch       *sources.MetricsBatch
+	collectedAt time.Time
+}
 
-	return *earliest, nil
+func newBatchCache() *batchCache {
+	return &batchCache{batches: make(map[string]cachedBatch)}
 }
 
-// uint64Quantity converts a uint64 into a Quantity, which only has constructors
-// that work with int64 (except for parse, which requires costly round-trips to string).
-// We lose precision until we fit in an int64 if greater than the max int64 value.
-func uint64Quantity(val uint64, scale resource.Scale) *resource.Quantity {
-	// easy path -- we can safely fit val into an int64
-	if val <= math.MaxInt64 {
-		return resource.NewScaledQuantity(int64(val), scale)
+// get fetches the last good batch for the given node, or nil if none is known, or
+// it's older than the given max age (if non-zero).
+func (c *batchCache) get(node string, maxAge time.Duration) *sources.MetricsBatch {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.batches[node]
+	if !ok {
+		return nil
+	}
+	if maxAge > 0 && time.Since(cached.collectedAt) > maxAge {
+		delete(c.batches, node)
+		return nil
 	}
+	return cached.batch
+}
 
-	glog.V(1).Infof("unexpectedly large resource value %v, loosing precision to fit in scaled resource.Quantity", val)
+func (c *batchCache) set(node string, batch *sources.MetricsBatch) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches[node] = cachedBatch{batch: batch, collectedAt: time.Now()}
+}
 
-	// otherwise, lose an decimal order-of-magnitude precision,
-	// so we can fit into a scaled quantity
-	return resource.NewScaledQuantity(int64(val/10), resource.Scale(1)+scale)
+// prune removes the batches of any node not in the given set, and those older
+// than the given max age (if non-zero).
+func (c *batchCache) prune(keep map[string]struct{}, maxAge time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for node, cached := range c.batches {
+		if _, ok := keep[node]; !ok || (maxAge > 0 && time.Since(cached.collectedAt) > maxAge) {
+			delete(c.batches, node)
+		}
+	}
 }
 
 type summaryProvider struct {
 	nodeLister    v1listers.NodeLister
 	kubeletClient KubeletInterface
 	addrResolver  NodeAddressResolver
+	opts          SourceOptions
+	lastBatches   *batchCache
+	faults        *faultTracker
+	throttling    *throttleTracker
+	cpuRates      *cpuRateTracker
+	health        *healthTracker
+	stale         *staleSummaryTracker
+	addrFallback  *addressFallback
+	translator    translate.BatchTranslator
 }
 
 func (p *summaryProvider) GetMetricSources() ([]sources.MetricSource, error) {
@@ -262,17 +782,78 @@ func (p *summaryProvider) GetMetricSources() ([]sources.MetricSource, error) {
 	}
 
 	var errs []error
+	known := make(map[string]struct{}, len(nodes))
 	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		if p.opts.NodeFilter != nil && !p.opts.NodeFilter(node) {
+			continue
+		}
+		if _, seen := known[node.Name]; seen {
+			// never scrape the same node twice in a cycle, even if the lister
+			// briefly holds both a deleted and a re-created node object
+			continue
+		}
+		known[node.Name] = struct{}{}
 		info, err := p.getNodeInfo(node)
 		if err != nil {
 			errs = append(errs, fmt.Errorf("unable to extract connection information for node %q: %v", node.Name, err))
 			continue
 		}
-		sources = append(sources, NewSummaryMetricsSource(info, p.kubeletClient))
+		sources = append(sources, &summaryMetricsSource{
+			node:          info,
+			kubeletClient: p.kubeletClient,
+			opts:          p.opts,
+			lastBatches:   p.lastBatches,
+			faults:        p.faults,
+			throttling:    p.throttling,
+			cpuRates:      p.cpuRates,
+			health:        p.health,
+			stale:         p.stale,
+			addrFallback:  p.addrFallback,
+			translator:    p.translator,
+			nodeLister:    p.nodeLister,
+			addrResolver:  p.addrResolver,
+		})
+	}
+	if p.opts.Statuses != nil {
+		p.opts.Statuses.Prune(known)
+	}
+	if pruner, ok := p.kubeletClient.(PruningKubeletInterface); ok {
+		pruner.Prune(known)
+	}
+	p.lastBatches.prune(known, p.opts.LastBatchMaxAge)
+	p.faults.prune(known)
+	p.throttling.prune(known)
+	p.cpuRates.prune(known)
+	p.health.prune(known)
+	p.stale.prune(known)
+	p.addrFallback.prune(known)
+	p.opts.FailureEvents.prune(known)
+	if pruner, ok := p.addrResolver.(PruningNodeAddressResolver); ok {
+		pruner.Prune(known)
 	}
 	return sources, utilerrors.NewAggregate(errs)
 }
 
+// ResetBaselines discards the samples kept of every node for deriving page fault,
+// CPU throttling and CPU usage rates.
+func (p *summaryProvider) ResetBaselines() {
+	// pruning down to no nodes forgets them all, just as if each node were new
+	p.faults.prune(nil)
+	p.throttling.prune(nil)
+	p.cpuRates.prune(nil)
+}
+
+// CycleEnded tells the Kubelet client, if it aggregates what it finds over each cycle
+// (see strict.go), that the given cycle ended.
+func (p *summaryProvider) CycleEnded(cycleID string) {
+	if observer, ok := p.kubeletClient.(sources.CycleEndObserver); ok {
+		observer.CycleEnded(cycleID)
+	}
+}
+
 func (p *summaryProvider) getNodeInfo(node *corev1.Node) (NodeInfo, error) {
 	// TODO(directxman12): why do we skip unready nodes?
 	nodeReady := false
@@ -291,17 +872,74 @@ func (p *summaryProvider) getNodeInfo(node *corev1.Node) (NodeInfo, error) {
 		return NodeInfo{}, err
 	}
 	info := NodeInfo{
-		Name:           node.Name,
-		ConnectAddress: addr,
+		Name:              node.Name,
+		UID:               node.UID,
+		ConnectAddress:    addr,
+		CreationTimestamp: node.CreationTimestamp.Time,
+		Pool:              nodePool(node, p.opts.NodePoolLabels),
+		Zone:              nodeZone(node),
+	}
+	if resolver, ok := p.addrResolver.(CandidateNodeAddressResolver); ok && p.addrFallback != nil {
+		candidates, err := resolver.NodeAddresses(node)
+		if err != nil {
+			return NodeInfo{}, err
+		}
+		if len(candidates) > 1 {
+			info.CandidateAddresses = candidates
+		}
 	}
 
 	return info, nil
 }
 
-func NewSummaryProvider(nodeLister v1listers.NodeLister, kubeletClient KubeletInterface, addrResolver NodeAddressResolver) sources.MetricSourceProvider {
-	return &summaryProvider{
+// nodePool finds the name of the given node's pool from the first of the given labels present on it.
+func nodePool(node *corev1.Node, poolLabels []string) string {
+	for _, label := range poolLabels {
+		if pool, ok := node.Labels[label]; ok && pool != "" {
+			return pool
+		}
+	}
+	return ""
+}
+
+// NewSummaryProvider creates a MetricSourceProvider that produces a summary source,
+// configured with the given options, for each ready node.
+func NewSummaryProvider(nodeLister v1listers.NodeLister, kubeletClient KubeletInterface, addrResolver NodeAddressResolver, opts SourceOptions) sources.MetricSourceProvider {
+	prov := &summaryProvider{
 		nodeLister:    nodeLister,
 		kubeletClient: kubeletClient,
 		addrResolver:  addrResolver,
+		opts:          opts,
+		lastBatches:   newBatchCache(),
+		stale:         newStaleSummaryTracker(),
+		translator:    newSummaryTranslator(opts),
+	}
+	if opts.PageFaultRates {
+		prov.faults = newFaultTracker()
+	}
+	if opts.CPUThrottlingRates {
+		prov.throttling = newThrottleTracker()
+	}
+	if opts.CPURateConsistencyRatio > 0 {
+		prov.cpuRates = newCPURateTracker()
+		opts.WarmStart.attach(prov.cpuRates)
+	}
+	if opts.NodeHealthSignals {
+		prov.health = newHealthTracker()
+	}
+	if opts.AddressFallbackTTL > 0 {
+		prov.addrFallback = newAddressFallback(opts.AddressFallbackTTL)
+	}
+	return prov
+}
+
+// NewProviderFactory returns a sources.ProviderFactory constructing a summary provider
+// with the given client, address resolver, and options, for use as the default provider
+// in sources.NewRegisteredSourceProvider.
+func NewProviderFactory(kubeletClient KubeletInterface, addrResolver NodeAddressResolver, opts SourceOptions) sources.ProviderFactory {
+	return func(provOpts sources.ProviderOptions) (sources.MetricSourceProvider, error) {
+		opts := opts
+		opts.NodeFilter = provOpts.NodeFilter
+		return NewSummaryProvider(provOpts.NodeLister, kubeletClient, addrResolver, opts), nil
 	}
 }
@@ -23,13 +23,20 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/priority"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
 	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
 	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
 )
@@ -42,20 +49,41 @@ func TestSummarySource(t *testing.T) {
 type fakeKubeletClient struct {
 	delay   time.Duration
 	metrics *stats.Summary
+	// onScrape, if set, is called at the start of each scrape, to simulate changes mid-scrape.
+	onScrape func()
+	// err, if set, fails each scrape.
+	err error
 
 	lastHost string
 }
 
-func (c *fakeKubeletClient) GetSummary(ctx context.Context, host string) (*stats.Summary, error) {
+func (c *fakeKubeletClient) GetSummary(ctx context.Context, host string) (*stats.Summary, *Provenance, error) {
+	prov := &Provenance{Scheme: "https", Host: host, Port: "10250", Path: "/stats/summary/", Attempts: 1}
+	if c.onScrape != nil {
+		c.onScrape()
+	}
 	select {
 	case <-ctx.Done():
-		return nil, fmt.Errorf("timed out")
+		// like the real client, say why the request was canceled
+		return nil, prov, fmt.Errorf("timed out: %w", context.Cause(ctx))
 	case <-time.After(c.delay):
 	}
 
 	c.lastHost = host
+	if c.err != nil {
+		return nil, prov, c.err
+	}
+
+	return c.metrics, prov, nil
+}
+
+// fakeRecorder records the events it's given as "<type> <reason> <message>".
+type fakeRecorder struct {
+	events []string
+}
 
-	return c.metrics, nil
+func (r *fakeRecorder) Eventf(ref *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	r.events = append(r.events, fmt.Sprintf("%s %s %s %s", ref.Name, eventType, reason, fmt.Sprintf(messageFmt, args...)))
 }
 
 func cpuStats(usageNanocores uint64, ts time.Time) *stats.CPUStats {
@@ -158,16 +186,81 @@ func verifyPods(summary *stats.Summary, batch *sources.MetricsBatch) {
 		expectedPods = append(expectedPods, sources.PodMetricsPoint{
 			Name:       pod.PodRef.Name,
 			Namespace:  pod.PodRef.Namespace,
+			NodeName:   summary.Node.NodeName,
 			Containers: containers,
 		})
 	}
 	Expect(batch.Pods).To(ConsistOf(expectedPods...))
 }
 
+// gaugeValue fetches the value of the given per-node gauge from the default registry, if it's present.
+func gaugeValue(name, node string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if nodeLabel(metric) == node {
+				return metric.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// scrapeErrors fetches the number of failed scrapes of the given class, across node pools.
+func scrapeErrors(class string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	total := 0.0
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_scrape_errors_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "class" && label.GetValue() == class {
+					total += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return total
+}
+
+func nodeLabel(metric *dto.Metric) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == "node" {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// fullHealthStats returns node rlimit and runtime stats with every health signal filled in.
+func fullHealthStats(ts time.Time) (*stats.RlimitStats, *stats.RuntimeStats) {
+	maxPID, curProc := int64(32768), int64(512)
+	available, capacity := uint64(10<<30), uint64(100<<30)
+	return &stats.RlimitStats{Time: metav1.Time{ts}, MaxPID: &maxPID, NumOfRunningProcesses: &curProc},
+		&stats.RuntimeStats{ImageFs: &stats.FsStats{Time: metav1.Time{ts}, AvailableBytes: &available, CapacityBytes: &capacity}}
+}
+
+const (
+	maxPIDsGauge          = "metrics_server_kubelet_summary_node_rlimit_max_pids"
+	runningProcsGauge     = "metrics_server_kubelet_summary_node_rlimit_running_processes"
+	imageFsAvailableGauge = "metrics_server_kubelet_summary_node_runtime_imagefs_available_bytes"
+	imageFsCapacityGauge  = "metrics_server_kubelet_summary_node_runtime_imagefs_capacity_bytes"
+)
+
+var healthGauges = []string{maxPIDsGauge, runningProcsGauge, imageFsAvailableGauge, imageFsCapacityGauge}
+
 var _ = Describe("Summary Source", func() {
 	var (
 		src        sources.MetricSource
 		client     *fakeKubeletClient
+		statuses   *ScrapeStatusTracker
 		scrapeTime time.Time = time.Now()
 		nodeInfo   NodeInfo  = NodeInfo{
 			ConnectAddress: "10.0.1.2",
@@ -178,8 +271,9 @@ var _ = Describe("Summary Source", func() {
 		client = &fakeKubeletClient{
 			metrics: &stats.Summary{
 				Node: stats.NodeStats{
-					CPU:    cpuStats(100, scrapeTime.Add(100*time.Millisecond)),
-					Memory: memStats(200, scrapeTime.Add(200*time.Millisecond)),
+					NodeName: nodeInfo.Name,
+					CPU:      cpuStats(100, scrapeTime.Add(100*time.Millisecond)),
+					Memory:   memStats(200, scrapeTime.Add(200*time.Millisecond)),
 				},
 				Pods: []stats.PodStats{
 					podStats("ns1", "pod1",
@@ -194,7 +288,8 @@ var _ = Describe("Summary Source", func() {
 				},
 			},
 		}
-		src = NewSummaryMetricsSource(nodeInfo, client)
+		statuses = NewScrapeStatusTracker()
+		src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{Statuses: statuses})
 	})
 
 	It("should pass the provided context to the kubelet client to time out requests", func() {
@@ -212,6 +307,22 @@ var _ = Describe("Summary Source", func() {
 		Expect(err).To(HaveOccurred())
 	})
 
+	It("should record why the scrape was canceled in its status and the error metrics", func() {
+		timeouts := scrapeErrors("timeout")
+		ctx, workDone := context.WithTimeoutCause(context.Background(), 50*time.Millisecond, &sources.ErrCanceled{Reason: sources.CancelReasonTimeout, Detail: "the scrape timeout of 50ms was reached"})
+		defer workDone()
+		client.delay = 4 * time.Second
+		_, err := src.Collect(ctx)
+		Expect(err).To(HaveOccurred())
+
+		status, ok := statuses.Get(nodeInfo.Name)
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeFalse())
+		Expect(status.CancelCause).To(Equal(sources.CancelReasonTimeout))
+		Expect(status.Error).To(ContainSubstring("the scrape timeout of 50ms was reached"))
+		Expect(scrapeErrors("timeout")).To(Equal(timeouts + 1))
+	})
+
 	It("should fetch by connection address", func() {
 		By("collecting the batch")
 		_, err := src.Collect(context.Background())
@@ -221,6 +332,38 @@ var _ = Describe("Summary Source", func() {
 		Expect(client.lastHost).To(Equal(nodeInfo.ConnectAddress))
 	})
 
+	It("should record the scrape status and source endpoint for the node", func() {
+		By("collecting the batch")
+		ctx := sources.WithCycleID(sources.WithScrapeReason(context.Background(), sources.ScrapeReasonCycle), "cycle-1")
+		_, err := src.Collect(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that the status was recorded")
+		status, ok := statuses.Get(nodeInfo.Name)
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeTrue())
+		Expect(status.Source).NotTo(BeNil())
+		Expect(status.Source.Host).To(Equal(nodeInfo.ConnectAddress))
+		Expect(status.Reason).To(Equal("cycle"))
+		Expect(status.CycleID).To(Equal("cycle-1"))
+	})
+
+	It("should record the source endpoint even when the scrape fails", func() {
+		By("collecting the batch with a timeout shorter than the delay")
+		ctx, workDone := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		client.delay = 1 * time.Second
+		_, err := src.Collect(ctx)
+		workDone()
+		Expect(err).To(HaveOccurred())
+
+		By("verifying that the failure was attributed to the endpoint tried")
+		status, ok := statuses.Get(nodeInfo.Name)
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeFalse())
+		Expect(status.Error).NotTo(BeEmpty())
+		Expect(status.Source.Host).To(Equal(nodeInfo.ConnectAddress))
+	})
+
 	It("should return the working set and cpu usage for the node, and all pods on the node", func() {
 		By("collecting the batch")
 		batch, err := src.Collect(context.Background())
@@ -248,6 +391,53 @@ var _ = Describe("Summary Source", func() {
 		Expect(batch.Pods[1].Containers[0].Timestamp).To(Equal(client.metrics.Pods[1].Containers[0].CPU.Time.Time))
 	})
 
+	Context("when pods' samples lag the node's", func() {
+		// lagSamples fetches the number of pod timestamp lags observed so far.
+		lagSamples := func() uint64 {
+			families, err := prometheus.DefaultGatherer.Gather()
+			Expect(err).NotTo(HaveOccurred())
+			for _, family := range families {
+				if family.GetName() == "metrics_server_kubelet_summary_pod_timestamp_lag_seconds" {
+					return family.GetMetric()[0].GetHistogram().GetSampleCount()
+				}
+			}
+			return 0
+		}
+
+		BeforeEach(func() {
+			client.metrics.Pods[1].Containers[0] = containerStats("container1", 700, 800, scrapeTime.Add(-30*time.Second))
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{Statuses: statuses, PodTimestampLagThreshold: 20 * time.Second})
+		})
+
+		It("should time each pod's sample by its own containers, never by the node", func() {
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(batch.Nodes[0].Timestamp).To(Equal(client.metrics.Node.CPU.Time.Time))
+			Expect(batch.Pods[0].SampleTime()).To(Equal(client.metrics.Pods[0].Containers[0].CPU.Time.Time))
+			Expect(batch.Pods[1].SampleTime()).To(Equal(client.metrics.Pods[1].Containers[0].CPU.Time.Time))
+		})
+
+		It("should observe the lag of every pod, noting the pods lagging beyond the threshold", func() {
+			before := lagSamples()
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lagSamples() - before).To(Equal(uint64(len(client.metrics.Pods))))
+
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.Notes).To(ConsistOf("1 pods' samples lag the node's timestamp by more than 20s"))
+		})
+
+		It("should not note anything with the threshold disabled", func() {
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{Statuses: statuses})
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.Notes).To(BeEmpty())
+		})
+	})
+
 	It("should continue on missing CPU or memory metrics", func() {
 		By("removing some data from the raw summary")
 		client.metrics.Node.Memory = nil
@@ -265,6 +455,267 @@ var _ = Describe("Summary Source", func() {
 		verifyPods(client.metrics, batch)
 	})
 
+	It("should cap the number of pods processed per node, dropping the same pods each time", func() {
+		By("setting up an oversized summary, in reverse order")
+		var pods []stats.PodStats
+		for i := 1500; i > 0; i-- {
+			pods = append(pods, podStats(fmt.Sprintf("ns%d", i%3), fmt.Sprintf("pod%04d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+		}
+		client.metrics.Pods = pods
+		src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{Statuses: statuses, MaxPodsPerNode: 1000})
+
+		By("collecting the batch twice")
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		secondBatch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that only the first pods in namespace/name order were kept")
+		Expect(batch.Pods).To(HaveLen(1000))
+		Expect(batch.Pods[0].Namespace).To(Equal("ns0"))
+		Expect(batch.Pods[0].Name).To(Equal("pod0003"))
+		Expect(batch.Pods[999].Namespace).To(Equal("ns1"))
+		Expect(batch.Pods).To(Equal(secondBatch.Pods))
+
+		By("verifying that node metrics are still present")
+		verifyNode(nodeInfo.Name, client.metrics, batch)
+
+		By("verifying that the overflow was noted in the node's status, along with the summary being the same")
+		status, ok := statuses.Get(nodeInfo.Name)
+		Expect(ok).To(BeTrue())
+		Expect(status.Success).To(BeTrue())
+		Expect(status.Notes).To(ConsistOf(ContainSubstring("dropped 500 pods"), ContainSubstring("served from the Kubelet's cache")))
+	})
+
+	It("should never drop pods in priority namespaces when capping pods per node", func() {
+		By("setting up an oversized summary whose priority pods would otherwise sort last")
+		var pods []stats.PodStats
+		for i := 0; i < 1200; i++ {
+			pods = append(pods, podStats("ns1", fmt.Sprintf("pod%04d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+		}
+		for i := 0; i < 5; i++ {
+			pods = append(pods, podStats("zz-critical", fmt.Sprintf("pod%d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+		}
+		client.metrics.Pods = pods
+		prio := priority.NewNamespaces([]string{"zz-critical"}, nil, nil)
+		src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{MaxPodsPerNode: 1000, Priority: prio})
+
+		By("collecting the batch")
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that the cap was respected, and all priority pods survived, ordered first")
+		Expect(batch.Pods).To(HaveLen(1000))
+		for i := 0; i < 5; i++ {
+			Expect(batch.Pods[i].Namespace).To(Equal("zz-critical"))
+		}
+		Expect(batch.Pods[5].Name).To(Equal("pod0000"))
+	})
+
+	It("should keep all priority pods even if they alone exceed the cap", func() {
+		By("setting up a summary with more priority pods than the cap")
+		var pods []stats.PodStats
+		for i := 0; i < 20; i++ {
+			pods = append(pods, podStats("kube-system", fmt.Sprintf("pod%d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+			pods = append(pods, podStats("ns1", fmt.Sprintf("pod%d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+		}
+		client.metrics.Pods = pods
+		prio := priority.NewNamespaces(priority.DefaultNamespaces, nil, nil)
+		src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{MaxPodsPerNode: 10, Priority: prio})
+
+		By("collecting the batch")
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that only priority pods remain")
+		Expect(batch.Pods).To(HaveLen(20))
+		for _, pod := range batch.Pods {
+			Expect(pod.Namespace).To(Equal("kube-system"))
+		}
+	})
+
+	It("should only collect pods in the allowed namespaces, before capping pods per node", func() {
+		By("setting up a summary whose disallowed pods would otherwise fill the cap")
+		var pods []stats.PodStats
+		for i := 0; i < 20; i++ {
+			pods = append(pods, podStats("other-tenant", fmt.Sprintf("pod%d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+			pods = append(pods, podStats("tenant", fmt.Sprintf("pod%d", i),
+				containerStats("container1", 100, 200, scrapeTime)))
+		}
+		client.metrics.Pods = pods
+		allowlist := provider.NewNamespaceAllowlist([]string{"tenant"}, nil, nil)
+		src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{MaxPodsPerNode: 20, Namespaces: allowlist})
+
+		By("collecting the batch")
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("verifying that only the allowed namespace's pods were kept, and none were capped")
+		Expect(batch.Pods).To(HaveLen(20))
+		for _, pod := range batch.Pods {
+			Expect(pod.Namespace).To(Equal("tenant"))
+		}
+		verifyNode(nodeInfo.Name, client.metrics, batch)
+	})
+
+	Context("when recording scrape failure events", func() {
+		var recorder *fakeRecorder
+
+		BeforeEach(func() {
+			recorder = &fakeRecorder{}
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{FailureEvents: NewScrapeFailureEvents(recorder, 3)})
+		})
+
+		collectTimes := func(n int) {
+			for i := 0; i < n; i++ {
+				src.Collect(context.Background())
+			}
+		}
+
+		It("should record an event once scrapes fail for the threshold number of cycles, and when they recover", func() {
+			client.err = &ErrNotFound{}
+			collectTimes(2)
+			Expect(recorder.events).To(BeEmpty())
+
+			By("recording a single warning at the threshold")
+			collectTimes(3)
+			Expect(recorder.events).To(HaveLen(1))
+			Expect(recorder.events[0]).To(HavePrefix("node1 Warning " + EventReasonScrapeFailing + " "))
+			Expect(recorder.events[0]).To(ContainSubstring("for 3 consecutive cycles (" + ErrorClassNotFound + ")"))
+			Expect(recorder.events[0]).To(ContainSubstring((&ErrNotFound{}).Error()))
+
+			By("recording the recovery, only once")
+			client.err = nil
+			collectTimes(2)
+			Expect(recorder.events).To(HaveLen(2))
+			Expect(recorder.events[1]).To(Equal("node1 Normal " + EventReasonScrapeRecovered + " metrics-server is scraping the node's Kubelet successfully again, after 5 consecutive failed scrapes"))
+		})
+
+		It("should not record anything for failures shorter than the threshold", func() {
+			for i := 0; i < 3; i++ {
+				client.err = &ErrNotFound{}
+				collectTimes(2)
+				client.err = nil
+				collectTimes(1)
+			}
+			Expect(recorder.events).To(BeEmpty())
+		})
+	})
+
+	Context("when verifying the reported node name", func() {
+		It("should accept summaries reporting the node scraped", func() {
+			By("collecting a batch whose summary reports the right node name")
+			client.metrics.Node.NodeName = nodeInfo.Name
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			verifyNode(nodeInfo.Name, client.metrics, batch)
+		})
+
+		It("should accept, but note, summaries that don't report a node name", func() {
+			By("collecting a batch whose summary has an empty node name")
+			client.metrics.Node.NodeName = ""
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			verifyNode(nodeInfo.Name, client.metrics, batch)
+
+			By("verifying that the status notes that the name couldn't be verified")
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.Notes).To(ContainElement(ContainSubstring("could not be verified")))
+		})
+
+		It("should reject summaries reporting another node with a typed error", func() {
+			By("collecting a batch whose summary reports a different node name")
+			client.metrics.Node.NodeName = "node2"
+			batch, err := src.Collect(context.Background())
+
+			By("verifying that the error carries both names and no data was returned")
+			Expect(IsNodeMismatchError(err)).To(BeTrue())
+			Expect(err).To(Equal(&ErrNodeMismatch{Requested: nodeInfo.Name, Reported: "node2"}))
+			Expect(batch).To(BeNil())
+
+			By("verifying that the status records the failure")
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.Success).To(BeFalse())
+			Expect(status.Error).To(ContainSubstring("node2"))
+		})
+
+		It("should only warn about summaries reporting another node, if configured to", func() {
+			By("collecting a batch in warn-only mode whose summary reports a different node name")
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{Statuses: statuses, NodeNameVerification: NodeNameVerificationWarn})
+			client.metrics.Node.NodeName = "node2"
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that the data was stored under the node scraped")
+			verifyNode(nodeInfo.Name, client.metrics, batch)
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.Notes).To(ContainElement(ContainSubstring("node2")))
+		})
+	})
+
+	Context("when a recently created node has no stats yet", func() {
+		BeforeEach(func() {
+			client.metrics = &stats.Summary{Node: stats.NodeStats{NodeName: nodeInfo.Name}}
+		})
+
+		It("should record the node as warming up, rather than as failing", func() {
+			By("collecting the batch for a node created within the grace period")
+			info := nodeInfo
+			info.CreationTimestamp = time.Now().Add(-1 * time.Minute)
+			src = NewSummaryMetricsSource(info, client, SourceOptions{Statuses: statuses, WarmupGracePeriod: 5 * time.Minute})
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(BeEmpty())
+
+			By("verifying that the status shows the node as warming up")
+			status, ok := statuses.Get(nodeInfo.Name)
+			Expect(ok).To(BeTrue())
+			Expect(status.WarmingUp).To(BeTrue())
+			Expect(status.Error).To(BeEmpty())
+		})
+
+		It("should report an error once the node ages out of the grace period while still empty", func() {
+			By("collecting the batch while the node is within the grace period")
+			info := nodeInfo
+			info.CreationTimestamp = time.Now().Add(-50 * time.Millisecond)
+			src = NewSummaryMetricsSource(info, client, SourceOptions{Statuses: statuses, WarmupGracePeriod: 100 * time.Millisecond})
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("collecting the batch again after the grace period has passed")
+			time.Sleep(100 * time.Millisecond)
+			_, err = src.Collect(context.Background())
+			Expect(err).To(HaveOccurred())
+
+			By("verifying that the status shows a failure")
+			status, ok := statuses.Get(nodeInfo.Name)
+			Expect(ok).To(BeTrue())
+			Expect(status.WarmingUp).To(BeFalse())
+			Expect(status.Success).To(BeFalse())
+			Expect(status.Error).NotTo(BeEmpty())
+		})
+
+		It("should still report partial node stats as an error", func() {
+			By("collecting the batch for a recently created node with only memory stats")
+			client.metrics.Node.Memory = memStats(200, scrapeTime)
+			info := nodeInfo
+			info.CreationTimestamp = time.Now()
+			src = NewSummaryMetricsSource(info, client, SourceOptions{Statuses: statuses, WarmupGracePeriod: 5 * time.Minute})
+			_, err := src.Collect(context.Background())
+			Expect(err).To(HaveOccurred())
+
+			By("verifying that the node isn't considered to be warming up")
+			status, _ := statuses.Get(nodeInfo.Name)
+			Expect(status.WarmingUp).To(BeFalse())
+		})
+	})
+
 	It("should handle larger-than-int64 CPU or memory values gracefully", func() {
 		By("setting some data in the summary to be above math.MaxInt64")
 		plusTen := uint64(math.MaxInt64 + 10)
@@ -281,15 +732,317 @@ var _ = Describe("Summary Source", func() {
 		batch, err := src.Collect(context.Background())
 		Expect(err).NotTo(HaveOccurred())
 
-		By("verifying that the data is still present, at lower precision")
-		nodeMem := *resource.NewScaledQuantity(int64(plusTen/10), 1)
-		nodeMem.Format = resource.BinarySI
-		podMem := *resource.NewScaledQuantity(int64(minusOneHundred/10), 1)
-		podMem.Format = resource.BinarySI
-		Expect(batch.Nodes[0].MemoryUsage).To(Equal(nodeMem))
+		By("verifying that the CPU data is still present, at lower precision")
 		Expect(batch.Nodes[0].CpuUsage).To(Equal(*resource.NewScaledQuantity(int64(plusTwenty/10), -8)))
 		Expect(batch.Pods[0].Containers[1].CpuUsage).To(Equal(*resource.NewScaledQuantity(int64(minusTen/10), -8)))
-		Expect(batch.Pods[1].Containers[0].MemoryUsage).To(Equal(podMem))
+
+		By("verifying that the memory data is clamped to whole bytes, rather than wrapping negative")
+		maxMem := *resource.NewQuantity(math.MaxInt64, resource.BinarySI)
+		Expect(batch.Nodes[0].MemoryUsage).To(Equal(maxMem))
+		Expect(batch.Pods[1].Containers[0].MemoryUsage).To(Equal(maxMem))
+	})
+
+	Context("when page fault rates are enabled", func() {
+		// withFaults sets the page fault counts of the first container, sampled at the given offset from the scrape time.
+		withFaults := func(pageFaults, majorFaults uint64, offset time.Duration) {
+			mem := client.metrics.Pods[0].Containers[0].Memory
+			mem.Time = metav1.Time{scrapeTime.Add(offset)}
+			mem.PageFaults = &pageFaults
+			mem.MajorPageFaults = &majorFaults
+		}
+		firstContainerFaults := func(batch *sources.MetricsBatch) *sources.PageFaultRates {
+			for _, pod := range batch.Pods {
+				if pod.Namespace == "ns1" && pod.Name == "pod1" {
+					return pod.Containers[0].PageFaults
+				}
+			}
+			Fail("pod ns1/pod1 missing from batch")
+			return nil
+		}
+
+		BeforeEach(func() {
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{PageFaultRates: true})
+		})
+
+		It("should calculate page fault rates over the window between summaries", func() {
+			By("collecting a first summary, which has nothing to calculate a rate from")
+			withFaults(1000, 10, 0)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch)).To(BeNil())
+
+			By("collecting a second summary 10 seconds later")
+			withFaults(1500, 35, 10*time.Second)
+			batch, err = src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying the rates")
+			rates := firstContainerFaults(batch)
+			Expect(rates).NotTo(BeNil())
+			Expect(rates.PageFaults.MilliValue()).To(Equal(int64(50000)))
+			Expect(rates.MajorPageFaults.MilliValue()).To(Equal(int64(2500)))
+
+			By("verifying that containers without page fault counts have no rates")
+			Expect(batch.Pods).To(ContainElement(WithTransform(func(pod sources.PodMetricsPoint) *sources.PageFaultRates {
+				return pod.Containers[0].PageFaults
+			}, BeNil())))
+		})
+
+		It("should carry the rates forward through the same summary served again from the Kubelet's cache", func() {
+			withFaults(1000, 10, 0)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			withFaults(1500, 35, 10*time.Second)
+			_, err = src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("collecting the same summary twice more")
+			for i := 0; i < 2; i++ {
+				batch, err := src.Collect(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+				rates := firstContainerFaults(batch)
+				Expect(rates).NotTo(BeNil())
+				Expect(rates.Window).To(Equal(10 * time.Second))
+				Expect(rates.PageFaults.MilliValue()).To(Equal(int64(50000)))
+				Expect(rates.MajorPageFaults.MilliValue()).To(Equal(int64(2500)))
+			}
+
+			By("calculating the rates afresh from the next fresh summary")
+			withFaults(1600, 40, 20*time.Second)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch).PageFaults.MilliValue()).To(Equal(int64(10000)))
+		})
+
+		It("should calculate rates over the actual window when scrapes were missed", func() {
+			withFaults(1000, 10, 0)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("collecting a summary after two missed 10 second cycles")
+			withFaults(1600, 40, 30*time.Second)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("verifying that the rates, and their window, cover the whole gap")
+			rates := firstContainerFaults(batch)
+			Expect(rates).NotTo(BeNil())
+			Expect(rates.Window).To(Equal(30 * time.Second))
+			Expect(rates.PageFaults.MilliValue()).To(Equal(int64(20000)))
+			Expect(rates.MajorPageFaults.MilliValue()).To(Equal(int64(1000)))
+		})
+
+		It("should decline to report rates over gaps longer than the maximum", func() {
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{PageFaultRates: true, MaxRateGap: 25 * time.Second})
+			withFaults(1000, 10, 0)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("collecting a summary after two missed 10 second cycles")
+			withFaults(1600, 40, 30*time.Second)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch)).To(BeNil())
+
+			By("reporting rates again once the next cycle succeeds")
+			withFaults(1700, 45, 40*time.Second)
+			batch, err = src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			rates := firstContainerFaults(batch)
+			Expect(rates).NotTo(BeNil())
+			Expect(rates.Window).To(Equal(10 * time.Second))
+			Expect(rates.PageFaults.MilliValue()).To(Equal(int64(10000)))
+		})
+
+		It("should not report a rate when the counters are reset", func() {
+			By("collecting a first summary")
+			withFaults(1000, 10, 0)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			By("collecting a summary after the container restarted")
+			withFaults(100, 1, 10*time.Second)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch)).To(BeNil())
+
+			By("verifying that the rate is calculated from the new counters afterwards")
+			withFaults(300, 3, 20*time.Second)
+			batch, err = src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch).PageFaults.MilliValue()).To(Equal(int64(20000)))
+		})
+
+		It("should not report a rate for a stale sample", func() {
+			withFaults(1000, 10, 0)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(firstContainerFaults(batch)).To(BeNil())
+		})
+	})
+
+	Context("when excluding containers", func() {
+		BeforeEach(func() {
+			client.metrics.Pods[0].Containers = append(client.metrics.Pods[0].Containers,
+				containerStats("istio-proxy", 1300, 1400, scrapeTime.Add(60*time.Millisecond)),
+				containerStats("linkerd-proxy", 1500, 1600, scrapeTime.Add(70*time.Millisecond)))
+		})
+
+		// containersOf returns the containers collected for pod ns1/pod1.
+		containersOf := func(batch *sources.MetricsBatch) []sources.ContainerMetricsPoint {
+			for _, pod := range batch.Pods {
+				if pod.Namespace == "ns1" && pod.Name == "pod1" {
+					return pod.Containers
+				}
+			}
+			Fail("pod ns1/pod1 missing from batch")
+			return nil
+		}
+		collectWith := func(patterns []string, mode ContainerExclusionMode) []sources.ContainerMetricsPoint {
+			filter, err := NewContainerFilter(patterns, mode)
+			Expect(err).NotTo(HaveOccurred())
+			src = NewSummaryMetricsSource(nodeInfo, client, SourceOptions{ExcludedContainers: filter})
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			return containersOf(batch)
+		}
+
+		It("should still list matching containers, marked as excluded from pod totals, by default", func() {
+			containers := collectWith([]string{"istio-proxy", "linkerd-*"}, ContainerExclusionList)
+			Expect(containers).To(HaveLen(4))
+			for _, container := range containers {
+				excluded := container.Name == "istio-proxy" || container.Name == "linkerd-proxy"
+				Expect(container.ExcludedFromPodTotals).To(Equal(excluded), "container %s", container.Name)
+			}
+			Expect(containers[2].CpuUsage).To(Equal(*resource.NewScaledQuantity(1300, -9)))
+		})
+
+		It("should drop matching containers entirely in drop mode", func() {
+			containers := collectWith([]string{"*-proxy"}, ContainerExclusionDrop)
+			Expect(containers).To(HaveLen(2))
+			Expect(containers[0].Name).To(Equal("container1"))
+			Expect(containers[1].Name).To(Equal("container2"))
+			Expect(containers[0].ExcludedFromPodTotals).To(BeFalse())
+		})
+
+		It("should only match exact names when not given a glob", func() {
+			containers := collectWith([]string{"proxy"}, ContainerExclusionDrop)
+			Expect(containers).To(HaveLen(4))
+		})
+
+		It("should reject invalid patterns", func() {
+			_, err := NewContainerFilter([]string{"istio-proxy", "[istio"}, ContainerExclusionList)
+			Expect(err).To(HaveOccurred())
+			_, err = NewContainerFilter([]string{""}, ContainerExclusionList)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject unknown modes", func() {
+			_, err := NewContainerFilter([]string{"istio-proxy"}, ContainerExclusionMode("hide"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when publishing node health signals", func() {
+		var healthNode NodeInfo
+		healthNodes := 0
+
+		BeforeEach(func() {
+			// the gauges are global, so give each test its own node
+			healthNodes++
+			healthNode = NodeInfo{ConnectAddress: "10.0.1.3", Name: fmt.Sprintf("health-node%d", healthNodes)}
+			client.metrics.Node.NodeName = healthNode.Name
+			src = NewSummaryMetricsSource(healthNode, client, SourceOptions{NodeHealthSignals: true})
+		})
+
+		It("should publish every signal present in full node stats, without affecting the node metrics", func() {
+			client.metrics.Node.Rlimit, client.metrics.Node.Runtime = fullHealthStats(scrapeTime)
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			verifyNode(healthNode.Name, client.metrics, batch)
+
+			expected := map[string]float64{
+				maxPIDsGauge:          32768,
+				runningProcsGauge:     512,
+				imageFsAvailableGauge: 10 << 30,
+				imageFsCapacityGauge:  100 << 30,
+			}
+			for name, val := range expected {
+				actual, present := gaugeValue(name, healthNode.Name)
+				Expect(present).To(BeTrue(), "gauge %s", name)
+				Expect(actual).To(Equal(val), "gauge %s", name)
+			}
+		})
+
+		It("should only publish the signals present in sparse node stats", func() {
+			maxPID := int64(32768)
+			client.metrics.Node.Rlimit = &stats.RlimitStats{MaxPID: &maxPID}
+			client.metrics.Node.Runtime = &stats.RuntimeStats{}
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			verifyNode(healthNode.Name, client.metrics, batch)
+
+			maxPIDs, present := gaugeValue(maxPIDsGauge, healthNode.Name)
+			Expect(present).To(BeTrue())
+			Expect(maxPIDs).To(Equal(float64(32768)))
+			for _, name := range []string{runningProcsGauge, imageFsAvailableGauge, imageFsCapacityGauge} {
+				_, present := gaugeValue(name, healthNode.Name)
+				Expect(present).To(BeFalse(), "gauge %s", name)
+			}
+		})
+
+		It("should tolerate node stats without any rlimit or runtime stats", func() {
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			verifyNode(healthNode.Name, client.metrics, batch)
+			for _, name := range healthGauges {
+				_, present := gaugeValue(name, healthNode.Name)
+				Expect(present).To(BeFalse(), "gauge %s", name)
+			}
+		})
+
+		It("should remove signals which go missing from later summaries", func() {
+			client.metrics.Node.Rlimit, client.metrics.Node.Runtime = fullHealthStats(scrapeTime)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			client.metrics.Node.Runtime = nil
+			_, err = src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			_, present := gaugeValue(imageFsAvailableGauge, healthNode.Name)
+			Expect(present).To(BeFalse())
+			_, present = gaugeValue(maxPIDsGauge, healthNode.Name)
+			Expect(present).To(BeTrue())
+		})
+
+		It("should not publish anything unless enabled", func() {
+			src = NewSummaryMetricsSource(healthNode, client, SourceOptions{})
+			client.metrics.Node.Rlimit, client.metrics.Node.Runtime = fullHealthStats(scrapeTime)
+			_, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			for _, name := range healthGauges {
+				_, present := gaugeValue(name, healthNode.Name)
+				Expect(present).To(BeFalse(), "gauge %s", name)
+			}
+		})
+	})
+
+	It("should not calculate page fault rates unless enabled", func() {
+		pageFaults, majorFaults := uint64(1000), uint64(10)
+		client.metrics.Pods[0].Containers[0].Memory.PageFaults = &pageFaults
+		client.metrics.Pods[0].Containers[0].Memory.MajorPageFaults = &majorFaults
+		for i := 0; i < 2; i++ {
+			batch, err := src.Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			for _, pod := range batch.Pods {
+				for _, container := range pod.Containers {
+					Expect(container.PageFaults).To(BeNil())
+				}
+			}
+		}
 	})
 })
 
@@ -317,7 +1070,7 @@ func (l *fakeNodeLister) Get(name string) (*corev1.Node, error) {
 			return node, nil
 		}
 	}
-	return nil, fmt.Errorf("no such node %q", name)
+	return nil, apierrors.NewNotFound(corev1.Resource("nodes"), name)
 }
 
 func readyNames(nodes []*corev1.Node, addrs []string) []string {
@@ -331,7 +1084,7 @@ func readyNames(nodes []*corev1.Node, addrs []string) []string {
 			}
 		}
 		if nodeReady {
-			res = append(res, NewSummaryMetricsSource(NodeInfo{ConnectAddress: addrs[i], Name: node.Name}, nil).Name())
+			res = append(res, NewSummaryMetricsSource(NodeInfo{ConnectAddress: addrs[i], Name: node.Name}, nil, SourceOptions{}).Name())
 		}
 	}
 	return res
@@ -339,7 +1092,7 @@ func readyNames(nodes []*corev1.Node, addrs []string) []string {
 
 func makeNode(name, hostName, addr string, ready bool) *corev1.Node {
 	res := &corev1.Node{
-		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
 		Status: corev1.NodeStatus{
 			Addresses: []corev1.NodeAddress{
 				{Type: corev1.NodeHostName, Address: hostName},
@@ -358,6 +1111,16 @@ func makeNode(name, hostName, addr string, ready bool) *corev1.Node {
 	return res
 }
 
+// pruningKubeletClient is a fakeKubeletClient recording the nodes it was last told to keep.
+type pruningKubeletClient struct {
+	*fakeKubeletClient
+	kept map[string]struct{}
+}
+
+func (c *pruningKubeletClient) Prune(keep map[string]struct{}) {
+	c.kept = keep
+}
+
 var _ = Describe("Summary Source Provider", func() {
 	var (
 		nodeLister *fakeNodeLister
@@ -382,7 +1145,7 @@ var _ = Describe("Summary Source Provider", func() {
 		}
 		fakeClient = &fakeKubeletClient{}
 		addrResolver := NewPriorityNodeAddressResolver(DefaultAddressTypePriority)
-		provider = NewSummaryProvider(nodeLister, fakeClient, addrResolver)
+		provider = NewSummaryProvider(nodeLister, fakeClient, addrResolver, SourceOptions{})
 	})
 
 	It("should return a metrics source for all ready nodes", func() {
@@ -438,6 +1201,302 @@ var _ = Describe("Summary Source Provider", func() {
 		Expect(sourceNames).To(Equal(readyNodeNames[1:]))
 	})
 
+	It("should only return sources for the nodes selected by the node filter", func() {
+		By("setting up a provider which leaves node4 to another source")
+		addrResolver := NewPriorityNodeAddressResolver(DefaultAddressTypePriority)
+		provider = NewSummaryProvider(nodeLister, fakeClient, addrResolver, SourceOptions{
+			NodeFilter: func(node *corev1.Node) bool { return node.Name != "node4" },
+		})
+
+		By("listing the sources")
+		sources, _ := provider.GetMetricSources()
+
+		By("verifying that no source is present for the filtered node")
+		sourceNames := make([]string, len(sources))
+		for i, src := range sources {
+			sourceNames[i] = src.Name()
+		}
+		Expect(sourceNames).To(Equal([]string{"kubelet_summary:node1", "kubelet_summary:node-no-host"}))
+	})
+
+	It("should tell a Kubelet client which remembers nodes which of them still exist", func() {
+		pruning := &pruningKubeletClient{fakeKubeletClient: fakeClient}
+		provider = NewSummaryProvider(nodeLister, pruning, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{})
+		// nodes which can't be scraped this cycle (like the unready node3) still exist
+		provider.GetMetricSources()
+		Expect(pruning.kept).To(Equal(map[string]struct{}{"node1": {}, "node-no-host": {}, "node3": {}, "node4": {}}))
+	})
+
+	It("should keep the previous data for a node whose summary reports another node", func() {
+		By("setting up a provider for a single node")
+		nodeLister.nodes = []*corev1.Node{makeNode("node1", "node1.somedomain", "10.0.1.2", true)}
+		fakeClient.metrics = &stats.Summary{
+			Node: stats.NodeStats{
+				NodeName: "node1",
+				CPU:      cpuStats(100, time.Now()),
+				Memory:   memStats(200, time.Now()),
+			},
+		}
+
+		By("collecting a good batch")
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		goodBatch, err := srcs[0].Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		By("collecting a batch whose summary reports another node")
+		fakeClient.metrics.Node.NodeName = "node2"
+		fakeClient.metrics.Node.CPU = cpuStats(999, time.Now())
+		srcs, err = provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		batch, err := srcs[0].Collect(context.Background())
+
+		By("verifying that the previous data was returned alongside the error")
+		Expect(IsNodeMismatchError(err)).To(BeTrue())
+		Expect(batch).To(Equal(goodBatch))
+	})
+
+	// collectMismatched collects a good batch from node1, then runs the given function and
+	// collects a batch whose summary reports another node, returning what was served for it.
+	collectMismatched := func(between func()) *sources.MetricsBatch {
+		nodeLister.nodes = []*corev1.Node{makeNode("node1", "node1.somedomain", "10.0.1.2", true)}
+		fakeClient.metrics = &stats.Summary{
+			Node: stats.NodeStats{NodeName: "node1", CPU: cpuStats(100, time.Now()), Memory: memStats(200, time.Now())},
+		}
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = srcs[0].Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		between()
+		fakeClient.metrics.Node.NodeName = "node2"
+		srcs, err = provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		batch, err := srcs[0].Collect(context.Background())
+		Expect(IsNodeMismatchError(err)).To(BeTrue())
+		return batch
+	}
+
+	It("should stop serving the previous data of a node once it's older than the max age", func() {
+		provider = NewSummaryProvider(nodeLister, fakeClient, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{LastBatchMaxAge: 50 * time.Millisecond})
+		Expect(collectMismatched(func() { time.Sleep(100 * time.Millisecond) })).To(BeNil())
+	})
+
+	It("should forget the previous data of nodes that are gone", func() {
+		Expect(collectMismatched(func() {
+			nodeLister.nodes = nil
+			_, err := provider.GetMetricSources()
+			Expect(err).NotTo(HaveOccurred())
+			nodeLister.nodes = []*corev1.Node{makeNode("node1", "node1.somedomain", "10.0.1.2", true)}
+		})).To(BeNil())
+	})
+
+	It("should derive rates afresh once its baselines are reset", func() {
+		By("setting up a provider deriving a single node's CPU usage rate")
+		nodeLister.nodes = []*corev1.Node{makeNode("node1", "node1.somedomain", "10.0.1.2", true)}
+		provider = NewSummaryProvider(nodeLister, fakeClient, NewPriorityNodeAddressResolver(DefaultAddressTypePriority), SourceOptions{CPURateConsistencyRatio: 1.5})
+		start := time.Now()
+		collectAt := func(offset time.Duration, usageCoreNanoSeconds uint64) *sources.MetricsBatch {
+			cpu := cpuStats(1000000000, start.Add(offset))
+			cpu.UsageCoreNanoSeconds = &usageCoreNanoSeconds
+			fakeClient.metrics = &stats.Summary{
+				Node: stats.NodeStats{NodeName: "node1", CPU: cpu, Memory: memStats(200, start.Add(offset))},
+			}
+			srcs, err := provider.GetMetricSources()
+			Expect(err).NotTo(HaveOccurred())
+			batch, err := srcs[0].Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			return batch
+		}
+
+		By("deriving a rate from two summaries")
+		collectAt(0, 0)
+		batch := collectAt(10*time.Second, 20000000000)
+		Expect(batch.Nodes[0].CpuUsage.MilliValue()).To(Equal(int64(2000)))
+
+		By("serving the reported rate for the first summary after the reset")
+		provider.(sources.BaselineResetter).ResetBaselines()
+		batch = collectAt(time.Hour, 30000000000)
+		Expect(batch.Nodes[0].CpuUsage.MilliValue()).To(Equal(int64(1000)))
+
+		By("deriving rates from the new baseline after that")
+		batch = collectAt(time.Hour+10*time.Second, 35000000000)
+		Expect(batch.Nodes[0].CpuUsage.MilliValue()).To(Equal(int64(500)))
+	})
+
+	Context("when nodes churn mid-cycle", func() {
+		var (
+			inFlight *InFlightScrapes
+			statuses *ScrapeStatusTracker
+		)
+
+		// withUID returns a ready node with the given name, host name, and UID.
+		withUID := func(name, hostName string, uid types.UID) *corev1.Node {
+			node := makeNode(name, hostName, "10.0.1.2", true)
+			node.UID = uid
+			return node
+		}
+
+		BeforeEach(func() {
+			inFlight = NewInFlightScrapes()
+			statuses = NewScrapeStatusTracker()
+			addrResolver := NewPriorityNodeAddressResolver(DefaultAddressTypePriority)
+			provider = NewSummaryProvider(nodeLister, fakeClient, addrResolver, SourceOptions{InFlight: inFlight, Statuses: statuses})
+			nodeLister.nodes = []*corev1.Node{withUID("node1", "node1.somedomain", "uid-1")}
+			fakeClient.metrics = &stats.Summary{
+				Node: stats.NodeStats{
+					NodeName: "node1",
+					CPU:      cpuStats(100, time.Now()),
+					Memory:   memStats(200, time.Now()),
+				},
+			}
+		})
+
+		// collect lists the sources at the start of the cycle, then collects from the only one.
+		collect := func() (*sources.MetricsBatch, error) {
+			srcs, err := provider.GetMetricSources()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(srcs).To(HaveLen(1))
+			return srcs[0].Collect(context.Background())
+		}
+
+		It("should cancel the in-flight scrape of a node deleted mid-scrape, discarding its data", func() {
+			fakeClient.delay = 10 * time.Second
+			fakeClient.onScrape = func() {
+				deleted := nodeLister.nodes[0]
+				nodeLister.nodes = nil
+				inFlight.NodeDeleted(deleted)
+			}
+
+			deletions := scrapeErrors(string(sources.CancelReasonNodeDeleted))
+			start := time.Now()
+			batch, err := collect()
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(BeEmpty())
+
+			By("recording the deletion as the cause of the cancellation, without counting it as a failure")
+			status, ok := statuses.Get("node1")
+			Expect(ok).To(BeTrue())
+			Expect(status.CancelCause).To(Equal(sources.CancelReasonNodeDeleted))
+			Expect(status.Error).To(ContainSubstring(`node "node1" was deleted`))
+			Expect(scrapeErrors(string(sources.CancelReasonNodeDeleted))).To(Equal(deletions))
+		})
+
+		It("should accept deletions reported as tombstones", func() {
+			fakeClient.delay = 10 * time.Second
+			fakeClient.onScrape = func() {
+				inFlight.NodeDeleted(cache.DeletedFinalStateUnknown{Key: "node1", Obj: nodeLister.nodes[0]})
+			}
+			start := time.Now()
+			batch, err := collect()
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(BeEmpty())
+		})
+
+		It("should discard the data of a node deleted mid-scrape, even if the deletion wasn't reported", func() {
+			fakeClient.onScrape = func() { nodeLister.nodes = nil }
+			batch, err := collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(BeEmpty())
+		})
+
+		It("should not cancel the scrape of a re-created node when the deletion of the old one arrives late", func() {
+			nodeLister.nodes = []*corev1.Node{withUID("node1", "node1.somedomain", "uid-2")}
+			fakeClient.onScrape = func() {
+				inFlight.NodeDeleted(withUID("node1", "node1.somedomain", "uid-1"))
+			}
+			batch, err := collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(HaveLen(1))
+		})
+
+		It("should keep the data of a node re-created mid-scrape at the same address, under its new identity", func() {
+			fakeClient.onScrape = func() {
+				inFlight.NodeDeleted(nodeLister.nodes[0])
+				nodeLister.nodes = []*corev1.Node{withUID("node1", "node1.somedomain", "uid-2")}
+			}
+			srcs, err := provider.GetMetricSources()
+			Expect(err).NotTo(HaveOccurred())
+
+			By("checking that the deletion cancelled the scrape")
+			batch, err := srcs[0].Collect(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(BeEmpty())
+
+			By("re-creating the node without deleting it, as a missed watch event would")
+			nodeLister.nodes = []*corev1.Node{withUID("node1", "node1.somedomain", "uid-1")}
+			fakeClient.onScrape = func() {
+				nodeLister.nodes = []*corev1.Node{withUID("node1", "node1.somedomain", "uid-2")}
+			}
+			batch, err = collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(HaveLen(1))
+			Expect(batch.Nodes[0].Name).To(Equal("node1"))
+		})
+
+		It("should discard the data of a node re-created mid-scrape at a different address", func() {
+			fakeClient.onScrape = func() {
+				nodeLister.nodes = []*corev1.Node{withUID("node1", "node1-new.somedomain", "uid-2")}
+			}
+			batch, err := collect()
+			Expect(IsNodeReplacedError(err)).To(BeTrue(), "expected a node replaced error, got %v", err)
+			Expect(ErrorClass(err)).To(Equal(ErrorClassNodeReplaced))
+			Expect(batch).To(BeNil())
+		})
+
+		It("should ignore other changes to the node mid-cycle, scraping the address it had at the start", func() {
+			fakeClient.onScrape = func() {
+				nodeLister.nodes = []*corev1.Node{withUID("node1", "node1-new.somedomain", "uid-1")}
+			}
+			batch, err := collect()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batch.Nodes).To(HaveLen(1))
+			Expect(fakeClient.lastHost).To(Equal("node1.somedomain"))
+		})
+
+		It("should only scrape a node once per cycle, even if the lister briefly holds two objects for it", func() {
+			nodeLister.nodes = append(nodeLister.nodes, withUID("node1", "node1-new.somedomain", "uid-2"))
+			srcs, err := provider.GetMetricSources()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(srcs).To(HaveLen(1))
+		})
+	})
+
+	It("should remove the health signals of nodes that go away", func() {
+		addrResolver := NewPriorityNodeAddressResolver(DefaultAddressTypePriority)
+		provider = NewSummaryProvider(nodeLister, fakeClient, addrResolver, SourceOptions{NodeHealthSignals: true})
+		nodeLister.nodes = nodeLister.nodes[:1]
+		nodeLister.nodes[0].Name = "health-gone-node"
+		rlimit, runtime := fullHealthStats(time.Now())
+		fakeClient.metrics = &stats.Summary{Node: stats.NodeStats{
+			NodeName: "health-gone-node",
+			CPU:      cpuStats(100, time.Now()),
+			Memory:   memStats(200, time.Now()),
+			Rlimit:   rlimit,
+			Runtime:  runtime,
+		}}
+
+		By("collecting from the node")
+		srcs, err := provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs).To(HaveLen(1))
+		_, err = srcs[0].Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		_, present := gaugeValue(maxPIDsGauge, "health-gone-node")
+		Expect(present).To(BeTrue())
+
+		By("removing the node")
+		nodeLister.nodes = nil
+		_, err = provider.GetMetricSources()
+		Expect(err).NotTo(HaveOccurred())
+		for _, name := range healthGauges {
+			_, present := gaugeValue(name, "health-gone-node")
+			Expect(present).To(BeFalse(), "gauge %s", name)
+		}
+	})
+
 	It("should gracefully handle list errors", func() {
 		By("setting a fake error from the lister")
 		nodeLister.listErr = fmt.Errorf("something went wrong, expectedly")
@@ -0,0 +1,138 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// Kubelets with swap enabled report the swap usage of the node, and of each pod and container,
+// under "swap" keys which the vendored summary types predate.  When swap stats are enabled, they're
+// decoded alongside the summary (in the same pass, when decoding fast) into a SwapSummary, which
+// is handed to the source with the summary it came from.  Nodes that don't report swap usage
+// simply have none, so a cluster can mix nodes with swap and nodes without.
+
+// SwapStats is the swap usage reported by a Kubelet for a node, pod, or container.
+type SwapStats struct {
+	Time               metav1.Time `json:"time"`
+	SwapAvailableBytes *uint64     `json:"swapAvailableBytes,omitempty"`
+	SwapUsageBytes     *uint64     `json:"swapUsageBytes,omitempty"`
+}
+
+// PodSwapStats is the swap usage reported for a pod, and its containers.
+type PodSwapStats struct {
+	Pod *SwapStats
+	// Containers holds the swap usage of the containers which report it, by name.
+	Containers map[string]*SwapStats
+}
+
+// SwapSummary is the swap usage reported in a summary.
+type SwapSummary struct {
+	Node *SwapStats
+	// Pods holds the swap usage of the pods which report it (or whose containers do).
+	Pods map[stats.PodReference]*PodSwapStats
+}
+
+// swapSummaryGetter is implemented by KubeletInterfaces which can also decode
+// the swap usage reported in summaries.
+type swapSummaryGetter interface {
+	// GetSummaryWithSwap fetches summary metrics like GetSummary, also
+	// returning the swap usage reported in them.
+	GetSummaryWithSwap(ctx context.Context, host string) (*stats.Summary, *SwapSummary, *Provenance, error)
+}
+
+// pod returns the swap usage of the given pod, or nil if it reported none.
+func (s *SwapSummary) pod(ref stats.PodReference) *PodSwapStats {
+	if s == nil {
+		return nil
+	}
+	return s.Pods[ref]
+}
+
+// addPod records the swap usage of the given pod, unless it reported none.
+func (s *SwapSummary) addPod(ref stats.PodReference, pod *PodSwapStats) {
+	if pod.Pod == nil && len(pod.Containers) == 0 {
+		return
+	}
+	if s.Pods == nil {
+		s.Pods = make(map[stats.PodReference]*PodSwapStats)
+	}
+	s.Pods[ref] = pod
+}
+
+// container returns the swap usage of the given container, or nil if it reported none.
+func (p *PodSwapStats) container(name string) *SwapStats {
+	if p == nil {
+		return nil
+	}
+	return p.Containers[name]
+}
+
+// addContainer records the swap usage of the given container.
+func (p *PodSwapStats) addContainer(name string, swap *SwapStats) {
+	if p.Containers == nil {
+		p.Containers = make(map[string]*SwapStats)
+	}
+	p.Containers[name] = swap
+}
+
+// swapOnlySummary decodes just the swap usage from a summary.
+type swapOnlySummary struct {
+	Node struct {
+		Swap *SwapStats `json:"swap"`
+	} `json:"node"`
+	Pods []struct {
+		PodRef     stats.PodReference `json:"podRef"`
+		Swap       *SwapStats         `json:"swap"`
+		Containers []struct {
+			Name string     `json:"name"`
+			Swap *SwapStats `json:"swap"`
+		} `json:"containers"`
+	} `json:"pods"`
+}
+
+// decodeSwap decodes the swap usage from the given summary response, with encoding/json.
+func decodeSwap(body []byte, swap *SwapSummary) error {
+	var decoded swapOnlySummary
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return err
+	}
+	swap.Node = decoded.Node.Swap
+	for _, pod := range decoded.Pods {
+		podSwap := &PodSwapStats{Pod: pod.Swap}
+		for _, container := range pod.Containers {
+			if container.Swap != nil {
+				podSwap.addContainer(container.Name, container.Swap)
+			}
+		}
+		swap.addPod(pod.PodRef, podSwap)
+	}
+	return nil
+}
+
+// swapUsage returns the usage in the given swap stats, or nil if there's none.
+func swapUsage(swap *SwapStats) *resource.Quantity {
+	if swap == nil || swap.SwapUsageBytes == nil {
+		return nil
+	}
+	return translate.Uint64Bytes("swap usage", *swap.SwapUsageBytes)
+}
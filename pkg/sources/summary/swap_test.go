@@ -0,0 +1,115 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var _ = Describe("Swap Stats", func() {
+	var servers []*httptest.Server
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+		servers = nil
+	})
+
+	// serve serves the given fixture, returning a source for the given node collecting from it with the given options.
+	serve := func(node, fixture string, opts SourceOptions) sources.MetricSource {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "summaries", fixture))
+		Expect(err).NotTo(HaveOccurred())
+		server := httptest.NewServer(&fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK, body: string(body)})
+		servers = append(servers, server)
+		client, host := directClientWith(server, KubeletClientConfig{})
+		return NewSummaryMetricsSource(NodeInfo{Name: node, ConnectAddress: host}, client, opts)
+	}
+
+	// swapUsage collects from the given source, returning the swap usage of its node, pods and containers, by name (with
+	// pods as namespace/name, and containers as pod/container), with nil for those without any.
+	swapUsage := func(src sources.MetricSource) map[string]*resource.Quantity {
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Nodes).To(HaveLen(1))
+		res := map[string]*resource.Quantity{batch.Nodes[0].Name: batch.Nodes[0].SwapUsage}
+		for _, pod := range batch.Pods {
+			res[pod.Namespace+"/"+pod.Name] = pod.SwapUsage
+			for _, container := range pod.Containers {
+				res[pod.Name+"/"+container.Name] = container.SwapUsage
+			}
+		}
+		return res
+	}
+
+	bytes := func(value int64) *resource.Quantity {
+		return resource.NewQuantity(value, resource.BinarySI)
+	}
+
+	It("should collect swap usage from the nodes that report it, omitting it elsewhere", func() {
+		Expect(swapUsage(serve("swap-node1", "swap-node.json", SourceOptions{SwapStats: true}))).To(Equal(map[string]*resource.Quantity{
+			"swap-node1":                  bytes(1073741824),
+			"default/cache-0":             bytes(805306368),
+			"cache-0/redis":               bytes(805306368),
+			"cache-0/exporter":            bytes(0),
+			"default/web-6f5d8c7b9-2xq7k": nil,
+			"web-6f5d8c7b9-2xq7k/nginx":   nil,
+		}))
+
+		By("collecting from a node without swap in the same cluster")
+		Expect(swapUsage(serve("gpu-node1", "gpu-node.json", SourceOptions{SwapStats: true}))).To(Equal(map[string]*resource.Quantity{
+			"gpu-node1":                        nil,
+			"ml/trainer-0":                     nil,
+			"trainer-0/trainer":                nil,
+			"trainer-0/log-shipper":            nil,
+			"ml/inference-7d9f8c6b5-xk2lp":     nil,
+			"inference-7d9f8c6b5-xk2lp/server": nil,
+		}))
+	})
+
+	It("should leave swap usage out when disabled", func() {
+		for _, usage := range swapUsage(serve("swap-node1", "swap-node.json", SourceOptions{})) {
+			Expect(usage).To(BeNil())
+		}
+	})
+
+	It("should decode the same swap usage fast as in full, for every summary in the corpus", func() {
+		for name, body := range summaryCorpus() {
+			full := &SwapSummary{}
+			Expect(SummaryDecoderFull.DecodeSkippingWithSwap(body, &stats.Summary{}, nil, full)).To(Succeed(), name)
+			fast := &SwapSummary{}
+			Expect(SummaryDecoderFast.DecodeSkippingWithSwap(body, &stats.Summary{}, nil, fast)).To(Succeed(), name)
+			Expect(fast).To(Equal(full), name)
+			if name == "swap-node.json" {
+				Expect(full.Node).NotTo(BeNil())
+				Expect(full.Pods).To(HaveLen(1))
+			} else {
+				Expect(full).To(Equal(&SwapSummary{}), name)
+			}
+		}
+	})
+})
@@ -0,0 +1,353 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// The summary API doesn't include CFS throttling, so, when enabled, it's fetched with an
+// auxiliary request to the Kubelet's cAdvisor metrics endpoint, made with the same client
+// (and so the same TLS and authentication settings) as the summary, once the summary has
+// been fetched.  That endpoint serves every cAdvisor series for every container, so it's
+// parsed as a stream, one line at a time, with every line but the throttling series (for
+// the pods in the batch) skipped before parsing, and both the response and its lines
+// bounded in size.  Failures only cost the throttling rates: the summary's metrics are
+// still returned, and the scrape still counts as a success.
+//
+// Like page fault rates, throttling rates are calculated from the cumulative throttled
+// time in successive responses, over the time between them.
+
+const (
+	// throttledSecondsSeries is the cAdvisor series with the cumulative time each container was throttled.
+	throttledSecondsSeries = "container_cpu_cfs_throttled_seconds_total"
+	// maxCadvisorBytes bounds the size of the cAdvisor metrics read from a Kubelet.
+	maxCadvisorBytes = 64 << 20
+	// maxCadvisorLineBytes bounds the size of a single series line, beyond which it's skipped.
+	maxCadvisorLineBytes = 64 << 10
+)
+
+var throttlingFailuresTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "cpu_throttling_failures_total",
+		Help:      "The number of failed auxiliary scrapes of CPU throttling from the Kubelets' cAdvisor metrics, which don't affect the other metrics.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(throttlingFailuresTotal)
+}
+
+// podKey identifies a pod in a batch.
+type podKey struct {
+	namespace, pod string
+}
+
+type throttleSample struct {
+	timestamp time.Time
+	seconds   float64
+}
+
+// throttleSamples holds the cumulative throttled time sampled from a single response, by container.
+type throttleSamples map[containerKey]throttleSample
+
+// throttlingGetter is implemented by KubeletInterfaces which can fetch
+// CPU throttling from the Kubelets' cAdvisor metrics.
+type throttlingGetter interface {
+	// GetCPUThrottling fetches the cumulative throttled time of the containers
+	// in the given pods from the given Kubelet.
+	GetCPUThrottling(ctx context.Context, host string, pods map[podKey]struct{}) (throttleSamples, error)
+}
+
+// throttleTracker holds the last throttled times sampled from each node.
+type throttleTracker struct {
+	mu      sync.Mutex
+	samples map[string]throttleSamples
+}
+
+func newThrottleTracker() *throttleTracker {
+	return &throttleTracker{samples: make(map[string]throttleSamples)}
+}
+
+// swap replaces the samples for the given node, returning the previous ones, if any.
+func (t *throttleTracker) swap(node string, samples throttleSamples) throttleSamples {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.samples[node]
+	t.samples[node] = samples
+	return prev
+}
+
+// prune removes the samples of any node not in the given set.
+func (t *throttleTracker) prune(keep map[string]struct{}) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node := range t.samples {
+		if _, ok := keep[node]; !ok {
+			delete(t.samples, node)
+		}
+	}
+}
+
+// addThrottling fetches the throttling of the containers in the given batch from the given address
+// (which the summary was fetched from), setting their rates where the previous sample allows.
+// Failures are logged and counted, but otherwise ignored.
+func (src *summaryMetricsSource) addThrottling(ctx context.Context, batch *sources.MetricsBatch, addr string) {
+	getter, ok := src.kubeletClient.(throttlingGetter)
+	if src.throttling == nil || !ok || len(batch.Pods) == 0 {
+		return
+	}
+	pods := make(map[podKey]struct{}, len(batch.Pods))
+	for _, pod := range batch.Pods {
+		pods[podKey{namespace: pod.Namespace, pod: pod.Name}] = struct{}{}
+	}
+	samples, err := getter.GetCPUThrottling(withNodeZone(WithNodeName(ctx, src.node.Name), src.node.Zone), addr, pods)
+	if err != nil {
+		throttlingFailuresTotal.Inc()
+		loglevel.V(loglevel.Scraper, 2).Infof("unable to fetch CPU throttling from Kubelet %s (%s), leaving it out: %v", src.node.Name, addr, err)
+		return
+	}
+
+	prev := src.throttling.swap(src.node.Name, samples)
+	for i := range batch.Pods {
+		pod := &batch.Pods[i]
+		for j := range pod.Containers {
+			key := containerKey{namespace: pod.Namespace, pod: pod.Name, container: pod.Containers[j].Name}
+			pod.Containers[j].CPUThrottling = throttlingRate(prev[key], samples[key], src.opts.MaxRateGap)
+		}
+	}
+}
+
+// throttlingRate calculates the throttling rate between the given samples, if they allow it.
+func throttlingRate(last, cur throttleSample, maxGap time.Duration) *sources.ThrottlingRate {
+	if last.timestamp.IsZero() || cur.timestamp.IsZero() {
+		return nil
+	}
+	window, ok := translate.RateWindow(last.timestamp, cur.timestamp, cur.seconds < last.seconds, maxGap)
+	if !ok {
+		return nil
+	}
+	return &sources.ThrottlingRate{
+		ThrottledSeconds: translate.MilliRate(cur.seconds-last.seconds, window),
+		Window:           window,
+	}
+}
+
+// GetCPUThrottling fetches the cumulative throttled time of the containers in the given pods
+// from the given Kubelet's cAdvisor metrics, with the same client used for its summary.
+func (kc *kubeletClient) GetCPUThrottling(ctx context.Context, host string, pods map[podKey]struct{}) (samples throttleSamples, err error) {
+	endpoint, err := kc.endpointFor(ctx, host, "/metrics/cadvisor")
+	if err != nil {
+		return nil, err
+	}
+	url := endpoint.url
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	client := endpoint.client
+	trigger := scrapeTriggerFrom(ctx)
+	if trigger.reason != "" {
+		req.Header.Set(ReasonHeader, string(trigger.reason))
+	}
+	if trigger.cycleID != "" {
+		req.Header.Set(CycleHeader, trigger.cycleID)
+	}
+	req.Header.Set("Accept", "text/plain")
+	acceptGzip(req)
+
+	start := time.Now()
+	var statusCode int
+	body := &countingReader{}
+	defer func() { kc.observe(req, EndpointCadvisor, start, statusCode, body.n, err) }()
+
+	release, err := kc.gate.acquire(ctx, gateKeyFor(req))
+	if err != nil {
+		return nil, fmt.Errorf("gave up waiting to request %q (%s): %w", url, trigger, err)
+	}
+	defer release()
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, withCancelCause(ctx, fmt.Errorf("%w (%s)", err, trigger))
+	}
+	defer response.Body.Close()
+	statusCode = response.StatusCode
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request for %q failed (%s) - %q", url, trigger, response.Status)
+	}
+	measured, err := newMeasuredBody(response)
+	defer measured.record(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %q (%s): %v", url, trigger, err)
+	}
+	body.r = io.LimitReader(measured, maxCadvisorBytes)
+	samples, err = parseThrottling(body, pods, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q (%s): %v", url, trigger, err)
+	}
+	return samples, nil
+}
+
+// parseThrottling reads the throttled time of the containers in the given pods from the given
+// cAdvisor metrics, in the Prometheus text format, skipping all other series without parsing
+// them.  Samples without their own timestamps are given the given time.
+func parseThrottling(r io.Reader, pods map[podKey]struct{}, now time.Time) (throttleSamples, error) {
+	samples := make(throttleSamples)
+	reader := bufio.NewReaderSize(r, maxCadvisorLineBytes)
+	prefix := []byte(throttledSecondsSeries)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// too long to be worth parsing, so skip the rest of the line
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			line = nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if bytes.HasPrefix(line, prefix) {
+			if key, sample, ok := parseThrottlingLine(line[len(prefix):], now); ok {
+				if _, wanted := pods[podKey{namespace: key.namespace, pod: key.pod}]; wanted {
+					samples[key] = sample
+				}
+			}
+		}
+		if err == io.EOF {
+			return samples, nil
+		}
+	}
+}
+
+// parseThrottlingLine parses the labels, value, and optional timestamp of a throttled time
+// series, following its name.  Series without a named container (e.g. for the pod's cgroup,
+// or its pause container) are skipped.
+func parseThrottlingLine(line []byte, now time.Time) (containerKey, throttleSample, bool) {
+	var key containerKey
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) == 0 || line[0] != '{' {
+		// either another series sharing the prefix, or one without labels
+		return key, throttleSample{}, false
+	}
+	line = line[1:]
+	for {
+		line = bytes.TrimLeft(line, " ,")
+		if len(line) == 0 {
+			return key, throttleSample{}, false
+		}
+		if line[0] == '}' {
+			line = line[1:]
+			break
+		}
+		eq := bytes.IndexByte(line, '=')
+		if eq < 0 || eq+1 >= len(line) || line[eq+1] != '"' {
+			return key, throttleSample{}, false
+		}
+		name := string(bytes.TrimSpace(line[:eq]))
+		value, rest, ok := parseLabelValue(line[eq+2:])
+		if !ok {
+			return key, throttleSample{}, false
+		}
+		line = rest
+		// newer Kubelets drop the _name suffixes
+		switch name {
+		case "namespace":
+			key.namespace = value
+		case "pod", "pod_name":
+			key.pod = value
+		case "container", "container_name":
+			key.container = value
+		}
+	}
+	if key.namespace == "" || key.pod == "" || key.container == "" || key.container == "POD" {
+		return key, throttleSample{}, false
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) == 0 || len(fields) > 2 {
+		return key, throttleSample{}, false
+	}
+	seconds, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return key, throttleSample{}, false
+	}
+	sample := throttleSample{timestamp: now, seconds: seconds}
+	if len(fields) == 2 {
+		millis, err := strconv.ParseInt(string(fields[1]), 10, 64)
+		if err != nil {
+			return key, throttleSample{}, false
+		}
+		sample.timestamp = time.Unix(0, millis*int64(time.Millisecond))
+	}
+	return key, sample, true
+}
+
+// parseLabelValue parses a quoted label value (after its opening quote), returning it and the rest of the line.
+func parseLabelValue(line []byte) (string, []byte, bool) {
+	var value []byte
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			return string(value), line[i+1:], true
+		case '\\':
+			i++
+			if i == len(line) {
+				return "", nil, false
+			}
+			if line[i] == 'n' {
+				value = append(value, '\n')
+			} else {
+				value = append(value, line[i])
+			}
+		default:
+			value = append(value, line[i])
+		}
+	}
+	return "", nil, false
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
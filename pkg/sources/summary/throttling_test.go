@@ -0,0 +1,164 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// cadvisorFixture is the template of the fake Kubelet's cAdvisor metrics.
+var cadvisorFixture = template.Must(template.ParseFiles("testdata/cadvisor-metrics.txt"))
+
+// cadvisorValues fill in the cAdvisor metrics fixture.
+type cadvisorValues struct {
+	// Timestamp is the sample timestamp, in milliseconds since the epoch.
+	Timestamp    int64
+	App, Sidecar float64
+}
+
+// throttlingKubelet is a fake Kubelet serving both a summary and cAdvisor metrics.
+type throttlingKubelet struct {
+	mu       sync.Mutex
+	summary  []byte
+	cadvisor cadvisorValues
+	// cadvisorStatus, if set, fails the cAdvisor metrics with that status.
+	cadvisorStatus int
+	// junkLineBytes, if set, prefixes the cAdvisor metrics with a series line that long.
+	junkLineBytes int
+}
+
+func (k *throttlingKubelet) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch req.URL.Path {
+	case "/stats/summary/":
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(k.summary)
+	case "/metrics/cadvisor":
+		if k.cadvisorStatus != 0 {
+			http.Error(w, "injected error", k.cadvisorStatus)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if k.junkLineBytes > 0 {
+			w.Write([]byte(`container_cpu_cfs_throttled_seconds_total{id="` + strings.Repeat("x", k.junkLineBytes) + "\"} 1\n"))
+		}
+		Expect(cadvisorFixture.Execute(w, k.cadvisor)).To(Succeed())
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (k *throttlingKubelet) set(values cadvisorValues) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cadvisor = values
+}
+
+var _ = Describe("CPU Throttling Rates", func() {
+	var (
+		kubelet *throttlingKubelet
+		server  *httptest.Server
+		src     sources.MetricSource
+		start   time.Time
+	)
+
+	BeforeEach(func() {
+		start = time.Now().Truncate(time.Millisecond)
+		body, err := json.Marshal(&stats.Summary{
+			Node: stats.NodeStats{
+				NodeName: "node1",
+				CPU:      cpuStats(100, start),
+				Memory:   memStats(200, start),
+			},
+			Pods: []stats.PodStats{
+				podStats("ns1", "pod1", containerStats("app", 300, 400, start), containerStats("sidecar", 500, 600, start)),
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		kubelet = &throttlingKubelet{summary: body}
+		server = httptest.NewServer(kubelet)
+
+		host, port := serverHostPort(server)
+		client, err := NewKubeletClient(http.DefaultTransport, &KubeletClientConfig{
+			Port:                         port,
+			RESTConfig:                   &rest.Config{Host: "https://apiserver.invalid:6443"},
+			DeprecatedCompletelyInsecure: true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		src = NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{CPUThrottlingRates: true})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// collect collects a batch, returning the throttling rates of each container in it.
+	collect := func() map[string]*sources.ThrottlingRate {
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(batch.Pods).To(HaveLen(1))
+		rates := make(map[string]*sources.ThrottlingRate)
+		for _, container := range batch.Pods[0].Containers {
+			Expect(container.CpuUsage.IsZero()).To(BeFalse())
+			rates[container.Name] = container.CPUThrottling
+		}
+		return rates
+	}
+
+	It("should calculate the rates from successive samples of the cAdvisor metrics", func() {
+		kubelet.set(cadvisorValues{Timestamp: start.UnixNano() / int64(time.Millisecond), App: 12.5, Sidecar: 3})
+		Expect(collect()).To(Equal(map[string]*sources.ThrottlingRate{"app": nil, "sidecar": nil}))
+
+		kubelet.set(cadvisorValues{Timestamp: start.Add(10*time.Second).UnixNano() / int64(time.Millisecond), App: 14, Sidecar: 3.25})
+		Expect(collect()).To(Equal(map[string]*sources.ThrottlingRate{
+			"app":     {ThrottledSeconds: *resource.NewMilliQuantity(150, resource.DecimalSI), Window: 10 * time.Second},
+			"sidecar": {ThrottledSeconds: *resource.NewMilliQuantity(25, resource.DecimalSI), Window: 10 * time.Second},
+		}))
+
+		By("declining rates over stale samples")
+		Expect(collect()).To(Equal(map[string]*sources.ThrottlingRate{"app": nil, "sidecar": nil}))
+	})
+
+	It("should skip series lines too long to parse, without losing the rest", func() {
+		kubelet.junkLineBytes = 100 << 10
+		kubelet.set(cadvisorValues{Timestamp: start.UnixNano() / int64(time.Millisecond), App: 12.5, Sidecar: 3})
+		collect()
+		kubelet.set(cadvisorValues{Timestamp: start.Add(10*time.Second).UnixNano() / int64(time.Millisecond), App: 13.5, Sidecar: 3})
+		Expect(collect()["app"]).To(Equal(&sources.ThrottlingRate{ThrottledSeconds: *resource.NewMilliQuantity(100, resource.DecimalSI), Window: 10 * time.Second}))
+	})
+
+	It("should still return the summary's metrics when the cAdvisor metrics fail", func() {
+		kubelet.cadvisorStatus = http.StatusForbidden
+		Expect(collect()).To(Equal(map[string]*sources.ThrottlingRate{"app": nil, "sidecar": nil}))
+		Expect(collect()).To(Equal(map[string]*sources.ThrottlingRate{"app": nil, "sidecar": nil}))
+	})
+})
@@ -0,0 +1,207 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	utilflag "k8s.io/apiserver/pkg/util/flag"
+)
+
+// extraTLSVersions are the TLS versions accepted in addition to those known to the
+// (serving-side) Kubernetes TLS flag helpers, which predate TLS 1.3.
+var extraTLSVersions = map[string]uint16{
+	"VersionTLS13": tls.VersionTLS13,
+}
+
+// TLSPossibleVersions lists the names accepted by ParseTLSMinVersion.
+func TLSPossibleVersions() []string {
+	names := utilflag.TLSPossibleVersions()
+	for name := range extraTLSVersions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTLSMinVersion parses the name of a minimum TLS version for Kubelet connections,
+// in the same form as the Kubernetes --tls-min-version flags (e.g. "VersionTLS12").
+// An empty name means no minimum beyond Go's default, and is returned as zero.
+func ParseTLSMinVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+	if version, ok := extraTLSVersions[name]; ok {
+		return version, nil
+	}
+	version, err := utilflag.TLSVersion(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown Kubelet TLS version %q, must be one of %s", name, strings.Join(TLSPossibleVersions(), ", "))
+	}
+	return version, nil
+}
+
+// ParseTLSCipherSuites parses the names of the cipher suites allowed for Kubelet connections,
+// in the same form as the Kubernetes --tls-cipher-suites flags (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256").
+// No names means Go's default suites.
+func ParseTLSCipherSuites(names []string) ([]uint16, error) {
+	suites, err := utilflag.TLSCipherSuites(names)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Kubelet TLS cipher suites: %v (supported suites are %s)", err, strings.Join(utilflag.TLSCipherPossibleValues(), ", "))
+	}
+	return suites, nil
+}
+
+// tlsPolicy is the minimum version and allowed cipher suites required of Kubelet connections.
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	dial         DialFunc
+}
+
+// newTLSPolicy returns the TLS policy set in the given config, or nil if none is set.
+func newTLSPolicy(config *KubeletClientConfig) *tlsPolicy {
+	if config.TLSMinVersion == 0 && len(config.TLSCipherSuites) == 0 {
+		return nil
+	}
+	dial := config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &tlsPolicy{
+		minVersion:   config.TLSMinVersion,
+		cipherSuites: config.TLSCipherSuites,
+		dial:         dial,
+	}
+}
+
+// apply restricts the given TLS config to the policy.
+func (p *tlsPolicy) apply(tlsConfig *tls.Config) {
+	if p.minVersion != 0 {
+		tlsConfig.MinVersion = p.minVersion
+	}
+	if len(p.cipherSuites) > 0 {
+		tlsConfig.CipherSuites = p.cipherSuites
+	}
+}
+
+// allows checks if a connection with the given state meets the policy.  Go doesn't
+// allow the TLS 1.3 suites to be configured, so the allowed suites only apply below it.
+func (p *tlsPolicy) allows(state tls.ConnectionState) bool {
+	if state.Version < p.minVersion {
+		return false
+	}
+	if len(p.cipherSuites) == 0 || state.Version >= tls.VersionTLS13 {
+		return true
+	}
+	for _, suite := range p.cipherSuites {
+		if suite == state.CipherSuite {
+			return true
+		}
+	}
+	return false
+}
+
+// explain checks if the given request error was caused by the Kubelet at the given address
+// not meeting the policy, returning an ErrTLSPolicy describing what it negotiates if so.
+// Since failed handshakes don't say what the Kubelet offered, it makes a second, permissive,
+// handshake (without sending any requests) to find out.  Otherwise, it returns the original error.
+func (p *tlsPolicy) explain(ctx context.Context, addr string, err error, trigger scrapeTrigger) error {
+	var alertErr tls.AlertError
+	if p == nil || !errors.As(err, &alertErr) && !strings.Contains(err.Error(), "tls:") {
+		return err
+	}
+
+	conn, dialErr := p.dial(ctx, "tcp", addr)
+	if dialErr != nil {
+		return err
+	}
+	defer conn.Close()
+	var suites []uint16
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites = append(suites, suite.ID)
+	}
+	probe := tls.Client(conn, &tls.Config{
+		// we only look at the negotiated parameters, and never send anything
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       suites,
+	})
+	if probeErr := probe.HandshakeContext(ctx); probeErr != nil {
+		return err
+	}
+	state := probe.ConnectionState()
+	if p.allows(state) {
+		return err
+	}
+	return &ErrTLSPolicy{
+		addr:              addr,
+		negotiatedVersion: state.Version,
+		negotiatedSuite:   state.CipherSuite,
+		requiredVersion:   p.minVersion,
+		allowedSuites:     p.cipherSuites,
+		err:               err,
+		trigger:           trigger,
+	}
+}
+
+// ErrTLSPolicy indicates that the Kubelet only accepts TLS connections weaker than
+// the configured minimum version or allowed cipher suites.
+type ErrTLSPolicy struct {
+	addr              string
+	negotiatedVersion uint16
+	negotiatedSuite   uint16
+	requiredVersion   uint16
+	allowedSuites     []uint16
+	err               error
+	trigger           scrapeTrigger
+}
+
+func (err *ErrTLSPolicy) Error() string {
+	var required []string
+	if err.requiredVersion != 0 {
+		required = append(required, tls.VersionName(err.requiredVersion)+" or later")
+	}
+	if len(err.allowedSuites) > 0 {
+		names := make([]string, len(err.allowedSuites))
+		for i, suite := range err.allowedSuites {
+			names[i] = tls.CipherSuiteName(suite)
+		}
+		required = append(required, "one of the cipher suites "+strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("TLS connection to %q refused by policy (%s): negotiated %s with %s, but requires %s: %v",
+		err.addr, err.trigger, tls.VersionName(err.negotiatedVersion), tls.CipherSuiteName(err.negotiatedSuite), strings.Join(required, " and "), err.err)
+}
+
+func (err *ErrTLSPolicy) Unwrap() error {
+	return err.err
+}
+
+func (err *ErrTLSPolicy) ErrorClass() string { return ErrorClassTLSPolicy }
+func (err *ErrTLSPolicy) Remediation() string {
+	return remediations[ErrorClassTLSPolicy]
+}
+
+// IsTLSPolicyError checks if the given error (or any error it wraps) is an ErrTLSPolicy.
+func IsTLSPolicyError(err error) bool {
+	var policyErr *ErrTLSPolicy
+	return errors.As(err, &policyErr)
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// The stages at which the bytes of Kubelet responses are counted.
+const (
+	// TransferStageWire counts the bytes as transferred, before any decompression.
+	TransferStageWire = "wire"
+	// TransferStageDecompressed counts the bytes once decompressed.
+	TransferStageDecompressed = "decompressed"
+)
+
+// maxTransferZones bounds the number of zones that bytes transferred are reported for,
+// so that nodes with unusual zone labels can't grow the metrics without bound.  Bytes
+// from nodes in zones seen after that are reported for otherTransferZone.
+const maxTransferZones = 32
+
+const (
+	// unknownTransferZone is the zone reported for nodes without any zone label.
+	unknownTransferZone = "unknown"
+	// otherTransferZone is the zone reported for nodes in zones beyond maxTransferZones.
+	otherTransferZone = "other"
+)
+
+// zoneLabels are the node labels checked, in order, for the name of a node's availability zone.
+var zoneLabels = []string{
+	"topology.kubernetes.io/zone",
+	"failure-domain.beta.kubernetes.io/zone",
+}
+
+var (
+	kubeletResponseBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet",
+			Name:      "response_bytes_total",
+			Help:      "The number of bytes of Kubelet responses read, including those of failed or partial reads, by the availability zone of the node and the stage counted at (wire, before decompression, or decompressed)",
+		},
+		[]string{"zone", "stage"},
+	)
+	kubeletCycleResponseBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "kubelet",
+			Name:      "cycle_response_bytes",
+			Help:      "The number of bytes of Kubelet responses read during the last complete collection cycle, by the availability zone of the node and the stage counted at (wire, before decompression, or decompressed)",
+		},
+		[]string{"zone", "stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(kubeletResponseBytes)
+	prometheus.MustRegister(kubeletCycleResponseBytes)
+}
+
+// transferZoneKey identifies the bytes read from the nodes of a single zone.
+type transferZoneKey struct {
+	zone, stage string
+}
+
+// transferTracker aggregates the bytes read from the Kubelets by zone, in total and per cycle.
+// A cycle's bytes are published once the first request of the next cycle is made, since
+// every scrape of a cycle finishes (or times out) before the next starts.
+type transferTracker struct {
+	mu    sync.Mutex
+	zones map[string]struct{}
+	// cycle is the ID of the cycle being aggregated, and previous that of the last published,
+	// so that any straggling reads from it aren't mistaken for the start of a new cycle.
+	cycle, previous string
+	cycleBytes      map[transferZoneKey]int64
+}
+
+var transfers = newTransferTracker()
+
+func newTransferTracker() *transferTracker {
+	return &transferTracker{
+		zones:      make(map[string]struct{}),
+		cycleBytes: make(map[transferZoneKey]int64),
+	}
+}
+
+// zoneLabel returns the zone to report the given zone's bytes under.  The caller must hold mu.
+func (t *transferTracker) zoneLabel(zone string) string {
+	if zone == "" {
+		return unknownTransferZone
+	}
+	if _, ok := t.zones[zone]; ok {
+		return zone
+	}
+	if len(t.zones) >= maxTransferZones {
+		return otherTransferZone
+	}
+	t.zones[zone] = struct{}{}
+	return zone
+}
+
+// record counts the bytes of a response read with the given context, as both transferred
+// and decompressed.
+func (t *transferTracker) record(ctx context.Context, wire, decompressed int64) {
+	cycleID := sources.CycleIDFrom(ctx)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	zone := t.zoneLabel(nodeZoneFrom(ctx))
+	kubeletResponseBytes.WithLabelValues(zone, TransferStageWire).Add(float64(wire))
+	kubeletResponseBytes.WithLabelValues(zone, TransferStageDecompressed).Add(float64(decompressed))
+
+	if cycleID == "" || cycleID == t.previous {
+		return
+	}
+	if cycleID != t.cycle {
+		if t.cycle != "" {
+			t.publish()
+		}
+		t.previous, t.cycle = t.cycle, cycleID
+	}
+	t.cycleBytes[transferZoneKey{zone: zone, stage: TransferStageWire}] += wire
+	t.cycleBytes[transferZoneKey{zone: zone, stage: TransferStageDecompressed}] += decompressed
+}
+
+// publish sets the per-cycle gauges from the bytes of the cycle being aggregated, and starts
+// aggregating afresh.  The caller must hold mu.
+func (t *transferTracker) publish() {
+	kubeletCycleResponseBytes.Reset()
+	for key, bytes := range t.cycleBytes {
+		kubeletCycleResponseBytes.WithLabelValues(key.zone, key.stage).Set(float64(bytes))
+	}
+	t.cycleBytes = make(map[transferZoneKey]int64, len(t.cycleBytes))
+}
+
+type nodeZoneKey struct{}
+
+// withNodeZone records the availability zone of the node being scraped in the context,
+// so that the bytes read from its Kubelet can be attributed to it.
+func withNodeZone(ctx context.Context, zone string) context.Context {
+	return context.WithValue(ctx, nodeZoneKey{}, zone)
+}
+
+// nodeZoneFrom fetches the zone of the node being scraped from the context, if present.
+func nodeZoneFrom(ctx context.Context) string {
+	zone, _ := ctx.Value(nodeZoneKey{}).(string)
+	return zone
+}
+
+// nodeZone finds the name of the given node's zone from the first zone label present on it.
+func nodeZone(node *corev1.Node) string {
+	for _, label := range zoneLabels {
+		if zone, ok := node.Labels[label]; ok && zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
+
+// acceptGzip asks for a compressed response to the given request, as the transport would,
+// but so that the response is left compressed for a measuredBody to decompress, since
+// otherwise the bytes transferred can't be counted.
+func acceptGzip(req *http.Request) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+}
+
+// measuredBody reads the body of a response, decompressing it if it was compressed (see
+// acceptGzip), counting the bytes read both as transferred and once decompressed.
+type measuredBody struct {
+	wire         countingReader
+	decompressed countingReader
+}
+
+// newMeasuredBody wraps the body of the given response.  If it fails, the body can still be
+// recorded, since decompressing reads the start of the body.
+func newMeasuredBody(response *http.Response) (*measuredBody, error) {
+	body := &measuredBody{}
+	body.wire.r = response.Body
+	body.decompressed.r = &body.wire
+	if response.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(&body.wire)
+		if err != nil {
+			return body, fmt.Errorf("unable to decompress response: %v", err)
+		}
+		body.decompressed.r = gz
+		// as the transport does when it decompresses responses itself
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+	}
+	return body, nil
+}
+
+func (b *measuredBody) Read(p []byte) (int, error) {
+	return b.decompressed.Read(p)
+}
+
+// record counts the bytes read so far from the body, with the given request context.
+func (b *measuredBody) record(ctx context.Context) {
+	transfers.record(ctx, b.wire.n, b.decompressed.n)
+}
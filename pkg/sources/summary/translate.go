@@ -0,0 +1,264 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	stats "k8s.io/kubernetes/pkg/kubelet/apis/stats/v1alpha1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+// summaryPayload is what the summary translator translates: a summary, with the pods to
+// translate from it (which may be fewer than its pods, e.g. when capped), and the state
+// of the optional parts of its translation carried over from the node's last summary.
+type summaryPayload struct {
+	summary *stats.Summary
+	pods    []stats.PodStats
+	// swap, if non-nil, holds the swap usage reported in the summary.
+	swap *SwapSummary
+	// cpuCheck, if non-nil, checks the CPU usage rates in the summary (see cpurate.go).
+	cpuCheck *cpuRateCheck
+	// prevFaults and nextFaults, if non-nil, hold the page fault counts sampled from
+	// the last summary, to calculate rates from, and from this one (see pagefaults.go).
+	prevFaults, nextFaults faultSamples
+}
+
+// summaryTranslator translates Kubelet summaries into batches.
+type summaryTranslator struct {
+	excludedContainers *ContainerFilter
+	maxRateGap         time.Duration
+	acceleratorStats   bool
+	podUsageTolerance  float64
+	podMemoryOverhead  bool
+}
+
+var _ translate.BatchTranslator = &summaryTranslator{}
+
+func newSummaryTranslator(opts SourceOptions) *summaryTranslator {
+	return &summaryTranslator{
+		excludedContainers: opts.ExcludedContainers,
+		maxRateGap:         opts.MaxRateGap,
+		acceleratorStats:   opts.AcceleratorStats,
+		podUsageTolerance:  opts.PodUsageTolerance,
+		podMemoryOverhead:  opts.PodMemoryOverhead,
+	}
+}
+
+// Translate translates the given *summaryPayload into a batch.
+func (t *summaryTranslator) Translate(node translate.Node, payload interface{}) (*sources.MetricsBatch, error) {
+	p, ok := payload.(*summaryPayload)
+	if !ok {
+		return nil, translate.UnexpectedPayloadError("summary", payload)
+	}
+
+	res := &sources.MetricsBatch{
+		Nodes: make([]sources.NodeMetricsPoint, 1),
+		Pods:  make([]sources.PodMetricsPoint, len(p.pods)),
+	}
+
+	var errs []error
+	errs = append(errs, t.decodeNodeStats(node, &p.summary.Node, &res.Nodes[0], p.cpuCheck)...)
+	if p.swap != nil {
+		res.Nodes[0].SwapUsage = swapUsage(p.swap.Node)
+	}
+	if len(errs) != 0 {
+		// if we had errors providing node metrics, discard the data point
+		// so that we don't incorrectly report metric values as zero.
+		res.Nodes = res.Nodes[:1]
+	}
+
+	num := 0
+	for _, pod := range p.pods {
+		podErrs := t.decodePodStats(node, &pod, &res.Pods[num], p, p.swap.pod(pod.PodRef))
+		errs = append(errs, podErrs...)
+		if len(podErrs) != 0 {
+			// NB: we explicitly want to discard pods with partial results, since
+			// the horizontal pod autoscaler takes special action when a pod is missing
+			// metrics (and zero CPU or memory does not count as "missing metrics")
+
+			// we don't care if we reuse slots in the result array,
+			// because they get completely overwritten in decodePodStats
+			continue
+		}
+		num++
+	}
+	res.Pods = res.Pods[:num]
+
+	return res, utilerrors.NewAggregate(errs)
+}
+
+// decodeNodeStats decodes the given node stats into the target.  If cpuCheck is non-nil,
+// the node's CPU usage rate is checked by it (see cpurate.go).
+func (t *summaryTranslator) decodeNodeStats(node translate.Node, nodeStats *stats.NodeStats, target *sources.NodeMetricsPoint, cpuCheck *cpuRateCheck) []error {
+	timestamp, err := getScrapeTime(nodeStats.CPU, nodeStats.Memory)
+	if err != nil {
+		// if we can't get a timestamp, assume bad data in general
+		return []error{fmt.Errorf("unable to get valid timestamp for metric point for node %q, discarding data: %v", node.Address, err)}
+	}
+	*target = sources.NodeMetricsPoint{
+		Name: node.Name,
+		MetricsPoint: sources.MetricsPoint{
+			Timestamp: timestamp,
+			StartTime: nodeStats.StartTime.Time,
+		},
+	}
+	var errs []error
+	if err := cpuCheck.decodeCPU(&target.MetricsPoint, containerKey{}, nodeStats.CPU, nodeStats.StartTime.Time); err != nil {
+		errs = append(errs, fmt.Errorf("unable to get CPU for node %q, discarding data: %v", node.Address, err))
+	}
+	if err := decodeMemory(&target.MemoryUsage, nodeStats.Memory); err != nil {
+		errs = append(errs, fmt.Errorf("unable to get memory for node %q, discarding data: %v", node.Address, err))
+	}
+	return errs
+}
+
+// decodePodStats decodes the given pod's stats into the target.  If the payload's prevFaults and
+// nextFaults are non-nil, it also calculates page fault rates from prevFaults, recording the new
+// counts in nextFaults.  Likewise, if its cpuCheck is non-nil, the containers' CPU usage rates
+// are checked by it, and if swap is non-nil, it holds the swap usage reported for the pod.
+func (t *summaryTranslator) decodePodStats(node translate.Node, podStats *stats.PodStats, target *sources.PodMetricsPoint, p *summaryPayload, swap *PodSwapStats) []error {
+	containers := t.excludedContainers.keep(podStats.Containers)
+
+	// completely overwrite data in the target
+	*target = sources.PodMetricsPoint{
+		Name:       podStats.PodRef.Name,
+		Namespace:  podStats.PodRef.Namespace,
+		NodeName:   node.Name,
+		Containers: make([]sources.ContainerMetricsPoint, len(containers)),
+	}
+	if swap != nil {
+		target.SwapUsage = swapUsage(swap.Pod)
+	}
+
+	var errs []error
+	for i, container := range containers {
+		timestamp, err := getScrapeTime(container.CPU, container.Memory)
+		if err != nil {
+			// if we can't get a timestamp, assume bad data in general
+			errs = append(errs, fmt.Errorf("unable to get a valid timestamp for metric point for container %q in pod %s/%s on node %q, discarding data: %v", container.Name, target.Namespace, target.Name, node.Address, err))
+			continue
+		}
+		point := sources.ContainerMetricsPoint{
+			Name: container.Name,
+			MetricsPoint: sources.MetricsPoint{
+				Timestamp: timestamp,
+				StartTime: container.StartTime.Time,
+			},
+			ExcludedFromPodTotals: t.excludedContainers.Matches(container.Name),
+		}
+		key := containerKey{namespace: target.Namespace, pod: target.Name, container: container.Name}
+		if err := p.cpuCheck.decodeCPU(&point.MetricsPoint, key, container.CPU, container.StartTime.Time); err != nil {
+			errs = append(errs, fmt.Errorf("unable to get CPU for container %q in pod %s/%s on node %q, discarding data: %v", container.Name, target.Namespace, target.Name, node.Address, err))
+		}
+		if err := decodeMemory(&point.MemoryUsage, container.Memory); err != nil {
+			errs = append(errs, fmt.Errorf("unable to get memory for container %q in pod %s/%s on node %q: %v, discarding data", container.Name, target.Namespace, target.Name, node.Address, err))
+		}
+		if p.nextFaults != nil {
+			point.PageFaults = decodePageFaults(key, container.Memory, p.prevFaults, p.nextFaults, t.maxRateGap)
+		}
+		if t.acceleratorStats {
+			point.Accelerators = decodeAccelerators(container.Accelerators)
+		}
+		point.SwapUsage = swapUsage(swap.container(container.Name))
+
+		target.Containers[i] = point
+	}
+	if len(errs) == 0 && t.podUsageTolerance > 0 {
+		correctPodUsage(node.Name, podStats, target, t.podUsageTolerance)
+	}
+	if len(errs) == 0 && t.podMemoryOverhead {
+		target.MemoryOverhead = podMemoryOverhead(node.Name, podStats)
+	}
+
+	return errs
+}
+
+func decodeCPU(target *resource.Quantity, cpuStats *stats.CPUStats) error {
+	var usage *uint64
+	if cpuStats != nil {
+		usage = cpuStats.UsageNanoCores
+	}
+	nanoCores, err := translate.Required("cpu usage", usage)
+	if err != nil {
+		return err
+	}
+
+	*target = *translate.Uint64Quantity(nanoCores, -9)
+	return nil
+}
+
+func decodeMemory(target *resource.Quantity, memStats *stats.MemoryStats) error {
+	var workingSet *uint64
+	if memStats != nil {
+		workingSet = memStats.WorkingSetBytes
+	}
+	bytes, err := translate.Required("memory usage", workingSet)
+	if err != nil {
+		return err
+	}
+
+	*target = *translate.Uint64Bytes("memory usage", bytes)
+	return nil
+}
+
+// decodeAccelerators converts the given accelerator stats, returning nil if there are none.
+// Accelerators with makes that can't prefix a resource name (see sink.AcceleratorResources)
+// are left out, since their usage can't be served.
+func decodeAccelerators(accelStats []stats.AcceleratorStats) []sources.AcceleratorUsage {
+	var res []sources.AcceleratorUsage
+	for _, accel := range accelStats {
+		accelMake := strings.ToLower(accel.Make)
+		if errs := validation.IsDNS1123Label(accelMake); len(errs) > 0 {
+			loglevel.V(loglevel.Scraper, 2).Infof("ignoring accelerator %q with unusable make %q: %s", accel.ID, accel.Make, strings.Join(errs, ", "))
+			continue
+		}
+		memoryTotal, memoryUsed := translate.Uint64Bytes("accelerator memory total", accel.MemoryTotal), translate.Uint64Bytes("accelerator memory used", accel.MemoryUsed)
+		res = append(res, sources.AcceleratorUsage{
+			Make:        accelMake,
+			Model:       accel.Model,
+			ID:          accel.ID,
+			MemoryTotal: *memoryTotal,
+			MemoryUsed:  *memoryUsed,
+			DutyCycle:   *translate.Uint64Quantity(accel.DutyCycle, 0),
+		})
+	}
+	return res
+}
+
+// getScrapeTime returns the earlier of the timestamps of the given CPU and memory stats,
+// so that we can tell if a given data point was tainted by pod initialization.
+func getScrapeTime(cpu *stats.CPUStats, memory *stats.MemoryStats) (time.Time, error) {
+	var cpuTime, memoryTime time.Time
+	if cpu != nil {
+		cpuTime = cpu.Time.Time
+	}
+	if memory != nil {
+		memoryTime = memory.Time.Time
+	}
+	earliest, ok := translate.EarliestTimestamp(cpuTime, memoryTime)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no non-zero timestamp on either CPU or memory")
+	}
+	return earliest, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "update the golden files in testdata instead of comparing against them")
+
+// goldenBatch is what's compared against the golden files: the batch collected, and the error, if any.
+type goldenBatch struct {
+	Batch *sources.MetricsBatch `json:"batch"`
+	Error string                `json:"error,omitempty"`
+}
+
+var _ = Describe("Summary Translation", func() {
+	var (
+		kubelet *fakeKubelet
+		server  *httptest.Server
+		src     sources.MetricSource
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK}
+		server = httptest.NewServer(kubelet)
+		skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		client, host := directClientWith(server, KubeletClientConfig{SkippedSubtrees: skips.Retaining(AcceleratorSubtrees).Retaining(PodUsageSubtrees).Retaining(StartTimeSubtrees)})
+		// every optional part of the translation, besides those needing other endpoints
+		src = NewSummaryMetricsSource(NodeInfo{Name: "golden-node", ConnectAddress: host}, client, SourceOptions{
+			NodeNameVerification:    NodeNameVerificationWarn,
+			PageFaultRates:          true,
+			CPURateConsistencyRatio: 1.5,
+			AcceleratorStats:        true,
+			SwapStats:               true,
+			PodUsageTolerance:       0.1,
+			PodMemoryOverhead:       true,
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	// collect serves each of the given fixtures in turn, collecting each with the
+	// same source, and compares the last batch collected against the given golden file.
+	collect := func(golden string, fixtures ...string) {
+		var res goldenBatch
+		for _, fixture := range fixtures {
+			body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+			Expect(err).NotTo(HaveOccurred())
+			kubelet.body = string(body)
+			res = goldenBatch{}
+			res.Batch, err = src.Collect(context.Background())
+			if err != nil {
+				res.Error = err.Error()
+			}
+		}
+		actual, err := json.MarshalIndent(res, "", "  ")
+		Expect(err).NotTo(HaveOccurred())
+
+		goldenPath := filepath.Join("testdata", "batches", golden)
+		if *updateGolden {
+			Expect(ioutil.WriteFile(goldenPath, append(actual, '\n'), 0644)).To(Succeed())
+		}
+		expected, err := ioutil.ReadFile(goldenPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(actual)+"\n").To(Equal(string(expected)), golden)
+	}
+
+	It("should translate every summary in the corpus into the batches in the golden files", func() {
+		paths, err := filepath.Glob(filepath.Join("testdata", "summaries", "*.json"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(paths).NotTo(BeEmpty())
+		for _, path := range paths {
+			name := filepath.Base(path)
+			collect(name, filepath.Join("summaries", name))
+		}
+	})
+
+	It("should translate successive summaries into the batches with rates in the golden files", func() {
+		collect("agreeing-rates.json", filepath.Join("cpu-rates", "agreeing-1.json"), filepath.Join("cpu-rates", "agreeing-2.json"))
+		collect("disagreeing-rates.json", filepath.Join("cpu-rates", "disagreeing-1.json"), filepath.Join("cpu-rates", "disagreeing-2.json"))
+	})
+})
@@ -0,0 +1,315 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// The CPU usage rates derived from cumulative usage (see cpurate.go) need an earlier sample of
+// each container, so after a restart, they'd only be served from the second scrape of each
+// node on.  A WarmStart saves the last samples to a file, periodically and on shutdown, and
+// restores them on startup as the baselines of the first scrape.  A restored baseline is only
+// used for a container that started when it did at the time of the baseline (so that it's the
+// same container, whose counter can't have been reset in between), and that was sampled no
+// more than the maximum age before; otherwise, it's discarded, for just that container.
+//
+// The estimates of how long each node takes to scrape, which scrapes are ordered by (see
+// sources.CostOrdering), may be saved along with the samples, and restored on startup too,
+// aged by how long metrics-server was down.
+
+var warmStartBaselines = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "kubelet_summary",
+		Name:      "warm_start_baselines_total",
+		Help:      "Number of CPU usage samples restored from a warm start that the first scrape of their container or node derived a rate from (used), or discarded (start_time_mismatch, too_old).",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(warmStartBaselines)
+}
+
+const (
+	warmStartUsed              = "used"
+	warmStartStartTimeMismatch = "start_time_mismatch"
+	warmStartTooOld            = "too_old"
+)
+
+const (
+	// DefaultWarmStartMaxAge is the default age past which samples restored from a warm start are discarded.
+	DefaultWarmStartMaxAge = 5 * time.Minute
+	// DefaultWarmStartSaveInterval is the default interval at which the warm start is saved.
+	DefaultWarmStartSaveInterval = time.Minute
+)
+
+// warmStartVersion is the version of the files written by WarmStart.Save.  Files of version
+// 1, from before scrape costs were saved, are restored without any; those of other versions
+// are ignored.
+const warmStartVersion = 2
+
+type warmStartFile struct {
+	Version int                          `json:"version"`
+	SavedAt time.Time                    `json:"savedAt"`
+	Nodes   map[string][]warmStartSample `json:"nodes"`
+	// ScrapeCosts holds the scrape cost estimates, by source name, if they're saved.
+	ScrapeCosts map[string]sources.CostEstimate `json:"scrapeCosts,omitempty"`
+	// Resolution is the interval between collections when the file was saved, which may
+	// have been stretched, that the scrape cost estimates are aged at once restored.
+	Resolution time.Duration `json:"resolution,omitempty"`
+}
+
+// warmStartSample is a saved cpuSample.  The node's own sample has no pod or container.
+type warmStartSample struct {
+	Namespace            string    `json:"namespace,omitempty"`
+	Pod                  string    `json:"pod,omitempty"`
+	Container            string    `json:"container,omitempty"`
+	StartTime            time.Time `json:"startTime"`
+	Timestamp            time.Time `json:"timestamp"`
+	UsageCoreNanoSeconds uint64    `json:"usageCoreNanoSeconds"`
+}
+
+// WarmStart saves the cumulative CPU usage last sampled from each container to a file, to restore
+// as the baselines of the first scrapes after a restart.  It's used by the summary sources it's
+// given to (see SourceOptions.WarmStart) which check CPU rate consistency.
+type WarmStart struct {
+	path   string
+	maxAge time.Duration
+
+	mu sync.Mutex
+	// restored holds the samples restored, until they're handed to a tracker.
+	restored map[string]cpuSamples
+	tracker  *cpuRateTracker
+	// savedAt and savedResolution are when the restored file was saved, and the
+	// resolution then, and restoredCosts the scrape cost estimates in it, until
+	// they're handed to an estimator.
+	savedAt         time.Time
+	savedResolution time.Duration
+	restoredCosts   map[string]sources.CostEstimate
+	costs           sources.CostEstimator
+	resolution      func() time.Duration
+}
+
+// LoadWarmStart restores the samples saved to the given file, if there is one, which become
+// the baselines of the first scrapes, unless sampled more than the given max age before them.
+// A file that can't be restored is logged and ignored, starting without baselines, just as
+// on the very first start.
+func LoadWarmStart(path string, maxAge time.Duration) *WarmStart {
+	w := &WarmStart{path: path, maxAge: maxAge}
+	file, err := readWarmStart(path)
+	if err != nil {
+		logging.Background(loglevel.Scraper).Error(err, "unable to restore the warm start, starting without CPU usage baselines or scrape cost estimates", "path", path)
+		return w
+	}
+	if file != nil {
+		w.restored = file.samples()
+		w.savedAt, w.savedResolution, w.restoredCosts = file.SavedAt, file.Resolution, file.ScrapeCosts
+	}
+	return w
+}
+
+func readWarmStart(path string) (*warmStartFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file warmStartFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %v", path, err)
+	}
+	if file.Version != warmStartVersion && file.Version != 1 {
+		return nil, fmt.Errorf("%s is of version %d, not %d", path, file.Version, warmStartVersion)
+	}
+	return &file, nil
+}
+
+// samples converts the saved samples into the baselines of each node.
+func (file *warmStartFile) samples() map[string]cpuSamples {
+	res := make(map[string]cpuSamples, len(file.Nodes))
+	for node, saved := range file.Nodes {
+		samples := make(cpuSamples, len(saved))
+		for _, sample := range saved {
+			key := containerKey{namespace: sample.Namespace, pod: sample.Pod, container: sample.Container}
+			samples[key] = cpuSample{timestamp: sample.Timestamp, usage: sample.UsageCoreNanoSeconds, startTime: sample.StartTime, warm: true}
+		}
+		res[node] = samples
+	}
+	return res
+}
+
+// attach hands the restored samples to the given tracker, as the baselines of any nodes it
+// has none of, and saves the tracker's samples from then on.  A nil WarmStart does nothing.
+func (w *WarmStart) attach(t *cpuRateTracker) {
+	if w == nil || t == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.warmMaxAge = w.maxAge
+	for node, samples := range w.restored {
+		if _, ok := t.samples[node]; !ok {
+			t.samples[node] = samples
+		}
+	}
+	w.restored = nil
+	w.tracker = t
+}
+
+// TrackScrapeCosts restores the scrape cost estimates saved to the file, if any, into the given
+// estimator, and saves its estimates from then on.  The estimates are aged by the number of
+// collections missed since each was saved, at the resolution then, or failing that, the given
+// current resolution.  A nil WarmStart does nothing.
+func (w *WarmStart) TrackScrapeCosts(estimator sources.CostEstimator, resolution func() time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.restoredCosts) > 0 {
+		interval := w.savedResolution
+		if interval == 0 {
+			interval = resolution()
+		}
+		// estimates saved again before their nodes were scraped keep when they were first saved
+		bySavedAt := make(map[int64]map[string]sources.CostEstimate)
+		for name, est := range w.restoredCosts {
+			savedAt := w.savedAt
+			if est.SavedAt != nil {
+				savedAt = *est.SavedAt
+			}
+			est.SavedAt = &savedAt
+			if bySavedAt[savedAt.UnixNano()] == nil {
+				bySavedAt[savedAt.UnixNano()] = make(map[string]sources.CostEstimate)
+			}
+			bySavedAt[savedAt.UnixNano()][name] = est
+		}
+		missedSince := func(savedAt time.Time) int {
+			if interval <= 0 {
+				return 0
+			}
+			return int(time.Since(savedAt) / interval)
+		}
+		for savedAt, estimates := range bySavedAt {
+			estimator.RestoreEstimates(estimates, missedSince(time.Unix(0, savedAt)))
+		}
+		downtime := time.Since(w.savedAt)
+		logging.Background(loglevel.Scraper).V(1).Info("restored scrape cost estimates from the warm start", "path", w.path, "nodes", len(w.restoredCosts), "downtime", downtime, "resolution", interval, "missedCycles", missedSince(w.savedAt))
+	}
+	w.restoredCosts = nil
+	w.costs, w.resolution = estimator, resolution
+}
+
+// Save saves the samples last taken of each node's containers, and the scrape cost estimates, if
+// tracked, replacing the file atomically.  It saves nothing until the WarmStart is given to a
+// source or an estimator.
+func (w *WarmStart) Save() error {
+	w.mu.Lock()
+	tracker, costs, resolution := w.tracker, w.costs, w.resolution
+	w.mu.Unlock()
+	if tracker == nil && costs == nil {
+		return nil
+	}
+	file := warmStartFile{Version: warmStartVersion, SavedAt: time.Now()}
+	if tracker != nil {
+		file.Nodes = tracker.export()
+	}
+	if costs != nil {
+		file.ScrapeCosts = costs.Estimates()
+		file.Resolution = resolution()
+	}
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return err
+	}
+	tmpPath := w.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, w.path)
+}
+
+// RunUntil saves the samples every interval until the given channel is closed.  Callers should
+// Save once more after scraping stops, so that the last samples are saved.
+func (w *WarmStart) RunUntil(interval time.Duration, stopCh <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.Save(); err != nil {
+					logging.Background(loglevel.Scraper).Error(err, "unable to save the warm start", "path", w.path)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// export copies the tracker's samples for saving.
+func (t *cpuRateTracker) export() map[string][]warmStartSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make(map[string][]warmStartSample, len(t.samples))
+	for node, samples := range t.samples {
+		saved := make([]warmStartSample, 0, len(samples))
+		for key, sample := range samples {
+			saved = append(saved, warmStartSample{
+				Namespace:            key.namespace,
+				Pod:                  key.pod,
+				Container:            key.container,
+				StartTime:            sample.startTime,
+				Timestamp:            sample.timestamp,
+				UsageCoreNanoSeconds: sample.usage,
+			})
+		}
+		res[node] = saved
+	}
+	return res
+}
+
+// usableWarmSample checks if a rate may be derived between the given sample, restored from
+// a warm start, and the current sample of the same container, counting why not if it can't.
+func (c *cpuRateCheck) usableWarmSample(last, cur cpuSample) bool {
+	switch {
+	case last.startTime.IsZero() || !last.startTime.Equal(cur.startTime):
+		warmStartBaselines.WithLabelValues(warmStartStartTimeMismatch).Inc()
+		return false
+	case c.warmMaxAge > 0 && cur.timestamp.Sub(last.timestamp) > c.warmMaxAge:
+		warmStartBaselines.WithLabelValues(warmStartTooOld).Inc()
+		return false
+	}
+	warmStartBaselines.WithLabelValues(warmStartUsed).Inc()
+	return true
+}
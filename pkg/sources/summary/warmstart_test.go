@@ -0,0 +1,280 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package summary_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+// warmStartBaselines fetches the counts of baselines restored from a warm start, by result.
+func warmStartBaselines() map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	res := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "metrics_server_kubelet_summary_warm_start_baselines_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			res[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+		}
+	}
+	return res
+}
+
+var _ = Describe("Warm Start", func() {
+	var (
+		kubelet *fakeKubelet
+		server  *httptest.Server
+		client  KubeletInterface
+		host    string
+		dir     string
+		path    string
+		// maxRateGap is the max gap the sources derive rates over
+		maxRateGap time.Duration
+	)
+
+	BeforeEach(func() {
+		kubelet = &fakeKubelet{summaryPath: "/stats/summary/", status: http.StatusOK}
+		server = httptest.NewServer(kubelet)
+		skips, err := NewSubtreeSkips(DefaultSkippedSubtrees, false)
+		Expect(err).NotTo(HaveOccurred())
+		client, host = directClientWith(server, KubeletClientConfig{SkippedSubtrees: skips.Retaining(StartTimeSubtrees)})
+		dir, err = ioutil.TempDir("", "warm-start")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "warm-start.json")
+		maxRateGap = 0
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	newSource := func(warmStart *WarmStart) sources.MetricSource {
+		return NewSummaryMetricsSource(NodeInfo{Name: "node1", ConnectAddress: host}, client, SourceOptions{CPURateConsistencyRatio: 2, MaxRateGap: maxRateGap, WarmStart: warmStart})
+	}
+
+	// collect serves the given fixture, and collects it with the given source, returning
+	// the CPU usage of the node, and of each container, in millicores.
+	collect := func(src sources.MetricSource, fixture string) map[string]int64 {
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "cpu-rates", fixture))
+		Expect(err).NotTo(HaveOccurred())
+		kubelet.body = string(body)
+
+		batch, err := src.Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		usage := map[string]int64{"node": batch.Nodes[0].CpuUsage.MilliValue()}
+		for _, container := range batch.Pods[0].Containers {
+			usage[container.Name] = container.CpuUsage.MilliValue()
+		}
+		return usage
+	}
+
+	// restart collects the first fixture with a fresh pipeline, saving its warm start, and then
+	// collects the second with another, restored from it with the given max age, as after a restart.
+	restart := func(first, second string, maxAge time.Duration) map[string]int64 {
+		warmStart := LoadWarmStart(path, maxAge)
+		// the reported rates, with no baselines yet
+		Expect(collect(newSource(warmStart), first)).To(Equal(map[string]int64{"node": 2000, "app": 500, "sidecar": 20}))
+		Expect(warmStart.Save()).To(Succeed())
+
+		return collect(newSource(LoadWarmStart(path, maxAge)), second)
+	}
+
+	It("should derive rates on the first scrape after a restart from the samples saved before it", func() {
+		before := warmStartBaselines()
+		// rather than the reported 5000m and 2m; the fixtures give the node no start time,
+		// so its baseline can't be validated, and its reported rate is served
+		Expect(restart("disagreeing-1.json", "disagreeing-2.json", time.Minute)).To(Equal(map[string]int64{"node": 2200, "app": 500, "sidecar": 20}))
+
+		after := warmStartBaselines()
+		Expect(after["used"] - before["used"]).To(BeEquivalentTo(2))
+		Expect(after["start_time_mismatch"] - before["start_time_mismatch"]).To(BeEquivalentTo(1))
+	})
+
+	It("should derive the first rates after a restart over the whole window since the samples saved before it", func() {
+		// the fixtures are 10s apart, longer than the gap rates are otherwise derived over
+		maxRateGap = 5 * time.Second
+		warmStart := LoadWarmStart(path, time.Minute)
+		collect(newSource(warmStart), "disagreeing-1.json")
+		Expect(warmStart.Save()).To(Succeed())
+
+		body, err := ioutil.ReadFile(filepath.Join("testdata", "cpu-rates", "disagreeing-2.json"))
+		Expect(err).NotTo(HaveOccurred())
+		kubelet.body = string(body)
+		batch, err := newSource(LoadWarmStart(path, time.Minute)).Collect(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		windows := make(map[string]time.Duration)
+		usage := make(map[string]int64)
+		for _, container := range batch.Pods[0].Containers {
+			windows[container.Name], usage[container.Name] = container.Window, container.CpuUsage.MilliValue()
+		}
+		Expect(usage).To(Equal(map[string]int64{"app": 500, "sidecar": 20}))
+		Expect(windows).To(Equal(map[string]time.Duration{"app": 10 * time.Second, "sidecar": 10 * time.Second}))
+	})
+
+	It("should discard the baselines of just the containers restarted since they were saved", func() {
+		Expect(restart("disagreeing-1.json", "restarted-2.json", time.Minute)).To(Equal(map[string]int64{"node": 2200, "app": 5000, "sidecar": 20}))
+	})
+
+	It("should discard baselines sampled more than the max age before", func() {
+		before := warmStartBaselines()
+		Expect(restart("disagreeing-1.json", "disagreeing-2.json", 5*time.Second)).To(Equal(map[string]int64{"node": 2200, "app": 5000, "sidecar": 2}))
+		Expect(warmStartBaselines()["too_old"] - before["too_old"]).To(BeEquivalentTo(2))
+	})
+
+	It("should start without baselines from a file it can't restore", func() {
+		Expect(ioutil.WriteFile(path, []byte("not json"), 0600)).To(Succeed())
+		Expect(collect(newSource(LoadWarmStart(path, time.Minute)), "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2200, "app": 5000, "sidecar": 2}))
+	})
+
+	It("should restore baselines from files saved before scrape costs were", func() {
+		warmStart := LoadWarmStart(path, time.Minute)
+		collect(newSource(warmStart), "disagreeing-1.json")
+		Expect(warmStart.Save()).To(Succeed())
+
+		By("rewriting the file as of version 1")
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		var file map[string]interface{}
+		Expect(json.Unmarshal(data, &file)).To(Succeed())
+		Expect(file).To(HaveKeyWithValue("version", BeEquivalentTo(2)))
+		file["version"] = 1
+		data, err = json.Marshal(file)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+
+		Expect(collect(newSource(LoadWarmStart(path, time.Minute)), "disagreeing-2.json")).To(Equal(map[string]int64{"node": 2200, "app": 500, "sidecar": 20}))
+	})
+
+	Context("with scrape costs", func() {
+		// resolution is the current interval between collections
+		var resolution time.Duration
+
+		BeforeEach(func() {
+			resolution = time.Minute
+		})
+
+		// restartOrdering returns a cost ordering restored from the warm start, as on startup.
+		restartOrdering := func() (sources.ScrapeOrdering, *WarmStart) {
+			ordering := sources.CostOrdering(nil, 0)
+			warmStart := LoadWarmStart(path, time.Minute)
+			warmStart.TrackScrapeCosts(ordering.(sources.CostEstimator), func() time.Duration { return resolution })
+			return ordering, warmStart
+		}
+
+		// savedFile reads the warm start file as saved.
+		savedFile := func() map[string]interface{} {
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			var file map[string]interface{}
+			Expect(json.Unmarshal(data, &file)).To(Succeed())
+			return file
+		}
+
+		It("should restore the scrape cost estimates saved before a restart", func() {
+			src, gone := newSource(nil), NewSummaryMetricsSource(NodeInfo{Name: "gone-node", ConnectAddress: host}, client, SourceOptions{})
+			ordering, warmStart := restartOrdering()
+			ordering.Observe(src, 2*time.Second, &sources.MetricsBatch{Pods: make([]sources.PodMetricsPoint, 30)})
+			ordering.Observe(gone, time.Second, &sources.MetricsBatch{})
+			saved := ordering.(sources.CostEstimator).Estimates()
+			Expect(saved).To(HaveLen(2))
+			Expect(warmStart.Save()).To(Succeed())
+
+			savedAt, err := time.Parse(time.RFC3339Nano, savedFile()["savedAt"].(string))
+			Expect(err).NotTo(HaveOccurred())
+			restored, _ := restartOrdering()
+			for name, est := range saved {
+				est.SavedAt = &savedAt
+				saved[name] = est
+			}
+			Expect(restored.(sources.CostEstimator).Estimates()).To(Equal(saved))
+
+			By("forgetting the estimates of the nodes gone at the first collection")
+			restored.Offsets([]sources.MetricSource{src}, time.Second)
+			Expect(restored.(sources.CostEstimator).Estimates()).To(Equal(map[string]sources.CostEstimate{
+				src.Name(): {Latency: 2 * time.Second, Pods: 30, SavedAt: &savedAt},
+			}))
+		})
+
+		It("should save scrape cost estimates without checking CPU rate consistency", func() {
+			ordering, warmStart := restartOrdering()
+			ordering.Observe(newSource(nil), time.Second, &sources.MetricsBatch{})
+			Expect(warmStart.Save()).To(Succeed())
+
+			restored, _ := restartOrdering()
+			Expect(restored.(sources.CostEstimator).Estimates()).To(HaveLen(1))
+		})
+
+		It("should keep when the estimates of nodes not scraped since a restart were saved, when saving them again", func() {
+			scraped, unscraped := newSource(nil), NewSummaryMetricsSource(NodeInfo{Name: "unscraped-node", ConnectAddress: host}, client, SourceOptions{})
+			ordering, warmStart := restartOrdering()
+			ordering.Observe(scraped, time.Second, &sources.MetricsBatch{})
+			ordering.Observe(unscraped, time.Second, &sources.MetricsBatch{})
+			Expect(warmStart.Save()).To(Succeed())
+			firstSavedAt := savedFile()["savedAt"]
+
+			By("saving again after a restart, having only scraped one of the nodes")
+			ordering, warmStart = restartOrdering()
+			ordering.Observe(scraped, time.Second, &sources.MetricsBatch{})
+			Expect(warmStart.Save()).To(Succeed())
+			file := savedFile()
+			Expect(file["savedAt"]).NotTo(Equal(firstSavedAt))
+			costs := file["scrapeCosts"].(map[string]interface{})
+			Expect(costs[unscraped.Name()]).To(HaveKeyWithValue("savedAt", firstSavedAt))
+			Expect(costs[scraped.Name()]).NotTo(HaveKey("savedAt"))
+		})
+
+		It("should age the restored estimates by the cycles missed at the resolution when they were saved", func() {
+			src := newSource(nil)
+			resolution = 5 * time.Minute
+			ordering, warmStart := restartOrdering()
+			ordering.Observe(src, time.Second, &sources.MetricsBatch{})
+			Expect(warmStart.Save()).To(Succeed())
+			saved := ordering.(sources.CostEstimator).Estimates()
+
+			By("backdating the save by ten minutes, two cycles at the stretched resolution")
+			file := savedFile()
+			file["savedAt"] = time.Now().Add(-10*time.Minute - time.Second).Format(time.RFC3339Nano)
+			data, err := json.Marshal(file)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+
+			By("restarting at the configured resolution, which is shorter")
+			resolution = time.Minute
+			restored, _ := restartOrdering()
+			restored.Observe(src, 3*time.Second, &sources.MetricsBatch{})
+			expected := sources.CostOrdering(nil, 0)
+			expected.(sources.CostEstimator).RestoreEstimates(saved, 2)
+			expected.Observe(src, 3*time.Second, &sources.MetricsBatch{})
+			Expect(restored.(sources.CostEstimator).Estimates()).To(Equal(expected.(sources.CostEstimator).Estimates()))
+		})
+	})
+})
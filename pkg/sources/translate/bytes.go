@@ -0,0 +1,73 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"math"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Byte values (memory, swap, and accelerator memory) are always translated into quantities of
+// whole bytes, in BinarySI, so that they render as integers or exact binary suffixes (e.g.
+// "12Ti"), never in scientific notation, however large.  Sources report them as uint64s, while
+// quantities hold int64s, so values past math.MaxInt64 (which no real memory reaches, so are
+// corrupt) are clamped to it, rather than losing precision or wrapping negative.
+
+var clampedValues = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "translation",
+		Name:      "clamped_values_total",
+		Help:      "The number of byte values translated that were too large for a quantity, so were clamped to the largest int64, by value",
+	},
+	[]string{"value"},
+)
+
+func init() {
+	prometheus.MustRegister(clampedValues)
+}
+
+// Uint64Bytes converts the given number of bytes of the named value into a
+// quantity, clamping it to math.MaxInt64 if it's larger.
+func Uint64Bytes(value string, val uint64) *resource.Quantity {
+	if val > math.MaxInt64 {
+		return clamped(value, val)
+	}
+	return resource.NewQuantity(int64(val), resource.BinarySI)
+}
+
+// FloatBytes converts the given number of bytes of the named value into a quantity, rounding
+// it to whole bytes, and clamping it to math.MaxInt64 if it's larger (or to zero if negative).
+func FloatBytes(value string, val float64) *resource.Quantity {
+	rounded := math.Round(val)
+	switch {
+	case rounded >= math.MaxInt64:
+		// float64(math.MaxInt64) rounds up to 2^63, which doesn't fit
+		return clamped(value, rounded)
+	case rounded > 0:
+		return resource.NewQuantity(int64(rounded), resource.BinarySI)
+	}
+	return resource.NewQuantity(0, resource.BinarySI)
+}
+
+// clamped counts the named value as clamped, returning the largest quantity of bytes.
+func clamped(value string, val interface{}) *resource.Quantity {
+	clampedValues.WithLabelValues(value).Inc()
+	glog.Warningf("the %s of %v bytes is too large for a quantity, so was clamped to %d bytes", value, val, int64(math.MaxInt64))
+	return resource.NewQuantity(math.MaxInt64, resource.BinarySI)
+}
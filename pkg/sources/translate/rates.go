@@ -0,0 +1,78 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"math"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// Rates are calculated from the cumulative counters in successive samples.  Just like the CPU
+// usage rate that the Kubelet calculates from cumulative CPU usage, a counter lower than in the
+// previous sample means it was reset (e.g. by the container restarting), so no rate is reported
+// until the next sample.  Rates are calculated over the actual time between the two samples,
+// however many cycles that spans, but may be declined past a maximum gap, since averaging over
+// a long gap hides any spikes in it.  Sample times come from the Kubelets' wall clocks, which
+// can jump (e.g. when a host resumes from suspend), so windows which aren't positive are declined
+// too, rather than producing negative or infinite rates.
+
+// RateWindow returns the window between the last and current samples of one or more counters,
+// and whether a rate can be calculated over it: not if the current sample is no newer than the
+// last (i.e. it's stale), any of the counters was reset, or the window is longer than the given
+// maximum gap, if non-zero.
+func RateWindow(last, cur time.Time, reset bool, maxGap time.Duration) (time.Duration, bool) {
+	window := cur.Sub(last)
+	if window <= 0 || reset {
+		return 0, false
+	}
+	if maxGap > 0 && window > maxGap {
+		// e.g. the scrapes in between failed, so wait for a rate over a shorter window
+		return 0, false
+	}
+	return window, true
+}
+
+// PerSecond returns the rate of the given increase over the given window, per second.
+func PerSecond(increase float64, window time.Duration) float64 {
+	return increase / window.Seconds()
+}
+
+// MilliRate returns the rate of the given increase over the given window,
+// per second, as a quantity to milli-unit precision.
+func MilliRate(increase float64, window time.Duration) resource.Quantity {
+	milliRate := increase * 1000 / window.Seconds()
+	return *resource.NewMilliQuantity(int64(milliRate), resource.DecimalSI)
+}
+
+// Uint64Quantity converts a uint64 into a Quantity, which only has constructors
+// that work with int64 (except for parse, which requires costly round-trips to string).
+// We lose precision until we fit in an int64 if greater than the max int64 value.
+// Byte values are converted with Uint64Bytes instead, which never loses precision.
+func Uint64Quantity(val uint64, scale resource.Scale) *resource.Quantity {
+	// easy path -- we can safely fit val into an int64
+	if val <= math.MaxInt64 {
+		return resource.NewScaledQuantity(int64(val), scale)
+	}
+
+	loglevel.V(loglevel.Scraper, 1).Infof("unexpectedly large resource value %v, loosing precision to fit in scaled resource.Quantity", val)
+
+	// otherwise, lose an decimal order-of-magnitude precision,
+	// so we can fit into a scaled quantity
+	return resource.NewScaledQuantity(int64(val/10), resource.Scale(1)+scale)
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package translate defines how the payloads collected by metrics sources (such as Kubelet
+// summaries) are translated into MetricsBatches, and holds the helpers shared by the
+// translators: rate math, and validation of the values translated.
+//
+// Each source has its own BatchTranslator for its own payloads, so that the translation
+// of one source's payloads doesn't need to know about any other source's types.
+package translate
+
+import (
+	"fmt"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+)
+
+// Node identifies the node a payload was collected from.
+type Node struct {
+	// Name is the name of the node, which its metrics are stored under.
+	Name string
+	// Address is the address the payload was collected from, for errors.
+	Address string
+}
+
+// BatchTranslator translates the payloads collected by some source into MetricsBatches.
+type BatchTranslator interface {
+	// Translate translates the given payload, collected from the given node, into a batch.
+	// On errors, it returns what it could translate, along with the errors, leaving out any
+	// pods with only partial metrics, since the HPA takes special action when a pod is
+	// missing metrics (but zero usage doesn't count as missing).
+	Translate(node Node, payload interface{}) (*sources.MetricsBatch, error)
+}
+
+// UnexpectedPayloadError is returned by translators given payloads they can't translate.
+func UnexpectedPayloadError(translator string, payload interface{}) error {
+	return fmt.Errorf("the %s translator can't translate payloads of type %T", translator, payload)
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate_test
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/sources/translate"
+)
+
+func TestTranslate(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Translate Suite")
+}
+
+var _ = Describe("Rate Math", func() {
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	It("should only allow rates over fresh samples of counters that weren't reset, within the maximum gap", func() {
+		window, ok := RateWindow(start, start.Add(10*time.Second), false, time.Minute)
+		Expect(ok).To(BeTrue())
+		Expect(window).To(Equal(10 * time.Second))
+
+		_, ok = RateWindow(start, start, false, 0)
+		Expect(ok).To(BeFalse(), "stale sample")
+		_, ok = RateWindow(start, start.Add(-time.Second), false, 0)
+		Expect(ok).To(BeFalse(), "older sample")
+		_, ok = RateWindow(start, start.Add(10*time.Second), true, 0)
+		Expect(ok).To(BeFalse(), "reset counter")
+		_, ok = RateWindow(start, start.Add(2*time.Minute), false, time.Minute)
+		Expect(ok).To(BeFalse(), "too long a gap")
+
+		window, ok = RateWindow(start, start.Add(time.Hour), false, 0)
+		Expect(ok).To(BeTrue(), "no maximum gap")
+		Expect(window).To(Equal(time.Hour))
+	})
+
+	It("should calculate rates per second, to milli-unit precision as quantities", func() {
+		Expect(PerSecond(50, 10*time.Second)).To(Equal(5.0))
+		Expect(MilliRate(50, 10*time.Second)).To(Equal(*resource.NewMilliQuantity(5000, resource.DecimalSI)))
+		Expect(MilliRate(1, 3*time.Second)).To(Equal(*resource.NewMilliQuantity(333, resource.DecimalSI)))
+		Expect(MilliRate(0, time.Second)).To(Equal(*resource.NewMilliQuantity(0, resource.DecimalSI)))
+	})
+
+	It("should convert uint64s into quantities, losing precision only past the largest int64", func() {
+		Expect(Uint64Quantity(1234000000, -9).MilliValue()).To(Equal(int64(1234)))
+		Expect(Uint64Quantity(math.MaxInt64, 0).Value()).To(Equal(int64(math.MaxInt64)))
+		Expect(Uint64Quantity(math.MaxUint64, -9).Cmp(*resource.NewScaledQuantity(math.MaxUint64/10, -8))).To(Equal(0))
+	})
+})
+
+// clampedCount fetches the number of times the given value was clamped from the default registry.
+func clampedCount(value string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_translation_clamped_values_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == value {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Byte Quantities", func() {
+	// roundTrip renders the given quantity as JSON, checking it's an integer or has an exact
+	// binary suffix, and parses it back.
+	roundTrip := func(quantity *resource.Quantity) *resource.Quantity {
+		data, err := json.Marshal(quantity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(MatchRegexp(`^"[0-9]+([KMGTPE]i)?"$`))
+		res := &resource.Quantity{}
+		Expect(json.Unmarshal(data, res)).To(Succeed())
+		return res
+	}
+
+	It("should round-trip whole bytes at the extremes, in binary suffixes", func() {
+		for _, val := range []uint64{0, 1, 1023, 12 << 40, 12<<40 + 1, math.MaxInt64} {
+			quantity := Uint64Bytes("memory usage", val)
+			Expect(quantity.Format).To(Equal(resource.BinarySI))
+			parsed := roundTrip(quantity)
+			Expect(parsed.Value()).To(Equal(int64(val)), "%d bytes", val)
+		}
+		Expect(Uint64Bytes("memory usage", 12<<40).String()).To(Equal("12Ti"))
+		Expect(clampedCount("memory usage")).To(BeZero())
+	})
+
+	It("should clamp values above the largest int64, counting them, rather than wrapping negative", func() {
+		for i, val := range []uint64{math.MaxInt64 + 1, math.MaxUint64} {
+			parsed := roundTrip(Uint64Bytes("swap usage", val))
+			Expect(parsed.Value()).To(Equal(int64(math.MaxInt64)))
+			Expect(clampedCount("swap usage")).To(Equal(float64(i + 1)))
+		}
+	})
+
+	It("should round floats to whole bytes, clamping those out of range", func() {
+		Expect(roundTrip(FloatBytes("smoothed memory usage", 0)).Value()).To(BeZero())
+		Expect(roundTrip(FloatBytes("smoothed memory usage", 0.6)).Value()).To(Equal(int64(1)))
+		Expect(roundTrip(FloatBytes("smoothed memory usage", -3)).Value()).To(BeZero())
+		Expect(roundTrip(FloatBytes("smoothed memory usage", 12<<40)).String()).To(Equal("12Ti"))
+		Expect(clampedCount("smoothed memory usage")).To(BeZero())
+
+		Expect(roundTrip(FloatBytes("smoothed memory usage", math.MaxInt64)).Value()).To(Equal(int64(math.MaxInt64)))
+		Expect(roundTrip(FloatBytes("smoothed memory usage", math.MaxUint64)).Value()).To(Equal(int64(math.MaxInt64)))
+		Expect(clampedCount("smoothed memory usage")).To(Equal(2.0))
+	})
+})
+
+var _ = Describe("Validation", func() {
+	It("should take the earliest non-zero timestamp, failing if there's none", func() {
+		early := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+		late := early.Add(time.Second)
+		earliest, ok := EarliestTimestamp(late, time.Time{}, early)
+		Expect(ok).To(BeTrue())
+		Expect(earliest).To(Equal(early))
+
+		_, ok = EarliestTimestamp(time.Time{}, time.Time{})
+		Expect(ok).To(BeFalse())
+		_, ok = EarliestTimestamp()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should fail for missing metrics, rather than taking them as zero", func() {
+		zero := uint64(0)
+		value, err := Required("cpu usage", &zero)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value).To(BeZero())
+
+		_, err = Required("cpu usage", nil)
+		Expect(err).To(MatchError("missing cpu usage metric"))
+	})
+})
@@ -0,0 +1,43 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translate
+
+import (
+	"fmt"
+	"time"
+)
+
+// EarliestTimestamp returns the earliest of the given timestamps, ignoring zero timestamps
+// (from samples that weren't reported), or false if they're all zero.  Points made of several
+// samples take the earliest timestamp, so it can be told if any was tainted by a time period,
+// like pod startup (see provider.TimeInfo).
+func EarliestTimestamp(timestamps ...time.Time) (time.Time, bool) {
+	var earliest time.Time
+	for _, timestamp := range timestamps {
+		if !timestamp.IsZero() && (earliest.IsZero() || earliest.After(timestamp)) {
+			earliest = timestamp
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// Required returns the given value of the named metric, failing if it wasn't reported, since a
+// missing metric must never be translated as zero (which the HPA would take at face value).
+func Required(metric string, value *uint64) (uint64, error) {
+	if value == nil {
+		return 0, fmt.Errorf("missing %s metric", metric)
+	}
+	return *value, nil
+}
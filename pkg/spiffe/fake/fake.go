@@ -0,0 +1,198 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe"
+)
+
+// CA is the certificate authority of a fake SPIFFE trust domain.
+type CA struct {
+	TrustDomain string
+
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+// NewCA creates a CA for the given trust domain.
+func NewCA(trustDomain string) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"SPIFFE"}},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{TrustDomain: trustDomain, cert: cert, key: key, serial: 1}, nil
+}
+
+// Pool returns a pool of the CA's certificate.
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue issues an SVID for the given path in the CA's trust domain, valid for serving and
+// client authentication, and for connections to 127.0.0.1 (for test servers).
+func (ca *CA) Issue(path string) (*spiffe.X509SVID, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca.serial++
+	id := &url.URL{Scheme: "spiffe", Host: ca.TrustDomain, Path: path}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		URIs:         []*url.URL{id},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &spiffe.X509SVID{
+		SPIFFEID:    id.String(),
+		X509SVID:    raw,
+		X509SVIDKey: keyDER,
+		Bundle:      ca.cert.Raw,
+	}, nil
+}
+
+// TLSCertificate converts the given SVID into a certificate for serving TLS.
+func TLSCertificate(svid *spiffe.X509SVID) (tls.Certificate, error) {
+	key, err := x509.ParsePKCS8PrivateKey(svid.X509SVIDKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{svid.X509SVID}, PrivateKey: key}, nil
+}
+
+// WorkloadAPI is a fake SPIFFE Workload API, serving a single SVID (which may be rotated)
+// to every caller, on a Unix socket in a temporary directory.
+type WorkloadAPI struct {
+	dir    string
+	server *grpc.Server
+
+	mu      sync.Mutex
+	svid    *spiffe.X509SVID
+	rotated chan struct{}
+}
+
+// NewWorkloadAPI starts serving the given SVID.
+func NewWorkloadAPI(svid *spiffe.X509SVID) (*WorkloadAPI, error) {
+	dir, err := ioutil.TempDir("", "spiffe-workload-api")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "agent.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	api := &WorkloadAPI{
+		dir:     dir,
+		server:  grpc.NewServer(),
+		svid:    svid,
+		rotated: make(chan struct{}),
+	}
+	spiffe.RegisterWorkloadAPIServer(api.server, api)
+	go api.server.Serve(listener)
+	return api, nil
+}
+
+// SocketPath returns the path of the socket the API is served on.
+func (api *WorkloadAPI) SocketPath() string {
+	return filepath.Join(api.dir, "agent.sock")
+}
+
+// Rotate replaces the SVID served, sending it to every open stream.
+func (api *WorkloadAPI) Rotate(svid *spiffe.X509SVID) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.svid = svid
+	close(api.rotated)
+	api.rotated = make(chan struct{})
+}
+
+// Close stops serving, and removes the socket.
+func (api *WorkloadAPI) Close() {
+	api.server.Stop()
+	os.RemoveAll(api.dir)
+}
+
+func (api *WorkloadAPI) FetchX509SVID(ctx context.Context, req *spiffe.X509SVIDRequest, send func(*spiffe.X509SVIDResponse) error) error {
+	if md, _ := metadata.FromIncomingContext(ctx); len(md["workload.spiffe.io"]) != 1 || md["workload.spiffe.io"][0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	for {
+		api.mu.Lock()
+		svid, rotated := api.svid, api.rotated
+		api.mu.Unlock()
+		if err := send(&spiffe.X509SVIDResponse{SVIDs: []*spiffe.X509SVID{svid}}); err != nil {
+			return err
+		}
+		select {
+		case <-rotated:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spiffe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+)
+
+// DefaultReadyTimeout is how long to wait for the first SVID at startup.
+const DefaultReadyTimeout = 30 * time.Second
+
+// Backoff bounds for re-establishing the Workload API stream after it fails.
+const (
+	minStreamBackoff = time.Second
+	maxStreamBackoff = 30 * time.Second
+)
+
+var (
+	svidExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "spiffe",
+			Name:      "x509_svid_expiry_timestamp_seconds",
+			Help:      "The expiry time of the X.509 SVID currently presented to Kubelets, in seconds since the epoch",
+		},
+	)
+	svidUpdatesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "spiffe",
+			Name:      "x509_svid_updates_total",
+			Help:      "The number of X.509 SVID updates received from the SPIFFE Workload API, by whether they were accepted",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(svidExpiry)
+	prometheus.MustRegister(svidUpdatesTotal)
+}
+
+// X509Source keeps the X.509 SVID of metrics-server, and the bundle of its trust domain,
+// current by streaming them from the SPIFFE Workload API.  They're read on each TLS
+// handshake, so rotating them only affects new connections: established connections
+// (and the scrapes in flight on them) are left alone.
+type X509Source struct {
+	socketPath string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	id     string
+	bundle *x509.CertPool
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// NewX509Source returns a source of X.509 SVIDs from the Workload API served on the
+// given Unix socket (given either as a path, or as a unix:// URL).  It doesn't
+// connect until RunUntil is called.
+func NewX509Source(socketPath string) *X509Source {
+	return &X509Source{
+		socketPath: strings.TrimPrefix(socketPath, "unix://"),
+		ready:      make(chan struct{}),
+	}
+}
+
+// RunUntil streams SVIDs from the Workload API in the background, re-establishing
+// the stream as needed, until the given channel is closed.
+func (s *X509Source) RunUntil(stopCh <-chan struct{}) error {
+	conn, err := grpc.Dial(s.socketPath, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		return fmt.Errorf("unable to connect to the SPIFFE Workload API at %q: %v", s.socketPath, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+		conn.Close()
+	}()
+	go func() {
+		backoff := minStreamBackoff
+		for {
+			received, err := s.stream(ctx, conn)
+			if ctx.Err() != nil {
+				return
+			}
+			if received {
+				backoff = minStreamBackoff
+			}
+			glog.Warningf("lost the X.509 SVID stream from the SPIFFE Workload API at %q, retrying in %s (the current SVID is kept until then): %v", s.socketPath, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > maxStreamBackoff {
+				backoff = maxStreamBackoff
+			}
+		}
+	}()
+	return nil
+}
+
+// stream receives SVID updates until the stream fails, returning whether any were received.
+func (s *X509Source) stream(ctx context.Context, conn *grpc.ClientConn) (bool, error) {
+	stream, err := fetchX509SVID(ctx, conn)
+	if err != nil {
+		return false, err
+	}
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if err := s.update(resp); err != nil {
+			svidUpdatesTotal.WithLabelValues("rejected").Inc()
+			glog.Errorf("ignoring an invalid X.509 SVID update from the SPIFFE Workload API: %v", err)
+			continue
+		}
+		svidUpdatesTotal.WithLabelValues("accepted").Inc()
+	}
+}
+
+// update replaces the current SVID and bundle with the first (default) SVID in the given response.
+func (s *X509Source) update(resp *X509SVIDResponse) error {
+	if len(resp.SVIDs) == 0 {
+		return fmt.Errorf("no SVIDs in the response")
+	}
+	svid := resp.SVIDs[0]
+	chain, err := x509.ParseCertificates(svid.X509SVID)
+	if err != nil {
+		return fmt.Errorf("unable to parse the certificates of SVID %q: %v", svid.SPIFFEID, err)
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("no certificates in SVID %q", svid.SPIFFEID)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(svid.X509SVIDKey)
+	if err != nil {
+		return fmt.Errorf("unable to parse the private key of SVID %q: %v", svid.SPIFFEID, err)
+	}
+	bundle, err := x509.ParseCertificates(svid.Bundle)
+	if err != nil {
+		return fmt.Errorf("unable to parse the bundle of SVID %q: %v", svid.SPIFFEID, err)
+	}
+
+	cert := &tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range bundle {
+		pool.AddCert(c)
+	}
+
+	s.mu.Lock()
+	s.cert, s.id, s.bundle = cert, svid.SPIFFEID, pool
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+
+	svidExpiry.Set(float64(chain[0].NotAfter.Unix()))
+	loglevel.V(loglevel.Client, 1).Infof("using X.509 SVID %q from the SPIFFE Workload API, valid until %s", svid.SPIFFEID, chain[0].NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// WaitUntilReady waits for the first SVID, returning an error if the context is done first.
+func (s *X509Source) WaitUntilReady(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no X.509 SVID received from the SPIFFE Workload API at %q: %v", s.socketPath, ctx.Err())
+	}
+}
+
+// ID returns the SPIFFE ID of the current SVID, or the empty string if there's none yet.
+func (s *X509Source) ID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.id
+}
+
+// GetClientCertificate returns the current SVID, for use as tls.Config.GetClientCertificate.
+func (s *X509Source) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, fmt.Errorf("no X.509 SVID received from the SPIFFE Workload API at %q yet", s.socketPath)
+	}
+	return s.cert, nil
+}
+
+// ConfigureClientTLS sets up the given TLS config to present the current SVID as the client
+// certificate, replacing any other.  If a trust domain is given, the server's certificate is
+// verified as an SVID in that trust domain, against its current bundle, in place of the usual
+// verification of the server's name and CA.
+func (s *X509Source) ConfigureClientTLS(tlsConfig *tls.Config, trustDomain string) {
+	tlsConfig.Certificates = nil
+	tlsConfig.GetClientCertificate = s.GetClientCertificate
+	if trustDomain != "" {
+		// NB: this only skips Go's built-in verification, in favour of verifyPeer
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return s.verifyPeer(rawCerts, trustDomain)
+		}
+	}
+}
+
+// verifyPeer verifies that the given certificate chain is an SVID in the given trust domain.
+func (s *X509Source) verifyPeer(rawCerts [][]byte, trustDomain string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificates presented, expected an X.509 SVID in trust domain %q", trustDomain)
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("unable to parse the presented certificates: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	leaf := certs[0]
+	id, err := spiffeID(leaf)
+	if err != nil {
+		return err
+	}
+	if id.Host != trustDomain {
+		return fmt.Errorf("presented X.509 SVID %q is not in trust domain %q", id, trustDomain)
+	}
+
+	s.mu.RLock()
+	bundle := s.bundle
+	s.mu.RUnlock()
+	if bundle == nil {
+		return fmt.Errorf("no bundle received from the SPIFFE Workload API at %q yet, unable to verify X.509 SVID %q", s.socketPath, id)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         bundle,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to verify X.509 SVID %q against the bundle of trust domain %q: %v", id, trustDomain, err)
+	}
+	return nil
+}
+
+// spiffeID returns the SPIFFE ID of the given SVID, which is its only URI SAN.
+func spiffeID(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" {
+		return nil, fmt.Errorf("presented certificate (subject %q) is not an X.509 SVID, which must have exactly one spiffe:// URI SAN", cert.Subject)
+	}
+	return cert.URIs[0], nil
+}
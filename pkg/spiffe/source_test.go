@@ -0,0 +1,193 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spiffe_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/spiffe"
+	"github.com/kubernetes-incubator/metrics-server/pkg/spiffe/fake"
+)
+
+func TestSPIFFE(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "SPIFFE Suite")
+}
+
+var _ = Describe("X.509 SVID Source", func() {
+	var (
+		ca      *fake.CA
+		svid    *X509SVID
+		api     *fake.WorkloadAPI
+		source  *X509Source
+		stopCh  chan struct{}
+		kubelet *httptest.Server
+	)
+
+	issue := func(ca *fake.CA, path string) *X509SVID {
+		svid, err := ca.Issue(path)
+		Expect(err).NotTo(HaveOccurred())
+		return svid
+	}
+
+	// serveKubelet serves requests with the given SVID, requiring clients to present an SVID from the CA.
+	serveKubelet := func(svid *X509SVID, handler http.Handler) *httptest.Server {
+		cert, err := fake.TLSCertificate(svid)
+		Expect(err).NotTo(HaveOccurred())
+		server := httptest.NewUnstartedServer(handler)
+		server.TLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.Pool(),
+		}
+		server.StartTLS()
+		return server
+	}
+
+	clientFor := func(trustDomain string) *http.Client {
+		tlsConfig := &tls.Config{}
+		source.ConfigureClientTLS(tlsConfig, trustDomain)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	BeforeEach(func() {
+		var err error
+		ca, err = fake.NewCA("example.org")
+		Expect(err).NotTo(HaveOccurred())
+		svid = issue(ca, "/metrics-server")
+		api, err = fake.NewWorkloadAPI(svid)
+		Expect(err).NotTo(HaveOccurred())
+
+		stopCh = make(chan struct{})
+		source = NewX509Source("unix://" + api.SocketPath())
+		Expect(source.RunUntil(stopCh)).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(source.WaitUntilReady(ctx)).To(Succeed())
+
+		kubelet = serveKubelet(issue(ca, "/kubelet/node1"), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(req.TLS.PeerCertificates[0].SerialNumber.String()))
+		}))
+	})
+
+	AfterEach(func() {
+		close(stopCh)
+		api.Close()
+		kubelet.Close()
+	})
+
+	currentSerial := func() int64 {
+		cert, err := source.GetClientCertificate(nil)
+		Expect(err).NotTo(HaveOccurred())
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+		return leaf.SerialNumber.Int64()
+	}
+
+	// presentedSerial fetches the serial number of the SVID presented to the kubelet by the given client.
+	presentedSerial := func(client *http.Client) int64 {
+		resp, err := client.Get(kubelet.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		serial, err := strconv.ParseInt(string(body), 10, 64)
+		Expect(err).NotTo(HaveOccurred())
+		return serial
+	}
+
+	It("should present its SVID, and verify the server's SVID in the trust domain", func() {
+		Expect(source.ID()).To(Equal("spiffe://example.org/metrics-server"))
+		Expect(presentedSerial(clientFor("example.org"))).To(Equal(currentSerial()))
+	})
+
+	It("should reject servers whose SVIDs are in another trust domain", func() {
+		_, err := clientFor("example.com").Get(kubelet.URL)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`not in trust domain "example.com"`))
+	})
+
+	It("should reject servers whose SVIDs aren't signed by the trust domain's bundle", func() {
+		impostorCA, err := fake.NewCA("example.org")
+		Expect(err).NotTo(HaveOccurred())
+		impostor := serveKubelet(issue(impostorCA, "/kubelet/node1"), http.NotFoundHandler())
+		defer impostor.Close()
+
+		_, err = clientFor("example.org").Get(impostor.URL)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("unable to verify X.509 SVID"))
+	})
+
+	It("should pick up rotated SVIDs, without dropping requests in flight", func() {
+		initial := currentSerial()
+		started, release := make(chan struct{}), make(chan struct{})
+		slow := serveKubelet(issue(ca, "/kubelet/node2"), http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		}))
+		defer slow.Close()
+
+		By("starting a request")
+		client := clientFor("example.org")
+		done := make(chan error, 1)
+		go func() {
+			resp, err := client.Get(slow.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			done <- err
+		}()
+		Eventually(started).Should(BeClosed())
+
+		By("rotating the SVID while it's in flight")
+		api.Rotate(issue(ca, "/metrics-server"))
+		Eventually(currentSerial).ShouldNot(Equal(initial))
+
+		By("verifying the request in flight still completes")
+		close(release)
+		Eventually(done).Should(Receive(BeNil()))
+
+		By("verifying new connections present the rotated SVID")
+		Expect(presentedSerial(client)).To(Equal(currentSerial()))
+	})
+
+	It("should keep the current SVID when sent an invalid one", func() {
+		initial := currentSerial()
+		api.Rotate(&X509SVID{SPIFFEID: "spiffe://example.org/metrics-server", X509SVID: []byte("garbage")})
+		Consistently(currentSerial, 200*time.Millisecond).Should(Equal(initial))
+	})
+
+	It("should time out waiting for an SVID from a Workload API that isn't there", func() {
+		absent := NewX509Source("/nonexistent/agent.sock")
+		Expect(absent.RunUntil(stopCh)).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(absent.WaitUntilReady(ctx)).NotTo(Succeed())
+		_, err := absent.GetClientCertificate(nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
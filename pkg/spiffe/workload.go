@@ -0,0 +1,135 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spiffe
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// This is the subset of the SPIFFE Workload API (workload.proto in the SPIFFE
+// specification) needed to fetch X.509 SVIDs.  The messages are written by hand,
+// rather than generated, since they're small, and only leave out fields we don't use
+// (CRLs and federated bundles), which are skipped when decoding.
+
+// fetchX509SVIDMethod is the full name of the streaming method serving X.509 SVIDs.
+const fetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// The Workload API rejects requests without this header, to protect against
+// server-side request forgery.
+const (
+	workloadHeaderKey   = "workload.spiffe.io"
+	workloadHeaderValue = "true"
+)
+
+// X509SVIDRequest requests the X.509 SVIDs of the calling workload.
+type X509SVIDRequest struct{}
+
+func (m *X509SVIDRequest) Reset()         { *m = X509SVIDRequest{} }
+func (m *X509SVIDRequest) String() string { return proto.CompactTextString(m) }
+func (*X509SVIDRequest) ProtoMessage()    {}
+
+// X509SVIDResponse carries the current X.509 SVIDs of the calling workload.
+// A new response is streamed each time they're rotated.
+type X509SVIDResponse struct {
+	SVIDs []*X509SVID `protobuf:"bytes,1,rep,name=svids"`
+}
+
+func (m *X509SVIDResponse) Reset()         { *m = X509SVIDResponse{} }
+func (m *X509SVIDResponse) String() string { return proto.CompactTextString(m) }
+func (*X509SVIDResponse) ProtoMessage()    {}
+
+// X509SVID is an X.509 SVID, with its private key and the bundle of its trust domain.
+type X509SVID struct {
+	// SPIFFEID is the SPIFFE ID of the SVID.
+	SPIFFEID string `protobuf:"bytes,1,opt,name=spiffe_id,json=spiffeId"`
+	// X509SVID is the ASN.1 DER encoded certificate chain, leaf first.
+	X509SVID []byte `protobuf:"bytes,2,opt,name=x509_svid,json=x509Svid"`
+	// X509SVIDKey is the ASN.1 DER encoded PKCS#8 private key.
+	X509SVIDKey []byte `protobuf:"bytes,3,opt,name=x509_svid_key,json=x509SvidKey"`
+	// Bundle is the ASN.1 DER encoded CA certificates of the trust domain.
+	Bundle []byte `protobuf:"bytes,4,opt,name=bundle"`
+}
+
+func (m *X509SVID) Reset()         { *m = X509SVID{} }
+func (m *X509SVID) String() string { return proto.CompactTextString(m) }
+func (*X509SVID) ProtoMessage()    {}
+
+// fetchX509SVIDStream is the stream of responses to a FetchX509SVID request.
+type fetchX509SVIDStream struct {
+	grpc.ClientStream
+}
+
+func (s *fetchX509SVIDStream) Recv() (*X509SVIDResponse, error) {
+	resp := &X509SVIDResponse{}
+	if err := s.ClientStream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// fetchX509SVID starts streaming the X.509 SVIDs of the calling workload over the given connection.
+func fetchX509SVID(ctx context.Context, conn *grpc.ClientConn) (*fetchX509SVIDStream, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, workloadHeaderKey, workloadHeaderValue)
+	stream, err := conn.NewStream(ctx, &workloadAPIServiceDesc.Streams[0], fetchX509SVIDMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(&X509SVIDRequest{}); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &fetchX509SVIDStream{stream}, nil
+}
+
+// WorkloadAPIServer serves the X.509 SVID part of the SPIFFE Workload API
+// (e.g. from a fake agent in tests).
+type WorkloadAPIServer interface {
+	// FetchX509SVID streams the SVIDs of the calling workload, sending
+	// a response each time they're rotated, until the stream is done.
+	FetchX509SVID(ctx context.Context, req *X509SVIDRequest, send func(*X509SVIDResponse) error) error
+}
+
+// RegisterWorkloadAPIServer registers the given Workload API implementation with the given gRPC server.
+func RegisterWorkloadAPIServer(s *grpc.Server, srv WorkloadAPIServer) {
+	s.RegisterService(&workloadAPIServiceDesc, srv)
+}
+
+var workloadAPIServiceDesc = grpc.ServiceDesc{
+	ServiceName: "SpiffeWorkloadAPI",
+	HandlerType: (*WorkloadAPIServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "FetchX509SVID",
+			Handler:       fetchX509SVIDHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "workload.proto",
+}
+
+func fetchX509SVIDHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &X509SVIDRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	send := func(resp *X509SVIDResponse) error { return stream.SendMsg(resp) }
+	return srv.(WorkloadAPIServer).FetchX509SVID(stream.Context(), req, send)
+}
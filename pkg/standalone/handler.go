@@ -0,0 +1,235 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standalone
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+)
+
+// APIPath is the path the metrics API is served under, the same as through the aggregator.
+const APIPath = "/apis/metrics.k8s.io/v1beta1/"
+
+// handler serves the node and pod metrics in the provider as the metrics API would, for
+// the nodes in the static list, and the pods in the Kubelets' summaries (since there are
+// no pod objects to match them to, they have no labels).
+type handler struct {
+	nodes    v1listers.NodeLister
+	provider provider.MetricsProvider
+	health   func(*http.Request) error
+}
+
+func newHandler(nodes v1listers.NodeLister, metricsProvider provider.MetricsProvider, health func(*http.Request) error) http.Handler {
+	return &handler{nodes: nodes, provider: metricsProvider, health: health}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/healthz" {
+		if err := h.health(req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, APIPath) {
+		h.writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("the path %q is not served", req.URL.Path))
+		return
+	}
+	if req.Method != http.MethodGet {
+		h.writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, fmt.Sprintf("%s is not supported", req.Method))
+		return
+	}
+	selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		h.writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, APIPath), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "nodes":
+		h.listNodes(w, selector)
+	case len(parts) == 2 && parts[0] == "nodes":
+		h.getNode(w, parts[1])
+	case len(parts) == 1 && parts[0] == "pods":
+		h.listPods(w, "", selector)
+	case len(parts) == 3 && parts[0] == "namespaces" && parts[2] == "pods":
+		h.listPods(w, parts[1], selector)
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "pods":
+		h.getPod(w, apitypes.NamespacedName{Namespace: parts[1], Name: parts[3]})
+	default:
+		h.writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("the path %q is not served", req.URL.Path))
+	}
+}
+
+func (h *handler) listNodes(w http.ResponseWriter, selector labels.Selector) {
+	nodes, err := h.nodes.List(selector)
+	if err != nil {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	items, err := h.nodeMetrics(nodes...)
+	if err != nil {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+	list := &v1beta1.NodeMetricsList{TypeMeta: metav1.TypeMeta{Kind: "NodeMetricsList", APIVersion: v1beta1.SchemeGroupVersion.String()}, Items: items}
+	h.write(w, list)
+}
+
+func (h *handler) getNode(w http.ResponseWriter, name string) {
+	node, err := h.nodes.Get(name)
+	if err != nil {
+		h.writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("nodemetrics.metrics.k8s.io %q not found", name))
+		return
+	}
+	items, err := h.nodeMetrics(node)
+	if err != nil {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+	if len(items) == 0 {
+		h.writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("nodemetrics.metrics.k8s.io %q not found", name))
+		return
+	}
+	items[0].TypeMeta = metav1.TypeMeta{Kind: "NodeMetrics", APIVersion: v1beta1.SchemeGroupVersion.String()}
+	h.write(w, &items[0])
+}
+
+// nodeMetrics returns the metrics of those of the given nodes with any.
+func (h *handler) nodeMetrics(nodes ...*corev1.Node) ([]v1beta1.NodeMetrics, error) {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Name
+	}
+	timeInfos, usages, err := h.provider.GetNodeMetrics(names...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1beta1.NodeMetrics, 0, len(nodes))
+	for i, node := range nodes {
+		if usages[i] == nil {
+			continue
+		}
+		res = append(res, v1beta1.NodeMetrics{
+			ObjectMeta: metav1.ObjectMeta{Name: node.Name, Labels: node.Labels, CreationTimestamp: metav1.Now()},
+			Timestamp:  metav1.NewTime(timeInfos[i].Timestamp),
+			Window:     metav1.Duration{Duration: timeInfos[i].Window},
+			Usage:      usages[i],
+		})
+	}
+	return res, nil
+}
+
+func (h *handler) listPods(w http.ResponseWriter, namespace string, selector labels.Selector) {
+	lister, ok := h.provider.(provider.PodListingProvider)
+	if !ok {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, "the provider can't list pods")
+		return
+	}
+	list := &v1beta1.PodMetricsList{TypeMeta: metav1.TypeMeta{Kind: "PodMetricsList", APIVersion: v1beta1.SchemeGroupVersion.String()}, Items: []v1beta1.PodMetrics{}}
+	// the pods have no labels, so only selectors matching no labels select them
+	if !selector.Matches(labels.Set{}) {
+		h.write(w, list)
+		return
+	}
+	pods := lister.ListPods(namespace)
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	items, err := h.podMetrics(pods...)
+	if err != nil {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+	list.Items = items
+	h.write(w, list)
+}
+
+func (h *handler) getPod(w http.ResponseWriter, pod apitypes.NamespacedName) {
+	items, err := h.podMetrics(pod)
+	if err != nil {
+		h.writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, err.Error())
+		return
+	}
+	if len(items) == 0 {
+		h.writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, fmt.Sprintf("podmetrics.metrics.k8s.io %q not found", pod.String()))
+		return
+	}
+	items[0].TypeMeta = metav1.TypeMeta{Kind: "PodMetrics", APIVersion: v1beta1.SchemeGroupVersion.String()}
+	h.write(w, &items[0])
+}
+
+// podMetrics returns the metrics of those of the given pods with any.
+func (h *handler) podMetrics(pods ...apitypes.NamespacedName) ([]v1beta1.PodMetrics, error) {
+	timeInfos, containers, err := h.provider.GetContainerMetrics(pods...)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]v1beta1.PodMetrics, 0, len(pods))
+	for i, pod := range pods {
+		if containers[i] == nil {
+			continue
+		}
+		item := v1beta1.PodMetrics{
+			ObjectMeta: metav1.ObjectMeta{Name: pod.Name, Namespace: pod.Namespace, CreationTimestamp: metav1.Now()},
+			Timestamp:  metav1.NewTime(timeInfos[i].Timestamp),
+			Window:     metav1.Duration{Duration: timeInfos[i].Window},
+			Containers: make([]v1beta1.ContainerMetrics, len(containers[i])),
+		}
+		for j, container := range containers[i] {
+			item.Containers[j] = v1beta1.ContainerMetrics{Name: container.Name, Usage: container.Usage}
+		}
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+func (h *handler) write(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeStatus writes a failure Status, as the API server would.
+func (h *handler) writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standalone
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LoadNodes returns a lister of the nodes in the given YAML or JSON file, which holds a NodeList
+// (as written by `kubectl get nodes -o yaml`).  Each node needs a name, and the addresses its
+// Kubelet is reachable at.  The file is only read once, since standalone nodes don't come and go.
+func LoadNodes(path string) (v1listers.NodeLister, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the static nodes file: %v", err)
+	}
+	list := &corev1.NodeList{}
+	if err := yaml.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("unable to parse the static nodes file %s: %v", path, err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i := range list.Items {
+		node := &list.Items[i]
+		if node.Name == "" {
+			return nil, fmt.Errorf("node %d in the static nodes file %s has no name", i, path)
+		}
+		if _, exists, _ := indexer.Get(node); exists {
+			return nil, fmt.Errorf("node %s is listed more than once in the static nodes file %s", node.Name, path)
+		}
+		if err := indexer.Add(node); err != nil {
+			return nil, err
+		}
+	}
+	if len(list.Items) == 0 {
+		return nil, fmt.Errorf("the static nodes file %s lists no nodes", path)
+	}
+	return v1listers.NewNodeLister(indexer), nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package standalone runs metrics-server without an API server, for Kubelets running standalone
+// (e.g. in the CI of node components): the nodes come from a static file rather than informers,
+// the pods are those in the Kubelets' summaries, and the metrics API is served on a plain HTTPS
+// listener, rather than registered with the aggregator.  Nothing talks to an API server.
+package standalone
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/manager"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	"github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+)
+
+// Config configures a standalone Server.
+type Config struct {
+	// Nodes lists the nodes to scrape (see LoadNodes).
+	Nodes v1listers.NodeLister
+	// Kubelet configures the client connecting to the Kubelets, which must connect to them
+	// directly, since there's no API server to proxy through.
+	Kubelet *summary.KubeletClientConfig
+	// AddressResolver, if non-nil, finds the address to connect to each node's Kubelet at,
+	// instead of the address of the first of summary.DefaultAddressTypePriority it has.
+	AddressResolver summary.NodeAddressResolver
+	// SourceOptions configures the summary sources scraping the Kubelets.
+	SourceOptions summary.SourceOptions
+	// MetricResolution is the interval at which metrics are scraped.
+	MetricResolution time.Duration
+	// ScrapeTimeout bounds each scrape, tuning.ScrapeTimeoutFor(MetricResolution) if zero.
+	ScrapeTimeout time.Duration
+
+	// Listener, if non-nil, is listened on instead of BindAddress (e.g. in tests).
+	Listener net.Listener
+	// BindAddress is the host and port to serve the metrics API on.
+	BindAddress string
+	// CertFile and KeyFile are the serving certificate and its key.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is the local CA which clients must present certificates signed
+	// by.  Otherwise, any client may read the metrics.
+	ClientCAFile string
+}
+
+// Server collects metrics from the statically listed Kubelets, serving them over HTTPS.
+type Server struct {
+	config   Config
+	provider provider.MetricsProvider
+	manager  *manager.Manager
+	handler  http.Handler
+}
+
+// registerDurationMetrics registers the duration histograms of the source manager and manager.
+var registerDurationMetrics sync.Once
+
+// NewServer constructs a standalone Server from the given config.
+func NewServer(config Config) (*Server, error) {
+	if config.Nodes == nil {
+		return nil, fmt.Errorf("a static list of nodes is required to run standalone")
+	}
+	if config.Kubelet == nil {
+		return nil, fmt.Errorf("a Kubelet client config is required to run standalone")
+	}
+	if config.Kubelet.UseAPIServerProxy {
+		return nil, fmt.Errorf("the Kubelets can't be scraped through the API server proxy when running standalone")
+	}
+	if config.ScrapeTimeout == 0 {
+		config.ScrapeTimeout = tuning.ScrapeTimeoutFor(config.MetricResolution)
+	}
+	addrResolver := config.AddressResolver
+	if addrResolver == nil {
+		addrResolver = summary.NewPriorityNodeAddressResolver(summary.DefaultAddressTypePriority)
+	}
+	kubeletClient, err := summary.KubeletClientFor(config.Kubelet)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct a client to connect to the kubelets: %v", err)
+	}
+
+	sourceProvider := summary.NewSummaryProvider(config.Nodes, kubeletClient, addrResolver, config.SourceOptions)
+	registerDurationMetrics.Do(func() {
+		sources.RegisterDurationMetrics(config.ScrapeTimeout)
+		manager.RegisterDurationMetrics(config.MetricResolution)
+	})
+	sourceManager := sources.NewOrderedSourceManager(sourceProvider, config.ScrapeTimeout, sources.RandomOrdering())
+	metricSink, metricsProvider := provsink.NewSinkProviderExpectingData(time.Now().Add(config.MetricResolution + config.ScrapeTimeout))
+
+	s := &Server{
+		config:   config,
+		provider: metricsProvider,
+		manager:  manager.NewManager(sourceManager, metricSink, config.MetricResolution),
+	}
+	s.handler = newHandler(config.Nodes, metricsProvider, s.manager.CheckHealth)
+	return s, nil
+}
+
+// Provider returns the provider of the stored node and pod metrics.
+func (s *Server) Provider() provider.MetricsProvider {
+	return s.provider
+}
+
+// Handler returns the handler serving the metrics API and the health check.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Run collects metrics, serving them until the given context is done.
+func (s *Server) Run(ctx context.Context) error {
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	listener := s.config.Listener
+	if listener == nil {
+		if listener, err = net.Listen("tcp", s.config.BindAddress); err != nil {
+			return fmt.Errorf("unable to listen on %s: %v", s.config.BindAddress, err)
+		}
+	}
+	server := &http.Server{Handler: s.handler, TLSConfig: tlsConfig}
+
+	s.manager.RunUntil(ctx.Done())
+	errCh := make(chan error, 1)
+	go func() {
+		glog.Infof("serving the metrics API standalone on %s", listener.Addr())
+		errCh <- server.Serve(tls.NewListener(listener, tlsConfig))
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
+
+// tlsConfig loads the serving certificate, and the client CA, if any.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the serving certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.config.ClientCAFile != "" {
+		caData, err := ioutil.ReadFile(s.config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates in the client CA file %s", s.config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
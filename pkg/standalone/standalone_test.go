@@ -0,0 +1,216 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standalone_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/fakefleet"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/standalone"
+)
+
+func TestStandalone(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Standalone Suite")
+}
+
+// writeNodes writes the given nodes as a NodeList to a file in the given directory.
+func writeNodes(dir string, nodes []*corev1.Node) string {
+	list := corev1.NodeList{}
+	for _, node := range nodes {
+		list.Items = append(list.Items, *node)
+	}
+	data, err := json.Marshal(&list)
+	Expect(err).NotTo(HaveOccurred())
+	path := filepath.Join(dir, "nodes.json")
+	Expect(ioutil.WriteFile(path, data, 0644)).To(Succeed())
+	return path
+}
+
+var _ = Describe("Standalone", func() {
+	var (
+		dir    string
+		fleet  *fakefleet.Fleet
+		config Config
+		pool   *x509.CertPool
+		cancel context.CancelFunc
+		done   chan error
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "standalone")
+		Expect(err).NotTo(HaveOccurred())
+		fleet, err = fakefleet.New(fakefleet.Config{Nodes: 3, PodsPerNode: 2, ContainersPerPod: 1, Namespaces: 1, Seed: 1})
+		Expect(err).NotTo(HaveOccurred())
+
+		nodes, err := fleet.NodeLister().List(labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		lister, err := LoadNodes(writeNodes(dir, nodes))
+		Expect(err).NotTo(HaveOccurred())
+
+		certPEM, keyPEM, err := certutil.GenerateSelfSignedCertKey("localhost", []net.IP{net.ParseIP("127.0.0.1")}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "tls.crt"), certPEM, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0600)).To(Succeed())
+		pool = x509.NewCertPool()
+		Expect(pool.AppendCertsFromPEM(certPEM)).To(BeTrue())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		config = Config{
+			Nodes: lister,
+			Kubelet: &summary.KubeletClientConfig{
+				Port: 10250,
+				RESTConfig: &rest.Config{
+					TLSClientConfig: rest.TLSClientConfig{
+						CAData:     fleet.CAData(),
+						ServerName: fakefleet.ServerName,
+					},
+				},
+				Dial: fleet.Dial,
+			},
+			MetricResolution: time.Second,
+			Listener:         listener,
+			CertFile:         filepath.Join(dir, "tls.crt"),
+			KeyFile:          filepath.Join(dir, "tls.key"),
+		}
+	})
+
+	// run starts a server from the config, returning the URL it serves the metrics API at.
+	run := func() string {
+		server, err := NewServer(config)
+		Expect(err).NotTo(HaveOccurred())
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() { done <- server.Run(ctx) }()
+		return fmt.Sprintf("https://%s%s", config.Listener.Addr(), APIPath)
+	}
+
+	AfterEach(func() {
+		if cancel != nil {
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+			cancel = nil
+		}
+		config.Listener.Close()
+		fleet.Close()
+		os.RemoveAll(dir)
+	})
+
+	// get fetches the given URL with the given client, decoding the response into obj,
+	// and returning its status code.
+	get := func(client *http.Client, url string, obj interface{}) (int, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if obj != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+				return 0, err
+			}
+		}
+		return resp.StatusCode, nil
+	}
+
+	clientWith := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}},
+		}
+	}
+
+	It("should serve the metrics of the listed nodes and their pods, without an API server", func() {
+		url := run()
+		client := clientWith()
+
+		Eventually(func() ([]v1beta1.NodeMetrics, error) {
+			var list v1beta1.NodeMetricsList
+			_, err := get(client, url+"nodes", &list)
+			return list.Items, err
+		}, 10*time.Second).Should(HaveLen(3))
+
+		var pods v1beta1.PodMetricsList
+		Expect(get(client, url+"pods", &pods)).To(Equal(http.StatusOK))
+		Expect(pods.Items).To(HaveLen(6))
+
+		pod := pods.Items[0]
+		var fetched v1beta1.PodMetrics
+		Expect(get(client, fmt.Sprintf("%snamespaces/%s/pods/%s", url, pod.Namespace, pod.Name), &fetched)).To(Equal(http.StatusOK))
+		Expect(fetched.Name).To(Equal(pod.Name))
+		Expect(fetched.Containers).To(HaveLen(1))
+
+		Expect(get(client, url+"nodes/no-such-node", nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only serve clients presenting certificates signed by the client CA, if any", func() {
+		caKey, err := certutil.NewPrivateKey()
+		Expect(err).NotTo(HaveOccurred())
+		caCert, err := certutil.NewSelfSignedCACert(certutil.Config{CommonName: "client-ca"}, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "client-ca.crt"), certutil.EncodeCertPEM(caCert), 0644)).To(Succeed())
+		config.ClientCAFile = filepath.Join(dir, "client-ca.crt")
+
+		key, err := certutil.NewPrivateKey()
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := certutil.NewSignedCert(certutil.Config{CommonName: "reader", Usages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, key, caCert, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		clientCert, err := tls.X509KeyPair(certutil.EncodeCertPEM(cert), certutil.EncodePrivateKeyPEM(key))
+		Expect(err).NotTo(HaveOccurred())
+
+		url := run()
+		Eventually(func() (int, error) {
+			return get(clientWith(clientCert), url+"nodes", nil)
+		}, 10*time.Second).Should(Equal(http.StatusOK))
+
+		_, err = get(clientWith(), url+"nodes", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject node lists naming the same node twice", func() {
+		nodes, err := fleet.NodeLister().List(labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = LoadNodes(writeNodes(dir, append(nodes, nodes[0])))
+		Expect(err).To(MatchError(ContainSubstring(nodes[0].Name)))
+	})
+
+	It("should refuse to scrape through the API server proxy", func() {
+		config.Kubelet.UseAPIServerProxy = true
+		_, err := NewServer(config)
+		Expect(err).To(HaveOccurred())
+	})
+})
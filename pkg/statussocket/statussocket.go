@@ -0,0 +1,225 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statussocket publishes the outcome of each node's scrape in every collection cycle
+// to a local Unix datagram socket, as a small JSON record per datagram, for agents such as
+// node-problem-detector to set node conditions from when metrics collection keeps failing.
+// Records are queued and sent asynchronously, so that a slow (or missing) reader never holds
+// up scrapes: records that don't fit in the queue, or can't be sent, are dropped and counted.
+// The socket needn't exist when metrics-server starts: it's connected to, and reconnected to
+// after it goes away, at most once per reconnect interval, dropping records in between.
+package statussocket
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/asyncqueue"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+)
+
+const (
+	// DefaultQueueSize is the default number of records which may be waiting to be sent.
+	DefaultQueueSize = 1000
+	// DefaultReconnectInterval is the default minimum time between attempts to connect to the socket.
+	DefaultReconnectInterval = 10 * time.Second
+
+	// writeTimeout bounds how long sending a record may wait for the reader to make room for it.
+	writeTimeout = 100 * time.Millisecond
+	// errorLogInterval is the minimum time between logged errors, so that a
+	// missing socket doesn't log an error for every record.
+	errorLogInterval = time.Minute
+)
+
+const (
+	dropReasonUnavailable = "unavailable"
+	dropReasonSendFailed  = "send_failed"
+)
+
+var recordsDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "metrics_server",
+		Subsystem: "scrape_status_socket",
+		Name:      "records_dropped_total",
+		Help:      "The number of scrape status records not sent to the scrape status socket, by why: the queue of records waiting to be sent was full, the publisher was closed, the socket was unavailable, or sending failed",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(recordsDropped)
+}
+
+// Record is the datagram sent for one node's scrape.
+type Record struct {
+	Node    string `json:"node"`
+	Success bool   `json:"success"`
+	// ErrorClass classifies the error the scrape failed with (see summary.ErrorClass), if it did.
+	ErrorClass     string  `json:"errorClass,omitempty"`
+	LatencySeconds float64 `json:"latencySeconds"`
+}
+
+// Conn is a connection to the socket.
+type Conn interface {
+	Write(b []byte) (int, error)
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Options configures a Publisher.
+type Options struct {
+	// Path is the path of the Unix datagram socket.
+	Path string
+	// QueueSize is the number of records which may be waiting to be sent,
+	// beyond which records are dropped.  It defaults to DefaultQueueSize.
+	QueueSize int
+	// ReconnectInterval is the minimum time between attempts to connect
+	// to the socket.  It defaults to DefaultReconnectInterval.
+	ReconnectInterval time.Duration
+	// Dial, if set, connects to the socket, in place of dialing it with net.Dial (e.g. for tests).
+	Dial func(path string) (Conn, error)
+}
+
+// Publisher sends a record of each cycle's scrape statuses it observes to the socket.
+// It's a summary.StatusObserver.
+type Publisher struct {
+	opts    Options
+	queue   *asyncqueue.Queue
+	dropped uint64
+
+	// the following are only used by the goroutine sending records
+	conn            Conn
+	lastDial        time.Time
+	lastErrorLogged time.Time
+}
+
+var _ summary.StatusObserver = &Publisher{}
+
+// New starts publishing to the socket with the given options.  It doesn't
+// connect to the socket until there's a record to send.
+func New(opts Options) *Publisher {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.ReconnectInterval <= 0 {
+		opts.ReconnectInterval = DefaultReconnectInterval
+	}
+	if opts.Dial == nil {
+		opts.Dial = dial
+	}
+	p := &Publisher{opts: opts}
+	p.queue = asyncqueue.New(asyncqueue.Options{
+		Size: opts.QueueSize,
+		Handle: func(record interface{}, _ bool) {
+			p.send(record.(Record))
+		},
+		Stop: p.disconnect,
+		Drop: p.drop,
+	})
+	return p
+}
+
+func dial(path string) (Conn, error) {
+	return net.Dial("unixgram", path)
+}
+
+// ObserveStatus queues a record of the given status to be sent, if it's from a collection
+// cycle, dropping it if the queue's full (or the publisher's closed), so it never blocks.
+// Warming up nodes are reported as successful, and scrapes cut short by their node's
+// deletion aren't reported.
+func (p *Publisher) ObserveStatus(status summary.NodeScrapeStatus) {
+	if status.Reason != string(sources.ScrapeReasonCycle) || status.CancelCause == sources.CancelReasonNodeDeleted {
+		return
+	}
+	p.queue.Push(Record{
+		Node:           status.Node,
+		Success:        status.Success || status.WarmingUp,
+		ErrorClass:     status.ErrorClass,
+		LatencySeconds: status.DurationSeconds,
+	})
+}
+
+// Dropped returns the number of records dropped so far, for whatever reason.
+func (p *Publisher) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+func (p *Publisher) drop(reason string) {
+	atomic.AddUint64(&p.dropped, 1)
+	recordsDropped.WithLabelValues(reason).Inc()
+}
+
+// Close stops publishing, once the queued records are sent, and closes the connection.
+// Records observed afterwards are dropped.  It's safe to call more than once.
+func (p *Publisher) Close() {
+	p.queue.Close()
+}
+
+// disconnect closes the connection, once the queue's closed.
+func (p *Publisher) disconnect() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *Publisher) send(record Record) {
+	if p.conn == nil {
+		if time.Since(p.lastDial) < p.opts.ReconnectInterval {
+			p.drop(dropReasonUnavailable)
+			return
+		}
+		p.lastDial = time.Now()
+		conn, err := p.opts.Dial(p.opts.Path)
+		if err != nil {
+			p.logError("connect to", err)
+			p.drop(dropReasonUnavailable)
+			return
+		}
+		glog.V(2).Infof("connected to scrape status socket %q", p.opts.Path)
+		p.conn = conn
+	}
+
+	datagram, err := json.Marshal(record)
+	if err != nil {
+		// can't happen, since records only contain strings, booleans, and numbers
+		p.logError("encode a record for", err)
+		p.drop(dropReasonSendFailed)
+		return
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := p.conn.Write(datagram); err != nil {
+		p.logError("send to", err)
+		p.drop(dropReasonSendFailed)
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			// the reader's gone, so reconnect once it's back (perhaps at a new socket)
+			p.conn.Close()
+			p.conn = nil
+		}
+	}
+}
+
+func (p *Publisher) logError(op string, err error) {
+	if time.Since(p.lastErrorLogged) < errorLogInterval {
+		return
+	}
+	p.lastErrorLogged = time.Now()
+	glog.Warningf("unable to %s scrape status socket %q (records are dropped until it's available): %v", op, p.opts.Path, err)
+}
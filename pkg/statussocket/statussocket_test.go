@@ -0,0 +1,263 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statussocket_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources/summary"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/statussocket"
+)
+
+func TestStatusSocket(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Scrape Status Socket Suite")
+}
+
+// socketReader reads the datagrams sent to a test socket, each decoded as a generic JSON object.
+type socketReader struct {
+	conn    *net.UnixConn
+	records chan map[string]interface{}
+}
+
+func listen(path string) *socketReader {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	Expect(err).NotTo(HaveOccurred())
+	r := &socketReader{conn: conn, records: make(chan map[string]interface{}, 100)}
+	go func() {
+		defer GinkgoRecover()
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			var record map[string]interface{}
+			Expect(json.Unmarshal(buf[:n], &record)).To(Succeed(), string(buf[:n]))
+			r.records <- record
+		}
+	}()
+	return r
+}
+
+func (r *socketReader) Close() {
+	r.conn.Close()
+}
+
+// blockedConn is a connection whose writes block until released.
+type blockedConn struct {
+	release chan struct{}
+	writing chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	written []string
+}
+
+func (c *blockedConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { close(c.writing) })
+	<-c.release
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, string(b))
+	return len(b), nil
+}
+
+func (c *blockedConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *blockedConn) Close() error                     { return nil }
+
+// cycleStatus returns the status of a cycle's scrape of the given node.
+func cycleStatus(node string, err error) summary.NodeScrapeStatus {
+	status := summary.NodeScrapeStatus{
+		Node:            node,
+		Reason:          string(sources.ScrapeReasonCycle),
+		CycleID:         "cycle1",
+		Success:         err == nil,
+		DurationSeconds: 0.5,
+	}
+	if err != nil {
+		status.Error = err.Error()
+		status.ErrorClass = summary.ErrorClass(err)
+	}
+	return status
+}
+
+// droppedFor fetches the number of records dropped for the given reason from the default registry.
+func droppedFor(reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() != "metrics_server_scrape_status_socket_records_dropped_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" && label.GetValue() == reason {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+var _ = Describe("Scrape Status Socket Publisher", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+		// socket paths are limited to around a hundred bytes, so keep it short
+		dir, err = ioutil.TempDir("", "sss")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "s.sock")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should send a JSON record of each cycle's scrape of each node", func() {
+		reader := listen(path)
+		defer reader.Close()
+		p := New(Options{Path: path})
+		defer p.Close()
+
+		statuses := summary.NewScrapeStatusTracker()
+		statuses.AddObserver(p)
+		statuses.Update(cycleStatus("node1", nil))
+		statuses.Update(cycleStatus("node2", &summary.ErrDial{}))
+		warmingUp := cycleStatus("node3", nil)
+		warmingUp.Success, warmingUp.WarmingUp = false, true
+		statuses.Update(warmingUp)
+
+		By("leaving out scrapes outside of cycles, and those cut short by their node's deletion")
+		debug := cycleStatus("node1", &summary.ErrDial{})
+		debug.Reason = string(sources.ScrapeReasonDebug)
+		statuses.Update(debug)
+		deleted := cycleStatus("node4", &sources.ErrCanceled{Reason: sources.CancelReasonNodeDeleted})
+		deleted.CancelCause = sources.CancelReasonNodeDeleted
+		statuses.Update(deleted)
+
+		Eventually(reader.records).Should(Receive(Equal(map[string]interface{}{"node": "node1", "success": true, "latencySeconds": 0.5})))
+		Eventually(reader.records).Should(Receive(Equal(map[string]interface{}{"node": "node2", "success": false, "errorClass": summary.ErrorClassDial, "latencySeconds": 0.5})))
+		Eventually(reader.records).Should(Receive(Equal(map[string]interface{}{"node": "node3", "success": true, "latencySeconds": 0.5})))
+		Consistently(reader.records, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(p.Dropped()).To(BeZero())
+	})
+
+	It("should drop records rather than block when the reader is slow", func() {
+		conn := &blockedConn{release: make(chan struct{}), writing: make(chan struct{})}
+		p := New(Options{
+			Path:      path,
+			QueueSize: 2,
+			Dial:      func(string) (Conn, error) { return conn, nil },
+		})
+
+		By("getting the publisher stuck sending the first record")
+		p.ObserveStatus(cycleStatus("node0", nil))
+		Eventually(conn.writing).Should(BeClosed())
+
+		By("observing more records than fit in the queue")
+		observed := make(chan struct{})
+		go func() {
+			defer close(observed)
+			for i := 1; i <= 10; i++ {
+				p.ObserveStatus(cycleStatus(fmt.Sprintf("node%d", i), nil))
+			}
+		}()
+		Eventually(observed, time.Second).Should(BeClosed())
+		Expect(p.Dropped()).To(BeEquivalentTo(8))
+
+		By("sending the queued records once the reader catches up")
+		close(conn.release)
+		p.Close()
+		var nodes []string
+		for _, datagram := range conn.written {
+			var record Record
+			Expect(json.Unmarshal([]byte(datagram), &record)).To(Succeed())
+			nodes = append(nodes, record.Node)
+		}
+		Expect(nodes).To(Equal([]string{"node0", "node1", "node2"}))
+	})
+
+	It("should count records observed once it's closed as dropped for that, rather than for a full queue", func() {
+		p := New(Options{Path: path})
+		p.Close()
+		closedBefore, fullBefore := droppedFor("closed"), droppedFor("queue_full")
+
+		p.ObserveStatus(cycleStatus("node1", nil))
+		Expect(p.Dropped()).To(BeEquivalentTo(1))
+		Expect(droppedFor("closed")).To(Equal(closedBefore + 1))
+		Expect(droppedFor("queue_full")).To(Equal(fullBefore))
+	})
+
+	It("should tolerate the socket's absence, reconnecting once it's back", func() {
+		p := New(Options{Path: path, ReconnectInterval: 50 * time.Millisecond})
+		defer p.Close()
+
+		By("dropping records while there's no socket")
+		p.ObserveStatus(cycleStatus("node1", nil))
+		Eventually(p.Dropped).Should(BeEquivalentTo(1))
+
+		By("sending records once the socket exists")
+		reader := listen(path)
+		Eventually(func() bool {
+			p.ObserveStatus(cycleStatus("node1", nil))
+			select {
+			case record := <-reader.records:
+				return record["node"] == "node1"
+			case <-time.After(10 * time.Millisecond):
+				return false
+			}
+		}, time.Second).Should(BeTrue())
+
+		By("reconnecting after the reader goes away and comes back")
+		reader.Close()
+		os.Remove(path)
+		Eventually(func() uint64 {
+			dropped := p.Dropped()
+			p.ObserveStatus(cycleStatus("node2", nil))
+			time.Sleep(5 * time.Millisecond)
+			return p.Dropped() - dropped
+		}).Should(BeEquivalentTo(1))
+		reader = listen(path)
+		defer reader.Close()
+		Eventually(func() bool {
+			p.ObserveStatus(cycleStatus("node3", nil))
+			select {
+			case record := <-reader.records:
+				return record["node"] == "node3"
+			case <-time.After(10 * time.Millisecond):
+				return false
+			}
+		}, time.Second).Should(BeTrue())
+	})
+})
@@ -0,0 +1,198 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package listing sorts and pages the lists of node and pod metrics.
+package listing
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+)
+
+// SortParam is the query parameter choosing the order of NodeMetrics and PodMetrics lists.
+const SortParam = "sortBy"
+
+// SortKey is an order in which lists can be sorted.
+type SortKey string
+
+const (
+	// SortByName sorts by namespace and name, and is the usual default.
+	SortByName SortKey = "name"
+	// SortByCPU sorts by CPU usage, highest first, and then by name.
+	SortByCPU SortKey = "cpu"
+	// SortByMemory sorts by memory usage, highest first, and then by name.
+	SortByMemory SortKey = "memory"
+	// Unsorted keeps items in the order given (e.g. the order they were requested in).
+	// It can't be requested with the SortParam, only be used as the default.
+	Unsorted SortKey = "unsorted"
+)
+
+type sortKey struct{}
+
+// WithSortBy records the raw value of the SortParam for the request.
+func WithSortBy(ctx context.Context, sortBy string) context.Context {
+	return context.WithValue(ctx, sortKey{}, sortBy)
+}
+
+// SortByFrom returns the order requested by the SortParam recorded for the request,
+// defaulting to the given order, or a bad request error if it's not a known order.
+func SortByFrom(ctx context.Context, defaultOrder SortKey) (SortKey, error) {
+	raw, _ := ctx.Value(sortKey{}).(string)
+	switch key := SortKey(raw); key {
+	case "":
+		return defaultOrder, nil
+	case SortByName, SortByCPU, SortByMemory:
+		return key, nil
+	default:
+		return "", errors.NewBadRequest(fmt.Sprintf("unknown %q value %q: lists may be sorted by %q, %q, or %q", SortParam, raw, SortByName, SortByCPU, SortByMemory))
+	}
+}
+
+// WithSortParam wraps the given handler, recording the SortParam of requests
+// in their contexts, since the storage doesn't see the raw query otherwise.
+func WithSortParam(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if sortBy := req.URL.Query().Get(SortParam); sortBy != "" {
+			req = req.WithContext(WithSortBy(req.Context(), sortBy))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Item holds what's needed to sort and page an item of a list.
+type Item struct {
+	// Key is the item's namespace and name, which is unique within the list.
+	Key string
+	// MilliCPU is the item's CPU usage, in millicores.
+	MilliCPU int64
+	// Memory is the item's memory usage, in bytes.
+	Memory int64
+}
+
+// continueToken is the decoded form of a list's continue token, which records the order
+// of the list and its last item, so that the next page starts after it wherever it ends
+// up, even if items are added, removed, or change usage between pages.
+type continueToken struct {
+	SortBy   SortKey `json:"sortBy"`
+	Key      string  `json:"key"`
+	MilliCPU int64   `json:"cpu,omitempty"`
+	Memory   int64   `json:"memory,omitempty"`
+}
+
+// less checks if a comes before b in the given order.
+func less(by SortKey, a, b Item) bool {
+	switch by {
+	case SortByCPU:
+		if a.MilliCPU != b.MilliCPU {
+			return a.MilliCPU > b.MilliCPU
+		}
+	case SortByMemory:
+		if a.Memory != b.Memory {
+			return a.Memory > b.Memory
+		}
+	}
+	return a.Key < b.Key
+}
+
+// Page sorts the given items in the order requested for the list (or the given default),
+// and then returns the indices of the items in the requested page, in order, along with the
+// continue token for the next page, if there is one.  Mismatched and malformed continue
+// tokens return bad request errors.
+func Page(ctx context.Context, items []Item, options *metainternalversion.ListOptions, defaultOrder SortKey) ([]int, string, error) {
+	by, err := SortByFrom(ctx, defaultOrder)
+	if err != nil {
+		return nil, "", err
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	if by != Unsorted {
+		sort.Slice(order, func(i, j int) bool {
+			return less(by, items[order[i]], items[order[j]])
+		})
+	}
+
+	if options == nil {
+		return order, "", nil
+	}
+	if options.Continue != "" {
+		after, err := decodeContinue(options.Continue)
+		if err != nil {
+			return nil, "", err
+		}
+		if after.SortBy != by {
+			return nil, "", errors.NewBadRequest(fmt.Sprintf("the continue token is for a list sorted by %q, not %q, so the %q parameter must not change between pages", after.SortBy, by, SortParam))
+		}
+		start, err := resume(by, items, order, Item{Key: after.Key, MilliCPU: after.MilliCPU, Memory: after.Memory})
+		if err != nil {
+			return nil, "", err
+		}
+		order = order[start:]
+	}
+	if options.Limit <= 0 || int64(len(order)) <= options.Limit {
+		return order, "", nil
+	}
+
+	order = order[:options.Limit]
+	last := items[order[len(order)-1]]
+	token := continueToken{SortBy: by, Key: last.Key}
+	switch by {
+	case SortByCPU:
+		token.MilliCPU = last.MilliCPU
+	case SortByMemory:
+		token.Memory = last.Memory
+	}
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return nil, "", err
+	}
+	return order, base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// resume finds where the page after the given last item starts in the given order.
+func resume(by SortKey, items []Item, order []int, last Item) (int, error) {
+	if by != Unsorted {
+		// the last item needn't still be there, since the next page just starts after where it would be
+		return sort.Search(len(order), func(i int) bool {
+			return less(by, last, items[order[i]])
+		}), nil
+	}
+	for i, index := range order {
+		if items[index].Key == last.Key {
+			return i + 1, nil
+		}
+	}
+	return 0, errors.NewResourceExpired(fmt.Sprintf("the last item of the previous page, %q, is gone, so the list must be restarted", last.Key))
+}
+
+// decodeContinue decodes the given continue token.
+func decodeContinue(encoded string) (continueToken, error) {
+	var token continueToken
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err == nil {
+		err = json.Unmarshal(raw, &token)
+	}
+	if err != nil || token.Key == "" {
+		return continueToken{}, errors.NewBadRequest("invalid continue token")
+	}
+	return token, nil
+}
@@ -19,16 +19,19 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/golang/glog"
-
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/listing"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apiserver/pkg/registry/rest"
 	v1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/metrics/pkg/apis/metrics"
@@ -39,22 +42,92 @@ type MetricStorage struct {
 	groupResource schema.GroupResource
 	prov          provider.NodeMetricsProvider
 	nodeLister    v1listers.NodeLister
+	// router, if non-nil, fetches the metrics of nodes owned by other replicas.
+	router provider.NodeRouter
+	// propagatedLabels lists the node labels copied onto each node's metrics.
+	propagatedLabels []string
+	// clock is used to compute the age of each node's metrics as they're served.
+	clock clock.Clock
+	// limiter, if non-nil, limits the gets and lists in flight.
+	limiter *provider.InflightLimiter
+	// available, if non-nil, is checked before serving each request.
+	available provider.AvailabilityCheck
+	// lastAttempt, if non-nil, enables serving nodes with no metrics as unavailable,
+	// and returns the time their metrics were last scraped (or attempted to be).
+	lastAttempt LastAttemptFunc
+	// serveProvenance enables annotating the metrics served with their provenance, when asked.
+	serveProvenance bool
 }
 
+// StatusAnnotation is set to StatusUnavailable on the NodeMetrics served for nodes
+// with no metrics, when those are served (see ServeUnavailableNodes).
+const StatusAnnotation = "metrics.k8s.io/status"
+
+// StatusUnavailable is the value of StatusAnnotation for nodes with no metrics.
+const StatusUnavailable = "unavailable"
+
+// LastAttemptFunc returns the time of the last attempt to scrape the given node, if any.
+type LastAttemptFunc func(node string) (time.Time, bool)
+
 var _ rest.KindProvider = &MetricStorage{}
 var _ rest.Storage = &MetricStorage{}
 var _ rest.Getter = &MetricStorage{}
 var _ rest.Lister = &MetricStorage{}
 var _ rest.Scoper = &MetricStorage{}
 
-func NewStorage(groupResource schema.GroupResource, prov provider.NodeMetricsProvider, nodeLister v1listers.NodeLister) *MetricStorage {
+// NewStorage constructs storage for node metrics, fetching the metrics of nodes
+// owned by other replicas through the given router, if non-nil.
+func NewStorage(groupResource schema.GroupResource, prov provider.NodeMetricsProvider, nodeLister v1listers.NodeLister, router provider.NodeRouter) *MetricStorage {
 	return &MetricStorage{
 		groupResource: groupResource,
 		prov:          prov,
 		nodeLister:    nodeLister,
+		router:        router,
+		clock:         clock.RealClock{},
 	}
 }
 
+// SetClock sets the clock used to compute the age of the metrics served.
+func (m *MetricStorage) SetClock(clk clock.Clock) {
+	m.clock = clk
+}
+
+// PropagateLabels sets the node labels (e.g. topology.kubernetes.io/zone) copied onto the
+// labels of each node's metrics, so that clients can aggregate them without joining them
+// with the nodes themselves.  The labels are taken from the node informer as each request
+// is served, so changes to them don't wait for the next scrape.
+func (m *MetricStorage) PropagateLabels(keys []string) {
+	m.propagatedLabels = keys
+}
+
+// LimitInflight sets the limiter of gets and lists in flight, which may be nil
+// (and may be shared with other storage) to avoid limiting them.
+func (m *MetricStorage) LimitInflight(limiter *provider.InflightLimiter) {
+	m.limiter = limiter
+}
+
+// SetAvailabilityCheck sets the check run before serving each request, which
+// may be nil, so that requests fail with its error while it fails.
+func (m *MetricStorage) SetAvailabilityCheck(check provider.AvailabilityCheck) {
+	m.available = check
+}
+
+// ServeUnavailableNodes enables serving nodes known to the node informer which have no
+// metrics (e.g. because they're NotReady) with zero usage, marked with StatusAnnotation,
+// and the time of the last attempt to scrape them (from the given func) as their timestamp,
+// rather than leaving them out, so that clients get the full list of nodes.  It's disabled
+// if the func is nil.  Pods are never served this way, since the HPA would take the zero
+// usage at face value.
+func (m *MetricStorage) ServeUnavailableNodes(lastAttempt LastAttemptFunc) {
+	m.lastAttempt = lastAttempt
+}
+
+// ServeProvenance enables annotating each node's metrics with where they came from (see
+// provider.AddProvenanceAnnotations) for requests asking for it with provider.DebugParam.
+func (m *MetricStorage) ServeProvenance(enabled bool) {
+	m.serveProvenance = enabled
+}
+
 // Storage interface
 func (m *MetricStorage) New() runtime.Object {
 	return &metrics.NodeMetrics{}
@@ -72,9 +145,39 @@ func (m *MetricStorage) NewList() runtime.Object {
 
 // Lister interface
 func (m *MetricStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	release, err := m.limiter.Acquire(ctx, provider.ListRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	labelSelector := labels.Everything()
-	if options != nil && options.LabelSelector != nil {
-		labelSelector = options.LabelSelector
+	var resourceVersion string
+	if options != nil {
+		if options.LabelSelector != nil {
+			labelSelector = options.LabelSelector
+		}
+		resourceVersion = options.ResourceVersion
+	}
+	if _, err := listing.SortByFrom(ctx, listing.SortByName); err != nil {
+		return nil, err
+	}
+	if _, err := provider.SmoothingFrom(ctx, m.prov); err != nil {
+		return nil, err
+	}
+	if _, err := provider.ProvenanceRequested(ctx, m.serveProvenance); err != nil {
+		return nil, err
+	}
+	// during cold start, ask clients to retry rather than returning empty lists
+	if err := m.available.Check(); err != nil {
+		return nil, err
+	}
+	if err := provider.CheckPopulated(m.prov); err != nil {
+		return nil, err
+	}
+	ctx, resourceVersion, err = provider.PinVersion(ctx, m.snapshots(), resourceVersion)
+	if err != nil {
+		return nil, err
 	}
 	nodes, err := m.nodeLister.ListWithPredicate(func(node *v1.Node) bool {
 		if labelSelector.Empty() {
@@ -84,7 +187,7 @@ func (m *MetricStorage) List(ctx context.Context, options *metainternalversion.L
 	})
 	if err != nil {
 		errMsg := fmt.Errorf("Error while listing nodes for selector %v: %v", labelSelector, err)
-		glog.Error(errMsg)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, errMsg.Error(), "selector", labelSelector)
 		return &metrics.NodeMetricsList{}, errMsg
 	}
 
@@ -93,57 +196,234 @@ func (m *MetricStorage) List(ctx context.Context, options *metainternalversion.L
 		names[i] = node.Name
 	}
 
-	metricsItems, err := m.getNodeMetrics(names...)
+	metricsItems, err := m.getNodeMetrics(ctx, names...)
 	if err != nil {
 		errMsg := fmt.Errorf("Error while fetching node metrics for selector %v: %v", labelSelector, err)
-		glog.Error(errMsg)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, errMsg.Error(), "selector", labelSelector)
 		return &metrics.NodeMetricsList{}, errMsg
 	}
 
-	return &metrics.NodeMetricsList{Items: metricsItems}, nil
+	if m.routed(ctx) {
+		metricsItems = m.mergeProxied(ctx, labelSelector, names, metricsItems)
+	}
+
+	res, err := pageNodeMetrics(ctx, metricsItems, options)
+	if err != nil {
+		return nil, err
+	}
+	res.ResourceVersion = resourceVersion
+	return res, nil
+}
+
+// pageNodeMetrics sorts the given node metrics in the order requested, returning the requested page.
+func pageNodeMetrics(ctx context.Context, items []metrics.NodeMetrics, options *metainternalversion.ListOptions) (*metrics.NodeMetricsList, error) {
+	keys := make([]listing.Item, len(items))
+	for i, item := range items {
+		keys[i] = listing.Item{
+			Key:      item.Name,
+			MilliCPU: item.Usage.Cpu().MilliValue(),
+			Memory:   item.Usage.Memory().Value(),
+		}
+	}
+	order, continueToken, err := listing.Page(ctx, keys, options, listing.SortByName)
+	if err != nil {
+		return nil, err
+	}
+	res := &metrics.NodeMetricsList{Items: make([]metrics.NodeMetrics, len(order))}
+	for i, index := range order {
+		res.Items[i] = items[index]
+	}
+	res.Continue = continueToken
+	return res, nil
 }
 
 func (m *MetricStorage) Get(ctx context.Context, name string, opts *metav1.GetOptions) (runtime.Object, error) {
-	nodeMetrics, err := m.getNodeMetrics(name)
+	release, err := m.limiter.Acquire(ctx, provider.GetRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if _, err := provider.SmoothingFrom(ctx, m.prov); err != nil {
+		return nil, err
+	}
+	if _, err := provider.ProvenanceRequested(ctx, m.serveProvenance); err != nil {
+		return nil, err
+	}
+	if m.routed(ctx) && !m.router.Owns(name) {
+		nodeMetrics, err := m.router.ProxyGet(ctx, name)
+		if err == nil {
+			return nodeMetrics, nil
+		}
+		// fall back to local data, which we may have if we owned the node until recently
+		logging.FromContext(ctx, loglevel.Provider).Warning(fmt.Sprintf("unable to fetch node metrics for node %q from the replica that owns it, falling back to local data: %v", name, err), "node", name, "err", err)
+	}
+	if err := m.available.Check(); err != nil {
+		return nil, err
+	}
+	if err := provider.CheckPopulated(m.prov); err != nil {
+		return nil, err
+	}
+	var resourceVersion string
+	if opts != nil {
+		resourceVersion = opts.ResourceVersion
+	}
+	if ctx, _, err = provider.PinVersion(ctx, m.snapshots(), resourceVersion); err != nil {
+		return nil, err
+	}
+
+	nodeMetrics, err := m.getNodeMetrics(ctx, name)
 	if err == nil && len(nodeMetrics) == 0 {
 		err = fmt.Errorf("no metrics known for node %q", name)
 	}
 	if err != nil {
-		glog.Errorf("unable to fetch node metrics for node %q: %v", name, err)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, fmt.Sprintf("unable to fetch node metrics for node %q: %v", name, err), "node", name)
 		return nil, errors.NewNotFound(m.groupResource, name)
 	}
 
 	return &nodeMetrics[0], nil
 }
 
-func (m *MetricStorage) getNodeMetrics(names ...string) ([]metrics.NodeMetrics, error) {
-	timestamps, usages, err := m.prov.GetNodeMetrics(names...)
+// routed checks if requests for nodes owned by other replicas should be proxied to them.
+func (m *MetricStorage) routed(ctx context.Context) bool {
+	return m.router != nil && !provider.LocalOnlyFrom(ctx)
+}
+
+// mergeProxied replaces the local metrics with those from the replicas that own each
+// node, keeping the local metrics for any nodes whose owners couldn't be reached.
+// The result follows the order of the given node names.
+func (m *MetricStorage) mergeProxied(ctx context.Context, selector labels.Selector, names []string, local []metrics.NodeMetrics) []metrics.NodeMetrics {
+	proxied, err := m.router.ProxyList(ctx, selector)
+	if err != nil {
+		logging.FromContext(ctx, loglevel.Provider).Warning(fmt.Sprintf("unable to fetch node metrics from all other replicas, returning partial results: %v", err), "err", err)
+	}
+	byName := make(map[string]metrics.NodeMetrics, len(local)+len(proxied))
+	for _, item := range local {
+		byName[item.Name] = item
+	}
+	for _, item := range proxied {
+		byName[item.Name] = item
+	}
+	res := make([]metrics.NodeMetrics, 0, len(byName))
+	for _, name := range names {
+		if item, ok := byName[name]; ok {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// providerFor returns the snapshot pinned for the request, if any, so that all items
+// in a response come from the same collection, or its smoothed view, if requested.
+func (m *MetricStorage) providerFor(ctx context.Context) provider.NodeMetricsProvider {
+	var prov provider.NodeMetricsProvider = m.prov
+	if snapshot := provider.SnapshotFrom(ctx); snapshot != nil {
+		prov = snapshot
+	}
+	if smoothed := provider.SmoothedFrom(ctx, prov); smoothed != nil {
+		return smoothed
+	}
+	return prov
+}
+
+// snapshots returns the provider as a SnapshotProvider, if it is one.
+func (m *MetricStorage) snapshots() provider.SnapshotProvider {
+	snapshots, _ := m.prov.(provider.SnapshotProvider)
+	return snapshots
+}
+
+func (m *MetricStorage) getNodeMetrics(ctx context.Context, names ...string) ([]metrics.NodeMetrics, error) {
+	prov := m.providerFor(ctx)
+	timestamps, usages, err := prov.GetNodeMetrics(names...)
 	if err != nil {
 		return nil, err
 	}
+	resourceVersion := provider.ResourceVersionOf(prov)
+	// already checked when the request started
+	withProvenance, _ := provider.ProvenanceRequested(ctx, m.serveProvenance)
 
 	res := make([]metrics.NodeMetrics, 0, len(names))
 
+	now := m.clock.Now()
 	for i, name := range names {
 		if usages[i] == nil {
-			glog.Errorf("unable to fetch node metrics for node %q: no metrics known for node", name)
+			if item, ok := m.unavailableNodeMetrics(name, resourceVersion, now); ok {
+				res = append(res, item)
+				continue
+			}
+			logging.FromContext(ctx, loglevel.Provider).Error(nil, fmt.Sprintf("unable to fetch node metrics for node %q: no metrics known for node", name), "node", name)
 
 			continue
 		}
 		res = append(res, metrics.NodeMetrics{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:              name,
-				CreationTimestamp: metav1.NewTime(time.Now()),
+				ResourceVersion:   resourceVersion,
+				Labels:            m.labelsFor(name),
+				Annotations:       provider.SampleAgeAnnotations(now, timestamps[i].Timestamp),
+				CreationTimestamp: metav1.NewTime(now),
 			},
 			Timestamp: metav1.NewTime(timestamps[i].Timestamp),
 			Window:    metav1.Duration{Duration: timestamps[i].Window},
 			Usage:     usages[i],
 		})
+		if withProvenance {
+			provider.AddProvenanceAnnotations(res[len(res)-1].Annotations, timestamps[i].Provenance)
+		}
 	}
 
 	return res, nil
 }
 
+// unavailableNodeMetrics returns the metrics served for the given node with no metrics,
+// if unavailable nodes are served and the node is known to the node informer.
+func (m *MetricStorage) unavailableNodeMetrics(name, resourceVersion string, now time.Time) (metrics.NodeMetrics, bool) {
+	if m.lastAttempt == nil {
+		return metrics.NodeMetrics{}, false
+	}
+	if _, err := m.nodeLister.Get(name); err != nil {
+		return metrics.NodeMetrics{}, false
+	}
+	// nodes never scraped yet have no timestamp
+	lastAttempt, _ := m.lastAttempt(name)
+	return metrics.NodeMetrics{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			ResourceVersion:   resourceVersion,
+			Labels:            m.labelsFor(name),
+			Annotations:       map[string]string{StatusAnnotation: StatusUnavailable},
+			CreationTimestamp: metav1.NewTime(now),
+		},
+		Timestamp: metav1.NewTime(lastAttempt),
+		Usage: v1.ResourceList{
+			v1.ResourceCPU:    *resource.NewMilliQuantity(0, resource.DecimalSI),
+			v1.ResourceMemory: *resource.NewQuantity(0, resource.BinarySI),
+		},
+	}, true
+}
+
+// labelsFor returns the propagated labels of the given node, if any.
+func (m *MetricStorage) labelsFor(name string) map[string]string {
+	if len(m.propagatedLabels) == 0 {
+		return nil
+	}
+	node, err := m.nodeLister.Get(name)
+	if err != nil {
+		logging.Background(loglevel.Provider).V(2).Info(fmt.Sprintf("unable to fetch node %q to propagate its labels: %v", name, err), "node", name, "err", err)
+		return nil
+	}
+	var res map[string]string
+	for _, key := range m.propagatedLabels {
+		if val, ok := node.Labels[key]; ok {
+			if res == nil {
+				res = make(map[string]string, len(m.propagatedLabels))
+			}
+			res[key] = val
+		}
+	}
+	return res
+}
+
 func (m *MetricStorage) NamespaceScoped() bool {
 	return false
 }
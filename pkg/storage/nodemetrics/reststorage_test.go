@@ -0,0 +1,330 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nodemetrics_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/listing"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/storage/nodemetrics"
+)
+
+const (
+	zoneLabel         = "topology.kubernetes.io/zone"
+	instanceTypeLabel = "node.kubernetes.io/instance-type"
+)
+
+func TestNodeMetricsStorage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "NodeMetrics Storage Suite")
+}
+
+func nodeWithLabels(name string, nodeLabels map[string]string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels}}
+}
+
+var _ = Describe("NodeMetrics Storage", func() {
+	var (
+		indexer    cache.Indexer
+		storage    *MetricStorage
+		sampleTime time.Time
+		metricSink sink.MetricSink
+		batch      *sources.MetricsBatch
+	)
+
+	BeforeEach(func() {
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		Expect(indexer.Add(nodeWithLabels("node1", map[string]string{zoneLabel: "zone-a", instanceTypeLabel: "large", "team": "infra"}))).To(Succeed())
+		Expect(indexer.Add(nodeWithLabels("node2", map[string]string{zoneLabel: "zone-b"}))).To(Succeed())
+		Expect(indexer.Add(nodeWithLabels("node3", map[string]string{zoneLabel: "zone-a"}))).To(Succeed())
+
+		sampleTime = time.Now()
+		batch = &sources.MetricsBatch{}
+		for i, name := range []string{"node1", "node2", "node3"} {
+			batch.Nodes = append(batch.Nodes, sources.NodeMetricsPoint{Name: name, MetricsPoint: sources.MetricsPoint{
+				Timestamp:   sampleTime,
+				CpuUsage:    *resource.NewMilliQuantity(100, resource.DecimalSI),
+				MemoryUsage: *resource.NewQuantity(int64(200+100*(i%2)), resource.BinarySI),
+			}})
+		}
+		var prov provider.MetricsProvider
+		metricSink, prov = provsink.NewSinkProvider()
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		storage = NewStorage(metrics.Resource("nodemetrics"), prov, v1listers.NewNodeLister(indexer), nil)
+	})
+
+	get := func(name string) *metrics.NodeMetrics {
+		obj, err := storage.Get(context.Background(), name, &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return obj.(*metrics.NodeMetrics)
+	}
+
+	list := func(selector labels.Selector) []metrics.NodeMetrics {
+		obj, err := storage.List(context.Background(), &metainternalversion.ListOptions{LabelSelector: selector})
+		Expect(err).NotTo(HaveOccurred())
+		return obj.(*metrics.NodeMetricsList).Items
+	}
+
+	It("should not propagate any node labels by default", func() {
+		Expect(get("node1").Labels).To(BeEmpty())
+		for _, item := range list(labels.Everything()) {
+			Expect(item.Labels).To(BeEmpty())
+		}
+	})
+
+	It("should annotate node metrics with their age as of each request", func() {
+		fakeClock := clock.NewFakeClock(sampleTime.Add(5 * time.Second))
+		storage.SetClock(fakeClock)
+		Expect(get("node1").Annotations).To(HaveKeyWithValue(provider.SampleAgeAnnotation, "5s"))
+
+		fakeClock.Step(1500 * time.Millisecond)
+		Expect(get("node1").Annotations).To(HaveKeyWithValue(provider.SampleAgeAnnotation, "6.5s"))
+		for _, item := range list(labels.Everything()) {
+			Expect(item.Annotations).To(HaveKeyWithValue(provider.SampleAgeAnnotation, "6.5s"))
+		}
+	})
+
+	It("should list nodes by name, or page through them sorted by usage", func() {
+		names := func(items []metrics.NodeMetrics) []string {
+			var names []string
+			for _, item := range items {
+				names = append(names, item.Name)
+			}
+			return names
+		}
+		Expect(names(list(labels.Everything()))).To(Equal([]string{"node1", "node2", "node3"}))
+
+		ctx := listing.WithSortBy(context.Background(), "memory")
+		obj, err := storage.List(ctx, &metainternalversion.ListOptions{Limit: 2})
+		Expect(err).NotTo(HaveOccurred())
+		first := obj.(*metrics.NodeMetricsList)
+		Expect(names(first.Items)).To(Equal([]string{"node2", "node1"}))
+
+		obj, err = storage.List(ctx, &metainternalversion.ListOptions{Limit: 2, Continue: first.Continue})
+		Expect(err).NotTo(HaveOccurred())
+		second := obj.(*metrics.NodeMetricsList)
+		Expect(names(second.Items)).To(Equal([]string{"node3"}))
+		Expect(second.Continue).To(BeEmpty())
+
+		_, err = storage.List(listing.WithSortBy(context.Background(), "uptime"), &metainternalversion.ListOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+	})
+
+	It("should stamp everything with the resource version of the batch served, failing for other versions", func() {
+		listAt := func(resourceVersion string) (*metrics.NodeMetricsList, error) {
+			obj, err := storage.List(context.Background(), &metainternalversion.ListOptions{ResourceVersion: resourceVersion})
+			if err != nil {
+				return nil, err
+			}
+			return obj.(*metrics.NodeMetricsList), nil
+		}
+		first, err := listAt("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first.ResourceVersion).NotTo(BeEmpty())
+		for _, item := range first.Items {
+			Expect(item.ResourceVersion).To(Equal(first.ResourceVersion))
+		}
+		Expect(get("node1").ResourceVersion).To(Equal(first.ResourceVersion))
+		for _, version := range []string{"0", first.ResourceVersion} {
+			res, err := listAt(version)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.ResourceVersion).To(Equal(first.ResourceVersion))
+		}
+
+		By("moving on to a higher version with the next batch")
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		second, err := listAt("0")
+		Expect(err).NotTo(HaveOccurred())
+		firstVersion, _ := strconv.ParseUint(first.ResourceVersion, 10, 64)
+		secondVersion, _ := strconv.ParseUint(second.ResourceVersion, 10, 64)
+		Expect(secondVersion).To(BeNumerically(">", firstVersion))
+		_, err = storage.Get(context.Background(), "node1", &metav1.GetOptions{ResourceVersion: second.ResourceVersion})
+		Expect(err).NotTo(HaveOccurred())
+
+		By("failing with 410 Gone for versions no longer retained")
+		_, err = listAt(first.ResourceVersion)
+		Expect(apierrors.IsResourceExpired(err)).To(BeTrue())
+		Expect(apierrors.ReasonForError(err)).To(Equal(metav1.StatusReasonExpired))
+		_, err = storage.Get(context.Background(), "node1", &metav1.GetOptions{ResourceVersion: first.ResourceVersion})
+		Expect(apierrors.IsResourceExpired(err)).To(BeTrue())
+
+		By("asking clients to retry versions not committed yet, and rejecting invalid ones")
+		_, err = listAt(strconv.FormatUint(secondVersion+1, 10))
+		Expect(apierrors.IsTimeout(err)).To(BeTrue())
+		_, err = listAt("last-tuesday")
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+	})
+
+	It("should serve the availability check's error instead of metrics while it fails", func() {
+		unavailable := apierrors.NewServiceUnavailable("the nodes informer hasn't synced")
+		storage.SetAvailabilityCheck(func() error { return unavailable })
+		_, err := storage.Get(context.Background(), "node1", &metav1.GetOptions{})
+		Expect(err).To(Equal(unavailable))
+		_, err = storage.List(context.Background(), &metainternalversion.ListOptions{})
+		Expect(err).To(Equal(unavailable))
+	})
+
+	It("should serve smoothed usage when requested, rejecting unknown smoothing, or smoothing while disabled", func() {
+		smoothed := provider.WithSmoothing(context.Background(), string(provider.SmoothingExponential))
+		_, err := storage.Get(smoothed, "node1", &metav1.GetOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+
+		By("smoothing a half-life of history")
+		metricSink.(sink.SmoothingSink).SetSmoothingHalfLife(time.Minute)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		for i := range batch.Nodes {
+			batch.Nodes[i].Timestamp = sampleTime.Add(time.Minute)
+			batch.Nodes[i].CpuUsage = *resource.NewMilliQuantity(300, resource.DecimalSI)
+		}
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		obj, err := storage.Get(smoothed, "node1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		node := obj.(*metrics.NodeMetrics)
+		Expect(node.Usage.Cpu().MilliValue()).To(Equal(int64(200)))
+		Expect(node.Window.Duration).To(Equal(time.Minute))
+		obj, err = storage.List(smoothed, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.NodeMetricsList).Items).To(HaveLen(3))
+		Expect(get("node1").Usage.Cpu().MilliValue()).To(Equal(int64(300)))
+
+		_, err = storage.List(provider.WithSmoothing(context.Background(), "median"), &metainternalversion.ListOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+	})
+
+	It("should annotate node metrics with their provenance when requested, rejecting it while disabled", func() {
+		debug := provider.WithDebug(context.Background(), provider.DebugProvenance)
+		_, err := storage.Get(debug, "node1", &metav1.GetOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+
+		By("recording the provenance of each node")
+		collected := sampleTime.Add(-time.Second)
+		for i := range batch.Nodes {
+			batch.Nodes[i].Provenance = sources.NewProvenance("cycle-1", "kubelet_summary", "https://10.0.0.1:10250/stats/summary", collected, sources.ProvenanceStale)
+		}
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		storage.ServeProvenance(true)
+
+		obj, err := storage.Get(debug, "node1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		annotations := obj.(*metrics.NodeMetrics).Annotations
+		Expect(annotations).To(HaveKeyWithValue(provider.ProvenanceCycleAnnotation, "cycle-1"))
+		Expect(annotations).To(HaveKeyWithValue(provider.ProvenanceSourceAnnotation, "kubelet_summary"))
+		Expect(annotations).To(HaveKeyWithValue(provider.ProvenanceEndpointAnnotation, "https://10.0.0.1:10250/stats/summary"))
+		Expect(annotations).To(HaveKeyWithValue(provider.ProvenanceCollectedAnnotation, collected.UTC().Format(time.RFC3339Nano)))
+		Expect(annotations).To(HaveKeyWithValue(provider.ProvenanceKindAnnotation, "stale"))
+		obj, err = storage.List(debug, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, item := range obj.(*metrics.NodeMetricsList).Items {
+			Expect(item.Annotations).To(HaveKeyWithValue(provider.ProvenanceKindAnnotation, "stale"))
+		}
+
+		By("leaving it out unless requested")
+		Expect(get("node1").Annotations).NotTo(HaveKey(provider.ProvenanceCycleAnnotation))
+
+		_, err = storage.List(provider.WithDebug(context.Background(), "everything"), &metainternalversion.ListOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+	})
+
+	Context("with a node with no metrics", func() {
+		var lastAttempt time.Time
+
+		BeforeEach(func() {
+			Expect(indexer.Add(nodeWithLabels("node4", map[string]string{zoneLabel: "zone-b"}))).To(Succeed())
+			lastAttempt = sampleTime.Add(-30 * time.Second)
+		})
+
+		lastAttempts := func(node string) (time.Time, bool) {
+			if node == "node4" {
+				return lastAttempt, true
+			}
+			return time.Time{}, false
+		}
+
+		It("should leave it out by default", func() {
+			Expect(list(labels.Everything())).To(HaveLen(3))
+			_, err := storage.Get(context.Background(), "node4", &metav1.GetOptions{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should serve it as unavailable, with zero usage as of the last attempt, when enabled", func() {
+			storage.ServeUnavailableNodes(lastAttempts)
+			storage.PropagateLabels([]string{zoneLabel})
+			storage.SetClock(clock.NewFakeClock(sampleTime))
+			items := list(labels.Everything())
+			Expect(items).To(HaveLen(4))
+			for _, item := range items[:3] {
+				Expect(item.Annotations).NotTo(HaveKey(StatusAnnotation))
+			}
+
+			node4 := get("node4")
+			Expect(node4.Annotations).To(Equal(map[string]string{StatusAnnotation: StatusUnavailable}))
+			Expect(node4.Labels).To(Equal(map[string]string{zoneLabel: "zone-b"}))
+			Expect(node4.Timestamp.Time).To(Equal(lastAttempt))
+			Expect(node4.Usage.Cpu().IsZero()).To(BeTrue())
+			Expect(node4.Usage.Memory().IsZero()).To(BeTrue())
+			Expect(items[3]).To(Equal(*node4))
+
+			By("still not serving nodes unknown to the node informer")
+			_, err := storage.Get(context.Background(), "node5", &metav1.GetOptions{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	Context("when propagating node labels", func() {
+		BeforeEach(func() {
+			storage.PropagateLabels([]string{zoneLabel, instanceTypeLabel})
+		})
+
+		It("should copy only the listed labels onto the node metrics", func() {
+			Expect(get("node1").Labels).To(Equal(map[string]string{zoneLabel: "zone-a", instanceTypeLabel: "large"}))
+			Expect(get("node2").Labels).To(Equal(map[string]string{zoneLabel: "zone-b"}))
+		})
+
+		It("should reflect changes to the node's labels without a new scrape", func() {
+			Expect(indexer.Update(nodeWithLabels("node2", map[string]string{zoneLabel: "zone-c", instanceTypeLabel: "small"}))).To(Succeed())
+			Expect(get("node2").Labels).To(Equal(map[string]string{zoneLabel: "zone-c", instanceTypeLabel: "small"}))
+		})
+
+		It("should filter lists by the propagated labels", func() {
+			items := list(labels.SelectorFromSet(labels.Set{zoneLabel: "zone-a"}))
+			Expect(items).To(HaveLen(2))
+			for _, item := range items {
+				Expect(item.Labels).To(HaveKeyWithValue(zoneLabel, "zone-a"))
+			}
+			Expect([]string{items[0].Name, items[1].Name}).To(ConsistOf("node1", "node3"))
+		})
+	})
+})
@@ -0,0 +1,79 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// NamesParam is the query parameter restricting a namespaced PodMetrics list to
+// an explicit, comma-separated list of pod names, so that controllers watching
+// particular workloads needn't get each pod or list the whole namespace.  The pods
+// are listed in the order requested, unless sorted explicitly.
+const NamesParam = "names"
+
+// MaxNames is the maximum number of pod names that may be requested in a single list.
+const MaxNames = 500
+
+type namesKey struct{}
+
+// WithNames records the raw value of the NamesParam for the request, so that lists restrict themselves to those names.
+func WithNames(ctx context.Context, names string) context.Context {
+	return context.WithValue(ctx, namesKey{}, names)
+}
+
+// namesFrom fetches the raw value of the NamesParam for the request, if it was given.
+func namesFrom(ctx context.Context) (string, bool) {
+	names, ok := ctx.Value(namesKey{}).(string)
+	return names, ok
+}
+
+// WithNamesParam wraps the given handler, recording the NamesParam of requests
+// in their contexts, since the storage doesn't see the raw query otherwise.
+func WithNamesParam(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if names, ok := req.URL.Query()[NamesParam]; ok {
+			req = req.WithContext(WithNames(req.Context(), strings.Join(names, ",")))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// parseNames splits the given comma-separated list of pod names, dropping empty and
+// duplicate entries.  It returns a bad request error if there are more than MaxNames.
+func parseNames(raw string) ([]string, error) {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, dup := seen[name]; dup {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	if len(names) > MaxNames {
+		return nil, errors.NewBadRequest(fmt.Sprintf("at most %d pod names may be requested at once with the %q parameter, but %d were requested", MaxNames, NamesParam, len(names)))
+	}
+	return names, nil
+}
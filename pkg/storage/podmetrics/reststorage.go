@@ -17,11 +17,14 @@ package podmetrics
 import (
 	"context"
 	"fmt"
-	"time"
-
-	"github.com/golang/glog"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
 	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/listing"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
@@ -30,6 +33,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	apitypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/registry/rest"
 	v1listers "k8s.io/client-go/listers/core/v1"
@@ -41,6 +45,22 @@ type MetricStorage struct {
 	groupResource schema.GroupResource
 	prov          provider.PodMetricsProvider
 	podLister     v1listers.PodLister
+	// serveUnmatched enables serving the metrics of pods with no pod object.
+	serveUnmatched bool
+	// clock is used to compute the age of each pod's metrics as they're served.
+	clock clock.Clock
+	// limiter, if non-nil, limits the gets and lists in flight.
+	limiter *provider.InflightLimiter
+	// available, if non-nil, is checked before serving each request.
+	available provider.AvailabilityCheck
+	// namespaces, if non-nil, restricts the namespaces whose pods are served.
+	namespaces *provider.NamespaceAllowlist
+	// access, if non-nil, filters lists across all namespaces to those the user may list in.
+	access *provider.NamespaceAccess
+	// serveProvenance enables annotating the metrics served with their provenance, when asked.
+	serveProvenance bool
+	// serveNodeNames enables annotating the metrics served with the node they were measured on.
+	serveNodeNames bool
 }
 
 var _ rest.KindProvider = &MetricStorage{}
@@ -53,9 +73,89 @@ func NewStorage(groupResource schema.GroupResource, prov provider.PodMetricsProv
 		groupResource: groupResource,
 		prov:          prov,
 		podLister:     podLister,
+		clock:         clock.RealClock{},
 	}
 }
 
+// SetClock sets the clock used to compute the age of the metrics served.
+func (m *MetricStorage) SetClock(clk clock.Clock) {
+	m.clock = clk
+}
+
+// UnmatchedPodAnnotation is set to "true" on PodMetrics served for pods with no
+// pod object in the informer, when serving them is enabled.
+const UnmatchedPodAnnotation = "metrics-server.kubernetes.io/unmatched-pod"
+
+// UsageCorrectedAnnotation is set on PodMetrics served for pods whose containers reported
+// more usage than the pod itself, to the comma-separated resources whose usage was scaled
+// down to the pod's, when the pod usage check is enabled.
+const UsageCorrectedAnnotation = "metrics-server.kubernetes.io/usage-corrected"
+
+// MemoryOverheadAnnotation is set on PodMetrics, when calculating it is enabled, to how far the
+// pod-level memory usage exceeds the sum of its containers' (the sandbox, and tmpfs volumes
+// charged to the pod), in bytes, so that consumers can account for the overhead.
+const MemoryOverheadAnnotation = "metrics-server.kubernetes.io/memory-overhead-bytes"
+
+// NamespaceCappedAnnotation is set on the PodMetrics in a list which are in a namespace whose
+// stored pods were capped (see sink.NamespaceCap), to the number of pods in that namespace left
+// out of storage, marking the list as partial.  Lists themselves carry no annotations, so every
+// item served from a capped namespace is marked.
+const NamespaceCappedAnnotation = "metrics-server.kubernetes.io/namespace-capped"
+
+// NodeNameAnnotation is set on PodMetrics, when serving it is enabled, to the name of the node
+// the metrics served were measured on, so that consumers can join them with the node's conditions
+// without fetching the pod.  For pods that moved between collections, this is the node of the
+// sample served, not necessarily the pod's current spec.nodeName.
+const NodeNameAnnotation = "metrics-server.kubernetes.io/node-name"
+
+// ServeUnmatchedPods enables serving the metrics of pods which have metrics, but no pod
+// object (marked with UnmatchedPodAnnotation), rather than leaving them out.  These are
+// static pods (e.g. of a self-hosted control plane) whose mirror pods haven't been
+// created, since static pods with mirror pods are matched to them by name.  Pods without
+// objects have no labels, so they're only listed for selectors matching no labels.
+func (m *MetricStorage) ServeUnmatchedPods(serve bool) {
+	m.serveUnmatched = serve
+}
+
+// LimitInflight sets the limiter of gets and lists in flight, which may be nil
+// (and may be shared with other storage) to avoid limiting them.
+func (m *MetricStorage) LimitInflight(limiter *provider.InflightLimiter) {
+	m.limiter = limiter
+}
+
+// SetAvailabilityCheck sets the check run before serving each request, which
+// may be nil, so that requests fail with its error while it fails.
+func (m *MetricStorage) SetAvailabilityCheck(check provider.AvailabilityCheck) {
+	m.available = check
+}
+
+// AllowNamespaces restricts the namespaces whose pods are served to the given allowlist,
+// which may be nil to serve every namespace.  Requests in other namespaces are forbidden,
+// and pods in other namespaces are left out of lists across all namespaces, whatever
+// metrics were collected for them.
+func (m *MetricStorage) AllowNamespaces(allowlist *provider.NamespaceAllowlist) {
+	m.namespaces = allowlist
+}
+
+// FilterNamespaceAccess filters lists across all namespaces down to the pods in the namespaces the
+// requesting user may list PodMetrics in, as decided by the given access, which may be nil to serve
+// such lists only to users who may list PodMetrics in every namespace.
+func (m *MetricStorage) FilterNamespaceAccess(access *provider.NamespaceAccess) {
+	m.access = access
+}
+
+// ServeProvenance enables annotating each pod's metrics with where they came from (see
+// provider.AddProvenanceAnnotations) for requests asking for it with provider.DebugParam.
+func (m *MetricStorage) ServeProvenance(enabled bool) {
+	m.serveProvenance = enabled
+}
+
+// ServeNodeNames enables annotating each pod's metrics with the node they were measured on
+// (see NodeNameAnnotation).
+func (m *MetricStorage) ServeNodeNames(enabled bool) {
+	m.serveNodeNames = enabled
+}
+
 // Storage interface
 func (m *MetricStorage) New() runtime.Object {
 	return &metrics.PodMetrics{}
@@ -73,36 +173,210 @@ func (m *MetricStorage) NewList() runtime.Object {
 
 // Lister interface
 func (m *MetricStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	release, err := m.limiter.Acquire(ctx, provider.ListRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	labelSelector := labels.Everything()
-	if options != nil && options.LabelSelector != nil {
-		labelSelector = options.LabelSelector
+	var resourceVersion string
+	if options != nil {
+		if options.LabelSelector != nil {
+			labelSelector = options.LabelSelector
+		}
+		resourceVersion = options.ResourceVersion
 	}
 	namespace := genericapirequest.NamespaceValue(ctx)
-	pods, err := m.podLister.Pods(namespace).List(labelSelector)
+	if err := m.namespaces.Check(m.groupResource, namespace, ""); err != nil {
+		return nil, err
+	}
+	rawNames, hasNames := namesFrom(ctx)
+	var names []string
+	if hasNames {
+		if namespace == "" {
+			return nil, errors.NewBadRequest(fmt.Sprintf("the %q parameter may only be used when listing pods in a namespace", NamesParam))
+		}
+		if names, err = parseNames(rawNames); err != nil {
+			return nil, err
+		}
+	}
+	// lists of named pods stay in the order requested, unless sorted explicitly
+	defaultOrder := listing.SortByName
+	if hasNames {
+		defaultOrder = listing.Unsorted
+	}
+	if _, err := listing.SortByFrom(ctx, defaultOrder); err != nil {
+		return nil, err
+	}
+	if _, err := provider.SmoothingFrom(ctx, m.prov); err != nil {
+		return nil, err
+	}
+	if _, err := provider.ProvenanceRequested(ctx, m.serveProvenance); err != nil {
+		return nil, err
+	}
+	// during cold start, ask clients to retry rather than returning empty lists
+	if err := m.available.Check(); err != nil {
+		return nil, err
+	}
+	if err := provider.CheckPopulated(m.prov); err != nil {
+		return nil, err
+	}
+	ctx, resourceVersion, err = provider.PinVersion(ctx, m.snapshots(), resourceVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []*v1.Pod
+	if hasNames {
+		pods, err = m.getNamedPods(namespace, names, labelSelector)
+	} else {
+		pods, err = m.podLister.Pods(namespace).List(labelSelector)
+	}
 	if err != nil {
 		errMsg := fmt.Errorf("Error while listing pods for selector %v in namespace %q: %v", labelSelector, namespace, err)
-		glog.Error(errMsg)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, errMsg.Error(), "selector", labelSelector, "namespace", namespace)
 		return &metrics.PodMetricsList{}, errMsg
 	}
 
-	metricsItems, err := m.getPodMetrics(pods...)
+	metricsItems, err := m.getPodMetrics(ctx, pods...)
+	if err == nil && m.serveUnmatched && labelSelector.Matches(labels.Set{}) {
+		var unmatchedItems []metrics.PodMetrics
+		unmatchedItems, err = m.getUnmatchedPodMetrics(ctx, m.unmatchedPods(ctx, namespace, names, hasNames))
+		metricsItems = append(metricsItems, unmatchedItems...)
+	}
 	if err != nil {
 		errMsg := fmt.Errorf("Error while fetching pod metrics for selector %v in namespace %q: %v", labelSelector, namespace, err)
-		glog.Error(errMsg)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, errMsg.Error(), "selector", labelSelector, "namespace", namespace)
 		return &metrics.PodMetricsList{}, errMsg
 	}
 
-	return &metrics.PodMetricsList{Items: metricsItems}, nil
+	if namespace == "" {
+		metricsItems = filterNamespaces(metricsItems, m.access.Filter(ctx))
+	}
+	m.markCappedNamespaces(ctx, metricsItems)
+
+	res, err := pagePodMetrics(ctx, metricsItems, options, defaultOrder)
+	if err != nil {
+		return nil, err
+	}
+	res.ResourceVersion = resourceVersion
+	return res, nil
+}
+
+// markCappedNamespaces sets NamespaceCappedAnnotation on the given pod metrics which are in
+// namespaces capped in the snapshot pinned for the request.
+func (m *MetricStorage) markCappedNamespaces(ctx context.Context, items []metrics.PodMetrics) {
+	var prov interface{} = m.prov
+	if snapshot := provider.SnapshotFrom(ctx); snapshot != nil {
+		prov = snapshot
+	}
+	capping, ok := prov.(provider.NamespaceCappingProvider)
+	if !ok {
+		return
+	}
+	evicted := make(map[string]int)
+	for i := range items {
+		count, checked := evicted[items[i].Namespace]
+		if !checked {
+			count = capping.NamespaceEvictions(items[i].Namespace)
+			evicted[items[i].Namespace] = count
+		}
+		if count == 0 {
+			continue
+		}
+		if items[i].Annotations == nil {
+			items[i].Annotations = make(map[string]string)
+		}
+		items[i].Annotations[NamespaceCappedAnnotation] = strconv.Itoa(count)
+	}
+}
+
+// filterNamespaces leaves out the pod metrics in namespaces the given func doesn't allow,
+// which may be nil to allow every namespace.  Each namespace is only checked once.
+func filterNamespaces(items []metrics.PodMetrics, allows func(namespace string) bool) []metrics.PodMetrics {
+	if allows == nil {
+		return items
+	}
+	allowed := make(map[string]bool)
+	res := items[:0]
+	for _, item := range items {
+		ok, checked := allowed[item.Namespace]
+		if !checked {
+			ok = allows(item.Namespace)
+			allowed[item.Namespace] = ok
+		}
+		if ok {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// pagePodMetrics sorts the given pod metrics in the order requested (or the given default), returning the requested page.
+func pagePodMetrics(ctx context.Context, items []metrics.PodMetrics, options *metainternalversion.ListOptions, defaultOrder listing.SortKey) (*metrics.PodMetricsList, error) {
+	keys := make([]listing.Item, len(items))
+	for i, item := range items {
+		keys[i].Key = item.Namespace + "/" + item.Name
+		for _, container := range item.Containers {
+			keys[i].MilliCPU += container.Usage.Cpu().MilliValue()
+			keys[i].Memory += container.Usage.Memory().Value()
+		}
+	}
+	order, continueToken, err := listing.Page(ctx, keys, options, defaultOrder)
+	if err != nil {
+		return nil, err
+	}
+	res := &metrics.PodMetricsList{Items: make([]metrics.PodMetrics, len(order))}
+	for i, index := range order {
+		res.Items[i] = items[index]
+	}
+	res.Continue = continueToken
+	return res, nil
 }
 
 // Getter interface
 func (m *MetricStorage) Get(ctx context.Context, name string, opts *metav1.GetOptions) (runtime.Object, error) {
+	release, err := m.limiter.Acquire(ctx, provider.GetRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if _, err := provider.SmoothingFrom(ctx, m.prov); err != nil {
+		return nil, err
+	}
+	if _, err := provider.ProvenanceRequested(ctx, m.serveProvenance); err != nil {
+		return nil, err
+	}
+	if err := m.available.Check(); err != nil {
+		return nil, err
+	}
+	if err := provider.CheckPopulated(m.prov); err != nil {
+		return nil, err
+	}
 	namespace := genericapirequest.NamespaceValue(ctx)
+	if err := m.namespaces.Check(m.groupResource, namespace, name); err != nil {
+		return nil, err
+	}
+	var resourceVersion string
+	if opts != nil {
+		resourceVersion = opts.ResourceVersion
+	}
+	if ctx, _, err = provider.PinVersion(ctx, m.snapshots(), resourceVersion); err != nil {
+		return nil, err
+	}
 
 	pod, err := m.podLister.Pods(namespace).Get(name)
+	if errors.IsNotFound(err) && m.serveUnmatched {
+		unmatched, fetchErr := m.getUnmatchedPodMetrics(ctx, m.unmatchedPods(ctx, namespace, []string{name}, true))
+		if fetchErr == nil && len(unmatched) != 0 {
+			return &unmatched[0], nil
+		}
+	}
 	if err != nil {
 		errMsg := fmt.Errorf("Error while getting pod %v: %v", name, err)
-		glog.Error(errMsg)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, errMsg.Error(), "pod", namespace+"/"+name)
 		if errors.IsNotFound(err) {
 			// return not-found errors directly
 			return &metrics.PodMetrics{}, err
@@ -113,18 +387,67 @@ func (m *MetricStorage) Get(ctx context.Context, name string, opts *metav1.GetOp
 		return &metrics.PodMetrics{}, errors.NewNotFound(v1.Resource("pods"), fmt.Sprintf("%v/%v", namespace, name))
 	}
 
-	podMetrics, err := m.getPodMetrics(pod)
+	podMetrics, err := m.getPodMetrics(ctx, pod)
 	if err == nil && len(podMetrics) == 0 {
 		err = fmt.Errorf("no metrics known for pod \"%s/%s\"", pod.Namespace, pod.Name)
 	}
 	if err != nil {
-		glog.Errorf("unable to fetch pod metrics for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		logging.FromContext(ctx, loglevel.Provider).Error(err, fmt.Sprintf("unable to fetch pod metrics for pod %s/%s: %v", pod.Namespace, pod.Name, err), "pod", pod.Namespace+"/"+pod.Name)
 		return nil, errors.NewNotFound(m.groupResource, fmt.Sprintf("%v/%v", namespace, name))
 	}
 	return &podMetrics[0], nil
 }
 
-func (m *MetricStorage) getPodMetrics(pods ...*v1.Pod) ([]metrics.PodMetrics, error) {
+// getNamedPods looks up each of the given pods directly, skipping any that
+// don't exist (or don't match the given selector).
+func (m *MetricStorage) getNamedPods(namespace string, names []string, selector labels.Selector) ([]*v1.Pod, error) {
+	pods := make([]*v1.Pod, 0, len(names))
+	for _, name := range names {
+		pod, err := m.podLister.Pods(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+// providerFor returns the snapshot pinned for the request, if any, so that all items
+// in a response come from the same collection, or its smoothed view, if requested.
+func (m *MetricStorage) providerFor(ctx context.Context) provider.PodMetricsProvider {
+	var prov provider.PodMetricsProvider = m.prov
+	if snapshot := provider.SnapshotFrom(ctx); snapshot != nil {
+		prov = snapshot
+	}
+	if smoothed := provider.SmoothedFrom(ctx, prov); smoothed != nil {
+		return smoothed
+	}
+	return prov
+}
+
+// snapshots returns the provider as a SnapshotProvider, if it is one.
+func (m *MetricStorage) snapshots() provider.SnapshotProvider {
+	snapshots, _ := m.prov.(provider.SnapshotProvider)
+	return snapshots
+}
+
+func (m *MetricStorage) getPodMetrics(ctx context.Context, pods ...*v1.Pod) ([]metrics.PodMetrics, error) {
+	if m.namespaces != nil {
+		// enforced here too, so that nothing in another namespace can be served by any path
+		allowed := make([]*v1.Pod, 0, len(pods))
+		for _, pod := range pods {
+			if m.namespaces.Allows(pod.Namespace) {
+				allowed = append(allowed, pod)
+			}
+		}
+		pods = allowed
+	}
 	namespacedNames := make([]apitypes.NamespacedName, len(pods))
 	for i, pod := range pods {
 		namespacedNames[i] = apitypes.NamespacedName{
@@ -132,16 +455,21 @@ func (m *MetricStorage) getPodMetrics(pods ...*v1.Pod) ([]metrics.PodMetrics, er
 			Namespace: pod.Namespace,
 		}
 	}
-	timestamps, containerMetrics, err := m.prov.GetContainerMetrics(namespacedNames...)
+	prov := m.providerFor(ctx)
+	timestamps, containerMetrics, err := prov.GetContainerMetrics(namespacedNames...)
 	if err != nil {
 		return nil, err
 	}
+	resourceVersion := provider.ResourceVersionOf(prov)
+	// already checked when the request started
+	withProvenance, _ := provider.ProvenanceRequested(ctx, m.serveProvenance)
 
 	res := make([]metrics.PodMetrics, 0, len(pods))
 
+	now := m.clock.Now()
 	for i, pod := range pods {
 		if containerMetrics[i] == nil {
-			glog.Errorf("unable to fetch pod metrics for pod %s/%s: no metrics known for pod", pod.Namespace, pod.Name)
+			logging.FromContext(ctx, loglevel.Provider).Error(nil, fmt.Sprintf("unable to fetch pod metrics for pod %s/%s: no metrics known for pod", pod.Namespace, pod.Name), "pod", pod.Namespace+"/"+pod.Name)
 			continue
 		}
 
@@ -149,12 +477,78 @@ func (m *MetricStorage) getPodMetrics(pods ...*v1.Pod) ([]metrics.PodMetrics, er
 			ObjectMeta: metav1.ObjectMeta{
 				Name:              pod.Name,
 				Namespace:         pod.Namespace,
-				CreationTimestamp: metav1.NewTime(time.Now()),
+				ResourceVersion:   resourceVersion,
+				Annotations:       provider.SampleAgeAnnotations(now, timestamps[i].Timestamp),
+				CreationTimestamp: metav1.NewTime(now),
 			},
 			Timestamp:  metav1.NewTime(timestamps[i].Timestamp),
 			Window:     metav1.Duration{Duration: timestamps[i].Window},
 			Containers: containerMetrics[i],
 		})
+		if corrected := timestamps[i].CorrectedResources; len(corrected) > 0 {
+			res[len(res)-1].Annotations[UsageCorrectedAnnotation] = strings.Join(corrected, ",")
+		}
+		if overhead := timestamps[i].MemoryOverhead; overhead != nil {
+			res[len(res)-1].Annotations[MemoryOverheadAnnotation] = strconv.FormatInt(overhead.Value(), 10)
+		}
+		if node := timestamps[i].NodeName; m.serveNodeNames && node != "" {
+			res[len(res)-1].Annotations[NodeNameAnnotation] = node
+		}
+		if withProvenance {
+			provider.AddProvenanceAnnotations(res[len(res)-1].Annotations, timestamps[i].Provenance)
+		}
+	}
+	return res, nil
+}
+
+// unmatchedPods returns the pods in the given namespace (or just the named ones, if named)
+// which have metrics, but no pod objects, in name order.
+func (m *MetricStorage) unmatchedPods(ctx context.Context, namespace string, names []string, hasNames bool) []apitypes.NamespacedName {
+	lister, ok := m.providerFor(ctx).(provider.PodListingProvider)
+	if !ok {
+		return nil
+	}
+	var wanted map[apitypes.NamespacedName]bool
+	if hasNames {
+		wanted = make(map[apitypes.NamespacedName]bool, len(names))
+		for _, name := range names {
+			wanted[apitypes.NamespacedName{Namespace: namespace, Name: name}] = true
+		}
+	}
+
+	var res []apitypes.NamespacedName
+	for _, pod := range lister.ListPods(namespace) {
+		if wanted != nil && !wanted[pod] {
+			continue
+		}
+		// NB: pods with objects the selector doesn't match aren't unmatched
+		if _, err := m.podLister.Pods(pod.Namespace).Get(pod.Name); !errors.IsNotFound(err) {
+			continue
+		}
+		res = append(res, pod)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// getUnmatchedPodMetrics fetches the metrics of the given pods with no pod objects,
+// marking them with UnmatchedPodAnnotation.
+func (m *MetricStorage) getUnmatchedPodMetrics(ctx context.Context, names []apitypes.NamespacedName) ([]metrics.PodMetrics, error) {
+	pods := make([]*v1.Pod, len(names))
+	for i, name := range names {
+		pods[i] = &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name}}
+	}
+	res, err := m.getPodMetrics(ctx, pods...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Annotations[UnmatchedPodAnnotation] = "true"
 	}
 	return res, nil
 }
@@ -0,0 +1,576 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package podmetrics_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/logging"
+	"github.com/kubernetes-incubator/metrics-server/pkg/loglevel"
+	"github.com/kubernetes-incubator/metrics-server/pkg/provider"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	"github.com/kubernetes-incubator/metrics-server/pkg/storage/listing"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/storage/podmetrics"
+)
+
+func TestPodMetricsStorage(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "PodMetrics Storage Suite")
+}
+
+func itemNames(obj interface{}) []string {
+	list := obj.(*metrics.PodMetricsList)
+	names := make([]string, len(list.Items))
+	for i, item := range list.Items {
+		names[i] = item.Name
+	}
+	return names
+}
+
+var _ = Describe("PodMetrics Storage", func() {
+	var (
+		storage    *MetricStorage
+		ctx        context.Context
+		sampleTime time.Time
+		indexer    cache.Indexer
+		batch      *sources.MetricsBatch
+		metricSink sink.MetricSink
+	)
+
+	BeforeEach(func() {
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		sampleTime = time.Now()
+		batch = &sources.MetricsBatch{}
+		for _, ns := range []string{"ns1", "ns2"} {
+			for i := 0; i < 4; i++ {
+				name := fmt.Sprintf("pod%d", i)
+				Expect(indexer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: ns,
+					Labels:    map[string]string{"even": fmt.Sprintf("%v", i%2 == 0)},
+				}})).To(Succeed())
+				batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: name, Namespace: ns, Containers: []sources.ContainerMetricsPoint{
+					{Name: "container1", MetricsPoint: sources.MetricsPoint{
+						Timestamp:   sampleTime,
+						CpuUsage:    *resource.NewMilliQuantity(100, resource.DecimalSI),
+						MemoryUsage: *resource.NewQuantity(200, resource.BinarySI),
+					}},
+				}})
+			}
+		}
+		// a pod without any metrics yet
+		Expect(indexer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "new-pod", Namespace: "ns1"}})).To(Succeed())
+
+		var prov provider.MetricsProvider
+		metricSink, prov = provsink.NewSinkProvider()
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		storage = NewStorage(metrics.Resource("pods"), prov, v1listers.NewPodLister(indexer))
+		ctx = genericapirequest.WithNamespace(context.Background(), "ns1")
+	})
+
+	It("should list all pods in the namespace without a list of names", func() {
+		list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(itemNames(list)).To(ConsistOf("pod0", "pod1", "pod2", "pod3"))
+	})
+
+	It("should log the pods it has no metrics for, with the pod as a field", func() {
+		recorder := &logging.Recorder{}
+		_, err := storage.Get(logging.NewContext(ctx, logging.NewLogger(recorder, loglevel.Provider)), "new-pod", &metav1.GetOptions{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		entries := recorder.Find("unable to fetch pod metrics for pod ns1/new-pod: no metrics known for pod")
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Severity).To(Equal("error"))
+		Expect(entries[0].Fields).To(Equal(map[string]interface{}{"pod": "ns1/new-pod"}))
+	})
+
+	It("should annotate pod metrics with their age as of each request", func() {
+		fakeClock := clock.NewFakeClock(sampleTime.Add(2 * time.Second))
+		storage.SetClock(fakeClock)
+		obj, err := storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(provider.SampleAgeAnnotation, "2s"))
+
+		fakeClock.Step(time.Minute)
+		list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, item := range list.(*metrics.PodMetricsList).Items {
+			Expect(item.Annotations).To(HaveKeyWithValue(provider.SampleAgeAnnotation, "1m2s"))
+		}
+	})
+
+	It("should annotate pod metrics with the resources whose usage was corrected", func() {
+		batch.Pods[1].CorrectedResources = []string{"cpu", "memory"}
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		obj, err := storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(UsageCorrectedAnnotation, "cpu,memory"))
+
+		obj, err = storage.Get(ctx, "pod2", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).NotTo(HaveKey(UsageCorrectedAnnotation))
+	})
+
+	It("should annotate pod metrics with their memory overhead, in bytes, when it was calculated", func() {
+		batch.Pods[1].MemoryOverhead = resource.NewQuantity(257*1024*1024, resource.BinarySI)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		obj, err := storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(MemoryOverheadAnnotation, "269484032"))
+
+		obj, err = storage.Get(ctx, "pod2", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).NotTo(HaveKey(MemoryOverheadAnnotation))
+	})
+
+	It("should annotate pod metrics with their provenance when requested, and it's enabled", func() {
+		debug := provider.WithDebug(ctx, provider.DebugProvenance)
+		_, err := storage.Get(debug, "pod1", &metav1.GetOptions{})
+		Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+
+		batch.Pods[1].Provenance = sources.NewProvenance("cycle-1", "kubelet_summary", "https://10.0.0.1:10250/stats/summary", sampleTime, sources.ProvenanceFallback)
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		storage.ServeProvenance(true)
+
+		obj, err := storage.Get(debug, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(provider.ProvenanceCycleAnnotation, "cycle-1"))
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(provider.ProvenanceKindAnnotation, "fallback"))
+
+		By("leaving it out for pods with no known provenance, or unless requested")
+		obj, err = storage.Get(debug, "pod2", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).NotTo(HaveKey(provider.ProvenanceCycleAnnotation))
+		obj, err = storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).NotTo(HaveKey(provider.ProvenanceCycleAnnotation))
+	})
+
+	It("should annotate pod metrics with the node of the sample served, as the pod moves between collections", func() {
+		batch.Pods[1].NodeName = "node1"
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		By("leaving it out unless enabled")
+		obj, err := storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).NotTo(HaveKey(NodeNameAnnotation))
+
+		storage.ServeNodeNames(true)
+		obj, err = storage.Get(ctx, "pod1", &metav1.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(NodeNameAnnotation, "node1"))
+
+		By("serving the new node once a sample from it is collected, whatever the pod object says")
+		Expect(indexer.Update(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "ns1", Labels: map[string]string{"even": "false"}},
+			Spec:       corev1.PodSpec{NodeName: "node3"},
+		})).To(Succeed())
+		batch.Pods[1].NodeName = "node2"
+		Expect(metricSink.Receive(batch)).To(Succeed())
+		list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, item := range list.(*metrics.PodMetricsList).Items {
+			if item.Name == "pod1" {
+				Expect(item.Annotations).To(HaveKeyWithValue(NodeNameAnnotation, "node2"))
+			} else {
+				Expect(item.Annotations).NotTo(HaveKey(NodeNameAnnotation))
+			}
+		}
+	})
+
+	It("should mark the pods listed from namespaces whose stored pods were capped with the number left out", func() {
+		metricSink.(sink.NamespaceCappedSink).SetNamespaceCap(sink.NamespaceCap{PodsPerNamespace: 3})
+		batch.Pods = batch.Pods[:7]
+		Expect(metricSink.Receive(batch)).To(Succeed())
+
+		list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.(*metrics.PodMetricsList).Items).To(HaveLen(3))
+		for _, item := range list.(*metrics.PodMetricsList).Items {
+			Expect(item.Annotations).To(HaveKeyWithValue(NamespaceCappedAnnotation, "1"))
+		}
+
+		By("leaving pods in namespaces at the cap unmarked")
+		list, err = storage.List(genericapirequest.WithNamespace(context.Background(), ""), &metainternalversion.ListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.(*metrics.PodMetricsList).Items).To(HaveLen(6))
+		for _, item := range list.(*metrics.PodMetricsList).Items {
+			if item.Namespace == "ns2" {
+				Expect(item.Annotations).NotTo(HaveKey(NamespaceCappedAnnotation))
+			} else {
+				Expect(item.Annotations).To(HaveKey(NamespaceCappedAnnotation))
+			}
+		}
+	})
+
+	Context("with an explicit list of pod names", func() {
+		It("should return exactly the named pods, in the order requested", func() {
+			list, err := storage.List(WithNames(ctx, "pod3,pod1"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"pod3", "pod1"}))
+		})
+
+		It("should omit missing pods, and pods without metrics", func() {
+			list, err := storage.List(WithNames(ctx, "pod0,no-such-pod,new-pod,pod2"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"pod0", "pod2"}))
+		})
+
+		It("should return pods named more than once only once", func() {
+			list, err := storage.List(WithNames(ctx, "pod1, pod1,,pod2,pod1"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"pod1", "pod2"}))
+		})
+
+		It("should only return pods in the request's namespace", func() {
+			list, err := storage.List(WithNames(genericapirequest.WithNamespace(context.Background(), "ns2"), "pod1,new-pod"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"pod1"}))
+			Expect(list.(*metrics.PodMetricsList).Items[0].Namespace).To(Equal("ns2"))
+		})
+
+		It("should also apply any label selector", func() {
+			selector := labels.SelectorFromSet(labels.Set{"even": "true"})
+			list, err := storage.List(WithNames(ctx, "pod0,pod1,pod2"), &metainternalversion.ListOptions{LabelSelector: selector})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"pod0", "pod2"}))
+		})
+
+		It("should reject requests for more than the maximum number of names, stating the limit", func() {
+			names := make([]string, MaxNames+1)
+			for i := range names {
+				names[i] = fmt.Sprintf("pod%d", i)
+			}
+			_, err := storage.List(WithNames(ctx, strings.Join(names, ",")), &metainternalversion.ListOptions{})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue(), "expected a bad request error, got %v", err)
+			Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("at most %d", MaxNames)))
+
+			By("accepting exactly the maximum number of names")
+			_, err = storage.List(WithNames(ctx, strings.Join(names[:MaxNames], ",")), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should reject lists of names across all namespaces", func() {
+			_, err := storage.List(WithNames(context.Background(), "pod1"), &metainternalversion.ListOptions{})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue(), "expected a bad request error, got %v", err)
+		})
+	})
+
+	Context("with static pods", func() {
+		kubeSystem := genericapirequest.WithNamespace(context.Background(), "kube-system")
+
+		BeforeEach(func() {
+			// the API server's static pod has a mirror pod, but etcd's mirror pod hasn't been created
+			Expect(indexer.Add(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "kube-apiserver-node1",
+				Namespace:   "kube-system",
+				Labels:      map[string]string{"component": "kube-apiserver"},
+				Annotations: map[string]string{"kubernetes.io/config.mirror": "8c2a0b6b5e3b2f3d9c7a6d1e4f5a6b7c"},
+			}})).To(Succeed())
+			for _, name := range []string{"kube-apiserver-node1", "etcd-node1"} {
+				batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: name, Namespace: "kube-system", Containers: []sources.ContainerMetricsPoint{
+					{Name: "main", MetricsPoint: sources.MetricsPoint{Timestamp: sampleTime}},
+				}})
+			}
+			Expect(metricSink.Receive(batch)).To(Succeed())
+		})
+
+		It("should serve static pods under the names of their mirror pods", func() {
+			list, err := storage.List(kubeSystem, &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(Equal([]string{"kube-apiserver-node1"}))
+			Expect(list.(*metrics.PodMetricsList).Items[0].Annotations).NotTo(HaveKey(UnmatchedPodAnnotation))
+		})
+
+		It("should leave out pods without objects by default", func() {
+			_, err := storage.Get(kubeSystem, "etcd-node1", &metav1.GetOptions{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		Context("when serving unmatched pods", func() {
+			BeforeEach(func() {
+				storage.ServeUnmatchedPods(true)
+			})
+
+			It("should list pods without objects, marked as unmatched", func() {
+				list, err := storage.List(kubeSystem, &metainternalversion.ListOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(itemNames(list)).To(Equal([]string{"etcd-node1", "kube-apiserver-node1"}))
+				Expect(list.(*metrics.PodMetricsList).Items[0].Annotations).To(HaveKeyWithValue(UnmatchedPodAnnotation, "true"))
+			})
+
+			It("should get pods without objects", func() {
+				obj, err := storage.Get(kubeSystem, "etcd-node1", &metav1.GetOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obj.(*metrics.PodMetrics).Annotations).To(HaveKeyWithValue(UnmatchedPodAnnotation, "true"))
+				Expect(obj.(*metrics.PodMetrics).Containers).To(HaveLen(1))
+			})
+
+			It("should only list pods without objects for selectors matching no labels", func() {
+				selector := labels.SelectorFromSet(labels.Set{"component": "kube-apiserver"})
+				list, err := storage.List(kubeSystem, &metainternalversion.ListOptions{LabelSelector: selector})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(itemNames(list)).To(Equal([]string{"kube-apiserver-node1"}))
+
+				selector, err = labels.Parse("component!=kube-apiserver")
+				Expect(err).NotTo(HaveOccurred())
+				list, err = storage.List(kubeSystem, &metainternalversion.ListOptions{LabelSelector: selector})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(itemNames(list)).To(Equal([]string{"etcd-node1"}))
+			})
+
+			It("should include pods without objects when named", func() {
+				list, err := storage.List(WithNames(kubeSystem, "etcd-node1,no-such-pod"), &metainternalversion.ListOptions{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(itemNames(list)).To(Equal([]string{"etcd-node1"}))
+			})
+
+			It("should still not find pods with neither objects nor metrics", func() {
+				_, err := storage.Get(kubeSystem, "no-such-pod", &metav1.GetOptions{})
+				Expect(apierrors.IsNotFound(err)).To(BeTrue())
+			})
+		})
+	})
+
+	Context("when restricted to some namespaces", func() {
+		var namespaces cache.Indexer
+
+		BeforeEach(func() {
+			namespaces = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			Expect(namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns2", Labels: map[string]string{"tenant": "b"}}})).To(Succeed())
+			selector := labels.SelectorFromSet(labels.Set{"tenant": "a"})
+			storage.AllowNamespaces(provider.NewNamespaceAllowlist([]string{"ns1"}, selector, v1listers.NewNamespaceLister(namespaces)))
+
+			// metrics were collected for another namespace's pod without an object, which must not leak either
+			batch.Pods = append(batch.Pods, sources.PodMetricsPoint{Name: "etcd-node1", Namespace: "kube-system", Containers: []sources.ContainerMetricsPoint{
+				{Name: "main", MetricsPoint: sources.MetricsPoint{Timestamp: sampleTime}},
+			}})
+			Expect(metricSink.Receive(batch)).To(Succeed())
+			storage.ServeUnmatchedPods(true)
+		})
+
+		It("should forbid gets and lists in other namespaces, even though their metrics were collected", func() {
+			ns2 := genericapirequest.WithNamespace(context.Background(), "ns2")
+			_, err := storage.Get(ns2, "pod1", &metav1.GetOptions{})
+			Expect(apierrors.IsForbidden(err)).To(BeTrue())
+			_, err = storage.List(ns2, &metainternalversion.ListOptions{})
+			Expect(apierrors.IsForbidden(err)).To(BeTrue())
+			_, err = storage.Get(genericapirequest.WithNamespace(context.Background(), "kube-system"), "etcd-node1", &metav1.GetOptions{})
+			Expect(apierrors.IsForbidden(err)).To(BeTrue())
+
+			By("still serving the allowed namespace")
+			_, err = storage.Get(ctx, "pod1", &metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should silently leave other namespaces out of lists across all namespaces", func() {
+			list, err := storage.List(context.Background(), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(list.(*metrics.PodMetricsList).Items).To(HaveLen(4))
+			for _, item := range list.(*metrics.PodMetricsList).Items {
+				Expect(item.Namespace).To(Equal("ns1"))
+			}
+		})
+
+		It("should allow namespaces matching the selector", func() {
+			Expect(namespaces.Update(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns2", Labels: map[string]string{"tenant": "a"}}})).To(Succeed())
+			list, err := storage.List(genericapirequest.WithNamespace(context.Background(), "ns2"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(ConsistOf("pod0", "pod1", "pod2", "pod3"))
+		})
+	})
+
+	Context("when filtering lists across all namespaces by access", func() {
+		// the namespaces each user may list pod metrics in, where the empty namespace is all of them
+		access := map[string][]string{"admin": {""}, "tenant-a": {"ns1"}}
+
+		BeforeEach(func() {
+			authz := authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+				for _, ns := range access[attrs.GetUser().GetName()] {
+					if ns == "" || ns == attrs.GetNamespace() {
+						return authorizer.DecisionAllow, "", nil
+					}
+				}
+				return authorizer.DecisionNoOpinion, "", nil
+			})
+			storage.FilterNamespaceAccess(provider.NewNamespaceAccess(authz, metrics.Resource("pods"), time.Minute))
+		})
+
+		listAs := func(name string) []string {
+			ctx := genericapirequest.WithUser(context.Background(), &user.DefaultInfo{Name: name})
+			list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			var res []string
+			for _, item := range list.(*metrics.PodMetricsList).Items {
+				res = append(res, item.Namespace+"/"+item.Name)
+			}
+			return res
+		}
+
+		It("should only list the pods in the namespaces the user may list", func() {
+			Expect(listAs("tenant-a")).To(Equal([]string{"ns1/pod0", "ns1/pod1", "ns1/pod2", "ns1/pod3"}))
+			Expect(listAs("nobody")).To(BeEmpty())
+			Expect(listAs("admin")).To(HaveLen(8))
+		})
+
+		It("should not filter lists within a namespace", func() {
+			ctx := genericapirequest.WithUser(genericapirequest.WithNamespace(context.Background(), "ns2"), &user.DefaultInfo{Name: "nobody"})
+			list, err := storage.List(ctx, &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(list)).To(HaveLen(4))
+		})
+	})
+
+	Context("when sorting and paging lists", func() {
+		cpu := []int64{300, 100, 400, 200}
+		memory := []int64{10, 40, 20, 30}
+
+		BeforeEach(func() {
+			for i := range batch.Pods {
+				pod := &batch.Pods[i]
+				if pod.Namespace != "ns1" {
+					continue
+				}
+				var index int
+				fmt.Sscanf(pod.Name, "pod%d", &index)
+				pod.Containers[0].CpuUsage = *resource.NewMilliQuantity(cpu[index], resource.DecimalSI)
+				pod.Containers[0].MemoryUsage = *resource.NewQuantity(memory[index], resource.BinarySI)
+				// a sidecar reported after the main container, with no usage of its own
+				pod.Containers = append(pod.Containers, sources.ContainerMetricsPoint{Name: "a-sidecar", MetricsPoint: sources.MetricsPoint{Timestamp: sampleTime}})
+			}
+			Expect(metricSink.Receive(batch)).To(Succeed())
+		})
+
+		list := func(ctx context.Context, options *metainternalversion.ListOptions) (*metrics.PodMetricsList, error) {
+			obj, err := storage.List(ctx, options)
+			if err != nil {
+				return nil, err
+			}
+			return obj.(*metrics.PodMetricsList), nil
+		}
+
+		It("should serve each pod's containers sorted by name", func() {
+			obj, err := storage.Get(ctx, "pod0", &metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			containers := obj.(*metrics.PodMetrics).Containers
+			Expect(containers).To(HaveLen(2))
+			Expect(containers[0].Name).To(Equal("a-sidecar"))
+			Expect(containers[1].Name).To(Equal("container1"))
+		})
+
+		It("should sort by name by default, and by usage, highest first, when asked", func() {
+			res, err := list(ctx, &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(res)).To(Equal([]string{"pod0", "pod1", "pod2", "pod3"}))
+
+			res, err = list(listing.WithSortBy(ctx, "cpu"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(res)).To(Equal([]string{"pod2", "pod0", "pod3", "pod1"}))
+
+			res, err = list(listing.WithSortBy(ctx, "memory"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(res)).To(Equal([]string{"pod1", "pod3", "pod2", "pod0"}))
+		})
+
+		It("should reject unknown sort keys as bad requests", func() {
+			_, err := list(listing.WithSortBy(ctx, "age"), &metainternalversion.ListOptions{})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+		})
+
+		It("should sort before paging, so that pages continue after the last item even if usage changes", func() {
+			sorted := listing.WithSortBy(ctx, "cpu")
+			first, err := list(sorted, &metainternalversion.ListOptions{Limit: 3})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(first)).To(Equal([]string{"pod2", "pod0", "pod3"}))
+			Expect(first.Continue).NotTo(BeEmpty())
+
+			By("committing a batch in which an already-listed pod jumps past the last one")
+			batch.Pods[1].Containers[0].CpuUsage = *resource.NewMilliQuantity(150, resource.DecimalSI)
+			batch.Pods[0].Containers[0].CpuUsage = *resource.NewMilliQuantity(50, resource.DecimalSI)
+			Expect(metricSink.Receive(batch)).To(Succeed())
+
+			By("checking that the next page starts after the last pod listed, without repeats")
+			second, err := list(sorted, &metainternalversion.ListOptions{Limit: 3, Continue: first.Continue})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(second)).To(Equal([]string{"pod1", "pod0"}))
+			Expect(second.Continue).To(BeEmpty())
+		})
+
+		It("should reject continue tokens from lists in a different order, or that aren't tokens at all", func() {
+			first, err := list(listing.WithSortBy(ctx, "memory"), &metainternalversion.ListOptions{Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = list(listing.WithSortBy(ctx, "cpu"), &metainternalversion.ListOptions{Limit: 2, Continue: first.Continue})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+			_, err = list(ctx, &metainternalversion.ListOptions{Limit: 2, Continue: first.Continue})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+			_, err = list(ctx, &metainternalversion.ListOptions{Limit: 2, Continue: "not-a-token"})
+			Expect(apierrors.IsBadRequest(err)).To(BeTrue())
+		})
+
+		It("should page named pods in the order requested, unless sorted explicitly", func() {
+			named := WithNames(ctx, "pod3,pod1,pod2")
+			first, err := list(named, &metainternalversion.ListOptions{Limit: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(first)).To(Equal([]string{"pod3", "pod1"}))
+			second, err := list(named, &metainternalversion.ListOptions{Limit: 2, Continue: first.Continue})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(second)).To(Equal([]string{"pod2"}))
+
+			res, err := list(listing.WithSortBy(named, "name"), &metainternalversion.ListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itemNames(res)).To(Equal([]string{"pod1", "pod2", "pod3"}))
+		})
+	})
+
+	It("should pass the names query parameter through to the storage", func() {
+		var list interface{}
+		var listErr error
+		handler := WithNamesParam(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+			list, listErr = storage.List(genericapirequest.WithNamespace(req.Context(), "ns1"), &metainternalversion.ListOptions{})
+		}))
+		req := httptest.NewRequest("GET", "/apis/metrics.k8s.io/v1beta1/namespaces/ns1/pods?"+NamesParam+"=pod2,pod0", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(listErr).NotTo(HaveOccurred())
+		Expect(itemNames(list)).To(Equal([]string{"pod2", "pod0"}))
+	})
+})
@@ -0,0 +1,279 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuning
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// DefaultPollInterval is how often the config file is checked for changes.
+const DefaultPollInterval = 10 * time.Second
+
+// MinMetricResolution is the shortest metric resolution supported.
+const MinMetricResolution = time.Second
+
+// DefaultHousekeepingInterval is the default interval at which the Kubelets'
+// cAdvisor refreshes container stats (the Kubelet's --housekeeping-interval).
+const DefaultHousekeepingInterval = 10 * time.Second
+
+// scrapeTimeoutFraction is the fraction of the resolution used as the scrape
+// timeout, unless one is given explicitly.
+const scrapeTimeoutFraction = 0.90
+
+var (
+	configGeneration = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "metrics_server",
+			Subsystem: "config",
+			Name:      "generation",
+			Help:      "The generation of the reloadable config in effect, counting from 1 for the config loaded at startup",
+		},
+	)
+	configReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "config",
+			Name:      "reloads_total",
+			Help:      "The number of changes to the reloadable config file seen, by whether they were accepted or rejected",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(configGeneration)
+	prometheus.MustRegister(configReloadsTotal)
+}
+
+// Config holds the scrape and storage parameters which can be reloaded from a file
+// without restarting.  These are the only reloadable parameters: everything else is
+// fixed by the flags at startup.
+type Config struct {
+	// MetricResolution is the interval between collection cycles.
+	MetricResolution time.Duration
+	// ScrapeTimeout is how long each cycle's scrapes may take.
+	ScrapeTimeout time.Duration
+	// StorageMemoryLimitBytes is the soft limit on the estimated memory used
+	// to store metrics, with zero meaning no limit.
+	StorageMemoryLimitBytes int64
+}
+
+// ScrapeTimeoutFor returns the default scrape timeout for the given resolution.
+func ScrapeTimeoutFor(resolution time.Duration) time.Duration {
+	return time.Duration(float64(resolution) * scrapeTimeoutFraction)
+}
+
+// Validate checks that the parameters make sense together.
+func (c Config) Validate() error {
+	if c.MetricResolution <= 0 {
+		return fmt.Errorf("metric resolution must be positive, not %s", c.MetricResolution)
+	}
+	if c.ScrapeTimeout <= 0 || c.ScrapeTimeout > c.MetricResolution {
+		return fmt.Errorf("scrape timeout (%s) must be positive, and no longer than the metric resolution (%s)", c.ScrapeTimeout, c.MetricResolution)
+	}
+	if c.StorageMemoryLimitBytes < 0 {
+		return fmt.Errorf("storage memory limit must not be negative, not %d", c.StorageMemoryLimitBytes)
+	}
+	return nil
+}
+
+// CheckResolution checks that the given metric resolution is supported, and that it isn't
+// shorter than the given cAdvisor housekeeping interval, unless forced to be.
+func CheckResolution(resolution, housekeeping time.Duration, force bool) error {
+	if resolution < MinMetricResolution {
+		return fmt.Errorf("metric resolution (%s) must be at least %s", resolution, MinMetricResolution)
+	}
+	if resolution < housekeeping && !force {
+		return fmt.Errorf("metric resolution (%s) is shorter than the Kubelets' cAdvisor housekeeping interval (%s): cAdvisor only refreshes container stats once per housekeeping interval, so most scrapes would just return the same stats again, at extra cost to the Kubelets.  Shorten the Kubelets' --housekeeping-interval and set --kubelet-housekeeping-interval to match, or set --force-metric-resolution to scrape this often anyway", resolution, housekeeping)
+	}
+	return nil
+}
+
+// file is the format of the config file, in YAML or JSON.  Parameters left out of
+// the file keep the values given by the flags, except that the scrape timeout
+// follows the resolution unless given explicitly.
+type file struct {
+	MetricResolution        *metav1.Duration `json:"metricResolution,omitempty"`
+	ScrapeTimeout           *metav1.Duration `json:"scrapeTimeout,omitempty"`
+	StorageMemoryLimitBytes *int64           `json:"storageMemoryLimitBytes,omitempty"`
+}
+
+// Parse parses the given config file contents, filling in any parameters left out of
+// it from the given base config.  Unknown (and so non-reloadable) parameters are rejected.
+func Parse(contents []byte, base Config) (Config, error) {
+	raw, err := yaml.YAMLToJSON(contents)
+	if err != nil {
+		return Config{}, fmt.Errorf("unable to parse config: %v", err)
+	}
+	var parsed file
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&parsed); err != nil {
+		return Config{}, fmt.Errorf("unable to parse config: %v", err)
+	}
+
+	cfg := base
+	if parsed.MetricResolution != nil {
+		cfg.MetricResolution = parsed.MetricResolution.Duration
+	}
+	cfg.ScrapeTimeout = ScrapeTimeoutFor(cfg.MetricResolution)
+	if parsed.ScrapeTimeout != nil {
+		cfg.ScrapeTimeout = parsed.ScrapeTimeout.Duration
+	}
+	if parsed.StorageMemoryLimitBytes != nil {
+		cfg.StorageMemoryLimitBytes = *parsed.StorageMemoryLimitBytes
+	}
+	return cfg, nil
+}
+
+// Watcher watches a config file for changes to the reloadable parameters, keeping the
+// last valid config when the file is changed to an invalid one.  Changes are held until
+// collected with Next, so that they can be applied together between collection cycles.
+type Watcher struct {
+	path     string
+	base     Config
+	validate func(Config) error
+	clock    clock.Clock
+
+	mu sync.Mutex
+	// contents are the file contents last seen, valid or not, so that
+	// invalid contents are only reported once.
+	contents []byte
+	current  Config
+	// generation is the generation of current.
+	generation int64
+	pending    bool
+}
+
+// NewWatcher loads the config from the given file, filling in any parameters left out of it
+// from the given base config, and checking it with the given validation function (which may
+// be nil) as well as Config.Validate.  It fails if the initial config isn't valid.
+func NewWatcher(path string, base Config, validate func(Config) error) (*Watcher, error) {
+	return NewWatcherWithClock(path, base, validate, clock.RealClock{})
+}
+
+// NewWatcherWithClock is like NewWatcher, but uses the given clock to schedule checks of the file.
+func NewWatcherWithClock(path string, base Config, validate func(Config) error, clk clock.Clock) (*Watcher, error) {
+	w := &Watcher{path: path, base: base, validate: validate, clock: clk}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file %q: %v", path, err)
+	}
+	cfg, err := w.load(contents)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %q: %v", path, err)
+	}
+	w.contents, w.current, w.generation = contents, cfg, 1
+	configGeneration.Set(1)
+	return w, nil
+}
+
+// Current returns the most recently loaded valid config, which
+// won't have taken effect yet if it's still to be collected with Next.
+func (w *Watcher) Current() Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// RunUntil checks the file for changes every DefaultPollInterval until the given channel is closed.
+func (w *Watcher) RunUntil(stopCh <-chan struct{}) {
+	go func() {
+		ticker := w.clock.NewTicker(DefaultPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				w.Reload()
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// Reload checks the file for changes, holding any valid new config until the next call to Next.
+// Invalid configs are logged and rejected, leaving the previous config in effect.
+func (w *Watcher) Reload() {
+	contents, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		// the file may be mid-update (e.g. a ConfigMap's symlinks being swapped), so try again next time
+		glog.Warningf("unable to read config file %q, keeping the current config: %v", w.path, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if bytes.Equal(contents, w.contents) {
+		return
+	}
+	w.contents = contents
+
+	cfg, err := w.load(contents)
+	if err != nil {
+		configReloadsTotal.WithLabelValues("rejected").Inc()
+		glog.Errorf("rejecting the changes to config file %q, keeping generation %d in effect: %v", w.path, w.generation, err)
+		return
+	}
+	configReloadsTotal.WithLabelValues("accepted").Inc()
+	if cfg == w.current {
+		return
+	}
+	w.current = cfg
+	w.generation++
+	w.pending = true
+	glog.Infof("loaded generation %d of config file %q, which will take effect at the next collection cycle: %+v", w.generation, w.path, cfg)
+}
+
+// Next returns the new config, if the file has changed since the last call, marking it as in
+// effect.  The caller must apply all of it before the next collection cycle starts.
+func (w *Watcher) Next() (Config, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.pending {
+		return Config{}, false
+	}
+	w.pending = false
+	configGeneration.Set(float64(w.generation))
+	return w.current, true
+}
+
+// load parses and validates the given file contents.
+func (w *Watcher) load(contents []byte) (Config, error) {
+	cfg, err := Parse(contents, w.base)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	if w.validate != nil {
+		if err := w.validate(cfg); err != nil {
+			return Config{}, err
+		}
+	}
+	return cfg, nil
+}
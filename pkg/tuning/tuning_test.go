@@ -0,0 +1,185 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tuning_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+
+	. "github.com/kubernetes-incubator/metrics-server/pkg/tuning"
+)
+
+func TestTuning(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Reloadable Config Suite")
+}
+
+var base = Config{
+	MetricResolution:        time.Minute,
+	ScrapeTimeout:           54 * time.Second,
+	StorageMemoryLimitBytes: 1000,
+}
+
+// generation returns the current value of the config generation gauge.
+func generation() float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	for _, family := range families {
+		if family.GetName() == "metrics_server_config_generation" {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	Fail("no config generation gauge found")
+	return 0
+}
+
+var _ = Describe("Reloadable Config", func() {
+	Describe("parsing", func() {
+		It("should fill in parameters left out of the file from the base config", func() {
+			cfg, err := Parse([]byte("storageMemoryLimitBytes: 500\n"), base)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(Config{MetricResolution: time.Minute, ScrapeTimeout: 54 * time.Second, StorageMemoryLimitBytes: 500}))
+		})
+
+		It("should make the scrape timeout follow the resolution unless given explicitly", func() {
+			cfg, err := Parse([]byte("metricResolution: 30s\n"), base)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.ScrapeTimeout).To(Equal(27 * time.Second))
+
+			cfg, err = Parse([]byte(`{"metricResolution": "30s", "scrapeTimeout": "10s"}`), base)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.ScrapeTimeout).To(Equal(10 * time.Second))
+		})
+
+		It("should reject parameters which aren't reloadable", func() {
+			_, err := Parse([]byte("metricResolution: 30s\nkubeletPort: 10250\n"), base)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("kubeletPort"))
+		})
+
+		It("should reject scrape timeouts longer than the resolution", func() {
+			cfg, err := Parse([]byte("metricResolution: 30s\nscrapeTimeout: 40s\n"), base)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+	})
+
+	Describe("checking the resolution", func() {
+		It("should refuse resolutions below the housekeeping interval unless forced", func() {
+			Expect(CheckResolution(10*time.Second, DefaultHousekeepingInterval, false)).To(Succeed())
+
+			err := CheckResolution(time.Second, DefaultHousekeepingInterval, false)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("--force-metric-resolution"))
+
+			Expect(CheckResolution(time.Second, DefaultHousekeepingInterval, true)).To(Succeed())
+			Expect(CheckResolution(time.Second, time.Second, false)).To(Succeed())
+		})
+
+		It("should refuse sub-second resolutions, even when forced", func() {
+			Expect(CheckResolution(500*time.Millisecond, 0, true)).NotTo(Succeed())
+		})
+	})
+
+	Describe("watching a file", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		writeConfig := func(contents string) {
+			Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "tuning")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(dir, "config.yaml")
+			writeConfig("metricResolution: 30s\n")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should start with the file's config, as generation 1", func() {
+			watcher, err := NewWatcher(path, base, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(watcher.Current().MetricResolution).To(Equal(30 * time.Second))
+			Expect(generation()).To(Equal(float64(1)))
+			_, changed := watcher.Next()
+			Expect(changed).To(BeFalse())
+		})
+
+		It("should refuse to start with an invalid config", func() {
+			writeConfig("metricResolution: -30s\n")
+			_, err := NewWatcher(path, base, nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should hold changes until they're collected, marking them as in effect", func() {
+			watcher, err := NewWatcher(path, base, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			writeConfig("metricResolution: 20s\n")
+			watcher.Reload()
+			Expect(generation()).To(Equal(float64(1)))
+
+			cfg, changed := watcher.Next()
+			Expect(changed).To(BeTrue())
+			Expect(cfg.MetricResolution).To(Equal(20 * time.Second))
+			Expect(generation()).To(Equal(float64(2)))
+
+			By("not returning the same change twice")
+			watcher.Reload()
+			_, changed = watcher.Next()
+			Expect(changed).To(BeFalse())
+		})
+
+		It("should reject invalid changes, keeping the previous config", func() {
+			watcher, err := NewWatcher(path, base, func(cfg Config) error {
+				if cfg.MetricResolution < 15*time.Second {
+					return fmt.Errorf("too short")
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, contents := range []string{"metricResolution: 10s\n", "metricResolution: [\n", "scrapeTimeout: 2m\n"} {
+				writeConfig(contents)
+				watcher.Reload()
+				_, changed := watcher.Next()
+				Expect(changed).To(BeFalse(), "config %q should have been rejected", contents)
+				Expect(watcher.Current().MetricResolution).To(Equal(30 * time.Second))
+			}
+
+			By("accepting a valid change afterwards")
+			writeConfig("metricResolution: 15s\n")
+			watcher.Reload()
+			cfg, changed := watcher.Next()
+			Expect(changed).To(BeTrue())
+			Expect(cfg.MetricResolution).To(Equal(15 * time.Second))
+		})
+	})
+})
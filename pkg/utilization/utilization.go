@@ -0,0 +1,218 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package utilization tracks the distribution of pods' CPU and memory usage relative to their
+// requests, as of each committed batch, for right-sizing tools, which otherwise recompute it
+// from the raw metrics and pod objects themselves.  Nothing served by the metrics API changes.
+package utilization
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/podcount"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+)
+
+// RatioBuckets are the buckets of the utilization ratios: each a factor of two above the last,
+// from 1/64th of the request up to 64 times it.
+var RatioBuckets = prometheus.ExponentialBuckets(1.0/64, 2, 13)
+
+// Resources are the resources whose utilization is tracked.
+var Resources = []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory}
+
+var (
+	utilizationRatio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "metrics_server",
+			Subsystem: "pod_utilization",
+			Name:      "ratio",
+			Help:      "The usage of each pod with metrics in each committed batch relative to its requests, summed over its containers, by resource",
+			Buckets:   RatioBuckets,
+		},
+		[]string{"resource"},
+	)
+	unrequestedPods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "pod_utilization",
+			Name:      "unrequested_total",
+			Help:      "The number of pods with metrics in each committed batch without any requests for the resource, so without a utilization ratio, by resource",
+		},
+		[]string{"resource"},
+	)
+	namespaceUtilizationRatio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "metrics_server",
+			Subsystem: "pod_utilization",
+			Name:      "namespace_ratio",
+			Help:      "As metrics_server_pod_utilization_ratio, for the namespaces given their own series, and the rest together as \"" + podcount.OtherNamespaces + "\"",
+			Buckets:   RatioBuckets,
+		},
+		[]string{"resource", "namespace"},
+	)
+	namespaceUnrequestedPods = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "metrics_server",
+			Subsystem: "pod_utilization",
+			Name:      "namespace_unrequested_total",
+			Help:      "As metrics_server_pod_utilization_unrequested_total, for the namespaces given their own series, and the rest together as \"" + podcount.OtherNamespaces + "\"",
+		},
+		[]string{"resource", "namespace"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(utilizationRatio)
+	prometheus.MustRegister(unrequestedPods)
+	prometheus.MustRegister(namespaceUtilizationRatio)
+	prometheus.MustRegister(namespaceUnrequestedPods)
+}
+
+// Tracker observes the utilization of the pods of each committed batch, looking up
+// their requests with a pod lister.
+//
+// With a per-namespace breakdown, up to topN namespaces have their own series, and the rest
+// are counted together, bounding the cardinality.  Since the histograms are cumulative,
+// namespaces keep their series for as long as they have pods with metrics, with any freed up
+// going to the namespaces with the most pods which don't have their own yet.
+type Tracker struct {
+	topN int
+	pods v1listers.PodLister
+
+	mu sync.Mutex
+	// namespaces are the namespaces currently given their own series.
+	namespaces map[string]struct{}
+}
+
+var _ sink.PodUsageObserver = &Tracker{}
+
+// NewTracker constructs a new tracker looking up requests with the given pod lister, giving
+// up to topN namespaces their own series, or none, if it's zero.
+func NewTracker(topN int, pods v1listers.PodLister) *Tracker {
+	return &Tracker{topN: topN, pods: pods, namespaces: make(map[string]struct{})}
+}
+
+// PodUsageCommitted observes the utilization of each pod just committed.
+func (t *Tracker) PodUsageCommitted(usage map[apitypes.NamespacedName]corev1.ResourceList) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.topN > 0 {
+		t.assignNamespaces(usage)
+	}
+
+	for podIdent, podUsage := range usage {
+		pod, err := t.pods.Pods(podIdent.Namespace).Get(podIdent.Name)
+		if err != nil {
+			// without a pod object (e.g. if it's just been deleted), its requests aren't known
+			continue
+		}
+		requests := Requests(pod)
+		namespace := podcount.OtherNamespaces
+		if _, ok := t.namespaces[podIdent.Namespace]; ok {
+			namespace = podIdent.Namespace
+		}
+		for _, resourceName := range Resources {
+			ratio, requested := Ratio(podUsage, requests, resourceName)
+			if !requested {
+				unrequestedPods.WithLabelValues(string(resourceName)).Inc()
+				if t.topN > 0 {
+					namespaceUnrequestedPods.WithLabelValues(string(resourceName), namespace).Inc()
+				}
+				continue
+			}
+			utilizationRatio.WithLabelValues(string(resourceName)).Observe(ratio)
+			if t.topN > 0 {
+				namespaceUtilizationRatio.WithLabelValues(string(resourceName), namespace).Observe(ratio)
+			}
+		}
+	}
+}
+
+// assignNamespaces frees the series of namespaces without any pods in the given usage, and
+// then gives any free series to the namespaces with the most pods which don't have their own.
+func (t *Tracker) assignNamespaces(usage map[apitypes.NamespacedName]corev1.ResourceList) {
+	counts := make(map[string]int)
+	for podIdent := range usage {
+		counts[podIdent.Namespace]++
+	}
+	for namespace := range t.namespaces {
+		if counts[namespace] > 0 {
+			continue
+		}
+		delete(t.namespaces, namespace)
+		for _, resourceName := range Resources {
+			namespaceUtilizationRatio.DeleteLabelValues(string(resourceName), namespace)
+			namespaceUnrequestedPods.DeleteLabelValues(string(resourceName), namespace)
+		}
+	}
+	if len(t.namespaces) >= t.topN {
+		return
+	}
+
+	var candidates []string
+	for namespace := range counts {
+		if _, ok := t.namespaces[namespace]; !ok {
+			candidates = append(candidates, namespace)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if counts[candidates[i]] != counts[candidates[j]] {
+			return counts[candidates[i]] > counts[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+	for _, namespace := range candidates {
+		if len(t.namespaces) >= t.topN {
+			break
+		}
+		t.namespaces[namespace] = struct{}{}
+	}
+}
+
+// Requests sums the CPU and memory requests of the given pod's containers.
+func Requests(pod *corev1.Pod) corev1.ResourceList {
+	res := corev1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		for _, resourceName := range Resources {
+			request, ok := container.Resources.Requests[resourceName]
+			if !ok {
+				continue
+			}
+			total := res[resourceName]
+			total.Add(request)
+			res[resourceName] = total
+		}
+	}
+	return res
+}
+
+// Ratio returns the given usage of the given resource relative to the given requests for it,
+// and whether there were any requests for it, since otherwise there's no ratio.
+func Ratio(usage, requests corev1.ResourceList, resourceName corev1.ResourceName) (float64, bool) {
+	request, ok := requests[resourceName]
+	if !ok || request.Sign() <= 0 {
+		return 0, false
+	}
+	used := usage[resourceName]
+	if resourceName == corev1.ResourceCPU {
+		return float64(used.MilliValue()) / float64(request.MilliValue()), true
+	}
+	return float64(used.Value()) / float64(request.Value()), true
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utilization_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/kubernetes-incubator/metrics-server/pkg/podcount"
+	provsink "github.com/kubernetes-incubator/metrics-server/pkg/provider/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sink"
+	"github.com/kubernetes-incubator/metrics-server/pkg/sources"
+	. "github.com/kubernetes-incubator/metrics-server/pkg/utilization"
+)
+
+func TestUtilization(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Utilization Suite")
+}
+
+// observations fetches the number of observations in each bucket (by upper bound, where the
+// last is +Inf) of the given histogram with the given labels, or the value of the given counter.
+func observations(name string, labels map[string]string) map[float64]uint64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).NotTo(HaveOccurred())
+	res := make(map[float64]uint64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if !hasLabels(metric, labels) {
+				continue
+			}
+			if metric.GetCounter() != nil {
+				res[0] = uint64(metric.GetCounter().GetValue())
+				continue
+			}
+			var below uint64
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				res[bucket.GetUpperBound()] = bucket.GetCumulativeCount() - below
+				below = bucket.GetCumulativeCount()
+			}
+			res[-1] = metric.GetHistogram().GetSampleCount() - below
+		}
+	}
+	return res
+}
+
+func hasLabels(metric *dto.Metric, labels map[string]string) bool {
+	matched := 0
+	for _, label := range metric.GetLabel() {
+		if val, ok := labels[label.GetName()]; ok && val == label.GetValue() {
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
+
+// newObservations returns the observations made since the given ones.
+func newObservations(before, after map[float64]uint64) map[float64]uint64 {
+	res := make(map[float64]uint64)
+	for bound, count := range after {
+		if count > before[bound] {
+			res[bound] = count - before[bound]
+		}
+	}
+	return res
+}
+
+// podWithRequests returns a pod with a container for each of the given CPU and memory
+// requests, where empty requests are left unset.
+func podWithRequests(namespace, name string, requests ...[2]string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	for _, request := range requests {
+		list := corev1.ResourceList{}
+		if request[0] != "" {
+			list[corev1.ResourceCPU] = resource.MustParse(request[0])
+		}
+		if request[1] != "" {
+			list[corev1.ResourceMemory] = resource.MustParse(request[1])
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Resources: corev1.ResourceRequirements{Requests: list}})
+	}
+	return pod
+}
+
+// usagePoint returns the metrics of a pod with a single container using the given CPU and memory.
+func usagePoint(namespace, name, cpu, memory string) sources.PodMetricsPoint {
+	return sources.PodMetricsPoint{Name: name, Namespace: namespace, Containers: []sources.ContainerMetricsPoint{
+		{Name: "main", MetricsPoint: sources.MetricsPoint{CpuUsage: resource.MustParse(cpu), MemoryUsage: resource.MustParse(memory)}},
+	}}
+}
+
+var _ = Describe("Pod utilization tracker", func() {
+	var (
+		indexer    cache.Indexer
+		metricSink sink.MetricSink
+	)
+
+	BeforeEach(func() {
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		metricSink, _ = provsink.NewSinkProvider()
+	})
+
+	observe := func(topN int) {
+		metricSink.(sink.PodUsageObservingSink).ObservePodUsage(NewTracker(topN, v1listers.NewPodLister(indexer)))
+	}
+
+	It("should assign pods to the buckets of their usage relative to the requests summed over their containers", func() {
+		observe(0)
+		// 150m of 2x100m, and 4Gi of 1Gi
+		Expect(indexer.Add(podWithRequests("ns1", "over", [2]string{"100m", "1Gi"}, [2]string{"100m", ""}))).To(Succeed())
+		// 10m of 1 core, and 100Mi of 1Gi
+		Expect(indexer.Add(podWithRequests("ns1", "idle", [2]string{"1", "1Gi"}))).To(Succeed())
+		cpuBefore := observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "cpu"})
+		memoryBefore := observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "memory"})
+
+		Expect(metricSink.Receive(&sources.MetricsBatch{Pods: []sources.PodMetricsPoint{
+			usagePoint("ns1", "over", "150m", "4Gi"),
+			usagePoint("ns1", "idle", "10m", "100Mi"),
+		}})).To(Succeed())
+
+		// 0.75 falls in (0.5, 1], and 0.01 in (0, 0.015625]
+		Expect(newObservations(cpuBefore, observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "cpu"}))).To(Equal(map[float64]uint64{
+			1: 1, 1.0 / 64: 1,
+		}))
+		// 4 falls in (2, 4], and 0.098 in (0.0625, 0.125]
+		Expect(newObservations(memoryBefore, observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "memory"}))).To(Equal(map[float64]uint64{
+			4: 1, 0.125: 1,
+		}))
+	})
+
+	It("should count pods without requests separately, and leave out pods without objects", func() {
+		observe(0)
+		Expect(indexer.Add(podWithRequests("ns1", "best-effort", [2]string{"", ""}))).To(Succeed())
+		Expect(indexer.Add(podWithRequests("ns1", "cpu-only", [2]string{"100m", ""}))).To(Succeed())
+		cpuBefore := observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "cpu"})
+		unrequestedCPUBefore := observations("metrics_server_pod_utilization_unrequested_total", map[string]string{"resource": "cpu"})
+		unrequestedMemoryBefore := observations("metrics_server_pod_utilization_unrequested_total", map[string]string{"resource": "memory"})
+
+		Expect(metricSink.Receive(&sources.MetricsBatch{Pods: []sources.PodMetricsPoint{
+			usagePoint("ns1", "best-effort", "100m", "100Mi"),
+			usagePoint("ns1", "cpu-only", "100m", "100Mi"),
+			usagePoint("ns1", "unmatched", "100m", "100Mi"),
+		}})).To(Succeed())
+
+		Expect(newObservations(cpuBefore, observations("metrics_server_pod_utilization_ratio", map[string]string{"resource": "cpu"}))).To(Equal(map[float64]uint64{1: 1}))
+		Expect(newObservations(unrequestedCPUBefore, observations("metrics_server_pod_utilization_unrequested_total", map[string]string{"resource": "cpu"}))).To(Equal(map[float64]uint64{0: 1}))
+		Expect(newObservations(unrequestedMemoryBefore, observations("metrics_server_pod_utilization_unrequested_total", map[string]string{"resource": "memory"}))).To(Equal(map[float64]uint64{0: 2}))
+	})
+
+	It("should break the ratios down by the namespaces with the most pods, counting the rest together", func() {
+		observe(1)
+		var batch sources.MetricsBatch
+		for _, pod := range []struct{ namespace, name string }{{"big", "a"}, {"big", "b"}, {"small", "c"}} {
+			Expect(indexer.Add(podWithRequests(pod.namespace, pod.name, [2]string{"100m", "100Mi"}))).To(Succeed())
+			batch.Pods = append(batch.Pods, usagePoint(pod.namespace, pod.name, "50m", "100Mi"))
+		}
+		bigBefore := observations("metrics_server_pod_utilization_namespace_ratio", map[string]string{"resource": "cpu", "namespace": "big"})
+		otherBefore := observations("metrics_server_pod_utilization_namespace_ratio", map[string]string{"resource": "cpu", "namespace": podcount.OtherNamespaces})
+
+		Expect(metricSink.Receive(&batch)).To(Succeed())
+
+		Expect(newObservations(bigBefore, observations("metrics_server_pod_utilization_namespace_ratio", map[string]string{"resource": "cpu", "namespace": "big"}))).To(Equal(map[float64]uint64{0.5: 2}))
+		Expect(newObservations(otherBefore, observations("metrics_server_pod_utilization_namespace_ratio", map[string]string{"resource": "cpu", "namespace": podcount.OtherNamespaces}))).To(Equal(map[float64]uint64{0.5: 1}))
+		Expect(observations("metrics_server_pod_utilization_namespace_ratio", map[string]string{"namespace": "small"})).To(BeEmpty())
+	})
+})